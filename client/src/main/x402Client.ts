@@ -33,6 +33,9 @@ interface PaymentRequirement {
   extra?: {
     name?: string
     version?: string
+    // Set when the gateway issues challenges: the nonce to sign,
+    // keccak256 of the challenge's bytes.
+    challengeNonce?: string
   }
 }
 
@@ -321,7 +324,7 @@ async function processRequest(
 
   const validAfter = 0n
   const validBefore = BigInt(Math.floor(Date.now() / 1000) + 300) // 5-min window
-  const nonce = toHex(crypto.getRandomValues(new Uint8Array(32)))
+  const nonce = req.extra?.challengeNonce ?? toHex(crypto.getRandomValues(new Uint8Array(32)))
   const domainName = req.extra?.name ?? 'USDC'
   const domainVersion = req.extra?.version ?? '2'
 
@@ -376,7 +379,8 @@ async function processRequest(
 
   setCachedToken(gatewayUrl, token)
   lastPaymentFailure.delete(gatewayUrl)
-  log({ ts: Date.now(), direction: 'in', message: `← token issued` })
+  const settlementTx = payResp.headers.get('X-Settlement-Tx')
+  log({ ts: Date.now(), direction: 'in', message: settlementTx ? `← token issued (settled in ${settlementTx})` : `← token issued` })
 
   // --- Execute original request with the new token ---
   const rpcResp = await gatewayFetch(endpoint, {
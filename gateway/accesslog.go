@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/ethdenver2026/gateway/proxy"
+	"github.com/ethdenver2026/gateway/x402"
+	"github.com/google/uuid"
+)
+
+// requestIDHeader carries the ID a request is logged under back to the
+// client, to quote when asking about it.
+const requestIDHeader = "X-Request-Id"
+
+// accessLog wraps next to log one line per request, for the share sample of
+// requests: its ID, the token it spent or the payer, the JSON-RPC methods,
+// the upstreams it went to, the credits left, the status and how long it
+// took. Every request gets an ID, logged or not.
+func accessLog(sample float64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := uuid.NewString()
+		w.Header().Set(requestIDHeader, id)
+		if sample < 1 && rand.Float64() >= sample {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		ctx, upstreams := proxy.TraceUpstreams(r.Context())
+		ctx, info := x402.TraceRequest(ctx)
+		rec := &accessWriter{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		req := info()
+		attrs := []any{
+			"request_id", id,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"latency_ms", float64(time.Since(start).Microseconds()) / 1000,
+		}
+		if len(req.Methods) > 0 {
+			attrs = append(attrs, "rpc_methods", req.Methods)
+		}
+		if req.TokenID != "" {
+			attrs = append(attrs, "tid", req.TokenID)
+		}
+		if req.Payer != "" {
+			attrs = append(attrs, "payer", req.Payer)
+		}
+		if hosts := upstreams(); len(hosts) > 0 {
+			attrs = append(attrs, "upstreams", hosts)
+		}
+		if req.Remaining >= 0 {
+			attrs = append(attrs, "credits_remaining", req.Remaining)
+		}
+		slog.Info("request", attrs...)
+	})
+}
+
+// accessWriter records the status of the response it writes.
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *accessWriter) WriteHeader(status int) {
+	if w.status == 0 && status >= http.StatusOK {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Hijack hands WebSocket upgrades the connection, which the WebSocket
+// library asks the writer for directly.
+func (w *accessWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *accessWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,778 @@
+// Package admin implements the gateway's authenticated operator API.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethdenver2026/gateway/proxy"
+	"github.com/ethdenver2026/gateway/x402"
+)
+
+// Config groups the dependencies of the admin API.
+type Config struct {
+	// Token is the shared secret operators present as
+	// "Authorization: Bearer <token>". Empty when ClientCerts alone
+	// authenticates operators; Token and ClientCerts must not both be unset.
+	Token string
+	// ClientCerts requires requests to come over TLS with a client
+	// certificate the listener verified (see LoadTLSConfig), besides Token
+	// when that is set.
+	ClientCerts bool
+	// Tokens is the batch token manager. Nil when payments are disabled, in
+	// which case the token endpoints answer 503.
+	Tokens *x402.TokenManager
+	// Settlements is the dead-letter list of settlements given up on. Nil
+	// when payments are disabled, in which case the settlement endpoints
+	// answer 503.
+	Settlements DeadSettlements
+	// Effective is the configuration the gateway runs with, secrets
+	// redacted, served as is.
+	Effective map[string]any
+	// Pricing is the gateway's pricing, changed at runtime through the
+	// pricing endpoints. Nil when payments are disabled, in which case they
+	// answer 503.
+	Pricing Pricing
+	// Usage reports what payers used and paid, from the token store. Nil
+	// when payments are disabled, in which case the report endpoints answer
+	// 503.
+	Usage UsageReports
+	// Events is the live event stream served to dashboards. Nil when
+	// payments are disabled, in which case the events endpoint answers 503.
+	Events *x402.EventStream
+	// Ledger is the double-entry ledger of payments and credits. Nil when it
+	// is not kept, in which case the ledger endpoints answer 503.
+	Ledger Ledger
+	// Reconciler reconciles the chain with the ledger daily. Nil when
+	// reconciliation is off, in which case its endpoint answers 503.
+	Reconciler Reconciliation
+	// Checks are the dependencies the health endpoint reports on, by name,
+	// each returning an error when the dependency is unusable.
+	Checks map[string]func() error
+	// Debug serves net/http/pprof profiles, goroutine dumps and the Go
+	// runtime's metrics under /admin/debug/.
+	Debug bool
+}
+
+// Reconciliation reports the last reconciliation of the chain with the
+// ledger, implemented by *x402.Reconciler.
+type Reconciliation interface {
+	LastReconciliation() *x402.ReconcileReport
+}
+
+// Ledger reads the ledger's balances and entries, implemented by the token
+// stores.
+type Ledger interface {
+	LedgerBalances(prefix string) ([]x402.LedgerBalance, error)
+	LedgerEntries(from, to time.Time) ([]x402.LedgerEntry, error)
+}
+
+// UsageReports totals usage and revenue over a window, implemented by the
+// token stores.
+type UsageReports interface {
+	UsageReport(from, to time.Time) (*x402.UsageReport, error)
+}
+
+// Pricing reads and replaces the pricing while serving, implemented by
+// *x402.Middleware.
+type Pricing interface {
+	Pricing() x402.Pricing
+	SetPricing(p x402.Pricing) error
+}
+
+// DeadSettlements is the dead-letter list of settlements whose retries ran
+// out, implemented by *x402.Middleware.
+type DeadSettlements interface {
+	DeadSettlements() ([]x402.PendingSettlement, error)
+	RetryDeadSettlement(id string) (bool, error)
+	DiscardDeadSettlement(id string) (bool, error)
+}
+
+// Handler serves the operator API under /admin/.
+type Handler struct {
+	cfg Config
+	mux *http.ServeMux
+}
+
+// New builds the admin API handler from cfg.
+func New(cfg Config) *Handler {
+	h := &Handler{cfg: cfg, mux: http.NewServeMux()}
+	h.mux.HandleFunc("GET /admin/tokens", h.listTokens)
+	h.mux.HandleFunc("GET /admin/tokens/{id}", h.inspectToken)
+	h.mux.HandleFunc("POST /admin/tokens/{id}/revoke", h.revokeToken)
+	h.mux.HandleFunc("POST /admin/tokens/{id}/credits", h.grantCredits)
+	h.mux.HandleFunc("GET /admin/settlements/dead", h.listDeadSettlements)
+	h.mux.HandleFunc("POST /admin/settlements/dead/{id}/retry", h.retryDeadSettlement)
+	h.mux.HandleFunc("DELETE /admin/settlements/dead/{id}", h.discardDeadSettlement)
+	h.mux.HandleFunc("GET /admin/metrics", h.metrics)
+	h.mux.HandleFunc("GET /admin/stats", h.stats)
+	h.mux.HandleFunc("GET /admin/events", h.events)
+	h.mux.HandleFunc("GET /admin/config", h.config)
+	h.mux.HandleFunc("GET /admin/pricing", h.getPricing)
+	h.mux.HandleFunc("PUT /admin/pricing", h.setPricing)
+	h.mux.HandleFunc("GET /admin/reports/usage", h.usageReport)
+	h.mux.HandleFunc("GET /admin/reports/revenue", h.usageReport)
+	h.mux.HandleFunc("GET /admin/ledger/balances", h.ledgerBalances)
+	h.mux.HandleFunc("GET /admin/ledger/entries", h.ledgerEntries)
+	h.mux.HandleFunc("GET /admin/reconciliation", h.reconciliation)
+	h.mux.HandleFunc("GET /admin/health", h.health)
+	if cfg.Debug {
+		h.registerDebug()
+	}
+	return h
+}
+
+// ServeHTTP authenticates the request and dispatches it to the matching route.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		if h.cfg.Token != "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		}
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+// authorized checks the client certificate and the bearer token, whichever
+// are configured, and refuses everyone when neither is. The token is
+// compared in constant time so response timing doesn't leak how much of a
+// guess was correct.
+func (h *Handler) authorized(r *http.Request) bool {
+	if h.cfg.Token == "" && !h.cfg.ClientCerts {
+		return false
+	}
+	if h.cfg.ClientCerts && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+		return false
+	}
+	if h.cfg.Token == "" {
+		return true
+	}
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(h.cfg.Token)) == 1
+}
+
+// listTokens handles GET /admin/tokens: the active tokens, newest first,
+// with the credits left on them. ?payer= selects a payer's tokens,
+// ?expires_after= and ?expires_before= (RFC 3339 or a date) their expiry,
+// ?min_remaining= and ?max_remaining= the credits left, ?all=true includes
+// expired and revoked tokens, and ?limit= caps the list (default and most
+// 1000).
+func (h *Handler) listTokens(w http.ResponseWriter, r *http.Request) {
+	if h.cfg.Tokens == nil {
+		writeError(w, http.StatusServiceUnavailable, "payments are disabled")
+		return
+	}
+	if !h.cfg.Tokens.Indexed() {
+		writeError(w, http.StatusServiceUnavailable, "the token store keeps no token index")
+		return
+	}
+	q := r.URL.Query()
+	query := x402.TokenQuery{Payer: q.Get("payer")}
+	var err error
+	if query.ExpiresAfter, err = reportTime(q.Get("expires_after"), time.Time{}); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid expires_after: "+err.Error())
+		return
+	}
+	if query.ExpiresBefore, err = reportTime(q.Get("expires_before"), time.Time{}); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid expires_before: "+err.Error())
+		return
+	}
+	for _, p := range []struct {
+		name string
+		dst  **int64
+	}{{"min_remaining", &query.MinRemaining}, {"max_remaining", &query.MaxRemaining}} {
+		if v := q.Get(p.name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid "+p.name+": "+err.Error())
+				return
+			}
+			*p.dst = &n
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if query.Limit, err = strconv.Atoi(v); err != nil || query.Limit <= 0 {
+			writeError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+	}
+	all := q.Get("all") == "true"
+
+	tokens, err := h.cfg.Tokens.FindTokens(query, all)
+	if err != nil {
+		slog.Error("admin: listing tokens failed", "err", err)
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"tokens": tokens,
+	})
+}
+
+// inspectToken handles GET /admin/tokens/{id}: what the token was issued
+// with and the state of its counter. {id} may also be an account ID
+// ("acct:0x…"), or a token issued before the index was kept, reported by
+// its counter alone.
+func (h *Handler) inspectToken(w http.ResponseWriter, r *http.Request) {
+	if h.cfg.Tokens == nil {
+		writeError(w, http.StatusServiceUnavailable, "payments are disabled")
+		return
+	}
+	id := r.PathValue("id")
+	t, err := h.cfg.Tokens.Inspect(id)
+	if err != nil {
+		if errors.Is(err, x402.ErrTokenNotFound) {
+			writeError(w, http.StatusNotFound, "token not found")
+			return
+		}
+		slog.Error("admin: inspecting token failed", "tid", id, "err", err)
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	writeJSON(w, http.StatusOK, t)
+}
+
+// grantCredits handles POST /admin/tokens/{id}/credits with a JSON body
+// {"credits": n, "reason": "..."}: n free credits for the token, or for
+// every token of an account ID ("acct:0x…"). The grant and its reason go
+// to the audit log and, as credits_granted, to the ledger.
+func (h *Handler) grantCredits(w http.ResponseWriter, r *http.Request) {
+	if h.cfg.Tokens == nil {
+		writeError(w, http.StatusServiceUnavailable, "payments are disabled")
+		return
+	}
+	var req struct {
+		Credits int64  `json:"credits"`
+		Reason  string `json:"reason"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	if req.Credits <= 0 {
+		writeError(w, http.StatusBadRequest, "credits must be positive")
+		return
+	}
+	id := r.PathValue("id")
+	remaining, err := h.cfg.Tokens.GrantCredits(id, req.Credits, "admin ("+r.RemoteAddr+")", req.Reason)
+	switch {
+	case errors.Is(err, x402.ErrTokenNotFound):
+		writeError(w, http.StatusNotFound, "token not found")
+		return
+	case errors.Is(err, x402.ErrTokenRevoked):
+		writeError(w, http.StatusConflict, "token revoked")
+		return
+	case errors.Is(err, x402.ErrTokenMetered):
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		slog.Error("admin: granting credits failed", "tid", id, "err", err)
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	slog.Info("admin: credits granted", "tid", id, "credits", req.Credits, "reason", req.Reason)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"token_id":  id,
+		"granted":   req.Credits,
+		"remaining": remaining,
+	})
+}
+
+// revokeToken handles POST /admin/tokens/{id}/revoke. {id} is a token ID, which
+// in account credit mode disables that token alone, or an account ID
+// ("acct:0x…") to disable all of a payer's tokens.
+func (h *Handler) revokeToken(w http.ResponseWriter, r *http.Request) {
+	if h.cfg.Tokens == nil {
+		writeError(w, http.StatusServiceUnavailable, "payments are disabled")
+		return
+	}
+	id := r.PathValue("id")
+	if err := h.cfg.Tokens.RevokeAs(id, "admin ("+r.RemoteAddr+")"); err != nil {
+		if errors.Is(err, x402.ErrTokenNotFound) {
+			writeError(w, http.StatusNotFound, "token not found")
+			return
+		}
+		slog.Error("admin: revoke failed", "tid", id, "err", err)
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	slog.Info("admin: token revoked", "tid", id)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"token_id": id,
+		"revoked":  true,
+	})
+}
+
+// listDeadSettlements handles GET /admin/settlements/dead: the settlements
+// given up on, oldest first, with their last error. Payments marked unissued
+// have no working token; one is issued if a retry settles them.
+func (h *Handler) listDeadSettlements(w http.ResponseWriter, r *http.Request) {
+	if h.cfg.Settlements == nil {
+		writeError(w, http.StatusServiceUnavailable, "payments are disabled")
+		return
+	}
+	dead, err := h.cfg.Settlements.DeadSettlements()
+	if err != nil {
+		slog.Error("admin: listing dead settlements failed", "err", err)
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if dead == nil {
+		dead = []x402.PendingSettlement{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"settlements": dead,
+	})
+}
+
+// retryDeadSettlement handles POST /admin/settlements/dead/{id}/retry,
+// queueing the settlement for a fresh round of attempts. Check the chain
+// first: a settlement reported failed may have landed after all, in which
+// case the retry reverts.
+func (h *Handler) retryDeadSettlement(w http.ResponseWriter, r *http.Request) {
+	if h.cfg.Settlements == nil {
+		writeError(w, http.StatusServiceUnavailable, "payments are disabled")
+		return
+	}
+	id := r.PathValue("id")
+	ok, err := h.cfg.Settlements.RetryDeadSettlement(id)
+	if err != nil {
+		slog.Error("admin: retrying dead settlement failed", "id", id, "err", err)
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "settlement not found")
+		return
+	}
+	slog.Info("admin: dead settlement queued for retry", "id", id)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":     id,
+		"queued": true,
+	})
+}
+
+// discardDeadSettlement handles DELETE /admin/settlements/dead/{id}, for a
+// settlement resolved by other means.
+func (h *Handler) discardDeadSettlement(w http.ResponseWriter, r *http.Request) {
+	if h.cfg.Settlements == nil {
+		writeError(w, http.StatusServiceUnavailable, "payments are disabled")
+		return
+	}
+	id := r.PathValue("id")
+	ok, err := h.cfg.Settlements.DiscardDeadSettlement(id)
+	if err != nil {
+		slog.Error("admin: discarding dead settlement failed", "id", id, "err", err)
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "settlement not found")
+		return
+	}
+	slog.Info("admin: dead settlement discarded", "id", id)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":        id,
+		"discarded": true,
+	})
+}
+
+// metrics handles GET /admin/metrics: the facilitator call, revenue and RPC
+// quorum metrics in the Prometheus text format, for a scraper configured
+// with the admin token.
+func (h *Handler) metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := x402.WriteMetrics(w); err != nil {
+		slog.Warn("admin: writing metrics failed", "err", err)
+		return
+	}
+	if err := x402.WriteRevenueMetrics(w); err != nil {
+		slog.Warn("admin: writing metrics failed", "err", err)
+		return
+	}
+	if err := proxy.WriteQuorumMetrics(w); err != nil {
+		slog.Warn("admin: writing metrics failed", "err", err)
+	}
+}
+
+// stats handles GET /admin/stats: what the gateway was paid since it
+// started, per asset and per payer, its settlements by outcome and its
+// relayers' gas spend.
+func (h *Handler) stats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, x402.RevenueStats())
+}
+
+// eventBuffer is how many events a dashboard may fall behind by before it
+// misses some.
+const eventBuffer = 256
+
+// eventKeepAlive is how often an idle event stream sends a comment, so
+// proxies do not time the connection out.
+const eventKeepAlive = 15 * time.Second
+
+// events handles GET /admin/events: a server-sent event stream of payment,
+// settlement and token events, the credits each request spends and the
+// request rate every second, each event named for its type with its JSON
+// as data. types=a,b limits the stream to those event types.
+func (h *Handler) events(w http.ResponseWriter, r *http.Request) {
+	if h.cfg.Events == nil {
+		writeError(w, http.StatusServiceUnavailable, "payments are disabled")
+		return
+	}
+	var types map[string]bool
+	if q := r.URL.Query().Get("types"); q != "" {
+		types = make(map[string]bool)
+		for _, t := range strings.Split(q, ",") {
+			types[strings.TrimSpace(t)] = true
+		}
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	events, unsubscribe := h.cfg.Events.Subscribe(eventBuffer)
+	defer unsubscribe()
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if types != nil && !types[ev.Type] {
+				continue
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				slog.Warn("admin: encoding event failed", "type", ev.Type, "err", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// config handles GET /admin/config: the effective configuration, with
+// secrets redacted.
+func (h *Handler) config(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.cfg.Effective)
+}
+
+// pricingView is the pricing as the pricing endpoints show it, in the terms
+// of PRICE_PER_REQUEST and MAX_AMOUNT_REQUIRED.
+type pricingView struct {
+	PricePerRequest    int64            `json:"pricePerRequest"`
+	MaxAmountRequired  int64            `json:"maxAmountRequired"`
+	RequestsPerPayment int64            `json:"requestsPerPayment"`
+	MethodCosts        map[string]int64 `json:"methodCosts"`
+	Tiered             bool             `json:"tiered"`
+}
+
+func newPricingView(p x402.Pricing) pricingView {
+	if p.MethodCosts == nil {
+		p.MethodCosts = map[string]int64{}
+	}
+	return pricingView{
+		PricePerRequest:    p.MaxAmountRequired / p.RequestsPerPayment,
+		MaxAmountRequired:  p.MaxAmountRequired,
+		RequestsPerPayment: p.RequestsPerPayment,
+		MethodCosts:        p.MethodCosts,
+		Tiered:             p.Tiered,
+	}
+}
+
+// getPricing handles GET /admin/pricing: the current pack price and method
+// costs.
+func (h *Handler) getPricing(w http.ResponseWriter, r *http.Request) {
+	if h.cfg.Pricing == nil {
+		writeError(w, http.StatusServiceUnavailable, "payments are disabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, newPricingView(h.cfg.Pricing.Pricing()))
+}
+
+// setPricing handles PUT /admin/pricing with a JSON body of pricePerRequest,
+// maxAmountRequired and methodCosts, each optional: an omitted field keeps
+// its value, and methodCosts replaces the whole table ({} clears it). The
+// 402 payload is rebuilt at once; issued tokens keep their credits. The
+// change lasts until the gateway restarts with its configured prices.
+func (h *Handler) setPricing(w http.ResponseWriter, r *http.Request) {
+	if h.cfg.Pricing == nil {
+		writeError(w, http.StatusServiceUnavailable, "payments are disabled")
+		return
+	}
+	var req struct {
+		PricePerRequest   *int64           `json:"pricePerRequest"`
+		MaxAmountRequired *int64           `json:"maxAmountRequired"`
+		MethodCosts       map[string]int64 `json:"methodCosts"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+
+	p := h.cfg.Pricing.Pricing()
+	if p.Tiered && (req.PricePerRequest != nil || req.MaxAmountRequired != nil) {
+		writeError(w, http.StatusConflict, "pricing tiers are configured: only methodCosts can be changed")
+		return
+	}
+	price := p.MaxAmountRequired / p.RequestsPerPayment
+	if req.PricePerRequest != nil {
+		price = *req.PricePerRequest
+	}
+	if req.MaxAmountRequired != nil {
+		p.MaxAmountRequired = *req.MaxAmountRequired
+	}
+	switch {
+	case price <= 0:
+		writeError(w, http.StatusBadRequest, "pricePerRequest must be positive")
+		return
+	case p.MaxAmountRequired < price:
+		writeError(w, http.StatusBadRequest, "maxAmountRequired must be >= pricePerRequest")
+		return
+	}
+	p.RequestsPerPayment = p.MaxAmountRequired / price
+	if req.MethodCosts != nil {
+		p.MethodCosts = req.MethodCosts
+	}
+	if err := h.cfg.Pricing.SetPricing(p); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	p = h.cfg.Pricing.Pricing()
+	slog.Info("admin: pricing changed",
+		"max_amount_required", p.MaxAmountRequired,
+		"requests_per_payment", p.RequestsPerPayment,
+		"method_costs", len(p.MethodCosts),
+	)
+	writeJSON(w, http.StatusOK, newPricingView(p))
+}
+
+// defaultReportWindow is the window a usage report covers when from is not
+// given.
+const defaultReportWindow = 30 * 24 * time.Hour
+
+// usageReport handles GET /admin/reports/usage, the calls and credits each
+// payer spent per method, and GET /admin/reports/revenue, what each payer
+// paid per asset, in its atomic units. Both take from and to, as RFC 3339
+// times or dates (to defaults to now, from to 30 days before), cover the
+// whole hours starting in between, and answer JSON with both tables or, with
+// format=csv, the one asked for as CSV.
+func (h *Handler) usageReport(w http.ResponseWriter, r *http.Request) {
+	if h.cfg.Usage == nil {
+		writeError(w, http.StatusServiceUnavailable, "payments are disabled")
+		return
+	}
+	q := r.URL.Query()
+	to, err := reportTime(q.Get("to"), time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid to: "+err.Error())
+		return
+	}
+	from, err := reportTime(q.Get("from"), to.Add(-defaultReportWindow))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid from: "+err.Error())
+		return
+	}
+	from, to = from.UTC().Truncate(time.Hour), to.UTC().Add(time.Hour-1).Truncate(time.Hour)
+	if !from.Before(to) {
+		writeError(w, http.StatusBadRequest, "from must be before to")
+		return
+	}
+	format := q.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		writeError(w, http.StatusBadRequest, "format must be json or csv")
+		return
+	}
+
+	rep, err := h.cfg.Usage.UsageReport(from, to)
+	if err != nil {
+		slog.Error("admin: usage report failed", "err", err)
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if format != "csv" {
+		writeJSON(w, http.StatusOK, rep)
+		return
+	}
+
+	name := path.Base(r.URL.Path)
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s-%s.csv"`, name, from.Format("20060102T15"), to.Format("20060102T15")))
+	cw := csv.NewWriter(w)
+	if name == "revenue" {
+		cw.Write([]string{"payer", "network", "asset", "payments", "amount"})
+		for _, p := range rep.Revenue {
+			cw.Write([]string{p.Payer, p.Network, p.Asset, strconv.FormatInt(p.Payments, 10), p.Amount})
+		}
+	} else {
+		cw.Write([]string{"payer", "method", "calls", "credits"})
+		for _, u := range rep.Usage {
+			cw.Write([]string{u.Payer, u.Method, strconv.FormatInt(u.Calls, 10), strconv.FormatInt(u.Credits, 10)})
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		slog.Warn("admin: writing usage report failed", "err", err)
+	}
+}
+
+// defaultLedgerWindow is the window the ledger entries listed cover when from
+// is not given.
+const defaultLedgerWindow = 24 * time.Hour
+
+// ledgerBalances handles GET /admin/ledger/balances: the balance of every
+// ledger account, or of those whose names start with prefix, such as
+// "held:" or "payer:0xabc".
+func (h *Handler) ledgerBalances(w http.ResponseWriter, r *http.Request) {
+	if h.cfg.Ledger == nil {
+		writeError(w, http.StatusServiceUnavailable, "the ledger is disabled")
+		return
+	}
+	balances, err := h.cfg.Ledger.LedgerBalances(r.URL.Query().Get("prefix"))
+	if err != nil {
+		slog.Error("admin: reading ledger balances failed", "err", err)
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if balances == nil {
+		balances = []x402.LedgerBalance{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"balances": balances})
+}
+
+// ledgerEntries handles GET /admin/ledger/entries: the entries posted between
+// from and to, RFC 3339 times or dates (to defaults to now, from to a day
+// before), oldest first.
+func (h *Handler) ledgerEntries(w http.ResponseWriter, r *http.Request) {
+	if h.cfg.Ledger == nil {
+		writeError(w, http.StatusServiceUnavailable, "the ledger is disabled")
+		return
+	}
+	q := r.URL.Query()
+	to, err := reportTime(q.Get("to"), time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid to: "+err.Error())
+		return
+	}
+	from, err := reportTime(q.Get("from"), to.Add(-defaultLedgerWindow))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid from: "+err.Error())
+		return
+	}
+	if !from.Before(to) {
+		writeError(w, http.StatusBadRequest, "from must be before to")
+		return
+	}
+	entries, err := h.cfg.Ledger.LedgerEntries(from.UTC(), to.UTC())
+	if err != nil {
+		slog.Error("admin: reading ledger entries failed", "err", err)
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if entries == nil {
+		entries = []x402.LedgerEntry{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"from": from.UTC(), "to": to.UTC(), "entries": entries})
+}
+
+// reconciliation handles GET /admin/reconciliation: the report of the last
+// day reconciled, 404 before the first has finished.
+func (h *Handler) reconciliation(w http.ResponseWriter, r *http.Request) {
+	if h.cfg.Reconciler == nil {
+		writeError(w, http.StatusServiceUnavailable, "reconciliation is disabled")
+		return
+	}
+	rep := h.cfg.Reconciler.LastReconciliation()
+	if rep == nil {
+		writeError(w, http.StatusNotFound, "no day reconciled yet")
+		return
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
+
+// health handles GET /admin/health: "ok", or "unhealthy" with status 503
+// when any check fails, with the result of each check and the uptime.
+func (h *Handler) health(w http.ResponseWriter, r *http.Request) {
+	results := make(map[string]string, len(h.cfg.Checks))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range h.cfg.Checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := "ok"
+			if err := check(); err != nil {
+				result = err.Error()
+			}
+			mu.Lock()
+			results[name] = result
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	status, code := "ok", http.StatusOK
+	for _, result := range results {
+		if result != "ok" {
+			status, code = "unhealthy", http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, code, map[string]any{
+		"status": status,
+		"uptime": time.Since(started).Round(time.Second).String(),
+		"checks": results,
+	})
+}
+
+// reportTime parses a report bound, an RFC 3339 time or a date (midnight
+// UTC), or returns fallback for an empty one.
+func reportTime(s string, fallback time.Time) (time.Time, error) {
+	if s == "" {
+		return fallback, nil
+	}
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
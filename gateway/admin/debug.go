@@ -0,0 +1,124 @@
+package admin
+
+import (
+	"math"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/metrics"
+	"time"
+)
+
+// started is when the process started, near enough, for the uptime.
+var started = time.Now()
+
+// registerDebug adds the profiling and runtime endpoints under
+// /admin/debug/, behind the admin token like the rest of the API.
+func (h *Handler) registerDebug() {
+	h.mux.HandleFunc("GET /admin/debug/pprof/", pprof.Index)
+	h.mux.HandleFunc("GET /admin/debug/pprof/cmdline", pprof.Cmdline)
+	h.mux.HandleFunc("GET /admin/debug/pprof/profile", pprof.Profile)
+	h.mux.HandleFunc("GET /admin/debug/pprof/symbol", pprof.Symbol)
+	h.mux.HandleFunc("POST /admin/debug/pprof/symbol", pprof.Symbol)
+	h.mux.HandleFunc("GET /admin/debug/pprof/trace", pprof.Trace)
+	// pprof.Index only serves named profiles under /debug/pprof/.
+	h.mux.HandleFunc("GET /admin/debug/pprof/{profile}", func(w http.ResponseWriter, r *http.Request) {
+		pprof.Handler(r.PathValue("profile")).ServeHTTP(w, r)
+	})
+	h.mux.HandleFunc("GET /admin/debug/goroutines", h.goroutines)
+	h.mux.HandleFunc("GET /admin/debug/runtime", h.runtimeStats)
+}
+
+// goroutines handles GET /admin/debug/goroutines: the stack of every
+// goroutine, as a panic prints them.
+func (h *Handler) goroutines(w http.ResponseWriter, r *http.Request) {
+	pprof.Handler("goroutine").ServeHTTP(w, withQuery(r, "debug", "2"))
+}
+
+// withQuery returns r with the query parameter key set to value.
+func withQuery(r *http.Request, key, value string) *http.Request {
+	r2 := r.Clone(r.Context())
+	q := r2.URL.Query()
+	q.Set(key, value)
+	r2.URL.RawQuery = q.Encode()
+	return r2
+}
+
+// runtimeStats handles GET /admin/debug/runtime: the Go runtime's metrics
+// (see runtime/metrics) by name, histograms summarised by count and
+// percentiles, with the goroutine count, GOMAXPROCS and uptime.
+func (h *Handler) runtimeStats(w http.ResponseWriter, r *http.Request) {
+	descs := metrics.All()
+	samples := make([]metrics.Sample, len(descs))
+	for i, d := range descs {
+		samples[i].Name = d.Name
+	}
+	metrics.Read(samples)
+
+	values := make(map[string]any, len(samples))
+	for _, s := range samples {
+		switch s.Value.Kind() {
+		case metrics.KindUint64:
+			values[s.Name] = s.Value.Uint64()
+		case metrics.KindFloat64:
+			if f := s.Value.Float64(); !math.IsInf(f, 0) && !math.IsNaN(f) {
+				values[s.Name] = f
+			}
+		case metrics.KindFloat64Histogram:
+			values[s.Name] = summarize(s.Value.Float64Histogram())
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"goVersion":  runtime.Version(),
+		"goroutines": runtime.NumGoroutine(),
+		"gomaxprocs": runtime.GOMAXPROCS(0),
+		"numCPU":     runtime.NumCPU(),
+		"uptime":     time.Since(started).Round(time.Second).String(),
+		"metrics":    values,
+	})
+}
+
+// histogramSummary is a runtime histogram reduced to what fits in JSON.
+type histogramSummary struct {
+	Count uint64  `json:"count"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+	Max   float64 `json:"max"`
+}
+
+// summarize returns the count of h and, for each percentile, the upper
+// bound of the bucket it falls in. Unbounded buckets are reported by their
+// finite bound.
+func summarize(h *metrics.Float64Histogram) histogramSummary {
+	var s histogramSummary
+	for _, c := range h.Counts {
+		s.Count += c
+	}
+	if s.Count == 0 {
+		return s
+	}
+	bound := func(i int) float64 {
+		if b := h.Buckets[i+1]; !math.IsInf(b, 0) {
+			return b
+		}
+		return h.Buckets[i]
+	}
+	var seen uint64
+	for i, c := range h.Counts {
+		if c == 0 {
+			continue
+		}
+		for _, p := range []struct {
+			q   float64
+			dst *float64
+		}{{0.5, &s.P50}, {0.9, &s.P90}, {0.99, &s.P99}} {
+			if *p.dst == 0 && float64(seen+c) >= p.q*float64(s.Count) {
+				*p.dst = bound(i)
+			}
+		}
+		seen += c
+		s.Max = bound(i)
+	}
+	return s
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/ethdenver2026/gateway/config"
+	"github.com/ethdenver2026/gateway/proxy"
+)
+
+// chainEndpoint is a JSON-RPC endpoint the gateway expects on a chain.
+type chainEndpoint struct {
+	name, url string
+	want      *big.Int
+	// fatal stops the gateway when the endpoint serves another chain,
+	// rather than only warning.
+	fatal bool
+}
+
+// chainEndpoints returns the endpoints whose chain the gateway relies on.
+// The settlement RPC of each local facilitator, and the one the price feeds
+// are read on, must be on its network: one on another chain verifies
+// payments against balances there while the relayer's transactions are
+// rejected, or worse, settle where the payee was never meant to be paid.
+// UPSTREAM_RPC_URL must be on UPSTREAM_CHAIN_ID when set, and is otherwise
+// only expected on NETWORK's chain.
+func chainEndpoints(cfg *config.Config) []chainEndpoint {
+	var endpoints []chainEndpoint
+	network, evm := evmChainID(cfg.Network)
+	switch {
+	case cfg.UpstreamChainID > 0:
+		endpoints = append(endpoints, chainEndpoint{"UPSTREAM_RPC_URL", cfg.UpstreamRPCURL, big.NewInt(int64(cfg.UpstreamChainID)), true})
+	case evm:
+		endpoints = append(endpoints, chainEndpoint{"UPSTREAM_RPC_URL", cfg.UpstreamRPCURL, network, false})
+	}
+	local := cfg.LocalFacilitator() || cfg.FacilitatorURL != "" && cfg.FacilitatorFailover
+	if evm && (local || len(cfg.PriceFeeds) > 0) {
+		endpoints = append(endpoints, chainEndpoint{"SETTLEMENT_RPC_URL", cfg.SettlementRPCURL, network, true})
+	}
+	for _, nf := range cfg.NetworkFacilitators {
+		if want, ok := evmChainID(nf.Network); ok && nf.FacilitatorURL == "" {
+			endpoints = append(endpoints, chainEndpoint{"settlement RPC for " + nf.Network, nf.SettlementRPCURL, want, true})
+		}
+	}
+	return endpoints
+}
+
+// verifyChains asks each endpoint its chain ID, returning an error for the
+// first fatal one on another chain. Non-fatal mismatches, and endpoints that
+// cannot be asked, are only logged: a node that is down at startup is the
+// retry logic's problem, not a misconfiguration.
+func verifyChains(client *http.Client, endpoints []chainEndpoint) error {
+	for _, e := range endpoints {
+		id, err := endpointChainID(client, e.url)
+		switch {
+		case err != nil:
+			slog.Warn("chain ID check failed", "endpoint", e.name, "url", config.RedactURL(e.url), "err", err)
+		case id.Cmp(e.want) == 0:
+			slog.Info("chain ID matches", "endpoint", e.name, "chain_id", id)
+		case e.fatal:
+			return fmt.Errorf("%s %s serves chain %s, expected %s", e.name, config.RedactURL(e.url), id, e.want)
+		default:
+			slog.Warn("endpoint serves another chain than NETWORK: fine only if that is intended (set UPSTREAM_CHAIN_ID to enforce its chain)",
+				"endpoint", e.name,
+				"chain_id", id,
+				"network_chain_id", e.want,
+			)
+		}
+	}
+	return nil
+}
+
+// watchChains checks the fatal endpoints' chain IDs every interval, sending
+// the first mismatch on wrong and returning.
+func watchChains(client *http.Client, endpoints []chainEndpoint, interval time.Duration, wrong chan<- error) {
+	for range time.Tick(interval) {
+		for _, e := range endpoints {
+			if !e.fatal {
+				continue
+			}
+			id, err := endpointChainID(client, e.url)
+			switch {
+			case err != nil:
+				slog.Warn("chain ID check failed", "endpoint", e.name, "url", config.RedactURL(e.url), "err", err)
+			case id.Cmp(e.want) != 0:
+				wrong <- fmt.Errorf("%s %s now serves chain %s, expected %s", e.name, config.RedactURL(e.url), id, e.want)
+				return
+			}
+		}
+	}
+}
+
+// chainChecks returns the admin health checks of the endpoints: each fails
+// when its endpoint cannot be asked its chain ID, or when a fatal one serves
+// another chain.
+func chainChecks(client *http.Client, endpoints []chainEndpoint) map[string]func() error {
+	checks := make(map[string]func() error, len(endpoints))
+	for _, e := range endpoints {
+		checks[e.name] = func() error {
+			id, err := endpointChainID(client, e.url)
+			if err != nil {
+				return err
+			}
+			if e.fatal && id.Cmp(e.want) != 0 {
+				return fmt.Errorf("serves chain %s, expected %s", id, e.want)
+			}
+			return nil
+		}
+	}
+	return checks
+}
+
+// endpointChainID asks the JSON-RPC endpoint at url its chain ID, through
+// client when it is set.
+func endpointChainID(client *http.Client, url string) (*big.Int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	ec, err := dialCheck(ctx, client, url)
+	if err != nil {
+		return nil, err
+	}
+	defer ec.Close()
+	return ec.ChainID(ctx)
+}
+
+// egressClient returns the HTTP client reaching the upstreams and settlement
+// RPC endpoints through EGRESS_PROXY_URL, or nil without one.
+func egressClient(cfg *config.Config) (*http.Client, error) {
+	if cfg.EgressProxyURL == "" {
+		return nil, nil
+	}
+	transport, err := proxy.EgressTransport(cfg.EgressProxyURL)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: transport}, nil
+}
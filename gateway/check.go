@@ -0,0 +1,326 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ethdenver2026/gateway/config"
+	"github.com/ethdenver2026/gateway/x402"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// checkTimeout bounds each network call of "gateway check".
+const checkTimeout = 15 * time.Second
+
+// settlementGas is the gas a settlement is assumed to take when checking
+// that a relayer can pay for one, the local facilitator's fallback limit.
+const settlementGas = 100_000
+
+// checkReport collects the results of "gateway check", printing each as it
+// comes in.
+type checkReport struct {
+	out      io.Writer
+	failures int
+	warnings int
+}
+
+func (r *checkReport) ok(format string, args ...any) {
+	fmt.Fprintf(r.out, "ok    "+format+"\n", args...)
+}
+
+func (r *checkReport) warn(format string, args ...any) {
+	r.warnings++
+	fmt.Fprintf(r.out, "warn  "+format+"\n", args...)
+}
+
+func (r *checkReport) fail(format string, args ...any) {
+	r.failures++
+	fmt.Fprintf(r.out, "FAIL  "+format+"\n", args...)
+}
+
+// runCheck implements "gateway check": it loads the configuration, checks
+// its addresses and that every endpoint it names is reachable and on the
+// chain it should be, and that the relayers can pay for settlements, so a
+// misconfiguration shows before deploying rather than on the first
+// payment. It prints a report and returns the exit code, 1 on any failure.
+func runCheck() int {
+	// The report goes to stdout; what the code it runs logs, to stderr.
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+	r := &checkReport{out: os.Stdout}
+	cfg, err := config.Load()
+	if err != nil {
+		r.fail("config: %v", err)
+		return 1
+	}
+	r.ok("config loads (network %s)", cfg.Network)
+	if cfg.SecretsProvider != "" {
+		if _, err := loadSecrets(cfg); err != nil {
+			r.fail("secrets from %s: %v", cfg.SecretsProvider, err)
+			return 1
+		}
+		r.ok("secrets read from %s", cfg.SecretsProvider)
+	}
+
+	client, err := egressClient(cfg)
+	if err != nil {
+		r.fail("EGRESS_PROXY_URL: %v", err)
+		return 1
+	}
+
+	checkAddresses(r, cfg)
+	checkUpstreams(r, cfg, client)
+	checkSettlement(r, cfg, client)
+	checkAuditLog(r, cfg)
+
+	fmt.Fprintf(r.out, "\n%d failed, %d warnings\n", r.failures, r.warnings)
+	if r.failures > 0 {
+		return 1
+	}
+	return 0
+}
+
+// checkAddresses checks the EVM addresses in the configuration: well formed,
+// EIP-55 checksummed when written in mixed case, and a payee that is not
+// the zero address.
+func checkAddresses(r *checkReport, cfg *config.Config) {
+	if !cfg.SolanaNetwork() {
+		if checkAddress(r, "GATEWAY_PAY_TO", cfg.GatewayPayTo) && common.HexToAddress(cfg.GatewayPayTo) == (common.Address{}) {
+			r.fail("GATEWAY_PAY_TO is the zero address: payments would be burned")
+		}
+	}
+	for _, a := range cfg.EIP3009Assets() {
+		if network := cmp.Or(a.Network, cfg.Network); !strings.HasPrefix(network, "solana:") {
+			checkAddress(r, "token "+a.DomainName+" on "+network, a.Address)
+		}
+	}
+	for _, a := range cfg.Permit2Assets {
+		checkAddress(r, "PERMIT2_ASSETS", a.Address)
+	}
+	for _, f := range cfg.PriceFeeds {
+		checkAddress(r, "PRICE_FEEDS feed", f.Feed)
+	}
+	if cfg.RelayerSigner == "external" {
+		checkAddress(r, "RELAYER_SIGNER_ADDRESS", cfg.RelayerSignerAddress)
+	}
+}
+
+// checkAddress checks the address named name, reporting whether it is one.
+func checkAddress(r *checkReport, name, addr string) bool {
+	if err := config.CheckAddress(addr); err != nil {
+		r.fail("%s: %v", name, err)
+		return false
+	}
+	r.ok("%s: %s", name, addr)
+	return true
+}
+
+// checkUpstreams dials every upstream and checks they serve one chain: the
+// fallback, archive, privacy and quorum providers stand in for
+// UPSTREAM_RPC_URL, so must be on its chain, and that on UPSTREAM_CHAIN_ID
+// when set. Each RPC_ROUTES upstream is only dialed, as the chain it serves
+// is its own.
+func checkUpstreams(r *checkReport, cfg *config.Config, client *http.Client) {
+	var want *big.Int
+	if cfg.UpstreamChainID > 0 {
+		want = big.NewInt(int64(cfg.UpstreamChainID))
+	}
+	primary, _ := checkEndpoint(r, client, "UPSTREAM_RPC_URL", cfg.UpstreamRPCURL, want)
+	if network, evm := evmChainID(cfg.Network); want == nil && evm && primary != nil && network.Cmp(primary) != 0 {
+		r.warn("UPSTREAM_RPC_URL serves chain %s but payments are taken on %s: fine only if that is intended", primary, cfg.Network)
+	}
+	standIns := []struct{ name, url string }{
+		{"UPSTREAM_FALLBACK_RPC_URL", cfg.UpstreamFallbackRPCURL},
+		{"ARCHIVE_RPC_URL", cfg.ArchiveRPCURL},
+	}
+	for _, u := range cfg.PrivacyRPCURLs {
+		standIns = append(standIns, struct{ name, url string }{"PRIVACY_RPC_URLS", u})
+	}
+	for _, u := range cfg.QuorumRPCURLs {
+		standIns = append(standIns, struct{ name, url string }{"QUORUM_RPC_URLS", u})
+	}
+	for _, s := range standIns {
+		if s.url != "" {
+			checkEndpoint(r, client, s.name, s.url, primary)
+		}
+	}
+	for _, rt := range cfg.RPCRoutes {
+		checkEndpoint(r, client, "RPC_ROUTES "+rt.Prefix, rt.UpstreamURL, nil)
+	}
+}
+
+// checkSettlement checks the settlement side of every local facilitator:
+// its RPC endpoint is on the facilitator's network and each relayer holds
+// enough for at least one settlement's gas. Remote facilitators are asked
+// whether they support the offered payments.
+func checkSettlement(r *checkReport, cfg *config.Config, client *http.Client) {
+	local := cfg.LocalFacilitator() || cfg.FacilitatorURL != "" && cfg.FacilitatorFailover
+	if cfg.FacilitatorURL != "" {
+		checkFacilitator(r, cfg, cfg.FacilitatorURL, cfg.Network)
+	}
+	switch {
+	case local:
+		checkRelayers(r, cfg, client, cfg.Network, cfg.SettlementRPCURL)
+	case cfg.SolanaFacilitator():
+		r.warn("SETTLEMENT_RPC_URL %s: Solana settlement is not checked", cfg.SettlementRPCURL)
+	case cfg.FacilitatorURL == "":
+		r.warn("payments disabled: no facilitator or relayer signer configured")
+	}
+	for _, nf := range cfg.NetworkFacilitators {
+		if nf.FacilitatorURL != "" {
+			checkFacilitator(r, cfg, nf.FacilitatorURL, nf.Network)
+			continue
+		}
+		checkRelayers(r, cfg, client, nf.Network, nf.SettlementRPCURL)
+	}
+}
+
+// checkFacilitator asks the remote facilitator at url whether it settles
+// exact payments on network.
+func checkFacilitator(r *checkReport, cfg *config.Config, url, network string) {
+	rf, err := newRemoteFacilitator(cfg, url)
+	if err != nil {
+		r.fail("facilitator %s: %v", url, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	if err := rf.CheckSupported(ctx, network, "exact"); err != nil {
+		r.fail("facilitator %s: %v", url, err)
+		return
+	}
+	r.ok("facilitator %s supports exact payments on %s", url, network)
+}
+
+// checkRelayers checks the local facilitator settling on network through
+// rpcURL: the endpoint is on network's chain, and each relayer account can
+// pay for a settlement at the current gas price.
+func checkRelayers(r *checkReport, cfg *config.Config, client *http.Client, network, rpcURL string) {
+	want, evm := evmChainID(network)
+	if !evm {
+		r.fail("%s: the local facilitator only settles on eip155: networks", network)
+		return
+	}
+	if _, ok := checkEndpoint(r, client, "settlement RPC for "+network, rpcURL, want); !ok {
+		return
+	}
+	lf, err := newLocalFacilitator(cfg, network, rpcURL)
+	if err != nil {
+		r.fail("relayer signer: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	ec, err := dialCheck(ctx, client, rpcURL)
+	if err != nil {
+		r.fail("settlement RPC for %s: %v", network, err)
+		return
+	}
+	defer ec.Close()
+	gasPrice, err := ec.SuggestGasPrice(ctx)
+	if err != nil {
+		r.fail("settlement RPC for %s: gas price: %v", network, err)
+		return
+	}
+	cost := new(big.Int).Mul(gasPrice, big.NewInt(settlementGas))
+	for _, addr := range lf.Relayers() {
+		balance, err := ec.BalanceAt(ctx, addr, nil)
+		switch {
+		case err != nil:
+			r.fail("relayer %s on %s: balance: %v", addr.Hex(), network, err)
+		case balance.Cmp(cost) < 0:
+			r.fail("relayer %s on %s holds %s wei, less than one settlement's gas (~%s wei)", addr.Hex(), network, balance, cost)
+		default:
+			r.ok("relayer %s on %s holds %s wei, ~%s settlements at the current gas price", addr.Hex(), network, balance, new(big.Int).Quo(balance, cost))
+		}
+	}
+}
+
+// checkAuditLog verifies the hash chain of the audit log, when one is kept
+// chained, and prints the hash of its last line to compare with one noted
+// earlier.
+func checkAuditLog(r *checkReport, cfg *config.Config) {
+	if cfg.AuditLogPath == "" || !cfg.AuditLogHashChain {
+		return
+	}
+	f, err := os.Open(cfg.AuditLogPath)
+	if errors.Is(err, os.ErrNotExist) {
+		r.ok("AUDIT_LOG_PATH %s: not written yet", cfg.AuditLogPath)
+		return
+	}
+	if err != nil {
+		r.fail("AUDIT_LOG_PATH: %v", err)
+		return
+	}
+	defer f.Close()
+	records, head, err := x402.VerifyAuditLog(f)
+	if err != nil {
+		r.fail("audit log %s: %v", cfg.AuditLogPath, err)
+		return
+	}
+	r.ok("audit log %s: %d records chained, last line hash %s", cfg.AuditLogPath, records, head)
+}
+
+// checkEndpoint dials the JSON-RPC endpoint named name at url and asks its
+// chain ID, failing the check if it is not want, when want is set. It
+// returns the chain ID, nil for a node that is reachable but does not
+// answer eth_chainId (not an EVM node), and whether the check passed.
+func checkEndpoint(r *checkReport, client *http.Client, name, url string, want *big.Int) (*big.Int, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	ec, err := dialCheck(ctx, client, url)
+	if err != nil {
+		r.fail("%s %s: %v", name, url, err)
+		return nil, false
+	}
+	defer ec.Close()
+	id, err := ec.ChainID(ctx)
+	var rpcErr rpc.Error
+	switch {
+	case errors.As(err, &rpcErr) && want == nil:
+		r.ok("%s %s reachable (no eth_chainId: %v)", name, url, err)
+		return nil, true
+	case err != nil:
+		r.fail("%s %s: %v", name, url, err)
+		return nil, false
+	case want != nil && id.Cmp(want) != 0:
+		r.fail("%s %s serves chain %s, expected %s", name, url, id, want)
+		return id, false
+	}
+	r.ok("%s %s serves chain %s", name, url, id)
+	return id, true
+}
+
+// dialCheck connects to the JSON-RPC endpoint at url, through client when
+// it is set.
+func dialCheck(ctx context.Context, client *http.Client, url string) (*ethclient.Client, error) {
+	if client == nil {
+		return ethclient.DialContext(ctx, url)
+	}
+	c, err := rpc.DialOptions(ctx, url, rpc.WithHTTPClient(client))
+	if err != nil {
+		return nil, err
+	}
+	return ethclient.NewClient(c), nil
+}
+
+// evmChainID returns the chain ID of an "eip155:" network, and whether it is
+// one.
+func evmChainID(network string) (*big.Int, bool) {
+	id, ok := strings.CutPrefix(network, "eip155:")
+	if !ok {
+		return nil, false
+	}
+	return new(big.Int).SetString(id, 10)
+}
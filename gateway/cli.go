@@ -0,0 +1,153 @@
+package main
+
+import (
+	_ "embed"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// version is the gateway's release, set at build time with
+// -ldflags "-X main.version=...".
+var version = "dev"
+
+// envExample documents every setting; each becomes a flag.
+//
+//go:embed .env.example
+var envExample string
+
+// envSetting is one setting of .env.example: its environment variable and
+// what the file says about it.
+type envSetting struct {
+	key, usage string
+}
+
+// envSettings reads the settings out of .env.example. A setting is described
+// by its trailing comment or, without one, by the comment lines right above
+// it.
+func envSettings() []envSetting {
+	var settings []envSetting
+	var above []string
+	for line := range strings.Lines(envExample) {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+			above = nil
+			continue
+		case strings.HasPrefix(line, "#"):
+			above = append(above, strings.TrimSpace(strings.TrimPrefix(line, "#")))
+			continue
+		}
+		key, rest, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		usage := strings.Join(above, "; ")
+		if _, comment, ok := strings.Cut(rest, " #"); ok {
+			usage = strings.TrimSpace(comment)
+		}
+		settings = append(settings, envSetting{key: key, usage: usage})
+		above = nil
+	}
+	return settings
+}
+
+// flagName is the flag of the environment variable key: UPSTREAM_RPC_URL
+// is --upstream-rpc-url.
+func flagName(key string) string {
+	return strings.ReplaceAll(strings.ToLower(key), "_", "-")
+}
+
+// parseCommand parses the command line, "[serve|check|version] [flags]",
+// returning the subcommand, "serve" when none is given. Every flag sets its
+// environment variable, so flags take precedence over the environment,
+// which takes precedence over a .env file. Errors, and the usage asked for
+// with -h, are printed to stderr.
+func parseCommand(args []string, stderr io.Writer) (string, error) {
+	cmd := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	switch cmd {
+	case "serve", "check", "version":
+	default:
+		err := fmt.Errorf("unknown command %q (see gateway -help)", cmd)
+		fmt.Fprintln(stderr, err)
+		return "", err
+	}
+
+	fs := flag.NewFlagSet("gateway "+cmd, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { usage(stderr, fs) }
+	for _, s := range envSettings() {
+		fs.Func(flagName(s.key), s.usage+" ($"+s.key+")", func(v string) error {
+			return os.Setenv(s.key, v)
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	if fs.NArg() > 0 {
+		err := fmt.Errorf("unexpected argument %q (see gateway -help)", fs.Arg(0))
+		fmt.Fprintln(stderr, err)
+		return "", err
+	}
+	return cmd, nil
+}
+
+// usage prints the commands and fs's flags.
+func usage(w io.Writer, fs *flag.FlagSet) {
+	fmt.Fprint(w, `Usage: gateway [command] [flags]
+
+Commands:
+  serve    run the gateway (the default)
+  check    check the configuration and the endpoints it names, then exit
+  version  print the version and exit
+
+Every flag mirrors the environment variable shown with it; flags win over
+the environment, which wins over a .env file in the working directory.
+
+Flags:
+`)
+	fs.SetOutput(w)
+	fs.PrintDefaults()
+}
+
+// printVersion prints the gateway's version, with the commit it was built
+// from when the build recorded it.
+func printVersion(w io.Writer) {
+	commit := ""
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				commit = " " + s.Value
+			}
+		}
+	}
+	fmt.Fprintf(w, "gateway %s%s (%s)\n", version, commit, runtime.Version())
+}
+
+// runCommand dispatches the command line, returning the exit code of a
+// command that ran, or -1 to serve.
+func runCommand(args []string) int {
+	cmd, err := parseCommand(args, os.Stderr)
+	switch {
+	case errors.Is(err, flag.ErrHelp):
+		return 0
+	case err != nil:
+		return 2
+	}
+	switch cmd {
+	case "check":
+		return runCheck()
+	case "version":
+		printVersion(os.Stdout)
+		return 0
+	}
+	return -1
+}
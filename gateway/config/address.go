@@ -0,0 +1,41 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// CheckAddress checks that addr is an EVM address and, when written in
+// mixed case, that it passes its EIP-55 checksum. All-lowercase and
+// all-uppercase addresses carry no checksum and are taken as they are.
+func CheckAddress(addr string) error {
+	if !common.IsHexAddress(addr) {
+		return fmt.Errorf("%q is not an address", addr)
+	}
+	if want := common.HexToAddress(addr).Hex(); hasMixedCase(addr) && want[2:] != addr[len(addr)-40:] {
+		return fmt.Errorf("%s fails its EIP-55 checksum (mistyped?), expected %s", addr, want)
+	}
+	return nil
+}
+
+// hasMixedCase reports whether the hex digits of addr are in both cases,
+// the only case in which they carry an EIP-55 checksum.
+func hasMixedCase(addr string) bool {
+	digits := strings.TrimPrefix(strings.TrimPrefix(addr, "0x"), "0X")
+	return strings.ToLower(digits) != digits && strings.ToUpper(digits) != digits
+}
+
+// checkPayee checks the address named name, which payments are sent to or
+// drawn on: an address, and not the zero address, where they would be
+// burned.
+func checkPayee(name, addr string) error {
+	if err := CheckAddress(addr); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if common.HexToAddress(addr) == (common.Address{}) {
+		return fmt.Errorf("%s is the zero address", name)
+	}
+	return nil
+}
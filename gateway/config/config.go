@@ -2,9 +2,15 @@ package config
 
 import (
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -14,12 +20,115 @@ import (
 type Config struct {
 	// UpstreamRPCURL is the Ethereum RPC endpoint to proxy to.
 	UpstreamRPCURL string
+	// UpstreamFallbackRPCURL, when set, is a second endpoint that read calls
+	// the upstream failed to answer are retried on.
+	UpstreamFallbackRPCURL string
+	// HTTPRoutes put the payment gate in front of further HTTP APIs, such as
+	// REST endpoints or inference servers: any request under a route's
+	// prefix is proxied to its upstream, with the prefix cut from the path,
+	// and charged the route's credits.
+	// Format: "prefix|upstreamURL|credits[|METHOD,METHOD];..."
+	HTTPRoutes []HTTPRoute
+	// RPCRoutes serve further chains next to UpstreamRPCURL's at /, such as
+	// /base and /eth, each proxied to its own upstream and sold on its own:
+	// payments are taken on the route's network at the route's credit packs,
+	// and the tokens they buy are good on that route alone.
+	// Format: "prefix|upstreamURL[|network[|tiers]];..." where network
+	// defaults to Network, and must otherwise be one NetworkFacilitators
+	// settles, and tiers, as in PRICING_TIERS, to the gateway's packs.
+	RPCRoutes []RPCRoute
+	// EgressProxyURL, when set, is a SOCKS5 proxy such as Tor
+	// ("socks5://127.0.0.1:9050") that connections to the upstreams and the
+	// settlement RPC endpoint are dialed through, hiding the gateway's
+	// address from the providers. Beacon APIs, price feeds and Solana
+	// settlement are still reached directly.
+	EgressProxyURL string
+	// UpstreamDialTimeout, UpstreamTLSTimeout and UpstreamHeaderTimeout
+	// bound connecting to an upstream, its TLS handshake and the wait for
+	// its response headers; 0 keeps Go's default, no limit for the last.
+	UpstreamDialTimeout   time.Duration
+	UpstreamTLSTimeout    time.Duration
+	UpstreamHeaderTimeout time.Duration
+	// UpstreamMaxIdleConns and UpstreamMaxIdleConnsPerHost size the pool of
+	// idle connections kept to the upstreams, in all and to each one.
+	UpstreamMaxIdleConns        int
+	UpstreamMaxIdleConnsPerHost int
+	// UpstreamMaxConnsPerHost caps the connections to each upstream; 0
+	// disables the cap.
+	UpstreamMaxConnsPerHost int
+	// PrivacyRPCURLs, when set, are further providers each client's calls
+	// are spread over along with the upstream, by method class, so that no
+	// provider sees all of a client's queries.
+	PrivacyRPCURLs []string
+	// PrivacyShuffle is how long a client keeps its assignment of method
+	// classes to providers before a new one is drawn.
+	PrivacyShuffle time.Duration
+	// ArchiveRPCURL, when set, is an archive node that calls needing
+	// historical state are sent to, as ArchiveRoutes say, leaving the
+	// upstream to be a cheaper full node.
+	ArchiveRPCURL string
+	// ArchiveRoutes are the methods ("eth_call") or namespaces ("debug_*")
+	// sent to the archive node, each optionally only when reading state at
+	// least a number of blocks behind the head ("eth_call:128").
+	ArchiveRoutes []string
+	// QuorumRPCURLs, when set, are further providers that calls to
+	// QuorumMethods are also sent to: the answer most of them and the
+	// upstream agree on is returned, and divergent providers are logged.
+	QuorumRPCURLs []string
+	// QuorumMethods are the methods ("eth_call") or namespaces ("eth_get*")
+	// cross-checked by the quorum providers.
+	QuorumMethods []string
+	// VerifyBeaconURLs, when set, are beacon APIs a light client follows the
+	// chain through, so clients asking with X-Rpc-Verify get state reads and
+	// eth_call answers verified against the signed state root.
+	VerifyBeaconURLs []string
+	// VerifyNetwork is the chain the light client follows: "mainnet",
+	// "sepolia", "holesky" or "hoodi". Verification works on L1 only.
+	VerifyNetwork string
+	// VerifiedCallCost is the credits a verified call costs on top of its
+	// usual cost; unverified answers are refunded it.
+	VerifiedCallCost int
+	// UpstreamWSURL, when set, is the upstream node's WebSocket endpoint:
+	// clients holding a token can then open a WebSocket on / and are charged
+	// per JSON-RPC message.
+	UpstreamWSURL string
+	// UpstreamFallbackWSURL, when set, is a second WebSocket endpoint that
+	// takes over, subscriptions and all, when the connection to the first is
+	// lost.
+	UpstreamFallbackWSURL string
+	// WSNotificationsPerCredit is how many subscription notifications a
+	// WebSocket client receives per credit; 0 makes them free.
+	WSNotificationsPerCredit int
+	// WSSubscriptionCost is the credits an eth_subscribe costs to set up,
+	// in place of its method cost; 0 prices it like any other call.
+	WSSubscriptionCost int
 
-	// GatewayPayTo is the gateway's USDC-receiving wallet address.
+	// ResponseCache selects the cache answering calls whose results cannot
+	// change, such as receipts and finalized blocks, without the upstream:
+	// "" (none), "memory" or "redis".
+	ResponseCache string
+	// ResponseCacheMaxEntries bounds the "memory" response cache.
+	ResponseCacheMaxEntries int
+	// RedisURL is the Redis server of the "redis" response cache.
+	RedisURL string
+	// CoalesceRequests sends identical read calls in flight at the same
+	// time to the upstream once, sharing its response.
+	CoalesceRequests bool
+	// HeadCacheTTL is how long eth_blockNumber, eth_gasPrice and
+	// eth_feeHistory results are reused for identical calls; 0 disables it.
+	HeadCacheTTL time.Duration
+	// CacheHitCost is what a call answered from the response or head cache
+	// costs, in credits, when less than its usual cost; negative charges it
+	// as usual.
+	CacheHitCost int
+
+	// GatewayPayTo is the gateway's USDC-receiving wallet address. On EVM
+	// networks it must pass its EIP-55 checksum when in mixed case, and not
+	// be the zero address, as must USDCAddress.
 	GatewayPayTo string
 
 	// USDCAddress is the USDC contract address on the target network.
-	// Base Sepolia default: 0x036CbD53842c5426634E7929541eC2318f3dCF7e
+	// Base Sepolia default: 0x036CbD53842c5426634e7929541eC2318f3dCF7e
 	USDCAddress string
 
 	// USDCDomainName is the EIP-712 domain name for the USDC contract.
@@ -33,21 +142,156 @@ type Config struct {
 	GatewayURL string
 
 	// FacilitatorURL is the x402 facilitator endpoint.
-	// When empty and GatewayPrivateKey is set, the gateway uses its own local facilitator.
+	// When empty and a relayer signer is configured (GatewayPrivateKey, or
+	// another RelayerSigner), the gateway uses its own local facilitator.
 	FacilitatorURL string
 
+	// FacilitatorVerifyTimeout and FacilitatorSettleTimeout bound each call
+	// to the remote facilitator's verify and settle endpoints. A verify call
+	// it fails to answer is retried up to FacilitatorVerifyRetries times.
+	FacilitatorVerifyTimeout time.Duration
+	FacilitatorSettleTimeout time.Duration
+	FacilitatorVerifyRetries int
+
+	// FacilitatorTLSCert and FacilitatorTLSKey are a PEM client certificate
+	// and key presented to remote facilitators behind mutual TLS.
+	// FacilitatorCAFile is a PEM bundle of the CAs trusted to sign their
+	// certificates, for a private facilitator, in place of the system roots.
+	FacilitatorTLSCert string
+	FacilitatorTLSKey  string
+	FacilitatorCAFile  string
+
+	// FacilitatorRequireSupport refuses to start when the remote
+	// facilitator's supported endpoint does not list the exact scheme on
+	// Network; otherwise that is only logged as a warning.
+	FacilitatorRequireSupport bool
+
+	// FacilitatorFailover, with FacilitatorURL and a relayer signer both
+	// configured, keeps the local facilitator on standby: payments are
+	// verified and settled by it whenever the remote facilitator is
+	// unreachable or answers with a server error.
+	FacilitatorFailover bool
+
+	// FacilitatorServer serves the x402 facilitator API (verify, settle,
+	// supported) under /facilitator/, backed by the local facilitator, for
+	// other x402 services to settle their payments through the gateway.
+	// FacilitatorServerToken, when set, is the bearer token they must send.
+	FacilitatorServer      bool
+	FacilitatorServerToken string
+
+	// NetworkFacilitators settle payments on further networks, each with its
+	// own facilitator, next to those on Network, which keep the facilitator
+	// configured above. The tokens accepted on each network are listed in
+	// TokenRegistry.
+	// Format: "network|facilitatorURL;network|local|settlementRPCURL;..."
+	// where "local" settles with the local facilitator's relayer signer.
+	NetworkFacilitators []NetworkFacilitator
+
 	// GatewayPrivateKey is the hex-encoded private key used by the local facilitator
 	// to submit transferWithAuthorization transactions and pay gas.
 	// The derived address should hold enough native token for gas.
 	GatewayPrivateKey string
 
+	// RelayerKeys are further hex-encoded private keys the local facilitator
+	// spreads EIP-3009 settlements across, round-robin, so settlements are
+	// not serialized on one account's nonces and one drained account does
+	// not halt them. GatewayPrivateKey stays the Permit2 spender and
+	// receiveWithAuthorization payee, settling those payments itself.
+	RelayerKeys []string
+
+	// RelayerSigner selects what signs the local facilitator's settlement
+	// transactions: "key" (the default, use GatewayPrivateKey), "keystore"
+	// (an encrypted keystore file), "external" (a Clef or Web3Signer
+	// endpoint), "aws-kms" or "gcp-kms". With the last three the relayer key
+	// never reaches the gateway.
+	RelayerSigner string
+
+	// RelayerKeystore is the encrypted keystore file for RelayerSigner
+	// "keystore", and RelayerKeystorePassword its passphrase.
+	RelayerKeystore         string
+	RelayerKeystorePassword string
+
+	// RelayerSignerURL is the remote signer's endpoint for RelayerSigner
+	// "external" (http(s), ws(s) or an IPC path), and RelayerSignerAddress
+	// the account it signs settlements for.
+	RelayerSignerURL     string
+	RelayerSignerAddress string
+
+	// RelayerKMSKey is the KMS key signing settlements: an AWS KMS key ID,
+	// ARN or alias (ECC_SECG_P256K1), or a GCP KMS key version resource name
+	// (EC_SIGN_SECP256K1_SHA256).
+	RelayerKMSKey string
+
+	// AWSRegion, AWSAccessKeyID, AWSSecretAccessKey and AWSSessionToken
+	// are the credentials for RelayerSigner "aws-kms", read from the
+	// standard AWS_* environment variables.
+	AWSRegion          string
+	AWSAccessKeyID     string
+	AWSSecretAccessKey string
+	AWSSessionToken    string
+
+	// GCPCredentialsFile is a service account key file for RelayerSigner
+	// "gcp-kms". When empty, the GCP instance's service account is used.
+	GCPCredentialsFile string
+
+	// SecretsProvider, when set, is the secrets manager JWTSecretRef and
+	// GatewayPrivateKeyRef are read from at startup, instead of the secrets
+	// living in the environment: "vault", "aws-sm" (AWS Secrets Manager,
+	// with the AWS_* credentials) or "gcp-sm" (GCP Secret Manager, with
+	// GCPCredentialsFile).
+	SecretsProvider string
+
+	// JWTSecretRef and GatewayPrivateKeyRef name the secrets holding
+	// JWT_SECRET and GATEWAY_PRIVATE_KEY: "path#field" for Vault (a KV
+	// secret's path, such as "secret/data/gateway"), the secret's name or
+	// ARN for AWS, "projects/*/secrets/*" for GCP. On AWS and GCP a
+	// "#field" suffix picks a field of a secret holding a JSON object.
+	JWTSecretRef         string
+	GatewayPrivateKeyRef string
+
+	// VaultAddr, VaultToken and VaultNamespace reach Vault for
+	// SecretsProvider "vault", read from the standard VAULT_* variables.
+	VaultAddr      string
+	VaultToken     string
+	VaultNamespace string
+
+	// SecretsRefresh, when positive, is how often the secrets are re-read.
+	// A new JWT secret signs tokens from then on, tokens signed with the one
+	// before staying valid; a new relayer key is only logged, taking effect
+	// at the next restart.
+	SecretsRefresh time.Duration
+
 	// SettlementRPCURL is the JSON-RPC endpoint for the settlement chain.
-	// Defaults to the public Base Sepolia endpoint.
+	// Defaults to the public Base Sepolia endpoint, or the cluster's public
+	// endpoint on a known Solana Network.
 	SettlementRPCURL string
 
+	// UpstreamChainID, when set, is the chain UpstreamRPCURL must serve: the
+	// gateway refuses to start, and stops, when it serves another. Unset,
+	// an upstream on a chain other than an eip155: Network's is only
+	// warned about, as the gateway may sell one chain's RPC for another's
+	// payments.
+	UpstreamChainID int
+
+	// ChainCheckInterval is how often the chain IDs of the upstream and
+	// settlement RPC endpoints are checked again after startup, to catch an
+	// endpoint repointed to another chain; 0 checks them at startup only.
+	ChainCheckInterval time.Duration
+
 	// Network is the CAIP-2 network identifier (e.g. "eip155:84532" for Base Sepolia).
+	// A "solana:" network takes SPL token payments instead; USDCAddress is then
+	// the USDC mint, defaulting to Circle's on mainnet-beta and devnet.
 	Network string
 
+	// SolanaFeePayerKey is the keypair, base58 or a solana-keygen JSON array,
+	// of the account paying the fees of Solana settlements. With a Solana
+	// Network and no FacilitatorURL, the gateway settles payments itself.
+	SolanaFeePayerKey string
+
+	// SolanaFeePayer is the remote facilitator's fee payer address, named in
+	// the offers, when FacilitatorURL is set on a Solana Network.
+	SolanaFeePayer string
+
 	// PricePerRequest is the cost per RPC call in USDC atomic units (6 decimals).
 	// 100 = 0.0001 USDC
 	PricePerRequest int64
@@ -56,51 +300,1065 @@ type Config struct {
 	// requests_total = MaxAmountRequired / PricePerRequest
 	MaxAmountRequired int64
 
+	// PricingTiers, when set, advertises several credit packs instead of the
+	// single MaxAmountRequired / PricePerRequest pack.
+	// Format: "amount:credits[:method|method],..." e.g.
+	// "10000:100,5000:100:eth_call|eth_getLogs". A tier with a method list
+	// sells tokens restricted to those JSON-RPC methods.
+	PricingTiers []PricingTier
+
+	// ExtraAssets are further EIP-3009 tokens (EURC, PYUSD, ...) accepted
+	// alongside USDC, each advertised with its own Accepts entries.
+	// Format: "address|domainName|domainVersion[|tiers];..." where tiers uses
+	// the PRICING_TIERS format in the asset's own units and defaults to the
+	// USDC tiers.
+	ExtraAssets []Asset
+
+	// TokenRegistry lists the EIP-3009 tokens accepted on each network, so
+	// one setting can serve deployments on several chains and tokens whose
+	// EIP-712 domains differ (EURC, bridged USDC variants). The entries for
+	// Network replace USDCAddress/USDCDomainName/USDCDomainVersion; it
+	// cannot be combined with ExtraAssets.
+	// Format: "network|address|decimals|domainName|domainVersion[|minAmount[|tiers]];..."
+	// where minAmount is the smallest pack amount offered in the token's
+	// atomic units and tiers uses the PRICING_TIERS format in those units.
+	TokenRegistry []Asset
+
+	// Permit2Assets are ERC-20 tokens accepted through Uniswap Permit2
+	// signature transfers, for tokens without EIP-3009. Requires the local
+	// facilitator, whose relayer is the permit spender.
+	// Format: "address[|tiers];..." with tiers as in PRICING_TIERS.
+	Permit2Assets []Asset
+
+	// USDPricePerRequest pegs the assets listed in PriceFeeds to a USD price
+	// per credit: their pack amounts are recomputed from the feeds every
+	// PriceRefreshInterval. Required when PriceFeeds is set.
+	USDPricePerRequest float64
+
+	// PriceFeeds maps accepted assets to Chainlink TOKEN/USD feeds on the
+	// settlement chain. Format: "asset|feed|tokenDecimals;...".
+	PriceFeeds []PriceFeed
+
+	// PriceRefreshInterval is how often feed prices are re-read.
+	PriceRefreshInterval time.Duration
+
+	// PriceMaxAge rejects feed answers older than this as stale.
+	PriceMaxAge time.Duration
+
+	// Coupons are promotional codes clients send in the X-Coupon header for
+	// a percentage off every pack, a percentage of bonus credits, or both.
+	// Format: "code:discount:bonus[:expiryDate],..." e.g.
+	// "LAUNCH:20:0:2026-12-31,BUILDERS:0:50". A coupon with an expiry date is
+	// accepted through that day (UTC).
+	Coupons []Coupon
+
+	// UptoPayments sells the Permit2 assets' packs under the x402 "upto"
+	// scheme: clients sign a permit for the pack amount, and only the share
+	// matching the credits they used is settled, once the token is exhausted
+	// or expires. Requires PERMIT2_ASSETS.
+	UptoPayments bool
+
+	// AsyncSettlement issues the batch token as soon as a payment verifies
+	// and settles it in a background worker with retries, taking the chain
+	// off the request path. Tokens whose payment cannot be settled are
+	// revoked.
+	AsyncSettlement bool
+
+	// SettlementBatchSize, when above 1, settles asynchronous EIP-3009
+	// payments in batches of up to this many per Multicall3 transaction
+	// instead of one transaction each, every settlement sweep. Requires
+	// ASYNC_SETTLEMENT and the local facilitator.
+	SettlementBatchSize int
+
+	// SettlementConfirmations, when positive, issues credits only once the
+	// settlement transaction has this many confirmations; paying requests get
+	// 202 and a URL to poll for the token. For reorg-prone chains. Requires
+	// the local facilitator.
+	SettlementConfirmations int
+
+	// SettlementReorgBlocks, when positive, watches mined settlement
+	// transactions until they are final; one a reorg drops from the chain
+	// that is not mined again within this many blocks has its credits
+	// withdrawn and a settlement_reorged webhook event sent. Requires the
+	// local or Solana facilitator.
+	SettlementReorgBlocks int
+
+	// SettlementStuckAfter is how long a settlement transaction sent by the
+	// local facilitator may stay unmined before it is rebroadcast with a
+	// higher tip and fee cap; zero disables rebroadcasting.
+	SettlementStuckAfter time.Duration
+
+	// SettlementMinValidity is how long a payment authorization must still
+	// be valid when the local facilitator verifies it, so its settlement can
+	// land before it expires. Authorizations not yet valid are rejected too.
+	SettlementMinValidity time.Duration
+
+	// Gas pricing of the local facilitator's settlement transactions. The
+	// tip is the node's suggestion times SettlementTipMultiplier, the fee
+	// cap the latest base fee times SettlementBaseFeeMultiplier plus the tip.
+	// Legacy transactions (SettlementLegacyTx, or chains without a base fee)
+	// pay the suggested gas price times SettlementGasPriceMultiplier.
+	// SettlementMaxFeeGwei, when positive, is a ceiling on the fee cap or
+	// gas price of any settlement transaction, rebroadcasts included.
+	SettlementTipMultiplier      float64
+	SettlementBaseFeeMultiplier  float64
+	SettlementGasPriceMultiplier float64
+	SettlementMaxFeeGwei         float64
+	SettlementLegacyTx           bool
+
+	// ReceiveWithAuthorization asks payers for EIP-3009
+	// receiveWithAuthorization signatures, which only the payee can submit,
+	// so a signature seen in the mempool cannot be front-run. Requires the
+	// local facilitator with GATEWAY_PAY_TO set to the relayer's address.
+	ReceiveWithAuthorization bool
+
+	// ChallengeSecret, when set, signs a challenge put in every 402 that
+	// payments must echo, binding them to this deployment: a payment made to
+	// another gateway paying the same address cannot be redeemed here. All
+	// replicas of a deployment need the same secret.
+	ChallengeSecret []byte
+
 	// JWTSecret is the HMAC-SHA256 key used to sign batch tokens.
 	JWTSecret []byte
 
-	// TokenExpiry is how long issued batch tokens remain valid.
+	// TokenExpiry is how long issued batch tokens remain valid, from
+	// TOKEN_EXPIRY (a Go duration) or else TOKEN_EXPIRY_HOURS.
 	TokenExpiry time.Duration
 
+	// FreeMethods are JSON-RPC methods proxied without payment, so clients
+	// can probe the endpoint before paying, e.g.
+	// "eth_chainId,eth_blockNumber,net_version,web3_clientVersion".
+	FreeMethods []string
+
+	// FreeRequestsPerDay, when positive, lets each client IP make this many
+	// requests a day without paying, so new users can try the endpoint. Usage
+	// is counted in the token store and resets at midnight UTC.
+	FreeRequestsPerDay int
+
+	// AllowedMethods, when non-empty, is the only JSON-RPC methods the gateway
+	// forwards; DeniedMethods are never forwarded. Entries are method names or
+	// namespaces with a trailing "*", e.g. "admin_*,personal_*,debug_*".
+	AllowedMethods []string
+	DeniedMethods  []string
+
+	// MethodCosts prices JSON-RPC methods in credits instead of one credit
+	// per call, e.g. "eth_getLogs:5,debug_traceTransaction:50". Unlisted
+	// methods cost one credit.
+	MethodCosts map[string]int64
+
+	// MaxBatchSize caps the number of calls in a JSON-RPC batch; 0 disables
+	// the cap. Each call of a batch is charged separately either way.
+	MaxBatchSize int
+	// BatchSplitSize, when positive, splits JSON-RPC batches of more calls
+	// into batches of this many, sent to the upstreams in parallel.
+	BatchSplitSize int
+	// MaxRequestBytes caps the size of a request body; 0 disables the cap.
+	MaxRequestBytes int
+	// MaxResponseBytes caps the size of an upstream response; 0 disables
+	// the cap. Responses are streamed, so only this bounds a huge one.
+	MaxResponseBytes int
+	// StreamFlushInterval is how often a response being streamed to the
+	// client is flushed; negative flushes after every write.
+	StreamFlushInterval time.Duration
+
+	// PayAndCall proxies the JSON-RPC body of a paying request in the same
+	// round trip, returning the new token alongside the RPC response.
+	PayAndCall bool
+
+	// PaymentHeaderPreference selects which payment header wins when a request
+	// carries both: "payment-signature" (default) or "x-payment".
+	PaymentHeaderPreference string
+
+	// TokenRateLimitRPS, when > 0, is embedded in every issued token as its
+	// sustained requests-per-second limit. TokenRateLimitBurst is the bucket
+	// size (defaults to the RPS rounded up).
+	TokenRateLimitRPS   float64
+	TokenRateLimitBurst int
+	// MaxInFlight and MaxInFlightPerToken, when > 0, cap the requests
+	// proxied at once, in all and per token; requests past them are
+	// answered 429 with Retry-After, without charging credits.
+	MaxInFlight         int
+	MaxInFlightPerToken int
+
+	// CORSAllowedOrigins lets pages from these origins call the gateway from
+	// a browser and read its payment headers, e.g.
+	// "https://app.example.com,https://wallet.example.org"; "*" allows any.
+	// CORS is disabled when empty.
+	CORSAllowedOrigins []string
+
+	// CORSMaxAge is how long browsers may cache a preflight response.
+	CORSMaxAge time.Duration
+
+	// AccessLogSample is the share of requests, from 0 to 1, logged with a
+	// line each: request ID, token or payer, methods, upstreams, credits
+	// left, status and latency. 0 disables the access log, for deployments
+	// that must not keep a record of who called what.
+	AccessLogSample float64
+
+	// AuditLogPath, when set, is the file every token issued, credit spent,
+	// refunded or added, revocation, payment and settlement is appended to,
+	// one JSON record per line. With AuditLogHashChain each record carries
+	// the hash of the one before, so editing or removing one is evident.
+	AuditLogPath      string
+	AuditLogHashChain bool
+
+	// Ledger keeps a double-entry ledger, in the token store, of every
+	// payment, settlement and credit issued, spent, refunded or forfeited,
+	// refusing entries that would leave an account on the wrong side of zero.
+	Ledger bool
+
+	// Reconcile compares, every day, the USDC transfers to GatewayPayTo on
+	// the settlement chain with the ledger's settlements, logging transfers
+	// no credits were issued for and credits issued without a transfer.
+	// Requires Ledger and an eip155: Network.
+	Reconcile bool
+
+	// TrustedProxies are the reverse proxies and load balancers, as CIDR
+	// ranges or addresses, whose X-Forwarded-For header is believed: a
+	// request from one is taken to come from the client the header names,
+	// so the free tier counts clients rather than the proxy. Empty trusts
+	// none, for a gateway facing the internet directly.
+	TrustedProxies []string
+
+	// BazaarURL, when set, is an x402 discovery service (bazaar) endpoint the
+	// gateway publishes its listing to — URL, offers, network, description —
+	// every BazaarRefreshInterval, so agents can find it. BazaarAPIKey is sent
+	// as a bearer token if the service requires one.
+	BazaarURL             string
+	BazaarAPIKey          string
+	BazaarRefreshInterval time.Duration
+
+	// WebhookURL, when set, receives payment and settlement events as JSON
+	// POSTs signed with WebhookSecret (HMAC-SHA256). WebhookEvents limits the
+	// event types sent; all are sent when empty.
+	WebhookURL    string
+	WebhookSecret string
+	WebhookEvents []string
+
+	// EventBus, when "nats" or "kafka", publishes payment, settlement and
+	// usage events to EventBusURL: a NATS server, or for "kafka" the HTTP URL
+	// of a Kafka REST proxy, not a broker address, since the gateway does not
+	// speak the Kafka protocol. Each event goes to the subject or topic
+	// "<EventBusTopicPrefix>.<type>".
+	// EventBusToken authenticates to the bus, and EventBusEvents limits the
+	// event types sent.
+	EventBus            string
+	EventBusURL         string
+	EventBusToken       string
+	EventBusTopicPrefix string
+	EventBusEvents      []string
+
 	// Port is the HTTP listen port.
 	Port int
+
+	// TLSCert and TLSKey are the PEM certificate, chain included, and key
+	// Port is served with over HTTPS. They are read again when they change,
+	// so a renewed certificate is picked up without a restart.
+	TLSCert string
+	TLSKey  string
+	// TLSAutocert serves Port over HTTPS with certificates obtained from
+	// Let's Encrypt, over ACME, for GatewayURL's host, kept in
+	// TLSAutocertDir. TLSAutocertEmail is the contact for the ACME account.
+	TLSAutocert      bool
+	TLSAutocertDir   string
+	TLSAutocertEmail string
+	// TLSHTTPPort, when set with TLS, also serves plain HTTP on this port,
+	// answering ACME HTTP challenges and redirecting the rest to GatewayURL.
+	TLSHTTPPort int
+
+	// TokenStore selects the token counter backend: "memory" (default),
+	// "bolt" (embedded file, single node) or "postgres".
+	TokenStore string
+
+	// BoltPath is the database file used when TokenStore is "bolt".
+	BoltPath string
+
+	// SnapshotPath, when set with the memory TokenStore, is where token counters
+	// and the replay cache are saved on shutdown and restored from on boot.
+	SnapshotPath string
+
+	// CreditMode selects how purchased credits are held: "token" (default, one
+	// counter per JWT) or "account" (one shared balance per payer address).
+	CreditMode string
+
+	// AdminToken is the bearer secret for the operator API under /admin/.
+	// The admin API is disabled when neither it nor AdminClientCA is set.
+	// Setting either requires AdminAddr, or AdminSharedPort to keep the
+	// admin API on Port as it was before it had a listener of its own.
+	AdminToken string
+	// AdminDebug serves pprof profiles, goroutine dumps and runtime metrics
+	// under /admin/debug/, behind the admin API's authentication.
+	AdminDebug bool
+	// AdminAddr is the host:port the admin API is served on, by a listener
+	// of its own. It is required when the admin API is enabled, unless
+	// AdminSharedPort is set.
+	AdminAddr string
+	// AdminSharedPort serves the admin API under /admin/ on Port, where
+	// paying clients reach it, instead of on AdminAddr. It must be asked for
+	// explicitly.
+	AdminSharedPort bool
+	// AdminTLSCert and AdminTLSKey are the PEM certificate and key the
+	// admin listener serves TLS with. AdminClientCA is a PEM bundle of the
+	// CAs trusted to sign operators' client certificates: set, the listener
+	// takes only connections with one, and AdminToken becomes optional. Like
+	// AdminToken, AdminClientCA requires AdminAddr or AdminSharedPort.
+	AdminTLSCert  string
+	AdminTLSKey   string
+	AdminClientCA string
+
+	// ReplayCacheMaxEntries caps the in-memory replay cache. Payments are
+	// rejected with 503 while it is full of unexpired authorizations.
+	ReplayCacheMaxEntries int
+
+	// DatabaseURL is the PostgreSQL connection string used when TokenStore is "postgres".
+	DatabaseURL string
+}
+
+// PricingTier is one credit pack: Amount USDC atomic units buys Credits calls,
+// limited to Methods when non-empty.
+type PricingTier struct {
+	Amount  int64
+	Credits int64
+	Methods []string
+}
+
+// Asset is an additional payment token and, optionally, its own credit packs.
+// Network, Decimals and MinAmount are only set for TokenRegistry entries.
+type Asset struct {
+	Network       string
+	Address       string
+	DomainName    string
+	DomainVersion string
+	Decimals      int
+	MinAmount     int64
+	Tiers         []PricingTier
+	Permit2       bool
+}
+
+// Coupon is a promotional code: Discount percent off every pack and Bonus
+// percent more credits, until Expires when set.
+type Coupon struct {
+	Code     string
+	Discount int64
+	Bonus    int64
+	Expires  time.Time
+}
+
+// NetworkFacilitator routes the payments made on Network to a facilitator:
+// the remote one at FacilitatorURL, or else the local facilitator settling
+// through SettlementRPCURL.
+type NetworkFacilitator struct {
+	Network          string
+	FacilitatorURL   string
+	SettlementRPCURL string
+}
+
+// HTTPRoute serves the HTTP API at UpstreamURL under Prefix, at Credits per
+// request, to requests of Methods or, if none are listed, of any method.
+type HTTPRoute struct {
+	Prefix      string
+	UpstreamURL string
+	Credits     int64
+	Methods     []string
+}
+
+// RPCRoute serves the JSON-RPC node at UpstreamURL under Prefix, paid for
+// on Network with Tiers, when set, as its credit packs.
+type RPCRoute struct {
+	Prefix      string
+	UpstreamURL string
+	Network     string
+	Tiers       []PricingTier
+}
+
+// PriceFeed is a Chainlink TOKEN/USD feed pricing an accepted asset.
+type PriceFeed struct {
+	Asset    string
+	Feed     string
+	Decimals int
 }
 
 // Load reads configuration from environment variables.
 // A .env file in the working directory is loaded if present (dev convenience).
 func Load() (*Config, error) {
 	_ = godotenv.Load() // no-op if .env absent (production uses real env vars)
+	env := &envReader{}
 	cfg := &Config{
-		UpstreamRPCURL:    getEnv("UPSTREAM_RPC_URL", "https://sepolia.base.org"),
-		GatewayPayTo:      getEnv("GATEWAY_PAY_TO", ""),
-		USDCAddress:       getEnv("USDC_ADDRESS", "0x036CbD53842c5426634E7929541eC2318f3dCF7e"),
-		USDCDomainName:    getEnv("USDC_DOMAIN_NAME", "USDC"),
-		USDCDomainVersion: getEnv("USDC_DOMAIN_VERSION", "2"),
-		GatewayURL:        getEnv("GATEWAY_URL", "http://localhost:8080"),
-		FacilitatorURL:    getEnv("FACILITATOR_URL", ""),
-		GatewayPrivateKey: getEnv("GATEWAY_PRIVATE_KEY", ""),
-		SettlementRPCURL:  getEnv("SETTLEMENT_RPC_URL", "https://sepolia.base.org"),
-		Network:           getEnv("NETWORK", "eip155:84532"),
-		PricePerRequest:   int64(getEnvInt("PRICE_PER_REQUEST", 100)),
-		MaxAmountRequired: int64(getEnvInt("MAX_AMOUNT_REQUIRED", 10000)),
-		Port:              getEnvInt("PORT", 8080),
-		TokenExpiry:       time.Duration(getEnvInt("TOKEN_EXPIRY_HOURS", 168)) * time.Hour, // 7 days
+		UpstreamRPCURL:      getEnv("UPSTREAM_RPC_URL", "https://sepolia.base.org"),
+		GatewayPayTo:        getEnv("GATEWAY_PAY_TO", ""),
+		USDCAddress:         getEnv("USDC_ADDRESS", "0x036CbD53842c5426634e7929541eC2318f3dCF7e"),
+		USDCDomainName:      getEnv("USDC_DOMAIN_NAME", "USDC"),
+		USDCDomainVersion:   getEnv("USDC_DOMAIN_VERSION", "2"),
+		GatewayURL:          getEnv("GATEWAY_URL", "http://localhost:8080"),
+		FacilitatorURL:      getEnv("FACILITATOR_URL", ""),
+		GatewayPrivateKey:   getEnv("GATEWAY_PRIVATE_KEY", ""),
+		SettlementRPCURL:    getEnv("SETTLEMENT_RPC_URL", "https://sepolia.base.org"),
+		Network:             getEnv("NETWORK", "eip155:84532"),
+		PricePerRequest:     int64(env.int("PRICE_PER_REQUEST", 100)),
+		MaxAmountRequired:   int64(env.int("MAX_AMOUNT_REQUIRED", 10000)),
+		Port:                env.int("PORT", 8080),
+		TokenExpiry:         env.duration("TOKEN_EXPIRY", env.duration("TOKEN_EXPIRY_HOURS", 168*time.Hour, time.Hour), 0), // 7 days
+		PayAndCall:          env.bool("PAY_AND_CALL", false),
+		TokenRateLimitRPS:   env.float("TOKEN_RATE_LIMIT_RPS", 0),
+		TokenRateLimitBurst: env.int("TOKEN_RATE_LIMIT_BURST", 0),
+		MaxInFlight:         env.int("MAX_IN_FLIGHT", 0),
+		MaxInFlightPerToken: env.int("MAX_IN_FLIGHT_PER_TOKEN", 0),
+		TokenStore:          getEnv("TOKEN_STORE", "memory"),
+		DatabaseURL:         getEnv("DATABASE_URL", ""),
+		BoltPath:            getEnv("BOLT_PATH", "gateway.db"),
+		SnapshotPath:        getEnv("SNAPSHOT_PATH", ""),
+		CreditMode:          getEnv("CREDIT_MODE", "token"),
+		AdminToken:          getEnv("ADMIN_TOKEN", ""),
+
+		UpstreamFallbackRPCURL:      getEnv("UPSTREAM_FALLBACK_RPC_URL", ""),
+		UpstreamChainID:             env.int("UPSTREAM_CHAIN_ID", 0),
+		ChainCheckInterval:          env.duration("CHAIN_CHECK_MINUTES", 10*time.Minute, time.Minute),
+		EgressProxyURL:              getEnv("EGRESS_PROXY_URL", ""),
+		UpstreamDialTimeout:         env.duration("UPSTREAM_DIAL_TIMEOUT_SECONDS", 30*time.Second, time.Second),
+		UpstreamTLSTimeout:          env.duration("UPSTREAM_TLS_TIMEOUT_SECONDS", 10*time.Second, time.Second),
+		UpstreamHeaderTimeout:       env.duration("UPSTREAM_HEADER_TIMEOUT_SECONDS", 0, time.Second),
+		UpstreamMaxIdleConns:        env.int("UPSTREAM_MAX_IDLE_CONNS", 100),
+		UpstreamMaxIdleConnsPerHost: env.int("UPSTREAM_MAX_IDLE_CONNS_PER_HOST", 100),
+		UpstreamMaxConnsPerHost:     env.int("UPSTREAM_MAX_CONNS_PER_HOST", 0),
+		PrivacyShuffle:              env.duration("PRIVACY_SHUFFLE_MINUTES", 10*time.Minute, time.Minute),
+		ArchiveRPCURL:               getEnv("ARCHIVE_RPC_URL", ""),
+		VerifyNetwork:               getEnv("VERIFY_NETWORK", "mainnet"),
+		VerifiedCallCost:            env.int("VERIFIED_CALL_COST", 1),
+		UpstreamWSURL:               getEnv("UPSTREAM_WS_URL", ""),
+		WSNotificationsPerCredit:    env.int("WS_NOTIFICATIONS_PER_CREDIT", 10),
+		UpstreamFallbackWSURL:       getEnv("UPSTREAM_FALLBACK_WS_URL", ""),
+		WSSubscriptionCost:          env.int("WS_SUBSCRIPTION_COST", 10),
+		ResponseCache:               getEnv("RESPONSE_CACHE", ""),
+		ResponseCacheMaxEntries:     env.int("RESPONSE_CACHE_MAX_ENTRIES", 10_000),
+		RedisURL:                    getEnv("REDIS_URL", ""),
+		CoalesceRequests:            env.bool("COALESCE_REQUESTS", false),
+		HeadCacheTTL:                env.duration("HEAD_CACHE_MS", 0, time.Millisecond),
+		CacheHitCost:                env.int("CACHE_HIT_COST", -1),
+		ReplayCacheMaxEntries:       env.int("REPLAY_CACHE_MAX_ENTRIES", 100_000),
+		PaymentHeaderPreference:     getEnv("PAYMENT_HEADER_PREFERENCE", "payment-signature"),
+		FacilitatorFailover:         env.bool("FACILITATOR_FAILOVER", false),
+		FacilitatorVerifyTimeout:    env.duration("FACILITATOR_VERIFY_TIMEOUT_SECONDS", 10*time.Second, time.Second),
+		FacilitatorSettleTimeout:    env.duration("FACILITATOR_SETTLE_TIMEOUT_SECONDS", 30*time.Second, time.Second),
+		FacilitatorVerifyRetries:    env.int("FACILITATOR_VERIFY_RETRIES", 2),
+		FacilitatorTLSCert:          getEnv("FACILITATOR_TLS_CERT", ""),
+		FacilitatorTLSKey:           getEnv("FACILITATOR_TLS_KEY", ""),
+		FacilitatorCAFile:           getEnv("FACILITATOR_CA_FILE", ""),
+		FacilitatorServer:           env.bool("FACILITATOR_SERVER", false),
+		FacilitatorServerToken:      getEnv("FACILITATOR_SERVER_TOKEN", ""),
+		ReceiveWithAuthorization:    env.bool("RECEIVE_WITH_AUTHORIZATION", false),
+		UptoPayments:                env.bool("UPTO_PAYMENTS", false),
+		AsyncSettlement:             env.bool("ASYNC_SETTLEMENT", false),
+		SettlementBatchSize:         env.int("SETTLEMENT_BATCH_SIZE", 0),
+		SettlementConfirmations:     env.int("SETTLEMENT_CONFIRMATIONS", 0),
+		SettlementReorgBlocks:       env.int("SETTLEMENT_REORG_BLOCKS", 0),
+		SettlementStuckAfter:        env.duration("SETTLEMENT_STUCK_SECONDS", 120*time.Second, time.Second),
+		SettlementMinValidity:       env.duration("SETTLEMENT_MIN_VALIDITY_SECONDS", 30*time.Second, time.Second),
+		SettlementMaxFeeGwei:        env.float("SETTLEMENT_MAX_FEE_GWEI", 0),
+		SettlementLegacyTx:          env.bool("SETTLEMENT_LEGACY_TX", false),
+		MaxBatchSize:                env.int("MAX_BATCH_SIZE", 100),
+		MaxRequestBytes:             env.int("MAX_REQUEST_BYTES", 5<<20),
+		MaxResponseBytes:            env.int("MAX_RESPONSE_BYTES", 1<<30),
+		StreamFlushInterval:         env.duration("STREAM_FLUSH_MS", 100*time.Millisecond, time.Millisecond),
+		BatchSplitSize:              env.int("BATCH_SPLIT_SIZE", 0),
+		FreeRequestsPerDay:          env.int("FREE_REQUESTS_PER_DAY", 0),
+		USDPricePerRequest:          env.float("USD_PRICE_PER_REQUEST", 0),
+		PriceRefreshInterval:        env.duration("PRICE_REFRESH_SECONDS", 60*time.Second, time.Second),
+		PriceMaxAge:                 env.duration("PRICE_MAX_AGE_SECONDS", 3600*time.Second, time.Second),
+		CORSMaxAge:                  env.duration("CORS_MAX_AGE_SECONDS", 600*time.Second, time.Second),
+		AccessLogSample:             env.float("ACCESS_LOG_SAMPLE", 1),
+		AuditLogPath:                getEnv("AUDIT_LOG_PATH", ""),
+		AuditLogHashChain:           env.bool("AUDIT_LOG_HASH_CHAIN", true),
+		Ledger:                      env.bool("LEDGER", false),
+		Reconcile:                   env.bool("RECONCILE", false),
+		AdminDebug:                  env.bool("ADMIN_DEBUG", false),
+		TLSCert:                     getEnv("TLS_CERT", ""),
+		TLSKey:                      getEnv("TLS_KEY", ""),
+		TLSAutocert:                 env.bool("TLS_AUTOCERT", false),
+		TLSAutocertDir:              getEnv("TLS_AUTOCERT_DIR", "autocert"),
+		TLSAutocertEmail:            getEnv("TLS_AUTOCERT_EMAIL", ""),
+		TLSHTTPPort:                 env.int("TLS_HTTP_PORT", 0),
+		AdminAddr:                   getEnv("ADMIN_ADDR", ""),
+		AdminSharedPort:             env.bool("ADMIN_SHARED_PORT", false),
+		AdminTLSCert:                getEnv("ADMIN_TLS_CERT", ""),
+		AdminTLSKey:                 getEnv("ADMIN_TLS_KEY", ""),
+		AdminClientCA:               getEnv("ADMIN_CLIENT_CA", ""),
+		BazaarURL:                   getEnv("BAZAAR_URL", ""),
+		BazaarAPIKey:                getEnv("BAZAAR_API_KEY", ""),
+		BazaarRefreshInterval:       env.duration("BAZAAR_REFRESH_MINUTES", 60*time.Minute, time.Minute),
+		WebhookURL:                  getEnv("WEBHOOK_URL", ""),
+		WebhookSecret:               getEnv("WEBHOOK_SECRET", ""),
+		EventBus:                    getEnv("EVENT_BUS", ""),
+		EventBusURL:                 getEnv("EVENT_BUS_URL", ""),
+		EventBusToken:               getEnv("EVENT_BUS_TOKEN", ""),
+		EventBusTopicPrefix:         getEnv("EVENT_BUS_TOPIC_PREFIX", "x402"),
+
+		SettlementTipMultiplier:      env.float("SETTLEMENT_TIP_MULTIPLIER", 1),
+		FacilitatorRequireSupport:    env.bool("FACILITATOR_REQUIRE_SUPPORT", false),
+		SettlementBaseFeeMultiplier:  env.float("SETTLEMENT_BASE_FEE_MULTIPLIER", 2),
+		SettlementGasPriceMultiplier: env.float("SETTLEMENT_GAS_PRICE_MULTIPLIER", 1),
+		RelayerSigner:                getEnv("RELAYER_SIGNER", "key"),
+		RelayerKeystore:              getEnv("RELAYER_KEYSTORE", ""),
+		RelayerKeystorePassword:      getEnv("RELAYER_KEYSTORE_PASSWORD", ""),
+		RelayerSignerURL:             getEnv("RELAYER_SIGNER_URL", ""),
+		RelayerSignerAddress:         getEnv("RELAYER_SIGNER_ADDRESS", ""),
+		RelayerKMSKey:                getEnv("RELAYER_KMS_KEY", ""),
+		AWSRegion:                    getEnv("AWS_REGION", getEnv("AWS_DEFAULT_REGION", "")),
+		AWSAccessKeyID:               getEnv("AWS_ACCESS_KEY_ID", ""),
+		AWSSecretAccessKey:           getEnv("AWS_SECRET_ACCESS_KEY", ""),
+		AWSSessionToken:              getEnv("AWS_SESSION_TOKEN", ""),
+		GCPCredentialsFile:           getEnv("GOOGLE_APPLICATION_CREDENTIALS", ""),
+		SecretsProvider:              getEnv("SECRETS_PROVIDER", ""),
+		JWTSecretRef:                 getEnv("JWT_SECRET_REF", ""),
+		GatewayPrivateKeyRef:         getEnv("GATEWAY_PRIVATE_KEY_REF", ""),
+		VaultAddr:                    getEnv("VAULT_ADDR", ""),
+		VaultToken:                   getEnv("VAULT_TOKEN", ""),
+		VaultNamespace:               getEnv("VAULT_NAMESPACE", ""),
+		SecretsRefresh:               env.duration("SECRETS_REFRESH_MINUTES", 0, time.Minute),
+		SolanaFeePayerKey:            getEnv("SOLANA_FEE_PAYER_KEY", ""),
+		SolanaFeePayer:               getEnv("SOLANA_FEE_PAYER", ""),
+	}
+	if err := env.err(); err != nil {
+		return nil, err
+	}
+	if cfg.Port < 1 || cfg.Port > 65535 {
+		return nil, fmt.Errorf("PORT must be between 1 and 65535, got %d", cfg.Port)
+	}
+	if cfg.TokenExpiry <= 0 {
+		return nil, fmt.Errorf("TOKEN_EXPIRY must be positive")
+	}
+	if cfg.UpstreamChainID < 0 || cfg.ChainCheckInterval < 0 {
+		return nil, fmt.Errorf("UPSTREAM_CHAIN_ID and CHAIN_CHECK_MINUTES must not be negative")
+	}
+	if cfg.SolanaNetwork() {
+		cluster, known := solanaClusters[cfg.Network]
+		if getEnv("USDC_ADDRESS", "") == "" {
+			if !known {
+				return nil, fmt.Errorf("NETWORK %s requires USDC_ADDRESS, the USDC mint on that cluster", cfg.Network)
+			}
+			cfg.USDCAddress = cluster.usdcMint
+		}
+		if getEnv("SETTLEMENT_RPC_URL", "") == "" {
+			if !known {
+				return nil, fmt.Errorf("NETWORK %s requires SETTLEMENT_RPC_URL", cfg.Network)
+			}
+			cfg.SettlementRPCURL = cluster.rpcURL
+		}
 	}
 
-	// Payment-related fields are only required when a facilitator is configured.
-	if cfg.FacilitatorURL != "" {
-		jwtHex := getEnv("JWT_SECRET", "")
-		if jwtHex == "" {
-			return nil, fmt.Errorf("JWT_SECRET env var is required when FACILITATOR_URL is set (32-byte hex)")
+	// A mistyped payee is advertised all the same, and what is paid to it
+	// is lost; catch it here rather than on the first payment.
+	if !cfg.SolanaNetwork() {
+		if cfg.GatewayPayTo != "" {
+			if err := checkPayee("GATEWAY_PAY_TO", cfg.GatewayPayTo); err != nil {
+				return nil, err
+			}
+		}
+		if err := checkPayee("USDC_ADDRESS", cfg.USDCAddress); err != nil {
+			return nil, err
+		}
+	}
+
+	tiers, err := parsePricingTiers(getEnv("PRICING_TIERS", ""))
+	if err != nil {
+		return nil, fmt.Errorf("PRICING_TIERS: %w", err)
+	}
+	cfg.PricingTiers = tiers
+
+	assets, err := parseAssets(getEnv("ACCEPTED_ASSETS", ""))
+	if err != nil {
+		return nil, fmt.Errorf("ACCEPTED_ASSETS: %w", err)
+	}
+	cfg.ExtraAssets = assets
+
+	routes, err := parseNetworkFacilitators(getEnv("NETWORK_FACILITATORS", ""))
+	if err != nil {
+		return nil, fmt.Errorf("NETWORK_FACILITATORS: %w", err)
+	}
+	cfg.NetworkFacilitators = routes
+
+	httpRoutes, err := parseHTTPRoutes(getEnv("HTTP_ROUTES", ""))
+	if err != nil {
+		return nil, fmt.Errorf("HTTP_ROUTES: %w", err)
+	}
+	cfg.HTTPRoutes = httpRoutes
+
+	rpcRoutes, err := parseRPCRoutes(getEnv("RPC_ROUTES", ""))
+	if err != nil {
+		return nil, fmt.Errorf("RPC_ROUTES: %w", err)
+	}
+	for i, r := range rpcRoutes {
+		if r.Network == "" {
+			rpcRoutes[i].Network = cfg.Network
+		} else if r.Network != cfg.Network && !cfg.routed(r.Network) {
+			return nil, fmt.Errorf("RPC_ROUTES: route %s: network %s is not NETWORK or one of NETWORK_FACILITATORS", r.Prefix, r.Network)
+		}
+		for _, h := range cfg.HTTPRoutes {
+			if h.Prefix == r.Prefix {
+				return nil, fmt.Errorf("RPC_ROUTES: prefix %s is also in HTTP_ROUTES", r.Prefix)
+			}
+		}
+	}
+	cfg.RPCRoutes = rpcRoutes
+
+	registry, err := parseTokenRegistry(getEnv("TOKEN_REGISTRY", ""))
+	if err != nil {
+		return nil, fmt.Errorf("TOKEN_REGISTRY: %w", err)
+	}
+	for _, a := range registry {
+		if a.Network == cfg.Network || cfg.routed(a.Network) {
+			cfg.TokenRegistry = append(cfg.TokenRegistry, a)
+		}
+	}
+	if len(registry) > 0 && !cfg.listsTokens(cfg.Network) {
+		return nil, fmt.Errorf("TOKEN_REGISTRY lists no tokens for NETWORK %s", cfg.Network)
+	}
+	for _, r := range cfg.NetworkFacilitators {
+		if !cfg.listsTokens(r.Network) {
+			return nil, fmt.Errorf("NETWORK_FACILITATORS: TOKEN_REGISTRY lists no tokens for %s", r.Network)
+		}
+	}
+	if len(cfg.TokenRegistry) > 0 && len(cfg.ExtraAssets) > 0 {
+		return nil, fmt.Errorf("ACCEPTED_ASSETS cannot be combined with TOKEN_REGISTRY; list the tokens in the registry")
+	}
+
+	cfg.FreeMethods = parseList(getEnv("FREE_METHODS", ""))
+	cfg.QuorumRPCURLs = parseList(getEnv("QUORUM_RPC_URLS", ""))
+	cfg.PrivacyRPCURLs = parseList(getEnv("PRIVACY_RPC_URLS", ""))
+	cfg.VerifyBeaconURLs = parseList(getEnv("VERIFY_BEACON_URLS", ""))
+	cfg.QuorumMethods = parseList(getEnv("QUORUM_METHODS", "eth_call,eth_getBalance,eth_getCode,eth_getStorageAt,eth_getTransactionCount,eth_getTransactionReceipt"))
+	cfg.ArchiveRoutes = parseList(getEnv("ARCHIVE_ROUTES", "debug_*,trace_*,eth_call:128,eth_getBalance:128,eth_getCode:128,eth_getProof:128,eth_getStorageAt:128,eth_getTransactionCount:128"))
+	cfg.AllowedMethods = parseList(getEnv("ALLOWED_METHODS", ""))
+	cfg.DeniedMethods = parseList(getEnv("DENIED_METHODS", "admin_*,personal_*,miner_*"))
+	cfg.CORSAllowedOrigins = parseList(getEnv("CORS_ALLOWED_ORIGINS", ""))
+	cfg.TrustedProxies = parseList(getEnv("TRUSTED_PROXIES", ""))
+	for _, p := range cfg.TrustedProxies {
+		var err error
+		if strings.Contains(p, "/") {
+			_, err = netip.ParsePrefix(p)
+		} else {
+			_, err = netip.ParseAddr(p)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("TRUSTED_PROXIES: %w", err)
+		}
+	}
+	cfg.WebhookEvents = parseList(getEnv("WEBHOOK_EVENTS", ""))
+	cfg.EventBusEvents = parseList(getEnv("EVENT_BUS_EVENTS", ""))
+	cfg.RelayerKeys = parseList(getEnv("RELAYER_KEYS", ""))
+
+	switch cfg.RelayerSigner {
+	case "key":
+	case "keystore":
+		if cfg.RelayerKeystore == "" {
+			return nil, fmt.Errorf("RELAYER_SIGNER=keystore requires RELAYER_KEYSTORE")
+		}
+	case "external":
+		if cfg.RelayerSignerURL == "" || cfg.RelayerSignerAddress == "" {
+			return nil, fmt.Errorf("RELAYER_SIGNER=external requires RELAYER_SIGNER_URL and RELAYER_SIGNER_ADDRESS")
+		}
+	case "aws-kms", "gcp-kms":
+		if cfg.RelayerKMSKey == "" {
+			return nil, fmt.Errorf("RELAYER_SIGNER=%s requires RELAYER_KMS_KEY", cfg.RelayerSigner)
+		}
+		if cfg.RelayerSigner == "aws-kms" && (cfg.AWSRegion == "" || cfg.AWSAccessKeyID == "" || cfg.AWSSecretAccessKey == "") {
+			return nil, fmt.Errorf("RELAYER_SIGNER=aws-kms requires AWS_REGION, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
 		}
-		secret, err := hex.DecodeString(jwtHex)
+	default:
+		return nil, fmt.Errorf("RELAYER_SIGNER must be \"key\", \"keystore\", \"external\", \"aws-kms\" or \"gcp-kms\", got %q", cfg.RelayerSigner)
+	}
+	if cfg.RelayerSigner != "key" && (cfg.GatewayPrivateKey != "" || cfg.GatewayPrivateKeyRef != "") {
+		return nil, fmt.Errorf("GATEWAY_PRIVATE_KEY cannot be set with RELAYER_SIGNER=%s", cfg.RelayerSigner)
+	}
+	switch cfg.SecretsProvider {
+	case "":
+		if cfg.JWTSecretRef != "" || cfg.GatewayPrivateKeyRef != "" {
+			return nil, fmt.Errorf("JWT_SECRET_REF and GATEWAY_PRIVATE_KEY_REF require SECRETS_PROVIDER")
+		}
+	case "vault":
+		if cfg.VaultAddr == "" || cfg.VaultToken == "" {
+			return nil, fmt.Errorf("SECRETS_PROVIDER=vault requires VAULT_ADDR and VAULT_TOKEN")
+		}
+	case "aws-sm":
+		if cfg.AWSRegion == "" || cfg.AWSAccessKeyID == "" || cfg.AWSSecretAccessKey == "" {
+			return nil, fmt.Errorf("SECRETS_PROVIDER=aws-sm requires AWS_REGION, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+		}
+	case "gcp-sm":
+	default:
+		return nil, fmt.Errorf("SECRETS_PROVIDER must be \"vault\", \"aws-sm\" or \"gcp-sm\", got %q", cfg.SecretsProvider)
+	}
+	if cfg.SecretsProvider != "" && cfg.JWTSecretRef == "" && cfg.GatewayPrivateKeyRef == "" {
+		return nil, fmt.Errorf("SECRETS_PROVIDER requires JWT_SECRET_REF or GATEWAY_PRIVATE_KEY_REF")
+	}
+	if cfg.GatewayPrivateKeyRef != "" && cfg.GatewayPrivateKey != "" {
+		return nil, fmt.Errorf("GATEWAY_PRIVATE_KEY and GATEWAY_PRIVATE_KEY_REF cannot both be set")
+	}
+	if cfg.SecretsRefresh < 0 {
+		return nil, fmt.Errorf("SECRETS_REFRESH_MINUTES must not be negative")
+	}
+	if cfg.FacilitatorServer && !cfg.LocalFacilitator() {
+		return nil, fmt.Errorf("FACILITATOR_SERVER requires the local facilitator (GATEWAY_PRIVATE_KEY or RELAYER_SIGNER, without FACILITATOR_URL)")
+	}
+	if cfg.FacilitatorVerifyTimeout <= 0 || cfg.FacilitatorSettleTimeout <= 0 {
+		return nil, fmt.Errorf("FACILITATOR_VERIFY_TIMEOUT_SECONDS and FACILITATOR_SETTLE_TIMEOUT_SECONDS must be positive")
+	}
+	if cfg.FacilitatorVerifyRetries < 0 {
+		return nil, fmt.Errorf("FACILITATOR_VERIFY_RETRIES must not be negative")
+	}
+	if (cfg.FacilitatorTLSCert == "") != (cfg.FacilitatorTLSKey == "") {
+		return nil, fmt.Errorf("FACILITATOR_TLS_CERT and FACILITATOR_TLS_KEY must be set together")
+	}
+	if (cfg.FacilitatorTLSCert != "" || cfg.FacilitatorCAFile != "") && !cfg.remoteFacilitator() {
+		return nil, fmt.Errorf("FACILITATOR_TLS_CERT, FACILITATOR_TLS_KEY and FACILITATOR_CA_FILE require a remote facilitator (FACILITATOR_URL or a NETWORK_FACILITATORS URL)")
+	}
+	if cfg.FacilitatorFailover && (cfg.FacilitatorURL == "" || !cfg.hasRelayerSigner()) {
+		return nil, fmt.Errorf("FACILITATOR_FAILOVER requires FACILITATOR_URL and a relayer signer (GATEWAY_PRIVATE_KEY or RELAYER_SIGNER) for the local facilitator")
+	}
+	if len(cfg.NetworkFacilitators) > 0 {
+		switch {
+		case cfg.SolanaNetwork():
+			return nil, fmt.Errorf("NETWORK_FACILITATORS is not supported on Solana networks")
+		case cfg.FacilitatorURL == "" && !cfg.LocalFacilitator():
+			return nil, fmt.Errorf("NETWORK_FACILITATORS requires a facilitator for NETWORK %s (FACILITATOR_URL, GATEWAY_PRIVATE_KEY or RELAYER_SIGNER)", cfg.Network)
+		}
+		for _, r := range cfg.NetworkFacilitators {
+			if r.Network == cfg.Network {
+				return nil, fmt.Errorf("NETWORK_FACILITATORS: %s is NETWORK, whose facilitator is FACILITATOR_URL or the local facilitator", r.Network)
+			}
+			if r.FacilitatorURL == "" && !cfg.hasRelayerSigner() {
+				return nil, fmt.Errorf("NETWORK_FACILITATORS: local settlement on %s requires a relayer signer (GATEWAY_PRIVATE_KEY or RELAYER_SIGNER)", r.Network)
+			}
+		}
+		// The routing facilitator only verifies and settles, and price feeds
+		// are read on NETWORK.
+		if cfg.SettlementConfirmations > 0 || cfg.SettlementBatchSize > 0 || cfg.SettlementReorgBlocks > 0 || getEnv("PRICE_FEEDS", "") != "" {
+			return nil, fmt.Errorf("NETWORK_FACILITATORS cannot be combined with SETTLEMENT_CONFIRMATIONS, SETTLEMENT_BATCH_SIZE, SETTLEMENT_REORG_BLOCKS or PRICE_FEEDS")
+		}
+	}
+	if cfg.SolanaNetwork() {
+		switch {
+		case cfg.FacilitatorURL != "" && cfg.SolanaFeePayer == "":
+			return nil, fmt.Errorf("NETWORK %s with FACILITATOR_URL requires SOLANA_FEE_PAYER, the facilitator's fee payer address", cfg.Network)
+		case cfg.FacilitatorURL == "" && cfg.SolanaFeePayerKey == "" && cfg.hasRelayerSigner():
+			return nil, fmt.Errorf("NETWORK %s settles with SOLANA_FEE_PAYER_KEY, not GATEWAY_PRIVATE_KEY or RELAYER_SIGNER", cfg.Network)
+		}
+		for _, name := range []string{"ACCEPTED_ASSETS", "TOKEN_REGISTRY", "PERMIT2_ASSETS", "PRICE_FEEDS", "FACILITATOR_FAILOVER", "FACILITATOR_SERVER"} {
+			if v := getEnv(name, ""); v != "" && v != "false" {
+				return nil, fmt.Errorf("%s is not supported on Solana networks", name)
+			}
+		}
+	} else if cfg.SolanaFeePayerKey != "" || cfg.SolanaFeePayer != "" {
+		return nil, fmt.Errorf("SOLANA_FEE_PAYER_KEY and SOLANA_FEE_PAYER require a solana: NETWORK")
+	}
+
+	methodCosts, err := parseMethodCosts(getEnv("METHOD_COSTS", ""))
+	if err != nil {
+		return nil, fmt.Errorf("METHOD_COSTS: %w", err)
+	}
+	cfg.MethodCosts = methodCosts
+
+	permit2Assets, err := parsePermit2Assets(getEnv("PERMIT2_ASSETS", ""))
+	if err != nil {
+		return nil, fmt.Errorf("PERMIT2_ASSETS: %w", err)
+	}
+	cfg.Permit2Assets = permit2Assets
+	if len(cfg.Permit2Assets) > 0 && !cfg.LocalFacilitator() {
+		return nil, fmt.Errorf("PERMIT2_ASSETS requires the local facilitator (GATEWAY_PRIVATE_KEY or RELAYER_SIGNER, without FACILITATOR_URL)")
+	}
+	priceFeeds, err := parsePriceFeeds(getEnv("PRICE_FEEDS", ""))
+	if err != nil {
+		return nil, fmt.Errorf("PRICE_FEEDS: %w", err)
+	}
+	cfg.PriceFeeds = priceFeeds
+	if len(cfg.PriceFeeds) > 0 && cfg.USDPricePerRequest <= 0 {
+		return nil, fmt.Errorf("PRICE_FEEDS requires USD_PRICE_PER_REQUEST")
+	}
+	if len(cfg.PriceFeeds) > 0 && cfg.PriceRefreshInterval <= 0 {
+		return nil, fmt.Errorf("PRICE_REFRESH_SECONDS must be positive")
+	}
+	// Packs below a token's minimum are never offered; catch configured ones
+	// now rather than advertising no packs for it. Oracle-priced amounts are
+	// only known at runtime.
+	for _, a := range cfg.TokenRegistry {
+		fed := false
+		for _, f := range cfg.PriceFeeds {
+			fed = fed || strings.EqualFold(f.Asset, a.Address)
+		}
+		tiers := a.Tiers
+		if len(tiers) == 0 {
+			tiers = cfg.PricingTiers
+		}
+		if len(tiers) == 0 {
+			tiers = []PricingTier{{Amount: cfg.MaxAmountRequired}}
+		}
+		for _, t := range tiers {
+			if !fed && t.Amount < a.MinAmount {
+				return nil, fmt.Errorf("TOKEN_REGISTRY: pack amount %d for token %s is below its minimum %d", t.Amount, a.Address, a.MinAmount)
+			}
+		}
+	}
+
+	coupons, err := parseCoupons(getEnv("COUPONS", ""))
+	if err != nil {
+		return nil, fmt.Errorf("COUPONS: %w", err)
+	}
+	cfg.Coupons = coupons
+
+	if cfg.Reconcile && (!cfg.Ledger || cfg.SolanaNetwork()) {
+		return nil, fmt.Errorf("RECONCILE requires LEDGER and an eip155 NETWORK")
+	}
+
+	if cfg.UptoPayments && len(cfg.Permit2Assets) == 0 {
+		return nil, fmt.Errorf("UPTO_PAYMENTS requires PERMIT2_ASSETS")
+	}
+
+	if cfg.BazaarURL != "" && cfg.BazaarRefreshInterval <= 0 {
+		return nil, fmt.Errorf("BAZAAR_REFRESH_MINUTES must be positive")
+	}
+
+	if cfg.WebhookURL != "" && len(cfg.WebhookSecret) < 16 {
+		return nil, fmt.Errorf("WEBHOOK_SECRET must be at least 16 characters when WEBHOOK_URL is set")
+	}
+
+	switch cfg.EventBus {
+	case "":
+	case "nats", "kafka":
+		if cfg.EventBusURL == "" {
+			return nil, fmt.Errorf("EVENT_BUS_URL is required with EVENT_BUS=%s", cfg.EventBus)
+		}
+	default:
+		return nil, fmt.Errorf("EVENT_BUS must be \"nats\" or \"kafka\", got %q", cfg.EventBus)
+	}
+
+	if cfg.AccessLogSample < 0 || cfg.AccessLogSample > 1 {
+		return nil, fmt.Errorf("ACCESS_LOG_SAMPLE must be between 0 and 1, got %g", cfg.AccessLogSample)
+	}
+
+	if cfg.FreeRequestsPerDay < 0 {
+		return nil, fmt.Errorf("FREE_REQUESTS_PER_DAY must not be negative")
+	}
+
+	for _, u := range []struct{ name, url string }{
+		{"UPSTREAM_WS_URL", cfg.UpstreamWSURL},
+		{"UPSTREAM_FALLBACK_WS_URL", cfg.UpstreamFallbackWSURL},
+	} {
+		if u.url != "" && !strings.HasPrefix(u.url, "ws://") && !strings.HasPrefix(u.url, "wss://") {
+			return nil, fmt.Errorf("%s must be a ws:// or wss:// URL, got %q", u.name, u.url)
+		}
+	}
+	if cfg.UpstreamFallbackWSURL != "" && cfg.UpstreamWSURL == "" {
+		return nil, fmt.Errorf("UPSTREAM_FALLBACK_WS_URL requires UPSTREAM_WS_URL")
+	}
+	if cfg.WSNotificationsPerCredit < 0 || cfg.WSSubscriptionCost < 0 {
+		return nil, fmt.Errorf("WS_NOTIFICATIONS_PER_CREDIT and WS_SUBSCRIPTION_COST must not be negative")
+	}
+
+	if cfg.MaxRequestBytes < 0 || cfg.MaxResponseBytes < 0 || cfg.BatchSplitSize < 0 {
+		return nil, fmt.Errorf("MAX_REQUEST_BYTES, MAX_RESPONSE_BYTES and BATCH_SPLIT_SIZE must not be negative")
+	}
+	if cfg.UpstreamDialTimeout < 0 || cfg.UpstreamTLSTimeout < 0 || cfg.UpstreamHeaderTimeout < 0 {
+		return nil, fmt.Errorf("UPSTREAM_DIAL_TIMEOUT_SECONDS, UPSTREAM_TLS_TIMEOUT_SECONDS and UPSTREAM_HEADER_TIMEOUT_SECONDS must not be negative")
+	}
+	if cfg.UpstreamMaxIdleConns < 0 || cfg.UpstreamMaxIdleConnsPerHost < 0 || cfg.UpstreamMaxConnsPerHost < 0 {
+		return nil, fmt.Errorf("UPSTREAM_MAX_IDLE_CONNS, UPSTREAM_MAX_IDLE_CONNS_PER_HOST and UPSTREAM_MAX_CONNS_PER_HOST must not be negative")
+	}
+	if cfg.VerifiedCallCost < 0 {
+		return nil, fmt.Errorf("VERIFIED_CALL_COST must not be negative")
+	}
+	if len(cfg.PrivacyRPCURLs) > 0 && cfg.PrivacyShuffle <= 0 {
+		return nil, fmt.Errorf("PRIVACY_SHUFFLE_MINUTES must be positive")
+	}
+
+	switch cfg.ResponseCache {
+	case "", "memory":
+	case "redis":
+		if cfg.RedisURL == "" {
+			return nil, fmt.Errorf("REDIS_URL is required when RESPONSE_CACHE=redis")
+		}
+	default:
+		return nil, fmt.Errorf("RESPONSE_CACHE must be \"memory\" or \"redis\", got %q", cfg.ResponseCache)
+	}
+	if cfg.ResponseCacheMaxEntries <= 0 {
+		return nil, fmt.Errorf("RESPONSE_CACHE_MAX_ENTRIES must be positive")
+	}
+	if cfg.HeadCacheTTL < 0 {
+		return nil, fmt.Errorf("HEAD_CACHE_MS must not be negative")
+	}
+
+	if cfg.SettlementStuckAfter < 0 || cfg.SettlementMaxFeeGwei < 0 {
+		return nil, fmt.Errorf("SETTLEMENT_STUCK_SECONDS and SETTLEMENT_MAX_FEE_GWEI must not be negative")
+	}
+	if cfg.SettlementMinValidity < 0 {
+		return nil, fmt.Errorf("SETTLEMENT_MIN_VALIDITY_SECONDS must not be negative")
+	}
+	if cfg.SettlementTipMultiplier <= 0 || cfg.SettlementGasPriceMultiplier <= 0 {
+		return nil, fmt.Errorf("SETTLEMENT_TIP_MULTIPLIER and SETTLEMENT_GAS_PRICE_MULTIPLIER must be positive")
+	}
+	if cfg.SettlementBaseFeeMultiplier < 1 {
+		// A fee cap below the base fee cannot be mined.
+		return nil, fmt.Errorf("SETTLEMENT_BASE_FEE_MULTIPLIER must be at least 1")
+	}
+
+	if cfg.SettlementConfirmations < 0 {
+		return nil, fmt.Errorf("SETTLEMENT_CONFIRMATIONS must not be negative")
+	}
+	if cfg.SettlementConfirmations > 0 && !cfg.LocalFacilitator() {
+		return nil, fmt.Errorf("SETTLEMENT_CONFIRMATIONS requires the local facilitator (GATEWAY_PRIVATE_KEY or RELAYER_SIGNER, without FACILITATOR_URL)")
+	}
+	if cfg.SettlementConfirmations > 0 && cfg.AsyncSettlement {
+		return nil, fmt.Errorf("SETTLEMENT_CONFIRMATIONS and ASYNC_SETTLEMENT cannot both be set")
+	}
+	if cfg.SettlementReorgBlocks < 0 {
+		return nil, fmt.Errorf("SETTLEMENT_REORG_BLOCKS must not be negative")
+	}
+	if cfg.SettlementReorgBlocks > 0 && !cfg.LocalFacilitator() && !cfg.SolanaFacilitator() {
+		return nil, fmt.Errorf("SETTLEMENT_REORG_BLOCKS requires the local facilitator (GATEWAY_PRIVATE_KEY or RELAYER_SIGNER, without FACILITATOR_URL) or SOLANA_FEE_PAYER_KEY")
+	}
+
+	if len(cfg.RelayerKeys) > 0 && !cfg.LocalFacilitator() {
+		return nil, fmt.Errorf("RELAYER_KEYS requires the local facilitator (GATEWAY_PRIVATE_KEY or RELAYER_SIGNER, without FACILITATOR_URL)")
+	}
+
+	if cfg.SettlementBatchSize < 0 {
+		return nil, fmt.Errorf("SETTLEMENT_BATCH_SIZE must not be negative")
+	}
+	if cfg.SettlementBatchSize > 1 && (!cfg.AsyncSettlement || !cfg.LocalFacilitator()) {
+		return nil, fmt.Errorf("SETTLEMENT_BATCH_SIZE requires ASYNC_SETTLEMENT and the local facilitator (GATEWAY_PRIVATE_KEY or RELAYER_SIGNER, without FACILITATOR_URL)")
+	}
+
+	if challengeHex := getEnv("PAYMENT_CHALLENGE_SECRET", ""); challengeHex != "" {
+		secret, err := hex.DecodeString(challengeHex)
 		if err != nil {
-			return nil, fmt.Errorf("JWT_SECRET must be valid hex: %w", err)
+			return nil, fmt.Errorf("PAYMENT_CHALLENGE_SECRET must be valid hex: %w", err)
 		}
 		if len(secret) < 32 {
-			return nil, fmt.Errorf("JWT_SECRET must be at least 32 bytes (64 hex chars)")
+			return nil, fmt.Errorf("PAYMENT_CHALLENGE_SECRET must be at least 32 bytes (64 hex chars)")
+		}
+		cfg.ChallengeSecret = secret
+	}
+
+	if cfg.ReceiveWithAuthorization && !cfg.LocalFacilitator() {
+		return nil, fmt.Errorf("RECEIVE_WITH_AUTHORIZATION requires the local facilitator (GATEWAY_PRIVATE_KEY or RELAYER_SIGNER, without FACILITATOR_URL)")
+	}
+
+	if cfg.PaymentHeaderPreference != "payment-signature" && cfg.PaymentHeaderPreference != "x-payment" {
+		return nil, fmt.Errorf("PAYMENT_HEADER_PREFERENCE must be \"payment-signature\" or \"x-payment\", got %q", cfg.PaymentHeaderPreference)
+	}
+
+	if cfg.TokenRateLimitRPS < 0 || cfg.TokenRateLimitBurst < 0 {
+		return nil, fmt.Errorf("TOKEN_RATE_LIMIT_RPS and TOKEN_RATE_LIMIT_BURST must not be negative")
+	}
+	if cfg.MaxInFlight < 0 || cfg.MaxInFlightPerToken < 0 {
+		return nil, fmt.Errorf("MAX_IN_FLIGHT and MAX_IN_FLIGHT_PER_TOKEN must not be negative")
+	}
+	if cfg.TokenRateLimitRPS > 0 && cfg.TokenRateLimitBurst == 0 {
+		cfg.TokenRateLimitBurst = int(math.Ceil(cfg.TokenRateLimitRPS))
+	}
+
+	if cfg.AdminToken != "" && len(cfg.AdminToken) < 32 {
+		return nil, fmt.Errorf("ADMIN_TOKEN must be at least 32 characters")
+	}
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return nil, fmt.Errorf("TLS_CERT and TLS_KEY must be set together")
+	}
+	if cfg.TLSAutocert {
+		if cfg.TLSCert != "" {
+			return nil, fmt.Errorf("TLS_AUTOCERT and TLS_CERT are exclusive")
+		}
+		u, err := url.Parse(cfg.GatewayURL)
+		if err != nil || u.Scheme != "https" || u.Hostname() == "" {
+			return nil, fmt.Errorf("TLS_AUTOCERT requires an https GATEWAY_URL naming the gateway's host, got %q", cfg.GatewayURL)
+		}
+		if _, err := netip.ParseAddr(u.Hostname()); err == nil || !strings.Contains(u.Hostname(), ".") {
+			return nil, fmt.Errorf("TLS_AUTOCERT requires GATEWAY_URL to name a public DNS host, got %q", u.Hostname())
+		}
+		if cfg.TLSAutocertDir == "" {
+			return nil, fmt.Errorf("TLS_AUTOCERT requires TLS_AUTOCERT_DIR")
+		}
+	}
+	if cfg.TLSHTTPPort != 0 {
+		if !cfg.TLS() {
+			return nil, fmt.Errorf("TLS_HTTP_PORT requires TLS_CERT or TLS_AUTOCERT")
+		}
+		if cfg.TLSHTTPPort < 1 || cfg.TLSHTTPPort > 65535 || cfg.TLSHTTPPort == cfg.Port {
+			return nil, fmt.Errorf("TLS_HTTP_PORT must be between 1 and 65535 and differ from PORT, got %d", cfg.TLSHTTPPort)
+		}
+	}
+
+	if cfg.AdminAddr != "" {
+		_, port, err := net.SplitHostPort(cfg.AdminAddr)
+		if err != nil {
+			return nil, fmt.Errorf("ADMIN_ADDR must be host:port, e.g. 127.0.0.1:9090: %w", err)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return nil, fmt.Errorf("ADMIN_ADDR port must be between 1 and 65535, got %q", port)
+		} else if n == cfg.Port || n == cfg.TLSHTTPPort {
+			return nil, fmt.Errorf("ADMIN_ADDR must be on another port than PORT and TLS_HTTP_PORT")
+		}
+	}
+	if (cfg.AdminTLSCert == "") != (cfg.AdminTLSKey == "") {
+		return nil, fmt.Errorf("ADMIN_TLS_CERT and ADMIN_TLS_KEY must be set together")
+	}
+	if cfg.AdminTLSCert != "" && cfg.AdminAddr == "" {
+		return nil, fmt.Errorf("ADMIN_TLS_CERT and ADMIN_TLS_KEY require ADMIN_ADDR")
+	}
+	if cfg.AdminClientCA != "" && cfg.AdminTLSCert == "" {
+		return nil, fmt.Errorf("ADMIN_CLIENT_CA requires ADMIN_TLS_CERT and ADMIN_TLS_KEY")
+	}
+	if !cfg.AdminEnabled() && (cfg.AdminAddr != "" || cfg.AdminDebug || cfg.AdminSharedPort) {
+		return nil, fmt.Errorf("ADMIN_ADDR, ADMIN_SHARED_PORT and ADMIN_DEBUG require ADMIN_TOKEN or ADMIN_CLIENT_CA")
+	}
+	if cfg.AdminEnabled() && cfg.AdminAddr == "" && !cfg.AdminSharedPort {
+		return nil, fmt.Errorf("ADMIN_TOKEN and ADMIN_CLIENT_CA no longer serve the admin API on PORT by default: set ADMIN_ADDR (e.g. 127.0.0.1:9090) to give it a listener of its own, or ADMIN_SHARED_PORT=true to keep it on PORT")
+	}
+	if cfg.AdminSharedPort && cfg.AdminAddr != "" {
+		return nil, fmt.Errorf("ADMIN_SHARED_PORT and ADMIN_ADDR cannot both be set")
+	}
+
+	if cfg.CreditMode != "token" && cfg.CreditMode != "account" {
+		return nil, fmt.Errorf("CREDIT_MODE must be \"token\" or \"account\", got %q", cfg.CreditMode)
+	}
+	if cfg.CreditMode == "account" {
+		// An account is one shared balance, so credits bought with a scoped
+		// pack would be spendable by the payer's full-access tokens.
+		for _, t := range cfg.PricingTiers {
+			if len(t.Methods) > 0 {
+				return nil, fmt.Errorf("PRICING_TIERS: method-scoped tiers are not supported with CREDIT_MODE=account")
+			}
+		}
+		for _, a := range append(cfg.EIP3009Assets(), cfg.Permit2Assets...) {
+			for _, t := range a.Tiers {
+				if len(t.Methods) > 0 {
+					return nil, fmt.Errorf("ACCEPTED_ASSETS: method-scoped tiers are not supported with CREDIT_MODE=account")
+				}
+			}
+		}
+	}
+
+	switch cfg.TokenStore {
+	case "memory", "bolt":
+	case "postgres":
+		if cfg.DatabaseURL == "" {
+			return nil, fmt.Errorf("DATABASE_URL env var is required when TOKEN_STORE=postgres")
+		}
+	default:
+		return nil, fmt.Errorf("TOKEN_STORE must be \"memory\", \"bolt\" or \"postgres\", got %q", cfg.TokenStore)
+	}
+
+	// Payment-related fields are only required when a facilitator is configured.
+	if cfg.FacilitatorURL != "" {
+		jwtHex := getEnv("JWT_SECRET", "")
+		switch {
+		case jwtHex != "" && cfg.JWTSecretRef != "":
+			return nil, fmt.Errorf("JWT_SECRET and JWT_SECRET_REF cannot both be set")
+		case jwtHex == "" && cfg.JWTSecretRef == "":
+			return nil, fmt.Errorf("JWT_SECRET env var is required when FACILITATOR_URL is set (32-byte hex)")
+		case jwtHex != "":
+			secret, err := ParseJWTSecret(jwtHex)
+			if err != nil {
+				return nil, err
+			}
+			cfg.JWTSecret = secret
 		}
-		cfg.JWTSecret = secret
 
 		if cfg.GatewayPayTo == "" {
 			return nil, fmt.Errorf("GATEWAY_PAY_TO env var is required when FACILITATOR_URL is set")
@@ -116,11 +1374,484 @@ func Load() (*Config, error) {
 	return cfg, nil
 }
 
+// EIP3009Assets returns the EIP-3009 tokens accepted: the TokenRegistry
+// entries for Network and the NetworkFacilitators networks, or else USDC
+// followed by ExtraAssets on Network.
+func (c *Config) EIP3009Assets() []Asset {
+	if len(c.TokenRegistry) > 0 {
+		return c.TokenRegistry
+	}
+	usdc := Asset{
+		Network:       c.Network,
+		Address:       c.USDCAddress,
+		DomainName:    c.USDCDomainName,
+		DomainVersion: c.USDCDomainVersion,
+	}
+	return append([]Asset{usdc}, c.ExtraAssets...)
+}
+
+// remoteFacilitator reports whether any payments are verified and settled
+// by a remote facilitator: at FacilitatorURL or a NetworkFacilitators URL.
+func (c *Config) remoteFacilitator() bool {
+	for _, r := range c.NetworkFacilitators {
+		if r.FacilitatorURL != "" {
+			return true
+		}
+	}
+	return c.FacilitatorURL != ""
+}
+
+// routed reports whether NetworkFacilitators routes payments on network.
+func (c *Config) routed(network string) bool {
+	for _, r := range c.NetworkFacilitators {
+		if r.Network == network {
+			return true
+		}
+	}
+	return false
+}
+
+// listsTokens reports whether TokenRegistry lists tokens for network.
+func (c *Config) listsTokens(network string) bool {
+	for _, a := range c.TokenRegistry {
+		if a.Network == network {
+			return true
+		}
+	}
+	return false
+}
+
+// LocalFacilitator reports whether the gateway settles payments itself:
+// no FacilitatorURL, and a relayer signer to send settlements with.
+func (c *Config) LocalFacilitator() bool {
+	return c.FacilitatorURL == "" && !c.SolanaNetwork() && c.hasRelayerSigner()
+}
+
+// TLS reports whether Port is served over HTTPS.
+func (c *Config) TLS() bool {
+	return c.TLSCert != "" || c.TLSAutocert
+}
+
+// AdminEnabled reports whether the admin API is served: operators
+// authenticate with AdminToken, an AdminClientCA certificate, or both.
+func (c *Config) AdminEnabled() bool {
+	return c.AdminToken != "" || c.AdminClientCA != ""
+}
+
+// SolanaFacilitator reports whether the gateway settles Solana payments
+// itself: a Solana Network, no FacilitatorURL, and a fee payer key.
+func (c *Config) SolanaFacilitator() bool {
+	return c.FacilitatorURL == "" && c.SolanaNetwork() && c.SolanaFeePayerKey != ""
+}
+
+// SolanaNetwork reports whether Network is a Solana cluster.
+func (c *Config) SolanaNetwork() bool {
+	return strings.HasPrefix(c.Network, "solana:")
+}
+
+// solanaClusters are the defaults for the known Solana networks: Circle's
+// USDC mint and the cluster's public RPC endpoint.
+var solanaClusters = map[string]struct{ usdcMint, rpcURL string }{
+	"solana:5eykt4UsFv8P8NJdTREpY1vzqKqZKvdp": {"EPjFWdd5AufqSSqeM2qN1xzybapC8G4wEGGkZwyTDt1v", "https://api.mainnet-beta.solana.com"},
+	"solana:EtWTRABZaYq6iMfeYKouRu166VU2xqa1": {"4zMMC9srt5Ri5X14GAgXhaHii3GnPAEERYPJgZJDncDU", "https://api.devnet.solana.com"},
+}
+
+// hasRelayerSigner reports whether a signer for the local facilitator's
+// settlement transactions is configured.
+func (c *Config) hasRelayerSigner() bool {
+	return c.GatewayPrivateKey != "" || c.GatewayPrivateKeyRef != "" || c.RelayerSigner != "key"
+}
+
+// ParseJWTSecret decodes a JWT_SECRET value, as set in the environment or
+// read from the secrets manager.
+func ParseJWTSecret(jwtHex string) ([]byte, error) {
+	secret, err := hex.DecodeString(jwtHex)
+	if err != nil {
+		return nil, fmt.Errorf("JWT_SECRET must be valid hex: %w", err)
+	}
+	if len(secret) < 32 {
+		return nil, fmt.Errorf("JWT_SECRET must be at least 32 bytes (64 hex chars)")
+	}
+	return secret, nil
+}
+
 // RequestsPerPayment returns the number of RPC credits issued per payment.
 func (c *Config) RequestsPerPayment() int64 {
 	return c.MaxAmountRequired / c.PricePerRequest
 }
 
+// parsePricingTiers parses "amount:credits[:method|method],...". An empty
+// string yields no tiers.
+func parsePricingTiers(s string) ([]PricingTier, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var tiers []PricingTier
+	for _, part := range strings.Split(s, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ":")
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, fmt.Errorf("tier %q must be amount:credits or amount:credits:methods", part)
+		}
+		amountStr, creditsStr := fields[0], fields[1]
+		amount, err := strconv.ParseInt(amountStr, 10, 64)
+		if err != nil || amount <= 0 {
+			return nil, fmt.Errorf("tier %q: amount must be a positive integer", part)
+		}
+		credits, err := strconv.ParseInt(creditsStr, 10, 64)
+		if err != nil || credits <= 0 {
+			return nil, fmt.Errorf("tier %q: credits must be a positive integer", part)
+		}
+		var methods []string
+		if len(fields) == 3 {
+			for _, m := range strings.Split(fields[2], "|") {
+				if m = strings.TrimSpace(m); m != "" {
+					methods = append(methods, m)
+				}
+			}
+			if len(methods) == 0 {
+				return nil, fmt.Errorf("tier %q: method list is empty", part)
+			}
+		}
+		tiers = append(tiers, PricingTier{Amount: amount, Credits: credits, Methods: methods})
+	}
+	return tiers, nil
+}
+
+// parseList splits a comma-separated list, dropping empty entries.
+func parseList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// parseMethodCosts parses "method:credits,...". An empty string yields nil.
+func parseMethodCosts(s string) (map[string]int64, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	costs := make(map[string]int64)
+	for _, part := range strings.Split(s, ",") {
+		method, costStr, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok || method == "" {
+			return nil, fmt.Errorf("entry %q must be method:credits", part)
+		}
+		cost, err := strconv.ParseInt(costStr, 10, 64)
+		if err != nil || cost <= 0 {
+			return nil, fmt.Errorf("entry %q: credits must be a positive integer", part)
+		}
+		if _, dup := costs[method]; dup {
+			return nil, fmt.Errorf("method %s listed twice", method)
+		}
+		costs[method] = cost
+	}
+	return costs, nil
+}
+
+// splitTiered splits an entry of a list setting into at most n trimmed
+// "|"-separated fields, the nth being a tiers field for parsePricingTiers.
+// The tiers field may itself contain "|" in method lists, so it takes the
+// rest of the entry.
+func splitTiered(entry string, n int) []string {
+	fields := strings.SplitN(strings.TrimSpace(entry), "|", n)
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	return fields
+}
+
+// parseAssets parses "address|domainName|domainVersion[|tiers];...". An
+// empty string yields no assets.
+func parseAssets(s string) ([]Asset, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var assets []Asset
+	for _, part := range strings.Split(s, ";") {
+		fields := splitTiered(part, 4)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("asset %q must be address|domainName|domainVersion[|tiers]", part)
+		}
+		a := Asset{Address: fields[0], DomainName: fields[1], DomainVersion: fields[2]}
+		if a.DomainName == "" || a.DomainVersion == "" {
+			return nil, fmt.Errorf("asset %q: domain name and version are required", part)
+		}
+		if len(fields) == 4 {
+			tiers, err := parsePricingTiers(fields[3])
+			if err != nil {
+				return nil, fmt.Errorf("asset %s: %w", a.Address, err)
+			}
+			a.Tiers = tiers
+		}
+		assets = append(assets, a)
+	}
+	return assets, nil
+}
+
+// parseTokenRegistry parses
+// "network|address|decimals|domainName|domainVersion[|minAmount[|tiers]];...".
+// An empty string yields no tokens.
+func parseTokenRegistry(s string) ([]Asset, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var tokens []Asset
+	for _, part := range strings.Split(s, ";") {
+		fields := splitTiered(part, 7)
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("token %q must be network|address|decimals|domainName|domainVersion[|minAmount[|tiers]]", part)
+		}
+		decimals, err := strconv.Atoi(fields[2])
+		if err != nil || decimals < 0 || decimals > 36 {
+			return nil, fmt.Errorf("token %q: decimals must be an integer between 0 and 36", part)
+		}
+		a := Asset{
+			Network:       fields[0],
+			Address:       fields[1],
+			Decimals:      decimals,
+			DomainName:    fields[3],
+			DomainVersion: fields[4],
+		}
+		if a.Network == "" || a.Address == "" || a.DomainName == "" || a.DomainVersion == "" {
+			return nil, fmt.Errorf("token %q: network, address, domain name and version are required", part)
+		}
+		if len(fields) > 5 && fields[5] != "" {
+			a.MinAmount, err = strconv.ParseInt(fields[5], 10, 64)
+			if err != nil || a.MinAmount < 0 {
+				return nil, fmt.Errorf("token %q: minimum amount must be a non-negative integer", part)
+			}
+		}
+		if len(fields) == 7 {
+			tiers, err := parsePricingTiers(fields[6])
+			if err != nil {
+				return nil, fmt.Errorf("token %s: %w", a.Address, err)
+			}
+			a.Tiers = tiers
+		}
+		for _, b := range tokens {
+			if b.Network == a.Network && strings.EqualFold(b.Address, a.Address) {
+				return nil, fmt.Errorf("token %s listed twice for %s", a.Address, a.Network)
+			}
+		}
+		tokens = append(tokens, a)
+	}
+	return tokens, nil
+}
+
+// parseNetworkFacilitators parses
+// "network|facilitatorURL;network|local|settlementRPCURL;...". An empty
+// string yields no routes.
+func parseNetworkFacilitators(s string) ([]NetworkFacilitator, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var routes []NetworkFacilitator
+	for _, part := range strings.Split(s, ";") {
+		fields := strings.Split(strings.TrimSpace(part), "|")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		var r NetworkFacilitator
+		switch {
+		case len(fields) == 2 && fields[1] != "local":
+			r = NetworkFacilitator{Network: fields[0], FacilitatorURL: fields[1]}
+		case len(fields) == 3 && fields[1] == "local":
+			r = NetworkFacilitator{Network: fields[0], SettlementRPCURL: fields[2]}
+		default:
+			return nil, fmt.Errorf("route %q must be network|facilitatorURL or network|local|settlementRPCURL", part)
+		}
+		if r.FacilitatorURL == "" && r.SettlementRPCURL == "" {
+			return nil, fmt.Errorf("route %q: facilitator or settlement RPC URL is required", part)
+		}
+		chainID, ok := strings.CutPrefix(r.Network, "eip155:")
+		if _, err := strconv.ParseUint(chainID, 10, 64); !ok || err != nil {
+			return nil, fmt.Errorf("route %q: network must be an eip155:<chainId> identifier", part)
+		}
+		for _, b := range routes {
+			if b.Network == r.Network {
+				return nil, fmt.Errorf("network %s routed twice", r.Network)
+			}
+		}
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+// parseHTTPRoutes parses "prefix|upstreamURL|credits[|METHOD,METHOD];...".
+// An empty string yields no routes.
+func parseHTTPRoutes(s string) ([]HTTPRoute, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var routes []HTTPRoute
+	for _, part := range strings.Split(s, ";") {
+		fields := strings.Split(strings.TrimSpace(part), "|")
+		if len(fields) != 3 && len(fields) != 4 {
+			return nil, fmt.Errorf("route %q must be prefix|upstreamURL|credits[|methods]", part)
+		}
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		r := HTTPRoute{Prefix: strings.TrimSuffix(fields[0], "/"), UpstreamURL: fields[1]}
+		if !strings.HasPrefix(r.Prefix, "/") {
+			return nil, fmt.Errorf("route %q: prefix must be a path other than /", part)
+		}
+		if u, err := url.Parse(r.UpstreamURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("route %q: upstream must be an http:// or https:// URL", part)
+		}
+		credits, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil || credits <= 0 {
+			return nil, fmt.Errorf("route %q: credits must be a positive integer", part)
+		}
+		r.Credits = credits
+		if len(fields) == 4 {
+			for _, m := range parseList(fields[3]) {
+				r.Methods = append(r.Methods, strings.ToUpper(m))
+			}
+		}
+		for _, b := range routes {
+			if b.Prefix == r.Prefix {
+				return nil, fmt.Errorf("prefix %s routed twice", r.Prefix)
+			}
+		}
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+// parseRPCRoutes parses "prefix|upstreamURL[|network[|tiers]];...". An
+// empty string yields no routes.
+func parseRPCRoutes(s string) ([]RPCRoute, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var routes []RPCRoute
+	for _, part := range strings.Split(s, ";") {
+		fields := splitTiered(part, 4)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("route %q must be prefix|upstreamURL[|network[|tiers]]", part)
+		}
+		r := RPCRoute{Prefix: strings.TrimSuffix(fields[0], "/"), UpstreamURL: fields[1]}
+		if !strings.HasPrefix(r.Prefix, "/") || r.Prefix == "/admin" || r.Prefix == "/facilitator" {
+			return nil, fmt.Errorf("route %q: prefix must be a path other than /, /admin and /facilitator", part)
+		}
+		if u, err := url.Parse(r.UpstreamURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("route %q: upstream must be an http:// or https:// URL", part)
+		}
+		if len(fields) > 2 {
+			r.Network = fields[2]
+		}
+		if len(fields) == 4 {
+			tiers, err := parsePricingTiers(fields[3])
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %w", r.Prefix, err)
+			}
+			r.Tiers = tiers
+		}
+		for _, b := range routes {
+			if b.Prefix == r.Prefix {
+				return nil, fmt.Errorf("prefix %s routed twice", r.Prefix)
+			}
+		}
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+// parsePermit2Assets parses "address[|tiers];...". An empty string yields no
+// assets.
+func parsePermit2Assets(s string) ([]Asset, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var assets []Asset
+	for _, part := range strings.Split(s, ";") {
+		address, tiersStr, hasTiers := strings.Cut(strings.TrimSpace(part), "|")
+		a := Asset{Address: strings.TrimSpace(address), Permit2: true}
+		if a.Address == "" {
+			return nil, fmt.Errorf("asset %q: address is required", part)
+		}
+		if hasTiers {
+			tiers, err := parsePricingTiers(tiersStr)
+			if err != nil {
+				return nil, fmt.Errorf("asset %s: %w", a.Address, err)
+			}
+			a.Tiers = tiers
+		}
+		assets = append(assets, a)
+	}
+	return assets, nil
+}
+
+// parsePriceFeeds parses "asset|feed|decimals;...". An empty string yields no
+// feeds.
+func parsePriceFeeds(s string) ([]PriceFeed, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var feeds []PriceFeed
+	for _, part := range strings.Split(s, ";") {
+		fields := strings.Split(strings.TrimSpace(part), "|")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("feed %q must be asset|feed|decimals", part)
+		}
+		decimals, err := strconv.Atoi(fields[2])
+		if err != nil || decimals < 0 || decimals > 36 {
+			return nil, fmt.Errorf("feed %q: decimals must be an integer between 0 and 36", part)
+		}
+		feeds = append(feeds, PriceFeed{Asset: fields[0], Feed: fields[1], Decimals: decimals})
+	}
+	return feeds, nil
+}
+
+// parseCoupons parses "code:discount:bonus[:expiryDate],...". An empty string
+// yields no coupons.
+func parseCoupons(s string) ([]Coupon, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var coupons []Coupon
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(s, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ":")
+		if len(fields) != 3 && len(fields) != 4 {
+			return nil, fmt.Errorf("coupon %q must be code:discount:bonus or code:discount:bonus:expiryDate", part)
+		}
+		c := Coupon{Code: fields[0]}
+		if c.Code == "" {
+			return nil, fmt.Errorf("coupon %q: code is required", part)
+		}
+		if seen[strings.ToUpper(c.Code)] {
+			return nil, fmt.Errorf("coupon %s listed twice", c.Code)
+		}
+		seen[strings.ToUpper(c.Code)] = true
+		discount, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || discount < 0 || discount > 99 {
+			return nil, fmt.Errorf("coupon %s: discount must be a percentage between 0 and 99", c.Code)
+		}
+		bonus, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil || bonus < 0 {
+			return nil, fmt.Errorf("coupon %s: bonus must be a non-negative percentage", c.Code)
+		}
+		if discount == 0 && bonus == 0 {
+			return nil, fmt.Errorf("coupon %s has neither a discount nor a bonus", c.Code)
+		}
+		c.Discount, c.Bonus = discount, bonus
+		if len(fields) == 4 {
+			day, err := time.Parse(time.DateOnly, fields[3])
+			if err != nil {
+				return nil, fmt.Errorf("coupon %s: expiry must be a YYYY-MM-DD date", c.Code)
+			}
+			c.Expires = day.AddDate(0, 0, 1)
+		}
+		coupons = append(coupons, c)
+	}
+	return coupons, nil
+}
+
 func getEnv(key, fallback string) string {
 	if v, ok := os.LookupEnv(key); ok {
 		return v
@@ -128,14 +1859,72 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
-func getEnvInt(key string, fallback int) int {
+// envReader reads typed settings, collecting an error for every value that
+// does not parse instead of silently using the default: a typo must not
+// start the gateway with settings nobody chose.
+type envReader struct {
+	errs []error
+}
+
+// err returns the errors of all settings read so far, if any.
+func (e *envReader) err() error {
+	return errors.Join(e.errs...)
+}
+
+func (e *envReader) int(key string, fallback int) int {
 	v := getEnv(key, "")
 	if v == "" {
 		return fallback
 	}
 	n, err := strconv.Atoi(v)
 	if err != nil {
+		e.errs = append(e.errs, fmt.Errorf("%s must be an integer, got %q", key, v))
 		return fallback
 	}
 	return n
 }
+
+func (e *envReader) float(key string, fallback float64) float64 {
+	v := getEnv(key, "")
+	if v == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Errorf("%s must be a number, got %q", key, v))
+		return fallback
+	}
+	return f
+}
+
+func (e *envReader) bool(key string, fallback bool) bool {
+	v := getEnv(key, "")
+	if v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Errorf("%s must be true or false, got %q", key, v))
+		return fallback
+	}
+	return b
+}
+
+// duration reads a duration in Go syntax, such as "90s" or "1h30m". A bare
+// number is taken in unit, the one the setting's name ends in; with a zero
+// unit the setting has none and bare numbers other than 0 are refused.
+func (e *envReader) duration(key string, fallback, unit time.Duration) time.Duration {
+	v := getEnv(key, "")
+	if v == "" {
+		return fallback
+	}
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil && unit != 0 {
+		return time.Duration(n) * unit
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Errorf("%s must be a duration such as 90s or 1h30m, got %q", key, v))
+		return fallback
+	}
+	return d
+}
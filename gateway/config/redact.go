@@ -0,0 +1,105 @@
+package config
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// redacted replaces the value of a secret that is set.
+const redacted = "[redacted]"
+
+// secretFields are the settings whose values are never shown.
+var secretFields = map[string]bool{
+	"AdminToken":              true,
+	"AWSAccessKeyID":          true,
+	"AWSSecretAccessKey":      true,
+	"AWSSessionToken":         true,
+	"BazaarAPIKey":            true,
+	"ChallengeSecret":         true,
+	"EventBusToken":           true,
+	"FacilitatorServerToken":  true,
+	"GatewayPrivateKey":       true,
+	"JWTSecret":               true,
+	"RelayerKeys":             true,
+	"RelayerKeystorePassword": true,
+	"SolanaFeePayerKey":       true,
+	"VaultToken":              true,
+	"WebhookSecret":           true,
+}
+
+// Redacted returns the configuration as it was resolved, keyed by field
+// name, for showing operators what the process runs with. Secrets that are
+// set show as "[redacted]", and URLs lose their passwords, query values and
+// any path segment long enough to be an API key, as providers put keys in
+// either. Durations are written like "1h30m0s".
+func (c *Config) Redacted() map[string]any {
+	return redactStruct(reflect.ValueOf(*c))
+}
+
+func redactStruct(v reflect.Value) map[string]any {
+	out := make(map[string]any, v.NumField())
+	for i := range v.NumField() {
+		name := v.Type().Field(i).Name
+		f := v.Field(i)
+		if secretFields[name] {
+			out[name] = ""
+			if f.Len() > 0 {
+				out[name] = redacted
+			}
+			continue
+		}
+		out[name] = redactValue(f)
+	}
+	return out
+}
+
+func redactValue(v reflect.Value) any {
+	if d, ok := v.Interface().(time.Duration); ok {
+		return d.String()
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return RedactURL(v.String())
+	case reflect.Struct:
+		return redactStruct(v)
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		out := make([]any, v.Len())
+		for i := range out {
+			out[i] = redactValue(v.Index(i))
+		}
+		return out
+	}
+	return v.Interface()
+}
+
+// RedactURL strips the credentials a URL may carry, in its user info, query
+// or path; other strings are returned as they are.
+func RedactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return s
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	if u.RawQuery != "" {
+		q := u.Query()
+		for k := range q {
+			q.Set(k, "xxxxx")
+		}
+		u.RawQuery = q.Encode()
+	}
+	segments := strings.Split(u.Path, "/")
+	for i, seg := range segments {
+		if len(seg) >= 16 {
+			segments[i] = "xxxxx"
+		}
+	}
+	u.Path, u.RawPath = strings.Join(segments, "/"), ""
+	return u.String()
+}
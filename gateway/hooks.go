@@ -0,0 +1,9 @@
+package main
+
+import "github.com/ethdenver2026/gateway/x402"
+
+// hooks are the request and response hooks compiled into this build, run in
+// order on every JSON-RPC request (see x402.Hook). Operators add their own
+// policies here, or append to it from an init func in a file of their own,
+// instead of changing the middleware.
+var hooks []x402.Hook
@@ -1,19 +1,34 @@
 package main
 
 import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"log/slog"
 	"math/big"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/ethdenver2026/gateway/admin"
 	"github.com/ethdenver2026/gateway/config"
 	"github.com/ethdenver2026/gateway/proxy"
 	"github.com/ethdenver2026/gateway/x402"
+	"github.com/ethereum/go-ethereum/common"
+	_ "github.com/jackc/pgx/v5/stdlib" // registers the "pgx" database/sql driver
+	bolt "go.etcd.io/bbolt"
 )
 
 func main() {
+	if code := runCommand(os.Args[1:]); code >= 0 {
+		os.Exit(code)
+	}
+
 	logLevel := slog.LevelInfo
 	if os.Getenv("LOG_LEVEL") == "debug" {
 		logLevel = slog.LevelDebug
@@ -25,51 +40,371 @@ func main() {
 		slog.Error("config error", "err", err)
 		os.Exit(1)
 	}
+	secrets, err := loadSecrets(cfg)
+	if err != nil {
+		slog.Error("reading secrets failed", "provider", cfg.SecretsProvider, "err", err)
+		os.Exit(1)
+	}
 
-	rpcProxy, err := proxy.NewRPC(cfg.UpstreamRPCURL)
+	proxy.SetTransport(proxy.TransportConfig{
+		DialTimeout:           cfg.UpstreamDialTimeout,
+		TLSHandshakeTimeout:   cfg.UpstreamTLSTimeout,
+		ResponseHeaderTimeout: cfg.UpstreamHeaderTimeout,
+		MaxIdleConns:          cfg.UpstreamMaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.UpstreamMaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.UpstreamMaxConnsPerHost,
+	})
+	if cfg.EgressProxyURL != "" {
+		if err := proxy.SetEgressProxy(cfg.EgressProxyURL); err != nil {
+			slog.Error("invalid egress proxy", "err", err)
+			os.Exit(1)
+		}
+	}
+	proxy.SetStreaming(cfg.StreamFlushInterval, int64(cfg.MaxResponseBytes))
+	// Signatures for the wrong chain verify locally just as well, so the
+	// endpoints are made to prove their chain before anything is served.
+	chainClient, err := egressClient(cfg)
+	if err != nil {
+		slog.Error("invalid egress proxy", "err", err)
+		os.Exit(1)
+	}
+	endpoints := chainEndpoints(cfg)
+	if err := verifyChains(chainClient, endpoints); err != nil {
+		slog.Error("RPC endpoint on the wrong chain: check NETWORK, SETTLEMENT_RPC_URL and UPSTREAM_CHAIN_ID", "err", err)
+		os.Exit(1)
+	}
+	rpcProxy, err := proxy.NewRPC(cfg.UpstreamRPCURL, cfg.UpstreamFallbackRPCURL)
 	if err != nil {
 		slog.Error("failed to create RPC proxy", "err", err)
 		os.Exit(1)
 	}
+	var upstream http.Handler = rpcProxy
+	if len(cfg.PrivacyRPCURLs) > 0 {
+		if upstream, err = proxy.NewRotator(rpcProxy, cfg.PrivacyRPCURLs, cfg.PrivacyShuffle); err != nil {
+			slog.Error("failed to create provider rotation", "err", err)
+			os.Exit(1)
+		}
+	}
+	if cfg.ArchiveRPCURL != "" {
+		if upstream, err = proxy.NewArchiveRouter(upstream, cfg.UpstreamRPCURL, cfg.ArchiveRPCURL, cfg.ArchiveRoutes); err != nil {
+			slog.Error("failed to create archive router", "err", err)
+			os.Exit(1)
+		}
+	}
+	if len(cfg.QuorumRPCURLs) > 0 {
+		providers := append([]string{cfg.UpstreamRPCURL}, cfg.QuorumRPCURLs...)
+		if upstream, err = proxy.NewQuorum(upstream, providers, cfg.QuorumMethods); err != nil {
+			slog.Error("failed to create quorum", "err", err)
+			os.Exit(1)
+		}
+	}
+	if cfg.CoalesceRequests {
+		upstream = proxy.NewCoalescer(upstream)
+	}
+	if cfg.ResponseCache != "" || cfg.HeadCacheTTL > 0 {
+		cacheCfg := proxy.CacheConfig{HeadTTL: cfg.HeadCacheTTL}
+		if cfg.ResponseCache != "" {
+			if cacheCfg.Store, err = newCacheStore(cfg); err != nil {
+				slog.Error("response cache init failed", "cache", cfg.ResponseCache, "err", err)
+				os.Exit(1)
+			}
+		}
+		if upstream, err = proxy.NewCache(upstream, cfg.UpstreamRPCURL, cacheCfg); err != nil {
+			slog.Error("response cache init failed", "cache", cfg.ResponseCache, "err", err)
+			os.Exit(1)
+		}
+	}
+	if cfg.BatchSplitSize > 0 {
+		upstream = proxy.NewSplitter(upstream, rpcProxy, cfg.BatchSplitSize)
+	}
+	if len(cfg.VerifyBeaconURLs) > 0 {
+		if upstream, err = proxy.NewVerifier(upstream, cfg.UpstreamRPCURL, cfg.VerifyNetwork, cfg.VerifyBeaconURLs); err != nil {
+			slog.Error("failed to start light client", "network", cfg.VerifyNetwork, "err", err)
+			os.Exit(1)
+		}
+	}
+	var routes []x402.Route
+	for _, r := range cfg.HTTPRoutes {
+		p, err := proxy.NewRPC(r.UpstreamURL, "")
+		if err != nil {
+			slog.Error("failed to create route proxy", "prefix", r.Prefix, "err", err)
+			os.Exit(1)
+		}
+		routes = append(routes, x402.Route{Prefix: r.Prefix, Methods: r.Methods, Credits: r.Credits, Next: p})
+	}
+	// Left nil, not a nil *proxy.WS, without a WebSocket upstream.
+	var wsProxy x402.WebSocketProxy
+	if cfg.UpstreamWSURL != "" {
+		ws, err := proxy.NewWS(cfg.UpstreamWSURL, cfg.UpstreamFallbackWSURL)
+		if err != nil {
+			slog.Error("failed to create WebSocket proxy", "err", err)
+			os.Exit(1)
+		}
+		wsProxy = ws
+	}
 
 	// Wire up the x402 payment layer.
-	//   - FACILITATOR_URL set → remote facilitator (x402.org or compatible)
-	//   - GATEWAY_PRIVATE_KEY set → self-hosted local facilitator (no external dependency)
+	//   - FACILITATOR_URL set → remote facilitator (x402.org or compatible),
+	//     with FACILITATOR_FAILOVER the local one standing in when it is down
+	//   - GATEWAY_PRIVATE_KEY or RELAYER_SIGNER set → self-hosted local facilitator (no external dependency)
+	//   - SOLANA_FEE_PAYER_KEY set on a solana: NETWORK → self-hosted Solana facilitator
 	//   - neither set        → plain pass-through proxy (no payment gate)
 	var facilitator x402.FacilitatorClient
 	var tokenManager *x402.TokenManager
+	var permit2Spender string
+	feePayer := cfg.SolanaFeePayer
+	var facilitatorServer *x402.FacilitatorServer
+	paymentMode := "disabled"
+	var relayers []string // the local facilitator's, primary first
 	switch {
+	case cfg.FacilitatorURL != "" && cfg.FacilitatorFailover:
+		lf, err := newLocalFacilitator(cfg, cfg.Network, cfg.SettlementRPCURL)
+		if err != nil {
+			slog.Error("local facilitator init failed", "signer", cfg.RelayerSigner, "err", err)
+			os.Exit(1)
+		}
+		paymentMode, relayers = "remote facilitator, local failover", relayerAddresses(lf)
+		slog.Info("payment mode: remote facilitator, local failover",
+			"url", cfg.FacilitatorURL,
+			"settlement_rpc", config.RedactURL(cfg.SettlementRPCURL),
+			"relayer", lf.Address().Hex(),
+			"signer", cfg.RelayerSigner,
+			"relayers", len(lf.Relayers()),
+		)
+		rf, err := newRemoteFacilitator(cfg, cfg.FacilitatorURL)
+		if err != nil {
+			slog.Error("facilitator client init failed", "err", err)
+			os.Exit(1)
+		}
+		probeFacilitator(cfg, rf, cfg.Network)
+		facilitator = x402.NewFailoverFacilitator(rf, lf)
+		if cfg.SettlementStuckAfter > 0 {
+			go bumpStuck(lf, cfg.SettlementStuckAfter)
+		}
+
 	case cfg.FacilitatorURL != "":
-		slog.Info("payment mode: remote facilitator", "url", cfg.FacilitatorURL)
-		facilitator = x402.NewFacilitator(cfg.FacilitatorURL)
-		store := x402.NewInMemoryTokenStore()
-		tokenManager = x402.NewTokenManager(cfg.JWTSecret, cfg.TokenExpiry, store)
+		slog.Info("payment mode: remote facilitator",
+			"url", cfg.FacilitatorURL,
+			"verify_timeout", cfg.FacilitatorVerifyTimeout,
+			"settle_timeout", cfg.FacilitatorSettleTimeout,
+			"verify_retries", cfg.FacilitatorVerifyRetries,
+			"client_cert", cfg.FacilitatorTLSCert != "",
+			"custom_ca", cfg.FacilitatorCAFile != "",
+		)
+		rf, err := newRemoteFacilitator(cfg, cfg.FacilitatorURL)
+		if err != nil {
+			slog.Error("facilitator client init failed", "err", err)
+			os.Exit(1)
+		}
+		probeFacilitator(cfg, rf, cfg.Network)
+		facilitator = rf
+		paymentMode = "remote facilitator"
 
-	case cfg.GatewayPrivateKey != "":
-		chainIDStr := strings.TrimPrefix(cfg.Network, "eip155:")
-		chainID := new(big.Int)
-		if _, ok := chainID.SetString(chainIDStr, 10); !ok {
-			slog.Error("invalid NETWORK for local facilitator", "network", cfg.Network)
+	case cfg.SolanaFacilitator():
+		sf, err := x402.NewSolanaFacilitator(cfg.SettlementRPCURL, cfg.Network, cfg.SolanaFeePayerKey)
+		if err != nil {
+			slog.Error("solana facilitator init failed", "err", err)
 			os.Exit(1)
 		}
-		lf, err := x402.NewLocalFacilitator(cfg.SettlementRPCURL, cfg.GatewayPrivateKey, chainID)
+		slog.Info("payment mode: solana facilitator",
+			"settlement_rpc", config.RedactURL(cfg.SettlementRPCURL),
+			"network", cfg.Network,
+			"fee_payer", sf.FeePayer(),
+		)
+		facilitator = sf
+		feePayer = sf.FeePayer()
+		paymentMode = "solana facilitator"
+
+	case cfg.LocalFacilitator():
+		lf, err := newLocalFacilitator(cfg, cfg.Network, cfg.SettlementRPCURL)
 		if err != nil {
-			slog.Error("local facilitator init failed", "err", err)
+			slog.Error("local facilitator init failed", "signer", cfg.RelayerSigner, "err", err)
 			os.Exit(1)
 		}
 		slog.Info("payment mode: local facilitator",
-			"settlement_rpc", cfg.SettlementRPCURL,
+			"settlement_rpc", config.RedactURL(cfg.SettlementRPCURL),
 			"relayer", lf.Address().Hex(),
+			"signer", cfg.RelayerSigner,
+			"relayers", len(lf.Relayers()),
+			"rebroadcast_after", cfg.SettlementStuckAfter,
+			"min_validity", cfg.SettlementMinValidity,
+			"legacy_tx", cfg.SettlementLegacyTx,
+			"max_fee_gwei", cfg.SettlementMaxFeeGwei,
 		)
 		facilitator = lf
-		store := x402.NewInMemoryTokenStore()
-		tokenManager = x402.NewTokenManager(cfg.JWTSecret, cfg.TokenExpiry, store)
+		permit2Spender = lf.Address().Hex()
+		paymentMode, relayers = "local facilitator", relayerAddresses(lf)
+		if cfg.FacilitatorServer {
+			facilitatorServer = x402.NewFacilitatorServer(x402.FacilitatorServerConfig{
+				Facilitator: lf,
+				Network:     cfg.Network,
+				Signers:     relayers,
+				Token:       cfg.FacilitatorServerToken,
+			})
+		}
+		if cfg.SettlementStuckAfter > 0 {
+			go bumpStuck(lf, cfg.SettlementStuckAfter)
+		}
+		if cfg.ReceiveWithAuthorization && !strings.EqualFold(cfg.GatewayPayTo, lf.Address().Hex()) {
+			slog.Error("RECEIVE_WITH_AUTHORIZATION requires GATEWAY_PAY_TO to be the relayer address",
+				"pay_to", cfg.GatewayPayTo,
+				"relayer", lf.Address().Hex(),
+			)
+			os.Exit(1)
+		}
 
 	default:
-		slog.Info("payment mode: disabled (set FACILITATOR_URL or GATEWAY_PRIVATE_KEY to enable)")
+		slog.Info("payment mode: disabled (set FACILITATOR_URL, GATEWAY_PRIVATE_KEY, RELAYER_SIGNER or SOLANA_FEE_PAYER_KEY to enable)")
+	}
+	if len(cfg.NetworkFacilitators) > 0 {
+		facilitator, err = routeNetworks(cfg, facilitator)
+		if err != nil {
+			slog.Error("network facilitator init failed", "err", err)
+			os.Exit(1)
+		}
 	}
 
-	mw, err := x402.NewMiddleware(x402.MiddlewareConfig{
+	var replay x402.ReplayCache
+	var settlements x402.SettlementStore
+	var freeTier x402.FreeTierStore
+	var usage x402.UsageStore
+	var ledger x402.LedgerStore
+	var audit *x402.AuditLog
+	closeStores := func() {}
+	if facilitator != nil && cfg.AuditLogPath != "" {
+		audit, err = x402.OpenAuditLog(cfg.AuditLogPath, cfg.AuditLogHashChain)
+		if err != nil {
+			slog.Error("audit log init failed", "path", cfg.AuditLogPath, "err", err)
+			os.Exit(1)
+		}
+		slog.Info("audit log", "path", cfg.AuditLogPath, "hash_chain", cfg.AuditLogHashChain)
+	}
+	if facilitator != nil {
+		store, rc, closeFn, err := newStores(cfg)
+		if err != nil {
+			slog.Error("token store init failed", "store", cfg.TokenStore, "err", err)
+			os.Exit(1)
+		}
+		var opts []x402.TokenManagerOption
+		if cfg.CreditMode == "account" {
+			opts = append(opts, x402.WithAccounts())
+			slog.Info("credit mode: per-payer accounts")
+		}
+		if cfg.TokenRateLimitRPS > 0 {
+			opts = append(opts, x402.WithRateLimit(cfg.TokenRateLimitRPS, cfg.TokenRateLimitBurst))
+			slog.Info("per-token rate limit", "rps", cfg.TokenRateLimitRPS, "burst", cfg.TokenRateLimitBurst)
+		}
+		if audit != nil {
+			opts = append(opts, x402.WithAuditLog(audit))
+		}
+		if cfg.Ledger {
+			ledger, _ = store.(x402.LedgerStore)
+			opts = append(opts, x402.WithLedger(ledger))
+		}
+		if index, ok := store.(x402.TokenIndex); ok {
+			opts = append(opts, x402.WithTokenIndex(index))
+		}
+		tokenManager = x402.NewTokenManager(cfg.JWTSecret, cfg.TokenExpiry, store, opts...)
+		replay = rc
+		// Every token store keeps pending settlements alongside its counters.
+		settlements, _ = store.(x402.SettlementStore)
+		freeTier, _ = store.(x402.FreeTierStore)
+		usage, _ = store.(x402.UsageStore)
+		closeStores = closeFn
+		go pruneReplayCache(replay, 10*time.Minute)
+		if cfg.FreeRequestsPerDay > 0 && freeTier != nil {
+			go pruneFreeTier(freeTier, time.Hour)
+		}
+	}
+	if secrets != nil {
+		slog.Info("secrets read from secrets manager",
+			"provider", cfg.SecretsProvider,
+			"jwt_secret", cfg.JWTSecretRef != "",
+			"relayer_key", cfg.GatewayPrivateKeyRef != "",
+			"refresh", cfg.SecretsRefresh,
+		)
+		if cfg.SecretsRefresh > 0 {
+			go refreshSecrets(secrets, cfg, tokenManager, cfg.SecretsRefresh)
+		}
+	}
+
+	tiers := pricingTiers(cfg.PricingTiers)
+	var assets []x402.AcceptedAsset
+	for _, a := range cfg.EIP3009Assets() {
+		assets = append(assets, x402.AcceptedAsset{
+			Address:       a.Address,
+			Network:       a.Network,
+			DomainName:    a.DomainName,
+			DomainVersion: a.DomainVersion,
+			Decimals:      a.Decimals,
+			MinAmount:     a.MinAmount,
+			Tiers:         pricingTiers(a.Tiers),
+		})
+	}
+	for _, a := range cfg.Permit2Assets {
+		assets = append(assets, x402.AcceptedAsset{
+			Address: a.Address,
+			Tiers:   pricingTiers(a.Tiers),
+			Permit2: true,
+			Upto:    cfg.UptoPayments,
+		})
+	}
+
+	var oracle x402.PriceOracle
+	if len(cfg.PriceFeeds) > 0 {
+		if err := attachPriceFeeds(assets, cfg.PriceFeeds); err != nil {
+			slog.Error("invalid PRICE_FEEDS", "err", err)
+			os.Exit(1)
+		}
+		oracle = x402.NewChainlinkOracle(cfg.SettlementRPCURL, cfg.PriceMaxAge)
+	}
+
+	policy, err := x402.NewMethodPolicy(cfg.AllowedMethods, cfg.DeniedMethods)
+	if err != nil {
+		slog.Error("invalid method policy", "err", err)
+		os.Exit(1)
+	}
+
+	var inFlight *x402.InFlightLimiter
+	if cfg.MaxInFlight > 0 || cfg.MaxInFlightPerToken > 0 {
+		inFlight = x402.NewInFlightLimiter(cfg.MaxInFlight, cfg.MaxInFlightPerToken)
+		slog.Info("in-flight limits", "global", cfg.MaxInFlight, "per_token", cfg.MaxInFlightPerToken)
+	}
+
+	var webhooks *x402.Webhooks
+	if facilitator != nil && cfg.WebhookURL != "" {
+		webhooks, err = x402.NewWebhooks(x402.WebhookConfig{
+			URL:    cfg.WebhookURL,
+			Secret: []byte(cfg.WebhookSecret),
+			Events: cfg.WebhookEvents,
+		})
+		if err != nil {
+			slog.Error("failed to configure webhooks", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	var events *x402.EventStream
+	if facilitator != nil && (cfg.AdminEnabled() || cfg.EventBus != "") {
+		events = x402.NewEventStream()
+	}
+	if facilitator != nil && cfg.EventBus != "" {
+		bus, err := x402.NewEventBus(x402.EventBusConfig{
+			Kind:        cfg.EventBus,
+			URL:         cfg.EventBusURL,
+			Token:       cfg.EventBusToken,
+			TopicPrefix: cfg.EventBusTopicPrefix,
+			Events:      cfg.EventBusEvents,
+		})
+		if err != nil {
+			slog.Error("failed to configure event bus", "err", err)
+			os.Exit(1)
+		}
+		go bus.Run(events)
+		slog.Info("event bus enabled", "kind", cfg.EventBus, "url", config.RedactURL(cfg.EventBusURL), "topic_prefix", cfg.EventBusTopicPrefix)
+	}
+
+	mwCfg := x402.MiddlewareConfig{
 		Network:            cfg.Network,
 		PayTo:              cfg.GatewayPayTo,
 		USDCAddress:        cfg.USDCAddress,
@@ -78,27 +413,768 @@ func main() {
 		GatewayURL:         cfg.GatewayURL,
 		MaxAmountRequired:  cfg.MaxAmountRequired,
 		RequestsPerPayment: cfg.RequestsPerPayment(),
+		Tiers:              tiers,
+		Policy:             policy,
+		FreeMethods:        cfg.FreeMethods,
+		MethodCosts:        cfg.MethodCosts,
+		MaxBatchSize:       cfg.MaxBatchSize,
+		MaxRequestBody:     int64(cfg.MaxRequestBytes),
+		USDPerCredit:       cfg.USDPricePerRequest,
+		Coupons:            coupons(cfg.Coupons),
+		Oracle:             oracle,
+		Assets:             assets,
+		Permit2Spender:     permit2Spender,
+		FeePayer:           feePayer,
+		PayAndCall:         cfg.PayAndCall,
+		PreferXPayment:     cfg.PaymentHeaderPreference == "x-payment",
+		Settlements:        settlements,
 		Tokens:             tokenManager,
+		Replay:             replay,
 		Facilitator:        facilitator,
-		Next:               rpcProxy,
-	})
+		Next:               upstream,
+		Routes:             routes,
+		Hooks:              hooks,
+		InFlight:           inFlight,
+		WebSocket:          wsProxy,
+
+		ReceiveWithAuthorization: cfg.ReceiveWithAuthorization,
+		NotificationsPerCredit:   int64(cfg.WSNotificationsPerCredit),
+		SubscriptionCost:         int64(cfg.WSSubscriptionCost),
+		CacheHitCost:             int64(cfg.CacheHitCost),
+		VerifiedCallCost:         int64(cfg.VerifiedCallCost),
+		AsyncSettlement:          cfg.AsyncSettlement,
+		SettlementBatchSize:      cfg.SettlementBatchSize,
+		Confirmations:            uint64(cfg.SettlementConfirmations),
+		ReorgBlocks:              uint64(cfg.SettlementReorgBlocks),
+		FreeRequestsPerDay:       int64(cfg.FreeRequestsPerDay),
+		FreeTier:                 freeTier,
+		Usage:                    usage,
+		Ledger:                   ledger,
+		ChallengeSecret:          cfg.ChallengeSecret,
+		Webhooks:                 webhooks,
+		Audit:                    audit,
+		Events:                   events,
+	}
+	mw, err := x402.NewMiddleware(mwCfg)
 	if err != nil {
 		slog.Error("failed to create x402 middleware", "err", err)
 		os.Exit(1)
 	}
+	chains := make([]*x402.Middleware, len(cfg.RPCRoutes))
+	for i, r := range cfg.RPCRoutes {
+		if chains[i], err = newChainMiddleware(mwCfg, r); err != nil {
+			slog.Error("failed to create RPC route", "prefix", r.Prefix, "err", err)
+			os.Exit(1)
+		}
+	}
+
+	if oracle != nil {
+		// Oracle-priced assets are only offered once they have a price.
+		for _, m := range append([]*x402.Middleware{mw}, chains...) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			if err := m.RefreshPrices(ctx); err != nil {
+				slog.Warn("initial price refresh incomplete", "err", err)
+			}
+			cancel()
+			go refreshPrices(m, cfg.PriceRefreshInterval)
+		}
+	}
+
+	// What the process runs with, after defaults, secrets managers and
+	// derivations, for operators to confirm in the log or at /admin/config.
+	effective := cfg.Redacted()
+	effective["RequestsPerPayment"] = cfg.RequestsPerPayment()
+	effective["PaymentMode"] = paymentMode
+	effective["Relayers"] = relayers
+	effective["Permit2Spender"] = permit2Spender
+	effective["SolanaFeePayer"] = feePayer
+	slog.Info("effective config", "config", effective)
 
 	addr := fmt.Sprintf(":%d", cfg.Port)
 	slog.Info("gateway starting",
 		"addr", addr,
-		"upstream", cfg.UpstreamRPCURL,
+		"upstream", config.RedactURL(cfg.UpstreamRPCURL),
+		"upstream_fallback", cfg.UpstreamFallbackRPCURL != "",
+		"egress_proxy", cfg.EgressProxyURL != "",
+		"privacy_providers", len(cfg.PrivacyRPCURLs),
+		"archive", cfg.ArchiveRPCURL != "",
+		"quorum_providers", len(cfg.QuorumRPCURLs),
+		"verified_calls", len(cfg.VerifyBeaconURLs) > 0,
+		"websocket", cfg.UpstreamWSURL != "",
+		"websocket_fallback", cfg.UpstreamFallbackWSURL != "",
+		"response_cache", cfg.ResponseCache,
+		"head_cache", cfg.HeadCacheTTL,
+		"coalesce_requests", cfg.CoalesceRequests,
+		"batch_split_size", cfg.BatchSplitSize,
+		"http_routes", len(cfg.HTTPRoutes),
+		"rpc_routes", len(cfg.RPCRoutes),
+		"hooks", len(hooks),
 		"network", cfg.Network,
 		"pay_to", cfg.GatewayPayTo,
 		"price_per_request", cfg.PricePerRequest,
 		"requests_per_payment", cfg.RequestsPerPayment(),
+		"pricing_tiers", len(cfg.PricingTiers),
+		"method_costs", len(cfg.MethodCosts),
+		"coupons", len(cfg.Coupons),
+		"free_methods", cfg.FreeMethods,
+		"denied_methods", cfg.DeniedMethods,
+		"eip3009_assets", len(cfg.EIP3009Assets()),
+		"permit2_assets", len(cfg.Permit2Assets),
+		"upto_payments", cfg.UptoPayments,
+		"async_settlement", cfg.AsyncSettlement,
+		"settlement_batch_size", cfg.SettlementBatchSize,
+		"settlement_confirmations", cfg.SettlementConfirmations,
+		"settlement_reorg_blocks", cfg.SettlementReorgBlocks,
+		"free_requests_per_day", cfg.FreeRequestsPerDay,
+		"payment_challenges", cfg.ChallengeSecret != nil,
+		"webhooks", webhooks != nil,
+		"access_log_sample", cfg.AccessLogSample,
+		"audit_log", audit != nil,
+		"ledger", ledger != nil,
 	)
 
-	if err := http.ListenAndServe(addr, mw); err != nil {
-		slog.Error("server error", "err", err)
+	var reconciliation admin.Reconciliation
+	if facilitator != nil && cfg.Reconcile && ledger != nil {
+		reconciler := x402.NewReconciler(x402.ReconcileConfig{
+			RPCURL:  cfg.SettlementRPCURL,
+			Network: cfg.Network,
+			USDC:    common.HexToAddress(cfg.USDCAddress),
+			PayTo:   common.HexToAddress(cfg.GatewayPayTo),
+			Ledger:  ledger,
+		})
+		go reconciler.Run(context.Background())
+		reconciliation = reconciler
+		slog.Info("daily reconciliation enabled", "pay_to", cfg.GatewayPayTo, "usdc", cfg.USDCAddress)
+	}
+
+	if facilitator != nil && cfg.BazaarURL != "" {
+		go publishListing(mw, x402.NewBazaarClient(cfg.BazaarURL, cfg.BazaarAPIKey), cfg.BazaarRefreshInterval)
+		slog.Info("bazaar listing enabled", "url", cfg.BazaarURL, "refresh", cfg.BazaarRefreshInterval)
+	}
+
+	if facilitator != nil && cfg.AsyncSettlement {
+		// Deferred payments' authorizations may be valid for only a minute.
+		go settleDue(mw, 10*time.Second)
+	} else if facilitator != nil && settlements != nil {
+		// Metered payments fall due as their tokens expire, and failed
+		// settlements are retried after a backoff of seconds to minutes.
+		go settleDue(mw, 30*time.Second)
+	}
+
+	var handler http.Handler = mw
+	if len(cfg.CORSAllowedOrigins) > 0 {
+		// The admin API is for operators, not browsers, and stays same-origin.
+		handler = x402.CORS(x402.CORSConfig{AllowedOrigins: cfg.CORSAllowedOrigins, MaxAge: cfg.CORSMaxAge}, mw)
+		slog.Info("CORS enabled", "origins", cfg.CORSAllowedOrigins)
+	}
+	mux := http.NewServeMux()
+	var adminSrv *http.Server
+	if cfg.AdminEnabled() {
+		var dead admin.DeadSettlements
+		if facilitator != nil && settlements != nil {
+			dead = mw
+		}
+		var pricing admin.Pricing
+		if facilitator != nil {
+			pricing = append(pricingGroup{mw}, chains...)
+		}
+		adminAPI := admin.New(admin.Config{
+			Token:       cfg.AdminToken,
+			ClientCerts: cfg.AdminClientCA != "",
+			Tokens:      tokenManager,
+			Settlements: dead,
+			Effective:   effective,
+			Pricing:     pricing,
+			Usage:       usage,
+			Ledger:      ledger,
+			Events:      events,
+			Reconciler:  reconciliation,
+			Checks:      chainChecks(chainClient, endpoints),
+			Debug:       cfg.AdminDebug,
+		})
+		if cfg.AdminSharedPort {
+			mux.Handle("/admin/", adminAPI)
+			slog.Warn("admin API shares PORT with paying clients (ADMIN_SHARED_PORT): set ADMIN_ADDR to serve it on a listener of its own")
+		} else {
+			adminMux := http.NewServeMux()
+			adminMux.Handle("/admin/", adminAPI)
+			var adminRoot http.Handler = adminMux
+			if cfg.AccessLogSample > 0 {
+				adminRoot = accessLog(cfg.AccessLogSample, adminRoot)
+			}
+			adminSrv = &http.Server{Addr: cfg.AdminAddr, Handler: adminRoot}
+			if cfg.AdminTLSCert != "" {
+				if adminSrv.TLSConfig, err = admin.LoadTLSConfig(cfg.AdminTLSCert, cfg.AdminTLSKey, cfg.AdminClientCA); err != nil {
+					slog.Error("invalid admin TLS configuration", "err", err)
+					os.Exit(1)
+				}
+			}
+			if events != nil {
+				adminSrv.RegisterOnShutdown(events.Close)
+			}
+		}
+		slog.Info("admin API enabled",
+			"path", "/admin/",
+			"addr", cmp.Or(cfg.AdminAddr, addr),
+			"tls", cfg.AdminTLSCert != "",
+			"client_certs", cfg.AdminClientCA != "",
+			"token", cfg.AdminToken != "",
+			"debug", cfg.AdminDebug,
+		)
+	}
+	if facilitatorServer != nil {
+		mux.Handle(x402.FacilitatorServerPath, facilitatorServer)
+		if cfg.FacilitatorServerToken == "" {
+			slog.Warn("facilitator API has no FACILITATOR_SERVER_TOKEN: anyone reaching it can spend relayer gas")
+		}
+		slog.Info("facilitator API enabled", "path", x402.FacilitatorServerPath, "authenticated", cfg.FacilitatorServerToken != "")
+	}
+	for i, r := range cfg.RPCRoutes {
+		var chain http.Handler = chains[i]
+		if len(cfg.CORSAllowedOrigins) > 0 {
+			chain = x402.CORS(x402.CORSConfig{AllowedOrigins: cfg.CORSAllowedOrigins, MaxAge: cfg.CORSMaxAge}, chain)
+		}
+		mountChain(mux, r.Prefix, chain)
+		slog.Info("RPC route enabled", "prefix", r.Prefix, "upstream", config.RedactURL(r.UpstreamURL), "network", r.Network, "pricing_tiers", len(r.Tiers))
+	}
+	mux.Handle("/", handler)
+
+	var root http.Handler = mux
+	if cfg.AccessLogSample > 0 {
+		root = accessLog(cfg.AccessLogSample, root)
+	}
+	if len(cfg.TrustedProxies) > 0 {
+		if root, err = x402.RealIP(cfg.TrustedProxies, root); err != nil {
+			slog.Error("invalid TRUSTED_PROXIES", "err", err)
+			os.Exit(1)
+		}
+		slog.Info("client addresses taken from X-Forwarded-For", "trusted_proxies", cfg.TrustedProxies)
+	}
+
+	srv := &http.Server{Addr: addr, Handler: root}
+	var httpSrv *http.Server
+	if cfg.TLS() {
+		tlsConfig, httpHandler, err := serverTLS(cfg)
+		if err != nil {
+			slog.Error("invalid TLS configuration", "err", err)
+			os.Exit(1)
+		}
+		srv.TLSConfig = tlsConfig
+		if cfg.TLSHTTPPort != 0 {
+			httpSrv = &http.Server{Addr: fmt.Sprintf(":%d", cfg.TLSHTTPPort), Handler: httpHandler}
+		}
+		slog.Info("TLS enabled",
+			"autocert", cfg.TLSAutocert,
+			"cert", cfg.TLSCert,
+			"http_port", cfg.TLSHTTPPort,
+		)
+	}
+	if events != nil {
+		// Event streams never end on their own: end them for the shutdown.
+		srv.RegisterOnShutdown(events.Close)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		var err error
+		if srv.TLSConfig != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("server error", "err", err)
+			os.Exit(1)
+		}
+	}()
+	if httpSrv != nil {
+		go func() {
+			if err := httpSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("HTTP redirect server error", "err", err)
+				os.Exit(1)
+			}
+		}()
+	}
+	if adminSrv != nil {
+		go func() {
+			var err error
+			if adminSrv.TLSConfig != nil {
+				err = adminSrv.ListenAndServeTLS("", "")
+			} else {
+				err = adminSrv.ListenAndServe()
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("admin server error", "err", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	wrongChain := make(chan error, 1)
+	if cfg.ChainCheckInterval > 0 {
+		go watchChains(chainClient, endpoints, cfg.ChainCheckInterval, wrongChain)
+	}
+	exitCode := 0
+	select {
+	case <-ctx.Done():
+	case err := <-wrongChain:
+		slog.Error("RPC ENDPOINT SWITCHED CHAINS — shutting down rather than settle on the wrong chain", "err", err)
+		exitCode = 1
+	}
+	slog.Info("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("graceful shutdown incomplete", "err", err)
+	}
+	if httpSrv != nil {
+		_ = httpSrv.Shutdown(shutdownCtx)
+	}
+	if adminSrv != nil {
+		if err := adminSrv.Shutdown(shutdownCtx); err != nil {
+			slog.Warn("graceful shutdown of the admin API incomplete", "err", err)
+		}
+	}
+	// Persist state only after in-flight requests have drained.
+	closeStores()
+	if audit != nil {
+		if err := audit.Close(); err != nil {
+			slog.Warn("closing audit log failed", "err", err)
+		}
+	}
+	if exitCode != 0 {
+		os.Exit(exitCode)
+	}
+}
+
+// newChainMiddleware builds the payment gate of an RPC route: base's, in
+// front of the route's upstream, taking payments on the route's network at
+// its credit packs for tokens scoped to its prefix.
+func newChainMiddleware(base x402.MiddlewareConfig, r config.RPCRoute) (*x402.Middleware, error) {
+	rpc, err := proxy.NewRPC(r.UpstreamURL, "")
+	if err != nil {
+		return nil, err
+	}
+	c := base
+	c.Next = rpc
+	c.Routes = nil
+	c.WebSocket = nil
+	c.GatewayURL = strings.TrimSuffix(base.GatewayURL, "/") + r.Prefix
+	c.Network = r.Network
+	if len(r.Tiers) > 0 {
+		c.Tiers = pricingTiers(r.Tiers)
+	}
+	c.Assets = nil
+	for _, a := range base.Assets {
+		network := a.Network
+		if network == "" {
+			network = base.Network
+		}
+		if network != r.Network {
+			continue
+		}
+		if len(r.Tiers) > 0 {
+			// The route's packs replace the assets' own too.
+			a.Tiers = nil
+		}
+		c.Assets = append(c.Assets, a)
+	}
+	if base.Tokens != nil {
+		c.Tokens = base.Tokens.Scoped(r.Prefix)
+	}
+	return x402.NewMiddleware(c)
+}
+
+// pricingGroup is the gateway and its RPC routes, which share its pack price
+// and method costs, priced as one through the admin API. Routes with their
+// own tiers keep offering them.
+type pricingGroup []*x402.Middleware
+
+func (g pricingGroup) Pricing() x402.Pricing {
+	return g[0].Pricing()
+}
+
+func (g pricingGroup) SetPricing(p x402.Pricing) error {
+	for _, m := range g {
+		if err := m.SetPricing(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mountChain serves h at prefix and the paths under it, with prefix cut from
+// the request path, so the route's JSON-RPC endpoint is at prefix itself.
+func mountChain(mux *http.ServeMux, prefix string, h http.Handler) {
+	strip := http.StripPrefix(prefix, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "" {
+			r.URL.Path = "/"
+		}
+		h.ServeHTTP(w, r)
+	}))
+	mux.Handle(prefix, strip)
+	mux.Handle(prefix+"/", strip)
+}
+
+// newStores builds the TokenCounterStore and ReplayCache for the backend
+// selected by cfg.TokenStore. Both share one database so a durable deployment
+// keeps credits and replay protection together. The returned close function
+// releases the backend (or writes the in-memory snapshot) at shutdown.
+func newStores(cfg *config.Config) (x402.TokenCounterStore, x402.ReplayCache, func(), error) {
+	switch cfg.TokenStore {
+	case "postgres":
+		db, err := sql.Open("pgx", cfg.DatabaseURL)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := db.PingContext(ctx); err != nil {
+			db.Close()
+			return nil, nil, nil, fmt.Errorf("connecting to postgres: %w", err)
+		}
+		store, err := x402.NewPostgresTokenStore(ctx, db)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		replay, err := x402.NewPostgresReplayCache(ctx, db)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		slog.Info("token store: postgres")
+		return store, replay, func() { db.Close() }, nil
+	case "bolt":
+		db, err := bolt.Open(cfg.BoltPath, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("opening %s: %w", cfg.BoltPath, err)
+		}
+		store, err := x402.NewBoltTokenStore(db)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		replay, err := x402.NewBoltReplayCache(db)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		slog.Info("token store: bolt", "path", cfg.BoltPath)
+		return store, replay, func() { db.Close() }, nil
+	default:
+		store := x402.NewInMemoryTokenStore()
+		replay := x402.NewInMemoryReplayCache(cfg.ReplayCacheMaxEntries)
+		if cfg.SnapshotPath == "" {
+			slog.Info("token store: in-memory (credits and replay protection are lost on restart)")
+			return store, replay, func() {}, nil
+		}
+		if err := x402.LoadSnapshot(cfg.SnapshotPath, store, replay); err != nil {
+			return nil, nil, nil, err
+		}
+		slog.Info("token store: in-memory with snapshot", "path", cfg.SnapshotPath)
+		save := func() {
+			if err := x402.SaveSnapshot(cfg.SnapshotPath, store, replay); err != nil {
+				slog.Error("saving snapshot failed", "path", cfg.SnapshotPath, "err", err)
+				return
+			}
+			slog.Info("saved snapshot", "path", cfg.SnapshotPath)
+		}
+		return store, replay, save, nil
+	}
+}
+
+// newCacheStore builds the response cache store selected by
+// cfg.ResponseCache.
+func newCacheStore(cfg *config.Config) (proxy.CacheStore, error) {
+	if cfg.ResponseCache == "redis" {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return proxy.NewRedisCacheStore(ctx, cfg.RedisURL)
+	}
+	return proxy.NewInMemoryCacheStore(cfg.ResponseCacheMaxEntries), nil
+}
+
+// pruneReplayCache periodically deletes replay entries whose authorizations
+// have expired, so the cache stays proportional to recent payment volume.
+func pruneReplayCache(cache x402.ReplayCache, interval time.Duration) {
+	for range time.Tick(interval) {
+		n, err := cache.Prune(time.Now())
+		if err != nil {
+			slog.Warn("replay cache prune failed", "err", err)
+			continue
+		}
+		if n > 0 {
+			slog.Debug("pruned replay cache", "removed", n)
+		}
+	}
+}
+
+// pruneFreeTier periodically deletes the free tier counts of past days.
+func pruneFreeTier(store x402.FreeTierStore, interval time.Duration) {
+	for range time.Tick(interval) {
+		n, err := store.PruneFreeRequests(time.Now())
+		if err != nil {
+			slog.Warn("free tier prune failed", "err", err)
+			continue
+		}
+		if n > 0 {
+			slog.Debug("pruned free tier counts", "removed", n)
+		}
+	}
+}
+
+// settleDue periodically settles upto payments whose tokens have expired
+// with credits left, and retries failed settlements.
+func settleDue(mw *x402.Middleware, interval time.Duration) {
+	for range time.Tick(interval) {
+		n, err := mw.SettleDue(context.Background(), time.Now())
+		if err != nil {
+			slog.Warn("settlement sweep failed", "err", err)
+			continue
+		}
+		if n > 0 {
+			slog.Info("processed due settlements", "count", n)
+		}
+	}
+}
+
+// bumpStuck periodically rebroadcasts the local facilitator's settlement
+// transactions that have been pending longer than after, with higher fees.
+func bumpStuck(lf *x402.LocalFacilitator, after time.Duration) {
+	interval := min(after/4, time.Minute)
+	for range time.Tick(max(interval, 5*time.Second)) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		n, err := lf.BumpStuck(ctx, time.Now(), after)
+		cancel()
+		if err != nil {
+			slog.Warn("stuck settlement sweep failed", "err", err)
+			continue
+		}
+		if n > 0 {
+			slog.Info("rebroadcast stuck settlements", "count", n)
+		}
+	}
+}
+
+// newRemoteFacilitator builds the client of the facilitator at url.
+func newRemoteFacilitator(cfg *config.Config, url string) (*x402.RemoteFacilitator, error) {
+	rcfg := x402.RemoteFacilitatorConfig{
+		VerifyTimeout: cfg.FacilitatorVerifyTimeout,
+		SettleTimeout: cfg.FacilitatorSettleTimeout,
+		VerifyRetries: cfg.FacilitatorVerifyRetries,
+	}
+	if cfg.FacilitatorTLSCert != "" || cfg.FacilitatorCAFile != "" {
+		tlsConfig, err := x402.LoadTLSConfig(cfg.FacilitatorTLSCert, cfg.FacilitatorTLSKey, cfg.FacilitatorCAFile)
+		if err != nil {
+			return nil, err
+		}
+		rcfg.TLS = tlsConfig
+	}
+	return x402.NewFacilitator(url, rcfg), nil
+}
+
+// probeFacilitator checks at startup that the remote facilitator settles the
+// payments the gateway offers, rather than leaving the first customer to find
+// out. A facilitator that does not list them is fatal with
+// FACILITATOR_REQUIRE_SUPPORT; one that cannot be asked only logs a warning.
+func probeFacilitator(cfg *config.Config, rf *x402.RemoteFacilitator, network string) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.FacilitatorVerifyTimeout)
+	defer cancel()
+	err := rf.CheckSupported(ctx, network, "exact")
+	switch {
+	case err == nil:
+		slog.Info("facilitator supports the offered payments", "network", network, "scheme", "exact")
+	case errors.Is(err, x402.ErrKindUnsupported) && cfg.FacilitatorRequireSupport:
+		slog.Error("facilitator does not support the offered payments", "err", err)
 		os.Exit(1)
+	case errors.Is(err, x402.ErrKindUnsupported):
+		slog.Warn("FACILITATOR DOES NOT SUPPORT THE OFFERED PAYMENTS — payments will fail (set FACILITATOR_REQUIRE_SUPPORT=true to refuse to start)", "err", err)
+	default:
+		slog.Warn("facilitator capability probe failed", "network", network, "err", err)
+	}
+}
+
+// routeNetworks wraps primary, the facilitator for NETWORK, in one routing
+// the payments on each NETWORK_FACILITATORS network to its own facilitator.
+func routeNetworks(cfg *config.Config, primary x402.FacilitatorClient) (x402.FacilitatorClient, error) {
+	facilitators := map[string]x402.FacilitatorClient{cfg.Network: primary}
+	for _, r := range cfg.NetworkFacilitators {
+		if r.FacilitatorURL != "" {
+			slog.Info("network routed to remote facilitator", "network", r.Network, "url", r.FacilitatorURL)
+			rf, err := newRemoteFacilitator(cfg, r.FacilitatorURL)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", r.Network, err)
+			}
+			probeFacilitator(cfg, rf, r.Network)
+			facilitators[r.Network] = rf
+			continue
+		}
+		lf, err := newLocalFacilitator(cfg, r.Network, r.SettlementRPCURL)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", r.Network, err)
+		}
+		slog.Info("network routed to local facilitator",
+			"network", r.Network,
+			"settlement_rpc", config.RedactURL(r.SettlementRPCURL),
+			"relayer", lf.Address().Hex(),
+		)
+		facilitators[r.Network] = lf
+		if cfg.SettlementStuckAfter > 0 {
+			go bumpStuck(lf, cfg.SettlementStuckAfter)
+		}
+	}
+	return x402.NewNetworkFacilitator(facilitators), nil
+}
+
+// newLocalFacilitator builds the local facilitator settling on network
+// through rpcURL from the relayer, settlement and egress proxy settings.
+func newLocalFacilitator(cfg *config.Config, network, rpcURL string) (*x402.LocalFacilitator, error) {
+	chainID, ok := new(big.Int).SetString(strings.TrimPrefix(network, "eip155:"), 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid network %q", network)
+	}
+	signer, err := relayerSigner(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("relayer signer: %w", err)
+	}
+	relayers := make([]x402.Signer, len(cfg.RelayerKeys))
+	for i, keyHex := range cfg.RelayerKeys {
+		relayers[i], err = x402.NewKeySigner(keyHex)
+		if err != nil {
+			return nil, fmt.Errorf("RELAYER_KEYS entry %d: %w", i, err)
+		}
+	}
+	opts := []x402.LocalFacilitatorOption{
+		x402.WithRelayers(relayers...),
+		x402.WithMinValidity(cfg.SettlementMinValidity),
+		x402.WithGasStrategy(x402.GasStrategy{
+			TipMultiplier:      cfg.SettlementTipMultiplier,
+			BaseFeeMultiplier:  cfg.SettlementBaseFeeMultiplier,
+			GasPriceMultiplier: cfg.SettlementGasPriceMultiplier,
+			MaxFeePerGas:       gweiToWei(cfg.SettlementMaxFeeGwei),
+			Legacy:             cfg.SettlementLegacyTx,
+		}),
+	}
+	if cfg.EgressProxyURL != "" {
+		transport, err := proxy.EgressTransport(cfg.EgressProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("egress proxy: %w", err)
+		}
+		opts = append(opts, x402.WithRPCTransport(transport))
+	}
+	return x402.NewLocalFacilitatorWithSigner(rpcURL, signer, chainID, opts...), nil
+}
+
+// relayerAddresses returns the addresses of lf's relayer accounts, the
+// primary one first.
+func relayerAddresses(lf *x402.LocalFacilitator) []string {
+	addrs := make([]string, 0, len(lf.Relayers()))
+	for _, addr := range lf.Relayers() {
+		addrs = append(addrs, addr.Hex())
+	}
+	return addrs
+}
+
+// relayerSigner returns the signer for the local facilitator's primary
+// relayer account, as chosen by RELAYER_SIGNER. A KMS signer reads the key's
+// public key, so this fails if the KMS cannot be reached.
+func relayerSigner(cfg *config.Config) (x402.Signer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	switch cfg.RelayerSigner {
+	case "keystore":
+		return x402.NewKeystoreSigner(cfg.RelayerKeystore, cfg.RelayerKeystorePassword)
+	case "external":
+		return x402.NewExternalSigner(ctx, cfg.RelayerSignerURL, cfg.RelayerSignerAddress)
+	case "aws-kms":
+		return x402.NewAWSKMSSigner(ctx, x402.AWSKMSConfig{
+			KeyID:           cfg.RelayerKMSKey,
+			Region:          cfg.AWSRegion,
+			AccessKeyID:     cfg.AWSAccessKeyID,
+			SecretAccessKey: cfg.AWSSecretAccessKey,
+			SessionToken:    cfg.AWSSessionToken,
+		})
+	case "gcp-kms":
+		return x402.NewGCPKMSSigner(ctx, x402.GCPKMSConfig{
+			KeyVersion:      cfg.RelayerKMSKey,
+			CredentialsFile: cfg.GCPCredentialsFile,
+		})
+	default:
+		return x402.NewKeySigner(cfg.GatewayPrivateKey)
+	}
+}
+
+// gweiToWei converts a gwei amount to wei, or nil when it is not positive.
+func gweiToWei(gwei float64) *big.Int {
+	if gwei <= 0 {
+		return nil
+	}
+	wei, _ := new(big.Float).Mul(big.NewFloat(gwei), big.NewFloat(1e9)).Int(nil)
+	return wei
+}
+
+// refreshPrices periodically re-reads the price feeds of oracle-priced assets
+// and updates the advertised pack amounts.
+func refreshPrices(mw *x402.Middleware, interval time.Duration) {
+	for range time.Tick(interval) {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		if err := mw.RefreshPrices(ctx); err != nil {
+			slog.Warn("price refresh failed", "err", err)
+		}
+		cancel()
+	}
+}
+
+// publishListing registers the gateway with a bazaar, then re-publishes its
+// listing periodically so current prices are shown and it is not dropped as
+// stale.
+func publishListing(mw *x402.Middleware, bazaar *x402.BazaarClient, interval time.Duration) {
+	publish := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := bazaar.Publish(ctx, mw.Listing()); err != nil {
+			slog.Warn("bazaar listing failed", "err", err)
+		}
+	}
+	publish()
+	for range time.Tick(interval) {
+		publish()
+	}
+}
+
+// attachPriceFeeds sets the price feed of each listed asset.
+func attachPriceFeeds(assets []x402.AcceptedAsset, feeds []config.PriceFeed) error {
+	for _, f := range feeds {
+		found := false
+		for i := range assets {
+			if strings.EqualFold(assets[i].Address, f.Asset) {
+				if assets[i].Decimals != 0 && assets[i].Decimals != f.Decimals {
+					return fmt.Errorf("asset %s has %d decimals in TOKEN_REGISTRY but %d in its feed", f.Asset, assets[i].Decimals, f.Decimals)
+				}
+				assets[i].PriceFeed = f.Feed
+				assets[i].Decimals = f.Decimals
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("asset %s is not an accepted asset", f.Asset)
+		}
+	}
+	return nil
+}
+
+// pricingTiers converts configured credit packs to the middleware's type.
+func pricingTiers(in []config.PricingTier) []x402.PricingTier {
+	out := make([]x402.PricingTier, len(in))
+	for i, t := range in {
+		out[i] = x402.PricingTier{Amount: t.Amount, Credits: t.Credits, Methods: t.Methods}
+	}
+	return out
+}
+
+// coupons converts configured coupons to the middleware's type.
+func coupons(in []config.Coupon) []x402.Coupon {
+	out := make([]x402.Coupon, len(in))
+	for i, c := range in {
+		out[i] = x402.Coupon{Code: c.Code, Discount: c.Discount, Bonus: c.Bonus, Expires: c.Expires}
 	}
+	return out
 }
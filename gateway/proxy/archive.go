@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// headRefresh is how long the full node's head block number is reused before
+// being asked for again.
+const headRefresh = 2 * time.Second
+
+// blockParam is, per method reading state at a block, the index of the param
+// naming the block. It defaults to "latest" when left out.
+var blockParam = map[string]int{
+	"debug_traceCall":         1,
+	"eth_call":                1,
+	"eth_createAccessList":    1,
+	"eth_estimateGas":         1,
+	"eth_getBalance":          1,
+	"eth_getCode":             1,
+	"eth_getProof":            2,
+	"eth_getStorageAt":        2,
+	"eth_getTransactionCount": 1,
+}
+
+// methodPattern matches a JSON-RPC method ("eth_call") or namespace with a
+// trailing "*" ("debug_*").
+type methodPattern struct {
+	method   string // a method, or a prefix with wildcard set
+	wildcard bool
+}
+
+func parseMethodPattern(s string) (methodPattern, error) {
+	var p methodPattern
+	p.method, p.wildcard = strings.CutSuffix(s, "*")
+	if p.method == "" || strings.Contains(p.method, "*") {
+		return methodPattern{}, fmt.Errorf("invalid method pattern %q", s)
+	}
+	return p, nil
+}
+
+func (p methodPattern) match(method string) bool {
+	if p.wildcard {
+		return strings.HasPrefix(method, p.method)
+	}
+	return method == p.method
+}
+
+// archiveRoute sends calls of the methods it matches to the archive
+// upstream: all of them, or with a minimum age only those reading state at a
+// block that many blocks or more behind the full node's head.
+type archiveRoute struct {
+	methodPattern
+	minAge uint64
+}
+
+// ArchiveRouter sends the calls that need historical state to an archive
+// node and every other call to a cheaper full node. A batch goes to the
+// archive node if any of its calls does.
+type ArchiveRouter struct {
+	full    http.Handler
+	archive *RPC
+	routes  []archiveRoute
+	client  *rpc.Client // of the full node, asked for its head
+
+	mu     sync.Mutex
+	head   uint64
+	headAt time.Time
+}
+
+// NewArchiveRouter returns a router sending calls to full, the proxy to
+// upstreamURL, or to archiveURL as routes say. A route is a method
+// ("eth_call") or namespace ("debug_*"), optionally followed by ":" and a
+// minimum block age ("eth_call:128"), which applies to the methods in
+// blockParam only.
+func NewArchiveRouter(full http.Handler, upstreamURL, archiveURL string, routes []string) (*ArchiveRouter, error) {
+	r := &ArchiveRouter{full: full}
+	for _, route := range routes {
+		method, age, hasAge := strings.Cut(route, ":")
+		pattern, err := parseMethodPattern(method)
+		if err != nil {
+			return nil, fmt.Errorf("invalid archive route %q", route)
+		}
+		rt := archiveRoute{methodPattern: pattern}
+		if hasAge {
+			n, err := strconv.ParseUint(age, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid block age in archive route %q", route)
+			}
+			rt.minAge = n
+		}
+		r.routes = append(r.routes, rt)
+	}
+	var err error
+	if r.archive, err = NewRPC(archiveURL, ""); err != nil {
+		return nil, err
+	}
+	if r.client, err = dialUpstream(upstreamURL); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// ServeHTTP forwards the request to the archive or the full node.
+func (r *ArchiveRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	if err == nil {
+		elems, _, _ := splitMessage(body)
+		for _, e := range elems {
+			var call cacheCall
+			if json.Unmarshal(e, &call) == nil && r.needsArchive(req.Context(), call) {
+				r.archive.ServeHTTP(w, req)
+				return
+			}
+		}
+	}
+	r.full.ServeHTTP(w, req)
+}
+
+// needsArchive reports whether call is routed to the archive node.
+func (r *ArchiveRouter) needsArchive(ctx context.Context, call cacheCall) bool {
+	for _, rt := range r.routes {
+		if !rt.match(call.Method) {
+			continue
+		}
+		if rt.minAge == 0 {
+			return true
+		}
+		i, ok := blockParam[call.Method]
+		if !ok {
+			continue
+		}
+		var params []json.RawMessage
+		if json.Unmarshal(call.Params, &params) != nil || len(params) <= i {
+			return false
+		}
+		return r.old(ctx, params[i], rt.minAge)
+	}
+	return false
+}
+
+// old reports whether block, a block tag, number, hash or EIP-1898 object,
+// is at least minAge blocks behind the head. Blocks whose age cannot be
+// told are taken to be old: the archive node has every block.
+func (r *ArchiveRouter) old(ctx context.Context, block json.RawMessage, minAge uint64) bool {
+	var ref struct {
+		BlockNumber string `json:"blockNumber"`
+		BlockHash   string `json:"blockHash"`
+	}
+	var tag string
+	switch {
+	case json.Unmarshal(block, &tag) == nil:
+	case json.Unmarshal(block, &ref) == nil && ref.BlockHash == "":
+		tag = ref.BlockNumber
+	default:
+		return true
+	}
+	switch tag {
+	case "latest", "pending", "safe", "finalized", "":
+		return false
+	case "earliest":
+		return true
+	}
+	number, err := hexutil.DecodeUint64(tag)
+	if err != nil {
+		return true
+	}
+	head, err := r.headBlock(ctx)
+	if err != nil {
+		return true
+	}
+	return number+minAge <= head
+}
+
+// headBlock returns the number of the full node's head block, asking it at
+// most every headRefresh.
+func (r *ArchiveRouter) headBlock(ctx context.Context) (uint64, error) {
+	r.mu.Lock()
+	if time.Since(r.headAt) < headRefresh {
+		defer r.mu.Unlock()
+		return r.head, nil
+	}
+	r.mu.Unlock()
+	var head hexutil.Uint64
+	if err := r.client.CallContext(ctx, &head, "eth_blockNumber"); err != nil {
+		return 0, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.head, r.headAt = uint64(head), time.Now()
+	return r.head, nil
+}
@@ -0,0 +1,356 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// CacheHeader is set to "HIT" on responses answered from the cache.
+const CacheHeader = "X-Rpc-Cache"
+
+const (
+	// finalizedRefresh is how long the upstream's finalized block number is
+	// reused before being asked for again.
+	finalizedRefresh = 12 * time.Second
+	// maxCachedResult is the largest response the cache keeps.
+	maxCachedResult = 1 << 20
+	// maxHeadEntries is how many head results are kept before the expired
+	// ones are swept.
+	maxHeadEntries = 1024
+)
+
+// headMethods change with every block, but a burst of clients polling them
+// can share one answer: they are served from a copy at most HeadTTL old.
+var headMethods = map[string]bool{
+	"eth_blockNumber": true,
+	"eth_feeHistory":  true,
+	"eth_gasPrice":    true,
+}
+
+// cachedBlockField names, per cacheable method, the field of the result
+// holding the number of the block it belongs to. The result is cached once
+// that block is finalized, and never while it is null. Methods with no
+// field are answered the same for as long as the upstream serves one chain.
+var cachedBlockField = map[string]string{
+	"eth_chainId":               "",
+	"net_version":               "",
+	"eth_getBlockByHash":        "number",
+	"eth_getBlockByNumber":      "number",
+	"eth_getBlockReceipts":      "blockNumber",
+	"eth_getTransactionByHash":  "blockNumber",
+	"eth_getTransactionReceipt": "blockNumber",
+}
+
+// CacheStore keeps the results of cached calls.
+type CacheStore interface {
+	// Get returns the value stored under key, and false if there is none.
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	// Set stores value under key.
+	Set(ctx context.Context, key string, value []byte) error
+}
+
+// CacheConfig configures a Cache.
+type CacheConfig struct {
+	// Store, when set, keeps the results that cannot change: the chain ID,
+	// and blocks, transactions and receipts of finalized blocks.
+	Store CacheStore
+	// HeadTTL, when positive, is how long results of headMethods are
+	// reused, in memory.
+	HeadTTL time.Duration
+}
+
+// Cache answers JSON-RPC calls from cached results without calling the
+// upstream: those that cannot change from a CacheStore, and head-of-chain
+// queries from a copy a few hundred milliseconds old. Other calls, batches
+// and misses go to next, and a miss's result is kept if it may be.
+type Cache struct {
+	next   http.Handler
+	cfg    CacheConfig
+	client *rpc.Client
+
+	mu          sync.Mutex
+	chainID     *big.Int // of the upstream, prefixing the keys
+	finalized   uint64
+	finalizedAt time.Time
+
+	headMu sync.Mutex
+	head   map[string]headEntry // by method and params
+}
+
+// headEntry is a result of a head method.
+type headEntry struct {
+	result  json.RawMessage
+	expires time.Time
+}
+
+// NewCache returns a Cache in front of next, the proxy to upstreamURL, which
+// is asked for its chain ID and finalized block.
+func NewCache(next http.Handler, upstreamURL string, cfg CacheConfig) (*Cache, error) {
+	client, err := dialUpstream(upstreamURL)
+	if err != nil {
+		return nil, err
+	}
+	return &Cache{next: next, cfg: cfg, client: client, head: make(map[string]headEntry)}, nil
+}
+
+// ServeHTTP answers the call from the cache if it can, and forwards it to the
+// upstream otherwise.
+func (c *Cache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		c.next.ServeHTTP(w, r)
+		return
+	}
+	var call cacheCall
+	switch {
+	case json.Unmarshal(body, &call) != nil:
+		c.next.ServeHTTP(w, r)
+	case c.cfg.HeadTTL > 0 && headMethods[call.Method]:
+		c.serveHead(w, r, call)
+	case c.cfg.Store != nil && finalCall(call):
+		c.serveFinal(w, r, call)
+	default:
+		c.next.ServeHTTP(w, r)
+	}
+}
+
+// serveFinal answers call from the store, or forwards it and stores its
+// result if it turns out to be final.
+func (c *Cache) serveFinal(w http.ResponseWriter, r *http.Request, call cacheCall) {
+	key, err := c.key(r.Context(), call)
+	if err != nil {
+		slog.Warn("response cache unavailable", "err", err)
+		c.next.ServeHTTP(w, r)
+		return
+	}
+	result, hit, err := c.cfg.Store.Get(r.Context(), key)
+	if err != nil {
+		slog.Warn("response cache read failed", "err", err)
+	}
+	if hit {
+		writeHit(w, call, result)
+		return
+	}
+	result, ok := c.forward(w, r)
+	if !ok || !c.final(r.Context(), call.Method, result) {
+		return
+	}
+	if err := c.cfg.Store.Set(r.Context(), key, result); err != nil {
+		slog.Warn("response cache write failed", "err", err)
+	}
+}
+
+// serveHead answers call from a result of the same query at most HeadTTL
+// old, or forwards it and keeps its result.
+func (c *Cache) serveHead(w http.ResponseWriter, r *http.Request, call cacheCall) {
+	var params bytes.Buffer
+	if len(call.Params) > 0 && json.Compact(&params, call.Params) != nil {
+		c.next.ServeHTTP(w, r)
+		return
+	}
+	key := call.Method + "\x00" + params.String()
+	now := time.Now()
+	c.headMu.Lock()
+	e, hit := c.head[key]
+	c.headMu.Unlock()
+	if hit && now.Before(e.expires) {
+		writeHit(w, call, e.result)
+		return
+	}
+
+	result, ok := c.forward(w, r)
+	if !ok || string(result) == "null" {
+		return
+	}
+	c.headMu.Lock()
+	defer c.headMu.Unlock()
+	if len(c.head) >= maxHeadEntries {
+		for k, e := range c.head {
+			if now.After(e.expires) {
+				delete(c.head, k)
+			}
+		}
+	}
+	c.head[key] = headEntry{result: result, expires: now.Add(c.cfg.HeadTTL)}
+}
+
+// forward passes the call to the upstream and returns its result, if it
+// answered with one small enough to keep.
+func (c *Cache) forward(w http.ResponseWriter, r *http.Request) (json.RawMessage, bool) {
+	rec := &cacheRecorder{ResponseWriter: w}
+	c.next.ServeHTTP(rec, r)
+	if rec.status != http.StatusOK || rec.overflow || rec.Header().Get("Content-Encoding") != "" {
+		return nil, false
+	}
+	var resp struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if json.Unmarshal(rec.body.Bytes(), &resp) != nil || len(resp.Result) == 0 {
+		return nil, false
+	}
+	return resp.Result, true
+}
+
+// writeHit answers call with a cached result.
+func writeHit(w http.ResponseWriter, call cacheCall, result json.RawMessage) {
+	resp, _ := json.Marshal(map[string]any{"jsonrpc": "2.0", "id": call.ID, "result": result})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(CacheHeader, "HIT")
+	_, _ = w.Write(resp)
+}
+
+// cacheCall is a JSON-RPC call the cache may answer.
+type cacheCall struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+// finalCall reports whether call is to a method whose final results are
+// stored, with params naming a block by hash or number, not by a tag such as
+// "latest".
+func finalCall(call cacheCall) bool {
+	if _, ok := cachedBlockField[call.Method]; !ok {
+		return false
+	}
+	if call.Method == "eth_getBlockByNumber" || call.Method == "eth_getBlockReceipts" {
+		var params []json.RawMessage
+		var block string
+		if json.Unmarshal(call.Params, &params) != nil || len(params) == 0 || json.Unmarshal(params[0], &block) != nil {
+			return false
+		}
+		if !strings.HasPrefix(block, "0x") {
+			return false
+		}
+	}
+	return true
+}
+
+// key returns the cache key of call: the upstream's chain ID, the method and
+// a digest of the params, compacted.
+func (c *Cache) key(ctx context.Context, call cacheCall) (string, error) {
+	c.mu.Lock()
+	chainID := c.chainID
+	c.mu.Unlock()
+	if chainID == nil {
+		var id hexutil.Big
+		if err := c.client.CallContext(ctx, &id, "eth_chainId"); err != nil {
+			return "", fmt.Errorf("reading upstream chain ID: %w", err)
+		}
+		c.mu.Lock()
+		c.chainID, chainID = id.ToInt(), id.ToInt()
+		c.mu.Unlock()
+	}
+	var params bytes.Buffer
+	if len(call.Params) > 0 && json.Compact(&params, call.Params) != nil {
+		return "", fmt.Errorf("invalid params")
+	}
+	sum := sha256.Sum256(append([]byte(call.Method+"\x00"), params.Bytes()...))
+	return fmt.Sprintf("rpc:%s:%s:%s", chainID, call.Method, hex.EncodeToString(sum[:])), nil
+}
+
+// final reports whether result, the answer to a call of method, can no
+// longer change.
+func (c *Cache) final(ctx context.Context, method string, result json.RawMessage) bool {
+	if len(result) == 0 || string(result) == "null" {
+		return false
+	}
+	field := cachedBlockField[method]
+	if field == "" {
+		return true
+	}
+	// Block receipts are an array, all of the same block.
+	if result[0] == '[' {
+		var items []json.RawMessage
+		if json.Unmarshal(result, &items) != nil || len(items) == 0 {
+			return false
+		}
+		result = items[0]
+	}
+	var fields map[string]json.RawMessage
+	var number hexutil.Uint64
+	if json.Unmarshal(result, &fields) != nil || json.Unmarshal(fields[field], &number) != nil {
+		return false
+	}
+	finalized, err := c.finalizedBlock(ctx)
+	if err != nil {
+		slog.Warn("reading upstream finalized block failed", "err", err)
+		return false
+	}
+	return uint64(number) <= finalized
+}
+
+// finalizedBlock returns the number of the upstream's finalized block,
+// asking it at most every finalizedRefresh.
+func (c *Cache) finalizedBlock(ctx context.Context) (uint64, error) {
+	c.mu.Lock()
+	if time.Since(c.finalizedAt) < finalizedRefresh {
+		defer c.mu.Unlock()
+		return c.finalized, nil
+	}
+	c.mu.Unlock()
+	// Only the number is read: not every chain's headers decode as
+	// go-ethereum's.
+	var head struct {
+		Number hexutil.Uint64 `json:"number"`
+	}
+	if err := c.client.CallContext(ctx, &head, "eth_getBlockByNumber", "finalized", false); err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.finalized, c.finalizedAt = uint64(head.Number), time.Now()
+	return c.finalized, nil
+}
+
+// cacheRecorder passes a response through, keeping a copy of its body up to
+// maxCachedResult.
+type cacheRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (r *cacheRecorder) WriteHeader(status int) {
+	if r.status == 0 && status >= http.StatusOK {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *cacheRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	if !r.overflow {
+		if r.body.Len()+len(b) > maxCachedResult {
+			r.overflow = true
+			r.body.Reset()
+		} else {
+			r.body.Write(b)
+		}
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *cacheRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,252 @@
+package proxy
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InMemoryCacheStore is a CacheStore holding at most maxEntries results,
+// evicting the least recently used.
+type InMemoryCacheStore struct {
+	mu         sync.Mutex
+	maxEntries int
+	order      *list.List // of *memoryEntry, most recently used first
+	entries    map[string]*list.Element
+}
+
+type memoryEntry struct {
+	key   string
+	value []byte
+}
+
+// NewInMemoryCacheStore creates an empty in-memory cache store.
+func NewInMemoryCacheStore(maxEntries int) *InMemoryCacheStore {
+	return &InMemoryCacheStore{
+		maxEntries: maxEntries,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+// Get returns the value stored under key.
+func (s *InMemoryCacheStore) Get(_ context.Context, key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	s.order.MoveToFront(e)
+	return e.Value.(*memoryEntry).value, true, nil
+}
+
+// Set stores value under key, evicting the least recently used entry if the
+// store is full.
+func (s *InMemoryCacheStore) Set(_ context.Context, key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[key]; ok {
+		e.Value.(*memoryEntry).value = value
+		s.order.MoveToFront(e)
+		return nil
+	}
+	s.entries[key] = s.order.PushFront(&memoryEntry{key: key, value: value})
+	if s.maxEntries > 0 && s.order.Len() > s.maxEntries {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*memoryEntry).key)
+	}
+	return nil
+}
+
+const (
+	// redisTimeout bounds one Redis command, including connecting. A slow
+	// cache is skipped rather than waited for.
+	redisTimeout = time.Second
+	// redisPoolSize is how many idle Redis connections are kept.
+	redisPoolSize = 16
+	// redisTTL is how long a result is kept in Redis. Results never go
+	// stale; the expiry only bounds the cache's size.
+	redisTTL = 24 * time.Hour
+)
+
+// RedisCacheStore is a CacheStore in Redis, shared by the gateway's
+// replicas. It speaks just enough of the Redis protocol for GET and SET.
+type RedisCacheStore struct {
+	addr     string
+	tls      bool
+	username string
+	password string
+	db       int
+	pool     chan *redisConn
+}
+
+// NewRedisCacheStore connects to the Redis server at rawURL,
+// redis://[[user]:password@]host:port[/db] or rediss:// for TLS.
+func NewRedisCacheStore(ctx context.Context, rawURL string) (*RedisCacheStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("Redis URL must be redis:// or rediss://, got %q", rawURL)
+	}
+	s := &RedisCacheStore{
+		addr: u.Host,
+		tls:  u.Scheme == "rediss",
+		pool: make(chan *redisConn, redisPoolSize),
+	}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		s.username = u.User.Username()
+		s.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if s.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid Redis database %q", db)
+		}
+	}
+	// Fail at startup, not on the first cacheable call.
+	if _, err := s.do(ctx, "PING"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get returns the value stored under key.
+func (s *RedisCacheStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	reply, err := s.do(ctx, "GET", key)
+	if err != nil || reply == nil {
+		return nil, false, err
+	}
+	return reply, true, nil
+}
+
+// Set stores value under key for redisTTL.
+func (s *RedisCacheStore) Set(ctx context.Context, key string, value []byte) error {
+	_, err := s.do(ctx, "SET", key, string(value), "EX", strconv.Itoa(int(redisTTL.Seconds())))
+	return err
+}
+
+// do runs a command on a pooled connection and returns its reply: a bulk or
+// simple string, or nil for a nil reply.
+func (s *RedisCacheStore) do(ctx context.Context, args ...string) ([]byte, error) {
+	c, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.do(args...)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	select {
+	case s.pool <- c:
+	default:
+		c.Close()
+	}
+	return reply, nil
+}
+
+// conn returns an idle connection, or a new one, logged in and on the
+// configured database.
+func (s *RedisCacheStore) conn(ctx context.Context) (*redisConn, error) {
+	select {
+	case c := <-s.pool:
+		return c, nil
+	default:
+	}
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	var nc net.Conn
+	var err error
+	if s.tls {
+		d := &tls.Dialer{Config: &tls.Config{MinVersion: tls.VersionTLS12}}
+		nc, err = d.DialContext(ctx, "tcp", s.addr)
+	} else {
+		var d net.Dialer
+		nc, err = d.DialContext(ctx, "tcp", s.addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis connect: %w", err)
+	}
+	c := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+	if s.password != "" {
+		args := []string{"AUTH", s.password}
+		if s.username != "" {
+			args = []string{"AUTH", s.username, s.password}
+		}
+		if _, err := c.do(args...); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if s.db != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(s.db)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// redisConn is a connection to Redis.
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// do sends a command and reads its reply.
+func (c *redisConn) do(args ...string) ([]byte, error) {
+	_ = c.SetDeadline(time.Now().Add(redisTimeout))
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(c, b.String()); err != nil {
+		return nil, err
+	}
+
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad reply %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Coalescer sends identical read calls that arrive while one is in flight to
+// the upstream once, and answers them all with its response, each under its
+// own request ID. Only single calls to safeMethods are coalesced, save the
+// streamedMethods, which are not held in memory; everything else goes to
+// next as it comes.
+type Coalescer struct {
+	next  http.Handler
+	group singleflight.Group
+}
+
+// NewCoalescer returns a Coalescer in front of next.
+func NewCoalescer(next http.Handler) *Coalescer {
+	return &Coalescer{next: next}
+}
+
+// ServeHTTP joins the call to an identical one in flight, or forwards it.
+func (c *Coalescer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		c.next.ServeHTTP(w, r)
+		return
+	}
+	var call cacheCall
+	var params bytes.Buffer
+	if json.Unmarshal(body, &call) != nil || !safeMethods[call.Method] || streamedMethods[call.Method] || idKey(call.ID) == "" ||
+		(len(call.Params) > 0 && json.Compact(&params, call.Params) != nil) {
+		c.next.ServeHTTP(w, r)
+		return
+	}
+
+	key := r.URL.RequestURI() + "\x00" + call.Method + "\x00" + params.String()
+	ch := c.group.DoChan(key, func() (any, error) {
+		return c.forward(r, body)
+	})
+	var res singleflight.Result
+	select {
+	case <-r.Context().Done():
+		return
+	case res = <-ch:
+	}
+	if res.Err != nil {
+		slog.Error("upstream RPC error", "err", res.Err)
+		http.Error(w, "upstream unavailable", http.StatusBadGateway)
+		return
+	}
+
+	resp := res.Val.(*sharedResponse)
+	out := resp.body
+	if res.Shared && resp.status == http.StatusOK {
+		out = withField(out, "id", call.ID)
+	}
+	resp.writeTo(w, out)
+}
+
+// forward makes the call for everyone waiting on it. It outlives the client
+// that started it, whose going away must not fail the others.
+func (c *Coalescer) forward(r *http.Request, body []byte) (*sharedResponse, error) {
+	req := r.Clone(context.WithoutCancel(r.Context()))
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return serveBuffered(c.next, req)
+}
+
+// serveBuffered serves req with h into a buffered response. It asks for an
+// uncompressed one, as the gateway reads or rewrites it.
+func serveBuffered(h http.Handler, req *http.Request) (resp *sharedResponse, err error) {
+	// The reverse proxy aborts with a panic when the upstream fails mid-body;
+	// here that is an error, not a crash.
+	defer func() {
+		if p := recover(); p != nil {
+			resp, err = nil, fmt.Errorf("buffered upstream call: %v", p)
+		}
+	}()
+	req.Header.Del("Accept-Encoding")
+	resp = &sharedResponse{header: make(http.Header)}
+	h.ServeHTTP(resp, req)
+	if resp.status == 0 {
+		resp.status = http.StatusOK
+	}
+	return resp, nil
+}
+
+// sharedResponse is a buffered response, to be written to a client in place
+// of, or along with, others.
+type sharedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+func (r *sharedResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *sharedResponse) WriteHeader(status int) {
+	if r.status == 0 && status >= http.StatusOK {
+		r.status = status
+	}
+}
+
+func (r *sharedResponse) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body = append(r.body, b...)
+	return len(b), nil
+}
+
+// writeTo writes the response to w with body in place of its own.
+func (r *sharedResponse) writeTo(w http.ResponseWriter, body []byte) {
+	for name, values := range r.header {
+		if name != "Content-Length" {
+			w.Header()[name] = values
+		}
+	}
+	w.WriteHeader(r.status)
+	_, _ = w.Write(body)
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// EgressTransport returns an HTTP transport dialing every connection through
+// the SOCKS5 proxy at proxyURL, such as a local Tor's
+// "socks5://127.0.0.1:9050". Host names are resolved by the proxy, so
+// neither the connections nor their DNS lookups come from the gateway. It
+// is otherwise tuned as SetTransport was told.
+func EgressTransport(proxyURL string) (*http.Transport, error) {
+	u, err := socksURL(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	t := newTransport()
+	t.Proxy = http.ProxyURL(u)
+	return t, nil
+}
+
+// SetEgressProxy sends the package's connections to upstreams, HTTP and
+// WebSocket alike, through the SOCKS5 proxy at proxyURL, so upstream
+// providers see the proxy's address rather than the gateway's. It must be
+// called before any proxy is created.
+func SetEgressProxy(proxyURL string) error {
+	t, err := EgressTransport(proxyURL)
+	if err != nil {
+		return err
+	}
+	u, _ := socksURL(proxyURL)
+	upstreamTransport = t
+	wsDialer.Proxy = http.ProxyURL(u)
+	return nil
+}
+
+// socksURL parses a socks5:// or socks5h:// proxy URL. Both are resolved
+// remotely; the WebSocket dialer only knows the first.
+func socksURL(proxyURL string) (*url.URL, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "socks5" && u.Scheme != "socks5h") || u.Host == "" {
+		return nil, fmt.Errorf("egress proxy must be a socks5:// URL, got %q", proxyURL)
+	}
+	u.Scheme = "socks5"
+	return u, nil
+}
+
+// dialUpstream returns a client of the upstream at rawURL connecting the way
+// the proxies do.
+func dialUpstream(rawURL string) (*rpc.Client, error) {
+	return rpc.DialOptions(context.Background(), rawURL, rpc.WithHTTPClient(&http.Client{Transport: upstreamTransport}))
+}
@@ -0,0 +1,239 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/beacon/blsync"
+	"github.com/ethereum/go-ethereum/beacon/engine"
+	bparams "github.com/ethereum/go-ethereum/beacon/params"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// maxVerifiedBlocks is how many blocks behind the verified head are kept to
+// verify calls against.
+const maxVerifiedBlocks = 256
+
+// lightNetworks are the chains the light client follows: their beacon chain,
+// whose sync committee signs the heads, and their execution chain, whose
+// rules calls are verified under.
+var lightNetworks = map[string]struct {
+	beacon *bparams.ChainConfig
+	chain  *params.ChainConfig
+}{
+	"mainnet": {bparams.MainnetLightConfig, params.MainnetChainConfig},
+	"sepolia": {bparams.SepoliaLightConfig, params.SepoliaChainConfig},
+	"holesky": {bparams.HoleskyLightConfig, params.HoleskyChainConfig},
+	"hoodi":   {bparams.HoodiLightConfig, params.HoodiChainConfig},
+}
+
+// verifiedBlock is an execution block whose header the light client has
+// verified: the sync committee signed the beacon block carrying it.
+type verifiedBlock struct {
+	hash   common.Hash
+	header *types.Header // the fields calls execute against; not hashable
+}
+
+// verifiedChain is the recent execution chain as the light client verified
+// it, from the beacon API, without trusting the upstream.
+type verifiedChain struct {
+	mu        sync.Mutex
+	byHash    map[common.Hash]*verifiedBlock
+	byNumber  map[uint64]*verifiedBlock // canonical
+	head      *verifiedBlock
+	finalized *verifiedBlock
+}
+
+// startLightClient starts a beacon light client following network through
+// the beacon APIs at beaconURLs, and returns the chain it verifies.
+func startLightClient(network string, beaconURLs []string) (*verifiedChain, *params.ChainConfig, error) {
+	n, ok := lightNetworks[network]
+	if !ok {
+		return nil, nil, fmt.Errorf("light client: unknown network %q", network)
+	}
+	if len(beaconURLs) == 0 {
+		return nil, nil, fmt.Errorf("light client: no beacon API")
+	}
+	chain := &verifiedChain{
+		byHash:   make(map[common.Hash]*verifiedBlock),
+		byNumber: make(map[uint64]*verifiedBlock),
+	}
+	// The light client hands the heads it verified to an execution client's
+	// engine API; here that is chain's, in process.
+	server := rpc.NewServer()
+	if err := server.RegisterName("engine", &engineAPI{chain: chain}); err != nil {
+		return nil, nil, err
+	}
+	client := blsync.NewClient(bparams.ClientConfig{
+		ChainConfig: *n.beacon,
+		Apis:        beaconURLs,
+		Threshold:   bparams.SyncCommitteeSupermajority,
+	})
+	client.SetEngineRPC(rpc.DialInProc(server))
+	if err := client.Start(); err != nil {
+		return nil, nil, err
+	}
+	return chain, n.chain, nil
+}
+
+// add records a verified block, not yet the head.
+func (c *verifiedChain) add(data engine.ExecutableData) {
+	number := new(big.Int).SetUint64(data.Number)
+	b := &verifiedBlock{
+		hash: data.BlockHash,
+		header: &types.Header{
+			ParentHash:    data.ParentHash,
+			Coinbase:      data.FeeRecipient,
+			Root:          data.StateRoot,
+			Difficulty:    new(big.Int),
+			Number:        number,
+			GasLimit:      data.GasLimit,
+			Time:          data.Timestamp,
+			MixDigest:     data.Random,
+			BaseFee:       data.BaseFeePerGas,
+			ExcessBlobGas: data.ExcessBlobGas,
+		},
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.byHash[b.hash] = b
+}
+
+// setHead makes the block hashed head the head of the chain, and the one
+// hashed finalized finalized.
+func (c *verifiedChain) setHead(head, finalized common.Hash) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.byHash[head]
+	if !ok {
+		return
+	}
+	c.head = b
+	if f, ok := c.byHash[finalized]; ok {
+		c.finalized = f
+	}
+	// The chain leading to the head is canonical, as far as it is known.
+	for ; ok; b, ok = c.byHash[b.header.ParentHash] {
+		n := b.header.Number.Uint64()
+		if c.byNumber[n] == b {
+			break
+		}
+		c.byNumber[n] = b
+	}
+
+	oldest := c.head.header.Number.Uint64()
+	if oldest < maxVerifiedBlocks {
+		return
+	}
+	oldest -= maxVerifiedBlocks
+	for hash, b := range c.byHash {
+		if b.header.Number.Uint64() < oldest {
+			delete(c.byHash, hash)
+		}
+	}
+	for n := range c.byNumber {
+		if n < oldest {
+			delete(c.byNumber, n)
+		}
+	}
+}
+
+// block returns the verified block ref names: a block tag, number, hash or
+// EIP-1898 object, or nil for the latest block. It returns false if the
+// block is not among the verified ones.
+func (c *verifiedChain) block(ref json.RawMessage) (*verifiedBlock, bool) {
+	var obj struct {
+		BlockNumber string      `json:"blockNumber"`
+		BlockHash   common.Hash `json:"blockHash"`
+	}
+	var tag string
+	switch {
+	case len(ref) == 0 || string(ref) == "null":
+		tag = "latest"
+	case json.Unmarshal(ref, &tag) == nil:
+	case json.Unmarshal(ref, &obj) == nil && obj.BlockHash != (common.Hash{}):
+		tag = obj.BlockHash.Hex()
+	case obj.BlockNumber != "":
+		tag = obj.BlockNumber
+	default:
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var b *verifiedBlock
+	switch {
+	case tag == "latest":
+		b = c.head
+	case tag == "safe" || tag == "finalized":
+		b = c.finalized
+	case len(tag) == 2+2*common.HashLength && strings.HasPrefix(tag, "0x"):
+		b = c.byHash[common.HexToHash(tag)]
+	default:
+		n, err := hexutil.DecodeUint64(tag)
+		if err != nil {
+			return nil, false
+		}
+		b = c.byNumber[n]
+	}
+	return b, b != nil
+}
+
+// hashOf returns the hash of the canonical verified block numbered n, or the
+// zero hash if it is not known, for the BLOCKHASH opcode.
+func (c *verifiedChain) hashOf(n uint64) common.Hash {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if b, ok := c.byNumber[n]; ok {
+		return b.hash
+	}
+	return common.Hash{}
+}
+
+// engineAPI is the part of the engine API the light client calls, accepting
+// every payload: the light client verified it before handing it over.
+type engineAPI struct {
+	chain *verifiedChain
+}
+
+var validPayload = engine.PayloadStatusV1{Status: engine.VALID}
+
+func (e *engineAPI) NewPayloadV1(data engine.ExecutableData) engine.PayloadStatusV1 {
+	e.chain.add(data)
+	return validPayload
+}
+
+func (e *engineAPI) NewPayloadV2(data engine.ExecutableData) engine.PayloadStatusV1 {
+	e.chain.add(data)
+	return validPayload
+}
+
+func (e *engineAPI) NewPayloadV3(data engine.ExecutableData, _ []common.Hash, _ *common.Hash) engine.PayloadStatusV1 {
+	e.chain.add(data)
+	return validPayload
+}
+
+func (e *engineAPI) NewPayloadV4(data engine.ExecutableData, _ []common.Hash, _ *common.Hash, _ []hexutil.Bytes) engine.PayloadStatusV1 {
+	e.chain.add(data)
+	return validPayload
+}
+
+func (e *engineAPI) ForkchoiceUpdatedV1(update engine.ForkchoiceStateV1, _ *engine.PayloadAttributes) engine.ForkChoiceResponse {
+	e.chain.setHead(update.HeadBlockHash, update.FinalizedBlockHash)
+	return engine.ForkChoiceResponse{PayloadStatus: validPayload}
+}
+
+func (e *engineAPI) ForkchoiceUpdatedV2(update engine.ForkchoiceStateV1, attrs *engine.PayloadAttributes) engine.ForkChoiceResponse {
+	return e.ForkchoiceUpdatedV1(update, attrs)
+}
+
+func (e *engineAPI) ForkchoiceUpdatedV3(update engine.ForkchoiceStateV1, attrs *engine.PayloadAttributes) engine.ForkChoiceResponse {
+	return e.ForkchoiceUpdatedV1(update, attrs)
+}
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// quorumProvider is one of the upstreams a Quorum cross-checks.
+type quorumProvider struct {
+	name string // the upstream's host, as logged and exported
+	rpc  *RPC
+}
+
+// Quorum sends single calls to the methods it checks to every provider at
+// once and answers with the result more than half of those that answered
+// agree on, so one lying or stale provider cannot mislead the client.
+// Providers answering otherwise are logged and counted in the quorum
+// metrics; without a majority the call fails with 502. Other requests go to
+// next.
+type Quorum struct {
+	next      http.Handler
+	providers []quorumProvider
+	methods   []methodPattern
+}
+
+// NewQuorum returns a Quorum in front of next, cross-checking the calls to
+// methods, exact names or namespaces such as "eth_get*", on the upstreams at
+// providerURLs.
+func NewQuorum(next http.Handler, providerURLs, methods []string) (*Quorum, error) {
+	q := &Quorum{next: next}
+	for _, m := range methods {
+		p, err := parseMethodPattern(m)
+		if err != nil {
+			return nil, err
+		}
+		q.methods = append(q.methods, p)
+	}
+	for _, raw := range providerURLs {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, err
+		}
+		rp, err := NewRPC(raw, "")
+		if err != nil {
+			return nil, err
+		}
+		q.providers = append(q.providers, quorumProvider{name: u.Host, rpc: rp})
+	}
+	return q, nil
+}
+
+// ServeHTTP cross-checks the call if it is one of the checked methods, and
+// forwards it to next otherwise.
+func (q *Quorum) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	var call cacheCall
+	if err != nil || json.Unmarshal(body, &call) != nil || !q.checks(call.Method) {
+		q.next.ServeHTTP(w, r)
+		return
+	}
+
+	answers := make([]*sharedResponse, len(q.providers))
+	votes := make([]string, len(q.providers)) // "" for no answer
+	var wg sync.WaitGroup
+	for i, p := range q.providers {
+		req := r.Clone(r.Context())
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := serveBuffered(p.rpc, req)
+			if err != nil || resp.status != http.StatusOK {
+				return
+			}
+			var out struct {
+				Result json.RawMessage `json:"result"`
+				Error  json.RawMessage `json:"error"`
+			}
+			var vote bytes.Buffer
+			if json.Unmarshal(resp.body, &out) != nil || json.Compact(&vote, append(out.Result, out.Error...)) != nil {
+				return
+			}
+			answers[i], votes[i] = resp, vote.String()
+		}()
+	}
+	wg.Wait()
+
+	counts := make(map[string]int)
+	answered := 0
+	for _, v := range votes {
+		if v != "" {
+			counts[v]++
+			answered++
+		}
+	}
+	majority := ""
+	for v, n := range counts {
+		if 2*n > answered {
+			majority = v
+		}
+	}
+	for i, v := range votes {
+		result := "agree"
+		switch {
+		case v == "":
+			result = "failed"
+		case v != majority:
+			result = "diverged"
+			slog.Warn("upstream answer diverges from the quorum", "provider", q.providers[i].name, "method", call.Method)
+		}
+		quorumMetrics.observe(q.providers[i].name, result)
+	}
+
+	switch {
+	case answered == 0:
+		slog.Error("upstream RPC error", "err", "no quorum provider answered", "method", call.Method)
+		http.Error(w, "upstream unavailable", http.StatusBadGateway)
+	case majority == "":
+		slog.Warn("quorum providers disagree", "method", call.Method, "answers", answered, "distinct", len(counts))
+		reply, _ := json.Marshal(map[string]any{
+			"jsonrpc": "2.0",
+			"id":      call.ID,
+			"error":   map[string]any{"code": rpcInternalError, "message": "upstream providers disagree"},
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write(reply)
+	default:
+		for i, v := range votes {
+			if v == majority {
+				answers[i].writeTo(w, answers[i].body)
+				return
+			}
+		}
+	}
+}
+
+// checks reports whether calls to method are cross-checked.
+func (q *Quorum) checks(method string) bool {
+	for _, p := range q.methods {
+		if p.match(method) {
+			return true
+		}
+	}
+	return false
+}
+
+// quorumMetrics counts the answers of every quorum provider in the process.
+var quorumMetrics = &quorumCounts{counts: make(map[[2]string]uint64)}
+
+type quorumCounts struct {
+	mu     sync.Mutex
+	counts map[[2]string]uint64 // by provider and result
+}
+
+func (c *quorumCounts) observe(provider, result string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[[2]string{provider, result}]++
+}
+
+// WriteQuorumMetrics writes the quorum metrics in the Prometheus text
+// exposition format: rpc_quorum_answers_total counts the answers to
+// cross-checked calls by provider and result, "agree", "diverged" or
+// "failed".
+func WriteQuorumMetrics(w io.Writer) error {
+	c := quorumMetrics
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([][2]string, 0, len(c.counts))
+	for k := range c.counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+
+	var b strings.Builder
+	b.WriteString("# HELP rpc_quorum_answers_total Answers of quorum providers to cross-checked calls by result.\n")
+	b.WriteString("# TYPE rpc_quorum_answers_total counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "rpc_quorum_answers_total{provider=%q,result=%q} %d\n", k[0], k[1], c.counts[k])
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,261 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// retryBackoff is how long a failed call waits before being retried on
+	// the same upstream, when there is no fallback to retry it on at once.
+	retryBackoff = 250 * time.Millisecond
+	// maxRetryBody is the largest request body kept for a retry; larger
+	// requests are forwarded once.
+	maxRetryBody = 1 << 20
+	// unhealthyFor is how long an upstream that failed a request is left out
+	// when spreading batches over the upstreams.
+	unhealthyFor = 30 * time.Second
+)
+
+// safeMethods are the JSON-RPC methods that only read chain state, so a call
+// that may already have reached the upstream can be sent again. Filter
+// methods are left out: filters live on one node.
+var safeMethods = map[string]bool{
+	"eth_blockNumber":                         true,
+	"eth_call":                                true,
+	"eth_chainId":                             true,
+	"eth_estimateGas":                         true,
+	"eth_feeHistory":                          true,
+	"eth_gasPrice":                            true,
+	"eth_getBalance":                          true,
+	"eth_getBlockByHash":                      true,
+	"eth_getBlockByNumber":                    true,
+	"eth_getBlockReceipts":                    true,
+	"eth_getBlockTransactionCountByHash":      true,
+	"eth_getBlockTransactionCountByNumber":    true,
+	"eth_getCode":                             true,
+	"eth_getLogs":                             true,
+	"eth_getProof":                            true,
+	"eth_getStorageAt":                        true,
+	"eth_getTransactionByBlockHashAndIndex":   true,
+	"eth_getTransactionByBlockNumberAndIndex": true,
+	"eth_getTransactionByHash":                true,
+	"eth_getTransactionCount":                 true,
+	"eth_getTransactionReceipt":               true,
+	"eth_getUncleCountByBlockHash":            true,
+	"eth_getUncleCountByBlockNumber":          true,
+	"eth_maxPriorityFeePerGas":                true,
+	"eth_syncing":                             true,
+	"net_version":                             true,
+	"web3_clientVersion":                      true,
+	"debug_traceBlockByHash":                  true,
+	"debug_traceBlockByNumber":                true,
+	"debug_traceCall":                         true,
+	"debug_traceTransaction":                  true,
+}
+
+// retryTransport sends a JSON-RPC request whose calls are all safe to repeat
+// a second time when the upstream cannot be reached or answers 429 or 5xx:
+// on the fallback upstream if there is one, else on the same upstream after
+// retryBackoff. Only if that fails too does the client see the error.
+//
+// A request goes to the primary upstream unless its context names the
+// fallback (see withUpstream), and is then retried on the primary. Upstreams
+// that failed a request recently are reported unhealthy.
+type retryTransport struct {
+	base     http.RoundTripper
+	primary  *url.URL
+	fallback *url.URL // nil without a fallback upstream
+
+	mu       sync.Mutex
+	failedAt [2]time.Time // of the primary and the fallback
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, retryable, err := bufferRetryable(req)
+	if err != nil {
+		return nil, err
+	}
+	orig, first, second := req.URL, 0, 0
+	if t.fallback != nil {
+		second = 1
+		if i, _ := req.Context().Value(upstreamKey{}).(int); i == 1 {
+			first, second = 1, 0
+			req = req.Clone(req.Context())
+			t.retarget(req, orig, first)
+		}
+	}
+	resp, err := t.roundTrip(req, first)
+	if !retryable || !failed(resp, err) || req.Context().Err() != nil {
+		return resp, err
+	}
+
+	var reason string
+	if resp != nil {
+		reason = resp.Status
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxRetryBody))
+		resp.Body.Close()
+	} else {
+		reason = err.Error()
+	}
+	retry := req.Clone(req.Context())
+	retry.Body = io.NopCloser(bytes.NewReader(body))
+	retry.ContentLength = int64(len(body))
+	if second != first {
+		t.retarget(retry, orig, second)
+		slog.Warn("upstream RPC call failed, retrying on the other upstream", "reason", reason)
+	} else {
+		slog.Warn("upstream RPC call failed, retrying", "reason", reason, "backoff", retryBackoff)
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(retryBackoff):
+		}
+	}
+	return t.roundTrip(retry, second)
+}
+
+// roundTrip sends req to upstream i, noting when the upstream fails it and,
+// for the access log, that the request went there.
+func (t *retryTransport) roundTrip(req *http.Request, i int) (*http.Response, error) {
+	traceUpstream(req.Context(), req.URL.Host)
+	resp, err := t.base.RoundTrip(req)
+	if failed(resp, err) && req.Context().Err() == nil {
+		t.mu.Lock()
+		t.failedAt[i] = time.Now()
+		t.mu.Unlock()
+	}
+	return resp, err
+}
+
+// retarget points req, a copy of a request for orig on the primary upstream,
+// at upstream i instead.
+func (t *retryTransport) retarget(req *http.Request, orig *url.URL, i int) {
+	target := t.primary
+	if i == 1 {
+		target = t.fallback
+	}
+	req.URL = rebase(orig, t.primary, target)
+	req.Host = target.Host
+}
+
+// healthy returns the indexes of the upstreams that have not failed a
+// request for unhealthyFor, or of all of them if every one has.
+func (t *retryTransport) healthy() []int {
+	n := 1
+	if t.fallback != nil {
+		n = 2
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var out []int
+	for i := 0; i < n; i++ {
+		if time.Since(t.failedAt[i]) >= unhealthyFor {
+			out = append(out, i)
+		}
+	}
+	if len(out) == 0 {
+		for i := 0; i < n; i++ {
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+// upstreamKey is the context key of the index of the upstream a request
+// should go to first: 0 for the primary, 1 for the fallback.
+type upstreamKey struct{}
+
+// withUpstream returns a copy of ctx sending requests to upstream i first.
+func withUpstream(ctx context.Context, i int) context.Context {
+	return context.WithValue(ctx, upstreamKey{}, i)
+}
+
+// failed reports whether an upstream answer calls for a retry: no answer, or
+// a rate limit or server error.
+func failed(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+}
+
+// bufferRetryable reads the request body, leaving req able to send it, and
+// reports whether it is a JSON-RPC request or batch of safe calls only.
+func bufferRetryable(req *http.Request) ([]byte, bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, false, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxRetryBody+1))
+	if err != nil {
+		req.Body.Close()
+		return nil, false, err
+	}
+	if len(body) > maxRetryBody {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return nil, false, nil
+	}
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, safeCalls(body), nil
+}
+
+// safeCalls reports whether body is a JSON-RPC request, or non-empty batch,
+// calling safeMethods only.
+func safeCalls(body []byte) bool {
+	type call struct {
+		Method string `json:"method"`
+	}
+	var calls []call
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		if err := json.Unmarshal(body, &calls); err != nil {
+			return false
+		}
+	} else {
+		var c call
+		if err := json.Unmarshal(body, &c); err != nil {
+			return false
+		}
+		calls = []call{c}
+	}
+	for _, c := range calls {
+		if !safeMethods[c.Method] {
+			return false
+		}
+	}
+	return len(calls) > 0
+}
+
+// rebase moves u, a URL on the primary upstream, to the same path on the
+// fallback upstream, joined as the reverse proxy joins it.
+func rebase(u, primary, fallback *url.URL) *url.URL {
+	out := *fallback
+	out.Path = joinPath(fallback.Path, strings.TrimPrefix(u.Path, primary.Path))
+	out.RawPath = ""
+	out.RawQuery = u.RawQuery
+	return &out
+}
+
+// joinPath joins two URL paths with exactly one slash between them.
+func joinPath(a, b string) string {
+	aslash, bslash := strings.HasSuffix(a, "/"), strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash && b != "":
+		return a + "/" + b
+	}
+	return a + b
+}
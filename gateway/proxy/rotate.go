@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRotationClients is how many clients' assignments are kept before the
+// stale ones are swept.
+const maxRotationClients = 10_000
+
+// methodClasses are the kinds of call that Rotator spreads over providers:
+// a provider sees only some kinds of a client's calls.
+var methodClasses = []string{"state", "blocks", "transactions", "logs", "other"}
+
+// methodClass returns the class of method, or "" for calls that depend on
+// state kept by the provider that answered an earlier one, filters, which
+// cannot move between providers.
+func methodClass(method string) string {
+	switch method {
+	case "eth_newFilter", "eth_newBlockFilter", "eth_newPendingTransactionFilter",
+		"eth_getFilterChanges", "eth_getFilterLogs", "eth_uninstallFilter":
+		return ""
+	case "eth_call", "eth_estimateGas", "eth_createAccessList", "eth_getBalance", "eth_getCode",
+		"eth_getStorageAt", "eth_getTransactionCount", "eth_getProof":
+		return "state"
+	case "eth_blockNumber", "eth_getBlockByNumber", "eth_getBlockByHash", "eth_getBlockReceipts",
+		"eth_feeHistory", "eth_gasPrice", "eth_maxPriorityFeePerGas", "eth_blobBaseFee":
+		return "blocks"
+	case "eth_getLogs":
+		return "logs"
+	}
+	if strings.HasPrefix(method, "eth_sendRaw") || strings.HasPrefix(method, "eth_getTransaction") {
+		return "transactions"
+	}
+	return "other"
+}
+
+// Rotator spreads each client's calls over several providers so that none
+// of them can piece together everything the client asks: every client gets
+// its own random assignment of method classes to providers, drawn anew every
+// shuffle interval, and when there are more providers than classes,
+// successive calls of a class take turns among the providers it has. A
+// batch goes where its first call does; filter calls always go to next.
+type Rotator struct {
+	next      http.Handler
+	providers []http.Handler // next first
+	shuffle   time.Duration
+
+	mu      sync.Mutex
+	clients map[string]*rotation
+}
+
+// rotation is one client's assignment of providers.
+type rotation struct {
+	providers map[string][]int // by class, indexes into Rotator.providers
+	turn      map[string]int   // by class, the next of its providers
+	expires   time.Time
+}
+
+// NewRotator returns a Rotator spreading calls over next, the proxy to the
+// upstream, and the providers at providerURLs, reassigning them every
+// shuffle.
+func NewRotator(next http.Handler, providerURLs []string, shuffle time.Duration) (*Rotator, error) {
+	r := &Rotator{next: next, providers: []http.Handler{next}, shuffle: shuffle, clients: make(map[string]*rotation)}
+	for _, raw := range providerURLs {
+		p, err := NewRPC(raw, "")
+		if err != nil {
+			return nil, err
+		}
+		r.providers = append(r.providers, p)
+	}
+	return r, nil
+}
+
+// ServeHTTP forwards the request to the provider the client's assignment
+// picks.
+func (r *Rotator) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		r.next.ServeHTTP(w, req)
+		return
+	}
+	elems, _, _ := splitMessage(body)
+	var call cacheCall
+	if len(elems) == 0 || json.Unmarshal(elems[0], &call) != nil {
+		r.next.ServeHTTP(w, req)
+		return
+	}
+	class := methodClass(call.Method)
+	if class == "" {
+		r.next.ServeHTTP(w, req)
+		return
+	}
+	r.providers[r.pick(rotationClient(req), class)].ServeHTTP(w, req)
+}
+
+// pick returns the provider client's next call of class goes to.
+func (r *Rotator) pick(client, class string) int {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rot, ok := r.clients[client]
+	if !ok || now.After(rot.expires) {
+		if len(r.clients) >= maxRotationClients {
+			for k, c := range r.clients {
+				if now.After(c.expires) {
+					delete(r.clients, k)
+				}
+			}
+		}
+		rot = r.assign(now)
+		r.clients[client] = rot
+	}
+	providers := rot.providers[class]
+	i := rot.turn[class]
+	rot.turn[class] = (i + 1) % len(providers)
+	return providers[i]
+}
+
+// assign draws a new assignment: the classes and the providers, each in a
+// random order, are paired off round-robin until every class has a provider
+// and every provider a class.
+func (r *Rotator) assign(now time.Time) *rotation {
+	rot := &rotation{
+		providers: make(map[string][]int, len(methodClasses)),
+		turn:      make(map[string]int, len(methodClasses)),
+		expires:   now.Add(r.shuffle),
+	}
+	classes := rand.Perm(len(methodClasses))
+	providers := rand.Perm(len(r.providers))
+	for i := range max(len(classes), len(providers)) {
+		class := methodClasses[classes[i%len(classes)]]
+		rot.providers[class] = append(rot.providers[class], providers[i%len(providers)])
+	}
+	return rot
+}
+
+// rotationClient identifies the client behind req: by its credentials if it
+// has any, else by its address.
+func rotationClient(req *http.Request) string {
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		return auth
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
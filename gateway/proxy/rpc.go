@@ -1,26 +1,42 @@
 package proxy
 
 import (
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strings"
 )
 
 // RPC is a reverse proxy that forwards JSON-RPC requests to an upstream node.
-// It strips client-identifying headers before forwarding.
+// It strips client-identifying headers before forwarding and
+// provider-identifying ones from the response. It serves plain HTTP APIs
+// just as well: only JSON-RPC calls that read chain state are ever retried.
 type RPC struct {
-	proxy *httputil.ReverseProxy
+	proxy     *httputil.ReverseProxy
+	transport *retryTransport
 }
 
-// NewRPC creates a new RPC reverse proxy targeting upstreamURL.
-func NewRPC(upstreamURL string) (*RPC, error) {
+// NewRPC creates a new RPC reverse proxy targeting upstreamURL. Calls that
+// only read chain state are retried once when the upstream fails them: on
+// fallbackURL if it is set, else on upstreamURL after a short backoff.
+func NewRPC(upstreamURL, fallbackURL string) (*RPC, error) {
 	target, err := url.Parse(upstreamURL)
 	if err != nil {
 		return nil, err
 	}
+	transport := &retryTransport{base: upstreamTransport, primary: target}
+	if fallbackURL != "" {
+		if transport.fallback, err = url.Parse(fallbackURL); err != nil {
+			return nil, err
+		}
+	}
 
 	rp := httputil.NewSingleHostReverseProxy(target)
+	rp.Transport = transport
+	rp.FlushInterval = flushInterval
 
 	// Wrap the default director to strip identifying headers.
 	base := rp.Director
@@ -42,15 +58,97 @@ func NewRPC(upstreamURL string) (*RPC, error) {
 		req.Host = target.Host
 	}
 
+	// The gateway answers CORS itself; upstream CORS headers would be added
+	// to its own and duplicates make browsers reject the response. Only the
+	// gateway's cache may report a cache hit, which is charged less, and only
+	// its verifier a verified answer, which is charged more.
+	rp.ModifyResponse = func(resp *http.Response) error {
+		for name := range resp.Header {
+			if strings.HasPrefix(name, "Access-Control-") {
+				resp.Header.Del(name)
+			}
+		}
+		scrubResponseHeaders(resp.Header)
+		resp.Header.Del(CacheHeader)
+		resp.Header.Del(VerifiedHeader)
+		if maxResponse > 0 {
+			if resp.ContentLength > maxResponse {
+				return fmt.Errorf("%w: %d bytes", errResponseTooLarge, resp.ContentLength)
+			}
+			resp.Body = &limitedBody{ReadCloser: resp.Body, limit: maxResponse}
+		}
+		return nil
+	}
+
 	// Propagate upstream errors to the client as 502.
 	// Log the full error server-side but return a generic message to the client
 	// to avoid leaking the upstream RPC URL or internal connection details.
 	rp.ErrorHandler = func(w http.ResponseWriter, _ *http.Request, err error) {
+		if errors.Is(err, errResponseTooLarge) {
+			slog.Warn("upstream response refused", "err", err)
+			http.Error(w, "upstream response too large", http.StatusBadGateway)
+			return
+		}
 		slog.Error("upstream RPC error", "err", err)
 		http.Error(w, "upstream unavailable", http.StatusBadGateway)
 	}
 
-	return &RPC{proxy: rp}, nil
+	return &RPC{proxy: rp, transport: transport}, nil
+}
+
+// providerHeaders are response headers naming or fingerprinting the
+// upstream provider, its CDN or its load balancers, or handing out its
+// cookies, none of which the client is meant to learn.
+var providerHeaders = []string{
+	"Alt-Svc",
+	"Expect-Ct",
+	"Nel",
+	"Report-To",
+	"Server",
+	"Set-Cookie",
+	"Strict-Transport-Security",
+	"Via",
+	"X-Cache",
+	"X-Cache-Hits",
+	"X-Powered-By",
+	"X-Request-Id",
+	"X-Served-By",
+	"X-Timer",
+}
+
+// providerHeaderPrefixes are the canonical prefixes of further such headers:
+// those of CDNs and clouds, and providers' rate-limit counters, which would
+// tell clients which plan the gateway is on.
+var providerHeaderPrefixes = []string{
+	"Cf-",
+	"Fly-",
+	"Ratelimit",
+	"X-Amz-",
+	"X-Amzn-",
+	"X-Azure-",
+	"X-Envoy-",
+	"X-Goog-",
+	"X-Kong-",
+	"X-Rate-Limit-",
+	"X-Ratelimit-",
+	"X-Vercel-",
+}
+
+// scrubResponseHeaders strips the provider-identifying headers from an
+// upstream response, as the director strips client-identifying ones from
+// the request: neither end learns who is on the other side.
+func scrubResponseHeaders(h http.Header) {
+	for _, name := range providerHeaders {
+		h.Del(name)
+	}
+	for name := range h {
+		for _, prefix := range providerHeaderPrefixes {
+			if strings.HasPrefix(name, prefix) {
+				h.Del(name)
+				break
+			}
+		}
+	}
 }
 
 // ServeHTTP forwards the request to the upstream RPC node.
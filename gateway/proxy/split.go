@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+// Splitter cuts JSON-RPC batches of more than size calls into batches of
+// size, sends them in parallel, and joins their responses in the order of
+// the calls. Batches of safeMethods only are spread over the upstreams of an
+// RPC proxy that have not failed recently; others all go to the primary,
+// which may hold their filters. Other requests go to next as they come.
+type Splitter struct {
+	next http.Handler
+	rpc  *RPC
+	size int
+}
+
+// NewSplitter returns a Splitter in front of next, which ends in rpc.
+func NewSplitter(next http.Handler, rpc *RPC, size int) *Splitter {
+	return &Splitter{next: next, rpc: rpc, size: size}
+}
+
+// ServeHTTP splits the request if it is a large batch, and forwards it.
+func (s *Splitter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		s.next.ServeHTTP(w, r)
+		return
+	}
+	elems, batch, ok := splitMessage(body)
+	if !ok || !batch || len(elems) <= s.size {
+		s.next.ServeHTTP(w, r)
+		return
+	}
+
+	upstreams := []int{0}
+	if safeCalls(body) {
+		upstreams = s.rpc.transport.healthy()
+	}
+	results := make([]*sharedResponse, (len(elems)+s.size-1)/s.size)
+	errs := make([]error, len(results))
+	var wg sync.WaitGroup
+	for i := range results {
+		chunk := joinMessage(elems[i*s.size:min((i+1)*s.size, len(elems))], true)
+		req := r.Clone(withUpstream(r.Context(), upstreams[i%len(upstreams)]))
+		req.Body = io.NopCloser(bytes.NewReader(chunk))
+		req.ContentLength = int64(len(chunk))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = serveBuffered(s.next, req)
+		}()
+	}
+	wg.Wait()
+
+	resps := make([]json.RawMessage, 0, len(elems))
+	for i, res := range results {
+		if errs[i] != nil {
+			slog.Error("upstream RPC error", "err", errs[i])
+			http.Error(w, "upstream unavailable", http.StatusBadGateway)
+			return
+		}
+		// A batch of notifications only is answered with nothing.
+		if res.status == http.StatusOK && len(bytes.TrimSpace(res.body)) == 0 {
+			continue
+		}
+		var part []json.RawMessage
+		if res.status != http.StatusOK || json.Unmarshal(res.body, &part) != nil {
+			// A part the upstreams failed fails the whole batch, which is
+			// then not charged for.
+			res.writeTo(w, res.body)
+			return
+		}
+		resps = append(resps, part...)
+	}
+	out, _ := json.Marshal(resps)
+	results[0].header.Set("Content-Type", "application/json")
+	results[0].writeTo(w, out)
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// errResponseTooLarge fails an upstream response past the size limit.
+var errResponseTooLarge = errors.New("upstream response too large")
+
+var (
+	// flushInterval is how often a response being streamed to the client is
+	// flushed, as httputil.ReverseProxy.FlushInterval.
+	flushInterval time.Duration
+	// maxResponse, when positive, is the largest upstream response relayed.
+	maxResponse int64
+)
+
+// streamedMethods can answer with hundreds of megabytes: their responses
+// are passed on as the upstream sends them, never held whole in memory to be
+// shared between clients.
+var streamedMethods = map[string]bool{
+	"debug_traceBlockByHash":        true,
+	"debug_traceBlockByNumber":      true,
+	"debug_traceCall":               true,
+	"debug_traceTransaction":        true,
+	"eth_getLogs":                   true,
+	"trace_block":                   true,
+	"trace_filter":                  true,
+	"trace_replayBlockTransactions": true,
+	"trace_transaction":             true,
+}
+
+// SetStreaming sets how upstream responses are streamed to clients: flushed
+// every interval (negative flushes after every write, zero only when the
+// write buffer fills) and cut off past limit bytes, when positive. A
+// response known to be too large is answered with 502; one found out to be
+// while streaming is aborted, as the client already has part of it. It must
+// be called before any proxy is created.
+func SetStreaming(interval time.Duration, limit int64) {
+	flushInterval, maxResponse = interval, limit
+}
+
+// limitedBody is an upstream response body failing with errResponseTooLarge
+// once more than its limit was read.
+type limitedBody struct {
+	io.ReadCloser
+	limit int64
+	read  int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if b.read > b.limit {
+		slog.Warn("aborting upstream response past the size limit", "limit", b.limit)
+		return 0, fmt.Errorf("%w: over %d bytes", errResponseTooLarge, b.limit)
+	}
+	return n, err
+}
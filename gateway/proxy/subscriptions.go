@@ -0,0 +1,281 @@
+package proxy
+
+// Subscription tracking: the relay remembers every eth_subscribe a client
+// made over it, and the ID it got back, so that when the upstream connection
+// is lost the subscriptions can be made again on the next one. The new
+// upstream hands out new IDs; the relay keeps the client on the ones it
+// knows, rewriting notifications and eth_unsubscribe calls between the two.
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// rpcInternalError is the JSON-RPC error code answering calls lost with the
+// upstream connection.
+const rpcInternalError = -32603
+
+// pendingCall is a client call awaiting the upstream's response.
+type pendingCall struct {
+	id     json.RawMessage
+	method string
+	params json.RawMessage
+}
+
+// subscription is a live subscription of the client.
+type subscription struct {
+	params     json.RawMessage // of the eth_subscribe that made it
+	upstreamID string          // "" while it is being made again
+}
+
+// rpcMessage is a JSON-RPC request, response or notification.
+type rpcMessage struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  json.RawMessage `json:"error,omitempty"`
+}
+
+// trackRequest records the calls of a client message before it is sent
+// upstream, rewriting the subscription IDs of eth_unsubscribe calls to the
+// upstream's. It returns the message to send, or instead a reply for the
+// client when the relay answers the message itself.
+func (rl *wsRelay) trackRequest(msg []byte) (out, reply []byte) {
+	elems, batch, ok := splitMessage(msg)
+	if !ok {
+		return msg, nil
+	}
+	changed := false
+	for i, e := range elems {
+		var m rpcMessage
+		if json.Unmarshal(e, &m) != nil || m.Method == "" {
+			continue
+		}
+		id := idKey(m.ID)
+		if id != "" {
+			rl.pending[id] = pendingCall{id: m.ID, method: m.Method, params: m.Params}
+		}
+		if m.Method != "eth_unsubscribe" {
+			continue
+		}
+		sub, cid := rl.subscriptionIn(m.Params)
+		if sub == nil {
+			continue
+		}
+		delete(rl.subs, cid)
+		delete(rl.byUpstream, sub.upstreamID)
+		switch {
+		case sub.upstreamID == "" && !batch:
+			// Still being made again, and dropped once it is: the upstream
+			// does not know the ID yet.
+			delete(rl.pending, id)
+			reply, _ := json.Marshal(map[string]any{"jsonrpc": "2.0", "id": m.ID, "result": true})
+			return nil, reply
+		case sub.upstreamID != "" && sub.upstreamID != cid:
+			elems[i] = withField(e, "params", []string{sub.upstreamID})
+			changed = true
+		}
+	}
+	if !changed {
+		return msg, nil
+	}
+	return joinMessage(elems, batch), nil
+}
+
+// trackResponse follows an upstream message: it records the subscriptions
+// the client's eth_subscribe calls made and rewrites notifications to the
+// client's subscription IDs. It returns the message to relay, and false for
+// responses to the relay's own requests, which the client never sees.
+func (rl *wsRelay) trackResponse(msg []byte) (out []byte, forward bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	elems, batch, ok := splitMessage(msg)
+	if !ok {
+		return msg, true
+	}
+	changed := false
+	for i, e := range elems {
+		var m rpcMessage
+		if json.Unmarshal(e, &m) != nil {
+			continue
+		}
+		if m.Method == "eth_subscription" {
+			var params map[string]json.RawMessage
+			var uid string
+			if json.Unmarshal(m.Params, &params) != nil || json.Unmarshal(params["subscription"], &uid) != nil {
+				continue
+			}
+			if cid, ok := rl.byUpstream[uid]; ok && cid != uid {
+				params["subscription"], _ = json.Marshal(cid)
+				elems[i] = withField(e, "params", params)
+				changed = true
+			}
+			continue
+		}
+
+		id := idKey(m.ID)
+		if cid, ok := rl.internal[id]; ok && !batch {
+			delete(rl.internal, id)
+			rl.resubscribed(cid, m)
+			return nil, false
+		}
+		call, ok := rl.pending[id]
+		if !ok {
+			continue
+		}
+		delete(rl.pending, id)
+		var uid string
+		if call.method != "eth_subscribe" || json.Unmarshal(m.Result, &uid) != nil {
+			continue
+		}
+		// The client keeps the first upstream's IDs, which another
+		// upstream may hand out again for a new subscription.
+		cid := uid
+		if _, taken := rl.subs[cid]; taken {
+			cid = newSubscriptionID()
+			elems[i] = withField(e, "result", cid)
+			changed = true
+		}
+		rl.subs[cid] = &subscription{params: call.params, upstreamID: uid}
+		rl.byUpstream[uid] = cid
+	}
+	if !changed {
+		return msg, true
+	}
+	return joinMessage(elems, batch), true
+}
+
+// resubscribe makes the client's subscriptions again on a new upstream
+// connection, sends it the eth_subscribe calls still in flight and answers
+// the other calls in flight with an error.
+func (rl *wsRelay) resubscribe() {
+	for id, call := range rl.pending {
+		if call.method == "eth_subscribe" {
+			rl.write(map[string]any{"jsonrpc": "2.0", "id": call.id, "method": call.method, "params": call.params})
+			continue
+		}
+		delete(rl.pending, id)
+		reply, _ := json.Marshal(map[string]any{
+			"jsonrpc": "2.0",
+			"id":      call.id,
+			"error":   map[string]any{"code": rpcInternalError, "message": "upstream connection lost"},
+		})
+		_ = rl.client.write(websocket.TextMessage, reply)
+	}
+	for cid, sub := range rl.subs {
+		delete(rl.byUpstream, sub.upstreamID)
+		sub.upstreamID = ""
+		rl.request(cid, "eth_subscribe", sub.params)
+	}
+}
+
+// resubscribed records the response to the eth_subscribe making the client's
+// subscription cid again, or to an eth_unsubscribe of the relay's own if cid
+// is empty. A subscription that cannot be made again closes the connection,
+// so the client knows its stream is gone.
+func (rl *wsRelay) resubscribed(cid string, m rpcMessage) {
+	if cid == "" {
+		return
+	}
+	sub := rl.subs[cid]
+	var uid string
+	switch {
+	case json.Unmarshal(m.Result, &uid) != nil:
+		slog.Warn("re-establishing subscription failed", "error", string(m.Error))
+		rl.client.close(websocket.CloseTryAgainLater, "subscription lost")
+	case sub == nil:
+		// Unsubscribed by the client meanwhile.
+		params, _ := json.Marshal([]string{uid})
+		rl.request("", "eth_unsubscribe", params)
+	default:
+		sub.upstreamID = uid
+		rl.byUpstream[uid] = cid
+	}
+}
+
+// request sends the upstream a call of the relay's own, made for the client
+// subscription cid, whose response trackResponse passes to resubscribed.
+func (rl *wsRelay) request(cid, method string, params json.RawMessage) {
+	rl.nextID++
+	id := fmt.Sprintf("%q", fmt.Sprintf("gateway-%d", rl.nextID))
+	rl.internal[id] = cid
+	rl.write(map[string]any{"jsonrpc": "2.0", "id": json.RawMessage(id), "method": method, "params": params})
+}
+
+// write sends the upstream a message of the relay's own. A failed write is
+// noticed by the upstream reader.
+func (rl *wsRelay) write(v any) {
+	msg, _ := json.Marshal(v)
+	_ = rl.upstream.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	_ = rl.upstream.WriteMessage(websocket.TextMessage, msg)
+}
+
+// subscriptionIn returns the live subscription, and its client-side ID,
+// named by the params of an eth_unsubscribe call.
+func (rl *wsRelay) subscriptionIn(params json.RawMessage) (*subscription, string) {
+	var ids []string
+	if json.Unmarshal(params, &ids) != nil || len(ids) == 0 {
+		return nil, ""
+	}
+	return rl.subs[ids[0]], ids[0]
+}
+
+// splitMessage parses a JSON-RPC message or batch into its elements.
+func splitMessage(msg []byte) (elems []json.RawMessage, batch, ok bool) {
+	msg = bytes.TrimSpace(msg)
+	if len(msg) > 0 && msg[0] == '[' {
+		if json.Unmarshal(msg, &elems) != nil {
+			return nil, true, false
+		}
+		return elems, true, true
+	}
+	return []json.RawMessage{msg}, false, json.Valid(msg)
+}
+
+// joinMessage is the inverse of splitMessage.
+func joinMessage(elems []json.RawMessage, batch bool) []byte {
+	if !batch {
+		return elems[0]
+	}
+	msg, _ := json.Marshal(elems)
+	return msg
+}
+
+// withField returns the JSON object obj with its field key set to value.
+func withField(obj json.RawMessage, key string, value any) json.RawMessage {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(obj, &fields) != nil {
+		return obj
+	}
+	v, err := json.Marshal(value)
+	if err != nil {
+		return obj
+	}
+	fields[key] = v
+	out, _ := json.Marshal(fields)
+	return out
+}
+
+// idKey is the map key of a JSON-RPC request ID, "" for none.
+func idKey(id json.RawMessage) string {
+	id = bytes.TrimSpace(id)
+	if len(id) == 0 || string(id) == "null" {
+		return ""
+	}
+	return string(id)
+}
+
+// newSubscriptionID returns a random subscription ID in the form nodes use.
+func newSubscriptionID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return "0x" + hex.EncodeToString(b)
+}
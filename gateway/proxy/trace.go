@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// traceKey is the context key of a request's upstream trace.
+type traceKey struct{}
+
+// upstreamTrace is the upstream hosts a request's calls were sent to.
+type upstreamTrace struct {
+	mu    sync.Mutex
+	hosts []string
+}
+
+// TraceUpstreams returns a copy of ctx under which the hosts of the
+// upstreams HTTP requests are sent to, retries and fallbacks included, are
+// recorded, and a function returning them in the order first used. A request
+// answered from the cache has none.
+func TraceUpstreams(ctx context.Context) (context.Context, func() []string) {
+	t := &upstreamTrace{}
+	return context.WithValue(ctx, traceKey{}, t), func() []string {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		return slices.Clone(t.hosts)
+	}
+}
+
+// traceUpstream records that a request under ctx went to host.
+func traceUpstream(ctx context.Context, host string) {
+	t, _ := ctx.Value(traceKey{}).(*upstreamTrace)
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !slices.Contains(t.hosts, host) {
+		t.hosts = append(t.hosts, host)
+	}
+}
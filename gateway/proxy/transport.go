@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// upstreamTransport carries the package's HTTP requests to upstreams.
+var upstreamTransport http.RoundTripper = http.DefaultTransport
+
+// transportConfig is what the package's transports are built from.
+var transportConfig TransportConfig
+
+// TransportConfig tunes the connections to upstreams. A zero field keeps
+// http.DefaultTransport's setting.
+type TransportConfig struct {
+	// DialTimeout bounds establishing a TCP connection.
+	DialTimeout time.Duration
+	// TLSHandshakeTimeout bounds the TLS handshake of a new connection.
+	TLSHandshakeTimeout time.Duration
+	// ResponseHeaderTimeout bounds the wait for an upstream's response
+	// headers once the request is written.
+	ResponseHeaderTimeout time.Duration
+	// MaxIdleConns caps the idle connections kept across all upstreams.
+	MaxIdleConns int
+	// MaxIdleConnsPerHost caps the idle connections kept to each upstream.
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost caps the connections to each upstream, idle or not;
+	// requests past it wait for one to free up.
+	MaxConnsPerHost int
+}
+
+// SetTransport tunes the package's connections to upstreams, HTTP and
+// WebSocket alike. It must be called before SetEgressProxy and before any
+// proxy is created.
+func SetTransport(c TransportConfig) {
+	transportConfig = c
+	upstreamTransport = newTransport()
+	if c.DialTimeout > 0 {
+		wsDialer.NetDialContext = (&net.Dialer{Timeout: c.DialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	}
+}
+
+// newTransport returns an HTTP transport set up as transportConfig says.
+func newTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	c := transportConfig
+	if c.DialTimeout > 0 {
+		t.DialContext = (&net.Dialer{Timeout: c.DialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	}
+	if c.TLSHandshakeTimeout > 0 {
+		t.TLSHandshakeTimeout = c.TLSHandshakeTimeout
+	}
+	if c.ResponseHeaderTimeout > 0 {
+		t.ResponseHeaderTimeout = c.ResponseHeaderTimeout
+	}
+	if c.MaxIdleConns > 0 {
+		t.MaxIdleConns = c.MaxIdleConns
+	}
+	if c.MaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	}
+	if c.MaxConnsPerHost > 0 {
+		t.MaxConnsPerHost = c.MaxConnsPerHost
+	}
+	return t
+}
@@ -0,0 +1,502 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/big"
+	"net/http"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/consensus/misc/eip4844"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/ethereum/go-ethereum/triedb"
+)
+
+const (
+	// VerifyHeader, set to "true" on a request, asks for its answer to be
+	// verified.
+	VerifyHeader = "X-Rpc-Verify"
+	// VerifiedHeader is set to "true" on responses the Verifier verified.
+	VerifiedHeader = "X-Rpc-Verified"
+)
+
+// callGasCap is the gas an eth_call is verified with at most, and by
+// default: that of geth's eth_call.
+const callGasCap = 50_000_000
+
+// verifiedMethods are the methods whose results the Verifier can check
+// against a verified block's state root.
+var verifiedMethods = map[string]bool{
+	"eth_call":                true,
+	"eth_getBalance":          true,
+	"eth_getCode":             true,
+	"eth_getProof":            true,
+	"eth_getStorageAt":        true,
+	"eth_getTransactionCount": true,
+}
+
+// callFields are the eth_call transaction fields the Verifier executes
+// calls with; calls with others are not verified.
+var callFields = map[string]bool{
+	"from": true, "to": true, "gas": true, "gasPrice": true, "maxFeePerGas": true,
+	"maxPriorityFeePerGas": true, "value": true, "data": true, "input": true,
+	"accessList": true, "nonce": true, "chainId": true, "type": true,
+}
+
+// Verifier checks the upstream's answers to state reads against the chain as
+// a beacon light client sees it, without trusting the upstream: the block is
+// one whose header the sync committee signed, account and storage values are
+// proven against its state root, and eth_call is executed locally on proven
+// state. Only single calls with X-Rpc-Verify: true are verified; it pins the
+// call to the verified block and marks the response X-Rpc-Verified: true. A
+// response proven wrong fails with 502. One that cannot be checked, say for
+// a block the light client has not seen, is passed on unmarked, as is every
+// other request.
+type Verifier struct {
+	next   http.Handler
+	client *rpc.Client // of the upstream, asked for proofs
+	chain  *verifiedChain
+	config *params.ChainConfig
+}
+
+// NewVerifier returns a Verifier in front of next, the proxy to upstreamURL,
+// following network ("mainnet", "sepolia", "holesky" or "hoodi") through the
+// beacon APIs at beaconURLs.
+func NewVerifier(next http.Handler, upstreamURL, network string, beaconURLs []string) (*Verifier, error) {
+	client, err := dialUpstream(upstreamURL)
+	if err != nil {
+		return nil, err
+	}
+	chain, config, err := startLightClient(network, beaconURLs)
+	if err != nil {
+		return nil, err
+	}
+	return &Verifier{next: next, client: client, chain: chain, config: config}, nil
+}
+
+// ServeHTTP forwards the request and verifies the answer if it was asked to.
+func (v *Verifier) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get(VerifyHeader) != "true" {
+		v.next.ServeHTTP(w, r)
+		return
+	}
+	r.Header.Del(VerifyHeader)
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	var call cacheCall
+	var params []json.RawMessage
+	if err != nil || json.Unmarshal(body, &call) != nil || !verifiedMethods[call.Method] ||
+		json.Unmarshal(call.Params, &params) != nil || len(params) < blockParam[call.Method] {
+		v.next.ServeHTTP(w, r)
+		return
+	}
+	// Past the block come state and block overrides, which are not verified.
+	i := blockParam[call.Method]
+	var ref json.RawMessage
+	if len(params) > i {
+		ref = params[i]
+	}
+	block, ok := v.chain.block(ref)
+	if !ok || len(params) > i+1 {
+		v.next.ServeHTTP(w, r)
+		return
+	}
+
+	params = append(params[:i], blockRef(block))
+	call.Params, _ = json.Marshal(params)
+	pinned, _ := json.Marshal(map[string]any{"jsonrpc": "2.0", "id": call.ID, "method": call.Method, "params": call.Params})
+	req := r.Clone(r.Context())
+	req.Body = io.NopCloser(bytes.NewReader(pinned))
+	req.ContentLength = int64(len(pinned))
+	resp, err := serveBuffered(v.next, req)
+	if err != nil {
+		slog.Error("upstream RPC error", "err", err)
+		http.Error(w, "upstream unavailable", http.StatusBadGateway)
+		return
+	}
+	var out struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if resp.status != http.StatusOK || json.Unmarshal(resp.body, &out) != nil || len(out.Result) == 0 {
+		resp.writeTo(w, resp.body)
+		return
+	}
+
+	valid, err := v.check(r.Context(), call.Method, params, block, out.Result)
+	switch {
+	case err != nil:
+		slog.Warn("response not verified", "method", call.Method, "block", block.header.Number, "err", err)
+		resp.writeTo(w, resp.body)
+	case !valid:
+		slog.Warn("upstream response failed verification", "method", call.Method, "block", block.header.Number)
+		reply, _ := json.Marshal(map[string]any{
+			"jsonrpc": "2.0",
+			"id":      call.ID,
+			"error":   map[string]any{"code": rpcInternalError, "message": "response failed verification"},
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write(reply)
+	default:
+		resp.header.Set(VerifiedHeader, "true")
+		resp.writeTo(w, resp.body)
+	}
+}
+
+// blockRef names b by hash, as a param: calls pinned to it cannot be
+// answered from another block of the same number.
+func blockRef(b *verifiedBlock) json.RawMessage {
+	ref, _ := json.Marshal(map[string]common.Hash{"blockHash": b.hash})
+	return ref
+}
+
+// check reports whether result is the right answer to the call of method
+// with params at block b. It returns an error if that cannot be told.
+func (v *Verifier) check(ctx context.Context, method string, params []json.RawMessage, b *verifiedBlock, result json.RawMessage) (bool, error) {
+	if method == "eth_call" {
+		return v.checkCall(ctx, params[0], b, result)
+	}
+	var addr common.Address
+	if err := json.Unmarshal(params[0], &addr); err != nil {
+		return false, err
+	}
+	if method == "eth_getProof" {
+		var keys []string
+		var proof accountProof
+		if err := json.Unmarshal(params[1], &keys); err != nil {
+			return false, err
+		}
+		if json.Unmarshal(result, &proof) != nil || proof.Address != addr || len(proof.StorageProof) != len(keys) {
+			return false, nil
+		}
+		for i, key := range keys {
+			if common.HexToHash(proof.StorageProof[i].Key) != common.HexToHash(key) {
+				return false, nil
+			}
+		}
+		_, err := proof.verify(b.header.Root)
+		return err == nil, nil
+	}
+
+	keys := []string{}
+	if method == "eth_getStorageAt" {
+		var key string
+		if err := json.Unmarshal(params[1], &key); err != nil {
+			return false, err
+		}
+		keys = []string{key}
+	}
+	var proof accountProof
+	if err := v.client.CallContext(ctx, &proof, "eth_getProof", addr, keys, blockRef(b)); err != nil {
+		return false, fmt.Errorf("reading proof: %w", err)
+	}
+	if proof.Address != addr || len(proof.StorageProof) != len(keys) {
+		return false, errors.New("proof of another account")
+	}
+	for i, key := range keys {
+		if common.HexToHash(proof.StorageProof[i].Key) != common.HexToHash(key) {
+			return false, nil
+		}
+	}
+	// The upstream proving its own answer wrong is as good as lying.
+	acc, err := proof.verify(b.header.Root)
+	if err != nil {
+		return false, nil
+	}
+	switch method {
+	case "eth_getBalance":
+		var balance hexutil.Big
+		return json.Unmarshal(result, &balance) == nil && balance.ToInt().Cmp(acc.Balance.ToBig()) == 0, nil
+	case "eth_getTransactionCount":
+		var nonce hexutil.Uint64
+		return json.Unmarshal(result, &nonce) == nil && uint64(nonce) == acc.Nonce, nil
+	case "eth_getCode":
+		var code hexutil.Bytes
+		return json.Unmarshal(result, &code) == nil && crypto.Keccak256Hash(code) == common.BytesToHash(acc.CodeHash), nil
+	default: // eth_getStorageAt
+		var value common.Hash
+		return json.Unmarshal(result, &value) == nil && value.Big().Cmp(proof.StorageProof[0].Value.ToInt()) == 0, nil
+	}
+}
+
+// checkCall reports whether result is what the call with args returns at
+// block b: it executes the call on the state it touches, proven by the
+// upstream against the block's state root.
+func (v *Verifier) checkCall(ctx context.Context, rawArgs json.RawMessage, b *verifiedBlock, result json.RawMessage) (bool, error) {
+	var want hexutil.Bytes
+	if json.Unmarshal(result, &want) != nil {
+		return false, nil
+	}
+	var fields map[string]json.RawMessage
+	var args callArgs
+	if err := json.Unmarshal(rawArgs, &fields); err != nil {
+		return false, err
+	}
+	for name := range fields {
+		if !callFields[name] {
+			return false, fmt.Errorf("call field %q not supported", name)
+		}
+	}
+	if err := json.Unmarshal(rawArgs, &args); err != nil {
+		return false, err
+	}
+
+	// The accounts the call touches: those in its access list, its sender,
+	// recipient and the fee recipient, and the precompiles, which also live
+	// in the state.
+	var list struct {
+		AccessList types.AccessList `json:"accessList"`
+		Error      string           `json:"error"`
+	}
+	if err := v.client.CallContext(ctx, &list, "eth_createAccessList", rawArgs, blockRef(b)); err != nil {
+		return false, fmt.Errorf("reading access list: %w", err)
+	}
+	if list.Error != "" {
+		return false, fmt.Errorf("reading access list: %s", list.Error)
+	}
+	slots := make(map[common.Address][]common.Hash)
+	touch := func(addr common.Address, keys ...common.Hash) {
+		slots[addr] = append(slots[addr], keys...)
+	}
+	touch(b.header.Coinbase)
+	if args.From != nil {
+		touch(*args.From)
+	} else {
+		touch(common.Address{})
+	}
+	if args.To != nil {
+		touch(*args.To)
+	}
+	rules := v.config.Rules(b.header.Number, true, b.header.Time)
+	for _, addr := range vm.ActivePrecompiles(rules) {
+		touch(addr)
+	}
+	for _, t := range append(list.AccessList, args.AccessList...) {
+		touch(t.Address, t.StorageKeys...)
+	}
+
+	// All proofs and code in one round trip.
+	batch := make([]rpc.BatchElem, 0, 2*len(slots))
+	proofs := make([]accountProof, len(slots))
+	codes := make([]hexutil.Bytes, len(slots))
+	for addr, keys := range slots {
+		if keys == nil {
+			keys = []common.Hash{}
+		}
+		i := len(batch) / 2
+		batch = append(batch,
+			rpc.BatchElem{Method: "eth_getProof", Args: []any{addr, keys, blockRef(b)}, Result: &proofs[i]},
+			rpc.BatchElem{Method: "eth_getCode", Args: []any{addr, blockRef(b)}, Result: &codes[i]},
+		)
+	}
+	if err := v.client.BatchCallContext(ctx, batch); err != nil {
+		return false, fmt.Errorf("reading proofs: %w", err)
+	}
+	for _, elem := range batch {
+		if elem.Error != nil {
+			return false, fmt.Errorf("reading proofs: %w", elem.Error)
+		}
+	}
+
+	// The state is the proof nodes, found by their hashes from the state
+	// root down: a node the upstream left out or made up is missing.
+	db := rawdb.NewMemoryDatabase()
+	for i, p := range proofs {
+		for _, node := range p.nodes() {
+			rawdb.WriteLegacyTrieNode(db, crypto.Keccak256Hash(node), node)
+		}
+		if len(codes[i]) > 0 {
+			rawdb.WriteCode(db, crypto.Keccak256Hash(codes[i]), codes[i])
+		}
+	}
+	statedb, err := state.New(b.header.Root, state.NewDatabase(triedb.NewDatabase(db, triedb.HashDefaults), nil))
+	if err != nil {
+		return false, err
+	}
+	evm := vm.NewEVM(v.blockContext(b), statedb, v.config, vm.Config{NoBaseFee: true})
+	res, err := core.ApplyMessage(evm, args.message(b.header.BaseFee), new(core.GasPool).AddGas(math.MaxUint64))
+	if err := statedb.Error(); err != nil {
+		return false, fmt.Errorf("proven state incomplete: %w", err)
+	}
+	if err != nil {
+		return false, err
+	}
+	return !res.Failed() && bytes.Equal(res.ReturnData, want), nil
+}
+
+// blockContext returns the context calls at block b execute in.
+func (v *Verifier) blockContext(b *verifiedBlock) vm.BlockContext {
+	h := b.header
+	ctx := vm.BlockContext{
+		CanTransfer: core.CanTransfer,
+		Transfer:    core.Transfer,
+		GetHash:     v.chain.hashOf,
+		Coinbase:    h.Coinbase,
+		GasLimit:    h.GasLimit,
+		BlockNumber: new(big.Int).Set(h.Number),
+		Time:        h.Time,
+		Difficulty:  new(big.Int),
+		BaseFee:     h.BaseFee,
+		Random:      &h.MixDigest,
+	}
+	if h.ExcessBlobGas != nil {
+		ctx.BlobBaseFee = eip4844.CalcBlobFee(v.config, h)
+	}
+	return ctx
+}
+
+// callArgs are the fields of an eth_call transaction that affect its result.
+type callArgs struct {
+	From                 *common.Address  `json:"from"`
+	To                   *common.Address  `json:"to"`
+	Gas                  *hexutil.Uint64  `json:"gas"`
+	GasPrice             *hexutil.Big     `json:"gasPrice"`
+	MaxFeePerGas         *hexutil.Big     `json:"maxFeePerGas"`
+	MaxPriorityFeePerGas *hexutil.Big     `json:"maxPriorityFeePerGas"`
+	Value                *hexutil.Big     `json:"value"`
+	Data                 *hexutil.Bytes   `json:"data"`
+	Input                *hexutil.Bytes   `json:"input"`
+	AccessList           types.AccessList `json:"accessList"`
+}
+
+// message returns the call as geth's eth_call executes it, at a block with
+// baseFee.
+func (a *callArgs) message(baseFee *big.Int) *core.Message {
+	msg := &core.Message{
+		To:                    a.To,
+		Value:                 new(big.Int),
+		GasLimit:              callGasCap,
+		GasPrice:              new(big.Int),
+		GasFeeCap:             new(big.Int),
+		GasTipCap:             new(big.Int),
+		AccessList:            a.AccessList,
+		SkipNonceChecks:       true,
+		SkipTransactionChecks: true,
+	}
+	if a.From != nil {
+		msg.From = *a.From
+	}
+	if a.Gas != nil && uint64(*a.Gas) < callGasCap {
+		msg.GasLimit = uint64(*a.Gas)
+	}
+	if a.Value != nil {
+		msg.Value = a.Value.ToInt()
+	}
+	switch {
+	case a.Input != nil:
+		msg.Data = *a.Input
+	case a.Data != nil:
+		msg.Data = *a.Data
+	}
+	switch {
+	case a.GasPrice != nil:
+		msg.GasPrice, msg.GasFeeCap, msg.GasTipCap = a.GasPrice.ToInt(), a.GasPrice.ToInt(), a.GasPrice.ToInt()
+	case a.MaxFeePerGas != nil:
+		msg.GasFeeCap = a.MaxFeePerGas.ToInt()
+		if a.MaxPriorityFeePerGas != nil {
+			msg.GasTipCap = a.MaxPriorityFeePerGas.ToInt()
+		}
+		msg.GasPrice = new(big.Int).Add(msg.GasTipCap, baseFee)
+		if msg.GasPrice.Cmp(msg.GasFeeCap) > 0 {
+			msg.GasPrice = msg.GasFeeCap
+		}
+	}
+	return msg
+}
+
+// accountProof is an eth_getProof result.
+type accountProof struct {
+	Address      common.Address  `json:"address"`
+	AccountProof []hexutil.Bytes `json:"accountProof"`
+	Balance      *hexutil.Big    `json:"balance"`
+	CodeHash     common.Hash     `json:"codeHash"`
+	Nonce        hexutil.Uint64  `json:"nonce"`
+	StorageHash  common.Hash     `json:"storageHash"`
+	StorageProof []struct {
+		Key   string          `json:"key"`
+		Value *hexutil.Big    `json:"value"`
+		Proof []hexutil.Bytes `json:"proof"`
+	} `json:"storageProof"`
+}
+
+// verify checks the proof against the state root and returns the account
+// it proves, if the values it claims are those proven.
+func (p *accountProof) verify(root common.Hash) (*types.StateAccount, error) {
+	value, err := trie.VerifyProof(root, crypto.Keccak256(p.Address.Bytes()), proofDB(p.AccountProof))
+	if err != nil {
+		return nil, err
+	}
+	acc := types.NewEmptyStateAccount()
+	codeHash, storageHash := p.CodeHash, p.StorageHash
+	if value == nil {
+		// geth reports a missing account with zero hashes.
+		if codeHash == (common.Hash{}) {
+			codeHash = types.EmptyCodeHash
+		}
+		if storageHash == (common.Hash{}) {
+			storageHash = types.EmptyRootHash
+		}
+	} else if err := rlp.DecodeBytes(value, acc); err != nil {
+		return nil, err
+	}
+	if p.Balance == nil || p.Balance.ToInt().Cmp(acc.Balance.ToBig()) != 0 || uint64(p.Nonce) != acc.Nonce ||
+		codeHash != common.BytesToHash(acc.CodeHash) || storageHash != acc.Root {
+		return nil, errors.New("account differs from its proof")
+	}
+
+	for _, s := range p.StorageProof {
+		var slot []byte
+		if acc.Root != types.EmptyRootHash {
+			value, err := trie.VerifyProof(acc.Root, crypto.Keccak256(common.HexToHash(s.Key).Bytes()), proofDB(s.Proof))
+			if err != nil {
+				return nil, err
+			}
+			if value != nil {
+				if err := rlp.DecodeBytes(value, &slot); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if s.Value == nil || s.Value.ToInt().Cmp(new(big.Int).SetBytes(slot)) != 0 {
+			return nil, errors.New("storage slot differs from its proof")
+		}
+	}
+	return acc, nil
+}
+
+// nodes returns every trie node in the proof.
+func (p *accountProof) nodes() []hexutil.Bytes {
+	nodes := append([]hexutil.Bytes(nil), p.AccountProof...)
+	for _, s := range p.StorageProof {
+		nodes = append(nodes, s.Proof...)
+	}
+	return nodes
+}
+
+// proofDB returns the proof nodes keyed by their hashes, as trie.VerifyProof
+// looks them up.
+func proofDB(proof []hexutil.Bytes) *memorydb.Database {
+	db := memorydb.New()
+	for _, node := range proof {
+		_ = db.Put(crypto.Keccak256(node), node)
+	}
+	return db
+}
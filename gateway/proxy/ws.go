@@ -0,0 +1,302 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// wsWriteTimeout bounds writing one message to either side.
+	wsWriteTimeout = 10 * time.Second
+	// wsDialTimeout bounds connecting to an upstream.
+	wsDialTimeout = 10 * time.Second
+	// wsPingInterval is how often the upstream is pinged, so a connection
+	// that died silently is noticed and failed over.
+	wsPingInterval = 30 * time.Second
+	// wsPongWait is how long the upstream may go without answering a ping.
+	wsPongWait = 2 * wsPingInterval
+	// wsRedialAttempts is how many times a lost upstream is redialled, with
+	// a doubling backoff from retryBackoff, before the client is dropped.
+	wsRedialAttempts = 5
+	// maxWSMessage is the largest message a client may send.
+	maxWSMessage = 1 << 20
+	// maxCloseReason is the longest reason a close frame can carry.
+	maxCloseReason = 123
+)
+
+var wsDialer = &websocket.Dialer{
+	Proxy:            http.ProxyFromEnvironment,
+	HandshakeTimeout: wsDialTimeout,
+}
+
+// WS is a WebSocket proxy to an upstream node's WebSocket endpoint. It relays
+// whole messages rather than bytes, so the gateway can inspect, meter or
+// answer each one, and it follows the client's subscriptions: when the
+// upstream connection is lost they are re-established on a new one, on the
+// fallback upstream if there is one, under the IDs the client knows.
+type WS struct {
+	upstreams []string // the primary upstream, then the fallback if any
+	upgrader  websocket.Upgrader
+}
+
+// NewWS creates a WebSocket proxy targeting upstreamURL and, when set,
+// failing over to fallbackURL. Both are ws:// or wss:// URLs.
+func NewWS(upstreamURL, fallbackURL string) (*WS, error) {
+	p := &WS{
+		upgrader: websocket.Upgrader{
+			// Clients authenticate with a token, not a cookie, so a page on
+			// another origin gains nothing it could not do by itself.
+			CheckOrigin: func(*http.Request) bool { return true },
+		},
+	}
+	for _, raw := range []string{upstreamURL, fallbackURL} {
+		if raw == "" {
+			continue
+		}
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "ws" && u.Scheme != "wss" {
+			return nil, fmt.Errorf("upstream WebSocket URL must be ws:// or wss://, got %q", raw)
+		}
+		p.upstreams = append(p.upstreams, u.String())
+	}
+	return p, nil
+}
+
+// ServeWebSocket upgrades the client's connection and proxies its messages
+// over a new connection to the upstream. Every message is passed to filter
+// first, fromClient telling its direction: a client message for which filter
+// returns a reply is answered with it instead of being forwarded, and an
+// error closes the connection with a policy violation and the error as
+// reason. filter is called concurrently for the two directions.
+//
+// No client header reaches the upstream.
+func (p *WS) ServeWebSocket(w http.ResponseWriter, r *http.Request, filter func(msg []byte, fromClient bool) (reply []byte, err error)) {
+	upstream, err := p.dial(r.Context(), 0)
+	if err != nil {
+		slog.Error("upstream WebSocket error", "err", err)
+		http.Error(w, "upstream unavailable", http.StatusBadGateway)
+		return
+	}
+
+	conn, err := p.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has answered the client.
+		upstream.Close()
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(maxWSMessage)
+
+	rl := &wsRelay{
+		ws:         p,
+		client:     &wsClient{conn: conn},
+		upstream:   upstream,
+		pending:    make(map[string]pendingCall),
+		subs:       make(map[string]*subscription),
+		byUpstream: make(map[string]string),
+		internal:   make(map[string]string),
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rl.relayUpstream(filter)
+	}()
+
+	for {
+		typ, msg, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		reply, err := filter(msg, true)
+		if err != nil {
+			rl.client.close(websocket.ClosePolicyViolation, err.Error())
+			break
+		}
+		if reply != nil {
+			if rl.client.write(websocket.TextMessage, reply) != nil {
+				break
+			}
+			continue
+		}
+		rl.send(typ, msg)
+	}
+
+	rl.mu.Lock()
+	rl.closing = true
+	// Closing the upstream ends the relay of its messages.
+	rl.upstream.Close()
+	rl.mu.Unlock()
+	<-done
+}
+
+// dial connects to the upstream at index i of p.upstreams and keeps it
+// pinged.
+func (p *WS) dial(ctx context.Context, i int) (*websocket.Conn, error) {
+	conn, _, err := wsDialer.DialContext(ctx, p.upstreams[i], nil)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	go func() {
+		for {
+			time.Sleep(wsPingInterval)
+			if conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)) != nil {
+				return
+			}
+		}
+	}()
+	return conn, nil
+}
+
+// redial connects to an upstream after the one at index i was lost: the
+// next one first, so the fallback takes over from the primary and the
+// primary from the fallback, backing off between attempts.
+func (p *WS) redial(i int) (*websocket.Conn, int, error) {
+	var err error
+	for attempt := 0; attempt < wsRedialAttempts; attempt++ {
+		next := (i + 1 + attempt) % len(p.upstreams)
+		if attempt > 0 || next == i {
+			time.Sleep(retryBackoff << attempt)
+		}
+		var conn *websocket.Conn
+		if conn, err = p.dial(context.Background(), next); err == nil {
+			return conn, next, nil
+		}
+	}
+	return nil, 0, err
+}
+
+// wsRelay is one proxied connection.
+type wsRelay struct {
+	ws     *WS
+	client *wsClient
+
+	mu         sync.Mutex // guards the fields below and writes to upstream
+	upstream   *websocket.Conn
+	current    int                      // index of upstream in ws.upstreams
+	closing    bool                     // the client has gone
+	pending    map[string]pendingCall   // calls awaiting a response, by request ID
+	subs       map[string]*subscription // live subscriptions, by client-side ID
+	byUpstream map[string]string        // client-side subscription IDs by upstream ID
+	internal   map[string]string        // the relay's own requests, by request ID; see resubscribe
+	nextID     int
+}
+
+// send forwards a client message to the upstream. A failed write is left
+// to the upstream reader, which finds the connection broken and fails over.
+func (rl *wsRelay) send(typ int, msg []byte) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	msg, reply := rl.trackRequest(msg)
+	if reply != nil {
+		_ = rl.client.write(websocket.TextMessage, reply)
+		return
+	}
+	_ = rl.upstream.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	_ = rl.upstream.WriteMessage(typ, msg)
+}
+
+// relayUpstream relays the upstream's messages to the client until either
+// side goes, failing over when the upstream connection is lost.
+func (rl *wsRelay) relayUpstream(filter func(msg []byte, fromClient bool) ([]byte, error)) {
+	rl.mu.Lock()
+	upstream := rl.upstream
+	rl.mu.Unlock()
+	for {
+		typ, msg, err := upstream.ReadMessage()
+		if err != nil {
+			if upstream = rl.failover(err); upstream == nil {
+				rl.client.close(websocket.CloseGoingAway, "upstream closed")
+				return
+			}
+			continue
+		}
+		msg, forward := rl.trackResponse(msg)
+		if !forward {
+			continue
+		}
+		if _, err := filter(msg, false); err != nil {
+			rl.client.close(websocket.ClosePolicyViolation, err.Error())
+			return
+		}
+		if rl.client.write(typ, msg) != nil {
+			return
+		}
+	}
+}
+
+// failover replaces the lost upstream connection and re-establishes the
+// client's subscriptions on the new one. It returns the new connection, or
+// nil if the client has gone or no upstream could be reached. Calls in
+// flight are answered with an error, except subscriptions, which are sent
+// again. Notifications sent while no upstream was connected are lost.
+func (rl *wsRelay) failover(cause error) *websocket.Conn {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.closing {
+		return nil
+	}
+	rl.upstream.Close()
+	slog.Warn("upstream WebSocket lost", "err", cause, "subscriptions", len(rl.subs))
+	conn, i, err := rl.ws.redial(rl.current)
+	if err != nil {
+		slog.Error("upstream WebSocket unavailable", "err", err)
+		return nil
+	}
+	if rl.closing {
+		conn.Close()
+		return nil
+	}
+	rl.upstream, rl.current = conn, i
+	rl.resubscribe()
+	slog.Info("upstream WebSocket reconnected", "upstream", i, "subscriptions", len(rl.subs))
+	return conn
+}
+
+// wsClient serialises writes to a client connection, which both directions
+// of the relay make.
+type wsClient struct {
+	conn   *websocket.Conn
+	mu     sync.Mutex
+	closed bool
+}
+
+func (c *wsClient) write(typ int, msg []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return errors.New("connection closed")
+	}
+	_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return c.conn.WriteMessage(typ, msg)
+}
+
+// close sends the client a close frame with code and reason, once, and
+// closes the connection.
+func (c *wsClient) close(code int, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	if len(reason) > maxCloseReason {
+		reason = reason[:maxCloseReason]
+	}
+	_ = c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(wsWriteTimeout))
+	c.conn.Close()
+}
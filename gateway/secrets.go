@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/ethdenver2026/gateway/config"
+	"github.com/ethdenver2026/gateway/x402"
+)
+
+// newSecretSource returns the client of the secrets manager SECRETS_PROVIDER
+// names.
+func newSecretSource(cfg *config.Config) (x402.SecretSource, error) {
+	switch cfg.SecretsProvider {
+	case "vault":
+		return x402.NewVaultSecrets(cfg.VaultAddr, cfg.VaultToken, cfg.VaultNamespace), nil
+	case "aws-sm":
+		return x402.NewAWSSecrets(x402.AWSSecretsConfig{
+			Region:          cfg.AWSRegion,
+			AccessKeyID:     cfg.AWSAccessKeyID,
+			SecretAccessKey: cfg.AWSSecretAccessKey,
+			SessionToken:    cfg.AWSSessionToken,
+		})
+	default:
+		return x402.NewGCPSecrets(cfg.GCPCredentialsFile)
+	}
+}
+
+// readSecrets reads the secrets JWT_SECRET_REF and GATEWAY_PRIVATE_KEY_REF
+// name, returning those that are set.
+func readSecrets(src x402.SecretSource, cfg *config.Config) (jwtSecret []byte, privateKey string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if cfg.JWTSecretRef != "" {
+		value, err := src.Secret(ctx, cfg.JWTSecretRef)
+		if err != nil {
+			return nil, "", fmt.Errorf("JWT_SECRET_REF: %w", err)
+		}
+		if jwtSecret, err = config.ParseJWTSecret(strings.TrimSpace(value)); err != nil {
+			return nil, "", fmt.Errorf("JWT_SECRET_REF: %w", err)
+		}
+	}
+	if cfg.GatewayPrivateKeyRef != "" {
+		value, err := src.Secret(ctx, cfg.GatewayPrivateKeyRef)
+		if err != nil {
+			return nil, "", fmt.Errorf("GATEWAY_PRIVATE_KEY_REF: %w", err)
+		}
+		privateKey = strings.TrimSpace(value)
+		if _, err := x402.NewKeySigner(privateKey); err != nil {
+			return nil, "", fmt.Errorf("GATEWAY_PRIVATE_KEY_REF: %w", err)
+		}
+	}
+	return jwtSecret, privateKey, nil
+}
+
+// loadSecrets reads the secrets kept in the secrets manager into cfg, as if
+// they had been set in the environment. It returns the manager, nil when
+// none is configured.
+func loadSecrets(cfg *config.Config) (x402.SecretSource, error) {
+	if cfg.SecretsProvider == "" {
+		return nil, nil
+	}
+	src, err := newSecretSource(cfg)
+	if err != nil {
+		return nil, err
+	}
+	jwtSecret, privateKey, err := readSecrets(src, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if jwtSecret != nil {
+		cfg.JWTSecret = jwtSecret
+	}
+	if privateKey != "" {
+		cfg.GatewayPrivateKey = privateKey
+	}
+	return src, nil
+}
+
+// refreshSecrets periodically re-reads the secrets. A new JWT secret is
+// rotated into tokens, if the gateway issues any; a new relayer key cannot
+// replace the running relayer, whose address payments name, so it is only
+// logged. A failed read keeps the secrets in use.
+func refreshSecrets(src x402.SecretSource, cfg *config.Config, tokens *x402.TokenManager, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		jwtSecret, privateKey, err := readSecrets(src, cfg)
+		if err != nil {
+			slog.Warn("secrets refresh failed", "provider", cfg.SecretsProvider, "err", err)
+			continue
+		}
+		if jwtSecret != nil && tokens != nil && string(jwtSecret) != string(cfg.JWTSecret) {
+			tokens.RotateSecret(jwtSecret)
+			cfg.JWTSecret = jwtSecret
+			slog.Info("JWT secret rotated", "provider", cfg.SecretsProvider)
+		}
+		if privateKey != "" && privateKey != cfg.GatewayPrivateKey {
+			slog.Warn("relayer key changed in the secrets manager; restart the gateway to use it", "provider", cfg.SecretsProvider)
+		}
+	}
+}
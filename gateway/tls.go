@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethdenver2026/gateway/config"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certCheckInterval is how often the certificate files are checked for a
+// renewed certificate.
+const certCheckInterval = time.Minute
+
+// serverTLS returns the TLS configuration PORT is served with, nil for plain
+// HTTP, and the handler of TLS_HTTP_PORT: ACME HTTP challenges under
+// autocert, and a redirect to GATEWAY_URL for everything else.
+func serverTLS(cfg *config.Config) (*tls.Config, http.Handler, error) {
+	redirect := redirectTo(cfg.GatewayURL)
+	switch {
+	case cfg.TLSAutocert:
+		u, _ := url.Parse(cfg.GatewayURL)
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(cfg.TLSAutocertDir),
+			HostPolicy: autocert.HostWhitelist(u.Hostname()),
+			Email:      cfg.TLSAutocertEmail,
+		}
+		tlsConfig := m.TLSConfig()
+		tlsConfig.MinVersion = tls.VersionTLS12
+		return tlsConfig, m.HTTPHandler(redirect), nil
+	case cfg.TLSCert != "":
+		certs := &certFiles{cert: cfg.TLSCert, key: cfg.TLSKey}
+		if err := certs.load(); err != nil {
+			return nil, nil, err
+		}
+		tlsConfig := &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			NextProtos:     []string{"h2", "http/1.1"},
+			GetCertificate: certs.get,
+		}
+		return tlsConfig, redirect, nil
+	}
+	return nil, nil, nil
+}
+
+// redirectTo redirects every request to the same path and query under base.
+func redirectTo(base string) http.Handler {
+	base = strings.TrimSuffix(base, "/")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, base+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// certFiles serves the certificate in a PEM certificate and key file pair,
+// loading it again when either file changes, so a certificate renewed in
+// place, by certbot say, is served without a restart.
+type certFiles struct {
+	cert, key string
+
+	mu      sync.Mutex
+	current *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+// load reads the certificate files.
+func (c *certFiles) load() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	modTime, err := c.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.cert, c.key)
+	if err != nil {
+		return fmt.Errorf("loading certificate: %w", err)
+	}
+	c.current, c.modTime, c.checked = &cert, modTime, time.Now()
+	return nil
+}
+
+// lastModified returns when the certificate or key file last changed.
+func (c *certFiles) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.cert, c.key} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("reading certificate: %w", err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// get is the tls.Config GetCertificate hook. At most every
+// certCheckInterval it looks for changed files; a certificate that fails to
+// load is logged, and the one before it served on.
+func (c *certFiles) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) < certCheckInterval {
+		return c.current, nil
+	}
+	c.checked = time.Now()
+	modTime, err := c.lastModified()
+	if err != nil || !modTime.After(c.modTime) {
+		return c.current, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.cert, c.key)
+	if err != nil {
+		// A renewal may be half written: try again at the next check.
+		slog.Warn("reloading TLS certificate failed, serving the previous one", "cert", c.cert, "err", err)
+		return c.current, nil
+	}
+	c.current, c.modTime = &cert, modTime
+	slog.Info("TLS certificate reloaded", "cert", c.cert)
+	return c.current, nil
+}
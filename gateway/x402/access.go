@@ -0,0 +1,56 @@
+package x402
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// RequestInfo is what the payment gate learned about a request, for the
+// access log.
+type RequestInfo struct {
+	// TokenID is the ID of the token the request spent credits of.
+	TokenID string
+	// Payer is the address that paid for the token, or for the payment the
+	// request carried.
+	Payer string
+	// Methods are the JSON-RPC methods called, as the hooks left them.
+	Methods []string
+	// Remaining is the credits left on the token once the request was
+	// served and any refund made; -1 when no token was charged.
+	Remaining int64
+}
+
+// requestInfoKey is the context key of a request's traced RequestInfo.
+type requestInfoKey struct{}
+
+// requestTrace is a RequestInfo filled in while a request is served.
+type requestTrace struct {
+	mu   sync.Mutex
+	info RequestInfo
+}
+
+// TraceRequest returns a copy of ctx under which the middleware records what
+// it learns about the request, and a function returning that so far.
+func TraceRequest(ctx context.Context) (context.Context, func() RequestInfo) {
+	t := &requestTrace{info: RequestInfo{Remaining: -1}}
+	return context.WithValue(ctx, requestInfoKey{}, t), func() RequestInfo {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		info := t.info
+		info.Methods = slices.Clone(info.Methods)
+		return info
+	}
+}
+
+// noteRequest applies note to r's RequestInfo if it is being traced.
+func noteRequest(r *http.Request, note func(*RequestInfo)) {
+	t, _ := r.Context().Value(requestInfoKey{}).(*requestTrace)
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	note(&t.info)
+}
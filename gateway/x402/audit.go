@@ -0,0 +1,200 @@
+package x402
+
+// Audit log: a record of every token issued, credit spent, refunded, added
+// or granted, token revoked, payment and settlement, written as JSON lines
+// to a file of its own, apart from the operational log and never rewritten.
+// With hash chaining each record carries the SHA-256 of the line before it,
+// so a record edited or removed after the fact breaks the chain at the next
+// one (VerifyAuditLog finds where). Publishing the hash of the last line now
+// and then also pins the records before it.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Audit events recorded by the token manager. The middleware's payment and
+// settlement events (see Webhooks) are recorded under their own names.
+const (
+	AuditTokenIssued     = "token_issued"
+	AuditCreditsUsed     = "credits_used"
+	AuditCreditsRefunded = "credits_refunded"
+	AuditCreditsAdded    = "credits_added"
+	AuditCreditsGranted  = "credits_granted"
+	AuditTokenRevoked    = "token_revoked"
+)
+
+// ActorGateway is the actor of what the gateway does on its own: settling
+// payments, refunding failed calls, revoking the tokens of payments that
+// never landed.
+const ActorGateway = "gateway"
+
+// AuditRecord is one line of the audit log.
+type AuditRecord struct {
+	Seq   uint64    `json:"seq"`
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	// Actor is who caused the event: the payer's address, ActorGateway, or
+	// an operator through the admin API ("admin" and the client address).
+	Actor string         `json:"actor"`
+	Data  map[string]any `json:"data,omitempty"`
+	// Prev is the hex SHA-256 of the previous line, empty for the first
+	// record and when the log is not hash-chained.
+	Prev string `json:"prev,omitempty"`
+}
+
+// AuditLog appends audit records to a file.
+type AuditLog struct {
+	mu      sync.Mutex
+	f       *os.File
+	chained bool
+	seq     uint64
+	prev    []byte // SHA-256 of the last line written
+}
+
+// OpenAuditLog opens the audit log at path for appending, creating it if
+// needed, and carries on its sequence and, when chained, its hash chain from
+// the last record there. A last line that is not a whole record, as a crash
+// mid-write leaves, is an error for the operator to look into.
+func OpenAuditLog(path string, chained bool) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	a := &AuditLog{f: f, chained: chained}
+	last, err := lastLine(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	if last != nil {
+		var rec AuditRecord
+		if err := json.Unmarshal(last, &rec); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s ends with a partial record: %w", path, err)
+		}
+		sum := sha256.Sum256(last)
+		a.seq, a.prev = rec.Seq, sum[:]
+	}
+	return a, nil
+}
+
+// Record appends a record of event, caused by actor, with data. A record
+// that cannot be written is logged: the audit log does not stop the gateway
+// serving.
+func (a *AuditLog) Record(event, actor string, data map[string]any) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	rec := AuditRecord{
+		Seq:   a.seq + 1,
+		Time:  time.Now().UTC(),
+		Event: event,
+		Actor: actor,
+		Data:  data,
+	}
+	if a.chained && a.prev != nil {
+		rec.Prev = hex.EncodeToString(a.prev)
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		slog.Error("audit record encoding failed", "event", event, "err", err)
+		return
+	}
+	if _, err := a.f.Write(append(line, '\n')); err != nil {
+		slog.Error("audit log write failed", "event", event, "err", err)
+		return
+	}
+	sum := sha256.Sum256(line)
+	a.seq, a.prev = rec.Seq, sum[:]
+}
+
+// Close closes the audit log file.
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.f.Close()
+}
+
+// VerifyAuditLog checks the hash chain of an audit log read from r: that
+// every record after the first names the hash of the line before it, and
+// that the sequence numbers follow on. It returns the number of records and
+// the hex SHA-256 of the last line, to compare with one published earlier.
+func VerifyAuditLog(r io.Reader) (records int, head string, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	var prev []byte
+	var seq uint64
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var rec AuditRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return records, "", fmt.Errorf("line %d: %w", records+1, err)
+		}
+		if prev != nil {
+			if rec.Prev == "" {
+				return records, "", fmt.Errorf("record %d is not hash-chained", rec.Seq)
+			}
+			if rec.Prev != hex.EncodeToString(prev) {
+				return records, "", fmt.Errorf("record %d does not follow record %d: the chain is broken", rec.Seq, seq)
+			}
+			if rec.Seq != seq+1 {
+				return records, "", fmt.Errorf("record %d follows record %d", rec.Seq, seq)
+			}
+		}
+		sum := sha256.Sum256(line)
+		prev, seq = sum[:], rec.Seq
+		records++
+	}
+	if err := scanner.Err(); err != nil {
+		return records, "", err
+	}
+	return records, hex.EncodeToString(prev), nil
+}
+
+// lastLine returns the last non-empty line of f, or nil if it has none.
+func lastLine(f *os.File) ([]byte, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	var tail []byte
+	buf := make([]byte, 4096)
+	for off := info.Size(); off > 0; {
+		n := min(int64(len(buf)), off)
+		off -= n
+		if _, err := f.ReadAt(buf[:n], off); err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		tail = append(append([]byte(nil), buf[:n]...), tail...)
+		trimmed := bytes.TrimRight(tail, "\n")
+		if i := bytes.LastIndexByte(trimmed, '\n'); i >= 0 {
+			return trimmed[i+1:], nil
+		}
+		if off == 0 && len(trimmed) > 0 {
+			return trimmed, nil
+		}
+	}
+	return nil, nil
+}
+
+// payerActor is the actor of what a payer does, "anonymous" for a payment
+// whose payer is not known.
+func payerActor(payer string) string {
+	if payer == "" {
+		return "anonymous"
+	}
+	return payer
+}
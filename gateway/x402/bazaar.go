@@ -0,0 +1,99 @@
+package x402
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// BazaarListing is this gateway as x402 discovery services ("bazaars") list
+// resources: where it is, what it costs, and how to find out more.
+type BazaarListing struct {
+	Resource    string                  `json:"resource"`
+	Type        string                  `json:"type"`
+	X402Version int                     `json:"x402Version"`
+	Accepts     []paymentRequirementsV2 `json:"accepts"`
+	LastUpdated time.Time               `json:"lastUpdated"`
+	Metadata    bazaarMetadata          `json:"metadata"`
+}
+
+type bazaarMetadata struct {
+	Description string `json:"description"`
+	Network     string `json:"network"`
+	// Protocol tells agents what to send once they have paid.
+	Protocol string `json:"protocol"`
+	// Discovery is the URL of the gateway's full discovery document.
+	Discovery string `json:"discovery"`
+}
+
+// Listing returns the gateway's current bazaar listing, with the regular
+// offers at current prices.
+func (m *Middleware) Listing() BazaarListing {
+	var payload paymentRequiredV2
+	_ = json.Unmarshal(m.pricing.Load().payloadJSON, &payload)
+	return BazaarListing{
+		Resource:    payload.Resource.URL,
+		Type:        "http",
+		X402Version: payload.X402Version,
+		Accepts:     payload.Accepts,
+		LastUpdated: time.Now().UTC(),
+		Metadata: bazaarMetadata{
+			Description: payload.Resource.Description,
+			Network:     m.cfg.Network,
+			Protocol:    "json-rpc",
+			Discovery:   strings.TrimSuffix(m.cfg.GatewayURL, "/") + discoveryPath,
+		},
+	}
+}
+
+// BazaarClient publishes listings to an x402 discovery service.
+type BazaarClient struct {
+	url    string
+	apiKey string
+	client *http.Client
+}
+
+// NewBazaarClient creates a BazaarClient posting listings to url, with apiKey
+// as bearer token when non-empty.
+func NewBazaarClient(url, apiKey string) *BazaarClient {
+	return &BazaarClient{
+		url:    url,
+		apiKey: apiKey,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}
+}
+
+// Publish registers the listing, or refreshes it: services key listings by
+// resource URL, so publishing again replaces the previous one.
+func (c *BazaarClient) Publish(ctx context.Context, listing BazaarListing) error {
+	body, err := json.Marshal(listing)
+	if err != nil {
+		return fmt.Errorf("encoding listing: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("bazaar returned %d: %s", resp.StatusCode, respBody)
+	}
+	return nil
+}
@@ -0,0 +1,701 @@
+package x402
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltTokensBucket holds one record per issued token, keyed by token ID.
+var boltTokensBucket = []byte("x402_tokens")
+
+// boltRevokedBucket holds the IDs of revoked tokens.
+var boltRevokedBucket = []byte("x402_revoked")
+
+// boltSettlementsBucket holds pending settlements as JSON, keyed by token ID.
+// It is named for the upto payments that were its first use.
+var boltSettlementsBucket = []byte("x402_upto")
+
+// boltDeadSettlementsBucket holds the settlements given up on, as JSON keyed
+// by token ID.
+var boltDeadSettlementsBucket = []byte("x402_dead_settlements")
+
+// boltFreeBucket holds the free tier counts, keyed by client and day. Values
+// are the big-endian unix expiry followed by the big-endian count used.
+var boltFreeBucket = []byte("x402_free")
+
+// boltUsageBucket holds the calls and credits each payer spent per method and
+// hour. Keys are the big-endian unix hour, the payer, a NUL and the method;
+// values the big-endian calls then credits.
+var boltUsageBucket = []byte("x402_usage")
+
+// boltRevenueBucket holds what each payer paid per asset and hour. Keys are
+// the big-endian unix hour then the payer, network and asset separated by
+// NULs; values the big-endian payment count then the decimal amount.
+var boltRevenueBucket = []byte("x402_revenue")
+
+// boltLedgerBucket holds the ledger entries as JSON. Keys are the big-endian
+// unix nanosecond time then the big-endian sequence number.
+var boltLedgerBucket = []byte("x402_ledger")
+
+// boltBalancesBucket holds the ledger balances. Keys are the account, a NUL
+// and the unit; values the decimal balance.
+var boltBalancesBucket = []byte("x402_ledger_balances")
+
+// boltIndexBucket holds the token index: what each token was issued with, as
+// JSON keyed by token ID.
+var boltIndexBucket = []byte("x402_token_index")
+
+// boltReplayBucket holds the keys of redeemed payment authorizations. Values
+// are the big-endian unix expiry, followed by the issued token once known.
+var boltReplayBucket = []byte("x402_replay")
+
+// BoltTokenStore is a TokenCounterStore persisted to a local bbolt file.
+// It gives a single-node deployment restart-safe counters without running a
+// database server. bbolt serialises write transactions, so UseRequest is
+// atomic without any extra locking.
+type BoltTokenStore struct {
+	db *bolt.DB
+}
+
+// NewBoltTokenStore creates the store's bucket in db if needed and returns a
+// store using it. The caller owns db and is responsible for closing it.
+func NewBoltTokenStore(db *bolt.DB) (*BoltTokenStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltTokensBucket, boltRevokedBucket, boltSettlementsBucket, boltDeadSettlementsBucket, boltFreeBucket, boltUsageBucket, boltRevenueBucket, boltLedgerBucket, boltBalancesBucket, boltIndexBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating token buckets: %w", err)
+	}
+	return &BoltTokenStore{db: db}, nil
+}
+
+// boltTokenRecord is the on-disk value for a token: total then used, each a
+// big-endian int64.
+type boltTokenRecord struct {
+	total int64
+	used  int64
+}
+
+func (r boltTokenRecord) marshal() []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b[0:8], uint64(r.total))
+	binary.BigEndian.PutUint64(b[8:16], uint64(r.used))
+	return b
+}
+
+func unmarshalBoltTokenRecord(b []byte) (boltTokenRecord, error) {
+	if len(b) != 16 {
+		return boltTokenRecord{}, fmt.Errorf("corrupt token record (%d bytes)", len(b))
+	}
+	return boltTokenRecord{
+		total: int64(binary.BigEndian.Uint64(b[0:8])),
+		used:  int64(binary.BigEndian.Uint64(b[8:16])),
+	}, nil
+}
+
+// RegisterToken stores the total allowance for a newly issued token.
+// If tokenID already exists the call is a no-op (idempotent).
+func (s *BoltTokenStore) RegisterToken(tokenID string, total int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltTokensBucket)
+		if b.Get([]byte(tokenID)) != nil {
+			return nil
+		}
+		return b.Put([]byte(tokenID), boltTokenRecord{total: total}.marshal())
+	})
+}
+
+// UseRequest consumes n credits and returns the number remaining.
+func (s *BoltTokenStore) UseRequest(tokenID string, n int64) (int64, error) {
+	var remaining int64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltTokensBucket)
+		raw := b.Get([]byte(tokenID))
+		if raw == nil {
+			return ErrTokenNotFound
+		}
+		rec, err := unmarshalBoltTokenRecord(raw)
+		if err != nil {
+			return err
+		}
+		if rec.used+n > rec.total {
+			return ErrTokenExhausted
+		}
+		rec.used += n
+		remaining = rec.total - rec.used
+		return b.Put([]byte(tokenID), rec.marshal())
+	})
+	if err != nil {
+		return 0, err
+	}
+	return remaining, nil
+}
+
+// AddCredits raises the token's allowance by n.
+func (s *BoltTokenStore) AddCredits(tokenID string, n int64) (int64, error) {
+	var remaining int64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltTokensBucket)
+		raw := b.Get([]byte(tokenID))
+		if raw == nil {
+			return ErrTokenNotFound
+		}
+		rec, err := unmarshalBoltTokenRecord(raw)
+		if err != nil {
+			return err
+		}
+		rec.total += n
+		remaining = rec.total - rec.used
+		return b.Put([]byte(tokenID), rec.marshal())
+	})
+	if err != nil {
+		return 0, err
+	}
+	return remaining, nil
+}
+
+// RefundRequest gives back n consumed credits.
+func (s *BoltTokenStore) RefundRequest(tokenID string, n int64) (int64, error) {
+	var remaining int64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltTokensBucket)
+		raw := b.Get([]byte(tokenID))
+		if raw == nil {
+			return ErrTokenNotFound
+		}
+		rec, err := unmarshalBoltTokenRecord(raw)
+		if err != nil {
+			return err
+		}
+		rec.used -= min(n, rec.used)
+		remaining = rec.total - rec.used
+		return b.Put([]byte(tokenID), rec.marshal())
+	})
+	if err != nil {
+		return 0, err
+	}
+	return remaining, nil
+}
+
+// Remaining returns the token's unused credits.
+func (s *BoltTokenStore) Remaining(tokenID string) (int64, error) {
+	var remaining int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(boltTokensBucket).Get([]byte(tokenID))
+		if raw == nil {
+			return ErrTokenNotFound
+		}
+		rec, err := unmarshalBoltTokenRecord(raw)
+		if err != nil {
+			return err
+		}
+		remaining = rec.total - rec.used
+		return nil
+	})
+	return remaining, err
+}
+
+// RevokeToken records tokenID as revoked.
+func (s *BoltTokenStore) RevokeToken(tokenID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltTokensBucket).Get([]byte(tokenID)) == nil {
+			return ErrTokenNotFound
+		}
+		return tx.Bucket(boltRevokedBucket).Put([]byte(tokenID), []byte{})
+	})
+}
+
+// IsRevoked reports whether tokenID has been revoked.
+func (s *BoltTokenStore) IsRevoked(tokenID string) (bool, error) {
+	revoked := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		revoked = tx.Bucket(boltRevokedBucket).Get([]byte(tokenID)) != nil
+		return nil
+	})
+	return revoked, err
+}
+
+// AddSettlement records a payment to be settled for its token.
+func (s *BoltTokenStore) AddSettlement(p PendingSettlement) error {
+	v, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("encoding settlement: %w", err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSettlementsBucket).Put([]byte(p.TokenID), v)
+	})
+}
+
+// TakeSettlement removes and returns the settlement recorded for tokenID.
+func (s *BoltTokenStore) TakeSettlement(tokenID string) (*PendingSettlement, error) {
+	var p *PendingSettlement
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltSettlementsBucket)
+		raw := b.Get([]byte(tokenID))
+		if raw == nil {
+			return nil
+		}
+		p = new(PendingSettlement)
+		if err := json.Unmarshal(raw, p); err != nil {
+			return fmt.Errorf("corrupt settlement: %w", err)
+		}
+		return b.Delete([]byte(tokenID))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// DueSettlements returns the tokens whose settlements are due by now.
+func (s *BoltTokenStore) DueSettlements(now time.Time) ([]string, error) {
+	var ids []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSettlementsBucket).ForEach(func(k, v []byte) error {
+			var p PendingSettlement
+			if err := json.Unmarshal(v, &p); err != nil {
+				return fmt.Errorf("corrupt settlement %s: %w", k, err)
+			}
+			if !p.SettleAt.After(now) {
+				ids = append(ids, string(k))
+			}
+			return nil
+		})
+	})
+	return ids, err
+}
+
+// AddDeadSettlement records a settlement that was given up on.
+func (s *BoltTokenStore) AddDeadSettlement(p PendingSettlement) error {
+	v, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("encoding settlement: %w", err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltDeadSettlementsBucket).Put([]byte(p.TokenID), v)
+	})
+}
+
+// DeadSettlements returns the settlements given up on, oldest first.
+func (s *BoltTokenStore) DeadSettlements() ([]PendingSettlement, error) {
+	var out []PendingSettlement
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltDeadSettlementsBucket).ForEach(func(k, v []byte) error {
+			var p PendingSettlement
+			if err := json.Unmarshal(v, &p); err != nil {
+				return fmt.Errorf("corrupt settlement %s: %w", k, err)
+			}
+			out = append(out, p)
+			return nil
+		})
+	})
+	sortDeadSettlements(out)
+	return out, err
+}
+
+// TakeDeadSettlement removes and returns the dead settlement recorded under
+// tokenID.
+func (s *BoltTokenStore) TakeDeadSettlement(tokenID string) (*PendingSettlement, error) {
+	var p *PendingSettlement
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltDeadSettlementsBucket)
+		raw := b.Get([]byte(tokenID))
+		if raw == nil {
+			return nil
+		}
+		p = new(PendingSettlement)
+		if err := json.Unmarshal(raw, p); err != nil {
+			return fmt.Errorf("corrupt settlement: %w", err)
+		}
+		return b.Delete([]byte(tokenID))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// UseFreeRequests counts n more free requests under key.
+func (s *BoltTokenStore) UseFreeRequests(key string, n, limit int64, expiresAt time.Time) (int64, error) {
+	var remaining int64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltFreeBucket)
+		v := make([]byte, 16)
+		if raw := b.Get([]byte(key)); len(raw) == 16 {
+			copy(v, raw)
+		} else {
+			binary.BigEndian.PutUint64(v[0:8], uint64(expiresAt.Unix()))
+		}
+		used := int64(binary.BigEndian.Uint64(v[8:16]))
+		if used+n > limit {
+			return ErrFreeTierExhausted
+		}
+		used += n
+		remaining = limit - used
+		binary.BigEndian.PutUint64(v[8:16], uint64(used))
+		return b.Put([]byte(key), v)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return remaining, nil
+}
+
+// PruneFreeRequests deletes the counts that expired before now.
+func (s *BoltTokenStore) PruneFreeRequests(now time.Time) (int, error) {
+	n := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltFreeBucket)
+		// Collect first: deleting under a live cursor can skip entries.
+		var expired [][]byte
+		if err := b.ForEach(func(k, v []byte) error {
+			// Counts start with their expiry, as replay entries do.
+			if boltReplayExpired(v, now) {
+				expired = append(expired, k)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(expired)
+		return nil
+	})
+	return n, err
+}
+
+// boltUsageKey is the key of fields in the hour starting at hour.
+func boltUsageKey(hour time.Time, fields ...string) []byte {
+	k := binary.BigEndian.AppendUint64(nil, uint64(hour.Unix()))
+	return append(k, strings.Join(fields, "\x00")...)
+}
+
+// AddUsage adds calls and credits to payer's use of method in an hour.
+func (s *BoltTokenStore) AddUsage(hour time.Time, payer, method string, calls, credits int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltUsageBucket)
+		k := boltUsageKey(hour, payer, method)
+		v := make([]byte, 16)
+		if raw := b.Get(k); len(raw) == 16 {
+			copy(v, raw)
+		}
+		binary.BigEndian.PutUint64(v[0:8], binary.BigEndian.Uint64(v[0:8])+uint64(calls))
+		binary.BigEndian.PutUint64(v[8:16], binary.BigEndian.Uint64(v[8:16])+uint64(credits))
+		return b.Put(k, v)
+	})
+}
+
+// AddRevenue adds to what payer paid in asset on network in an hour.
+func (s *BoltTokenStore) AddRevenue(hour time.Time, payer, network, asset string, payments int64, amount *big.Int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltRevenueBucket)
+		k := boltUsageKey(hour, payer, network, asset)
+		count, total := int64(0), new(big.Int)
+		if raw := b.Get(k); len(raw) > 8 {
+			count = int64(binary.BigEndian.Uint64(raw[0:8]))
+			if _, ok := total.SetString(string(raw[8:]), 10); !ok {
+				return fmt.Errorf("corrupt revenue record %q", raw[8:])
+			}
+		}
+		total.Add(total, amount)
+		v := binary.BigEndian.AppendUint64(nil, uint64(count+payments))
+		return b.Put(k, append(v, total.String()...))
+	})
+}
+
+// UsageReport totals the hours from from until before to.
+func (s *BoltTokenStore) UsageReport(from, to time.Time) (*UsageReport, error) {
+	t := newUsageTotals()
+	start, end := boltUsageKey(from), boltUsageKey(to)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltUsageBucket).Cursor()
+		for k, v := c.Seek(start); k != nil && bytes.Compare(k, end) < 0; k, v = c.Next() {
+			fields := strings.SplitN(string(k[8:]), "\x00", 2)
+			if len(fields) != 2 || len(v) != 16 {
+				return fmt.Errorf("corrupt usage record %q", k)
+			}
+			t.addUsage(fields[0], fields[1], int64(binary.BigEndian.Uint64(v[0:8])), int64(binary.BigEndian.Uint64(v[8:16])))
+		}
+		c = tx.Bucket(boltRevenueBucket).Cursor()
+		for k, v := c.Seek(start); k != nil && bytes.Compare(k, end) < 0; k, v = c.Next() {
+			fields := strings.SplitN(string(k[8:]), "\x00", 3)
+			amount, ok := new(big.Int).SetString(string(v[min(8, len(v)):]), 10)
+			if len(fields) != 3 || len(v) <= 8 || !ok {
+				return fmt.Errorf("corrupt revenue record %q", k)
+			}
+			t.addRevenue(fields[0], fields[1], fields[2], int64(binary.BigEndian.Uint64(v[0:8])), amount)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t.report(from, to), nil
+}
+
+// PostLedgerEntry appends e and applies its postings, unless one would take
+// a balance to the wrong side of zero.
+func (s *BoltTokenStore) PostLedgerEntry(e LedgerEntry) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		balances := tx.Bucket(boltBalancesBucket)
+		for _, p := range sortPostings(e.Postings) {
+			k := []byte(p.Account + "\x00" + p.Unit)
+			balance := new(big.Int)
+			if raw := balances.Get(k); raw != nil {
+				if _, ok := balance.SetString(string(raw), 10); !ok {
+					return fmt.Errorf("corrupt ledger balance %q", raw)
+				}
+			}
+			balance.Add(balance, p.Amount)
+			if !ledgerBalanceOK(p.Account, balance) {
+				return fmt.Errorf("%w: %s would hold %s %s", ErrLedgerInvariant, p.Account, balance, p.Unit)
+			}
+			if err := balances.Put(k, []byte(balance.String())); err != nil {
+				return err
+			}
+		}
+		ledger := tx.Bucket(boltLedgerBucket)
+		seq, err := ledger.NextSequence()
+		if err != nil {
+			return err
+		}
+		e.Seq = seq
+		v, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		k := binary.BigEndian.AppendUint64(nil, uint64(e.Time.UnixNano()))
+		return ledger.Put(binary.BigEndian.AppendUint64(k, seq), v)
+	})
+}
+
+// LedgerBalances returns the balances of the accounts starting with prefix.
+func (s *BoltTokenStore) LedgerBalances(prefix string) ([]LedgerBalance, error) {
+	var out []LedgerBalance
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBalancesBucket).Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			account, unit, ok := strings.Cut(string(k), "\x00")
+			amount, valid := new(big.Int).SetString(string(v), 10)
+			if !ok || !valid {
+				return fmt.Errorf("corrupt ledger balance %q", k)
+			}
+			out = append(out, LedgerBalance{Account: account, Unit: unit, Amount: amount})
+		}
+		return nil
+	})
+	return out, err
+}
+
+// LedgerEntries returns the entries posted from from until before to.
+func (s *BoltTokenStore) LedgerEntries(from, to time.Time) ([]LedgerEntry, error) {
+	var out []LedgerEntry
+	start := binary.BigEndian.AppendUint64(nil, uint64(from.UnixNano()))
+	end := binary.BigEndian.AppendUint64(nil, uint64(to.UnixNano()))
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltLedgerBucket).Cursor()
+		for k, v := c.Seek(start); k != nil && bytes.Compare(k, end) < 0; k, v = c.Next() {
+			var e LedgerEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return fmt.Errorf("corrupt ledger entry %x: %w", k, err)
+			}
+			out = append(out, e)
+		}
+		return nil
+	})
+	return out, err
+}
+
+// IndexToken records t.
+func (s *BoltTokenStore) IndexToken(t IssuedToken) error {
+	v, err := json.Marshal(t)
+	if err != nil {
+		return fmt.Errorf("encoding token: %w", err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltIndexBucket).Put([]byte(t.ID), v)
+	})
+}
+
+// IssuedToken returns the record of the token with the given ID.
+func (s *BoltTokenStore) IssuedToken(id string) (*IssuedToken, error) {
+	var t *IssuedToken
+	err := s.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(boltIndexBucket).Get([]byte(id))
+		if raw == nil {
+			return ErrTokenNotFound
+		}
+		t = new(IssuedToken)
+		if err := json.Unmarshal(raw, t); err != nil {
+			return fmt.Errorf("corrupt token %s: %w", id, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// IssuedTokens returns the tokens q selects, newest first.
+func (s *BoltTokenStore) IssuedTokens(q TokenQuery) ([]IssuedToken, error) {
+	var out []IssuedToken
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltIndexBucket).ForEach(func(k, v []byte) error {
+			var t IssuedToken
+			if err := json.Unmarshal(v, &t); err != nil {
+				return fmt.Errorf("corrupt token %s: %w", k, err)
+			}
+			if q.matches(t) {
+				out = append(out, t)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sortIssuedTokens(out, q.limit()), nil
+}
+
+// BoltReplayCache is a ReplayCache persisted to a local bbolt file, so a
+// restart does not reopen the window for replaying settled payments.
+type BoltReplayCache struct {
+	db *bolt.DB
+}
+
+// NewBoltReplayCache creates the cache's bucket in db if needed and returns a
+// cache using it. db may be shared with a BoltTokenStore.
+func NewBoltReplayCache(db *bolt.DB) (*BoltReplayCache, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltReplayBucket)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating replay bucket: %w", err)
+	}
+	return &BoltReplayCache{db: db}, nil
+}
+
+// Reserve records key, with resendHash, until expiresAt, returning false if
+// an unexpired entry already exists. An expired entry for the same key is
+// replaced.
+func (c *BoltReplayCache) Reserve(key, resendHash string, expiresAt time.Time) (bool, error) {
+	v := make([]byte, boltReplayHeader)
+	binary.BigEndian.PutUint64(v, uint64(expiresAt.Unix()))
+	if resendHash != "" {
+		hash, err := hex.DecodeString(resendHash)
+		if err != nil || len(hash) != sha256.Size {
+			return false, fmt.Errorf("invalid resend hash %q", resendHash)
+		}
+		copy(v[8:], hash)
+	}
+	reserved := false
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltReplayBucket)
+		if raw := b.Get([]byte(key)); raw != nil && !boltReplayExpired(raw, time.Now()) {
+			return nil
+		}
+		reserved = true
+		return b.Put([]byte(key), v)
+	})
+	return reserved, err
+}
+
+// Release forgets key.
+func (c *BoltReplayCache) Release(key string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltReplayBucket).Delete([]byte(key))
+	})
+}
+
+// SetToken records the token issued for key. Unknown keys are ignored.
+func (c *BoltReplayCache) SetToken(key, token string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltReplayBucket)
+		raw := b.Get([]byte(key))
+		if len(raw) < 8 {
+			return nil
+		}
+		v := make([]byte, boltReplayHeader+len(token))
+		copy(v, raw[:min(len(raw), boltReplayHeader)])
+		copy(v[boltReplayHeader:], token)
+		return b.Put([]byte(key), v)
+	})
+}
+
+// Token returns the token and resend hash recorded for key. Entries written
+// before resend hashes were recorded have neither.
+func (c *BoltReplayCache) Token(key string) (string, string, error) {
+	token, resendHash := "", ""
+	err := c.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(boltReplayBucket).Get([]byte(key))
+		if len(raw) < boltReplayHeader || boltReplayExpired(raw, time.Now()) {
+			return nil
+		}
+		token = string(raw[boltReplayHeader:])
+		if hash := raw[8:boltReplayHeader]; !bytes.Equal(hash, make([]byte, sha256.Size)) {
+			resendHash = hex.EncodeToString(hash)
+		}
+		return nil
+	})
+	return token, resendHash, err
+}
+
+// Prune deletes every entry that expired before now.
+func (c *BoltReplayCache) Prune(now time.Time) (int, error) {
+	n := 0
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltReplayBucket)
+		// Collect first: deleting under a live cursor can skip entries.
+		var expired [][]byte
+		if err := b.ForEach(func(k, v []byte) error {
+			if boltReplayExpired(v, now) {
+				expired = append(expired, k)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(expired)
+		return nil
+	})
+	return n, err
+}
+
+// boltReplayHeader is the length of a stored replay entry before its token:
+// the big-endian unix expiry, then the resend hash, zero if there is none.
+const boltReplayHeader = 8 + sha256.Size
+
+// boltReplayExpired reports whether a stored replay entry (see
+// boltReplayHeader, then an optional token) is past now. Entries written before expiries
+// were recorded have an empty value and are treated as expired.
+func boltReplayExpired(v []byte, now time.Time) bool {
+	if len(v) < 8 {
+		return true
+	}
+	return int64(binary.BigEndian.Uint64(v[:8])) < now.Unix()
+}
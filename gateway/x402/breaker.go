@@ -0,0 +1,77 @@
+package x402
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// breakerThreshold is how many calls in a row the facilitator must fail
+	// to answer for the circuit breaker to open.
+	breakerThreshold = 5
+	// breakerCooldown is how long an open circuit breaker fails calls at
+	// once before letting one through to probe the facilitator.
+	breakerCooldown = 30 * time.Second
+)
+
+// errCircuitOpen is wrapped, with ErrFacilitatorUnavailable, into the errors
+// of calls a RemoteFacilitator refused without making them.
+var errCircuitOpen = errors.New("circuit breaker open")
+
+// circuitBreaker stops calls to a facilitator that keeps failing, so payments
+// are refused, or failed over, at once instead of after a timeout each. After
+// breakerCooldown one call is let through: its success closes the breaker,
+// its failure keeps it open for another cooldown.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time // zero while closed
+	probing   bool      // a call is testing the facilitator after the cooldown
+}
+
+// allow reports whether a call may be made.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return true
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record records the outcome of an allowed call: ok if the facilitator
+// answered it, whatever the answer.
+func (b *circuitBreaker) record(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	wasOpen := !b.openUntil.IsZero()
+	b.probing = false
+	if ok {
+		if wasOpen {
+			slog.Info("facilitator circuit breaker closed")
+		}
+		b.failures, b.openUntil = 0, time.Time{}
+		return
+	}
+	b.failures++
+	if wasOpen || b.failures >= breakerThreshold {
+		if !wasOpen {
+			slog.Warn("facilitator circuit breaker opened", "failures", b.failures, "cooldown", breakerCooldown)
+		}
+		b.openUntil = time.Now().Add(breakerCooldown)
+	}
+}
+
+// abandon records that an allowed call was given up by its caller, which
+// tells nothing about the facilitator.
+func (b *circuitBreaker) abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
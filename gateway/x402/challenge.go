@@ -0,0 +1,120 @@
+package x402
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// challengeTTL is how long a challenge handed out in a 402 can be paid with.
+const challengeTTL = 10 * time.Minute
+
+// challengeLen is the byte length of a challenge: an expiry, a random nonce
+// and a truncated HMAC over both.
+const challengeLen = 8 + 8 + 16
+
+// newChallenge returns a fresh challenge valid for challengeTTL after now,
+// hex-encoded. It is stateless: any replica holding the same secret can check
+// it, and no other deployment can mint one.
+func (m *Middleware) newChallenge(now time.Time) string {
+	b := make([]byte, challengeLen)
+	binary.BigEndian.PutUint64(b[:8], uint64(now.Add(challengeTTL).Unix()))
+	_, _ = rand.Read(b[8:16])
+	copy(b[16:], m.challengeMAC(b[:16]))
+	return hex.EncodeToString(b)
+}
+
+// validChallenge reports whether challenge was issued by this deployment and
+// has not expired at now.
+func (m *Middleware) validChallenge(challenge string, now time.Time) bool {
+	b, err := hex.DecodeString(challenge)
+	if err != nil || len(b) != challengeLen {
+		return false
+	}
+	if !hmac.Equal(b[16:], m.challengeMAC(b[:16])) {
+		return false
+	}
+	return int64(binary.BigEndian.Uint64(b[:8])) >= now.Unix()
+}
+
+// challengeNonce returns the nonce a payment answering challenge signs:
+// keccak256 of the challenge's bytes. Echoing the challenge alone proves
+// nothing, as the echo is not signed; the nonce is.
+func challengeNonce(challenge string) common.Hash {
+	b, _ := hex.DecodeString(challenge)
+	return crypto.Keccak256Hash(b)
+}
+
+// signsChallenge reports whether the authorization in p, made against req,
+// is signed with the nonce of challenge. A Solana transaction has no nonce of
+// its own: it must carry the nonce, in hex as in the 402, as the text of an
+// SPL Memo instruction.
+func signsChallenge(p *localPayload, req *paymentRequirementsV2, challenge string) bool {
+	nonce := challengeNonce(challenge)
+	switch {
+	case IsSolanaNetwork(req.Network):
+		raw, err := base64.StdEncoding.DecodeString(p.Payload.Transaction)
+		if err != nil {
+			return false
+		}
+		tx, err := parseSolanaTx(raw)
+		return err == nil && tx.hasMemo(nonce.Hex())
+	case usesPermit2(req.Scheme):
+		a := &p.Payload.Permit2Authorization
+		return a.Nonce != "" && mustBI(a.Nonce).Cmp(new(big.Int).SetBytes(nonce[:])) == 0
+	case p.Payload.Authorization.From != "":
+		return common.HexToHash(p.Payload.Authorization.Nonce) == nonce
+	}
+	return false
+}
+
+func (m *Middleware) challengeMAC(msg []byte) []byte {
+	mac := hmac.New(sha256.New, m.cfg.ChallengeSecret)
+	mac.Write([]byte("x402-challenge"))
+	mac.Write(msg)
+	return mac.Sum(nil)[:16]
+}
+
+// withChallenge returns the set's 402 payload, JSON and base64-encoded, with
+// challenge and its nonce in the extra data of every Accepts entry.
+func (s *offerSet) withChallenge(challenge string) (payloadJSON []byte, payload402 string, err error) {
+	var payload paymentRequiredV2
+	if err := json.Unmarshal(s.payloadJSON, &payload); err != nil {
+		return nil, "", err
+	}
+	nonce := challengeNonce(challenge).Hex()
+	for i := range payload.Accepts {
+		payload.Accepts[i].Extra.Challenge = challenge
+		payload.Accepts[i].Extra.ChallengeNonce = nonce
+	}
+	payloadJSON, err = json.Marshal(payload)
+	if err != nil {
+		return nil, "", err
+	}
+	return payloadJSON, base64.StdEncoding.EncodeToString(payloadJSON), nil
+}
+
+// withChallenge returns a copy of o whose requirements carry the challenge
+// the client echoed, so a facilitator comparing the payment's "accepted"
+// block with the requirements sees them agree.
+func (o *offer) withChallenge(challenge string) (*offer, error) {
+	c := *o
+	c.requirements.Extra.Challenge = challenge
+	c.requirements.Extra.ChallengeNonce = challengeNonce(challenge).Hex()
+	reqJSON, err := json.Marshal(c.requirements)
+	if err != nil {
+		return nil, fmt.Errorf("marshalling payment requirements: %w", err)
+	}
+	c.requirementsJSON = reqJSON
+	return &c, nil
+}
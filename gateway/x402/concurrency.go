@@ -0,0 +1,80 @@
+package x402
+
+import (
+	"net/http"
+	"sync"
+)
+
+// InFlightLimiter caps the requests being proxied at once, in all and per
+// token, so a burst beyond what the upstream can take is turned away at the
+// door instead of slowing every request down. It may be shared by several
+// Middlewares to cap them together.
+type InFlightLimiter struct {
+	global   chan struct{} // nil when unlimited
+	perToken int
+
+	mu     sync.Mutex
+	tokens map[string]int // in flight, by token ID
+}
+
+// NewInFlightLimiter returns a limiter admitting up to global requests at
+// once and up to perToken of any one token; 0 lifts either cap.
+func NewInFlightLimiter(global, perToken int) *InFlightLimiter {
+	l := &InFlightLimiter{perToken: perToken, tokens: make(map[string]int)}
+	if global > 0 {
+		l.global = make(chan struct{}, global)
+	}
+	return l
+}
+
+// acquire admits a request of tokenID, "" for one without a token, if the
+// caps allow, returning the function that ends it.
+func (l *InFlightLimiter) acquire(tokenID string) (release func(), ok bool) {
+	if l == nil {
+		return func() {}, true
+	}
+	if l.perToken > 0 && tokenID != "" {
+		l.mu.Lock()
+		if l.tokens[tokenID] >= l.perToken {
+			l.mu.Unlock()
+			return nil, false
+		}
+		l.tokens[tokenID]++
+		l.mu.Unlock()
+	}
+	releaseToken := func() {
+		if l.perToken <= 0 || tokenID == "" {
+			return
+		}
+		l.mu.Lock()
+		if l.tokens[tokenID]--; l.tokens[tokenID] <= 0 {
+			delete(l.tokens, tokenID)
+		}
+		l.mu.Unlock()
+	}
+	if l.global != nil {
+		select {
+		case l.global <- struct{}{}:
+		default:
+			releaseToken()
+			return nil, false
+		}
+	}
+	return func() {
+		if l.global != nil {
+			<-l.global
+		}
+		releaseToken()
+	}, true
+}
+
+// admit admits a request of tokenID past the in-flight caps, or answers it
+// with 429 and returns ok=false. Nothing has been charged by then.
+func (m *Middleware) admit(w http.ResponseWriter, tokenID string) (release func(), ok bool) {
+	release, ok = m.cfg.InFlight.acquire(tokenID)
+	if !ok {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, http.StatusTooManyRequests, CodeOverloaded, "")
+	}
+	return release, ok
+}
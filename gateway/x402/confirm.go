@@ -0,0 +1,257 @@
+package x402
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// confirmationsPath is where clients poll payments awaiting confirmations,
+// followed by the payment's ID.
+const confirmationsPath = "/x402/payments/"
+
+const (
+	// confirmationTimeout bounds settling a payment and waiting for its
+	// confirmations.
+	confirmationTimeout = 15 * time.Minute
+	// confirmationRetention is how long a finished payment can still be
+	// polled for its outcome.
+	confirmationRetention = 15 * time.Minute
+	// maxLongPoll caps the wait a client may ask for with ?wait=<seconds>.
+	maxLongPoll = 60 * time.Second
+	// confirmationPollHint is the Retry-After suggested to polling clients.
+	confirmationPollHint = "2"
+)
+
+// pendingPayment is a payment whose settlement is waiting for confirmations.
+// Its outcome fields are written once, before done is closed.
+type pendingPayment struct {
+	id         string
+	replayKey  string
+	resendHash string // resendDigest of the payment, to answer its resubmission
+	credits    int64
+	done       chan struct{}
+
+	finished    time.Time
+	failed      bool
+	tokenStr    string // the new token; empty for a completed top-up
+	remaining   int64  // credits left on a topped-up token
+	transaction string // settlement transaction hash, if reported
+}
+
+// confirmationTracker holds the payments awaiting, or recently past, their
+// confirmations. It lives in memory only: after a restart a client recovers
+// its token by resubmitting the payment, which the replay cache answers.
+type confirmationTracker struct {
+	mu    sync.Mutex
+	byID  map[string]*pendingPayment
+	byKey map[string]*pendingPayment
+}
+
+func newConfirmationTracker() *confirmationTracker {
+	return &confirmationTracker{
+		byID:  make(map[string]*pendingPayment),
+		byKey: make(map[string]*pendingPayment),
+	}
+}
+
+// add registers a new pending payment, dropping finished ones past retention.
+func (t *confirmationTracker) add(replayKey, resendHash string, credits int64) *pendingPayment {
+	job := &pendingPayment{
+		id:         uuid.New().String(),
+		replayKey:  replayKey,
+		resendHash: resendHash,
+		credits:    credits,
+		done:       make(chan struct{}),
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cutoff := time.Now().Add(-confirmationRetention)
+	for id, j := range t.byID {
+		if !j.finished.IsZero() && j.finished.Before(cutoff) {
+			delete(t.byID, id)
+			delete(t.byKey, j.replayKey)
+		}
+	}
+	t.byID[job.id] = job
+	t.byKey[replayKey] = job
+	return job
+}
+
+// finish records job's outcome through set and wakes any long-polling client.
+func (t *confirmationTracker) finish(job *pendingPayment, set func(*pendingPayment)) {
+	t.mu.Lock()
+	set(job)
+	job.finished = time.Now()
+	t.mu.Unlock()
+	close(job.done)
+}
+
+func (t *confirmationTracker) byPaymentID(id string) *pendingPayment {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.byID[id]
+}
+
+func (t *confirmationTracker) byReplayKey(key string) *pendingPayment {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.byKey[key]
+}
+
+// startConfirmation settles a verified payment in the background and answers
+// the request with 202 and the URL to poll for its outcome. Credits are only
+// issued — a new token, or a top-up of topUp when it is non-nil — once the
+// settlement transaction has Confirmations confirmations.
+func (m *Middleware) startConfirmation(w http.ResponseWriter, r *http.Request, p *collectedPayment, topUp *Claims, topUpToken string) {
+	job := m.confirming.add(p.replayKey, p.resendHash, p.offer.credits)
+	go m.confirm(job, p, topUp, topUpToken)
+
+	slog.Info("payment awaiting confirmations", "payment", job.id, "payer", p.result.Payer, "confirmations", m.cfg.Confirmations)
+	m.writePendingPayment(w, r, job)
+}
+
+// confirm settles the payment, waits for its confirmations and issues its
+// credits, recording the outcome in job.
+func (m *Middleware) confirm(job *pendingPayment, p *collectedPayment, topUp *Claims, topUpToken string) {
+	ctx, cancel := context.WithTimeout(context.Background(), confirmationTimeout)
+	defer cancel()
+
+	data := paymentEventData(&p.offer.requirements, p.result.Payer, p.offer.credits, p.replayKey)
+	data["payment"] = job.id
+	m.notify(EventSettlementSubmitted, data)
+	cf := m.cfg.Facilitator.(ConfirmingFacilitator)
+	settled, err := cf.SettleConfirmed(ctx, p.payload, p.offer.requirementsJSON, m.cfg.Confirmations)
+	if err != nil {
+		slog.Warn("payment settlement not confirmed", "payment", job.id, "err", err)
+		data["error"] = err.Error()
+		event := EventSettlementFailed
+		if errors.Is(err, ErrSettlementReverted) {
+			// Nothing was paid: the payment may be presented again.
+			event = EventSettlementReverted
+			if err := m.cfg.Replay.Release(p.replayKey); err != nil {
+				slog.Error("replay cache release failed", "err", err)
+			}
+		}
+		// Otherwise the key stays reserved: the transaction may yet land.
+		m.notify(event, data)
+		m.confirming.finish(job, func(j *pendingPayment) { j.failed = true })
+		return
+	}
+	data["transaction"] = settled.Transaction
+	data["confirmations"] = m.cfg.Confirmations
+	m.notify(EventSettlementConfirmed, data)
+
+	if topUp != nil {
+		remaining, err := m.cfg.Tokens.AddCredits(topUp, p.offer.credits)
+		if err == nil {
+			m.recordToken(p, topUpToken)
+			slog.Info("topped up batch token", "tid", topUp.TokenID, "payer", p.result.Payer, "credits", p.offer.credits, "remaining", remaining)
+			m.confirming.finish(job, func(j *pendingPayment) {
+				j.remaining = remaining
+				j.transaction = settled.Transaction
+			})
+			m.watchReorg(settled.Transaction, p.replayKey, data, func() bool {
+				return m.withdrawCredits(topUp, p.offer.credits, true)
+			})
+			return
+		}
+		// As for a synchronous top-up, the client still gets its credits.
+		slog.Error("top-up failed after settlement, issuing new token", "tid", topUp.TokenID, "err", err)
+	}
+
+	tokenStr, err := m.cfg.Tokens.IssueToken(p.result.Payer, p.offer.credits, p.offer.methods)
+	if err != nil {
+		slog.Error("failed to issue batch token", "payment", job.id, "err", err)
+		m.confirming.finish(job, func(j *pendingPayment) { j.failed = true })
+		return
+	}
+	m.recordToken(p, tokenStr)
+	slog.Info("issued batch token", "payer", p.result.Payer, "credits", p.offer.credits)
+	m.confirming.finish(job, func(j *pendingPayment) {
+		j.tokenStr = tokenStr
+		j.transaction = settled.Transaction
+	})
+	m.watchReorg(settled.Transaction, p.replayKey, data, func() bool {
+		return m.withdrawToken(tokenStr, p.offer.credits)
+	})
+}
+
+// servePaymentStatus answers GET <confirmationsPath><id>. With ?wait=<seconds>
+// it long-polls, returning as soon as the payment's outcome is known.
+func (m *Middleware) servePaymentStatus(w http.ResponseWriter, r *http.Request) {
+	job := m.confirming.byPaymentID(strings.TrimPrefix(r.URL.Path, confirmationsPath))
+	if job == nil {
+		writeError(w, http.StatusNotFound, CodeUnknownPayment, "")
+		return
+	}
+
+	if secs, err := strconv.Atoi(r.URL.Query().Get("wait")); err == nil && secs > 0 {
+		timer := time.NewTimer(min(time.Duration(secs)*time.Second, maxLongPoll))
+		defer timer.Stop()
+		select {
+		case <-job.done:
+		case <-timer.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+	m.writePendingPayment(w, r, job)
+}
+
+// writePendingPayment writes the current state of job: 202 while it awaits
+// confirmations, then the credits it bought or the settlement failure.
+func (m *Middleware) writePendingPayment(w http.ResponseWriter, r *http.Request, job *pendingPayment) {
+	select {
+	case <-job.done:
+	default:
+		pollURL := strings.TrimSuffix(m.cfg.GatewayURL, "/") + confirmationsPath + job.id
+		w.Header().Set("Location", pollURL)
+		w.Header().Set("Retry-After", confirmationPollHint)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":        "pending",
+			"message":       "payment submitted — poll for your credits once it is confirmed",
+			"poll":          pollURL,
+			"confirmations": m.cfg.Confirmations,
+		})
+		return
+	}
+
+	if job.transaction != "" {
+		w.Header().Set(settlementTxHeader, job.transaction)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case job.failed:
+		m.send402WithCode(w, r, CodeSettlementFailed, "")
+	case job.tokenStr != "":
+		w.Header().Set(paymentTokenHeader, job.tokenStr)
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(withTransaction(map[string]interface{}{
+			"status":  "confirmed",
+			"message": "payment confirmed — retry your RPC request with the token",
+			"credits": job.credits,
+			"hint":    "set Authorization: Bearer <token from X-Payment-Token header>",
+		}, job.transaction))
+	default:
+		w.Header().Set(creditsRemainingHeader, strconv.FormatInt(job.remaining, 10))
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(withTransaction(map[string]interface{}{
+			"status":    "confirmed",
+			"message":   "top-up confirmed — keep using your existing token",
+			"credits":   job.credits,
+			"remaining": job.remaining,
+		}, job.transaction))
+	}
+}
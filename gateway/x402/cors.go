@@ -0,0 +1,102 @@
+package x402
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsAllowedHeaders are the request headers browser clients may send: the
+// JSON-RPC body's content type, the gateway's credentials and the request
+// for a verified answer.
+var corsAllowedHeaders = []string{
+	"Content-Type",
+	"Authorization",
+	paymentSignatureHeader,
+	xPaymentHeader,
+	paymentResendSecretHeader,
+	couponHeader,
+	rpcVerifyHeader,
+}
+
+// corsExposedHeaders are the response headers browser clients may read: the
+// 402 offers, settlement results, tokens and credit counts, cache hits,
+// verified answers, the payment hash to follow settlement by, where to poll a
+// payment awaiting confirmations, and the ID the request was logged under.
+var corsExposedHeaders = []string{
+	paymentRequiredHeader,
+	paymentResponseHeader,
+	xPaymentResponseHeader,
+	paymentTokenHeader,
+	settlementTxHeader,
+	paymentHashHeader,
+	creditsRemainingHeader,
+	rpcCacheHeader,
+	rpcVerifiedHeader,
+	freeRequestsRemainingHeader,
+	"Location",
+	"Retry-After",
+	"X-Request-Id",
+}
+
+// CORSConfig configures cross-origin access for browser-based clients.
+type CORSConfig struct {
+	// AllowedOrigins are the origins, such as "https://app.example.com", whose
+	// pages may call the gateway; "*" allows any. Credentials travel in
+	// headers, never cookies, so any origin is safe to allow.
+	AllowedOrigins []string
+	// MaxAge is how long browsers may cache a preflight response.
+	MaxAge time.Duration
+}
+
+// CORS wraps next with CORS handling: preflight OPTIONS requests from allowed
+// origins are answered directly, and other responses to them carry the
+// headers letting the page read the gateway's payment headers.
+func CORS(cfg CORSConfig, next http.Handler) http.Handler {
+	anyOrigin := false
+	origins := make(map[string]bool, len(cfg.AllowedOrigins))
+	for _, o := range cfg.AllowedOrigins {
+		if o == "*" {
+			anyOrigin = true
+		}
+		origins[strings.TrimSuffix(o, "/")] = true
+	}
+	allowHeaders := strings.Join(corsAllowedHeaders, ", ")
+	exposeHeaders := strings.Join(corsExposedHeaders, ", ")
+	maxAge := strconv.Itoa(int(cfg.MaxAge.Seconds()))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !anyOrigin {
+			// The answer depends on the origin, so caches must key on it.
+			w.Header().Add("Vary", "Origin")
+		}
+		if origin == "" || (!anyOrigin && !origins[origin]) {
+			if preflight {
+				// No CORS headers: the browser refuses the actual request.
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		if anyOrigin {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if preflight {
+			h.Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+			h.Set("Access-Control-Allow-Headers", allowHeaders)
+			h.Set("Access-Control-Max-Age", maxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.Set("Access-Control-Expose-Headers", exposeHeaders)
+		next.ServeHTTP(w, r)
+	})
+}
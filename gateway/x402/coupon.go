@@ -0,0 +1,84 @@
+package x402
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// couponHeader is the request header a client presents a coupon code in. It
+// must be sent both on the request answered with 402, to be offered the
+// discounted packs, and on the payment for one of them.
+const couponHeader = "X-Coupon"
+
+// Coupon is a promotional code changing the terms of every pack for the
+// clients that present it: a lower amount, more credits, or both.
+type Coupon struct {
+	// Code is what clients send in X-Coupon, matched case-insensitively.
+	Code string
+	// Discount is the percentage taken off each pack's amount, 0 to 99.
+	// Discounted amounts are rounded up to whole atomic units.
+	Discount int64
+	// Bonus is the percentage of extra credits each pack buys, rounded down.
+	Bonus int64
+	// Expires, when set, is when the coupon stops being accepted.
+	Expires time.Time
+}
+
+// validateCoupons checks that every coupon has a code, sane percentages and
+// changes something, and that no code is listed twice.
+func validateCoupons(coupons []Coupon) error {
+	seen := make(map[string]bool, len(coupons))
+	for _, c := range coupons {
+		if strings.TrimSpace(c.Code) == "" {
+			return errors.New("coupon code must not be empty")
+		}
+		key := couponKey(c.Code)
+		if seen[key] {
+			return fmt.Errorf("coupon %s listed twice", c.Code)
+		}
+		seen[key] = true
+		if c.Discount < 0 || c.Discount > 99 || c.Bonus < 0 {
+			return fmt.Errorf("coupon %s: discount must be 0-99%% and bonus not negative", c.Code)
+		}
+		if c.Discount == 0 && c.Bonus == 0 {
+			return fmt.Errorf("coupon %s has neither a discount nor a bonus", c.Code)
+		}
+	}
+	return nil
+}
+
+// couponKey normalises a coupon code for lookup.
+func couponKey(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// apply returns tier t on the coupon's terms.
+func (c *Coupon) apply(t PricingTier) PricingTier {
+	t.Amount = (t.Amount*(100-c.Discount) + 99) / 100
+	t.Credits += t.Credits * c.Bonus / 100
+	return t
+}
+
+// expired reports whether the coupon is no longer accepted at now.
+func (c *Coupon) expired(now time.Time) bool {
+	return !c.Expires.IsZero() && !now.Before(c.Expires)
+}
+
+// offersFor returns the offers advertised to r: those of the coupon in its
+// X-Coupon header, if it has one. ok is false when the header names no coupon
+// or an expired one; set is then the regular offers.
+func (m *Middleware) offersFor(r *http.Request) (set *offerSet, ok bool) {
+	set = m.pricing.Load()
+	code := r.Header.Get(couponHeader)
+	if strings.TrimSpace(code) == "" {
+		return set, true
+	}
+	couponed := set.coupons[couponKey(code)]
+	if couponed == nil || couponed.coupon.expired(time.Now()) {
+		return set, false
+	}
+	return couponed, true
+}
@@ -0,0 +1,102 @@
+package x402
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// discoveryPath serves the gateway's discovery document.
+const discoveryPath = "/.well-known/x402"
+
+// discoveryDocument describes how to pay this gateway, so x402-aware clients
+// and marketplaces can find and price it without provoking a 402 first.
+type discoveryDocument struct {
+	X402Version int                     `json:"x402Version"`
+	Resource    paymentResourceV2       `json:"resource"`
+	Accepts     []paymentRequirementsV2 `json:"accepts"`
+	Credits     discoveryCredits        `json:"credits"`
+	Payment     discoveryPayment        `json:"payment"`
+}
+
+// discoveryCredits is the credit policy: what tokens are worth and how
+// requests are charged against them.
+type discoveryCredits struct {
+	// Mode is "token" for a balance per token, "account" for one balance
+	// per payer shared by its tokens.
+	Mode               string           `json:"mode"`
+	TokenExpirySeconds int64            `json:"tokenExpirySeconds"`
+	MethodCosts        map[string]int64 `json:"methodCosts,omitempty"`
+	FreeMethods        []string         `json:"freeMethods,omitempty"`
+	FreeRequestsPerDay int64            `json:"freeRequestsPerDay,omitempty"`
+	MaxBatchSize       int              `json:"maxBatchSize,omitempty"`
+	RateLimit          *RateLimit       `json:"rateLimit,omitempty"`
+}
+
+// discoveryPayment lists the optional payment features and the headers they
+// use.
+type discoveryPayment struct {
+	PaymentHeaders    []string `json:"paymentHeaders"`
+	TokenHeader       string   `json:"tokenHeader"`
+	TopUps            bool     `json:"topUps"`
+	PayAndCall        bool     `json:"payAndCall"`
+	AsyncSettlement   bool     `json:"asyncSettlement"`
+	Confirmations     uint64   `json:"confirmations,omitempty"`
+	CouponHeader      string   `json:"couponHeader,omitempty"`
+	ChallengeRequired bool     `json:"challengeRequired"`
+	// PaymentHashHeader names the response header carrying a verified
+	// payment's hash; StatusPath, followed by it, serves its settlement
+	// status.
+	PaymentHashHeader string `json:"paymentHashHeader"`
+	StatusPath        string `json:"statusPath"`
+}
+
+// serveDiscovery answers GET discoveryPath with the current offers and
+// policy. Coupon codes are not listed; the offers are the regular ones.
+func (m *Middleware) serveDiscovery(w http.ResponseWriter) {
+	set := m.pricing.Load()
+	var payload paymentRequiredV2
+	_ = json.Unmarshal(set.payloadJSON, &payload)
+
+	credits := discoveryCredits{
+		Mode:               "token",
+		TokenExpirySeconds: int64(m.cfg.Tokens.Expiry().Seconds()),
+		MethodCosts:        set.methodCosts,
+		FreeMethods:        make([]string, 0, len(m.freeMethods)),
+		FreeRequestsPerDay: m.cfg.FreeRequestsPerDay,
+		MaxBatchSize:       m.cfg.MaxBatchSize,
+		RateLimit:          m.cfg.Tokens.rateLimit,
+	}
+	if m.cfg.Tokens.accounts {
+		credits.Mode = "account"
+	}
+	for method := range m.freeMethods {
+		credits.FreeMethods = append(credits.FreeMethods, method)
+	}
+	sort.Strings(credits.FreeMethods)
+
+	payment := discoveryPayment{
+		PaymentHeaders:    []string{paymentSignatureHeader, xPaymentHeader},
+		TokenHeader:       paymentTokenHeader,
+		TopUps:            true,
+		PayAndCall:        m.cfg.PayAndCall,
+		AsyncSettlement:   m.cfg.AsyncSettlement,
+		Confirmations:     m.cfg.Confirmations,
+		ChallengeRequired: m.cfg.ChallengeSecret != nil,
+		PaymentHashHeader: paymentHashHeader,
+		StatusPath:        settlementsPath,
+	}
+	if len(m.cfg.Coupons) > 0 {
+		payment.CouponHeader = couponHeader
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	_ = json.NewEncoder(w).Encode(discoveryDocument{
+		X402Version: payload.X402Version,
+		Resource:    payload.Resource,
+		Accepts:     payload.Accepts,
+		Credits:     credits,
+		Payment:     payment,
+	})
+}
@@ -0,0 +1,119 @@
+package x402
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ErrorCode is the machine-readable code in the body of every error response
+// the gateway itself produces, so clients can react without parsing messages.
+// Errors from the upstream node are passed through untouched.
+type ErrorCode string
+
+const (
+	// 402 Payment Required — the body also carries the x402 offers.
+	CodePaymentRequired      ErrorCode = "payment_required"       // no credentials
+	CodeTokenExhausted       ErrorCode = "token_exhausted"        // no credits left
+	CodeInsufficientCredits  ErrorCode = "insufficient_credits"   // fewer credits left than the call costs
+	CodeTokenExpired         ErrorCode = "token_expired"          // JWT past its expiry
+	CodeTokenInvalid         ErrorCode = "token_invalid"          // JWT malformed or badly signed
+	CodeTokenRevoked         ErrorCode = "token_revoked"          // revoked by an operator or for an unpaid settlement
+	CodeTokenNotFound        ErrorCode = "token_not_found"        // unknown to the counter store
+	CodeMeteredTokenTopUp    ErrorCode = "metered_token_topup"    // upto tokens cannot be topped up
+	CodeNoMatchingOffer      ErrorCode = "no_matching_offer"      // payment matches no advertised offer
+	CodeAmountTooLow         ErrorCode = "amount_too_low"         // payment is for less than the offer's amount
+	CodeOfferScopeMismatch   ErrorCode = "offer_scope_mismatch"   // top-up pack scoped differently from the token
+	CodeUptoTopUpUnsupported ErrorCode = "upto_topup_unsupported" // top-ups cannot be paid under upto
+	CodeCouponInvalid        ErrorCode = "coupon_invalid"         // X-Coupon names no coupon, or an expired one
+	CodeFreeTierExhausted    ErrorCode = "free_tier_exhausted"    // no free requests left today
+	CodeChallengeInvalid     ErrorCode = "challenge_invalid"      // payment signs no live challenge from this gateway
+	CodeVerificationFailed   ErrorCode = "verification_failed"    // the facilitator rejected the payment
+	CodeInsufficientFunds    ErrorCode = "insufficient_funds"     // payer's balance or allowance is below the amount
+	CodeWouldRevert          ErrorCode = "would_revert"           // simulating the settlement shows it would revert
+	CodeSettlementFailed     ErrorCode = "settlement_failed"      // the payment could not be settled
+
+	// Other statuses.
+	CodeBadRequest        ErrorCode = "bad_request"               // 400
+	CodeInvalidPayment    ErrorCode = "invalid_payment"           // 400: payment header not decodable
+	CodeUnauthorized      ErrorCode = "unauthorized"              // 401: facilitator API bearer token missing or wrong
+	CodePayerRevoked      ErrorCode = "payer_revoked"             // 403: the paying account is revoked
+	CodeMethodNotAllowed  ErrorCode = "method_not_allowed"        // 403: method outside the token's scope
+	CodeUnknownPayment    ErrorCode = "unknown_payment"           // 404: no such payment to poll
+	CodePaymentProcessed  ErrorCode = "payment_already_processed" // 409: payment redeemed or in flight
+	CodeRequestTooLarge   ErrorCode = "request_too_large"         // 413: body over the size limit
+	CodeRateLimited       ErrorCode = "rate_limited"              // 429
+	CodeOverloaded        ErrorCode = "overloaded"                // 429: too many requests in flight
+	CodeInternal          ErrorCode = "internal_error"            // 500
+	CodeUnavailable       ErrorCode = "unavailable"               // 503
+	CodeSettlementPending ErrorCode = "settlement_pending"        // 503: settlement failed, retrying in the background
+)
+
+// errorMessages are the default messages of the error codes.
+var errorMessages = map[ErrorCode]string{
+	CodePaymentRequired:      "payment required",
+	CodeTokenExhausted:       "token has no credits left",
+	CodeInsufficientCredits:  "token has too few credits left for this request",
+	CodeTokenExpired:         "token has expired",
+	CodeTokenInvalid:         "token is not valid",
+	CodeTokenRevoked:         "token has been revoked",
+	CodeTokenNotFound:        "token is not known to this gateway",
+	CodeMeteredTokenTopUp:    "metered tokens cannot be topped up",
+	CodeNoMatchingOffer:      "payment does not match any advertised offer",
+	CodeAmountTooLow:         "payment amount is below the offer's price",
+	CodeOfferScopeMismatch:   "top-up pack's method scope differs from the token's",
+	CodeUptoTopUpUnsupported: "top-ups cannot be paid under the upto scheme",
+	CodeCouponInvalid:        "coupon code is unknown or expired",
+	CodeFreeTierExhausted:    "free requests for today used up",
+	CodeChallengeInvalid:     "payment does not sign the nonce of a current challenge from this gateway",
+	CodeVerificationFailed:   "payment verification failed",
+	CodeInsufficientFunds:    "payer's token balance or allowance is below the payment amount",
+	CodeWouldRevert:          "payment's settlement would revert on chain",
+	CodeSettlementFailed:     "payment settlement failed",
+	CodeBadRequest:           "bad request",
+	CodeInvalidPayment:       "invalid payment header encoding",
+	CodeUnauthorized:         "unauthorized",
+	CodePayerRevoked:         "payer account revoked",
+	CodeMethodNotAllowed:     "method not allowed for this token",
+	CodeUnknownPayment:       "unknown payment",
+	CodePaymentProcessed:     "payment already processed",
+	CodeRequestTooLarge:      "request body too large",
+	CodeRateLimited:          "rate limit exceeded",
+	CodeOverloaded:           "too many requests in flight; retry shortly",
+	CodeInternal:             "internal error",
+	CodeUnavailable:          "temporarily unavailable",
+	CodeSettlementPending:    "payment settlement failed and is being retried; resubmit the same payment later to collect the token",
+}
+
+// retryableCodes are the errors for which repeating the same request later,
+// unchanged, may succeed. Retry-After says when, if it is set.
+var retryableCodes = map[ErrorCode]bool{
+	CodePaymentProcessed:  true, // the token is returned once settlement completes
+	CodeRateLimited:       true,
+	CodeOverloaded:        true,
+	CodeInternal:          true,
+	CodeUnavailable:       true,
+	CodeSettlementPending: true, // the resubmitted payment is answered with the token
+}
+
+// errorResponse is the body of an error response.
+type errorResponse struct {
+	Code      ErrorCode `json:"code"`
+	Message   string    `json:"message"`
+	Retryable bool      `json:"retryable"`
+}
+
+func newErrorResponse(code ErrorCode, message string) errorResponse {
+	if message == "" {
+		message = errorMessages[code]
+	}
+	return errorResponse{Code: code, Message: message, Retryable: retryableCodes[code]}
+}
+
+// writeError writes a JSON error response. An empty message uses the code's
+// default one.
+func writeError(w http.ResponseWriter, status int, code ErrorCode, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(newErrorResponse(code, message))
+}
@@ -0,0 +1,422 @@
+package x402
+
+// Event bus: the gateway's payment, settlement and usage events published to
+// a NATS server or, through a Kafka REST proxy, to Kafka topics, for
+// operators who feed them into data pipelines of their own. Like the
+// Redis cache, the gateway speaks just enough of each protocol itself.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// eventBusBuffer bounds the events waiting to be published; further
+	// events are dropped while the bus is slow or unreachable.
+	eventBusBuffer = 4096
+	// eventBusBatch caps the events sent to the bus in one go.
+	eventBusBatch = 100
+	// eventBusTimeout bounds connecting to and publishing on the bus.
+	eventBusTimeout = 5 * time.Second
+	// eventBusRedial is how long a bus that could not be reached is left
+	// alone before it is tried again; events meanwhile are dropped.
+	eventBusRedial = 5 * time.Second
+)
+
+// EventBusConfig configures publishing to an event bus.
+type EventBusConfig struct {
+	// Kind is "nats" or "kafka".
+	Kind string
+	// URL is the NATS server, nats://host:4222 or tls://host:4222, or the
+	// Kafka REST proxy, http(s)://host:8082. A user and password in it are
+	// sent as the NATS user or as HTTP basic auth.
+	URL string
+	// Token, when set, is sent as the NATS auth token or as a bearer token
+	// to the REST proxy.
+	Token string
+	// TopicPrefix names the subject or topic of each event:
+	// "<prefix>.<event type>", e.g. "x402.payment_verified".
+	TopicPrefix string
+	// Events, when non-empty, are the only event types published. Otherwise
+	// every event but EventRequestRate is.
+	Events []string
+}
+
+// eventPublisher sends messages, JSON encoded, to a topic of a bus.
+type eventPublisher interface {
+	publish(ctx context.Context, topic string, msgs [][]byte) error
+	close() error
+}
+
+// EventBus publishes the events of an EventStream to a NATS server or Kafka.
+// Delivery is at most once: events the bus does not take are logged and
+// dropped. Each event keeps the ID the EventStream gave it, so consumers
+// reading it from more than one place, or through a bus that delivers twice,
+// can de-duplicate by it.
+type EventBus struct {
+	cfg    EventBusConfig
+	events map[string]bool
+	pub    eventPublisher
+}
+
+// NewEventBus validates cfg and returns a bus that publishes once Run.
+func NewEventBus(cfg EventBusConfig) (*EventBus, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("event bus URL %q is not a URL", cfg.URL)
+	}
+	var pub eventPublisher
+	switch cfg.Kind {
+	case "nats":
+		if u.Scheme != "nats" && u.Scheme != "tls" {
+			return nil, fmt.Errorf("NATS URL must start with nats:// or tls://")
+		}
+		pub = newNATSPublisher(u, cfg.Token)
+	case "kafka":
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("Kafka REST proxy URL must start with http:// or https://")
+		}
+		pub = newKafkaRESTPublisher(u, cfg.Token)
+	default:
+		return nil, fmt.Errorf("unknown event bus %q", cfg.Kind)
+	}
+	if cfg.TopicPrefix == "" {
+		cfg.TopicPrefix = "x402"
+	}
+	events := make(map[string]bool, len(cfg.Events))
+	for _, e := range cfg.Events {
+		if !webhookEventTypes[e] && e != EventCreditsUsed && e != EventRequestRate {
+			return nil, fmt.Errorf("unknown event %q", e)
+		}
+		events[e] = true
+	}
+	return &EventBus{cfg: cfg, events: events, pub: pub}, nil
+}
+
+// Run publishes the events of stream until it is closed, then closes the
+// connection to the bus.
+func (b *EventBus) Run(stream *EventStream) {
+	ch, _ := stream.Subscribe(eventBusBuffer)
+	defer b.pub.close()
+	for ev := range ch {
+		batch := make(map[string][][]byte)
+		var order []string
+		add := func(ev Event) {
+			if !b.wants(ev.Type) {
+				return
+			}
+			msg, err := json.Marshal(WebhookEvent{ID: ev.ID, Type: ev.Type, Time: ev.Time, Data: ev.Data})
+			if err != nil {
+				slog.Error("encoding bus event failed", "event", ev.Type, "err", err)
+				return
+			}
+			topic := b.cfg.TopicPrefix + "." + ev.Type
+			if batch[topic] == nil {
+				order = append(order, topic)
+			}
+			batch[topic] = append(batch[topic], msg)
+		}
+		add(ev)
+		// Take what else is waiting, so a busy gateway sends batches.
+	drain:
+		for n := 1; n < eventBusBatch; n++ {
+			select {
+			case ev, ok := <-ch:
+				if !ok {
+					break drain
+				}
+				add(ev)
+			default:
+				break drain
+			}
+		}
+		for _, topic := range order {
+			ctx, cancel := context.WithTimeout(context.Background(), eventBusTimeout)
+			if err := b.pub.publish(ctx, topic, batch[topic]); err != nil {
+				slog.Warn("event bus publish failed, events dropped", "topic", topic, "events", len(batch[topic]), "err", err)
+			}
+			cancel()
+		}
+	}
+}
+
+// wants reports whether events of eventType are published.
+func (b *EventBus) wants(eventType string) bool {
+	if len(b.events) > 0 {
+		return b.events[eventType]
+	}
+	return eventType != EventRequestRate
+}
+
+// natsPublisher publishes to a NATS server over one connection, dialled when
+// first needed and again after it breaks.
+type natsPublisher struct {
+	addr       string
+	tls        bool
+	host       string
+	user, pass string
+	token      string
+
+	mu       sync.Mutex
+	conn     *natsConn
+	failedAt time.Time
+}
+
+func newNATSPublisher(u *url.URL, token string) *natsPublisher {
+	p := &natsPublisher{
+		addr:  u.Host,
+		tls:   u.Scheme == "tls",
+		host:  u.Hostname(),
+		token: token,
+	}
+	if u.Port() == "" {
+		p.addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	if u.User != nil {
+		p.user = u.User.Username()
+		p.pass, _ = u.User.Password()
+	}
+	return p
+}
+
+func (p *natsPublisher) publish(ctx context.Context, subject string, msgs [][]byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn != nil && p.conn.broken() {
+		p.conn.Close()
+		p.conn = nil
+	}
+	if p.conn == nil {
+		if time.Since(p.failedAt) < eventBusRedial {
+			return errors.New("NATS server unreachable")
+		}
+		c, err := p.dial(ctx)
+		if err != nil {
+			p.failedAt = time.Now()
+			return err
+		}
+		p.conn = c
+	}
+	var b bytes.Buffer
+	for _, msg := range msgs {
+		fmt.Fprintf(&b, "PUB %s %d\r\n", subject, len(msg))
+		b.Write(msg)
+		b.WriteString("\r\n")
+	}
+	if err := p.conn.write(b.Bytes()); err != nil {
+		p.conn.Close()
+		p.conn = nil
+		return fmt.Errorf("nats publish: %w", err)
+	}
+	return nil
+}
+
+func (p *natsPublisher) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		return nil
+	}
+	err := p.conn.Close()
+	p.conn = nil
+	return err
+}
+
+// dial connects and logs in: the server greets with INFO, is sent CONNECT,
+// and answers the PING that follows with PONG, or with -ERR when the
+// credentials are refused.
+func (p *natsPublisher) dial(ctx context.Context) (*natsConn, error) {
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return nil, fmt.Errorf("nats connect: %w", err)
+	}
+	deadline, _ := ctx.Deadline()
+	_ = nc.SetDeadline(deadline)
+	r := bufio.NewReader(nc)
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		nc.Close()
+		return nil, fmt.Errorf("nats connect: no INFO from server: %v", err)
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	_ = json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info)
+	if p.tls || info.TLSRequired {
+		tc := tls.Client(nc, &tls.Config{ServerName: p.host, MinVersion: tls.VersionTLS12})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("nats tls: %w", err)
+		}
+		nc = tc
+		r = bufio.NewReader(nc)
+	}
+
+	connect := map[string]any{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "x402-gateway",
+		"lang":     "go",
+		"version":  "1",
+		"protocol": 1,
+	}
+	if p.user != "" {
+		connect["user"], connect["pass"] = p.user, p.pass
+	}
+	if p.token != "" {
+		connect["auth_token"] = p.token
+	}
+	body, _ := json.Marshal(connect)
+	if _, err := fmt.Fprintf(nc, "CONNECT %s\r\nPING\r\n", body); err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("nats connect: %w", err)
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("nats connect: %w", err)
+		}
+		line = strings.TrimSpace(line)
+		if line == "PONG" {
+			break
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			nc.Close()
+			return nil, fmt.Errorf("nats connect: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+	_ = nc.SetDeadline(time.Time{})
+
+	c := &natsConn{Conn: nc, done: make(chan struct{})}
+	go c.read(r)
+	return c, nil
+}
+
+// natsConn is a connection to a NATS server. Its reader answers the server's
+// PINGs, without which the server drops the connection, and notes the errors
+// the server reports.
+type natsConn struct {
+	net.Conn
+	wmu  sync.Mutex
+	done chan struct{} // closed when the connection has broken
+}
+
+func (c *natsConn) write(b []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_ = c.SetWriteDeadline(time.Now().Add(eventBusTimeout))
+	_, err := c.Conn.Write(b)
+	return err
+}
+
+func (c *natsConn) read(r *bufio.Reader) {
+	defer close(c.done)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PING":
+			if err := c.write([]byte("PONG\r\n")); err != nil {
+				return
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			slog.Warn("NATS server error", "err", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+func (c *natsConn) broken() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// kafkaRESTPublisher produces to Kafka through a REST proxy speaking the
+// Confluent v2 API (Confluent REST Proxy, Redpanda's HTTP proxy).
+type kafkaRESTPublisher struct {
+	base   string
+	user   *url.Userinfo
+	token  string
+	client *http.Client
+}
+
+func newKafkaRESTPublisher(u *url.URL, token string) *kafkaRESTPublisher {
+	base := *u
+	base.User = nil
+	return &kafkaRESTPublisher{
+		base:   strings.TrimRight(base.String(), "/"),
+		user:   u.User,
+		token:  token,
+		client: &http.Client{Timeout: eventBusTimeout},
+	}
+}
+
+func (p *kafkaRESTPublisher) publish(ctx context.Context, topic string, msgs [][]byte) error {
+	records := make([]map[string]json.RawMessage, len(msgs))
+	for i, msg := range msgs {
+		records[i] = map[string]json.RawMessage{"value": msg}
+	}
+	body, err := json.Marshal(map[string]any{"records": records})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.base+"/topics/"+url.PathEscape(topic), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	} else if p.user != nil {
+		pass, _ := p.user.Password()
+		req.SetBasicAuth(p.user.Username(), pass)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("kafka produce: %w", err)
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("kafka REST proxy returned %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	// The proxy answers 200 even when some records were not produced,
+	// reporting them with an error in their offset.
+	var result struct {
+		Offsets []struct {
+			Error string `json:"error"`
+		} `json:"offsets"`
+	}
+	if json.Unmarshal(msg, &result) == nil {
+		for _, o := range result.Offsets {
+			if o.Error != "" {
+				return fmt.Errorf("kafka produce: %s", o.Error)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *kafkaRESTPublisher) close() error { return nil }
@@ -0,0 +1,120 @@
+package x402
+
+import (
+	"maps"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Events published on the event stream besides the payment, settlement and
+// token events (see Webhooks).
+const (
+	// EventCreditsUsed reports the credits a request spent, net of refunds,
+	// or a WebSocket message or subscription.
+	EventCreditsUsed = "credits_used"
+	// EventRequestRate reports, every second, the requests the gateway
+	// took and the credits they spent in the second before.
+	EventRequestRate = "request_rate"
+)
+
+// Event is an event as subscribers to an EventStream receive it. ID is
+// given once, when the event is published, and is the same for every
+// subscriber.
+type Event struct {
+	ID   string         `json:"id"`
+	Type string         `json:"type"`
+	Time time.Time      `json:"time"`
+	Data map[string]any `json:"data"`
+}
+
+// EventStream fans the gateway's events out to live subscribers, such as an
+// operator dashboard, as they happen. A subscriber that falls behind misses
+// events rather than holding up the requests that publish them.
+type EventStream struct {
+	mu     sync.Mutex
+	subs   map[chan Event]struct{}
+	closed bool
+
+	requests atomic.Int64
+	credits  atomic.Int64
+}
+
+// NewEventStream returns an event stream, publishing EventRequestRate every
+// second while anyone is subscribed.
+func NewEventStream() *EventStream {
+	s := &EventStream{subs: make(map[chan Event]struct{})}
+	go s.reportRate()
+	return s
+}
+
+// Subscribe returns a channel receiving every event published from now on,
+// holding up to buffer events the subscriber has yet to read, and the func
+// that unsubscribes. The channel is closed when the stream is.
+func (s *EventStream) Subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	s.subs[ch] = struct{}{}
+	return ch, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, ok := s.subs[ch]; ok {
+			delete(s.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Publish sends an event to every subscriber with room for it. data is
+// copied, so the caller may go on changing it.
+func (s *EventStream) Publish(eventType string, data map[string]any) {
+	if credits, ok := data["credits"].(int64); ok && eventType == EventCreditsUsed {
+		s.credits.Add(credits)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.subs) == 0 {
+		return
+	}
+	ev := Event{ID: uuid.New().String(), Type: eventType, Time: time.Now().UTC(), Data: maps.Clone(data)}
+	for ch := range s.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// countRequest counts a request toward the request rate.
+func (s *EventStream) countRequest() {
+	s.requests.Add(1)
+}
+
+// Close ends every subscription, closing its channel, and refuses new ones.
+func (s *EventStream) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for ch := range s.subs {
+		delete(s.subs, ch)
+		close(ch)
+	}
+}
+
+// reportRate publishes the request rate every second.
+func (s *EventStream) reportRate() {
+	for range time.Tick(time.Second) {
+		requests, credits := s.requests.Swap(0), s.credits.Swap(0)
+		s.Publish(EventRequestRate, map[string]any{
+			"requestsPerSecond": requests,
+			"creditsPerSecond":  credits,
+		})
+	}
+}
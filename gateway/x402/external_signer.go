@@ -0,0 +1,95 @@
+package x402
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// externalSigner signs through a remote signer speaking eth_signTransaction,
+// such as Clef or Web3Signer, which holds the key.
+type externalSigner struct {
+	address common.Address
+	client  *rpc.Client
+}
+
+// NewExternalSigner returns a Signer for address whose transactions are
+// signed by the remote signer at url (http(s), ws(s) or an IPC path). Clef
+// asks its operator to approve each transaction unless a rule file approves
+// settlements automatically.
+func NewExternalSigner(ctx context.Context, url, address string) (Signer, error) {
+	if !common.IsHexAddress(address) {
+		return nil, fmt.Errorf("invalid external signer address %q", address)
+	}
+	client, err := rpc.DialContext(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("dialing external signer: %w", err)
+	}
+	return &externalSigner{address: common.HexToAddress(address), client: client}, nil
+}
+
+func (s *externalSigner) Address() common.Address { return s.address }
+
+func (s *externalSigner) SignTx(ctx context.Context, tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	args := map[string]any{
+		"from":    s.address,
+		"to":      tx.To(),
+		"gas":     hexutil.Uint64(tx.Gas()),
+		"value":   (*hexutil.Big)(tx.Value()),
+		"nonce":   hexutil.Uint64(tx.Nonce()),
+		"data":    hexutil.Bytes(tx.Data()),
+		"chainId": (*hexutil.Big)(chainID),
+	}
+	if tx.Type() == types.LegacyTxType {
+		args["gasPrice"] = (*hexutil.Big)(tx.GasPrice())
+	} else {
+		args["maxFeePerGas"] = (*hexutil.Big)(tx.GasFeeCap())
+		args["maxPriorityFeePerGas"] = (*hexutil.Big)(tx.GasTipCap())
+	}
+	var result json.RawMessage
+	if err := s.client.CallContext(ctx, &result, "eth_signTransaction", args); err != nil {
+		return nil, fmt.Errorf("external signer: %w", err)
+	}
+	signed, err := decodeSignedTx(result)
+	if err != nil {
+		return nil, fmt.Errorf("external signer: %w", err)
+	}
+
+	// The signer may have changed the transaction before signing it (Clef
+	// lets its operator edit it); only the one asked for is sent.
+	signer := types.LatestSignerForChainID(chainID)
+	if signer.Hash(signed) != signer.Hash(tx) {
+		return nil, errors.New("external signer: signed a different transaction")
+	}
+	if from, err := types.Sender(signer, signed); err != nil || from != s.address {
+		return nil, fmt.Errorf("external signer: signature is not from %s", s.address.Hex())
+	}
+	return signed, nil
+}
+
+// decodeSignedTx reads an eth_signTransaction result: the raw transaction
+// (Web3Signer) or an object carrying it (Clef, geth).
+func decodeSignedTx(result json.RawMessage) (*types.Transaction, error) {
+	var raw hexutil.Bytes
+	if err := json.Unmarshal(result, &raw); err != nil {
+		var obj struct {
+			Raw hexutil.Bytes `json:"raw"`
+		}
+		if err := json.Unmarshal(result, &obj); err != nil || len(obj.Raw) == 0 {
+			return nil, errors.New("unrecognized eth_signTransaction result")
+		}
+		raw = obj.Raw
+	}
+	tx := new(types.Transaction)
+	if err := tx.UnmarshalBinary(raw); err != nil {
+		return nil, fmt.Errorf("decoding signed transaction: %w", err)
+	}
+	return tx, nil
+}
@@ -3,11 +3,16 @@ package x402
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"os"
+	"strings"
 	"time"
 )
 
@@ -17,23 +22,164 @@ import (
 // gating entirely (plain proxy mode).
 type FacilitatorClient interface {
 	Verify(ctx context.Context, payloadBytes, requirementsBytes []byte) (*VerifyResult, error)
-	Settle(ctx context.Context, payloadBytes, requirementsBytes []byte) error
+	Settle(ctx context.Context, payloadBytes, requirementsBytes []byte) (*SettleResult, error)
+}
+
+// ConfirmingFacilitator is a FacilitatorClient that can also wait for its
+// settlement transaction to be confirmed, for chains where a mined payment
+// may still be reorged away.
+type ConfirmingFacilitator interface {
+	FacilitatorClient
+	// SettleConfirmed settles like Settle and returns once the settlement
+	// transaction has succeeded with the given number of confirmations.
+	SettleConfirmed(ctx context.Context, payloadBytes, requirementsBytes []byte, confirmations uint64) (*SettleResult, error)
+}
+
+// ErrSettlementReverted is returned when a settlement transaction was mined
+// but reverted, so the payment was not made.
+var ErrSettlementReverted = errors.New("settlement transaction reverted")
+
+// ReceiptFacilitator is a FacilitatorClient whose settlement transactions can
+// be followed until they are mined.
+type ReceiptFacilitator interface {
+	FacilitatorClient
+	// WaitMined blocks until the settlement transaction tx, or a replacement
+	// sent for it, has been mined and returns the hash of the one that
+	// landed. It returns an error wrapping ErrSettlementReverted if that
+	// transaction reverted.
+	WaitMined(ctx context.Context, tx string) (string, error)
+	// Confirmations returns how many blocks include or build on the block
+	// that mined tx: zero while it is pending.
+	Confirmations(ctx context.Context, tx string) (uint64, error)
+}
+
+// ReorgFacilitator is a ReceiptFacilitator that can also report the chain's
+// height, so a settlement reorged out of the chain can be given a number of
+// blocks to be mined again.
+type ReorgFacilitator interface {
+	ReceiptFacilitator
+	// BlockNumber returns the number of the chain's latest block.
+	BlockNumber(ctx context.Context) (uint64, error)
+	// FinalityDepth returns the confirmations after which a transaction can
+	// no longer be reorged out of the chain.
+	FinalityDepth() uint64
+}
+
+// BatchingFacilitator is a FacilitatorClient that can also settle several
+// payments in one transaction, saving gas when payment volume is high.
+type BatchingFacilitator interface {
+	FacilitatorClient
+	// Batchable reports whether payments made against requirementsBytes can
+	// be settled by SettleBatch.
+	Batchable(requirementsBytes []byte) bool
+	// SettleBatch settles the payments together and returns each one's
+	// result, in order. An error means the outcome of every payment is
+	// unknown; settling them again is safe.
+	SettleBatch(ctx context.Context, payments []BatchPayment) ([]BatchResult, error)
+}
+
+// BatchPayment is a payment to settle in a batch.
+type BatchPayment struct {
+	Payload      []byte
+	Requirements []byte
+}
+
+// BatchResult is the outcome of one payment in a batch.
+type BatchResult struct {
+	// Transaction is the hash of the transaction that settled the payment.
+	// It is always set for a payment without Err.
+	Transaction string
+	// Err is why the payment was not settled.
+	Err error
+}
+
+// ErrFacilitatorUnavailable is returned by RemoteFacilitator when the
+// facilitator cannot be reached or answers with a server error, so the
+// payment's validity is unknown rather than refused.
+var ErrFacilitatorUnavailable = errors.New("facilitator unavailable")
+
+// Default RemoteFacilitatorConfig timeouts.
+const (
+	defaultVerifyTimeout = 10 * time.Second
+	defaultSettleTimeout = 30 * time.Second
+)
+
+// verifyRetryBase is the delay before retrying a verify call, doubled for
+// each further retry.
+const verifyRetryBase = 250 * time.Millisecond
+
+// RemoteFacilitatorConfig tunes how a RemoteFacilitator calls its facilitator.
+type RemoteFacilitatorConfig struct {
+	// VerifyTimeout bounds each verify call; defaults to 10s.
+	VerifyTimeout time.Duration
+	// SettleTimeout bounds the settle call, which waits for the facilitator
+	// to submit the transaction; defaults to 30s.
+	SettleTimeout time.Duration
+	// VerifyRetries is how often a verify call the facilitator failed to
+	// answer is retried, with exponential backoff. Verify changes nothing, so
+	// retrying it is safe; settle is never retried.
+	VerifyRetries int
+	// TLS, when set, configures the connections to the facilitator, such as
+	// a client certificate for mutual TLS or a private CA to trust; see
+	// LoadTLSConfig.
+	TLS *tls.Config
+}
+
+// LoadTLSConfig builds the TLS configuration for a facilitator behind mutual
+// TLS or with a certificate from a private CA. certFile and keyFile are the
+// PEM client certificate, chain included, and its key, both set or both
+// empty. caFile, when set, is a PEM bundle of the CAs trusted to sign the
+// facilitator's certificate in place of the system roots.
+func LoadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA bundle: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA bundle %s holds no PEM certificates", caFile)
+		}
+	}
+	return cfg, nil
 }
 
 // RemoteFacilitator talks to an x402 facilitator REST API.
 // It verifies and settles x402 payments without requiring the full x402 SDK.
+// While the facilitator is down its circuit breaker fails calls at once.
 type RemoteFacilitator struct {
-	url    string
-	client *http.Client
+	url     string
+	client  *http.Client
+	cfg     RemoteFacilitatorConfig
+	breaker circuitBreaker
 }
 
 // NewFacilitator creates a RemoteFacilitator that calls facilitatorURL.
-func NewFacilitator(facilitatorURL string) *RemoteFacilitator {
+func NewFacilitator(facilitatorURL string, cfg RemoteFacilitatorConfig) *RemoteFacilitator {
+	if cfg.VerifyTimeout <= 0 {
+		cfg.VerifyTimeout = defaultVerifyTimeout
+	}
+	if cfg.SettleTimeout <= 0 {
+		cfg.SettleTimeout = defaultSettleTimeout
+	}
+	client := &http.Client{}
+	if cfg.TLS != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = cfg.TLS
+		client.Transport = transport
+	}
 	return &RemoteFacilitator{
-		url: facilitatorURL,
-		client: &http.Client{
-			Timeout: 30 * time.Second,
-		},
+		url:    facilitatorURL,
+		client: client,
+		cfg:    cfg,
 	}
 }
 
@@ -43,12 +189,26 @@ type VerifyResult struct {
 	Payer string
 }
 
+// SettleResult holds the outcome of a settle call.
+type SettleResult struct {
+	// Transaction is the hash of the settlement transaction, so the payer can
+	// check the payment on-chain. Empty if the facilitator did not report it.
+	Transaction string
+}
+
 // Verify checks that the payment payload is valid against the requirements.
 //
 // payloadBytes is the raw JSON unmarshalled from the client's
-// Payment-Signature header (after base64-decoding).
+// Payment-Signature or X-PAYMENT header (after base64-decoding).
 // requirementsBytes is the JSON for a PaymentRequirementsV1 struct.
 func (f *RemoteFacilitator) Verify(ctx context.Context, payloadBytes, requirementsBytes []byte) (*VerifyResult, error) {
+	start := time.Now()
+	result, err := f.verify(ctx, payloadBytes, requirementsBytes)
+	observeCall("remote", "verify", requirementsBytes, start, err)
+	return result, err
+}
+
+func (f *RemoteFacilitator) verify(ctx context.Context, payloadBytes, requirementsBytes []byte) (*VerifyResult, error) {
 	body, err := f.buildBody(payloadBytes, requirementsBytes)
 	if err != nil {
 		return nil, err
@@ -60,7 +220,7 @@ func (f *RemoteFacilitator) Verify(ctx context.Context, payloadBytes, requiremen
 		InvalidMessage string `json:"invalidMessage"`
 		Payer          string `json:"payer"`
 	}
-	if err := f.post(ctx, "/verify", body, &resp); err != nil {
+	if err := f.verifyWithRetries(ctx, body, &resp); err != nil {
 		return nil, fmt.Errorf("facilitator verify: %w", err)
 	}
 	if !resp.IsValid {
@@ -68,34 +228,91 @@ func (f *RemoteFacilitator) Verify(ctx context.Context, payloadBytes, requiremen
 		if resp.InvalidMessage != "" {
 			reason += ": " + resp.InvalidMessage
 		}
+		if resp.InvalidReason == "insufficient_funds" {
+			return nil, fmt.Errorf("payment invalid: %w: %s", ErrInsufficientFunds, resp.InvalidMessage)
+		}
 		return nil, fmt.Errorf("payment invalid: %s", reason)
 	}
 	return &VerifyResult{Payer: resp.Payer}, nil
 }
 
 // Settle finalises the on-chain payment. Call after a successful Verify.
-func (f *RemoteFacilitator) Settle(ctx context.Context, payloadBytes, requirementsBytes []byte) error {
+func (f *RemoteFacilitator) Settle(ctx context.Context, payloadBytes, requirementsBytes []byte) (*SettleResult, error) {
+	start := time.Now()
+	result, err := f.settle(ctx, payloadBytes, requirementsBytes)
+	observeCall("remote", "settle", requirementsBytes, start, err)
+	return result, err
+}
+
+func (f *RemoteFacilitator) settle(ctx context.Context, payloadBytes, requirementsBytes []byte) (*SettleResult, error) {
 	body, err := f.buildBody(payloadBytes, requirementsBytes)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var resp struct {
 		Success      bool   `json:"success"`
 		ErrorReason  string `json:"errorReason"`
 		ErrorMessage string `json:"errorMessage"`
+		Transaction  string `json:"transaction"`
 	}
-	if err := f.post(ctx, "/settle", body, &resp); err != nil {
-		return fmt.Errorf("facilitator settle: %w", err)
+	if err := f.post(ctx, "/settle", f.cfg.SettleTimeout, body, &resp); err != nil {
+		return nil, fmt.Errorf("facilitator settle: %w", err)
 	}
 	if !resp.Success {
 		reason := resp.ErrorReason
 		if resp.ErrorMessage != "" {
 			reason += ": " + resp.ErrorMessage
 		}
-		return fmt.Errorf("settlement failed: %s", reason)
+		return nil, fmt.Errorf("settlement failed: %s", reason)
 	}
-	return nil
+	return &SettleResult{Transaction: resp.Transaction}, nil
+}
+
+// SupportedKind is a kind of payment a facilitator verifies and settles, as
+// listed by its supported endpoint.
+type SupportedKind struct {
+	X402Version int            `json:"x402Version"`
+	Scheme      string         `json:"scheme"`
+	Network     string         `json:"network"`
+	Extra       map[string]any `json:"extra,omitempty"`
+}
+
+// Supported fetches the kinds of payments the facilitator settles from its
+// supported endpoint.
+func (f *RemoteFacilitator) Supported(ctx context.Context) ([]SupportedKind, error) {
+	var resp struct {
+		Kinds []SupportedKind `json:"kinds"`
+	}
+	if err := f.do(ctx, "/supported", f.cfg.VerifyTimeout, nil, &resp); err != nil {
+		return nil, fmt.Errorf("facilitator supported: %w", err)
+	}
+	return resp.Kinds, nil
+}
+
+// ErrKindUnsupported is returned by CheckSupported when the facilitator does
+// not list a payment kind the gateway offers.
+var ErrKindUnsupported = errors.New("payment kind not supported by the facilitator")
+
+// CheckSupported checks that the facilitator settles x402 version 2 payments
+// of scheme on network, returning an error wrapping ErrKindUnsupported if it
+// does not, or wrapping ErrFacilitatorUnavailable if it cannot be asked. The
+// supported endpoint does not list assets, so those cannot be checked.
+func (f *RemoteFacilitator) CheckSupported(ctx context.Context, network, scheme string) error {
+	kinds, err := f.Supported(ctx)
+	if err != nil {
+		return err
+	}
+	for _, k := range kinds {
+		if k.X402Version == 2 && k.Network == network && k.Scheme == scheme {
+			return nil
+		}
+	}
+	listed := make([]string, len(kinds))
+	for i, k := range kinds {
+		listed[i] = fmt.Sprintf("v%d %s %s", k.X402Version, k.Scheme, k.Network)
+	}
+	return fmt.Errorf("%w: v2 %s %s (facilitator lists %s)", ErrKindUnsupported, scheme, network, strings.Join(listed, ", "))
 }
 
 // buildBody constructs the JSON request body for /verify and /settle.
@@ -125,31 +342,75 @@ func (f *RemoteFacilitator) buildBody(payloadBytes, requirementsBytes []byte) ([
 	return json.Marshal(body)
 }
 
+// verifyWithRetries posts a verify request, retrying with exponential
+// backoff while the facilitator fails to answer it.
+func (f *RemoteFacilitator) verifyWithRetries(ctx context.Context, body []byte, dst interface{}) error {
+	for attempt := 0; ; attempt++ {
+		err := f.post(ctx, "/verify", f.cfg.VerifyTimeout, body, dst)
+		if !errors.Is(err, ErrFacilitatorUnavailable) || errors.Is(err, errCircuitOpen) || attempt >= f.cfg.VerifyRetries {
+			return err
+		}
+		delay := verifyRetryBase << attempt
+		slog.Warn("facilitator verify failed, retrying", "attempt", attempt+1, "retry_in", delay, "err", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
 // post sends a POST request to path (relative to f.url) with the given JSON
-// body, and JSON-decodes the response into dst.
-func (f *RemoteFacilitator) post(ctx context.Context, path string, body []byte, dst interface{}) error {
+// body, waiting at most timeout, and JSON-decodes the response into dst.
+// Failures to get an answer feed the circuit breaker.
+func (f *RemoteFacilitator) post(ctx context.Context, path string, timeout time.Duration, body []byte, dst interface{}) error {
+	if !f.breaker.allow() {
+		return fmt.Errorf("%w: %w", ErrFacilitatorUnavailable, errCircuitOpen)
+	}
+	err := f.do(ctx, path, timeout, body, dst)
+	if ctx.Err() != nil {
+		f.breaker.abandon()
+	} else {
+		f.breaker.record(!errors.Is(err, ErrFacilitatorUnavailable))
+	}
+	return err
+}
+
+// do makes a request to path, a POST of body or a GET if body is nil.
+func (f *RemoteFacilitator) do(ctx context.Context, path string, timeout time.Duration, body []byte, dst interface{}) error {
 	url := f.url + path
 	slog.Debug("facilitator request", "url", url, "body", string(body))
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	method := http.MethodPost
+	if body == nil {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Content-Type", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
 
 	resp, err := f.client.Do(req)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %w", ErrFacilitatorUnavailable, err)
 	}
 	defer resp.Body.Close()
 
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("reading response: %w", err)
+		return fmt.Errorf("%w: reading response: %w", ErrFacilitatorUnavailable, err)
 	}
 
 	slog.Debug("facilitator response", "url", url, "status", resp.StatusCode, "body", string(respBody))
 
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("%w: facilitator returned %d: %s", ErrFacilitatorUnavailable, resp.StatusCode, respBody)
+	}
 	if resp.StatusCode >= 400 {
 		return fmt.Errorf("facilitator returned %d: %s", resp.StatusCode, respBody)
 	}
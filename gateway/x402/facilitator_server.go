@@ -0,0 +1,222 @@
+package x402
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// FacilitatorServerPath is where the facilitator API is served: its verify,
+// settle and supported endpoints sit under it, so other x402 services use
+// the gateway's URL plus this path as their facilitator URL.
+const FacilitatorServerPath = "/facilitator/"
+
+// facilitatorSchemes are the payment schemes the facilitator API settles.
+var facilitatorSchemes = []string{"exact", SchemePermit2, SchemeUpto}
+
+// FacilitatorServerConfig configures the facilitator API.
+type FacilitatorServerConfig struct {
+	// Facilitator verifies and settles the payments, typically the
+	// gateway's LocalFacilitator.
+	Facilitator FacilitatorClient
+	// Network is the CAIP-2 network Facilitator settles on, e.g.
+	// "eip155:84532". Payments on any other network are refused.
+	Network string
+	// Signers are the addresses settlement transactions are sent from,
+	// listed by the supported endpoint. The first is the Permit2 spender.
+	Signers []string
+	// Token, when set, is the shared secret callers present as
+	// "Authorization: Bearer <token>". Without it anyone who can reach the
+	// API can have the relayers pay gas for their payments.
+	Token string
+}
+
+// FacilitatorServer serves the x402 facilitator REST API, so other x402
+// services can verify and settle their payments through this gateway:
+//
+//	POST <FacilitatorServerPath>verify    {x402Version, paymentPayload, paymentRequirements}
+//	POST <FacilitatorServerPath>settle    the same; the payment is verified again first
+//	GET  <FacilitatorServerPath>supported the schemes and network it settles
+//
+// Only x402 version 2 payments are accepted. A refused payment is answered
+// 200 with isValid or success false and the reason, as x402 facilitators do.
+type FacilitatorServer struct {
+	cfg FacilitatorServerConfig
+	mux *http.ServeMux
+}
+
+// NewFacilitatorServer returns the facilitator API handler.
+func NewFacilitatorServer(cfg FacilitatorServerConfig) *FacilitatorServer {
+	s := &FacilitatorServer{cfg: cfg, mux: http.NewServeMux()}
+	s.mux.HandleFunc("POST "+FacilitatorServerPath+"verify", s.verify)
+	s.mux.HandleFunc("POST "+FacilitatorServerPath+"settle", s.settle)
+	s.mux.HandleFunc("GET "+FacilitatorServerPath+"supported", s.supported)
+	return s
+}
+
+// ServeHTTP authenticates the request, when a token is configured, and
+// dispatches it to the matching endpoint.
+func (s *FacilitatorServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.Token != "" {
+		got, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(s.cfg.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="facilitator"`)
+			writeError(w, http.StatusUnauthorized, CodeUnauthorized, "")
+			return
+		}
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// facilitatorRequest is the body of a verify or settle request.
+type facilitatorRequest struct {
+	X402Version         int             `json:"x402Version"`
+	PaymentPayload      json.RawMessage `json:"paymentPayload"`
+	PaymentRequirements json.RawMessage `json:"paymentRequirements"`
+}
+
+type verifyResponse struct {
+	IsValid        bool   `json:"isValid"`
+	InvalidReason  string `json:"invalidReason,omitempty"`
+	InvalidMessage string `json:"invalidMessage,omitempty"`
+	Payer          string `json:"payer,omitempty"`
+}
+
+type settleResponse struct {
+	Success      bool   `json:"success"`
+	ErrorReason  string `json:"errorReason,omitempty"`
+	ErrorMessage string `json:"errorMessage,omitempty"`
+	Payer        string `json:"payer,omitempty"`
+	Transaction  string `json:"transaction"`
+	Network      string `json:"network"`
+}
+
+// verify handles POST verify.
+func (s *FacilitatorServer) verify(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.readRequest(w, r)
+	if !ok {
+		return
+	}
+	if reason, message := s.check(req); reason != "" {
+		writeJSON(w, verifyResponse{InvalidReason: reason, InvalidMessage: message})
+		return
+	}
+	result, err := s.cfg.Facilitator.Verify(r.Context(), req.PaymentPayload, req.PaymentRequirements)
+	if err != nil {
+		slog.Info("facilitator API: payment invalid", "err", err)
+		writeJSON(w, verifyResponse{InvalidReason: invalidReason(err), InvalidMessage: err.Error()})
+		return
+	}
+	writeJSON(w, verifyResponse{IsValid: true, Payer: result.Payer})
+}
+
+// settle handles POST settle. The payment is verified first: settlement
+// alone does not check the authorization's signature or the payer's funds.
+func (s *FacilitatorServer) settle(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.readRequest(w, r)
+	if !ok {
+		return
+	}
+	resp := settleResponse{Network: s.cfg.Network}
+	if reason, message := s.check(req); reason != "" {
+		resp.ErrorReason, resp.ErrorMessage = reason, message
+		writeJSON(w, resp)
+		return
+	}
+	result, err := s.cfg.Facilitator.Verify(r.Context(), req.PaymentPayload, req.PaymentRequirements)
+	if err != nil {
+		slog.Info("facilitator API: payment invalid", "err", err)
+		resp.ErrorReason, resp.ErrorMessage = invalidReason(err), err.Error()
+		writeJSON(w, resp)
+		return
+	}
+	resp.Payer = result.Payer
+	settled, err := s.cfg.Facilitator.Settle(r.Context(), req.PaymentPayload, req.PaymentRequirements)
+	if err != nil {
+		slog.Warn("facilitator API: settlement failed", "payer", result.Payer, "err", err)
+		resp.ErrorReason, resp.ErrorMessage = "unexpected_settle_error", err.Error()
+		if errors.Is(err, ErrSettlementWouldRevert) {
+			resp.ErrorReason = "invalid_transaction_state"
+		}
+		writeJSON(w, resp)
+		return
+	}
+	slog.Info("facilitator API: payment settled", "payer", result.Payer, "tx", settled.Transaction)
+	resp.Success, resp.Transaction = true, settled.Transaction
+	writeJSON(w, resp)
+}
+
+// supported handles GET supported.
+func (s *FacilitatorServer) supported(w http.ResponseWriter, r *http.Request) {
+	kinds := make([]SupportedKind, len(facilitatorSchemes))
+	for i, scheme := range facilitatorSchemes {
+		kinds[i] = SupportedKind{X402Version: 2, Scheme: scheme, Network: s.cfg.Network}
+	}
+	writeJSON(w, map[string]any{
+		"kinds":      kinds,
+		"extensions": []string{},
+		"signers":    map[string][]string{s.cfg.Network: s.cfg.Signers},
+	})
+}
+
+// readRequest decodes a verify or settle request, answering 400 if it is
+// malformed and 413 if it is over 1 MiB.
+func (s *FacilitatorServer) readRequest(w http.ResponseWriter, r *http.Request) (*facilitatorRequest, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		if tooLarge := (*http.MaxBytesError)(nil); errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, CodeRequestTooLarge, "")
+			return nil, false
+		}
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "")
+		return nil, false
+	}
+	var req facilitatorRequest
+	if err := json.Unmarshal(body, &req); err != nil || len(req.PaymentPayload) == 0 || len(req.PaymentRequirements) == 0 {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "body must be {x402Version, paymentPayload, paymentRequirements}")
+		return nil, false
+	}
+	return &req, true
+}
+
+// check returns why the facilitator cannot take the payment, as an x402
+// reason and message, or "" if it can.
+func (s *FacilitatorServer) check(req *facilitatorRequest) (reason, message string) {
+	if req.X402Version != 2 {
+		return "invalid_x402_version", "only x402 version 2 is supported"
+	}
+	requirements, err := parseRequirements(req.PaymentRequirements)
+	if err != nil {
+		return "invalid_payment_requirements", err.Error()
+	}
+	if requirements.Network != s.cfg.Network {
+		return "invalid_network", "payments are settled on " + s.cfg.Network
+	}
+	for _, scheme := range facilitatorSchemes {
+		if requirements.Scheme == scheme {
+			return "", ""
+		}
+	}
+	return "invalid_scheme", "unsupported scheme " + requirements.Scheme
+}
+
+// invalidReason maps a verification error to the x402 reason reported for it.
+func invalidReason(err error) string {
+	switch {
+	case errors.Is(err, ErrInsufficientFunds):
+		return "insufficient_funds"
+	case errors.Is(err, ErrSettlementWouldRevert):
+		return "invalid_transaction_state"
+	default:
+		return "invalid_payload"
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,83 @@
+package x402
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// failoverCooldown is how long a FailoverFacilitator sends every payment to
+// its fallback after the primary was found unavailable, before trying the
+// primary again. It spares payments the primary's timeout while it is down.
+const failoverCooldown = 30 * time.Second
+
+// FailoverFacilitator verifies and settles payments through a primary
+// facilitator, typically a remote one, and through a fallback, typically the
+// local facilitator, whenever the primary is unavailable. A payment the
+// primary rejects is not retried with the fallback.
+//
+// Settling with the fallback after the primary failed mid-settlement cannot
+// pay twice: the authorization's nonce is spent by whichever settlement lands
+// first, and the other reverts.
+type FailoverFacilitator struct {
+	primary  FacilitatorClient
+	fallback FacilitatorClient
+
+	// downUntil is when, in Unix nanoseconds, the primary is next tried
+	// after failing; zero while it is up.
+	downUntil atomic.Int64
+}
+
+// NewFailoverFacilitator returns a FacilitatorClient using primary, or
+// fallback when primary fails with an error wrapping
+// ErrFacilitatorUnavailable.
+func NewFailoverFacilitator(primary, fallback FacilitatorClient) *FailoverFacilitator {
+	return &FailoverFacilitator{primary: primary, fallback: fallback}
+}
+
+// Verify verifies the payment with the primary facilitator, or the fallback
+// if the primary is unavailable.
+func (f *FailoverFacilitator) Verify(ctx context.Context, payloadBytes, requirementsBytes []byte) (*VerifyResult, error) {
+	if f.usePrimary() {
+		result, err := f.primary.Verify(ctx, payloadBytes, requirementsBytes)
+		if !f.failover(ctx, "verify", err) {
+			return result, err
+		}
+	}
+	return f.fallback.Verify(ctx, payloadBytes, requirementsBytes)
+}
+
+// Settle settles the payment with the primary facilitator, or the fallback
+// if the primary is unavailable.
+func (f *FailoverFacilitator) Settle(ctx context.Context, payloadBytes, requirementsBytes []byte) (*SettleResult, error) {
+	if f.usePrimary() {
+		result, err := f.primary.Settle(ctx, payloadBytes, requirementsBytes)
+		if !f.failover(ctx, "settle", err) {
+			return result, err
+		}
+	}
+	return f.fallback.Settle(ctx, payloadBytes, requirementsBytes)
+}
+
+// usePrimary reports whether the primary is to be tried: it has not failed,
+// or failed more than failoverCooldown ago.
+func (f *FailoverFacilitator) usePrimary() bool {
+	until := f.downUntil.Load()
+	return until == 0 || time.Now().UnixNano() >= until
+}
+
+// failover reports whether the primary's err calls for the fallback, marking
+// the primary down if so, or back up once it answers again.
+func (f *FailoverFacilitator) failover(ctx context.Context, op string, err error) bool {
+	if !errors.Is(err, ErrFacilitatorUnavailable) || ctx.Err() != nil {
+		if f.downUntil.Swap(0) != 0 {
+			slog.Info("primary facilitator recovered")
+		}
+		return false
+	}
+	f.downUntil.Store(time.Now().Add(failoverCooldown).UnixNano())
+	slog.Warn("primary facilitator unavailable, failing over", "op", op, "retry_after", failoverCooldown, "err", err)
+	return true
+}
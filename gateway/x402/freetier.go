@@ -0,0 +1,96 @@
+package x402
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ErrFreeTierExhausted is returned by a FreeTierStore when a client has no
+// free requests left today.
+var ErrFreeTierExhausted = errors.New("free tier exhausted")
+
+// freeRequestsRemainingHeader tells a client on the free tier how many free
+// requests it has left today.
+const freeRequestsRemainingHeader = "X-Free-Requests-Remaining"
+
+// FreeTierStore counts the free requests each client has used per day.
+// Implementations must be safe for concurrent use; shared backends make the
+// allowance hold across gateway replicas.
+type FreeTierStore interface {
+	// UseFreeRequests atomically counts n more requests under key (a client
+	// and day) and returns how many of limit are left. Returns
+	// ErrFreeTierExhausted, counting nothing, when fewer than n are left. The
+	// count is kept at least until expiresAt.
+	UseFreeRequests(key string, n, limit int64, expiresAt time.Time) (remaining int64, err error)
+
+	// PruneFreeRequests deletes counts that expired before now and returns
+	// how many were removed.
+	PruneFreeRequests(now time.Time) (int, error)
+}
+
+// serveFreeTier proxies a request without credentials on its client's daily
+// allowance of free requests, charged like credits. It returns nil once the
+// request is answered, served or shed, ErrFreeTierExhausted when the
+// allowance is used up, or the store's error; the caller then answers with
+// 402.
+func (m *Middleware) serveFreeTier(w http.ResponseWriter, r *http.Request) error {
+	client := clientKey(r)
+	if client == "" {
+		return errors.New("client address unknown")
+	}
+	bodyBytes, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+	calls, _ := rpcCalls(bodyBytes)
+	cost := m.cost(r, calls)
+	release, ok := m.admit(w, "")
+	if !ok {
+		return nil
+	}
+	defer release()
+
+	now := time.Now().UTC()
+	day := now.Format(time.DateOnly)
+	midnight := now.Truncate(24 * time.Hour).Add(24 * time.Hour)
+	remaining, err := m.cfg.FreeTier.UseFreeRequests(client+"|"+day, cost, m.cfg.FreeRequestsPerDay, midnight)
+	if err != nil {
+		if !errors.Is(err, ErrFreeTierExhausted) {
+			slog.Error("free tier lookup failed", "client", client, "err", err)
+		}
+		return err
+	}
+
+	slog.Debug("free tier request", "client", client, "cost", cost, "remaining", remaining)
+	w.Header().Set(freeRequestsRemainingHeader, strconv.FormatInt(remaining, 10))
+	// Verified answers are for paying clients.
+	r.Header.Del(rpcVerifyHeader)
+	m.next(r).ServeHTTP(w, r)
+	return nil
+}
+
+// clientKey identifies the client behind r for the free tier: its IP address,
+// with IPv6 addresses reduced to their /64 so a client cannot rotate through
+// its own subnet for more free requests.
+func clientKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	if ip.To4() == nil {
+		return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+	}
+	return ip.String()
+}
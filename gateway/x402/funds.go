@@ -0,0 +1,86 @@
+package x402
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// ErrInsufficientFunds is returned by Verify when the payer's token balance,
+// or its Permit2 allowance, is below the payment amount: settling would
+// revert and burn the relayer's gas.
+var ErrInsufficientFunds = errors.New("insufficient funds")
+
+var (
+	// balanceOfSig is the selector for ERC20.balanceOf(address).
+	balanceOfSig = crypto.Keccak256([]byte("balanceOf(address)"))[:4]
+	// allowanceSig is the selector for ERC20.allowance(address,address).
+	allowanceSig = crypto.Keccak256([]byte("allowance(address,address)"))[:4]
+)
+
+// fundsCheckTimeout bounds the balance and allowance reads during Verify.
+const fundsCheckTimeout = 5 * time.Second
+
+// checkFunds returns ErrInsufficientFunds unless owner holds at least amount
+// of token and, when spender is non-nil, has approved spender for at least as
+// much. Failing to read the chain is logged and lets the payment through:
+// verification failing should mean the payment is bad, and settlement meets
+// the same RPC trouble without spending gas.
+func (f *LocalFacilitator) checkFunds(ctx context.Context, token, owner common.Address, amount *big.Int, spender *common.Address) error {
+	ctx, cancel := context.WithTimeout(ctx, fundsCheckTimeout)
+	defer cancel()
+
+	client, err := f.dial(ctx)
+	if err != nil {
+		slog.Warn("payer funds check skipped", "err", fmt.Errorf("rpc connect: %w", err))
+		return nil
+	}
+	defer client.Close()
+
+	balance, err := callUint(ctx, client, token, balanceOfSig, addrPad(owner))
+	if err != nil {
+		slog.Warn("payer funds check skipped", "payer", owner.Hex(), "err", fmt.Errorf("balanceOf: %w", err))
+		return nil
+	}
+	if balance.Cmp(amount) < 0 {
+		return fmt.Errorf("%w: %s holds %s of %s, payment needs %s", ErrInsufficientFunds, owner.Hex(), balance, token.Hex(), amount)
+	}
+	if spender == nil {
+		return nil
+	}
+
+	allowance, err := callUint(ctx, client, token, allowanceSig, addrPad(owner), addrPad(*spender))
+	if err != nil {
+		slog.Warn("payer funds check skipped", "payer", owner.Hex(), "err", fmt.Errorf("allowance: %w", err))
+		return nil
+	}
+	if allowance.Cmp(amount) < 0 {
+		return fmt.Errorf("%w: %s approved %s for %s of %s, payment needs %s", ErrInsufficientFunds, owner.Hex(), spender.Hex(), allowance, token.Hex(), amount)
+	}
+	return nil
+}
+
+// callUint eth_calls a view function of contract taking 32-byte arguments and
+// returning a uint256.
+func callUint(ctx context.Context, client *ethclient.Client, contract common.Address, selector []byte, args ...[]byte) (*big.Int, error) {
+	data := append([]byte(nil), selector...)
+	for _, a := range args {
+		data = append(data, a...)
+	}
+	out, err := client.CallContract(ctx, ethereum.CallMsg{To: &contract, Data: data}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(out) < 32 {
+		return nil, fmt.Errorf("short response (%d bytes)", len(out))
+	}
+	return new(big.Int).SetBytes(out[:32]), nil
+}
@@ -0,0 +1,152 @@
+package x402
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// defaultTip is the priority fee used when the node cannot suggest one.
+var defaultTip = big.NewInt(1e9) // 1 gwei
+
+// GasStrategy prices the local facilitator's settlement transactions.
+type GasStrategy struct {
+	// TipMultiplier scales the node's suggested priority fee. Default 1.
+	TipMultiplier float64
+	// BaseFeeMultiplier scales the latest base fee in the fee cap, which is
+	// that plus the tip: headroom for the base fee rising before the
+	// transaction is mined. Default 2.
+	BaseFeeMultiplier float64
+	// GasPriceMultiplier scales the node's suggested gas price for legacy
+	// transactions. Default 1.
+	GasPriceMultiplier float64
+	// MaxFeePerGas, when non-nil, is a ceiling in wei on the fee cap (or
+	// legacy gas price) of any settlement transaction, replacements
+	// included.
+	MaxFeePerGas *big.Int
+	// Legacy sends pre-EIP-1559 transactions with a gas price. They are also
+	// sent, whatever this says, on chains whose blocks have no base fee.
+	Legacy bool
+}
+
+// withDefaults fills in the unset multipliers.
+func (g GasStrategy) withDefaults() GasStrategy {
+	if g.TipMultiplier <= 0 {
+		g.TipMultiplier = 1
+	}
+	if g.BaseFeeMultiplier <= 0 {
+		g.BaseFeeMultiplier = 2
+	}
+	if g.GasPriceMultiplier <= 0 {
+		g.GasPriceMultiplier = 1
+	}
+	return g
+}
+
+// LocalFacilitatorOption configures optional LocalFacilitator behaviour.
+type LocalFacilitatorOption func(*LocalFacilitator)
+
+// WithGasStrategy prices settlement transactions with g instead of the
+// defaults.
+func WithGasStrategy(g GasStrategy) LocalFacilitatorOption {
+	return func(f *LocalFacilitator) { f.gas = g.withDefaults() }
+}
+
+// txFees are the fee fields of a settlement transaction: a gas price for a
+// legacy transaction, a tip and fee cap otherwise.
+type txFees struct {
+	legacy   bool
+	gasPrice *big.Int
+	tip      *big.Int
+	feeCap   *big.Int
+}
+
+// currentFees returns the fees the gas strategy sets for a transaction sent
+// now.
+func (f *LocalFacilitator) currentFees(ctx context.Context, client *ethclient.Client) (txFees, error) {
+	header, err := client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return txFees{}, fmt.Errorf("latest header: %w", err)
+	}
+
+	if f.gas.Legacy || header.BaseFee == nil {
+		price, err := client.SuggestGasPrice(ctx)
+		if err != nil {
+			return txFees{}, fmt.Errorf("gas price: %w", err)
+		}
+		price = capFee(mulFee(price, f.gas.GasPriceMultiplier), f.gas.MaxFeePerGas)
+		return txFees{legacy: true, gasPrice: price}, nil
+	}
+
+	tip, err := client.SuggestGasTipCap(ctx)
+	if err != nil {
+		slog.Debug("priority fee suggestion failed, using default", "err", err)
+		tip = defaultTip
+	}
+	tip = mulFee(tip, f.gas.TipMultiplier)
+	feeCap := new(big.Int).Add(mulFee(header.BaseFee, f.gas.BaseFeeMultiplier), tip)
+	feeCap = capFee(feeCap, f.gas.MaxFeePerGas)
+	return txFees{tip: capFee(tip, feeCap), feeCap: feeCap}, nil
+}
+
+// feesOf returns the fees tx was sent with.
+func feesOf(tx *types.Transaction) txFees {
+	if tx.Type() == types.LegacyTxType {
+		return txFees{legacy: true, gasPrice: tx.GasPrice()}
+	}
+	return txFees{tip: tx.GasTipCap(), feeCap: tx.GasFeeCap()}
+}
+
+// maxFee is the most per gas the fees can cost.
+func (fees txFees) maxFee() *big.Int {
+	if fees.legacy {
+		return fees.gasPrice
+	}
+	return fees.feeCap
+}
+
+// newTx builds an unsigned transaction with these fees.
+func (fees txFees) newTx(chainID *big.Int, nonce, gas uint64, to *common.Address, data []byte) *types.Transaction {
+	if fees.legacy {
+		return types.NewTx(&types.LegacyTx{
+			Nonce:    nonce,
+			GasPrice: fees.gasPrice,
+			Gas:      gas,
+			To:       to,
+			Value:    new(big.Int),
+			Data:     data,
+		})
+	}
+	return types.NewTx(&types.DynamicFeeTx{
+		ChainID:   chainID,
+		Nonce:     nonce,
+		GasTipCap: fees.tip,
+		GasFeeCap: fees.feeCap,
+		Gas:       gas,
+		To:        to,
+		Value:     new(big.Int),
+		Data:      data,
+	})
+}
+
+// mulFee scales a fee by m, rounding down.
+func mulFee(fee *big.Int, m float64) *big.Int {
+	if m == 1 {
+		return new(big.Int).Set(fee)
+	}
+	scaled, _ := new(big.Float).Mul(new(big.Float).SetInt(fee), big.NewFloat(m)).Int(nil)
+	return scaled
+}
+
+// capFee returns fee, or limit if that is lower and non-nil.
+func capFee(fee, limit *big.Int) *big.Int {
+	if limit != nil && fee.Cmp(limit) > 0 {
+		return new(big.Int).Set(limit)
+	}
+	return fee
+}
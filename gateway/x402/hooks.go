@@ -0,0 +1,196 @@
+package x402
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// rpcInternalError is the JSON-RPC error code for a failure of the server.
+const rpcInternalError = -32603
+
+// Hook is an operator policy compiled into the gateway, run on every HTTP
+// JSON-RPC request after it is validated and before it is charged for or
+// proxied: it may rewrite the calls, reprice the request or reject it.
+// Hooks run in the order they are configured, each seeing what the previous
+// ones left. A Hook that also implements ResponseHook sees the response.
+type Hook interface {
+	// Request inspects and may change ex. An error rejects the request,
+	// answering each call with a JSON-RPC error: a *HookError's, or an
+	// internal error for any other.
+	Request(ex *Exchange) error
+}
+
+// ResponseHook is a Hook that also inspects, and may change, the response to
+// the requests it let through before it is sent. Response hooks run in the
+// reverse order of their requests, the first hook seeing the response last.
+// The response is then buffered whole rather than streamed to the client.
+type ResponseHook interface {
+	Hook
+	// Response inspects and may change resp. An error answers the request
+	// with a 500 instead, refunding its credits.
+	Response(ex *Exchange, resp *HookResponse) error
+}
+
+// HookError rejects a request with a JSON-RPC error.
+type HookError struct {
+	Code    int
+	Message string
+}
+
+func (e *HookError) Error() string {
+	return e.Message
+}
+
+// Call is one JSON-RPC call as hooks see it.
+type Call struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// Exchange is a JSON-RPC request passing through the hooks.
+type Exchange struct {
+	// Request is the HTTP request, for its headers and client address; its
+	// body is Calls.
+	Request *http.Request
+	// Calls are the request's calls, forwarded as hooks leave them.
+	Calls []Call
+	// Batch is whether the request is a batch, even of one call.
+	Batch bool
+	// Cost is what the request is charged, in credits, before any discount
+	// for a cache hit or premium for a verified answer; it starts at the
+	// calls' price; a negative cost charges nothing. Free methods and the
+	// pass-through mode charge nothing whatever it is.
+	Cost int64
+}
+
+// HookResponse is the response to an Exchange.
+type HookResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// exchangeKey is the context key of a request's Exchange.
+type exchangeKey struct{}
+
+// exchangeOf returns the Exchange r went through, or nil if hooks did not
+// see it.
+func exchangeOf(r *http.Request) *Exchange {
+	ex, _ := r.Context().Value(exchangeKey{}).(*Exchange)
+	return ex
+}
+
+// runHooks passes the JSON-RPC request in body through the request hooks
+// and returns it bound to their Exchange, with the calls they left as its
+// body, and that body. If a hook rejects the request, it is answered and a
+// nil request returned.
+func (m *Middleware) runHooks(w http.ResponseWriter, r *http.Request, body []byte) (*http.Request, []byte) {
+	ex := &Exchange{Request: r}
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		ex.Batch = true
+		_ = json.Unmarshal(body, &ex.Calls)
+	} else {
+		var call Call
+		_ = json.Unmarshal(body, &call)
+		ex.Calls = []Call{call}
+	}
+	calls, _ := rpcCalls(body)
+	ex.Cost = m.requestCost(calls)
+
+	for _, h := range m.cfg.Hooks {
+		err := h.Request(ex)
+		if err == nil {
+			continue
+		}
+		hookErr := &HookError{Code: rpcInternalError, Message: "internal error"}
+		if !errors.As(err, &hookErr) {
+			slog.Error("request hook failed", "err", err)
+		}
+		reply := make([]rpcCall, len(ex.Calls))
+		for i, c := range ex.Calls {
+			reply[i] = rpcCall{ID: c.ID, Method: c.Method}
+		}
+		writeRPCReply(w, rpcErrorReply(reply, ex.Batch, hookErr.Code, hookErr.Message))
+		return nil, nil
+	}
+
+	var rewritten []byte
+	if ex.Batch {
+		rewritten, _ = json.Marshal(ex.Calls)
+	} else if len(ex.Calls) > 0 {
+		rewritten, _ = json.Marshal(ex.Calls[0])
+	}
+	r = r.WithContext(context.WithValue(r.Context(), exchangeKey{}, ex))
+	r.Body = io.NopCloser(bytes.NewReader(rewritten))
+	r.ContentLength = int64(len(rewritten))
+	ex.Request = r
+	return r, rewritten
+}
+
+// withResponseHooks wraps next so the response hooks of ex see its
+// response before it is sent.
+func (m *Middleware) withResponseHooks(ex *Exchange, next http.Handler) http.Handler {
+	var hooks []ResponseHook
+	for _, h := range m.cfg.Hooks {
+		if rh, ok := h.(ResponseHook); ok {
+			hooks = append(hooks, rh)
+		}
+	}
+	if len(hooks) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &bufferedResponse{header: make(http.Header)}
+		next.ServeHTTP(rec, r)
+		resp := &HookResponse{Status: rec.status, Header: rec.header, Body: rec.body.Bytes()}
+		if resp.Status == 0 {
+			resp.Status = http.StatusOK
+		}
+		for i := len(hooks) - 1; i >= 0; i-- {
+			if err := hooks[i].Response(ex, resp); err != nil {
+				slog.Error("response hook failed", "err", err)
+				writeError(w, http.StatusInternalServerError, CodeInternal, "")
+				return
+			}
+		}
+		for name, values := range resp.Header {
+			w.Header()[name] = values
+		}
+		w.Header().Del("Content-Length")
+		w.WriteHeader(resp.Status)
+		_, _ = w.Write(resp.Body)
+	})
+}
+
+// bufferedResponse is a ResponseWriter keeping the response for the
+// response hooks.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 && status >= http.StatusOK {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
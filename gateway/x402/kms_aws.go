@@ -0,0 +1,164 @@
+package x402
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AWSKMSConfig locates an AWS KMS key and the credentials to sign with it.
+type AWSKMSConfig struct {
+	// KeyID is the key's ID, ARN or alias. It must be an asymmetric
+	// ECC_SECG_P256K1 signing key.
+	KeyID string
+	// Region is the AWS region holding the key, e.g. "us-east-1".
+	Region string
+	// AccessKeyID, SecretAccessKey and, for temporary credentials,
+	// SessionToken authenticate the requests. The principal needs
+	// kms:GetPublicKey and kms:Sign on the key.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// awsKMS calls the AWS KMS JSON API.
+type awsKMS struct {
+	cfg      AWSKMSConfig
+	endpoint string
+	client   *http.Client
+}
+
+// NewAWSKMSSigner returns a Signer whose key is held by AWS KMS. It reads
+// the key's public key to learn the relayer address.
+func NewAWSKMSSigner(ctx context.Context, cfg AWSKMSConfig) (Signer, error) {
+	if cfg.KeyID == "" || cfg.Region == "" || cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		return nil, fmt.Errorf("AWS KMS signing needs a key ID, region and credentials")
+	}
+	k := &awsKMS{
+		cfg:      cfg,
+		endpoint: "https://kms." + cfg.Region + ".amazonaws.com/",
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}
+
+	var out struct {
+		PublicKey []byte `json:"PublicKey"`
+	}
+	if err := k.call(ctx, "GetPublicKey", map[string]any{"KeyId": cfg.KeyID}, &out); err != nil {
+		return nil, fmt.Errorf("reading AWS KMS public key: %w", err)
+	}
+	addr, err := secp256k1Address(out.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("AWS KMS key %s: %w", cfg.KeyID, err)
+	}
+	return &remoteSigner{address: addr, sign: k.sign}, nil
+}
+
+// sign returns the DER-encoded signature of digest.
+func (k *awsKMS) sign(ctx context.Context, digest []byte) ([]byte, error) {
+	var out struct {
+		Signature []byte `json:"Signature"`
+	}
+	err := k.call(ctx, "Sign", map[string]any{
+		"KeyId":            k.cfg.KeyID,
+		"Message":          digest,
+		"MessageType":      "DIGEST",
+		"SigningAlgorithm": "ECDSA_SHA_256",
+	}, &out)
+	if err != nil {
+		return nil, fmt.Errorf("AWS KMS sign: %w", err)
+	}
+	return out.Signature, nil
+}
+
+// call invokes a KMS action, decoding its response into dst.
+func (k *awsKMS) call(ctx context.Context, action string, in, dst any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, k.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	if k.cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", k.cfg.SessionToken)
+	}
+	signSigV4(req, body, "kms", k.cfg.Region, k.cfg.AccessKeyID, k.cfg.SecretAccessKey, time.Now())
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		_ = json.Unmarshal(respBody, &e)
+		return fmt.Errorf("%s returned %d: %s %s", action, resp.StatusCode, e.Type, e.Message)
+	}
+	return json.Unmarshal(respBody, dst)
+}
+
+// signSigV4 adds an AWS Signature Version 4 Authorization header to req,
+// which has body, no query string, and path "/". Every header already set
+// is signed, with the host and date.
+func signSigV4(req *http.Request, body []byte, service, region, accessKeyID, secretAccessKey string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	payloadHash := sha256.Sum256(body)
+	canonicalRequest := req.Method + "\n/\n\n" + canonicalHeaders.String() + "\n" + signedHeaders + "\n" + hex.EncodeToString(payloadHash[:])
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
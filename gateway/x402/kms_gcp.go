@@ -0,0 +1,240 @@
+package x402
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	gcpKMSEndpoint = "https://cloudkms.googleapis.com/v1/"
+	gcpKMSScope    = "https://www.googleapis.com/auth/cloudkms"
+	// gcpMetadataToken serves access tokens for the service account of the
+	// GCP instance the gateway runs on.
+	gcpMetadataToken = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// GCPKMSConfig locates a Google Cloud KMS key version and the credentials to
+// sign with it.
+type GCPKMSConfig struct {
+	// KeyVersion is the key version's resource name,
+	// "projects/*/locations/*/keyRings/*/cryptoKeys/*/cryptoKeyVersions/*".
+	// The key must have the EC_SIGN_SECP256K1_SHA256 algorithm.
+	KeyVersion string
+	// CredentialsFile is a service account key file. When empty, access
+	// tokens come from the metadata server of the GCP instance the gateway
+	// runs on. The account needs cloudkms.cryptoKeyVersions.viewPublicKey
+	// and useToSign on the key.
+	CredentialsFile string
+}
+
+// gcpKMS calls the Cloud KMS REST API.
+type gcpKMS struct {
+	keyVersion string
+	client     *http.Client
+	tokens     *gcpTokenSource
+}
+
+// NewGCPKMSSigner returns a Signer whose key is held by Google Cloud KMS. It
+// reads the key's public key to learn the relayer address.
+func NewGCPKMSSigner(ctx context.Context, cfg GCPKMSConfig) (Signer, error) {
+	if cfg.KeyVersion == "" {
+		return nil, fmt.Errorf("GCP KMS signing needs a key version")
+	}
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+	}
+	tokens := &gcpTokenSource{client: client, scope: gcpKMSScope}
+	if cfg.CredentialsFile != "" {
+		account, err := readServiceAccount(cfg.CredentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		tokens.account = account
+	}
+	k := &gcpKMS{keyVersion: cfg.KeyVersion, client: client, tokens: tokens}
+
+	var out struct {
+		PEM string `json:"pem"`
+	}
+	if err := k.call(ctx, http.MethodGet, "/publicKey", nil, &out); err != nil {
+		return nil, fmt.Errorf("reading GCP KMS public key: %w", err)
+	}
+	block, _ := pem.Decode([]byte(out.PEM))
+	if block == nil {
+		return nil, fmt.Errorf("GCP KMS key %s: public key is not PEM", cfg.KeyVersion)
+	}
+	addr, err := secp256k1Address(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("GCP KMS key %s: %w", cfg.KeyVersion, err)
+	}
+	return &remoteSigner{address: addr, sign: k.sign}, nil
+}
+
+// sign returns the DER-encoded signature of digest. Cloud KMS takes it as a
+// SHA-256 digest, but signs whatever 32 bytes it is given.
+func (k *gcpKMS) sign(ctx context.Context, digest []byte) ([]byte, error) {
+	var out struct {
+		Signature []byte `json:"signature"`
+	}
+	in := map[string]any{"digest": map[string]any{"sha256": digest}}
+	if err := k.call(ctx, http.MethodPost, ":asymmetricSign", in, &out); err != nil {
+		return nil, fmt.Errorf("GCP KMS sign: %w", err)
+	}
+	return out.Signature, nil
+}
+
+// call sends a request for the key version's method (a path suffix),
+// decoding the response into dst.
+func (k *gcpKMS) call(ctx context.Context, method, suffix string, in, dst any) error {
+	token, err := k.tokens.token(ctx)
+	if err != nil {
+		return err
+	}
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, gcpKMSEndpoint+k.keyVersion+suffix, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return doJSON(k.client, req, dst)
+}
+
+// gcpServiceAccount is the part of a service account key file used to get
+// access tokens.
+type gcpServiceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+func readServiceAccount(path string) (*gcpServiceAccount, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading GCP credentials: %w", err)
+	}
+	var account gcpServiceAccount
+	if err := json.Unmarshal(raw, &account); err != nil {
+		return nil, fmt.Errorf("parsing GCP credentials: %w", err)
+	}
+	if account.ClientEmail == "" || account.PrivateKey == "" {
+		return nil, errors.New("GCP credentials are not a service account key")
+	}
+	if account.TokenURI == "" {
+		account.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	return &account, nil
+}
+
+// gcpTokenSource hands out OAuth access tokens, fetching a new one shortly
+// before the current one expires.
+type gcpTokenSource struct {
+	client  *http.Client
+	account *gcpServiceAccount // nil: use the metadata server
+	scope   string             // requested for account tokens
+
+	mu     sync.Mutex
+	cached string
+	expiry time.Time
+}
+
+func (s *gcpTokenSource) token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cached != "" && time.Until(s.expiry) > time.Minute {
+		return s.cached, nil
+	}
+
+	var req *http.Request
+	var err error
+	if s.account != nil {
+		req, err = s.account.tokenRequest(ctx, s.scope)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, gcpMetadataToken, nil)
+		if err == nil {
+			req.Header.Set("Metadata-Flavor", "Google")
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	var out struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := doJSON(s.client, req, &out); err != nil {
+		return "", fmt.Errorf("GCP access token: %w", err)
+	}
+	s.cached = out.AccessToken
+	s.expiry = time.Now().Add(time.Duration(out.ExpiresIn) * time.Second)
+	return s.cached, nil
+}
+
+// tokenRequest builds the OAuth JWT-bearer request exchanging a signed
+// assertion for an access token of scope.
+func (a *gcpServiceAccount) tokenRequest(ctx context.Context, scope string) (*http.Request, error) {
+	key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(a.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("GCP service account key: %w", err)
+	}
+	now := time.Now()
+	assertion, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   a.ClientEmail,
+		"scope": scope,
+		"aud":   a.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}).SignedString(key)
+	if err != nil {
+		return nil, fmt.Errorf("signing GCP token assertion: %w", err)
+	}
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+// doJSON sends req and decodes a 200 response's JSON body into dst.
+func doJSON(client *http.Client, req *http.Request, dst any) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d: %s", req.URL.Host, resp.StatusCode, bytes.TrimSpace(body))
+	}
+	return json.Unmarshal(body, dst)
+}
@@ -0,0 +1,256 @@
+package x402
+
+// Ledger: every payment, settlement, credit issued, granted, spent, refunded
+// or forfeited is posted as a balanced double-entry transaction, so a payer's
+// balance, a token's credits or the gateway's takings can be traced to the
+// entries that made them rather than read off counters kept apart.
+//
+// Amounts are in units: "credits", or "<network>/<asset>" for money in the
+// asset's atomic units. A posting debits an account with a positive amount
+// and credits it with a negative one; the postings of an entry add up to
+// zero in each unit. Accounts, by the prefix of their name:
+//
+//	issued:<payer>      credits issued to payer            (credit balance)
+//	granted:<counter>   credits operators gave it free     (credit balance)
+//	held:<counter>      credits a token or account holds   (debit balance)
+//	consumed:<counter>  credits spent from it              (debit balance)
+//	forfeited:<counter> credits left on it when revoked    (debit balance)
+//	payer:<payer>       what payer has paid                (credit balance)
+//	payment:<hash>      a payment authorized, not settled  (debit balance)
+//	treasury:<payTo>    payments settled to payTo          (debit balance)
+//
+// The stores refuse, as a whole, an entry that would leave any account on
+// the wrong side of zero: credits spent that were never held, a refund of
+// credits never spent, a payment settled twice or beyond what was
+// authorized.
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Ledger entry kinds.
+const (
+	LedgerCreditsIssued    = "credits_issued"
+	LedgerCreditsAdded     = "credits_added"
+	LedgerCreditsGranted   = "credits_granted"
+	LedgerCreditsUsed      = "credits_used"
+	LedgerCreditsRefunded  = "credits_refunded"
+	LedgerCreditsForfeited = "credits_forfeited"
+	// LedgerPayment is a payment verified, owed until it settles.
+	LedgerPayment = "payment"
+	// LedgerSettlement moves a settled payment to the treasury.
+	LedgerSettlement = "settlement"
+	// LedgerSettlementReorged takes a settlement back out of the treasury.
+	LedgerSettlementReorged = "settlement_reorged"
+	// LedgerPaymentReleased returns to the payer what a payment authorized
+	// but will not settle: the rest of an upto payment settled for less, or
+	// a payment whose settlement reverted.
+	LedgerPaymentReleased = "payment_released"
+)
+
+// LedgerCredits is the unit credits are posted in.
+const LedgerCredits = "credits"
+
+// ErrLedgerInvariant is returned for an entry that would take an account to
+// the wrong side of zero.
+var ErrLedgerInvariant = errors.New("ledger invariant violated")
+
+// LedgerEntry is a balanced transaction in the ledger.
+type LedgerEntry struct {
+	// Seq is assigned by the store, in posting order.
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+	// Ref is the token ID or payment hash the entry is about.
+	Ref string `json:"ref,omitempty"`
+	// Tx is the transaction of a settlement or reorged settlement.
+	Tx       string          `json:"tx,omitempty"`
+	Postings []LedgerPosting `json:"postings"`
+}
+
+// LedgerPosting debits (a positive Amount) or credits (a negative one) an
+// account.
+type LedgerPosting struct {
+	Account string   `json:"account"`
+	Unit    string   `json:"unit"`
+	Amount  *big.Int `json:"amount"`
+}
+
+// LedgerBalance is the sum of the postings to an account in a unit.
+type LedgerBalance struct {
+	Account string   `json:"account"`
+	Unit    string   `json:"unit"`
+	Amount  *big.Int `json:"amount"`
+}
+
+// LedgerStore keeps the ledger. Implementations must be safe for concurrent
+// use; the bolt and postgres token stores keep it across restarts.
+type LedgerStore interface {
+	// PostLedgerEntry appends e, numbering it, and adds its postings to the
+	// balances of their accounts, all or nothing. Returns
+	// ErrLedgerInvariant, posting nothing, if a balance would end up on the
+	// wrong side of zero (see ledgerBalanceOK).
+	PostLedgerEntry(e LedgerEntry) error
+
+	// LedgerBalances returns the balances of the accounts whose names start
+	// with prefix, ordered by account and unit.
+	LedgerBalances(prefix string) ([]LedgerBalance, error)
+
+	// LedgerEntries returns the entries posted from from until before to,
+	// oldest first.
+	LedgerEntries(from, to time.Time) ([]LedgerEntry, error)
+}
+
+// ledgerBalanceOK reports whether balance is on the side of zero account
+// keeps it: issued and granted credits and payers' payments are credit
+// balances, every other account a debit balance.
+func ledgerBalanceOK(account string, balance *big.Int) bool {
+	if strings.HasPrefix(account, "issued:") || strings.HasPrefix(account, "granted:") || strings.HasPrefix(account, "payer:") {
+		return balance.Sign() <= 0
+	}
+	return balance.Sign() >= 0
+}
+
+// ledgerTransfer returns the postings moving amount of unit from the credited
+// account to the debited one.
+func ledgerTransfer(debit, credit, unit string, amount *big.Int) []LedgerPosting {
+	return []LedgerPosting{
+		{Account: debit, Unit: unit, Amount: new(big.Int).Set(amount)},
+		{Account: credit, Unit: unit, Amount: new(big.Int).Neg(amount)},
+	}
+}
+
+// creditTransfer is ledgerTransfer for n credits.
+func creditTransfer(debit, credit string, n int64) []LedgerPosting {
+	return ledgerTransfer(debit, credit, LedgerCredits, big.NewInt(n))
+}
+
+// postLedger posts e to store, timed now. Postings of nothing are left out,
+// and an entry left with none is not posted. An entry that does not balance,
+// or that the store refuses, is logged: the ledger does not stop the gateway
+// serving.
+func postLedger(store LedgerStore, e LedgerEntry) {
+	kept := e.Postings[:0]
+	for _, p := range e.Postings {
+		if p.Amount.Sign() != 0 {
+			kept = append(kept, p)
+		}
+	}
+	if len(kept) == 0 {
+		return
+	}
+	if err := checkBalanced(kept); err != nil {
+		slog.Error("ledger entry refused", "kind", e.Kind, "ref", e.Ref, "err", err)
+		return
+	}
+	e.Time, e.Postings = time.Now().UTC(), kept
+	if err := store.PostLedgerEntry(e); err != nil {
+		slog.Error("ledger entry refused", "kind", e.Kind, "ref", e.Ref, "err", err)
+	}
+}
+
+// checkBalanced returns an error unless the postings add up to zero in each
+// unit.
+func checkBalanced(postings []LedgerPosting) error {
+	sums := make(map[string]*big.Int)
+	for _, p := range postings {
+		if sums[p.Unit] == nil {
+			sums[p.Unit] = new(big.Int)
+		}
+		sums[p.Unit].Add(sums[p.Unit], p.Amount)
+	}
+	for unit, sum := range sums {
+		if sum.Sign() != 0 {
+			return fmt.Errorf("postings in %s are off by %s", unit, sum)
+		}
+	}
+	return nil
+}
+
+// sortPostings orders postings by account and unit, the order the stores
+// lock balances in so concurrent entries cannot deadlock.
+func sortPostings(postings []LedgerPosting) []LedgerPosting {
+	sorted := append([]LedgerPosting(nil), postings...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Account != sorted[j].Account {
+			return sorted[i].Account < sorted[j].Account
+		}
+		return sorted[i].Unit < sorted[j].Unit
+	})
+	return sorted
+}
+
+// sortBalances orders balances by account and unit.
+func sortBalances(balances []LedgerBalance) {
+	sort.Slice(balances, func(i, j int) bool {
+		if balances[i].Account != balances[j].Account {
+			return balances[i].Account < balances[j].Account
+		}
+		return balances[i].Unit < balances[j].Unit
+	})
+}
+
+// ledgerPayer is the name payer's accounts go by: the folded address, or
+// "anonymous" when the payer is not known.
+func ledgerPayer(payer string) string {
+	return payerActor(foldAddress(payer))
+}
+
+// recordLedger posts what a payment or settlement event moved.
+func (m *Middleware) recordLedger(eventType string, data map[string]any) {
+	hash, _ := data["paymentHash"].(string)
+	amountStr, _ := data["amount"].(string)
+	amount, ok := new(big.Int).SetString(amountStr, 10)
+	if hash == "" || !ok {
+		return
+	}
+	network, _ := data["network"].(string)
+	asset, _ := data["asset"].(string)
+	payer, _ := data["payer"].(string)
+	payTo, _ := data["payTo"].(string)
+	tx, _ := data["transaction"].(string)
+	unit := network + "/" + foldAddress(asset)
+	payment := "payment:" + hash
+	payerAccount := "payer:" + ledgerPayer(payer)
+	treasury := "treasury:" + foldAddress(payTo)
+
+	switch eventType {
+	case EventPaymentVerified:
+		postLedger(m.cfg.Ledger, LedgerEntry{Kind: LedgerPayment, Ref: hash, Postings: ledgerTransfer(payment, payerAccount, unit, amount)})
+	case EventSettlementConfirmed:
+		postLedger(m.cfg.Ledger, LedgerEntry{Kind: LedgerSettlement, Ref: hash, Tx: foldAddress(tx), Postings: ledgerTransfer(treasury, payment, unit, amount)})
+		if scheme, _ := data["scheme"].(string); scheme == SchemeUpto {
+			// Settled for what was used: the rest of the authorization
+			// goes back.
+			m.releasePayment(hash, payerAccount, unit)
+		}
+	case EventSettlementReorged:
+		postLedger(m.cfg.Ledger, LedgerEntry{Kind: LedgerSettlementReorged, Ref: hash, Tx: foldAddress(tx), Postings: ledgerTransfer(payment, treasury, unit, amount)})
+	case EventSettlementReverted:
+		if retry, _ := data["willRetry"].(bool); !retry {
+			m.releasePayment(hash, payerAccount, unit)
+		}
+	}
+}
+
+// releasePayment returns what is left of the payment with the given hash to
+// its payer.
+func (m *Middleware) releasePayment(hash, payerAccount, unit string) {
+	payment := "payment:" + hash
+	balances, err := m.cfg.Ledger.LedgerBalances(payment)
+	if err != nil {
+		slog.Error("ledger balance lookup failed", "account", payment, "err", err)
+		return
+	}
+	for _, b := range balances {
+		if b.Account == payment && b.Unit == unit {
+			postLedger(m.cfg.Ledger, LedgerEntry{Kind: LedgerPaymentReleased, Ref: hash, Postings: ledgerTransfer(payerAccount, payment, unit, b.Amount)})
+		}
+	}
+}
@@ -12,13 +12,16 @@ package x402
 
 import (
 	"context"
-	"crypto/ecdsa"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"math/big"
+	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum"
@@ -26,6 +29,7 @@ import (
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
 )
 
 // Pre-computed EIP-712 type hashes (constant across all instances).
@@ -36,6 +40,9 @@ var (
 	authTypeHash = crypto.Keccak256Hash([]byte(
 		"TransferWithAuthorization(address from,address to,uint256 value,uint256 validAfter,uint256 validBefore,bytes32 nonce)",
 	))
+	receiveAuthTypeHash = crypto.Keccak256Hash([]byte(
+		"ReceiveWithAuthorization(address from,address to,uint256 value,uint256 validAfter,uint256 validBefore,bytes32 nonce)",
+	))
 )
 
 // transferWithAuthSig is the 4-byte selector for USDC.transferWithAuthorization.
@@ -43,12 +50,41 @@ var transferWithAuthSig = crypto.Keccak256([]byte(
 	"transferWithAuthorization(address,address,uint256,uint256,uint256,bytes32,uint8,bytes32,bytes32)",
 ))[:4]
 
+// receiveWithAuthSig is the 4-byte selector for USDC.receiveWithAuthorization.
+var receiveWithAuthSig = crypto.Keccak256([]byte(
+	"receiveWithAuthorization(address,address,uint256,uint256,uint256,bytes32,uint8,bytes32,bytes32)",
+))[:4]
+
+// PrimaryTypeReceiveWithAuthorization, advertised in an offer's extra
+// "primaryType", asks clients to sign an EIP-3009 ReceiveWithAuthorization.
+// The token contract only accepts it from the payee itself, so a signature
+// seen in the mempool cannot be front-run by another submitter.
+const PrimaryTypeReceiveWithAuthorization = "ReceiveWithAuthorization"
+
 // LocalFacilitator implements FacilitatorClient without any external dependency.
 type LocalFacilitator struct {
-	rpcURL     string
-	privateKey *ecdsa.PrivateKey
-	address    common.Address
-	chainID    *big.Int
+	rpcURL  string
+	address common.Address
+	chainID *big.Int
+	gas     GasStrategy
+
+	// minValidity is how long an authorization must remain valid when
+	// verified, so its settlement has time to land.
+	minValidity time.Duration
+
+	// transport, when set, carries the connections to rpcURL.
+	transport http.RoundTripper
+
+	// relayers are the accounts settlements are sent from, the primary one
+	// (address) first; nextRelayer picks the next in round-robin order.
+	relayers    []*relayer
+	nextRelayer atomic.Uint64
+
+	// batchTxs are the batch transactions authorizations were submitted in,
+	// by batchCall.key, kept until the batch's outcome is known; see
+	// SettleBatch.
+	batchMu  sync.Mutex
+	batchTxs map[string]common.Hash
 }
 
 // NewLocalFacilitator creates a LocalFacilitator.
@@ -56,17 +92,70 @@ type LocalFacilitator struct {
 //   - rpcURL: JSON-RPC endpoint of the settlement chain (e.g. Base Sepolia).
 //   - privateKeyHex: hex-encoded private key of the relayer wallet (pays gas).
 //   - chainID: settlement chain ID (e.g. 84532 for Base Sepolia).
-func NewLocalFacilitator(rpcURL, privateKeyHex string, chainID *big.Int) (*LocalFacilitator, error) {
-	key, err := crypto.HexToECDSA(strings.TrimPrefix(privateKeyHex, "0x"))
+func NewLocalFacilitator(rpcURL, privateKeyHex string, chainID *big.Int, opts ...LocalFacilitatorOption) (*LocalFacilitator, error) {
+	signer, err := NewKeySigner(privateKeyHex)
 	if err != nil {
 		return nil, fmt.Errorf("invalid gateway private key: %w", err)
 	}
-	return &LocalFacilitator{
-		rpcURL:     rpcURL,
-		privateKey: key,
-		address:    crypto.PubkeyToAddress(key.PublicKey),
-		chainID:    chainID,
-	}, nil
+	return NewLocalFacilitatorWithSigner(rpcURL, signer, chainID, opts...), nil
+}
+
+// NewLocalFacilitatorWithSigner creates a LocalFacilitator whose relayer
+// wallet signs through signer, e.g. a key held by a cloud KMS.
+func NewLocalFacilitatorWithSigner(rpcURL string, signer Signer, chainID *big.Int, opts ...LocalFacilitatorOption) *LocalFacilitator {
+	f := &LocalFacilitator{
+		rpcURL:   rpcURL,
+		address:  signer.Address(),
+		chainID:  chainID,
+		gas:      GasStrategy{}.withDefaults(),
+		relayers: []*relayer{newRelayer(signer)},
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
+}
+
+// WithMinValidity makes Verify reject authorizations that expire within d,
+// which could not be settled before they lapse. Asynchronously settled
+// payments need a window covering the settlement delay.
+func WithMinValidity(d time.Duration) LocalFacilitatorOption {
+	return func(f *LocalFacilitator) { f.minValidity = d }
+}
+
+// WithRPCTransport makes the facilitator reach the settlement chain's RPC
+// endpoint through t, such as one dialing through a SOCKS5 proxy, so the
+// endpoint does not learn the gateway's address.
+func WithRPCTransport(t http.RoundTripper) LocalFacilitatorOption {
+	return func(f *LocalFacilitator) { f.transport = t }
+}
+
+// dial connects to the settlement chain's RPC endpoint.
+func (f *LocalFacilitator) dial(ctx context.Context) (*ethclient.Client, error) {
+	if f.transport == nil {
+		return ethclient.DialContext(ctx, f.rpcURL)
+	}
+	client, err := rpc.DialOptions(ctx, f.rpcURL, rpc.WithHTTPClient(&http.Client{Transport: f.transport}))
+	if err != nil {
+		return nil, err
+	}
+	return ethclient.NewClient(client), nil
+}
+
+// checkValidityWindow rejects an authorization that is not valid yet (after
+// validAfter, when given) or expires before minValidity from now has passed.
+func (f *LocalFacilitator) checkValidityWindow(validAfter, validBefore *big.Int) error {
+	now := time.Now()
+	if validAfter != nil && validAfter.Cmp(big.NewInt(now.Unix())) > 0 {
+		return fmt.Errorf("authorization not yet valid (validAfter=%s)", validAfter)
+	}
+	if validBefore.Cmp(big.NewInt(now.Unix())) < 0 {
+		return fmt.Errorf("authorization expired (validBefore=%s)", validBefore)
+	}
+	if minBefore := now.Add(f.minValidity).Unix(); validBefore.Cmp(big.NewInt(minBefore)) < 0 {
+		return fmt.Errorf("authorization expires too soon (validBefore=%s, need at least %d)", validBefore, minBefore)
+	}
+	return nil
 }
 
 // ---------------------------------------------------------------------------
@@ -75,13 +164,15 @@ func NewLocalFacilitator(rpcURL, privateKeyHex string, chainID *big.Int) (*Local
 
 type localPayload struct {
 	Accepted struct {
+		Scheme  string `json:"scheme"`
 		Network string `json:"network"`
 		Asset   string `json:"asset"`
 		PayTo   string `json:"payTo"`
 		Amount  string `json:"amount"`
 		Extra   struct {
-			Name    string `json:"name"`
-			Version string `json:"version"`
+			Name      string `json:"name"`
+			Version   string `json:"version"`
+			Challenge string `json:"challenge"`
 		} `json:"extra"`
 	} `json:"accepted"`
 	Payload struct {
@@ -94,10 +185,47 @@ type localPayload struct {
 			ValidBefore string `json:"validBefore"`
 			Nonce       string `json:"nonce"`
 		} `json:"authorization"`
+		// Permit2Authorization is set instead of Authorization for the
+		// permit2 scheme.
+		Permit2Authorization permit2Authorization `json:"permit2Authorization"`
+		// Transaction is set instead, for Solana payments: the payer-signed
+		// transaction, base64-encoded.
+		Transaction string `json:"transaction"`
 	} `json:"payload"`
 }
 
+// parseLocalPayload decodes a payment payload into the v2 shape. x402 v1
+// payloads are accepted too, either bare ({"x402Version":1,"scheme",
+// "network","payload"}) or in the v1 facilitator layout ({"paymentPayload",
+// "paymentRequirements"}); their fields are mapped onto the v2 "accepted"
+// block so the rest of the code handles one shape.
 func parseLocalPayload(raw []byte) (*localPayload, error) {
+	var probe struct {
+		X402Version         int             `json:"x402Version"`
+		Accepted            json.RawMessage `json:"accepted"`
+		PaymentPayload      json.RawMessage `json:"paymentPayload"`
+		PaymentRequirements json.RawMessage `json:"paymentRequirements"`
+	}
+	if err := json.Unmarshal(raw, &probe); err != nil {
+		return nil, fmt.Errorf("parsing payment payload: %w", err)
+	}
+
+	switch {
+	case len(probe.PaymentPayload) > 0:
+		p, err := parseV1Payload(probe.PaymentPayload)
+		if err != nil {
+			return nil, err
+		}
+		if len(probe.PaymentRequirements) > 0 {
+			if err := p.applyV1Requirements(probe.PaymentRequirements); err != nil {
+				return nil, err
+			}
+		}
+		return p, nil
+	case probe.X402Version == 1 && len(probe.Accepted) == 0:
+		return parseV1Payload(raw)
+	}
+
 	var p localPayload
 	if err := json.Unmarshal(raw, &p); err != nil {
 		return nil, fmt.Errorf("parsing payment payload: %w", err)
@@ -105,6 +233,91 @@ func parseLocalPayload(raw []byte) (*localPayload, error) {
 	return &p, nil
 }
 
+// v1NetworkChainIDs maps x402 v1 network names to EVM chain IDs.
+var v1NetworkChainIDs = map[string]int64{
+	"base":           8453,
+	"base-sepolia":   84532,
+	"avalanche":      43114,
+	"avalanche-fuji": 43113,
+	"polygon":        137,
+	"polygon-amoy":   80002,
+	"sei":            1329,
+	"sei-testnet":    1328,
+	"iotex":          4689,
+}
+
+// v1NetworkToCAIP2 converts a v1 network name such as "base-sepolia" to its
+// CAIP-2 identifier. Names that are already CAIP-2, or unknown, pass through
+// unchanged and will fail to match any offer.
+func v1NetworkToCAIP2(network string) string {
+	if id, ok := v1NetworkChainIDs[network]; ok {
+		return fmt.Sprintf("eip155:%d", id)
+	}
+	return network
+}
+
+// parseV1Payload decodes a bare x402 v1 PaymentPayload. v1 has no echo of
+// the chosen requirements, so only scheme and network are known; the amount
+// is matched from the authorization value.
+func parseV1Payload(raw []byte) (*localPayload, error) {
+	var v1 struct {
+		Scheme  string `json:"scheme"`
+		Network string `json:"network"`
+	}
+	if err := json.Unmarshal(raw, &v1); err != nil {
+		return nil, fmt.Errorf("parsing v1 payment payload: %w", err)
+	}
+	var p localPayload
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return nil, fmt.Errorf("parsing v1 payment payload: %w", err)
+	}
+	p.Accepted.Scheme = v1.Scheme
+	p.Accepted.Network = v1NetworkToCAIP2(v1.Network)
+	return &p, nil
+}
+
+// applyV1Requirements fills the "accepted" block from v1 PaymentRequirements
+// sent alongside the payload.
+func (p *localPayload) applyV1Requirements(raw []byte) error {
+	var req struct {
+		Scheme            string `json:"scheme"`
+		Network           string `json:"network"`
+		MaxAmountRequired string `json:"maxAmountRequired"`
+		Asset             string `json:"asset"`
+		PayTo             string `json:"payTo"`
+		Extra             struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"extra"`
+	}
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return fmt.Errorf("parsing v1 payment requirements: %w", err)
+	}
+	if p.Accepted.Scheme == "" {
+		p.Accepted.Scheme = req.Scheme
+	}
+	if p.Accepted.Network == "" {
+		p.Accepted.Network = v1NetworkToCAIP2(req.Network)
+	}
+	p.Accepted.Amount = req.MaxAmountRequired
+	p.Accepted.Asset = req.Asset
+	p.Accepted.PayTo = req.PayTo
+	p.Accepted.Extra.Name = req.Extra.Name
+	p.Accepted.Extra.Version = req.Extra.Version
+	return nil
+}
+
+// parseRequirements decodes the gateway's own requirements for the offer being
+// paid. These — not the client's echoed "accepted" block — are authoritative
+// for network, asset, EIP-712 domain, payTo and amount.
+func parseRequirements(raw []byte) (*paymentRequirementsV2, error) {
+	var req paymentRequirementsV2
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return nil, fmt.Errorf("parsing payment requirements: %w", err)
+	}
+	return &req, nil
+}
+
 // ---------------------------------------------------------------------------
 // EIP-712 helpers
 // ---------------------------------------------------------------------------
@@ -135,9 +348,9 @@ func domainSeparator(name, version string, chainID *big.Int, contract common.Add
 	return crypto.Keccak256Hash(enc)
 }
 
-func authHash(from, to common.Address, value, validAfter, validBefore *big.Int, nonce [32]byte) common.Hash {
+func authHash(typeHash common.Hash, from, to common.Address, value, validAfter, validBefore *big.Int, nonce [32]byte) common.Hash {
 	enc := make([]byte, 7*32)
-	copy(enc[0:32], authTypeHash.Bytes())
+	copy(enc[0:32], typeHash.Bytes())
 	copy(enc[32:64], addrPad(from))
 	copy(enc[64:96], addrPad(to))
 	copy(enc[96:128], pad32(value))
@@ -147,17 +360,47 @@ func authHash(from, to common.Address, value, validAfter, validBefore *big.Int,
 	return crypto.Keccak256Hash(enc)
 }
 
-func eip712Digest(p *localPayload) (common.Hash, [32]byte, error) {
-	parts := strings.Split(p.Accepted.Network, ":")
+// chainIDFromNetwork extracts the chain ID from a CAIP-2 "eip155:<id>" network.
+func chainIDFromNetwork(network string) (*big.Int, error) {
+	parts := strings.Split(network, ":")
 	if len(parts) != 2 {
-		return common.Hash{}, [32]byte{}, fmt.Errorf("invalid network: %s", p.Accepted.Network)
+		return nil, fmt.Errorf("invalid network: %s", network)
 	}
 	chainID := new(big.Int)
 	if _, ok := chainID.SetString(parts[1], 10); !ok {
-		return common.Hash{}, [32]byte{}, fmt.Errorf("invalid chainId: %s", parts[1])
+		return nil, fmt.Errorf("invalid chainId: %s", parts[1])
+	}
+	return chainID, nil
+}
+
+// recoverSigner returns the address whose key made the 65-byte hex
+// signature of digest.
+func recoverSigner(digest common.Hash, signature string) (common.Address, error) {
+	sig, err := hex.DecodeString(strings.TrimPrefix(signature, "0x"))
+	if err != nil || len(sig) != 65 {
+		return common.Address{}, fmt.Errorf("invalid signature")
+	}
+	if sig[64] >= 27 {
+		sig[64] -= 27 // ecrecover expects 0/1
+	}
+	pubBytes, err := crypto.Ecrecover(digest.Bytes(), sig)
+	if err != nil {
+		return common.Address{}, fmt.Errorf("ecrecover: %w", err)
 	}
+	pub, err := crypto.UnmarshalPubkey(pubBytes)
+	if err != nil {
+		return common.Address{}, fmt.Errorf("unmarshal pubkey: %w", err)
+	}
+	return crypto.PubkeyToAddress(*pub), nil
+}
 
-	usdcAddr := common.HexToAddress(p.Accepted.Asset)
+func eip712Digest(p *localPayload, req *paymentRequirementsV2) (common.Hash, [32]byte, error) {
+	chainID, err := chainIDFromNetwork(req.Network)
+	if err != nil {
+		return common.Hash{}, [32]byte{}, err
+	}
+
+	usdcAddr := common.HexToAddress(req.Asset)
 	from := common.HexToAddress(p.Payload.Authorization.From)
 	to := common.HexToAddress(p.Payload.Authorization.To)
 	value := mustBI(p.Payload.Authorization.Value)
@@ -172,8 +415,12 @@ func eip712Digest(p *localPayload) (common.Hash, [32]byte, error) {
 	var nonce [32]byte
 	copy(nonce[32-len(nonceBytes):], nonceBytes)
 
-	ds := domainSeparator(p.Accepted.Extra.Name, p.Accepted.Extra.Version, chainID, usdcAddr)
-	ah := authHash(from, to, value, validAfter, validBefore, nonce)
+	ds := domainSeparator(req.Extra.Name, req.Extra.Version, chainID, usdcAddr)
+	typeHash := authTypeHash
+	if req.Extra.PrimaryType == PrimaryTypeReceiveWithAuthorization {
+		typeHash = receiveAuthTypeHash
+	}
+	ah := authHash(typeHash, from, to, value, validAfter, validBefore, nonce)
 
 	digest := crypto.Keccak256Hash(append([]byte{0x19, 0x01}, append(ds.Bytes(), ah.Bytes()...)...))
 	return digest, nonce, nil
@@ -189,47 +436,74 @@ func mustBI(s string) *big.Int {
 func (f *LocalFacilitator) Address() common.Address { return f.address }
 
 // ---------------------------------------------------------------------------
-// Verify — checks the EIP-3009 signature without touching the chain
+// Verify — checks the EIP-3009 signature, then that the payer can cover it
 // ---------------------------------------------------------------------------
 
-func (f *LocalFacilitator) Verify(_ context.Context, payloadBytes, _ []byte) (*VerifyResult, error) {
+func (f *LocalFacilitator) Verify(ctx context.Context, payloadBytes, requirementsBytes []byte) (*VerifyResult, error) {
+	start := time.Now()
+	result, err := f.verify(ctx, payloadBytes, requirementsBytes)
+	observeCall("local", "verify", requirementsBytes, start, err)
+	return result, err
+}
+
+func (f *LocalFacilitator) verify(ctx context.Context, payloadBytes, requirementsBytes []byte) (*VerifyResult, error) {
 	p, err := parseLocalPayload(payloadBytes)
 	if err != nil {
 		return nil, err
 	}
+	req, err := parseRequirements(requirementsBytes)
+	if err != nil {
+		return nil, err
+	}
 
-	// Check expiry
+	if usesPermit2(req.Scheme) {
+		chainID, err := chainIDFromNetwork(req.Network)
+		if err != nil {
+			return nil, err
+		}
+		if err := f.checkValidityWindow(nil, mustBI(p.Payload.Permit2Authorization.Deadline)); err != nil {
+			return nil, err
+		}
+		payer, err := verifyPermit2(p, req, chainID, f.address)
+		if err != nil {
+			return nil, err
+		}
+		// Permit2 pulls the tokens under the payer's approval of it. An upto
+		// permit must cover its maximum: usage is not known in advance.
+		amount := mustBI(p.Payload.Permit2Authorization.Permitted.Amount)
+		if err := f.checkFunds(ctx, common.HexToAddress(req.Asset), payer, amount, &Permit2Address); err != nil {
+			return nil, err
+		}
+		callData, err := packPermitTransferFrom(p, req)
+		if err != nil {
+			return nil, err
+		}
+		if err := f.simulateSettlement(ctx, Permit2Address, callData); err != nil {
+			return nil, err
+		}
+		slog.Info("local permit2 verify OK", "payer", payer.Hex(), "amount", p.Payload.Permit2Authorization.Permitted.Amount)
+		return &VerifyResult{Payer: payer.Hex()}, nil
+	}
+
+	// Check the validity window: the token contract reverts a settlement
+	// outside it.
+	validAfter := mustBI(p.Payload.Authorization.ValidAfter)
 	validBefore := mustBI(p.Payload.Authorization.ValidBefore)
-	if validBefore.Int64() < time.Now().Unix() {
-		return nil, fmt.Errorf("authorization expired (validBefore=%d)", validBefore.Int64())
+	if err := f.checkValidityWindow(validAfter, validBefore); err != nil {
+		return nil, err
 	}
 
 	// Compute EIP-712 digest
-	digest, _, err := eip712Digest(p)
+	digest, _, err := eip712Digest(p, req)
 	if err != nil {
 		return nil, err
 	}
 
-	// Decode and normalize signature
-	sigHex := strings.TrimPrefix(p.Payload.Signature, "0x")
-	sig, err := hex.DecodeString(sigHex)
-	if err != nil || len(sig) != 65 {
-		return nil, fmt.Errorf("invalid signature")
-	}
-	if sig[64] >= 27 {
-		sig[64] -= 27 // ecrecover expects 0/1
-	}
-
 	// Recover signer
-	pubBytes, err := crypto.Ecrecover(digest.Bytes(), sig)
+	recovered, err := recoverSigner(digest, p.Payload.Signature)
 	if err != nil {
-		return nil, fmt.Errorf("ecrecover: %w", err)
-	}
-	pub, err := crypto.UnmarshalPubkey(pubBytes)
-	if err != nil {
-		return nil, fmt.Errorf("unmarshal pubkey: %w", err)
+		return nil, err
 	}
-	recovered := crypto.PubkeyToAddress(*pub)
 	expected := common.HexToAddress(p.Payload.Authorization.From)
 	if recovered != expected {
 		return nil, fmt.Errorf("signature mismatch: signed by %s, claimed %s", recovered.Hex(), expected.Hex())
@@ -237,35 +511,165 @@ func (f *LocalFacilitator) Verify(_ context.Context, payloadBytes, _ []byte) (*V
 
 	// Check payTo matches requirements
 	authTo := common.HexToAddress(p.Payload.Authorization.To)
-	reqPayTo := common.HexToAddress(p.Accepted.PayTo)
+	reqPayTo := common.HexToAddress(req.PayTo)
 	if authTo != reqPayTo {
 		return nil, fmt.Errorf("payTo mismatch: auth=%s req=%s", authTo.Hex(), reqPayTo.Hex())
 	}
+	// receiveWithAuthorization only succeeds when called by the payee.
+	if req.Extra.PrimaryType == PrimaryTypeReceiveWithAuthorization && authTo != f.address {
+		return nil, fmt.Errorf("receiveWithAuthorization payee %s is not the relayer %s", authTo.Hex(), f.address.Hex())
+	}
 
 	// Check amount
 	authValue := mustBI(p.Payload.Authorization.Value)
-	reqAmount := mustBI(p.Accepted.Amount)
+	reqAmount := mustBI(req.Amount)
 	if authValue.Cmp(reqAmount) < 0 {
 		return nil, fmt.Errorf("amount too low: authorized %s, required %s", authValue, reqAmount)
 	}
 
+	if err := f.checkFunds(ctx, common.HexToAddress(req.Asset), recovered, authValue, nil); err != nil {
+		return nil, err
+	}
+	callData, _, err := authorizationCall(p, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.simulateSettlement(ctx, common.HexToAddress(req.Asset), callData); err != nil {
+		return nil, err
+	}
+
 	slog.Info("local verify OK", "payer", recovered.Hex(), "amount", authValue.String())
 	return &VerifyResult{Payer: recovered.Hex()}, nil
 }
 
 // ---------------------------------------------------------------------------
-// Settle — submits transferWithAuthorization to the USDC contract
+// Settle — submits transferWithAuthorization to the USDC contract, or
+// permitTransferFrom to Permit2 for the permit2 and upto schemes
 // ---------------------------------------------------------------------------
 
-func (f *LocalFacilitator) Settle(ctx context.Context, payloadBytes, _ []byte) error {
+func (f *LocalFacilitator) Settle(ctx context.Context, payloadBytes, requirementsBytes []byte) (*SettleResult, error) {
+	hash, err := f.settle(ctx, payloadBytes, requirementsBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &SettleResult{Transaction: hash.Hex()}, nil
+}
+
+// SettleConfirmed settles like Settle, then waits until the settlement
+// transaction has the given number of confirmations (1 = mined).
+func (f *LocalFacilitator) SettleConfirmed(ctx context.Context, payloadBytes, requirementsBytes []byte, confirmations uint64) (*SettleResult, error) {
+	hash, err := f.settle(ctx, payloadBytes, requirementsBytes)
+	if err != nil {
+		return nil, err
+	}
+	mined, err := f.waitConfirmed(ctx, hash, confirmations)
+	if err != nil {
+		return nil, err
+	}
+	return &SettleResult{Transaction: mined.Hex()}, nil
+}
+
+// WaitMined waits until the settlement transaction tx, or a replacement
+// BumpStuck sent for it, has been mined, and returns the hash that landed.
+func (f *LocalFacilitator) WaitMined(ctx context.Context, tx string) (string, error) {
+	mined, err := f.waitConfirmed(ctx, common.HexToHash(tx), 1)
+	if err != nil {
+		return "", err
+	}
+	return mined.Hex(), nil
+}
+
+// Confirmations returns the number of confirmations of the settlement
+// transaction tx, zero while it is unmined.
+func (f *LocalFacilitator) Confirmations(ctx context.Context, tx string) (uint64, error) {
+	client, err := f.dial(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("rpc connect: %w", err)
+	}
+	defer client.Close()
+	receipt, err := client.TransactionReceipt(ctx, common.HexToHash(tx))
+	if errors.Is(err, ethereum.NotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("settlement receipt: %w", err)
+	}
+	head, err := client.BlockNumber(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("block number: %w", err)
+	}
+	mined := receipt.BlockNumber.Uint64()
+	if head < mined {
+		return 0, nil
+	}
+	return head - mined + 1, nil
+}
+
+// settle submits the settlement transaction and returns its hash.
+func (f *LocalFacilitator) settle(ctx context.Context, payloadBytes, requirementsBytes []byte) (common.Hash, error) {
+	start := time.Now()
+	hash, err := f.submitSettlement(ctx, payloadBytes, requirementsBytes)
+	observeCall("local", "settle", requirementsBytes, start, err)
+	return hash, err
+}
+
+func (f *LocalFacilitator) submitSettlement(ctx context.Context, payloadBytes, requirementsBytes []byte) (common.Hash, error) {
 	p, err := parseLocalPayload(payloadBytes)
 	if err != nil {
-		return err
+		return common.Hash{}, err
+	}
+	req, err := parseRequirements(requirementsBytes)
+	if err != nil {
+		return common.Hash{}, err
+	}
+
+	if usesPermit2(req.Scheme) {
+		callData, err := packPermitTransferFrom(p, req)
+		if err != nil {
+			return common.Hash{}, err
+		}
+		hash, err := f.submit(ctx, f.primary(), Permit2Address, callData)
+		if err != nil {
+			return common.Hash{}, err
+		}
+		slog.Info("permit2 settlement tx submitted",
+			"hash", hash.Hex(),
+			"from", p.Payload.Permit2Authorization.From,
+			"to", req.PayTo,
+			"token", req.Asset,
+			"value", req.Amount,
+		)
+		return hash, nil
+	}
+
+	callData, _, err := authorizationCall(p, req)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	relayers := f.rotation()
+	if req.Extra.PrimaryType == PrimaryTypeReceiveWithAuthorization {
+		relayers = f.primary()
+	}
+	hash, err := f.submit(ctx, relayers, common.HexToAddress(req.Asset), callData)
+	if err != nil {
+		return common.Hash{}, err
 	}
 
-	_, nonce32, err := eip712Digest(p)
+	slog.Info("settlement tx submitted",
+		"hash", hash.Hex(),
+		"from", p.Payload.Authorization.From,
+		"to", p.Payload.Authorization.To,
+		"value", p.Payload.Authorization.Value,
+	)
+	return hash, nil
+}
+
+// authorizationCall returns the call data redeeming an EIP-3009 payment on
+// its token contract, and the authorization's nonce.
+func authorizationCall(p *localPayload, req *paymentRequirementsV2) (callData []byte, nonce [32]byte, err error) {
+	_, nonce32, err := eip712Digest(p, req)
 	if err != nil {
-		return err
+		return nil, nonce, err
 	}
 
 	from := common.HexToAddress(p.Payload.Authorization.From)
@@ -273,13 +677,12 @@ func (f *LocalFacilitator) Settle(ctx context.Context, payloadBytes, _ []byte) e
 	value := mustBI(p.Payload.Authorization.Value)
 	validAfter := mustBI(p.Payload.Authorization.ValidAfter)
 	validBefore := mustBI(p.Payload.Authorization.ValidBefore)
-	usdcAddr := common.HexToAddress(p.Accepted.Asset)
 
 	// Decode signature → v, r, s
 	sigHex := strings.TrimPrefix(p.Payload.Signature, "0x")
 	sig, err := hex.DecodeString(sigHex)
 	if err != nil || len(sig) != 65 {
-		return fmt.Errorf("invalid signature for settlement")
+		return nil, nonce, fmt.Errorf("invalid signature for settlement")
 	}
 	var r, s [32]byte
 	copy(r[:], sig[:32])
@@ -290,73 +693,141 @@ func (f *LocalFacilitator) Settle(ctx context.Context, payloadBytes, _ []byte) e
 	}
 
 	// ABI-encode transferWithAuthorization(address,address,uint256,uint256,uint256,bytes32,uint8,bytes32,bytes32)
-	callData := packTransferWithAuth(from, to, value, validAfter, validBefore, nonce32, v, r, s)
+	// or receiveWithAuthorization, which takes the same arguments.
+	selector := transferWithAuthSig
+	if req.Extra.PrimaryType == PrimaryTypeReceiveWithAuthorization {
+		selector = receiveWithAuthSig
+	}
+	return packTransferWithAuth(selector, from, to, value, validAfter, validBefore, nonce32, v, r, s), nonce32, nil
+}
 
-	client, err := ethclient.DialContext(ctx, f.rpcURL)
+// confirmationPollInterval is how often waitConfirmed checks the chain.
+const confirmationPollInterval = 2 * time.Second
+
+// waitConfirmed blocks until the transaction hash, or a replacement sent
+// for it by BumpStuck, has succeeded and has confirmations blocks on top of
+// (and including) its own, or ctx is done. It returns the hash of the
+// transaction that landed. A receipt that disappears — the block was reorged
+// out — is waited for again, since the transaction usually lands in the
+// replacement chain.
+func (f *LocalFacilitator) waitConfirmed(ctx context.Context, hash common.Hash, confirmations uint64) (common.Hash, error) {
+	client, err := f.dial(ctx)
 	if err != nil {
-		return fmt.Errorf("rpc connect: %w", err)
+		return common.Hash{}, fmt.Errorf("rpc connect: %w", err)
 	}
 	defer client.Close()
 
-	txNonce, err := client.PendingNonceAt(ctx, f.address)
+	ticker := time.NewTicker(confirmationPollInterval)
+	defer ticker.Stop()
+	for {
+		for _, h := range f.replacements(hash) {
+			receipt, err := client.TransactionReceipt(ctx, h)
+			switch {
+			case errors.Is(err, ethereum.NotFound):
+				// Not mined yet, reorged out, or replaced.
+				continue
+			case err != nil:
+				slog.Warn("settlement receipt lookup failed", "hash", h.Hex(), "err", err)
+				continue
+			}
+			f.chargeGas(h, receipt)
+			if receipt.Status != types.ReceiptStatusSuccessful {
+				return common.Hash{}, fmt.Errorf("%w: %s", ErrSettlementReverted, h.Hex())
+			}
+			head, err := client.BlockNumber(ctx)
+			if err != nil {
+				slog.Warn("block number lookup failed", "err", err)
+				break
+			}
+			mined := receipt.BlockNumber.Uint64()
+			if head >= mined && head-mined+1 >= confirmations {
+				slog.Info("settlement tx confirmed", "hash", h.Hex(), "block", mined, "confirmations", head-mined+1)
+				return h, nil
+			}
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return common.Hash{}, fmt.Errorf("waiting for %d confirmations of %s: %w", confirmations, hash.Hex(), ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// chargeGas counts the fee the receipt of hash shows its relayer paid, once
+// per transaction. Transactions sent before a restart are not tracked, and
+// so not counted; neither is a rollup's L1 data fee, which receipts report
+// apart.
+func (f *LocalFacilitator) chargeGas(hash common.Hash, receipt *types.Receipt) {
+	if receipt.EffectiveGasPrice == nil {
+		return
+	}
+	for _, r := range f.relayers {
+		if r.charge(hash) {
+			fee := new(big.Int).Mul(new(big.Int).SetUint64(receipt.GasUsed), receipt.EffectiveGasPrice)
+			revenue.spendGas(fmt.Sprintf("eip155:%s", f.chainID), r.address.Hex(), fee)
+			return
+		}
+	}
+}
+
+// submit signs and sends a transaction calling target with callData from the
+// first of relayers whose balance can pay for its gas, returning its hash.
+func (f *LocalFacilitator) submit(ctx context.Context, relayers []*relayer, target common.Address, callData []byte) (common.Hash, error) {
+	client, err := f.dial(ctx)
 	if err != nil {
-		return fmt.Errorf("pending nonce: %w", err)
+		return common.Hash{}, fmt.Errorf("rpc connect: %w", err)
+	}
+	defer client.Close()
+
+	// A settlement that would revert still costs gas: catch it first, with
+	// the reason, when the node can tell.
+	if err := simulate(ctx, client, relayers[0].address, target, callData); err != nil {
+		if errors.Is(err, ErrSettlementWouldRevert) {
+			return common.Hash{}, fmt.Errorf("transaction_failed: %w", err)
+		}
+		slog.Warn("settlement simulation skipped", "err", err)
 	}
 
 	// Gas estimation with safe fallback
 	gasLimit := uint64(100_000)
 	if est, err := client.EstimateGas(ctx, ethereum.CallMsg{
-		From: f.address,
-		To:   &usdcAddr,
+		From: relayers[0].address,
+		To:   &target,
 		Data: callData,
 	}); err == nil {
 		gasLimit = est * 12 / 10 // 20% buffer
 	}
 
-	// EIP-1559 fee params
-	header, err := client.HeaderByNumber(ctx, nil)
+	fees, err := f.currentFees(ctx, client)
 	if err != nil {
-		return fmt.Errorf("latest header: %w", err)
-	}
-	tip := big.NewInt(1e9) // 1 gwei priority fee
-	feeCap := new(big.Int).Add(header.BaseFee, tip)
-
-	tx := types.NewTx(&types.DynamicFeeTx{
-		ChainID:   f.chainID,
-		Nonce:     txNonce,
-		GasTipCap: tip,
-		GasFeeCap: feeCap,
-		Gas:       gasLimit,
-		To:        &usdcAddr,
-		Value:     new(big.Int),
-		Data:      callData,
-	})
-
-	signed, err := types.SignTx(tx, types.NewLondonSigner(f.chainID), f.privateKey)
-	if err != nil {
-		return fmt.Errorf("signing settlement tx: %w", err)
+		return common.Hash{}, err
 	}
 
-	if err := client.SendTransaction(ctx, signed); err != nil {
-		return fmt.Errorf("transaction_failed: %w", err)
+	cost := new(big.Int).Mul(new(big.Int).SetUint64(gasLimit), fees.maxFee())
+	for _, r := range relayers {
+		if !r.canPay(ctx, client, cost) {
+			continue
+		}
+		signed, err := r.send(ctx, client, f.chainID, fees, gasLimit, target, callData)
+		if err != nil {
+			return common.Hash{}, err
+		}
+		return signed.Hash(), nil
 	}
-
-	slog.Info("settlement tx submitted",
-		"hash", signed.Hash().Hex(),
-		"from", from.Hex(),
-		"to", to.Hex(),
-		"value", value.String(),
-	)
-	return nil
+	return common.Hash{}, fmt.Errorf("transaction_failed: no relayer can pay %s wei of gas", cost)
 }
 
 // ---------------------------------------------------------------------------
 // Manual ABI encoding for transferWithAuthorization
 // ---------------------------------------------------------------------------
 
-// packTransferWithAuth manually ABI-encodes the transferWithAuthorization call.
-// This avoids a runtime abi.JSON parse and keeps the import footprint small.
+// packTransferWithAuth manually ABI-encodes the transferWithAuthorization call
+// (or receiveWithAuthorization, per selector). This avoids a runtime abi.JSON
+// parse and keeps the import footprint small.
 func packTransferWithAuth(
+	selector []byte,
 	from, to common.Address,
 	value, validAfter, validBefore *big.Int,
 	nonce [32]byte,
@@ -369,7 +840,7 @@ func packTransferWithAuth(
 	// bytes32: as-is.
 	// uint8: right-aligned in 32 bytes.
 	data := make([]byte, 4+9*32)
-	copy(data[:4], transferWithAuthSig)
+	copy(data[:4], selector)
 	offset := 4
 	copy(data[offset+12:offset+32], from.Bytes()); offset += 32
 	copy(data[offset+12:offset+32], to.Bytes()); offset += 32
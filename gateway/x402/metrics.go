@@ -0,0 +1,167 @@
+package x402
+
+// Facilitator metrics: every verify and settle call to the remote, local and
+// Solana facilitators is timed and counted, and its last error kept, so
+// operators can see a slow or failing facilitator holding up payments before
+// revenue stalls. WriteMetrics renders them in the Prometheus text format.
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the call duration
+// histogram's buckets: from a fast verify to a settlement waiting on a
+// congested chain.
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// maxErrorLabel bounds the error message exported with the last error.
+const maxErrorLabel = 200
+
+// facilitatorMetrics holds the metrics of every facilitator in the process.
+var facilitatorMetrics = &callMetrics{series: make(map[callKey]*callSeries)}
+
+// callKey identifies the calls of one kind to one facilitator.
+type callKey struct {
+	facilitator string // "remote", "local" or "solana"
+	network     string
+	op          string // "verify", "settle" or "settle_batch"
+}
+
+// callSeries is what is recorded about the calls of one callKey.
+type callSeries struct {
+	buckets   []uint64 // per latencyBuckets bound, not cumulative
+	count     uint64
+	sum       float64
+	successes uint64
+	failures  uint64
+	lastError string
+	lastErrAt time.Time
+}
+
+type callMetrics struct {
+	mu     sync.Mutex
+	series map[callKey]*callSeries
+}
+
+// observeCall records a call of op to facilitator that started at start and
+// returned err. The network is read from the payment's requirements.
+func observeCall(facilitator, op string, requirementsBytes []byte, start time.Time, err error) {
+	var network string
+	if req, perr := parseRequirements(requirementsBytes); perr == nil {
+		network = req.Network
+	}
+	facilitatorMetrics.observe(callKey{facilitator: facilitator, network: network, op: op}, time.Since(start), err)
+}
+
+func (m *callMetrics) observe(key callKey, d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.series[key]
+	if s == nil {
+		s = &callSeries{buckets: make([]uint64, len(latencyBuckets))}
+		m.series[key] = s
+	}
+	secs := d.Seconds()
+	for i, le := range latencyBuckets {
+		if secs <= le {
+			s.buckets[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += secs
+	if err == nil {
+		s.successes++
+		return
+	}
+	s.failures++
+	s.lastError = err.Error()
+	s.lastErrAt = time.Now()
+}
+
+// WriteMetrics writes the facilitator metrics in the Prometheus text
+// exposition format:
+//
+//   - x402_facilitator_call_duration_seconds, a histogram of call durations
+//   - x402_facilitator_calls_total, calls by result ("success" or "failure")
+//   - x402_facilitator_last_error_timestamp_seconds, when a call last failed
+//   - x402_facilitator_last_error_info, 1 labeled with that call's error
+//
+// Every series is labeled with the facilitator ("remote", "local" or
+// "solana"), the payment's network and the operation.
+func WriteMetrics(w io.Writer) error {
+	m := facilitatorMetrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]callKey, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.facilitator != b.facilitator {
+			return a.facilitator < b.facilitator
+		}
+		if a.network != b.network {
+			return a.network < b.network
+		}
+		return a.op < b.op
+	})
+
+	var b strings.Builder
+	b.WriteString("# HELP x402_facilitator_call_duration_seconds Duration of facilitator verify and settle calls.\n")
+	b.WriteString("# TYPE x402_facilitator_call_duration_seconds histogram\n")
+	for _, k := range keys {
+		s, labels := m.series[k], k.labels()
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += s.buckets[i]
+			fmt.Fprintf(&b, "x402_facilitator_call_duration_seconds_bucket{%s,le=%q} %d\n", labels, fmt.Sprint(le), cumulative)
+		}
+		fmt.Fprintf(&b, "x402_facilitator_call_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, s.count)
+		fmt.Fprintf(&b, "x402_facilitator_call_duration_seconds_sum{%s} %g\n", labels, s.sum)
+		fmt.Fprintf(&b, "x402_facilitator_call_duration_seconds_count{%s} %d\n", labels, s.count)
+	}
+	b.WriteString("# HELP x402_facilitator_calls_total Facilitator verify and settle calls by result.\n")
+	b.WriteString("# TYPE x402_facilitator_calls_total counter\n")
+	for _, k := range keys {
+		s, labels := m.series[k], k.labels()
+		fmt.Fprintf(&b, "x402_facilitator_calls_total{%s,result=\"success\"} %d\n", labels, s.successes)
+		fmt.Fprintf(&b, "x402_facilitator_calls_total{%s,result=\"failure\"} %d\n", labels, s.failures)
+	}
+	b.WriteString("# HELP x402_facilitator_last_error_timestamp_seconds When a facilitator call last failed, in Unix seconds.\n")
+	b.WriteString("# TYPE x402_facilitator_last_error_timestamp_seconds gauge\n")
+	for _, k := range keys {
+		if s := m.series[k]; s.failures > 0 {
+			fmt.Fprintf(&b, "x402_facilitator_last_error_timestamp_seconds{%s} %d\n", k.labels(), s.lastErrAt.Unix())
+		}
+	}
+	b.WriteString("# HELP x402_facilitator_last_error_info The error of the last failed facilitator call.\n")
+	b.WriteString("# TYPE x402_facilitator_last_error_info gauge\n")
+	for _, k := range keys {
+		if s := m.series[k]; s.failures > 0 {
+			msg := s.lastError
+			if len(msg) > maxErrorLabel {
+				msg = strings.ToValidUTF8(msg[:maxErrorLabel], "")
+			}
+			fmt.Fprintf(&b, "x402_facilitator_last_error_info{%s,error=\"%s\"} 1\n", k.labels(), escapeLabel(msg))
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// labels renders the key as Prometheus labels, without braces.
+func (k callKey) labels() string {
+	return fmt.Sprintf(`facilitator="%s",network="%s",op="%s"`, escapeLabel(k.facilitator), escapeLabel(k.network), escapeLabel(k.op))
+}
+
+// escapeLabel escapes a Prometheus label value.
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
@@ -2,17 +2,24 @@ package x402
 
 import (
 	"bytes"
-	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/big"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"log/slog"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/golang-jwt/jwt/v5"
 )
 
 // paymentRequiredHeader is the response header that carries the 402 payload.
@@ -21,17 +28,79 @@ const paymentRequiredHeader = "Payment-Required"
 // paymentSignatureHeader is the request header the client sends its payment in.
 const paymentSignatureHeader = "Payment-Signature"
 
+// paymentResponseHeader carries the settlement result back to a client that
+// paid via Payment-Signature.
+const paymentResponseHeader = "Payment-Response"
+
+// xPaymentHeader is the payment request header used by the published x402
+// spec and most client SDKs; xPaymentResponseHeader is its response pair.
+const (
+	xPaymentHeader         = "X-Payment"
+	xPaymentResponseHeader = "X-Payment-Response"
+)
+
 // paymentTokenHeader is the response header carrying the issued batch JWT.
 const paymentTokenHeader = "X-Payment-Token"
 
+// paymentResendSecretHeader is the request header in which a client sends a
+// secret of its choosing with a payment. Resubmitting the payment with the
+// same secret gets back the token it was redeemed for, should the client lose
+// the response.
+const paymentResendSecretHeader = "X-Payment-Resend-Secret"
+
+// settlementTxHeader carries the hash of the transaction that settled the
+// payment, so the payer can verify it on-chain.
+const settlementTxHeader = "X-Settlement-Tx"
+
 // creditsRemainingHeader tells the client how many credits remain after this call.
 const creditsRemainingHeader = "X-Rpc-Credits-Remaining"
 
+// rpcCacheHeader is set to "HIT" by the response cache (proxy.Cache) on
+// calls it answered without the upstream.
+const rpcCacheHeader = "X-Rpc-Cache"
+
+// rpcVerifyHeader, set to "true", asks for a verified answer, which the
+// verifier in front of the upstream (proxy.Verifier) marks by setting
+// rpcVerifiedHeader to "true".
+const (
+	rpcVerifyHeader   = "X-Rpc-Verify"
+	rpcVerifiedHeader = "X-Rpc-Verified"
+)
+
 // paymentRequirementsExtra carries EIP-712 domain metadata the facilitator
 // needs to verify the client's signature without querying the chain.
 type paymentRequirementsExtra struct {
-	Name    string `json:"name"`
-	Version string `json:"version"`
+	// Name and Version are the EIP-712 domain of an EVM asset; Solana assets
+	// have none.
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+	// Decimals, when known, is the asset's decimals, for displaying Amount.
+	Decimals int `json:"decimals,omitempty"`
+	// Credits is the number of RPC calls this entry buys, so clients can
+	// choose between credit packs.
+	Credits int64 `json:"credits,omitempty"`
+	// Methods, when set, lists the only JSON-RPC methods the pack's token
+	// may call.
+	Methods []string `json:"methods,omitempty"`
+	// Spender is the address a permit2-scheme permit must name as spender:
+	// the relayer that submits the transfer.
+	Spender string `json:"spender,omitempty"`
+	// FeePayer is the Solana account a Solana payment transaction must name
+	// as fee payer: the facilitator's, which signs and submits it.
+	FeePayer string `json:"feePayer,omitempty"`
+	// PrimaryType, when set to "ReceiveWithAuthorization", asks the client to
+	// sign that EIP-3009 type instead of TransferWithAuthorization.
+	PrimaryType string `json:"primaryType,omitempty"`
+	// Coupon names the coupon the entry is priced under.
+	Coupon string `json:"coupon,omitempty"`
+	// Challenge, when set, is a gateway-issued nonce the client must echo in
+	// its payment's "accepted" block.
+	Challenge string `json:"challenge,omitempty"`
+	// ChallengeNonce is set with Challenge: the nonce the payment's EIP-3009
+	// authorization, or as a uint256 its Permit2 permit, must be signed with;
+	// a Solana transaction carries it, as is, in an SPL Memo instruction.
+	// Clients derive it as keccak256 of the challenge's hex-decoded bytes.
+	ChallengeNonce string `json:"challengeNonce,omitempty"`
 }
 
 // paymentRequirementsV2 mirrors the x402 v2 PaymentRequirements schema.
@@ -79,49 +148,226 @@ type MiddlewareConfig struct {
 	MaxAmountRequired int64
 	// RequestsPerPayment is credits issued per batch purchase.
 	RequestsPerPayment int64
+	// Tiers, when non-empty, replaces MaxAmountRequired/RequestsPerPayment with
+	// several credit packs, each advertised as its own Accepts entry. Tier
+	// amounts must be unique.
+	Tiers []PricingTier
+	// FreeMethods are JSON-RPC methods served without payment or credits,
+	// such as eth_chainId or net_version: clients and wallets probe these
+	// before deciding to pay. A batch is free only if every call in it is.
+	FreeMethods []string
+	// Policy, when set, blocks JSON-RPC methods before anything is charged or
+	// proxied, answering with a JSON-RPC error. It also applies without a
+	// facilitator.
+	Policy *MethodPolicy
+	// MethodCosts prices JSON-RPC methods in credits, so heavy calls such as
+	// eth_getLogs or debug_traceTransaction cost more than eth_call. Methods
+	// not listed cost one credit; a batch costs the sum of its calls.
+	MethodCosts map[string]int64
+	// MaxBatchSize, when positive, rejects JSON-RPC batches with more calls
+	// than this before anything is charged or proxied.
+	MaxBatchSize int
+	// MaxRequestBody, when positive, rejects request bodies of more bytes
+	// than this with 413 instead of buffering them.
+	MaxRequestBody int64
+	// USDPerCredit is the USD price of one credit, used for assets with a
+	// PriceFeed: their pack amounts are recomputed from the feed by
+	// RefreshPrices, keeping each pack's credits.
+	USDPerCredit float64
+	// Oracle reads the assets' price feeds. Required when any asset has a
+	// PriceFeed.
+	Oracle PriceOracle
+	// Coupons are promotional codes clients present in the X-Coupon header
+	// to be offered, and pay for, discounted or bonus-credit packs.
+	Coupons []Coupon
+	// Assets, when non-empty, replaces USDCAddress/USDCDomainName/
+	// USDCDomainVersion with one or more payment tokens; every asset's tiers
+	// are advertised as separate Accepts entries.
+	Assets []AcceptedAsset
+	// Permit2Spender is the relayer address clients must authorise in Permit2
+	// permits. Required when any asset has Permit2 set.
+	Permit2Spender string
+	// FeePayer is the facilitator's fee payer account on Solana. Required
+	// when Network is a Solana network.
+	FeePayer string
+	// ReceiveWithAuthorization asks clients for EIP-3009
+	// receiveWithAuthorization signatures, which only the payee may submit,
+	// instead of front-runnable transferWithAuthorization ones. PayTo must
+	// then be the settling relayer's address, and every EIP-3009 asset must
+	// implement receiveWithAuthorization.
+	ReceiveWithAuthorization bool
+	// Settlements keeps verified payments until they are settled in the
+	// background: upto permits until their metered settlement, and every
+	// payment when AsyncSettlement is set. Required by either; usually the
+	// token store itself.
+	Settlements SettlementStore
+	// AsyncSettlement issues the token as soon as a payment verifies and
+	// settles it in the background, retrying transient failures, instead of
+	// settling inside the request. A payment that cannot be settled gets its
+	// token revoked. Top-ups are still settled before credits are added.
+	AsyncSettlement bool
+	// Confirmations, when positive, withholds credits until the settlement
+	// transaction has this many confirmations (1 = mined). A paying request
+	// is answered with 202 and a URL to poll, or long-poll, for the token;
+	// pay-and-call requests are not proxied. Requires a ConfirmingFacilitator
+	// and cannot be combined with AsyncSettlement.
+	Confirmations uint64
+	// ReorgBlocks, when positive, keeps watching settlement transactions
+	// after they are mined, until they are final: one that a reorg drops
+	// from the chain and that is not mined again within ReorgBlocks blocks
+	// has its payment's credits withdrawn and a settlement_reorged event
+	// sent. Requires a ReorgFacilitator.
+	ReorgBlocks uint64
+	// SettlementBatchSize, when above 1, leaves asynchronously settled
+	// payments to SettleDue, which settles up to this many in one
+	// transaction where the facilitator can. Requires AsyncSettlement and a
+	// BatchingFacilitator.
+	SettlementBatchSize int
+	// FreeRequestsPerDay, when positive, lets each client IP make this many
+	// requests a day (UTC) without credentials before the 402 gate applies,
+	// charged like credits. Requires FreeTier.
+	FreeRequestsPerDay int64
+	// FreeTier counts the free requests; usually the token store itself.
+	FreeTier FreeTierStore
+	// Usage, when set, keeps what each payer spent per method and paid, for
+	// usage reports; usually the token store itself.
+	Usage UsageStore
+	// Ledger, when set, posts every payment and settlement to the ledger;
+	// usually the token store itself, also given to the TokenManager (see
+	// WithLedger).
+	Ledger LedgerStore
+	// ChallengeSecret, when set, puts a challenge signed with it in every 402
+	// and requires payments to echo one that has not expired and to sign its
+	// nonce (see paymentRequirementsExtra.ChallengeNonce), so a payment made to another
+	// deployment paying the same address cannot be redeemed here. Replicas
+	// of one deployment share the secret. Bare x402 v1 payloads, which echo
+	// nothing, are then refused.
+	ChallengeSecret []byte
+	// Webhooks, when set, receives payment, settlement and token events.
+	Webhooks *Webhooks
+	// Events, when set, receives every event notify reports, the credits
+	// each request spends and the request count, for live subscribers.
+	Events *EventStream
+	// Audit, when set, records the payment, settlement and token events, as
+	// Tokens records what happens to credits (see WithAuditLog).
+	Audit *AuditLog
 	// Tokens signs / validates batch JWTs and manages credit counters.
 	// Must be non-nil when Facilitator is set.
 	Tokens *TokenManager
+	// Replay records redeemed payment authorizations so a payment cannot be
+	// exchanged for more than one batch token. Defaults to an in-memory cache.
+	Replay ReplayCache
 	// Facilitator handles payment verification and settlement.
 	// When nil, the middleware acts as a plain pass-through — no 402 is issued
 	// and all requests are forwarded directly to Next. Use this when no
-	// facilitator is available for the target chain.
+	// facilitator is available for the target chain. A ReceiptFacilitator's
+	// settlement transactions are followed until mined, and the credits of
+	// a payment whose transaction reverted are withdrawn.
 	Facilitator FacilitatorClient
 	// Next is the handler to call after a valid token is found (the RPC proxy).
 	Next http.Handler
+	// InFlight, when set, caps the requests proxied at once, in all and per
+	// token; requests past a cap are answered 429 with Retry-After before
+	// anything is charged.
+	InFlight *InFlightLimiter
+	// Hooks are operator policies compiled into the gateway, run in order on
+	// every HTTP JSON-RPC request and, for ResponseHooks, its response.
+	// Routes and WebSocket messages bypass them.
+	Hooks []Hook
+	// Routes put the gate in front of further HTTP APIs, served under their
+	// own path prefixes with any HTTP method and priced per request. Bodies
+	// are capped by MaxRequestBody like JSON-RPC ones.
+	Routes []Route
+	// PayAndCall, when true, also proxies the JSON-RPC body of a paying
+	// request: the payment is settled, the token issued, one credit spent and
+	// the RPC response returned with the token in X-Payment-Token — one round
+	// trip instead of two. Payments without an RPC body are unaffected.
+	PayAndCall bool
+	// CacheHitCost is what a call answered from the response cache in front
+	// of the upstream costs, in credits, when it is less than the call's
+	// usual cost: Next reports such a hit with X-Rpc-Cache: HIT, and the
+	// difference is refunded. Zero makes hits free; a negative value charges
+	// them like any other call.
+	CacheHitCost int64
+	// VerifiedCallCost is what a call asking for a verified answer with
+	// X-Rpc-Verify: true costs on top of its usual cost, in credits; it is
+	// refunded unless Next marks the answer X-Rpc-Verified: true. Free
+	// calls and the free tier are never verified.
+	VerifiedCallCost int64
+	// PreferXPayment makes the X-PAYMENT header win when a request carries
+	// both it and Payment-Signature. By default Payment-Signature wins.
+	PreferXPayment bool
+	// WebSocket, when set, serves WebSocket connections to / for clients
+	// holding a token: each JSON-RPC message they send is charged like an
+	// HTTP request and the connection is closed once the token runs out.
+	WebSocket WebSocketProxy
+	// NotificationsPerCredit, when positive, charges WebSocket clients one
+	// credit per this many subscription notifications delivered. Otherwise
+	// notifications are free.
+	NotificationsPerCredit int64
+	// SubscriptionCost, when positive, is what setting up a subscription
+	// with eth_subscribe over a WebSocket costs, in place of the method's
+	// cost; it is refunded if the node refuses the subscription.
+	// eth_unsubscribe is free.
+	SubscriptionCost int64
 }
 
 // Middleware implements the x402 batch-token payment gate.
 type Middleware struct {
-	cfg              MiddlewareConfig
-	requirementsJSON []byte // JSON of paymentRequirementsV2, passed to the facilitator
-	payloadJSON      []byte // JSON of paymentRequiredV2, sent as the 402 body
-	payload402       string // base64(payloadJSON), sent in Payment-Required header
+	cfg         MiddlewareConfig
+	limiters    *tokenLimiters
+	freeMethods map[string]bool
+	pricing     atomic.Pointer[offerSet]
+	confirming  *confirmationTracker
+	statuses    *statusTracker
 
-	// seenPayments guards against replaying the same payment signature to obtain
-	// multiple batch tokens. Key = SHA-256 of the raw payment payload bytes.
-	seenMu       sync.Mutex
-	seenPayments map[[32]byte]struct{}
+	pricesMu sync.Mutex                  // serialises RefreshPrices and SetPricing
+	prices   map[common.Address]*big.Rat // last USD price per feed
+	terms    Pricing                     // current pack and method costs, set by SetPricing
 }
 
-// NewMiddleware builds the x402 middleware from cfg.
-func NewMiddleware(cfg MiddlewareConfig) (*Middleware, error) {
-	req := paymentRequirementsV2{
-		Scheme:            "exact",
-		Network:           cfg.Network,
-		Amount:            fmt.Sprintf("%d", cfg.MaxAmountRequired),
-		PayTo:             cfg.PayTo,
-		MaxTimeoutSeconds: 60,
-		Asset:             cfg.USDCAddress,
-		Extra: paymentRequirementsExtra{
-			Name:    cfg.USDCDomainName,
-			Version: cfg.USDCDomainVersion,
-		},
+// offerSet is what the gateway currently advertises. It is replaced as a
+// whole when oracle prices are refreshed or the pricing is changed.
+type offerSet struct {
+	offers      []offer          // one per Accepts entry, in advertised order
+	payloadJSON []byte           // JSON of paymentRequiredV2, sent as the 402 body
+	payload402  string           // base64(payloadJSON), sent in Payment-Required header
+	methodCosts map[string]int64 // credits per call of the priced methods
+
+	coupon  *Coupon              // the coupon these offers are priced under, if any
+	coupons map[string]*offerSet // the offers under each coupon, by couponKey
+}
+
+// newOfferSet builds the offers and 402 payload for cfg at the given prices,
+// and those advertised to the holders of each coupon.
+func newOfferSet(cfg MiddlewareConfig, prices map[common.Address]*big.Rat) (*offerSet, error) {
+	set, err := newCouponOfferSet(cfg, prices, nil)
+	if err != nil {
+		return nil, err
+	}
+	set.coupons = make(map[string]*offerSet, len(cfg.Coupons))
+	for i := range cfg.Coupons {
+		c := &cfg.Coupons[i]
+		couponed, err := newCouponOfferSet(cfg, prices, c)
+		if err != nil {
+			return nil, fmt.Errorf("coupon %s: %w", c.Code, err)
+		}
+		set.coupons[couponKey(c.Code)] = couponed
 	}
+	set.methodCosts = cfg.MethodCosts
+	return set, nil
+}
 
-	requirementsJSON, err := json.Marshal(req)
+// newCouponOfferSet builds the offers and 402 payload for cfg at the given
+// prices under coupon, which may be nil.
+func newCouponOfferSet(cfg MiddlewareConfig, prices map[common.Address]*big.Rat, coupon *Coupon) (*offerSet, error) {
+	offers, err := buildOffers(cfg, prices, coupon)
 	if err != nil {
-		return nil, fmt.Errorf("marshalling payment requirements: %w", err)
+		return nil, err
+	}
+	accepts := make([]paymentRequirementsV2, len(offers))
+	for i, o := range offers {
+		accepts[i] = o.requirements
 	}
 
 	payloadRequired := paymentRequiredV2{
@@ -129,197 +375,1076 @@ func NewMiddleware(cfg MiddlewareConfig) (*Middleware, error) {
 		Error:       "Payment required",
 		Resource: paymentResourceV2{
 			URL:         cfg.GatewayURL,
-			Description: fmt.Sprintf("RPC access: %d credits per payment", cfg.RequestsPerPayment),
+			Description: offersDescription(offers),
 			MimeType:    "",
 		},
-		Accepts: []paymentRequirementsV2{req},
+		Accepts: accepts,
 	}
 	payloadJSON, err := json.Marshal(payloadRequired)
 	if err != nil {
 		return nil, fmt.Errorf("marshalling payment required payload: %w", err)
 	}
-
-	return &Middleware{
-		cfg:              cfg,
-		requirementsJSON: requirementsJSON,
-		payloadJSON:      payloadJSON,
-		payload402:       base64.StdEncoding.EncodeToString(payloadJSON),
-		seenPayments:     make(map[[32]byte]struct{}),
+	return &offerSet{
+		offers:      offers,
+		payloadJSON: payloadJSON,
+		payload402:  base64.StdEncoding.EncodeToString(payloadJSON),
+		coupon:      coupon,
 	}, nil
 }
 
+// NewMiddleware builds the x402 middleware from cfg. Oracle-priced assets are
+// not offered until RefreshPrices has run.
+func NewMiddleware(cfg MiddlewareConfig) (*Middleware, error) {
+	if cfg.AsyncSettlement && cfg.Settlements == nil {
+		return nil, errors.New("asynchronous settlement needs a settlement store")
+	}
+	if cfg.Confirmations > 0 {
+		if _, ok := cfg.Facilitator.(ConfirmingFacilitator); !ok {
+			return nil, errors.New("waiting for confirmations needs a facilitator that can report them")
+		}
+		if cfg.AsyncSettlement {
+			return nil, errors.New("waiting for confirmations and asynchronous settlement are exclusive")
+		}
+	}
+	if cfg.ReorgBlocks > 0 {
+		if _, ok := cfg.Facilitator.(ReorgFacilitator); !ok {
+			return nil, errors.New("watching settlements for reorgs needs a facilitator that can report the chain's height")
+		}
+	}
+	if cfg.SettlementBatchSize > 1 {
+		if _, ok := cfg.Facilitator.(BatchingFacilitator); !ok {
+			return nil, errors.New("batched settlement needs a facilitator that can batch")
+		}
+		if !cfg.AsyncSettlement {
+			return nil, errors.New("batched settlement needs asynchronous settlement")
+		}
+	}
+	if cfg.FreeRequestsPerDay > 0 && cfg.FreeTier == nil {
+		return nil, errors.New("a free tier needs a free tier store")
+	}
+	if err := validateCoupons(cfg.Coupons); err != nil {
+		return nil, err
+	}
+	if err := validateRoutes(cfg.Routes); err != nil {
+		return nil, err
+	}
+	if err := validateMethodCosts(cfg.MethodCosts); err != nil {
+		return nil, err
+	}
+	prices := make(map[common.Address]*big.Rat)
+	set, err := newOfferSet(cfg, prices)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Replay == nil {
+		cfg.Replay = NewInMemoryReplayCache(DefaultReplayCacheEntries)
+	}
+
+	freeMethods := make(map[string]bool, len(cfg.FreeMethods))
+	for _, method := range cfg.FreeMethods {
+		freeMethods[method] = true
+	}
+
+	m := &Middleware{
+		cfg:         cfg,
+		limiters:    newTokenLimiters(),
+		freeMethods: freeMethods,
+		confirming:  newConfirmationTracker(),
+		statuses:    newStatusTracker(),
+		prices:      prices,
+		terms: Pricing{
+			MaxAmountRequired:  cfg.MaxAmountRequired,
+			RequestsPerPayment: cfg.RequestsPerPayment,
+			MethodCosts:        cfg.MethodCosts,
+			Tiered:             len(cfg.Tiers) > 0,
+		},
+	}
+	m.pricing.Store(set)
+	return m, nil
+}
+
 // ServeHTTP implements http.Handler.
 func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Only allow POST to / (standard JSON-RPC endpoint).
-	if r.Method != http.MethodPost || r.URL.Path != "/" {
-		http.Error(w, "only POST / is supported", http.StatusBadRequest)
+	if m.cfg.Events != nil {
+		m.cfg.Events.countRequest()
+	}
+	// Payments awaiting confirmations are polled for their credits.
+	if r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, confirmationsPath) {
+		m.servePaymentStatus(w, r)
+		return
+	}
+	// Any verified payment can be followed through settlement.
+	if r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, settlementsPath) {
+		m.serveSettlementStatus(w, r)
+		return
+	}
+	// The discovery document describes the payment gate, if there is one.
+	if r.Method == http.MethodGet && r.URL.Path == discoveryPath && m.cfg.Facilitator != nil {
+		m.serveDiscovery(w)
+		return
+	}
+
+	// WebSocket clients connect to / and are metered per message.
+	if m.cfg.WebSocket != nil && r.URL.Path == "/" && isWebSocketUpgrade(r) {
+		m.serveWebSocket(w, r)
 		return
 	}
 
+	// Routes put the gate in front of other HTTP APIs; everything else must
+	// be a POST to / (the standard JSON-RPC endpoint).
+	route := m.matchRoute(r)
+	switch {
+	case route != nil && !route.allows(r.Method):
+		w.Header().Set("Allow", strings.Join(route.Methods, ", "))
+		writeError(w, http.StatusMethodNotAllowed, CodeBadRequest, fmt.Sprintf("only %s are supported on %s", strings.Join(route.Methods, ", "), route.Prefix))
+		return
+	case route != nil:
+		r = withRoute(r, route)
+	case r.Method != http.MethodPost || r.URL.Path != "/":
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "only POST / is supported")
+		return
+	}
+
+	if m.cfg.MaxRequestBody > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, m.cfg.MaxRequestBody)
+	}
+	bodyBytes, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		if tooLarge := (*http.MaxBytesError)(nil); errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, CodeRequestTooLarge, fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit))
+			return
+		}
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "failed to read request body")
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+	// Malformed requests are answered before anything is charged for them.
+	// A payment may come without a body, only to buy a token. What a route's
+	// API accepts is its own business.
+	if route == nil {
+		paying, _ := m.payment(r)
+		if paying == "" || len(bytes.TrimSpace(bodyBytes)) > 0 {
+			if !enforceValid(w, bodyBytes) {
+				return
+			}
+		}
+		if !m.enforceBatchSize(w, bodyBytes) {
+			return
+		}
+		// Hooks see the request before the policy, which applies to the
+		// calls they leave.
+		if len(m.cfg.Hooks) > 0 && len(bytes.TrimSpace(bodyBytes)) > 0 {
+			if r, bodyBytes = m.runHooks(w, r, bodyBytes); r == nil {
+				return
+			}
+		}
+		if !m.enforcePolicy(w, bodyBytes) {
+			return
+		}
+		noteRequest(r, func(i *RequestInfo) { i.Methods = rpcMethods(bodyBytes) })
+	}
+
 	// Pass-through mode: no facilitator configured, skip payment gate entirely.
 	if m.cfg.Facilitator == nil {
-		m.cfg.Next.ServeHTTP(w, r)
+		release, ok := m.admit(w, "")
+		if !ok {
+			return
+		}
+		defer release()
+		m.next(r).ServeHTTP(w, r)
+		return
+	}
+
+	authHeader := r.Header.Get("Authorization")
+	paymentHeader, _ := m.payment(r)
+
+	// Free probes skip the gate, credentials or not, and are not verified; a
+	// payment is still processed so a client can buy a token with any request.
+	if paymentHeader == "" && m.isFree(r) {
+		release, ok := m.admit(w, "")
+		if !ok {
+			return
+		}
+		defer release()
+		r.Header.Del(rpcVerifyHeader)
+		m.next(r).ServeHTTP(w, r)
 		return
 	}
 
-	// --- Path 1: client presents a batch JWT ---
-	if authHeader := r.Header.Get("Authorization"); strings.HasPrefix(authHeader, "Bearer ") {
+	// --- Path 1: client presents a batch JWT together with a payment — top-up ---
+	if strings.HasPrefix(authHeader, "Bearer ") && paymentHeader != "" {
 		tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
-		handled := m.serveWithToken(w, r, tokenStr)
-		if handled {
+		if claims, err := m.cfg.Tokens.ValidateToken(tokenStr); err == nil {
+			m.handleTopUp(w, r, tokenStr, claims, paymentHeader)
 			return
 		}
-		// Token invalid/expired — fall through to payment path.
+		// Token invalid/expired — treat the payment as a fresh purchase below.
 	}
 
-	// --- Path 2: client presents an x402 payment payload ---
-	if paymentHeader := r.Header.Get(paymentSignatureHeader); paymentHeader != "" {
+	// --- Path 2: client presents a batch JWT ---
+	code := CodePaymentRequired
+	if strings.HasPrefix(authHeader, "Bearer ") && paymentHeader == "" {
+		tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
+		err := m.serveWithToken(w, r, tokenStr)
+		if err == nil {
+			return
+		}
+		// Token invalid/expired — fall through to the 402.
+		code = CodeTokenInvalid
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			code = CodeTokenExpired
+		}
+	}
+
+	// --- Path 3: client presents an x402 payment payload ---
+	if paymentHeader != "" {
 		m.handlePayment(w, r, paymentHeader)
 		return
 	}
 
-	// --- Path 3: no credentials — return 402 ---
-	m.send402(w)
+	// A client without credentials may be on its daily free allowance.
+	if code == CodePaymentRequired && m.cfg.FreeRequestsPerDay > 0 {
+		err := m.serveFreeTier(w, r)
+		if err == nil {
+			return
+		}
+		if errors.Is(err, ErrFreeTierExhausted) {
+			code = CodeFreeTierExhausted
+		}
+	}
+
+	// --- Path 4: no (usable) credentials — return 402 ---
+	m.send402WithCode(w, r, code, "")
+}
+
+// payment returns the encoded payment carried by r, accepting both the
+// Payment-Signature and X-PAYMENT conventions, and the header the settlement
+// result should be returned in.
+func (m *Middleware) payment(r *http.Request) (encoded, responseHeader string) {
+	sig := r.Header.Get(paymentSignatureHeader)
+	xp := r.Header.Get(xPaymentHeader)
+	switch {
+	case xp != "" && (sig == "" || m.cfg.PreferXPayment):
+		return xp, xPaymentResponseHeader
+	case sig != "":
+		return sig, paymentResponseHeader
+	}
+	return "", ""
+}
+
+// settlementResponse is the body of the (X-)Payment-Response header.
+type settlementResponse struct {
+	Success     bool   `json:"success"`
+	Transaction string `json:"transaction"`
+	Network     string `json:"network"`
+	Payer       string `json:"payer,omitempty"`
 }
 
 // serveWithToken validates the JWT and, if credits remain, proxies the request.
-// Returns true if the request is fully handled; false if the token is
-// structurally invalid/expired and the caller should try the payment path.
-func (m *Middleware) serveWithToken(w http.ResponseWriter, r *http.Request, tokenStr string) bool {
+// Returns nil if the request is fully handled, or the validation error if the
+// token is structurally invalid/expired and the caller should try the payment
+// path.
+func (m *Middleware) serveWithToken(w http.ResponseWriter, r *http.Request, tokenStr string) error {
 	claims, err := m.cfg.Tokens.ValidateToken(tokenStr)
 	if err != nil {
 		// Malformed or expired JWT — let the caller fall through.
-		return false
+		return err
+	}
+
+	m.serveClaims(w, r, claims)
+	return nil
+}
+
+// serveClaims spends one credit of a validated token and proxies the request.
+func (m *Middleware) serveClaims(w http.ResponseWriter, r *http.Request, claims *Claims) {
+	// Read the body up front: scoped tokens must be checked before a credit
+	// is consumed, and the method is logged either way.
+	bodyBytes, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "failed to read request body")
+		return
+	}
+	// Restore the body for the next handler.
+	r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+	noteRequest(r, func(i *RequestInfo) { i.TokenID, i.Payer = claims.TokenID, claims.Subject })
+	var calls []rpcCall
+	var methods []string
+	if routeOf(r) == nil {
+		calls, _ = rpcCalls(bodyBytes)
+		methods = rpcMethods(bodyBytes)
 	}
 
-	remaining, err := m.cfg.Tokens.UseRequest(claims)
+	if len(claims.Methods) > 0 {
+		// A batch is only allowed if every call in it is; an unparseable body
+		// has no method the scope could allow.
+		if len(methods) == 0 {
+			writeError(w, http.StatusForbidden, CodeMethodNotAllowed, "")
+			return
+		}
+		for _, method := range methods {
+			if !claims.AllowsMethod(method) {
+				slog.Info("method outside token scope", "tid", claims.TokenID, "method", method)
+				writeError(w, http.StatusForbidden, CodeMethodNotAllowed, fmt.Sprintf("method %q not allowed for this token", method))
+				return
+			}
+		}
+	}
+
+	// Rate limiting comes before accounting so a throttled call costs nothing.
+	if rl := claims.RateLimit; rl != nil && rl.RPS > 0 {
+		if ok, wait := m.limiters.allow(claims.TokenID, *rl); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, CodeRateLimited, "")
+			return
+		}
+	}
+	release, ok := m.admit(w, claims.TokenID)
+	if !ok {
+		return
+	}
+	defer release()
+
+	var premium int64
+	if r.Header.Get(rpcVerifyHeader) == "true" && routeOf(r) == nil {
+		premium = m.cfg.VerifiedCallCost
+	}
+	cost := m.cost(r, calls) + premium
+	remaining, err := m.cfg.Tokens.UseRequest(claims, cost)
 	if err != nil {
 		switch {
 		case errors.Is(err, ErrTokenExhausted):
-			slog.Info("token exhausted", "tid", claims.TokenID)
-			m.send402(w)
+			slog.Info("token exhausted", "tid", claims.TokenID, "cost", cost)
+			if claims.Metered {
+				// Normally settled on the last credit; this catches a failed attempt.
+				m.settleAsync(claims.TokenID)
+			}
+			if cost > 1 {
+				// Some credits may remain, just not enough for this call.
+				m.send402WithCode(w, r, CodeInsufficientCredits, "")
+				return
+			}
+			m.send402WithCode(w, r, CodeTokenExhausted, "")
+		case errors.Is(err, ErrTokenRevoked):
+			// Like token_not_found, answer directly rather than falling through
+			// to the payment path.
+			slog.Warn("revoked token presented", "tid", claims.TokenID)
+			m.send402WithCode(w, r, CodeTokenRevoked, "")
 		case errors.Is(err, ErrTokenNotFound):
 			// Valid JWT signature but no counter entry — server was restarted.
 			// The client holds a legitimately issued but now-unredeemable token.
-			// Return 402 directly; do NOT fall through to the payment path,
-			// which could cause an accidental double-charge if the request also
-			// carries a Payment-Signature header.
+			// Return 402 with a reason so the client knows to buy a new one.
 			slog.Warn("token not in store (server restarted?)", "tid", claims.TokenID)
-			m.send402WithReason(w, "token_not_found")
+			m.send402WithCode(w, r, CodeTokenNotFound, "")
 		default:
-			http.Error(w, "internal error", http.StatusInternalServerError)
+			slog.Error("token accounting failed", "tid", claims.TokenID, "err", err)
+			writeError(w, http.StatusInternalServerError, CodeInternal, "")
 		}
-		return true
+		return
 	}
 
-	// Extract the RPC method from the request body for logging.
-	bodyBytes, err := io.ReadAll(r.Body)
-	r.Body.Close()
 	method := ""
-	if err == nil {
-		var rpcReq map[string]interface{}
-		if err := json.Unmarshal(bodyBytes, &rpcReq); err == nil {
-			if m, ok := rpcReq["method"].(string); ok {
-				method = m
+	if len(methods) > 0 {
+		method = methods[0]
+	}
+	if rt := routeOf(r); rt != nil {
+		slog.Debug("proxying route request", "route", rt.Prefix, "method", r.Method, "tid", claims.TokenID, "cost", cost, "remaining", remaining)
+	} else {
+		slog.Debug("proxying RPC request", "method", method, "tid", claims.TokenID, "cost", cost, "remaining", remaining)
+	}
+
+	// Customers are not charged for calls the gateway failed to serve: if the
+	// upstream (or the proxy itself) answers 5xx, or rate-limits the gateway
+	// with 429, the credits are returned. The refund happens before the
+	// status line is sent so the remaining-credits header reflects it.
+	// Calls answered from the response cache are refunded down to
+	// CacheHitCost the same way, and the premium of calls left unverified.
+	charged := cost
+	rec := &statusRecorder{ResponseWriter: w}
+	rec.beforeHeader = func(status int) {
+		var refund int64
+		var reason string
+		switch {
+		case status >= http.StatusInternalServerError || status == http.StatusTooManyRequests:
+			refund, reason = cost, "refunded credits for failed upstream call"
+		case m.cfg.CacheHitCost >= 0 && w.Header().Get(rpcCacheHeader) == "HIT":
+			refund, reason = cost-m.cfg.CacheHitCost, "refunded credits for cached call"
+		case premium > 0 && w.Header().Get(rpcVerifiedHeader) != "true":
+			refund, reason = premium, "refunded premium for unverified call"
+		}
+		if refund > 0 {
+			refunded, err := m.cfg.Tokens.RefundRequest(claims, refund)
+			if err != nil {
+				slog.Error("credit refund failed", "tid", claims.TokenID, "status", status, "err", err)
+			} else {
+				slog.Info(reason, "tid", claims.TokenID, "status", status, "cost", cost, "refund", refund, "remaining", refunded)
+				remaining = refunded
+				charged = cost - refund
 			}
 		}
+		w.Header().Set(creditsRemainingHeader, fmt.Sprintf("%d", remaining))
+	}
+	m.next(r).ServeHTTP(rec, r)
+	if rec.status == 0 {
+		// The handler wrote nothing; net/http will send an empty 200.
+		rec.WriteHeader(http.StatusOK)
+	}
+	noteRequest(r, func(i *RequestInfo) { i.Remaining = remaining })
+	m.recordUsage(r, claims.Subject, calls, charged)
+	if m.cfg.Events != nil {
+		m.cfg.Events.Publish(EventCreditsUsed, map[string]any{
+			"tid":       claims.TokenID,
+			"payer":     claims.Subject,
+			"methods":   methods,
+			"credits":   charged,
+			"remaining": remaining,
+			"status":    rec.status,
+		})
 	}
-	// Restore the body for the next handler.
-	r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
 
-	slog.Info("proxying RPC request", "method", method, "tid", claims.TokenID, "remaining", remaining)
-	w.Header().Set(creditsRemainingHeader, fmt.Sprintf("%d", remaining))
-	m.cfg.Next.ServeHTTP(w, r)
-	return true
+	if remaining == 0 {
+		slog.Info("token used up", "tid", claims.TokenID)
+		m.notify(EventTokenExhausted, map[string]any{"tid": claims.TokenID, "counter": claims.CounterID(), "payer": claims.Subject})
+	}
+	// A metered token is paid for once its last credit is spent.
+	if claims.Metered && remaining == 0 {
+		m.settleAsync(claims.TokenID)
+	}
+}
+
+// rpcCall is the part of a JSON-RPC request the gateway inspects.
+type rpcCall struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+}
+
+// rpcCalls parses a JSON-RPC request or batch, reporting whether it was a
+// batch. Every element of a batch is returned, malformed ones with an empty
+// Method, since the upstream answers each of them. It returns nil if the body
+// is neither a JSON-RPC request nor a JSON array.
+func rpcCalls(body []byte) (calls []rpcCall, batch bool) {
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var elems []json.RawMessage
+		if err := json.Unmarshal(body, &elems); err != nil {
+			return nil, true
+		}
+		calls = make([]rpcCall, len(elems))
+		for i, e := range elems {
+			_ = json.Unmarshal(e, &calls[i])
+		}
+		return calls, true
+	}
+	var call rpcCall
+	if err := json.Unmarshal(body, &call); err != nil || call.Method == "" {
+		return nil, false
+	}
+	return []rpcCall{call}, false
+}
+
+// rpcMethods extracts the method names from a JSON-RPC request or batch. It
+// returns nil if the body is not valid JSON-RPC.
+func rpcMethods(body []byte) []string {
+	calls, _ := rpcCalls(body)
+	if calls == nil {
+		return nil
+	}
+	methods := make([]string, len(calls))
+	for i, c := range calls {
+		if c.Method == "" {
+			return nil
+		}
+		methods[i] = c.Method
+	}
+	return methods
+}
+
+// statusRecorder wraps a ResponseWriter to observe the status code, calling
+// beforeHeader just before the status line is sent.
+type statusRecorder struct {
+	http.ResponseWriter
+	status       int
+	beforeHeader func(status int)
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if status < http.StatusOK {
+		// Informational (1xx) responses precede the real status line.
+		r.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if r.status != 0 {
+		return
+	}
+	r.status = status
+	r.beforeHeader(status)
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer (flushing
+// streamed upstream responses).
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
 }
 
 // handlePayment processes an incoming x402 payment:
-// verify → settle → issue batch JWT → return token to client.
+// verify → settle → issue batch JWT → return token to client. In pay-and-call
+// mode a request with a JSON-RPC body is then proxied on the new token.
 func (m *Middleware) handlePayment(w http.ResponseWriter, r *http.Request, encoded string) {
-	payloadBytes, err := base64.StdEncoding.DecodeString(encoded)
+	p, ok := m.collectPayment(w, r, encoded, nil)
+	if !ok {
+		return
+	}
+	if p.confirming {
+		m.startConfirmation(w, r, p, nil, "")
+		return
+	}
+	if !m.wantsCall(r) {
+		m.issueToken(w, p)
+		return
+	}
+
+	tokenStr, ok := m.mintToken(w, p)
+	if !ok {
+		return
+	}
+	claims, err := m.cfg.Tokens.ValidateToken(tokenStr)
 	if err != nil {
-		http.Error(w, "invalid Payment-Signature encoding", http.StatusBadRequest)
+		// Can't happen for a token we just signed, but the client still paid.
+		slog.Error("freshly issued token failed validation", "err", err)
+		w.Header().Set(paymentTokenHeader, tokenStr)
+		writeError(w, http.StatusInternalServerError, CodeInternal, "")
 		return
 	}
+	// The token goes out with the RPC response, whatever its status.
+	w.Header().Set(paymentTokenHeader, tokenStr)
+	m.serveClaims(w, r, claims)
+}
 
-	// Deduplication: reject payment payloads we have already processed.
-	// This prevents a client from replaying one payment to receive multiple
-	// batch tokens. We use the SHA-256 of the raw payload as the key.
-	payloadHash := sha256.Sum256(payloadBytes)
-	m.seenMu.Lock()
-	_, seen := m.seenPayments[payloadHash]
-	if !seen {
-		m.seenPayments[payloadHash] = struct{}{}
+// isFree reports whether every JSON-RPC call in r's body is a free method.
+// Routes are never free.
+func (m *Middleware) isFree(r *http.Request) bool {
+	if len(m.freeMethods) == 0 || routeOf(r) != nil {
+		return false
+	}
+	bodyBytes, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+	if err != nil {
+		return false
+	}
+	methods := rpcMethods(bodyBytes)
+	for _, method := range methods {
+		if !m.freeMethods[method] {
+			return false
+		}
+	}
+	return len(methods) > 0
+}
+
+// wantsCall reports whether a paying request should also be proxied: the
+// pay-and-call mode is on and the body is a JSON-RPC request, or the request
+// is to a route.
+func (m *Middleware) wantsCall(r *http.Request) bool {
+	if !m.cfg.PayAndCall {
+		return false
+	}
+	if routeOf(r) != nil {
+		return true
+	}
+	bodyBytes, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+	return err == nil && len(rpcMethods(bodyBytes)) > 0
+}
+
+// mintToken issues a batch JWT for the offer a collected payment bought. On
+// failure it writes the error response and returns ok=false.
+func (m *Middleware) mintToken(w http.ResponseWriter, p *collectedPayment) (tokenStr string, ok bool) {
+	if p.offer.requirements.Scheme == SchemeUpto || p.deferred {
+		return m.mintUnsettledToken(w, p)
+	}
+	tokenStr, err := m.cfg.Tokens.IssueToken(p.result.Payer, p.offer.credits, p.offer.methods)
+	if err != nil {
+		slog.Error("failed to issue batch token", "err", err)
+		writeError(w, http.StatusInternalServerError, CodeInternal, "")
+		return "", false
 	}
-	m.seenMu.Unlock()
+	m.recordToken(p, tokenStr)
 
-	if seen {
-		http.Error(w, "payment already processed", http.StatusConflict)
+	slog.Info("issued batch token", "payer", p.result.Payer, "credits", p.offer.credits)
+	if p.watch {
+		if claims, err := m.cfg.Tokens.ValidateToken(tokenStr); err == nil {
+			go m.watchSettlement(p, claims, false)
+		} else {
+			slog.Error("freshly issued token failed validation", "err", err)
+		}
+	}
+	return tokenStr, true
+}
+
+// mintUnsettledToken issues a batch JWT for a payment settled later — an upto
+// payment, metered and settled for its usage, or a deferred one — and queues
+// the payment for settlement. Nothing has been charged yet, so if the payment
+// cannot be queued the token is revoked and the payment left unredeemed.
+func (m *Middleware) mintUnsettledToken(w http.ResponseWriter, p *collectedPayment) (tokenStr string, ok bool) {
+	var claims *Claims
+	var err error
+	if p.offer.requirements.Scheme == SchemeUpto {
+		tokenStr, claims, err = m.cfg.Tokens.IssueMeteredToken(p.result.Payer, p.offer.credits, p.offer.methods)
+	} else {
+		tokenStr, claims, err = m.cfg.Tokens.IssueUnsettledToken(p.result.Payer, p.offer.credits, p.offer.methods)
+	}
+	if err == nil {
+		// A metered payment falls due when its token expires (or sooner, once
+		// it is used up); a deferred one at once.
+		settleAt := time.Now()
+		if claims.Metered {
+			settleAt = claims.ExpiresAt.Time
+		}
+		if err = m.enqueueSettlement(p, claims, settleAt); err != nil {
+			if rerr := m.cfg.Tokens.Revoke(claims.TokenID); rerr != nil {
+				slog.Error("revoking unqueued token failed", "tid", claims.TokenID, "err", rerr)
+			}
+		}
+	}
+	if err != nil {
+		slog.Error("failed to issue unsettled token", "err", err)
+		if err := m.cfg.Replay.Release(p.replayKey); err != nil {
+			slog.Error("replay cache release failed", "err", err)
+		}
+		writeError(w, http.StatusInternalServerError, CodeInternal, "")
+		return "", false
+	}
+	m.recordToken(p, tokenStr)
+
+	if claims.Metered {
+		slog.Info("issued metered batch token", "payer", p.result.Payer, "tid", claims.TokenID, "max_credits", p.offer.credits)
+		return tokenStr, true
+	}
+	slog.Info("issued batch token, settlement deferred", "payer", p.result.Payer, "tid", claims.TokenID, "credits", p.offer.credits)
+	if m.cfg.SettlementBatchSize <= 1 {
+		m.settleAsync(claims.TokenID)
+	}
+	return tokenStr, true
+}
+
+// issueToken issues a batch JWT for the offer a collected payment bought and
+// returns it to the client in the X-Payment-Token header.
+func (m *Middleware) issueToken(w http.ResponseWriter, p *collectedPayment) {
+	credits := p.offer.credits
+	tokenStr, ok := m.mintToken(w, p)
+	if !ok {
 		return
 	}
 
+	w.Header().Set(paymentTokenHeader, tokenStr)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(withTransaction(map[string]interface{}{
+		"message": "payment accepted — retry your RPC request with the token",
+		"credits": credits,
+		"hint":    "set Authorization: Bearer <token from X-Payment-Token header>",
+	}, p.transaction))
+}
+
+// withTransaction adds the settlement transaction hash, when known, to a
+// payment-accepted response body.
+func withTransaction(body map[string]interface{}, tx string) map[string]interface{} {
+	if tx != "" {
+		body["transaction"] = tx
+	}
+	return body
+}
+
+// handleTopUp processes a payment presented alongside a valid batch JWT:
+// verify → settle → add credits to the existing token. The client keeps using
+// the same JWT instead of juggling several. In pay-and-call mode a request
+// with a JSON-RPC body is then proxied on the topped-up token.
+func (m *Middleware) handleTopUp(w http.ResponseWriter, r *http.Request, tokenStr string, claims *Claims, encoded string) {
+	// A metered token's usage is settled against the single permit it was
+	// issued for; extra credits would have nothing to be charged to.
+	if claims.Metered {
+		slog.Info("top-up of metered token refused", "tid", claims.TokenID)
+		m.send402WithCode(w, r, CodeMeteredTokenTopUp, "")
+		return
+	}
+
+	// Refuse before taking payment if the credits would have nowhere to go.
+	if err := m.cfg.Tokens.CheckUsable(claims); err != nil {
+		switch {
+		case errors.Is(err, ErrTokenRevoked):
+			slog.Warn("top-up for revoked token refused", "tid", claims.TokenID)
+			m.send402WithCode(w, r, CodeTokenRevoked, "")
+		case errors.Is(err, ErrTokenNotFound):
+			slog.Warn("top-up for unknown token refused (server restarted?)", "tid", claims.TokenID)
+			m.send402WithCode(w, r, CodeTokenNotFound, "")
+		default:
+			slog.Error("token lookup failed", "tid", claims.TokenID, "err", err)
+			writeError(w, http.StatusInternalServerError, CodeInternal, "")
+		}
+		return
+	}
+
+	p, ok := m.collectPayment(w, r, encoded, claims)
+	if !ok {
+		return
+	}
+	if p.confirming {
+		m.startConfirmation(w, r, p, claims, tokenStr)
+		return
+	}
+	credits := p.offer.credits
+
+	remaining, err := m.cfg.Tokens.AddCredits(claims, credits)
+	if err != nil {
+		// The payment has settled, so the client must get its credits somehow:
+		// fall back to a fresh token rather than keeping the money.
+		slog.Error("top-up failed after settlement, issuing new token", "tid", claims.TokenID, "err", err)
+		m.issueToken(w, p)
+		return
+	}
+	m.recordToken(p, tokenStr)
+	if p.watch {
+		go m.watchSettlement(p, claims, true)
+	}
+
+	slog.Info("topped up batch token",
+		"tid", claims.TokenID,
+		"payer", p.result.Payer,
+		"credits", credits,
+		"remaining", remaining,
+	)
+
+	if m.wantsCall(r) {
+		m.serveClaims(w, r, claims)
+		return
+	}
+
+	w.Header().Set(creditsRemainingHeader, fmt.Sprintf("%d", remaining))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(withTransaction(map[string]interface{}{
+		"message":   "top-up accepted — keep using your existing token",
+		"credits":   credits,
+		"remaining": remaining,
+	}, p.transaction))
+}
+
+// collectedPayment is a payment that has been verified and, unless it is an
+// upto payment or its settlement is deferred or must be confirmed, settled.
+type collectedPayment struct {
+	result      *VerifyResult
+	offer       *offer
+	replayKey   string
+	resendHash  string    // resendDigest of the payment, if its client can ask for a resend
+	payload     []byte    // decoded payment payload
+	validUntil  time.Time // when the authorization expires
+	deferred    bool      // settlement left to the background worker
+	confirming  bool      // to be settled and confirmed before crediting
+	transaction string    // settlement transaction hash, if reported
+	watch       bool      // transaction to be followed until mined
+}
+
+// recordToken remembers the token a payment was redeemed for, so a client
+// that resubmits the payment after losing the response gets it back.
+func (m *Middleware) recordToken(p *collectedPayment, tokenStr string) {
+	if err := m.cfg.Replay.SetToken(p.replayKey, tokenStr); err != nil {
+		// The credits are already issued; only a lost-response retry is affected.
+		slog.Error("replay cache token record failed", "err", err)
+	}
+}
+
+// collectPayment decodes, de-duplicates, verifies and settles the payment in
+// encoded. For a top-up, topUp is the token being topped up and the offer must
+// have the same method scope. On failure — or when the payment was already
+// redeemed and its token has been re-sent — it writes the response and
+// returns ok=false.
+func (m *Middleware) collectPayment(w http.ResponseWriter, r *http.Request, encoded string, topUp *Claims) (p *collectedPayment, ok bool) {
+	payloadBytes, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeInvalidPayment, "")
+		return nil, false
+	}
+
+	// A payment under an unknown or expired coupon would be matched against
+	// the regular prices; refuse it rather than charge more than expected.
+	set, ok := m.offersFor(r)
+	if !ok {
+		slog.Info("payment with invalid coupon refused", "coupon", r.Header.Get(couponHeader))
+		m.send402WithCode(w, r, CodeCouponInvalid, "")
+		return nil, false
+	}
+
+	// Work out which Accepts entry the client paid for; that entry's
+	// requirements are what the facilitator verifies against.
+	off, err := matchOffer(set.offers, payloadBytes)
+	if err != nil {
+		slog.Warn("payment matches no offer", "err", err)
+		if errors.Is(err, errAmountTooLow) {
+			m.send402WithCode(w, r, CodeAmountTooLow, "")
+		} else {
+			m.send402WithCode(w, r, CodeNoMatchingOffer, "")
+		}
+		return nil, false
+	}
+	// The payment must answer one of this deployment's challenges, by
+	// signing its nonce; the offer then carries it to the facilitator.
+	if m.cfg.ChallengeSecret != nil {
+		p, err := parseLocalPayload(payloadBytes)
+		if err != nil || !m.validChallenge(p.Accepted.Extra.Challenge, time.Now()) {
+			slog.Warn("payment without a valid challenge refused")
+			m.send402WithCode(w, r, CodeChallengeInvalid, "")
+			return nil, false
+		}
+		if !signsChallenge(p, &off.requirements, p.Accepted.Extra.Challenge) {
+			slog.Warn("payment not signed over its challenge refused")
+			m.send402WithCode(w, r, CodeChallengeInvalid, "")
+			return nil, false
+		}
+		if off, err = off.withChallenge(p.Accepted.Extra.Challenge); err != nil {
+			slog.Error("adding challenge to requirements failed", "err", err)
+			writeError(w, http.StatusInternalServerError, CodeInternal, "")
+			return nil, false
+		}
+	}
+	// Credits added to a token inherit its scope, so a top-up must buy a pack
+	// with the same one.
+	if topUp != nil && !sameMethods(off.methods, topUp.Methods) {
+		slog.Info("top-up pack scope differs from token", "tid", topUp.TokenID)
+		m.send402WithCode(w, r, CodeOfferScopeMismatch, "")
+		return nil, false
+	}
+	if topUp != nil && off.requirements.Scheme == SchemeUpto {
+		slog.Info("top-up with upto payment refused", "tid", topUp.TokenID)
+		m.send402WithCode(w, r, CodeUptoTopUpUnsupported, "")
+		return nil, false
+	}
+
+	// Deduplication: reject payment authorizations we have already processed.
+	// This prevents a client from replaying one payment to receive multiple
+	// batch tokens. The key is the EIP-3009 (network, asset, from, nonce) tuple,
+	// which the token contract itself treats as single-use, and it is kept
+	// until the authorization's validBefore has passed.
+	key, expiresAt := replayEntry(payloadBytes, &off.requirements)
+	resendHash := resendDigest(payloadBytes, r.Header.Get(paymentResendSecretHeader))
+	reserved, err := m.cfg.Replay.Reserve(key, resendHash, expiresAt)
+	if errors.Is(err, ErrReplayCacheFull) {
+		slog.Warn("replay cache full, rejecting payment")
+		w.Header().Set("Retry-After", "60")
+		writeError(w, http.StatusServiceUnavailable, CodeUnavailable, "payment processing temporarily unavailable")
+		return nil, false
+	}
+	if err != nil {
+		slog.Error("replay cache reserve failed", "err", err)
+		writeError(w, http.StatusInternalServerError, CodeInternal, "")
+		return nil, false
+	}
+	if !reserved {
+		m.resendToken(w, r, key, resendHash)
+		return nil, false
+	}
+
 	// Use the request context so client disconnects propagate to facilitator calls.
 	ctx := r.Context()
 
-	result, err := m.cfg.Facilitator.Verify(ctx, payloadBytes, m.requirementsJSON)
+	result, err := m.cfg.Facilitator.Verify(ctx, payloadBytes, off.requirementsJSON)
 	if err != nil {
 		slog.Warn("payment verification failed", "err", err)
-		// Remove the hash so the client can retry with a valid payment.
-		m.seenMu.Lock()
-		delete(m.seenPayments, payloadHash)
-		m.seenMu.Unlock()
-		http.Error(w, "payment verification failed", http.StatusPaymentRequired)
-		return
+		// Forget the key so the client can retry with a valid payment.
+		if err := m.cfg.Replay.Release(key); err != nil {
+			slog.Error("replay cache release failed", "err", err)
+		}
+		code, message := CodeVerificationFailed, ""
+		switch {
+		case errors.Is(err, ErrInsufficientFunds):
+			code = CodeInsufficientFunds
+		case errors.Is(err, ErrSettlementWouldRevert):
+			// The revert reason tells the client what to fix.
+			code, message = CodeWouldRevert, err.Error()
+		}
+		m.send402WithCode(w, r, code, message)
+		return nil, false
 	}
 
-	if err := m.cfg.Facilitator.Settle(ctx, payloadBytes, m.requirementsJSON); err != nil {
+	noteRequest(r, func(i *RequestInfo) { i.Payer = result.Payer })
+	if err := m.cfg.Tokens.CheckPayer(result.Payer); err != nil {
+		// Nothing has been settled yet, so the authorization stays unused.
+		if err := m.cfg.Replay.Release(key); err != nil {
+			slog.Error("replay cache release failed", "err", err)
+		}
+		if errors.Is(err, ErrTokenRevoked) {
+			slog.Warn("payment from revoked account refused", "payer", result.Payer)
+			writeError(w, http.StatusForbidden, CodePayerRevoked, "")
+			return nil, false
+		}
+		slog.Error("payer lookup failed", "payer", result.Payer, "err", err)
+		writeError(w, http.StatusInternalServerError, CodeInternal, "")
+		return nil, false
+	}
+
+	m.notify(EventPaymentVerified, paymentEventData(&off.requirements, result.Payer, off.credits, key))
+	w.Header().Set(paymentHashHeader, paymentHash(key))
+	if set.coupon != nil {
+		slog.Info("coupon redeemed", "coupon", set.coupon.Code, "payer", result.Payer, "amount", off.requirements.Amount, "credits", off.credits)
+	}
+
+	collected := &collectedPayment{result: result, offer: off, replayKey: key, resendHash: resendHash, payload: payloadBytes, validUntil: expiresAt}
+	if off.requirements.Scheme == SchemeUpto {
+		// Settled for actual usage once the token is exhausted or expires.
+		return collected, true
+	}
+	if m.cfg.AsyncSettlement && topUp == nil {
+		// Settled in the background once the token has been issued.
+		collected.deferred = true
+		return collected, true
+	}
+	if m.cfg.Confirmations > 0 {
+		// Settled by startConfirmation, which answers with a poll URL.
+		collected.confirming = true
+		return collected, true
+	}
+
+	m.notify(EventSettlementSubmitted, paymentEventData(&off.requirements, result.Payer, off.credits, key))
+	settled, err := m.cfg.Facilitator.Settle(ctx, payloadBytes, off.requirementsJSON)
+	if err != nil {
 		slog.Warn("payment settlement failed", "err", err)
-		// Do NOT remove the hash here: the payment may have been partially settled.
+		failed := paymentEventData(&off.requirements, result.Payer, off.credits, key)
+		failed["error"] = err.Error()
+		failed["willRetry"] = m.cfg.Settlements != nil
+		m.notify(EventSettlementFailed, failed)
+		// Do NOT release the key here: the payment may have been partially settled.
+		if m.cfg.Settlements != nil {
+			// Retried in the background; the client collects its token by
+			// resubmitting the payment once it has settled.
+			m.queueFailedSettlement(collected, err)
+			w.Header().Set("Retry-After", strconv.Itoa(int(settlePendingRetryAfter.Seconds())))
+			writeError(w, http.StatusServiceUnavailable, CodeSettlementPending, "")
+			return nil, false
+		}
 		// The facilitator is expected to be idempotent; the client should contact
 		// support if they believe they were charged without receiving a token.
-		http.Error(w, fmt.Sprintf("payment settlement failed: %v", err), http.StatusPaymentRequired)
+		m.send402WithCode(w, r, CodeSettlementFailed, fmt.Sprintf("payment settlement failed: %v", err))
+		return nil, false
+	}
+
+	collected.transaction = settled.Transaction
+	m.trackTransaction(key, settled.Transaction)
+	if _, ok := m.receiptFacilitator(settled.Transaction); ok {
+		// Reported confirmed, or reverted, once mined.
+		collected.watch = true
+	} else {
+		confirmed := paymentEventData(&off.requirements, result.Payer, off.credits, key)
+		confirmed["transaction"] = settled.Transaction
+		m.notify(EventSettlementConfirmed, confirmed)
+	}
+	if settled.Transaction != "" {
+		w.Header().Set(settlementTxHeader, settled.Transaction)
+	}
+
+	// Tell x402 clients the payment went through, in the header matching the
+	// convention they paid with.
+	if _, responseHeader := m.payment(r); responseHeader != "" {
+		resp, _ := json.Marshal(settlementResponse{
+			Success:     true,
+			Transaction: settled.Transaction,
+			Network:     off.requirements.Network,
+			Payer:       result.Payer,
+		})
+		w.Header().Set(responseHeader, base64.StdEncoding.EncodeToString(resp))
+	}
+
+	return collected, true
+}
+
+// resendToken answers a resubmitted payment whose replay key is key and
+// resendDigest resendHash. If the payment was redeemed, the client most likely
+// never saw the response (a network blip after settlement), so the original
+// token is returned rather than keeping the money. Everything in the payment
+// is public once it reaches the mempool, so only a client that sent it with a
+// resend secret, and sends the same one again, gets the token. A payment
+// still in flight, whose settlement failed, or resubmitted without its secret
+// is rejected as before.
+func (m *Middleware) resendToken(w http.ResponseWriter, r *http.Request, key, resendHash string) {
+	if resendHash == "" {
+		writeError(w, http.StatusConflict, CodePaymentProcessed, "")
+		return
+	}
+
+	// A payment awaiting confirmations answers with its status instead.
+	if job := m.confirming.byReplayKey(key); job != nil {
+		if job.resendHash != resendHash {
+			writeError(w, http.StatusConflict, CodePaymentProcessed, "")
+			return
+		}
+		m.writePendingPayment(w, r, job)
 		return
 	}
 
-	tokenStr, err := m.cfg.Tokens.IssueToken(result.Payer, m.cfg.RequestsPerPayment)
+	tokenStr, recorded, err := m.cfg.Replay.Token(key)
 	if err != nil {
-		slog.Error("failed to issue batch token", "err", err)
-		http.Error(w, "internal error", http.StatusInternalServerError)
+		slog.Error("replay cache token lookup failed", "err", err)
+		writeError(w, http.StatusInternalServerError, CodeInternal, "")
+		return
+	}
+	if tokenStr == "" || recorded != resendHash {
+		writeError(w, http.StatusConflict, CodePaymentProcessed, "")
 		return
 	}
 
-	slog.Info("issued batch token", "payer", result.Payer, "credits", m.cfg.RequestsPerPayment)
+	slog.Info("re-sent token for resubmitted payment")
 
 	w.Header().Set(paymentTokenHeader, tokenStr)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	_ = json.NewEncoder(w).Encode(map[string]interface{}{
-		"message": "payment accepted — retry your RPC request with the token",
-		"credits": m.cfg.RequestsPerPayment,
+		"message": "payment already processed — returning the token it was redeemed for",
 		"hint":    "set Authorization: Bearer <token from X-Payment-Token header>",
 	})
 }
 
 // send402 writes a standard 402 Payment Required response.
-func (m *Middleware) send402(w http.ResponseWriter) {
-	m.send402WithReason(w, "")
+func (m *Middleware) send402(w http.ResponseWriter, r *http.Request) {
+	m.send402WithCode(w, r, CodePaymentRequired, "")
 }
 
-// send402WithReason writes a 402 response with an optional machine-readable
-// reason code so clients can distinguish different 402 causes.
-func (m *Middleware) send402WithReason(w http.ResponseWriter, reason string) {
-	w.Header().Set(paymentRequiredHeader, m.payload402)
+// send402WithCode writes a 402 response: the x402 offers — those of r's
+// coupon, if any — with the error code telling the client why it must pay. An
+// empty message uses the code's default one.
+func (m *Middleware) send402WithCode(w http.ResponseWriter, r *http.Request, code ErrorCode, message string) {
+	set, ok := m.offersFor(r)
+	if !ok && code == CodePaymentRequired {
+		code = CodeCouponInvalid
+	}
+	payloadJSON, payload402 := set.payloadJSON, set.payload402
+	if m.cfg.ChallengeSecret != nil {
+		var err error
+		payloadJSON, payload402, err = set.withChallenge(m.newChallenge(time.Now()))
+		if err != nil {
+			slog.Error("adding challenge to 402 payload failed", "err", err)
+			writeError(w, http.StatusInternalServerError, CodeInternal, "")
+			return
+		}
+	}
+	w.Header().Set(paymentRequiredHeader, payload402)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusPaymentRequired)
 
-	body := struct {
-		X402Version int                     `json:"x402Version"`
-		Error       string                  `json:"error"`
-		Resource    paymentResourceV2       `json:"resource"`
-		Accepts     []paymentRequirementsV2 `json:"accepts"`
-		Reason      string                  `json:"reason,omitempty"`
-	}{}
-	_ = json.Unmarshal(m.payloadJSON, &body)
-	body.Reason = reason
+	var body struct {
+		paymentRequiredV2
+		errorResponse
+	}
+	_ = json.Unmarshal(payloadJSON, &body.paymentRequiredV2)
+	body.errorResponse = newErrorResponse(code, message)
+	body.Error = body.Message
 	_ = json.NewEncoder(w).Encode(body)
 }
@@ -0,0 +1,21 @@
+-- Batch tokens and their authoritative credit counters.
+CREATE TABLE IF NOT EXISTS x402_tokens (
+    token_id   TEXT        PRIMARY KEY,
+    total      BIGINT      NOT NULL CHECK (total >= 0),
+    used       BIGINT      NOT NULL DEFAULT 0 CHECK (used >= 0),
+    issued_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CHECK (used <= total)
+);
+
+-- Append-only record of every credit movement, for reporting and disputes.
+CREATE TABLE IF NOT EXISTS x402_token_events (
+    id         BIGSERIAL   PRIMARY KEY,
+    token_id   TEXT        NOT NULL REFERENCES x402_tokens (token_id),
+    kind       TEXT        NOT NULL,
+    delta      BIGINT      NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS x402_token_events_token_id_idx
+    ON x402_token_events (token_id, created_at);
@@ -0,0 +1,5 @@
+-- Payment authorizations that have already been redeemed for a batch token.
+CREATE TABLE IF NOT EXISTS x402_replay_cache (
+    key        TEXT        PRIMARY KEY,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
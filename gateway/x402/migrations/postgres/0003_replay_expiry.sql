@@ -0,0 +1,6 @@
+-- Replay entries only need to outlive the authorization's validBefore.
+ALTER TABLE x402_replay_cache
+    ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ NOT NULL DEFAULT now() + interval '1 day';
+
+CREATE INDEX IF NOT EXISTS x402_replay_cache_expires_at_idx
+    ON x402_replay_cache (expires_at);
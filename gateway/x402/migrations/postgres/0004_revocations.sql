@@ -0,0 +1,5 @@
+-- Tokens an operator has revoked. Rows are never deleted.
+CREATE TABLE IF NOT EXISTS x402_revoked_tokens (
+    token_id   TEXT        PRIMARY KEY REFERENCES x402_tokens (token_id),
+    revoked_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
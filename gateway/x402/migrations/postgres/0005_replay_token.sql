@@ -0,0 +1,5 @@
+-- The batch token a payment was redeemed for, re-sent if the client submits
+-- the same payment again after losing the response. Holds bearer credentials,
+-- so restrict access to this table accordingly.
+ALTER TABLE x402_replay_cache
+    ADD COLUMN IF NOT EXISTS token TEXT;
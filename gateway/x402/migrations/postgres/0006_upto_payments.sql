@@ -0,0 +1,14 @@
+-- Upto-scheme permits awaiting their metered settlement: the client's payload
+-- and the offer it was made against, settled for the token's usage once it is
+-- exhausted or settle_at has passed.
+CREATE TABLE IF NOT EXISTS x402_upto_payments (
+    token_id     TEXT        PRIMARY KEY,
+    payload      BYTEA       NOT NULL,
+    requirements BYTEA       NOT NULL,
+    credits      BIGINT      NOT NULL,
+    settle_at    TIMESTAMPTZ NOT NULL,
+    deadline     TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS x402_upto_payments_settle_at_idx
+    ON x402_upto_payments (settle_at);
@@ -0,0 +1,5 @@
+-- Pending settlements now also hold payments settled asynchronously, not
+-- just upto permits, and count failed attempts for the retry backoff.
+ALTER TABLE x402_upto_payments RENAME TO x402_pending_settlements;
+ALTER INDEX x402_upto_payments_settle_at_idx RENAME TO x402_pending_settlements_settle_at_idx;
+ALTER TABLE x402_pending_settlements ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0;
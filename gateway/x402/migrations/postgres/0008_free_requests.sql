@@ -0,0 +1,10 @@
+-- Free tier usage: the free requests each client has made per day, keyed by
+-- client and day, kept until expires_at for pruning.
+CREATE TABLE IF NOT EXISTS x402_free_requests (
+    key        TEXT        PRIMARY KEY,
+    used       BIGINT      NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS x402_free_requests_expires_at_idx
+    ON x402_free_requests (expires_at);
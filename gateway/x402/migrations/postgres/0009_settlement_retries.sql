@@ -0,0 +1,26 @@
+-- Failed synchronous settlements are retried from the pending settlements
+-- table too: they have no token yet, so the row carries what is needed to
+-- issue one once the payment settles. Settlements given up on move to
+-- x402_dead_settlements until an operator retries or discards them.
+ALTER TABLE x402_pending_settlements
+    ADD COLUMN replay_key TEXT    NOT NULL DEFAULT '',
+    ADD COLUMN payer      TEXT    NOT NULL DEFAULT '',
+    ADD COLUMN methods    TEXT    NOT NULL DEFAULT '',
+    ADD COLUMN unissued   BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN last_error TEXT    NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS x402_dead_settlements (
+    token_id     TEXT        PRIMARY KEY,
+    payload      BYTEA       NOT NULL,
+    requirements BYTEA       NOT NULL,
+    credits      BIGINT      NOT NULL,
+    settle_at    TIMESTAMPTZ NOT NULL,
+    deadline     TIMESTAMPTZ NOT NULL,
+    attempts     INTEGER     NOT NULL,
+    replay_key   TEXT        NOT NULL,
+    payer        TEXT        NOT NULL,
+    methods      TEXT        NOT NULL,
+    unissued     BOOLEAN     NOT NULL,
+    last_error   TEXT        NOT NULL,
+    failed_at    TIMESTAMPTZ NOT NULL
+);
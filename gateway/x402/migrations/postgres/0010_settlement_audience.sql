@@ -0,0 +1,4 @@
+-- Payments bought on a chain route are settled with their route recorded, so
+-- a token issued once the payment settles is scoped to it.
+ALTER TABLE x402_pending_settlements ADD COLUMN audience TEXT NOT NULL DEFAULT '';
+ALTER TABLE x402_dead_settlements ADD COLUMN audience TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,20 @@
+-- Usage reports: the calls and credits each payer spent per method, and what
+-- each payer paid per asset, added up by hour.
+CREATE TABLE IF NOT EXISTS x402_usage (
+    hour    TIMESTAMPTZ NOT NULL,
+    payer   TEXT        NOT NULL,
+    method  TEXT        NOT NULL,
+    calls   BIGINT      NOT NULL,
+    credits BIGINT      NOT NULL,
+    PRIMARY KEY (hour, payer, method)
+);
+
+CREATE TABLE IF NOT EXISTS x402_revenue (
+    hour     TIMESTAMPTZ    NOT NULL,
+    payer    TEXT           NOT NULL,
+    network  TEXT           NOT NULL,
+    asset    TEXT           NOT NULL,
+    payments BIGINT         NOT NULL,
+    amount   NUMERIC(78, 0) NOT NULL,
+    PRIMARY KEY (hour, payer, network, asset)
+);
@@ -0,0 +1,19 @@
+-- Ledger: balanced double-entry transactions for every payment, settlement
+-- and credit issued, spent, refunded or forfeited, and the balances of the
+-- accounts they post to.
+CREATE TABLE IF NOT EXISTS x402_ledger_entries (
+    seq      BIGSERIAL   PRIMARY KEY,
+    time     TIMESTAMPTZ NOT NULL,
+    kind     TEXT        NOT NULL,
+    ref      TEXT        NOT NULL,
+    postings JSONB       NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS x402_ledger_entries_time ON x402_ledger_entries (time);
+
+CREATE TABLE IF NOT EXISTS x402_ledger_balances (
+    account TEXT           NOT NULL,
+    unit    TEXT           NOT NULL,
+    balance NUMERIC(78, 0) NOT NULL,
+    PRIMARY KEY (account, unit)
+);
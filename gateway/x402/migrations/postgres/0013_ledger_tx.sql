@@ -0,0 +1,3 @@
+-- The transaction of each settlement entry, for reconciling the ledger with
+-- the transfers seen on chain.
+ALTER TABLE x402_ledger_entries ADD COLUMN IF NOT EXISTS tx TEXT NOT NULL DEFAULT '';
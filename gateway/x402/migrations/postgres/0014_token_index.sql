@@ -0,0 +1,17 @@
+-- Token index: what each token was issued with, for operators to find a
+-- payer's tokens. payer_key is the payer folded the way addresses compare.
+CREATE TABLE IF NOT EXISTS x402_issued_tokens (
+    token_id   TEXT        PRIMARY KEY,
+    payer      TEXT        NOT NULL,
+    payer_key  TEXT        NOT NULL,
+    counter    TEXT        NOT NULL,
+    audience   TEXT        NOT NULL,
+    credits    BIGINT      NOT NULL,
+    methods    TEXT        NOT NULL,
+    metered    BOOLEAN     NOT NULL,
+    issued_at  TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS x402_issued_tokens_payer ON x402_issued_tokens (payer_key, issued_at);
+CREATE INDEX IF NOT EXISTS x402_issued_tokens_expires ON x402_issued_tokens (expires_at);
@@ -0,0 +1,5 @@
+-- The hash of the payment payload and the client's resend secret. A recorded
+-- token is only re-sent to a client reproducing it: the replay key is built
+-- from fields anyone can read on-chain.
+ALTER TABLE x402_replay_cache
+    ADD COLUMN IF NOT EXISTS payload_hash TEXT;
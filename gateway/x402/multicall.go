@@ -0,0 +1,417 @@
+package x402
+
+// Settlement batching: EIP-3009 payments are redeemed through Multicall3's
+// aggregate3, many transferWithAuthorization calls in one transaction, so
+// each payment pays a share of one transaction's overhead instead of its own.
+// The calls are simulated first and the failing ones left out, and every
+// call is allowed to fail on-chain, so one bad payment cannot sink the rest.
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// Multicall3Address is the canonical Multicall3 deployment, at the same
+// address on every supported chain.
+var Multicall3Address = common.HexToAddress("0xcA11bde05977b3631167028862bE2a173976CA11")
+
+var (
+	// aggregate3Sig is the selector for
+	// Multicall3.aggregate3((address,bool,bytes)[]).
+	aggregate3Sig = crypto.Keccak256([]byte("aggregate3((address,bool,bytes)[])"))[:4]
+	// authorizationStateSig is the selector for
+	// EIP-3009 authorizationState(address,bytes32).
+	authorizationStateSig = crypto.Keccak256([]byte("authorizationState(address,bytes32)"))[:4]
+	// errorStringSig is the selector of a Solidity revert reason.
+	errorStringSig = crypto.Keccak256([]byte("Error(string)"))[:4]
+	// authorizationUsedTopic is the topic of EIP-3009
+	// AuthorizationUsed(address indexed authorizer, bytes32 indexed nonce),
+	// emitted by a transfer with authorization but not by a cancellation.
+	authorizationUsedTopic = crypto.Keccak256Hash([]byte("AuthorizationUsed(address,bytes32)"))
+)
+
+// authorizationLogLookback is how many blocks back the AuthorizationUsed log
+// of an authorization redeemed outside a known batch is looked for.
+const authorizationLogLookback = 50_000
+
+// batchCall is one payment's transferWithAuthorization in a batch.
+type batchCall struct {
+	index int
+	token common.Address
+	from  common.Address
+	nonce [32]byte
+	data  []byte
+}
+
+// Batchable reports whether payments made against requirementsBytes can be
+// settled in a batch: EIP-3009 transfer authorizations. A Permit2 permit
+// names the relayer as spender and a receive authorization the payee as
+// caller, so neither can be redeemed through Multicall3.
+func (f *LocalFacilitator) Batchable(requirementsBytes []byte) bool {
+	req, err := parseRequirements(requirementsBytes)
+	if err != nil {
+		return false
+	}
+	return batchable(req)
+}
+
+func batchable(req *paymentRequirementsV2) bool {
+	return !usesPermit2(req.Scheme) && req.Extra.PrimaryType != PrimaryTypeReceiveWithAuthorization
+}
+
+// SettleBatch settles EIP-3009 payments in one Multicall3 transaction and
+// waits for it to be mined. A payment whose authorization has already been
+// used counts as settled only if its AuthorizationUsed log is found, in the
+// batch transaction an earlier attempt whose outcome was lost submitted it in
+// or in the recent blocks, and by that log's transaction. An authorization
+// used without one was canceled by its payer, and fails.
+func (f *LocalFacilitator) SettleBatch(ctx context.Context, payments []BatchPayment) ([]BatchResult, error) {
+	start := time.Now()
+	results, err := f.settleBatch(ctx, payments)
+	if len(payments) > 0 {
+		observeCall("local", "settle_batch", payments[0].Requirements, start, err)
+	}
+	return results, err
+}
+
+func (f *LocalFacilitator) settleBatch(ctx context.Context, payments []BatchPayment) ([]BatchResult, error) {
+	results := make([]BatchResult, len(payments))
+	var calls []*batchCall
+	for i, bp := range payments {
+		c, err := newBatchCall(i, bp)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		calls = append(calls, c)
+	}
+	if len(calls) == 0 {
+		return results, nil
+	}
+
+	client, err := f.dial(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("rpc connect: %w", err)
+	}
+	defer client.Close()
+
+	var unredeemed []*batchCall
+	for _, c := range calls {
+		used, err := authorizationUsed(ctx, client, c)
+		if err != nil {
+			return nil, fmt.Errorf("authorization state: %w", err)
+		}
+		if !used {
+			unredeemed = append(unredeemed, c)
+			continue
+		}
+		tx, err := f.redemption(ctx, client, c)
+		switch {
+		case err != nil:
+			return nil, fmt.Errorf("authorization redemption: %w", err)
+		case tx == (common.Hash{}):
+			results[c.index].Err = errors.New("authorization used without a transfer: canceled by its payer")
+		default:
+			results[c.index].Transaction = tx.Hex()
+		}
+		f.forgetBatch(c)
+	}
+	if len(unredeemed) == 0 {
+		return results, nil
+	}
+
+	// Leave out the calls that would fail now.
+	out, err := client.CallContract(ctx, ethereum.CallMsg{
+		From: f.address,
+		To:   &Multicall3Address,
+		Data: packAggregate3(unredeemed),
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("simulating batch: %w", err)
+	}
+	ok, returned, err := unpackAggregate3(out, len(unredeemed))
+	if err != nil {
+		return nil, fmt.Errorf("simulating batch: %w", err)
+	}
+	var batch []*batchCall
+	for i, c := range unredeemed {
+		if !ok[i] {
+			results[c.index].Err = fmt.Errorf("settlement call reverted: %s", revertReason(returned[i]))
+			continue
+		}
+		batch = append(batch, c)
+	}
+	if len(batch) == 0 {
+		return results, nil
+	}
+
+	hash, err := f.submit(ctx, f.rotation(), Multicall3Address, packAggregate3(batch))
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("batch settlement tx submitted", "hash", hash.Hex(), "payments", len(batch))
+	for _, c := range batch {
+		f.recordBatch(c, hash)
+	}
+	mined, err := f.waitConfirmed(ctx, hash, 1)
+	if err != nil {
+		return nil, err
+	}
+	receipt, err := client.TransactionReceipt(ctx, mined)
+	if err != nil {
+		return nil, fmt.Errorf("batch receipt: %w", err)
+	}
+
+	// A call can still have failed on-chain, had its payer moved the funds
+	// since the simulation.
+	for _, c := range batch {
+		if redeemedIn(receipt, c) {
+			results[c.index].Transaction = mined.Hex()
+		} else {
+			results[c.index].Err = fmt.Errorf("settlement call reverted in batch %s", mined.Hex())
+		}
+		f.forgetBatch(c)
+	}
+	return results, nil
+}
+
+// key identifies c's authorization among the batches submitted.
+func (c *batchCall) key() string {
+	return c.token.Hex() + "|" + c.from.Hex() + "|" + common.Hash(c.nonce).Hex()
+}
+
+// recordBatch remembers that c was submitted in the batch transaction hash.
+func (f *LocalFacilitator) recordBatch(c *batchCall, hash common.Hash) {
+	f.batchMu.Lock()
+	defer f.batchMu.Unlock()
+	if f.batchTxs == nil {
+		f.batchTxs = make(map[string]common.Hash)
+	}
+	f.batchTxs[c.key()] = hash
+}
+
+// forgetBatch drops the batch transaction c was recorded in, once its
+// outcome is reported.
+func (f *LocalFacilitator) forgetBatch(c *batchCall) {
+	f.batchMu.Lock()
+	defer f.batchMu.Unlock()
+	delete(f.batchTxs, c.key())
+}
+
+// redemption returns the transaction that redeemed c's used authorization:
+// the batch it was recorded in, or else the latest of the last
+// authorizationLogLookback blocks with its AuthorizationUsed log. It returns
+// the zero hash if neither shows it redeemed.
+func (f *LocalFacilitator) redemption(ctx context.Context, client *ethclient.Client, c *batchCall) (common.Hash, error) {
+	f.batchMu.Lock()
+	recorded, ok := f.batchTxs[c.key()]
+	f.batchMu.Unlock()
+	if ok {
+		// Any replacement sent for the batch carries the same calls.
+		for _, h := range f.replacements(recorded) {
+			receipt, err := client.TransactionReceipt(ctx, h)
+			if errors.Is(err, ethereum.NotFound) {
+				continue
+			}
+			if err != nil {
+				return common.Hash{}, err
+			}
+			if redeemedIn(receipt, c) {
+				return h, nil
+			}
+		}
+	}
+
+	head, err := client.BlockNumber(ctx)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	floor := uint64(0)
+	if head > authorizationLogLookback {
+		floor = head - authorizationLogLookback
+	}
+	hi := head
+	for {
+		lo := max(floor, hi-min(hi, reconcileLogBlocks-1))
+		logs, err := client.FilterLogs(ctx, ethereum.FilterQuery{
+			FromBlock: new(big.Int).SetUint64(lo),
+			ToBlock:   new(big.Int).SetUint64(hi),
+			Addresses: []common.Address{c.token},
+			Topics:    [][]common.Hash{{authorizationUsedTopic}, {common.BytesToHash(c.from.Bytes())}, {c.nonce}},
+		})
+		if err != nil {
+			return common.Hash{}, fmt.Errorf("authorization logs of blocks %d-%d: %w", lo, hi, err)
+		}
+		for i := len(logs) - 1; i >= 0; i-- {
+			if !logs[i].Removed {
+				return logs[i].TxHash, nil
+			}
+		}
+		if lo == floor {
+			return common.Hash{}, nil
+		}
+		hi = lo - 1
+	}
+}
+
+// redeemedIn reports whether receipt holds the AuthorizationUsed log of c's
+// authorization.
+func redeemedIn(receipt *types.Receipt, c *batchCall) bool {
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		return false
+	}
+	for _, l := range receipt.Logs {
+		if l.Address == c.token && len(l.Topics) == 3 && l.Topics[0] == authorizationUsedTopic &&
+			l.Topics[1] == common.BytesToHash(c.from.Bytes()) && l.Topics[2] == common.Hash(c.nonce) {
+			return true
+		}
+	}
+	return false
+}
+
+// newBatchCall builds the call redeeming payment i of a batch.
+func newBatchCall(i int, bp BatchPayment) (*batchCall, error) {
+	p, err := parseLocalPayload(bp.Payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := parseRequirements(bp.Requirements)
+	if err != nil {
+		return nil, err
+	}
+	if !batchable(req) {
+		return nil, fmt.Errorf("scheme %s cannot be settled in a batch", req.Scheme)
+	}
+	data, nonce, err := authorizationCall(p, req)
+	if err != nil {
+		return nil, err
+	}
+	return &batchCall{
+		index: i,
+		token: common.HexToAddress(req.Asset),
+		from:  common.HexToAddress(p.Payload.Authorization.From),
+		nonce: nonce,
+		data:  data,
+	}, nil
+}
+
+// authorizationUsed reports whether c's authorization has been redeemed.
+func authorizationUsed(ctx context.Context, client *ethclient.Client, c *batchCall) (bool, error) {
+	state, err := callUint(ctx, client, c.token, authorizationStateSig, addrPad(c.from), c.nonce[:])
+	if err != nil {
+		return false, err
+	}
+	return state.Sign() != 0, nil
+}
+
+// packAggregate3 ABI-encodes an aggregate3 call making every call with
+// allowFailure set.
+func packAggregate3(calls []*batchCall) []byte {
+	data := append([]byte(nil), aggregate3Sig...)
+	data = append(data, pad32(big.NewInt(32))...) // offset of the array
+	data = append(data, pad32(big.NewInt(int64(len(calls))))...)
+
+	// The heads are the offsets of the (address,bool,bytes) tuples, counted
+	// from the first head.
+	var tails []byte
+	for _, c := range calls {
+		data = append(data, pad32(big.NewInt(int64(32*len(calls)+len(tails))))...)
+		tuple := make([]byte, 4*32+(len(c.data)+31)/32*32)
+		copy(tuple[12:32], c.token.Bytes())
+		tuple[63] = 1    // allowFailure
+		tuple[95] = 0x60 // offset of callData in the tuple
+		copy(tuple[96:128], pad32(big.NewInt(int64(len(c.data)))))
+		copy(tuple[128:], c.data)
+		tails = append(tails, tuple...)
+	}
+	return append(data, tails...)
+}
+
+// unpackAggregate3 decodes aggregate3's (bool,bytes)[] result, which must
+// have n entries, into each call's success flag and return data.
+func unpackAggregate3(out []byte, n int) ([]bool, [][]byte, error) {
+	array, err := abiWord(out, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	length, err := abiWord(out, array)
+	if err != nil {
+		return nil, nil, err
+	}
+	if length != uint64(n) {
+		return nil, nil, fmt.Errorf("batch returned %d results for %d calls", length, n)
+	}
+	heads := array + 32
+	ok := make([]bool, n)
+	returned := make([][]byte, n)
+	for i := range n {
+		rel, err := abiWord(out, heads+uint64(32*i))
+		if err != nil {
+			return nil, nil, err
+		}
+		tuple := heads + rel
+		success, err := abiWord(out, tuple)
+		if err != nil {
+			return nil, nil, err
+		}
+		rel, err = abiWord(out, tuple+32)
+		if err != nil {
+			return nil, nil, err
+		}
+		size, err := abiWord(out, tuple+rel)
+		if err != nil {
+			return nil, nil, err
+		}
+		start := tuple + rel + 32
+		if start+size > uint64(len(out)) {
+			return nil, nil, errors.New("short batch result")
+		}
+		ok[i] = success != 0
+		returned[i] = out[start : start+size]
+	}
+	return ok, returned, nil
+}
+
+// abiWord reads the 32-byte word at off as an offset or length, which cannot
+// exceed the size of out.
+func abiWord(out []byte, off uint64) (uint64, error) {
+	if off > uint64(len(out)) || uint64(len(out))-off < 32 {
+		return 0, errors.New("short batch result")
+	}
+	word := out[off : off+32]
+	for _, b := range word[:24] {
+		if b != 0 {
+			return 0, errors.New("malformed batch result")
+		}
+	}
+	v := binary.BigEndian.Uint64(word[24:])
+	if v > uint64(len(out)) {
+		return 0, errors.New("malformed batch result")
+	}
+	return v, nil
+}
+
+// revertReason returns the message of a Solidity Error(string) revert, or
+// the raw return data in hex.
+func revertReason(data []byte) string {
+	if len(data) >= 4+64 && string(data[:4]) == string(errorStringSig) {
+		if size, err := abiWord(data[4:], 32); err == nil && 64+size <= uint64(len(data)-4) {
+			return string(data[4+64 : 4+64+size])
+		}
+	}
+	if len(data) == 0 {
+		return "no reason given"
+	}
+	return common.Bytes2Hex(data)
+}
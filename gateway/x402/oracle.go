@@ -0,0 +1,169 @@
+package x402
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// PriceOracle supplies USD prices for assets whose pack amounts are pegged
+// to a USD price per credit rather than configured in atomic units.
+type PriceOracle interface {
+	// USDPrice returns the USD price of one whole token as reported by feed.
+	USDPrice(ctx context.Context, feed common.Address) (*big.Rat, error)
+}
+
+var (
+	// aggregatorDecimalsSig is the selector for AggregatorV3Interface.decimals().
+	aggregatorDecimalsSig = crypto.Keccak256([]byte("decimals()"))[:4]
+	// latestRoundDataSig is the selector for AggregatorV3Interface.latestRoundData().
+	latestRoundDataSig = crypto.Keccak256([]byte("latestRoundData()"))[:4]
+)
+
+// ChainlinkOracle reads Chainlink AggregatorV3 price feeds (TOKEN / USD) with
+// eth_call on the settlement chain.
+type ChainlinkOracle struct {
+	rpcURL string
+	maxAge time.Duration
+
+	mu       sync.Mutex
+	decimals map[common.Address]uint8 // feeds' decimals never change
+}
+
+// NewChainlinkOracle creates an oracle reading feeds through rpcURL. Answers
+// older than maxAge are rejected as stale; zero disables the check.
+func NewChainlinkOracle(rpcURL string, maxAge time.Duration) *ChainlinkOracle {
+	return &ChainlinkOracle{
+		rpcURL:   rpcURL,
+		maxAge:   maxAge,
+		decimals: make(map[common.Address]uint8),
+	}
+}
+
+// USDPrice returns the feed's latest answer scaled by its decimals.
+func (o *ChainlinkOracle) USDPrice(ctx context.Context, feed common.Address) (*big.Rat, error) {
+	client, err := ethclient.DialContext(ctx, o.rpcURL)
+	if err != nil {
+		return nil, fmt.Errorf("rpc connect: %w", err)
+	}
+	defer client.Close()
+
+	decimals, err := o.feedDecimals(ctx, client, feed)
+	if err != nil {
+		return nil, err
+	}
+
+	// latestRoundData returns (roundId, answer, startedAt, updatedAt, answeredInRound).
+	out, err := client.CallContract(ctx, ethereum.CallMsg{To: &feed, Data: latestRoundDataSig}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("latestRoundData: %w", err)
+	}
+	if len(out) < 5*32 {
+		return nil, fmt.Errorf("latestRoundData: short response (%d bytes)", len(out))
+	}
+	answer := new(big.Int).SetBytes(out[32:64])
+	if out[32]&0x80 != 0 || answer.Sign() == 0 {
+		return nil, fmt.Errorf("feed %s reported a non-positive price", feed.Hex())
+	}
+	updatedAt := time.Unix(new(big.Int).SetBytes(out[96:128]).Int64(), 0)
+	if o.maxAge > 0 && time.Since(updatedAt) > o.maxAge {
+		return nil, fmt.Errorf("feed %s is stale (updated %s)", feed.Hex(), updatedAt.UTC().Format(time.RFC3339))
+	}
+
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil)
+	return new(big.Rat).SetFrac(answer, scale), nil
+}
+
+func (o *ChainlinkOracle) feedDecimals(ctx context.Context, client *ethclient.Client, feed common.Address) (uint8, error) {
+	o.mu.Lock()
+	d, ok := o.decimals[feed]
+	o.mu.Unlock()
+	if ok {
+		return d, nil
+	}
+
+	out, err := client.CallContract(ctx, ethereum.CallMsg{To: &feed, Data: aggregatorDecimalsSig}, nil)
+	if err != nil {
+		return 0, fmt.Errorf("decimals: %w", err)
+	}
+	if len(out) < 32 {
+		return 0, fmt.Errorf("decimals: short response (%d bytes)", len(out))
+	}
+	d = out[31]
+
+	o.mu.Lock()
+	o.decimals[feed] = d
+	o.mu.Unlock()
+	return d, nil
+}
+
+// RefreshPrices fetches the USD price of every oracle-priced asset and
+// rebuilds the advertised offers from them. A feed that cannot be read keeps
+// its last known price; an asset that has never been priced is left out of
+// the 402 until it is. Call it before serving and then periodically.
+func (m *Middleware) RefreshPrices(ctx context.Context) error {
+	if m.cfg.Oracle == nil {
+		return nil
+	}
+
+	m.pricesMu.Lock()
+	defer m.pricesMu.Unlock()
+
+	var errs []error
+	for _, a := range m.cfg.Assets {
+		if a.PriceFeed == "" {
+			continue
+		}
+		feed := common.HexToAddress(a.PriceFeed)
+		price, err := m.cfg.Oracle.USDPrice(ctx, feed)
+		if err != nil {
+			slog.Warn("price feed read failed, keeping last price", "asset", a.Address, "feed", a.PriceFeed, "err", err)
+			errs = append(errs, err)
+			continue
+		}
+		m.prices[feed] = price
+	}
+
+	set, err := newOfferSet(m.pricedConfig(), m.prices)
+	if err != nil {
+		return err
+	}
+	m.pricing.Store(set)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%d price feed(s) unavailable: %w", len(errs), errs[0])
+	}
+	return nil
+}
+
+// peggedAmount returns the atomic amount of a token with the given decimals
+// worth credits × usdPerCredit at price (USD per whole token), rounded up.
+func peggedAmount(credits int64, usdPerCredit float64, decimals int, price *big.Rat) (int64, error) {
+	// Go through the shortest decimal form so 0.0001 is exactly 1/10000
+	// rather than its nearest binary float.
+	usd, ok := new(big.Rat).SetString(strconv.FormatFloat(usdPerCredit, 'g', -1, 64))
+	if !ok || usd.Sign() <= 0 {
+		return 0, fmt.Errorf("invalid USD price per credit %v", usdPerCredit)
+	}
+	v := new(big.Rat).Mul(usd, new(big.Rat).SetInt64(credits))
+	v.Mul(v, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil)))
+	v.Quo(v, price)
+
+	n := new(big.Int).Quo(v.Num(), v.Denom())
+	if new(big.Rat).SetInt(n).Cmp(v) < 0 {
+		n.Add(n, big.NewInt(1))
+	}
+	if !n.IsInt64() || n.Sign() <= 0 {
+		return 0, fmt.Errorf("pegged amount %s out of range", n)
+	}
+	return n.Int64(), nil
+}
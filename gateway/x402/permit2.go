@@ -0,0 +1,150 @@
+package x402
+
+// Permit2 support: any ERC-20 can be accepted, whether or not it implements
+// EIP-3009 or EIP-2612, by having the payer approve Uniswap's Permit2 contract
+// once and then sign a SignatureTransfer permit per payment. The relayer is
+// the permit's spender and pulls the funds to payTo with permitTransferFrom.
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// SchemePermit2 is the Accepts scheme for payments made with a Permit2
+// SignatureTransfer permit instead of an EIP-3009 authorization.
+const SchemePermit2 = "permit2"
+
+// Permit2Address is the canonical Permit2 deployment, at the same address on
+// every supported chain.
+var Permit2Address = common.HexToAddress("0x000000000022D473030F116dDEE9F6B43aC78BA3")
+
+var (
+	permit2DomainTypeHash = crypto.Keccak256Hash([]byte(
+		"EIP712Domain(string name,uint256 chainId,address verifyingContract)",
+	))
+	tokenPermissionsTypeHash = crypto.Keccak256Hash([]byte(
+		"TokenPermissions(address token,uint256 amount)",
+	))
+	permitTransferFromTypeHash = crypto.Keccak256Hash([]byte(
+		"PermitTransferFrom(TokenPermissions permitted,address spender,uint256 nonce,uint256 deadline)" +
+			"TokenPermissions(address token,uint256 amount)",
+	))
+)
+
+// permitTransferFromSig is the 4-byte selector for
+// Permit2.permitTransferFrom(PermitTransferFrom,SignatureTransferDetails,address,bytes).
+var permitTransferFromSig = crypto.Keccak256([]byte(
+	"permitTransferFrom(((address,uint256),uint256,uint256),(address,uint256),address,bytes)",
+))[:4]
+
+// permit2Authorization is the signed permit in a permit2 payment payload.
+type permit2Authorization struct {
+	From      string `json:"from"`
+	Permitted struct {
+		Token  string `json:"token"`
+		Amount string `json:"amount"`
+	} `json:"permitted"`
+	Spender  string `json:"spender"`
+	Nonce    string `json:"nonce"`
+	Deadline string `json:"deadline"`
+}
+
+// permit2Digest returns the EIP-712 digest the payer signed for a.
+func permit2Digest(a *permit2Authorization, chainID *big.Int) common.Hash {
+	domain := make([]byte, 4*32)
+	copy(domain[0:32], permit2DomainTypeHash.Bytes())
+	copy(domain[32:64], crypto.Keccak256([]byte("Permit2")))
+	copy(domain[64:96], pad32(chainID))
+	copy(domain[96:128], addrPad(Permit2Address))
+	ds := crypto.Keccak256Hash(domain)
+
+	perms := make([]byte, 3*32)
+	copy(perms[0:32], tokenPermissionsTypeHash.Bytes())
+	copy(perms[32:64], addrPad(common.HexToAddress(a.Permitted.Token)))
+	copy(perms[64:96], pad32(mustBI(a.Permitted.Amount)))
+
+	enc := make([]byte, 5*32)
+	copy(enc[0:32], permitTransferFromTypeHash.Bytes())
+	copy(enc[32:64], crypto.Keccak256(perms))
+	copy(enc[64:96], addrPad(common.HexToAddress(a.Spender)))
+	copy(enc[96:128], pad32(mustBI(a.Nonce)))
+	copy(enc[128:160], pad32(mustBI(a.Deadline)))
+	sh := crypto.Keccak256Hash(enc)
+
+	return crypto.Keccak256Hash(append([]byte{0x19, 0x01}, append(ds.Bytes(), sh.Bytes()...)...))
+}
+
+// verifyPermit2 checks a permit2 payment against the gateway's requirements
+// and returns the payer. spender is the relayer that will submit the transfer.
+func verifyPermit2(p *localPayload, req *paymentRequirementsV2, chainID *big.Int, spender common.Address) (common.Address, error) {
+	a := &p.Payload.Permit2Authorization
+
+	// An upto permit is settled only once the token it bought is used up or
+	// expired, so it must stay valid for the whole advertised window. The
+	// deadline is otherwise checked with every authorization's validity
+	// window by the caller.
+	if req.Scheme == SchemeUpto {
+		minDeadline := time.Now().Add(time.Duration(req.MaxTimeoutSeconds) * time.Second).Unix()
+		if mustBI(a.Deadline).Cmp(big.NewInt(minDeadline)) < 0 {
+			return common.Address{}, fmt.Errorf("permit deadline %s too soon for metered settlement (need %d)", a.Deadline, minDeadline)
+		}
+	}
+	if common.HexToAddress(a.Spender) != spender {
+		return common.Address{}, fmt.Errorf("spender mismatch: permit=%s relayer=%s", a.Spender, spender.Hex())
+	}
+	if common.HexToAddress(a.Permitted.Token) != common.HexToAddress(req.Asset) {
+		return common.Address{}, fmt.Errorf("token mismatch: permit=%s req=%s", a.Permitted.Token, req.Asset)
+	}
+	amount := mustBI(a.Permitted.Amount)
+	if amount.Cmp(mustBI(req.Amount)) < 0 {
+		return common.Address{}, fmt.Errorf("amount too low: permitted %s, required %s", amount, req.Amount)
+	}
+
+	recovered, err := recoverSigner(permit2Digest(a, chainID), p.Payload.Signature)
+	if err != nil {
+		return common.Address{}, err
+	}
+	if expected := common.HexToAddress(a.From); recovered != expected {
+		return common.Address{}, fmt.Errorf("signature mismatch: signed by %s, claimed %s", recovered.Hex(), expected.Hex())
+	}
+	return recovered, nil
+}
+
+// packPermitTransferFrom ABI-encodes Permit2.permitTransferFrom, moving
+// req.Amount of the permitted token from the payer to req.PayTo. Under the
+// upto scheme req.Amount is the metered amount, at most the permitted one.
+func packPermitTransferFrom(p *localPayload, req *paymentRequirementsV2) ([]byte, error) {
+	a := &p.Payload.Permit2Authorization
+	sig, err := hex.DecodeString(strings.TrimPrefix(p.Payload.Signature, "0x"))
+	if err != nil || len(sig) != 65 {
+		return nil, fmt.Errorf("invalid signature for settlement")
+	}
+	if sig[64] < 27 {
+		sig[64] += 27 // Permit2 expects 27/28
+	}
+
+	// Head: permit (token, amount, nonce, deadline), transferDetails (to,
+	// requestedAmount), owner, offset of signature — all static except the
+	// signature, which follows as length + data padded to 32 bytes.
+	const headSlots = 8
+	data := make([]byte, 4+headSlots*32+32+96)
+	copy(data[:4], permitTransferFromSig)
+	slot := func(i int) []byte { return data[4+i*32 : 4+(i+1)*32] }
+	copy(slot(0), addrPad(common.HexToAddress(a.Permitted.Token)))
+	copy(slot(1), pad32(mustBI(a.Permitted.Amount)))
+	copy(slot(2), pad32(mustBI(a.Nonce)))
+	copy(slot(3), pad32(mustBI(a.Deadline)))
+	copy(slot(4), addrPad(common.HexToAddress(req.PayTo)))
+	copy(slot(5), pad32(mustBI(req.Amount)))
+	copy(slot(6), addrPad(common.HexToAddress(a.From)))
+	copy(slot(7), pad32(big.NewInt(headSlots*32)))
+	copy(slot(8), pad32(big.NewInt(int64(len(sig)))))
+	copy(data[4+9*32:], sig)
+	return data, nil
+}
@@ -0,0 +1,181 @@
+package x402
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// rpcMethodNotFound is the JSON-RPC error code returned for blocked methods,
+// the same code a node returns for a method it does not expose.
+const rpcMethodNotFound = -32601
+
+// rpcInvalidRequest is the JSON-RPC error code for the other calls of a batch
+// rejected because it contains a blocked method.
+const rpcInvalidRequest = -32600
+
+// MethodPolicy decides which JSON-RPC methods the gateway forwards upstream.
+// Rules name a method exactly ("eth_sendRawTransaction") or a namespace with a
+// trailing "*" ("debug_*").
+type MethodPolicy struct {
+	allow rules // empty allows every method not denied
+	deny  rules
+}
+
+// rules is a parsed set of method rules.
+type rules struct {
+	exact    map[string]bool
+	prefixes []string
+}
+
+func parseRules(list []string) (rules, error) {
+	r := rules{exact: make(map[string]bool)}
+	for _, rule := range list {
+		prefix, wildcard := strings.CutSuffix(rule, "*")
+		switch {
+		case prefix == "" || strings.Contains(prefix, "*"):
+			return rules{}, fmt.Errorf("invalid method rule %q", rule)
+		case wildcard:
+			r.prefixes = append(r.prefixes, prefix)
+		default:
+			r.exact[rule] = true
+		}
+	}
+	return r, nil
+}
+
+func (r rules) empty() bool {
+	return len(r.exact) == 0 && len(r.prefixes) == 0
+}
+
+func (r rules) match(method string) bool {
+	if r.exact[method] {
+		return true
+	}
+	for _, p := range r.prefixes {
+		if strings.HasPrefix(method, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewMethodPolicy builds a policy that blocks the methods matching deny and,
+// when allow is non-empty, every method not matching allow. Deny wins when a
+// method matches both.
+func NewMethodPolicy(allow, deny []string) (*MethodPolicy, error) {
+	a, err := parseRules(allow)
+	if err != nil {
+		return nil, err
+	}
+	d, err := parseRules(deny)
+	if err != nil {
+		return nil, err
+	}
+	return &MethodPolicy{allow: a, deny: d}, nil
+}
+
+// Allows reports whether method may be forwarded.
+func (p *MethodPolicy) Allows(method string) bool {
+	if p.deny.match(method) {
+		return false
+	}
+	return p.allow.empty() || p.allow.match(method)
+}
+
+// rpcError is a JSON-RPC 2.0 error response.
+type rpcError struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Error   rpcErrorBody    `json:"error"`
+}
+
+type rpcErrorBody struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// enforceBatchSize answers the request with a JSON-RPC error, and returns
+// false, if body is a batch of more than MaxBatchSize calls.
+func (m *Middleware) enforceBatchSize(w http.ResponseWriter, body []byte) bool {
+	return writeRPCReply(w, m.batchSizeReply(body))
+}
+
+// batchSizeReply returns the JSON-RPC error answering body if it is a batch
+// of more than MaxBatchSize calls, and nil otherwise.
+func (m *Middleware) batchSizeReply(body []byte) []byte {
+	if m.cfg.MaxBatchSize <= 0 {
+		return nil
+	}
+	calls, batch := rpcCalls(body)
+	if !batch || len(calls) <= m.cfg.MaxBatchSize {
+		return nil
+	}
+	reply, _ := json.Marshal(rpcError{
+		JSONRPC: "2.0",
+		ID:      json.RawMessage("null"),
+		Error: rpcErrorBody{
+			Code:    rpcInvalidRequest,
+			Message: fmt.Sprintf("batch of %d calls exceeds the limit of %d", len(calls), m.cfg.MaxBatchSize),
+		},
+	})
+	return reply
+}
+
+// enforcePolicy answers the request with JSON-RPC errors, and returns false,
+// if any call in body is blocked by the policy. A batch is rejected as a
+// whole so that no part of it reaches the upstream or is charged for.
+func (m *Middleware) enforcePolicy(w http.ResponseWriter, body []byte) bool {
+	return writeRPCReply(w, m.policyReply(body))
+}
+
+// policyReply returns the JSON-RPC errors answering body if any call in it
+// is blocked by the policy, and nil otherwise.
+func (m *Middleware) policyReply(body []byte) []byte {
+	if m.cfg.Policy == nil {
+		return nil
+	}
+	calls, batch := rpcCalls(body)
+	blocked := false
+	for _, c := range calls {
+		if !m.cfg.Policy.Allows(c.Method) {
+			blocked = true
+			break
+		}
+	}
+	if !blocked {
+		return nil
+	}
+
+	resps := make([]rpcError, len(calls))
+	for i, c := range calls {
+		resps[i] = rpcError{JSONRPC: "2.0", ID: c.ID}
+		if resps[i].ID == nil {
+			resps[i].ID = json.RawMessage("null")
+		}
+		if m.cfg.Policy.Allows(c.Method) {
+			resps[i].Error = rpcErrorBody{Code: rpcInvalidRequest, Message: "batch contains a blocked method"}
+		} else {
+			resps[i].Error = rpcErrorBody{Code: rpcMethodNotFound, Message: fmt.Sprintf("method %s is not available on this gateway", c.Method)}
+		}
+	}
+	if batch {
+		reply, _ := json.Marshal(resps)
+		return reply
+	}
+	reply, _ := json.Marshal(resps[0])
+	return reply
+}
+
+// writeRPCReply answers the request with reply, a JSON-RPC response, and
+// returns false; a nil reply writes nothing and returns true.
+func writeRPCReply(w http.ResponseWriter, reply []byte) bool {
+	if reply == nil {
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(append(reply, '\n'))
+	return false
+}
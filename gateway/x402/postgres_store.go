@@ -0,0 +1,861 @@
+package x402
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+)
+
+// postgresMigrations holds the schema shipped with the package. Files are
+// applied in lexical order, so new migrations must sort after existing ones
+// (0002_..., 0003_...). Applied files must never be edited.
+//
+//go:embed migrations/postgres/*.sql
+var postgresMigrations embed.FS
+
+// postgresOpTimeout bounds every store operation. TokenCounterStore has no
+// context parameter, so this keeps a stalled database from hanging requests.
+const postgresOpTimeout = 5 * time.Second
+
+// postgresMigrationLock is the pg_advisory_xact_lock key held while migrating,
+// so several gateway replicas booting at once don't race on the schema.
+const postgresMigrationLock = 0x783430325f6d6967 // "x402_mig"
+
+// Event kinds recorded in x402_token_events.
+const (
+	tokenEventIssue  = "issue"
+	tokenEventUse    = "use"
+	tokenEventTopUp  = "topup"
+	tokenEventRefund = "refund"
+	tokenEventRevoke = "revoke"
+)
+
+// PostgresTokenStore is a TokenCounterStore backed by PostgreSQL.
+// Counters survive restarts and are shared between gateway replicas; every
+// issuance and consumption is also appended to x402_token_events so operators
+// can query what was sold and used.
+type PostgresTokenStore struct {
+	db *sql.DB
+}
+
+// NewPostgresTokenStore applies any pending schema migrations to db and returns
+// a store using it. The caller owns db (and its driver registration) and is
+// responsible for closing it.
+func NewPostgresTokenStore(ctx context.Context, db *sql.DB) (*PostgresTokenStore, error) {
+	if err := MigratePostgres(ctx, db); err != nil {
+		return nil, err
+	}
+	return &PostgresTokenStore{db: db}, nil
+}
+
+// MigratePostgres applies the embedded schema migrations that have not yet been
+// recorded in x402_schema_migrations. Each migration runs in its own transaction.
+func MigratePostgres(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS x402_schema_migrations (
+			version    TEXT        PRIMARY KEY,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`); err != nil {
+		return fmt.Errorf("creating migrations table: %w", err)
+	}
+
+	names, err := fs.Glob(postgresMigrations, "migrations/postgres/*.sql")
+	if err != nil {
+		return fmt.Errorf("listing migrations: %w", err)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := applyPostgresMigration(ctx, db, name); err != nil {
+			return fmt.Errorf("migration %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func applyPostgresMigration(ctx context.Context, db *sql.DB, name string) error {
+	script, err := postgresMigrations.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	version := name[len("migrations/postgres/"):]
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, postgresMigrationLock); err != nil {
+		return fmt.Errorf("acquiring migration lock: %w", err)
+	}
+
+	var applied bool
+	if err := tx.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM x402_schema_migrations WHERE version = $1)`, version,
+	).Scan(&applied); err != nil {
+		return err
+	}
+	if applied {
+		return nil
+	}
+
+	if _, err := tx.ExecContext(ctx, string(script)); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO x402_schema_migrations (version) VALUES ($1)`, version,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RegisterToken inserts the counter row for a newly issued token.
+// If tokenID already exists the call is a no-op (idempotent).
+func (s *PostgresTokenStore) RegisterToken(tokenID string, total int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresOpTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO x402_tokens (token_id, total) VALUES ($1, $2)
+		ON CONFLICT (token_id) DO NOTHING`, tokenID, total)
+	if err != nil {
+		return err
+	}
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if inserted == 0 {
+		return nil // already registered
+	}
+	if err := insertTokenEvent(ctx, tx, tokenID, tokenEventIssue, total); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseRequest consumes n credits under a row lock and returns the number
+// remaining.
+func (s *PostgresTokenStore) UseRequest(tokenID string, n int64) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresOpTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// FOR UPDATE serialises concurrent requests on the same token while leaving
+	// other tokens unaffected.
+	var total, used int64
+	err = tx.QueryRowContext(ctx,
+		`SELECT total, used FROM x402_tokens WHERE token_id = $1 FOR UPDATE`, tokenID,
+	).Scan(&total, &used)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrTokenNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	if used+n > total {
+		return 0, ErrTokenExhausted
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE x402_tokens SET used = used + $2, updated_at = now() WHERE token_id = $1`, tokenID, n,
+	); err != nil {
+		return 0, err
+	}
+	if err := insertTokenEvent(ctx, tx, tokenID, tokenEventUse, -n); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return total - used - n, nil
+}
+
+// AddCredits raises the token's allowance by n and records a top-up event.
+func (s *PostgresTokenStore) AddCredits(tokenID string, n int64) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresOpTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var remaining int64
+	err = tx.QueryRowContext(ctx, `
+		UPDATE x402_tokens SET total = total + $2, updated_at = now()
+		WHERE token_id = $1
+		RETURNING total - used`, tokenID, n,
+	).Scan(&remaining)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrTokenNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := insertTokenEvent(ctx, tx, tokenID, tokenEventTopUp, n); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return remaining, nil
+}
+
+// RefundRequest gives back n consumed credits and records a refund event.
+func (s *PostgresTokenStore) RefundRequest(tokenID string, n int64) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresOpTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var total, used int64
+	err = tx.QueryRowContext(ctx,
+		`SELECT total, used FROM x402_tokens WHERE token_id = $1 FOR UPDATE`, tokenID,
+	).Scan(&total, &used)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrTokenNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	n = min(n, used)
+	if n == 0 {
+		return total - used, nil
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE x402_tokens SET used = used - $2, updated_at = now() WHERE token_id = $1`, tokenID, n,
+	); err != nil {
+		return 0, err
+	}
+	if err := insertTokenEvent(ctx, tx, tokenID, tokenEventRefund, n); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return total - used + n, nil
+}
+
+// Remaining returns the token's unused credits.
+func (s *PostgresTokenStore) Remaining(tokenID string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresOpTimeout)
+	defer cancel()
+
+	var remaining int64
+	err := s.db.QueryRowContext(ctx,
+		`SELECT total - used FROM x402_tokens WHERE token_id = $1`, tokenID,
+	).Scan(&remaining)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrTokenNotFound
+	}
+	return remaining, err
+}
+
+// RevokeToken records tokenID as revoked.
+func (s *PostgresTokenStore) RevokeToken(tokenID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresOpTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM x402_tokens WHERE token_id = $1)`, tokenID,
+	).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrTokenNotFound
+	}
+
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO x402_revoked_tokens (token_id) VALUES ($1)
+		ON CONFLICT (token_id) DO NOTHING`, tokenID)
+	if err != nil {
+		return err
+	}
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if inserted == 0 {
+		return nil // already revoked
+	}
+	if err := insertTokenEvent(ctx, tx, tokenID, tokenEventRevoke, 0); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// IsRevoked reports whether tokenID has been revoked.
+func (s *PostgresTokenStore) IsRevoked(tokenID string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresOpTimeout)
+	defer cancel()
+
+	var revoked bool
+	err := s.db.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM x402_revoked_tokens WHERE token_id = $1)`, tokenID,
+	).Scan(&revoked)
+	return revoked, err
+}
+
+// AddSettlement records a payment to be settled for its token.
+func (s *PostgresTokenStore) AddSettlement(p PendingSettlement) error {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresOpTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO x402_pending_settlements (token_id, payload, requirements, credits, settle_at, deadline, attempts,
+			replay_key, payer, methods, unissued, last_error, audience)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		ON CONFLICT (token_id) DO UPDATE
+			SET payload = EXCLUDED.payload, requirements = EXCLUDED.requirements,
+			    credits = EXCLUDED.credits, settle_at = EXCLUDED.settle_at, deadline = EXCLUDED.deadline,
+			    attempts = EXCLUDED.attempts, replay_key = EXCLUDED.replay_key, payer = EXCLUDED.payer,
+			    methods = EXCLUDED.methods, unissued = EXCLUDED.unissued, last_error = EXCLUDED.last_error,
+			    audience = EXCLUDED.audience`,
+		p.TokenID, p.Payload, p.Requirements, p.Credits, p.SettleAt, p.Deadline, p.Attempts,
+		p.ReplayKey, p.Payer, strings.Join(p.Methods, ","), p.Unissued, p.LastError, p.Audience)
+	return err
+}
+
+// TakeSettlement removes and returns the settlement recorded for tokenID.
+// The DELETE ... RETURNING hands the row to exactly one replica.
+func (s *PostgresTokenStore) TakeSettlement(tokenID string) (*PendingSettlement, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresOpTimeout)
+	defer cancel()
+
+	p := PendingSettlement{TokenID: tokenID}
+	var methods string
+	err := s.db.QueryRowContext(ctx, `
+		DELETE FROM x402_pending_settlements WHERE token_id = $1
+		RETURNING payload, requirements, credits, settle_at, deadline, attempts,
+			replay_key, payer, methods, unissued, last_error, audience`, tokenID,
+	).Scan(&p.Payload, &p.Requirements, &p.Credits, &p.SettleAt, &p.Deadline, &p.Attempts,
+		&p.ReplayKey, &p.Payer, &methods, &p.Unissued, &p.LastError, &p.Audience)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.Methods = splitMethods(methods)
+	return &p, nil
+}
+
+// DueSettlements returns the tokens whose settlements are due by now.
+func (s *PostgresTokenStore) DueSettlements(now time.Time) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresOpTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT token_id FROM x402_pending_settlements WHERE settle_at <= $1`, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// AddDeadSettlement records a settlement that was given up on.
+func (s *PostgresTokenStore) AddDeadSettlement(p PendingSettlement) error {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresOpTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO x402_dead_settlements (token_id, payload, requirements, credits, settle_at, deadline, attempts,
+			replay_key, payer, methods, unissued, last_error, failed_at, audience)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		ON CONFLICT (token_id) DO UPDATE
+			SET payload = EXCLUDED.payload, requirements = EXCLUDED.requirements,
+			    credits = EXCLUDED.credits, settle_at = EXCLUDED.settle_at, deadline = EXCLUDED.deadline,
+			    attempts = EXCLUDED.attempts, replay_key = EXCLUDED.replay_key, payer = EXCLUDED.payer,
+			    methods = EXCLUDED.methods, unissued = EXCLUDED.unissued, last_error = EXCLUDED.last_error,
+			    failed_at = EXCLUDED.failed_at, audience = EXCLUDED.audience`,
+		p.TokenID, p.Payload, p.Requirements, p.Credits, p.SettleAt, p.Deadline, p.Attempts,
+		p.ReplayKey, p.Payer, strings.Join(p.Methods, ","), p.Unissued, p.LastError, p.FailedAt, p.Audience)
+	return err
+}
+
+// DeadSettlements returns the settlements given up on, oldest first.
+func (s *PostgresTokenStore) DeadSettlements() ([]PendingSettlement, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresOpTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT token_id, payload, requirements, credits, settle_at, deadline, attempts,
+			replay_key, payer, methods, unissued, last_error, failed_at, audience
+		FROM x402_dead_settlements ORDER BY failed_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []PendingSettlement
+	for rows.Next() {
+		var p PendingSettlement
+		var methods string
+		if err := rows.Scan(&p.TokenID, &p.Payload, &p.Requirements, &p.Credits, &p.SettleAt, &p.Deadline, &p.Attempts,
+			&p.ReplayKey, &p.Payer, &methods, &p.Unissued, &p.LastError, &p.FailedAt, &p.Audience); err != nil {
+			return nil, err
+		}
+		p.Methods = splitMethods(methods)
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// TakeDeadSettlement removes and returns the dead settlement recorded under
+// tokenID.
+func (s *PostgresTokenStore) TakeDeadSettlement(tokenID string) (*PendingSettlement, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresOpTimeout)
+	defer cancel()
+
+	p := PendingSettlement{TokenID: tokenID}
+	var methods string
+	err := s.db.QueryRowContext(ctx, `
+		DELETE FROM x402_dead_settlements WHERE token_id = $1
+		RETURNING payload, requirements, credits, settle_at, deadline, attempts,
+			replay_key, payer, methods, unissued, last_error, failed_at, audience`, tokenID,
+	).Scan(&p.Payload, &p.Requirements, &p.Credits, &p.SettleAt, &p.Deadline, &p.Attempts,
+		&p.ReplayKey, &p.Payer, &methods, &p.Unissued, &p.LastError, &p.FailedAt, &p.Audience)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.Methods = splitMethods(methods)
+	return &p, nil
+}
+
+// splitMethods parses a method scope stored comma-separated; "" is full
+// access.
+func splitMethods(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// UseFreeRequests counts n more free requests under key. The conditional
+// upsert keeps concurrent replicas from overrunning the limit together.
+func (s *PostgresTokenStore) UseFreeRequests(key string, n, limit int64, expiresAt time.Time) (int64, error) {
+	if n > limit {
+		return 0, ErrFreeTierExhausted
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), postgresOpTimeout)
+	defer cancel()
+
+	var used int64
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO x402_free_requests (key, used, expires_at) VALUES ($1, $2, $4)
+		ON CONFLICT (key) DO UPDATE
+			SET used = x402_free_requests.used + EXCLUDED.used
+			WHERE x402_free_requests.used + EXCLUDED.used <= $3
+		RETURNING used`, key, n, limit, expiresAt,
+	).Scan(&used)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrFreeTierExhausted
+	}
+	if err != nil {
+		return 0, err
+	}
+	return limit - used, nil
+}
+
+// PruneFreeRequests deletes the counts that expired before now.
+func (s *PostgresTokenStore) PruneFreeRequests(now time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresOpTimeout)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, `DELETE FROM x402_free_requests WHERE expires_at < $1`, now)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// AddUsage adds calls and credits to payer's use of method in an hour.
+func (s *PostgresTokenStore) AddUsage(hour time.Time, payer, method string, calls, credits int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresOpTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO x402_usage (hour, payer, method, calls, credits) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (hour, payer, method) DO UPDATE
+			SET calls = x402_usage.calls + EXCLUDED.calls,
+			    credits = x402_usage.credits + EXCLUDED.credits`,
+		hour, payer, method, calls, credits,
+	)
+	return err
+}
+
+// AddRevenue adds to what payer paid in asset on network in an hour.
+func (s *PostgresTokenStore) AddRevenue(hour time.Time, payer, network, asset string, payments int64, amount *big.Int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresOpTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO x402_revenue (hour, payer, network, asset, payments, amount) VALUES ($1, $2, $3, $4, $5, $6::numeric)
+		ON CONFLICT (hour, payer, network, asset) DO UPDATE
+			SET payments = x402_revenue.payments + EXCLUDED.payments,
+			    amount = x402_revenue.amount + EXCLUDED.amount`,
+		hour, payer, network, asset, payments, amount.String(),
+	)
+	return err
+}
+
+// UsageReport totals the hours from from until before to.
+func (s *PostgresTokenStore) UsageReport(from, to time.Time) (*UsageReport, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresOpTimeout)
+	defer cancel()
+
+	rep := &UsageReport{From: from, To: to, Usage: []MethodUsage{}, Revenue: []PaidRevenue{}}
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT payer, method, SUM(calls)::bigint, SUM(credits)::bigint FROM x402_usage
+		WHERE hour >= $1 AND hour < $2
+		GROUP BY payer, method ORDER BY payer, method`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u MethodUsage
+		if err := rows.Scan(&u.Payer, &u.Method, &u.Calls, &u.Credits); err != nil {
+			return nil, err
+		}
+		rep.Usage = append(rep.Usage, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.db.QueryContext(ctx, `
+		SELECT payer, network, asset, SUM(payments)::bigint, SUM(amount)::text FROM x402_revenue
+		WHERE hour >= $1 AND hour < $2
+		GROUP BY payer, network, asset ORDER BY payer, network, asset`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r PaidRevenue
+		if err := rows.Scan(&r.Payer, &r.Network, &r.Asset, &r.Payments, &r.Amount); err != nil {
+			return nil, err
+		}
+		rep.Revenue = append(rep.Revenue, r)
+	}
+	return rep, rows.Err()
+}
+
+// PostLedgerEntry appends e and applies its postings in one transaction,
+// unless one would take a balance to the wrong side of zero. Balances are
+// locked in account order, so concurrent entries cannot deadlock.
+func (s *PostgresTokenStore) PostLedgerEntry(e LedgerEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresOpTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, p := range sortPostings(e.Postings) {
+		var raw string
+		if err := tx.QueryRowContext(ctx, `
+			INSERT INTO x402_ledger_balances (account, unit, balance) VALUES ($1, $2, $3::numeric)
+			ON CONFLICT (account, unit) DO UPDATE SET balance = x402_ledger_balances.balance + EXCLUDED.balance
+			RETURNING balance::text`,
+			p.Account, p.Unit, p.Amount.String(),
+		).Scan(&raw); err != nil {
+			return err
+		}
+		balance, ok := new(big.Int).SetString(raw, 10)
+		if !ok {
+			return fmt.Errorf("corrupt ledger balance %q", raw)
+		}
+		if !ledgerBalanceOK(p.Account, balance) {
+			return fmt.Errorf("%w: %s would hold %s %s", ErrLedgerInvariant, p.Account, balance, p.Unit)
+		}
+	}
+	postings, err := json.Marshal(e.Postings)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO x402_ledger_entries (time, kind, ref, tx, postings) VALUES ($1, $2, $3, $4, $5)`,
+		e.Time, e.Kind, e.Ref, e.Tx, postings,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// LedgerBalances returns the balances of the accounts starting with prefix.
+func (s *PostgresTokenStore) LedgerBalances(prefix string) ([]LedgerBalance, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresOpTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT account, unit, balance::text FROM x402_ledger_balances
+		WHERE starts_with(account, $1) ORDER BY account, unit`, prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []LedgerBalance
+	for rows.Next() {
+		var b LedgerBalance
+		var raw string
+		if err := rows.Scan(&b.Account, &b.Unit, &raw); err != nil {
+			return nil, err
+		}
+		var ok bool
+		if b.Amount, ok = new(big.Int).SetString(raw, 10); !ok {
+			return nil, fmt.Errorf("corrupt ledger balance %q", raw)
+		}
+		out = append(out, b)
+	}
+	return out, rows.Err()
+}
+
+// LedgerEntries returns the entries posted from from until before to.
+func (s *PostgresTokenStore) LedgerEntries(from, to time.Time) ([]LedgerEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresOpTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT seq, time, kind, ref, tx, postings FROM x402_ledger_entries
+		WHERE time >= $1 AND time < $2 ORDER BY seq`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []LedgerEntry
+	for rows.Next() {
+		var e LedgerEntry
+		var postings []byte
+		if err := rows.Scan(&e.Seq, &e.Time, &e.Kind, &e.Ref, &e.Tx, &postings); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(postings, &e.Postings); err != nil {
+			return nil, fmt.Errorf("corrupt ledger entry %d: %w", e.Seq, err)
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// IndexToken records t.
+func (s *PostgresTokenStore) IndexToken(t IssuedToken) error {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresOpTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO x402_issued_tokens (token_id, payer, payer_key, counter, audience, credits, methods, metered, issued_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (token_id) DO UPDATE
+			SET payer = EXCLUDED.payer, payer_key = EXCLUDED.payer_key, counter = EXCLUDED.counter,
+			    audience = EXCLUDED.audience, credits = EXCLUDED.credits, methods = EXCLUDED.methods,
+			    metered = EXCLUDED.metered, issued_at = EXCLUDED.issued_at, expires_at = EXCLUDED.expires_at`,
+		t.ID, t.Payer, foldAddress(t.Payer), t.Counter, t.Audience, t.Credits, strings.Join(t.Methods, ","), t.Metered, t.IssuedAt, t.Expires)
+	return err
+}
+
+// issuedTokenColumns are the columns scanIssuedToken reads, in order.
+const issuedTokenColumns = `token_id, payer, counter, audience, credits, methods, metered, issued_at, expires_at`
+
+// scanIssuedToken reads a row of issuedTokenColumns.
+func scanIssuedToken(row interface{ Scan(...any) error }) (IssuedToken, error) {
+	var t IssuedToken
+	var methods string
+	err := row.Scan(&t.ID, &t.Payer, &t.Counter, &t.Audience, &t.Credits, &methods, &t.Metered, &t.IssuedAt, &t.Expires)
+	t.Methods = splitMethods(methods)
+	return t, err
+}
+
+// IssuedToken returns the record of the token with the given ID.
+func (s *PostgresTokenStore) IssuedToken(id string) (*IssuedToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresOpTimeout)
+	defer cancel()
+
+	t, err := scanIssuedToken(s.db.QueryRowContext(ctx, `SELECT `+issuedTokenColumns+` FROM x402_issued_tokens WHERE token_id = $1`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrTokenNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// IssuedTokens returns the tokens q selects, newest first.
+func (s *PostgresTokenStore) IssuedTokens(q TokenQuery) ([]IssuedToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresOpTimeout)
+	defer cancel()
+
+	where, args := []string{"TRUE"}, []any{}
+	if q.Payer != "" {
+		args = append(args, foldAddress(q.Payer))
+		where = append(where, fmt.Sprintf("payer_key = $%d", len(args)))
+	}
+	if !q.ExpiresAfter.IsZero() {
+		args = append(args, q.ExpiresAfter)
+		where = append(where, fmt.Sprintf("expires_at > $%d", len(args)))
+	}
+	if !q.ExpiresBefore.IsZero() {
+		args = append(args, q.ExpiresBefore)
+		where = append(where, fmt.Sprintf("expires_at < $%d", len(args)))
+	}
+	args = append(args, q.limit())
+	rows, err := s.db.QueryContext(ctx, `SELECT `+issuedTokenColumns+` FROM x402_issued_tokens
+		WHERE `+strings.Join(where, " AND ")+fmt.Sprintf(` ORDER BY issued_at DESC, token_id LIMIT $%d`, len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []IssuedToken
+	for rows.Next() {
+		t, err := scanIssuedToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+func insertTokenEvent(ctx context.Context, tx *sql.Tx, tokenID, kind string, delta int64) error {
+	_, err := tx.ExecContext(ctx,
+		`INSERT INTO x402_token_events (token_id, kind, delta) VALUES ($1, $2, $3)`,
+		tokenID, kind, delta,
+	)
+	return err
+}
+
+// PostgresReplayCache is a ReplayCache backed by PostgreSQL. Because the table
+// is shared, a payment redeemed on one gateway replica cannot be replayed
+// against another.
+type PostgresReplayCache struct {
+	db *sql.DB
+}
+
+// NewPostgresReplayCache applies any pending schema migrations to db and
+// returns a cache using it. db may be shared with a PostgresTokenStore.
+func NewPostgresReplayCache(ctx context.Context, db *sql.DB) (*PostgresReplayCache, error) {
+	if err := MigratePostgres(ctx, db); err != nil {
+		return nil, err
+	}
+	return &PostgresReplayCache{db: db}, nil
+}
+
+// Reserve records key, with resendHash, until expiresAt, returning false if
+// an unexpired entry already exists. An expired entry for the same key is
+// replaced.
+func (c *PostgresReplayCache) Reserve(key, resendHash string, expiresAt time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresOpTimeout)
+	defer cancel()
+
+	res, err := c.db.ExecContext(ctx, `
+		INSERT INTO x402_replay_cache (key, expires_at, payload_hash) VALUES ($1, $2, NULLIF($3, ''))
+		ON CONFLICT (key) DO UPDATE
+			SET created_at = now(), expires_at = EXCLUDED.expires_at, token = NULL, payload_hash = EXCLUDED.payload_hash
+			WHERE x402_replay_cache.expires_at < now()`, key, expiresAt, resendHash)
+	if err != nil {
+		return false, err
+	}
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return inserted == 1, nil
+}
+
+// Release forgets key.
+func (c *PostgresReplayCache) Release(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresOpTimeout)
+	defer cancel()
+
+	_, err := c.db.ExecContext(ctx, `DELETE FROM x402_replay_cache WHERE key = $1`, key)
+	return err
+}
+
+// SetToken records the token issued for key. Unknown keys are ignored.
+func (c *PostgresReplayCache) SetToken(key, token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresOpTimeout)
+	defer cancel()
+
+	_, err := c.db.ExecContext(ctx, `UPDATE x402_replay_cache SET token = $2 WHERE key = $1`, key, token)
+	return err
+}
+
+// Token returns the token and resend hash recorded for key. The resend hash
+// is kept in the payload_hash column.
+func (c *PostgresReplayCache) Token(key string) (string, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresOpTimeout)
+	defer cancel()
+
+	var token, resendHash sql.NullString
+	err := c.db.QueryRowContext(ctx,
+		`SELECT token, payload_hash FROM x402_replay_cache WHERE key = $1 AND expires_at >= now()`, key,
+	).Scan(&token, &resendHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", nil
+	}
+	return token.String, resendHash.String, err
+}
+
+// Prune deletes every entry that expired before now.
+func (c *PostgresReplayCache) Prune(now time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresOpTimeout)
+	defer cancel()
+
+	res, err := c.db.ExecContext(ctx, `DELETE FROM x402_replay_cache WHERE expires_at < $1`, now)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
@@ -0,0 +1,425 @@
+package x402
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// errNoMatchingOffer is returned when a payment doesn't correspond to any
+// entry of the advertised Accepts array.
+var errNoMatchingOffer = errors.New("payment does not match any advertised offer")
+
+// errAmountTooLow is returned when a payment matches an offer in everything
+// but its amount, which is lower than the offer's.
+var errAmountTooLow = errors.New("payment amount is below the offer's price")
+
+// PricingTier is one credit pack: paying Amount (asset atomic units) buys
+// Credits RPC calls. When Methods is non-empty the issued token is scoped to
+// those JSON-RPC methods, so cheaper read-only packs can be sold alongside
+// full-access ones.
+type PricingTier struct {
+	Amount  int64
+	Credits int64
+	Methods []string
+}
+
+// AcceptedAsset is an EIP-3009 token the gateway accepts payment in, such as
+// USDC, EURC or PYUSD, on the configured network.
+type AcceptedAsset struct {
+	// Address is the token contract.
+	Address string
+	// Network, when set, is the network the asset is offered on instead of
+	// MiddlewareConfig.Network; the facilitator must settle payments there,
+	// as a NetworkFacilitator routing each network to its own does.
+	Network string
+	// DomainName and DomainVersion are the token's EIP-712 domain, needed to
+	// verify the client's signature.
+	DomainName    string
+	DomainVersion string
+	// Tiers, when non-empty, are this asset's credit packs with amounts in its
+	// own atomic units. Otherwise the middleware-wide tiers apply unchanged.
+	Tiers []PricingTier
+	// Permit2 accepts the asset through a Permit2 SignatureTransfer permit
+	// instead of EIP-3009, so any ERC-20 can be used. DomainName and
+	// DomainVersion are then unused; MiddlewareConfig.Permit2Spender must be set.
+	Permit2 bool
+	// PriceFeed, when set, is a TOKEN/USD price feed: the asset's pack
+	// amounts are derived from MiddlewareConfig.USDPerCredit at the feed's
+	// price instead of configured, so volatile tokens can be accepted at a
+	// stable USD price.
+	PriceFeed string
+	// Decimals is the token's decimals, needed to price it from PriceFeed.
+	// When set it is also advertised, so clients can display pack amounts.
+	Decimals int
+	// MinAmount, when positive, is the smallest pack amount offered in the
+	// asset; packs below it (after a coupon discount or oracle pricing) are
+	// left out, as settling them would cost more than they bring in.
+	MinAmount int64
+	// Upto sells the asset's packs under the upto scheme: the Permit2 permit
+	// covers the pack amount, but only the share matching the credits used is
+	// settled, once the token is exhausted or expires. Requires Permit2 and
+	// MiddlewareConfig.Settlements.
+	Upto bool
+}
+
+// offer is one entry of the 402 Accepts array together with what it buys.
+type offer struct {
+	requirements     paymentRequirementsV2
+	requirementsJSON []byte // passed to the facilitator for this offer
+	credits          int64
+	methods          []string // nil for full access
+}
+
+// buildOffers expands the configured assets and tiers into Accepts entries,
+// one per (asset, tier). Oracle-priced assets are priced from prices, keyed by
+// feed, and left out while they have no price yet. Under a coupon every tier
+// is on the coupon's terms.
+func buildOffers(cfg MiddlewareConfig, prices map[common.Address]*big.Rat, coupon *Coupon) ([]offer, error) {
+	tiers := cfg.Tiers
+	if len(tiers) == 0 {
+		tiers = []PricingTier{{Amount: cfg.MaxAmountRequired, Credits: cfg.RequestsPerPayment}}
+	}
+	assets := cfg.Assets
+	if len(assets) == 0 {
+		assets = []AcceptedAsset{{
+			Address:       cfg.USDCAddress,
+			DomainName:    cfg.USDCDomainName,
+			DomainVersion: cfg.USDCDomainVersion,
+		}}
+	}
+
+	var offers []offer
+	seenAssets := make(map[string]bool, len(assets))
+	for _, a := range assets {
+		network := a.Network
+		if network == "" {
+			network = cfg.Network
+		}
+		solana := IsSolanaNetwork(network)
+		if solana && !IsSolanaAddress(cfg.FeePayer) {
+			return nil, fmt.Errorf("offers on %s need the facilitator's fee payer", network)
+		}
+		if solana && !IsSolanaAddress(cfg.PayTo) {
+			return nil, fmt.Errorf("pay-to %q is not a Solana address", cfg.PayTo)
+		}
+		if !validAddress(network, a.Address) {
+			return nil, fmt.Errorf("invalid asset address %q", a.Address)
+		}
+		// The same token address may be accepted on several networks.
+		assetKey := network + "|" + a.Address
+		if !solana {
+			assetKey = network + "|" + common.HexToAddress(a.Address).Hex()
+		}
+		if seenAssets[assetKey] {
+			return nil, fmt.Errorf("duplicate asset %s", a.Address)
+		}
+		seenAssets[assetKey] = true
+		if a.Permit2 && !common.IsHexAddress(cfg.Permit2Spender) {
+			return nil, fmt.Errorf("asset %s uses Permit2 but no valid Permit2 spender is configured", a.Address)
+		}
+		if a.Upto && (!a.Permit2 || cfg.Settlements == nil || cfg.Tokens == nil) {
+			return nil, fmt.Errorf("asset %s uses the upto scheme, which needs Permit2, a token manager and a settlement store", a.Address)
+		}
+
+		assetTiers := a.Tiers
+		if len(assetTiers) == 0 {
+			assetTiers = tiers
+		}
+		if a.PriceFeed != "" {
+			if !common.IsHexAddress(a.PriceFeed) || cfg.Oracle == nil || cfg.USDPerCredit <= 0 {
+				return nil, fmt.Errorf("asset %s has a price feed but no valid feed address, oracle or USD price", a.Address)
+			}
+			price := prices[common.HexToAddress(a.PriceFeed)]
+			if price == nil {
+				continue
+			}
+			pegged := make([]PricingTier, len(assetTiers))
+			for i, t := range assetTiers {
+				amount, err := peggedAmount(t.Credits, cfg.USDPerCredit, a.Decimals, price)
+				if err != nil {
+					return nil, fmt.Errorf("pricing asset %s: %w", a.Address, err)
+				}
+				pegged[i] = PricingTier{Amount: amount, Credits: t.Credits, Methods: t.Methods}
+			}
+			assetTiers = pegged
+		}
+		seen := make(map[int64]bool, len(assetTiers))
+		for _, t := range assetTiers {
+			if t.Amount <= 0 || t.Credits <= 0 {
+				return nil, fmt.Errorf("invalid pricing tier %d:%d", t.Amount, t.Credits)
+			}
+			if coupon != nil {
+				t = coupon.apply(t)
+			}
+			if t.Amount < a.MinAmount {
+				continue
+			}
+			// The asset and amount are how a payment is matched back to its
+			// tier, so amounts must be unique per asset.
+			if seen[t.Amount] {
+				return nil, fmt.Errorf("duplicate pricing tier amount %d for asset %s", t.Amount, a.Address)
+			}
+			seen[t.Amount] = true
+
+			req := paymentRequirementsV2{
+				Scheme:            "exact",
+				Network:           network,
+				Amount:            fmt.Sprintf("%d", t.Amount),
+				PayTo:             cfg.PayTo,
+				MaxTimeoutSeconds: 60,
+				Asset:             a.Address,
+				Extra: paymentRequirementsExtra{
+					Name:     a.DomainName,
+					Version:  a.DomainVersion,
+					Decimals: a.Decimals,
+					Credits:  t.Credits,
+					Methods:  t.Methods,
+				},
+			}
+			if coupon != nil {
+				req.Extra.Coupon = coupon.Code
+			}
+			if solana {
+				// The client builds the transfer transaction with the
+				// facilitator as fee payer.
+				req.Extra.Name = ""
+				req.Extra.Version = ""
+				req.Extra.FeePayer = cfg.FeePayer
+			}
+			if cfg.ReceiveWithAuthorization {
+				req.Extra.PrimaryType = PrimaryTypeReceiveWithAuthorization
+			}
+			if a.Permit2 {
+				req.Scheme = SchemePermit2
+				req.Extra.PrimaryType = ""
+				req.Extra.Name = "Permit2"
+				req.Extra.Version = ""
+				req.Extra.Spender = cfg.Permit2Spender
+			}
+			if a.Upto {
+				// The permit must outlive the token so usage can be settled.
+				req.Scheme = SchemeUpto
+				req.MaxTimeoutSeconds = int((cfg.Tokens.Expiry() + uptoSettleMargin).Seconds())
+			}
+			reqJSON, err := json.Marshal(req)
+			if err != nil {
+				return nil, fmt.Errorf("marshalling payment requirements: %w", err)
+			}
+			offers = append(offers, offer{requirements: req, requirementsJSON: reqJSON, credits: t.Credits, methods: t.Methods})
+		}
+	}
+	return offers, nil
+}
+
+// offersDescription summarises the offers for the x402 resource description.
+func offersDescription(offers []offer) string {
+	if len(offers) == 1 && offers[0].requirements.Scheme != SchemeUpto {
+		return fmt.Sprintf("RPC access: %d credits per payment", offers[0].credits)
+	}
+	assets := make(map[string]bool)
+	for _, o := range offers {
+		assets[o.requirements.Asset] = true
+	}
+	packs := make([]string, len(offers))
+	for i, o := range offers {
+		packs[i] = fmt.Sprintf("%d credits for %s", o.credits, o.requirements.Amount)
+		if len(assets) > 1 {
+			if usesPermit2(o.requirements.Scheme) {
+				packs[i] += " of " + o.requirements.Asset + " via Permit2"
+			} else {
+				packs[i] += " " + o.requirements.Extra.Name
+			}
+		}
+		if o.requirements.Scheme == SchemeUpto {
+			packs[i] = "up to " + packs[i] + ", charged per credit used"
+		}
+		if len(o.methods) > 0 {
+			packs[i] += " (" + strings.Join(o.methods, ", ") + " only)"
+		}
+	}
+	return "RPC access: " + strings.Join(packs, ", ")
+}
+
+// matchOffer finds the offer among offers a payment payload was made against.
+//
+// v2 payloads echo the chosen requirements in "accepted"; the match is on the
+// fields that determine what was paid (scheme, network, asset, payTo, amount),
+// so the client cannot claim a bigger pack than it paid for. Payloads without
+// an amount (bare x402 v1) are matched on the authorized value instead, and on
+// the network and asset where given; the facilitator's signature check over
+// the chosen asset's domain catches a wrong guess.
+func matchOffer(offers []offer, payloadBytes []byte) (*offer, error) {
+	p, err := parseLocalPayload(payloadBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	paid := p.Accepted.Amount
+	if paid == "" {
+		paid = p.Payload.Authorization.Value
+		if paid == "" {
+			paid = p.Payload.Permit2Authorization.Permitted.Amount
+		}
+	}
+	// cheapest is the lowest amount among the offers matching in all but
+	// amount, to tell an underpayment from a payment for no pack at all.
+	var cheapest *big.Int
+	for i := range offers {
+		req := &offers[i].requirements
+		var match bool
+		if p.Accepted.Amount == "" {
+			match = (p.Accepted.Network == "" || p.Accepted.Network == req.Network) &&
+				(p.Accepted.Asset == "" || sameAddress(p.Accepted.Asset, req.Asset))
+		} else {
+			match = p.Accepted.Scheme == req.Scheme &&
+				p.Accepted.Network == req.Network &&
+				sameAddress(p.Accepted.Asset, req.Asset) &&
+				sameAddress(p.Accepted.PayTo, req.PayTo)
+		}
+		if !match {
+			continue
+		}
+		if paid == req.Amount {
+			return &offers[i], nil
+		}
+		if amount := mustBI(req.Amount); cheapest == nil || amount.Cmp(cheapest) < 0 {
+			cheapest = amount
+		}
+	}
+	if cheapest != nil && mustBI(paid).Cmp(cheapest) < 0 {
+		return nil, errAmountTooLow
+	}
+	return nil, errNoMatchingOffer
+}
+
+// requestCost returns the credits a request making calls costs: one per call
+// of a batch, or the method's price from the table, so a batch is charged like
+// the separate requests it replaces. Malformed calls still reach the upstream
+// and cost one credit, as does a body that isn't JSON-RPC at all.
+func (m *Middleware) requestCost(calls []rpcCall) int64 {
+	if len(calls) == 0 {
+		return 1
+	}
+	costs := m.pricing.Load().methodCosts
+	var cost int64
+	for _, call := range calls {
+		if c, ok := costs[call.Method]; ok {
+			cost += c
+		} else {
+			cost++
+		}
+	}
+	return cost
+}
+
+// Pricing is what the default credit pack costs and how calls are charged
+// against it, the part of the pricing that can change while serving.
+type Pricing struct {
+	// MaxAmountRequired buys RequestsPerPayment credits, in the configured
+	// asset's atomic units.
+	MaxAmountRequired  int64
+	RequestsPerPayment int64
+	MethodCosts        map[string]int64
+	// Tiered reports that pricing tiers are configured, which replace the
+	// default pack; it is ignored by SetPricing.
+	Tiered bool
+}
+
+// Pricing returns the current pricing.
+func (m *Middleware) Pricing() Pricing {
+	m.pricesMu.Lock()
+	defer m.pricesMu.Unlock()
+	p := m.terms
+	p.MethodCosts = maps.Clone(p.MethodCosts)
+	return p
+}
+
+// SetPricing changes the pricing while serving: the 402 payload and every
+// coupon's offers are rebuilt at the new pack price and take effect at once,
+// while tokens already issued keep the credits they were bought with. Under
+// pricing tiers the pack is recorded but the tiers are still what is offered;
+// the method costs apply either way.
+func (m *Middleware) SetPricing(p Pricing) error {
+	if p.MaxAmountRequired <= 0 || p.RequestsPerPayment <= 0 {
+		return fmt.Errorf("pack amount and credits must be positive, got %d for %d", p.MaxAmountRequired, p.RequestsPerPayment)
+	}
+	if err := validateMethodCosts(p.MethodCosts); err != nil {
+		return err
+	}
+	m.pricesMu.Lock()
+	defer m.pricesMu.Unlock()
+
+	p.MethodCosts = maps.Clone(p.MethodCosts)
+	p.Tiered = m.terms.Tiered
+	prev := m.terms
+	m.terms = p
+	set, err := newOfferSet(m.pricedConfig(), m.prices)
+	if err != nil {
+		m.terms = prev
+		return err
+	}
+	m.pricing.Store(set)
+	return nil
+}
+
+// pricedConfig returns the configuration with the current pricing. The
+// caller holds pricesMu.
+func (m *Middleware) pricedConfig() MiddlewareConfig {
+	cfg := m.cfg
+	cfg.MaxAmountRequired = m.terms.MaxAmountRequired
+	cfg.RequestsPerPayment = m.terms.RequestsPerPayment
+	cfg.MethodCosts = m.terms.MethodCosts
+	return cfg
+}
+
+// validateMethodCosts checks that every priced method costs something; free
+// methods are configured as such.
+func validateMethodCosts(costs map[string]int64) error {
+	for method, c := range costs {
+		if c <= 0 {
+			return fmt.Errorf("method %s: cost must be positive, got %d", method, c)
+		}
+	}
+	return nil
+}
+
+// sameMethods reports whether two method scopes are equal, ignoring order.
+func sameMethods(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := make(map[string]bool, len(a))
+	for _, m := range a {
+		set[m] = true
+	}
+	for _, m := range b {
+		if !set[m] {
+			return false
+		}
+	}
+	return true
+}
+
+// sameAddress compares two addresses: hex ones case-insensitively (EIP-55
+// checksum casing is not significant), Solana's base58 ones exactly.
+func sameAddress(a, b string) bool {
+	if common.IsHexAddress(a) && common.IsHexAddress(b) {
+		return common.HexToAddress(a) == common.HexToAddress(b)
+	}
+	return IsSolanaAddress(a) && a == b
+}
+
+// validAddress reports whether addr is an account address on network:
+// base58 on Solana, hex on EVM chains.
+func validAddress(network, addr string) bool {
+	if IsSolanaNetwork(network) {
+		return IsSolanaAddress(addr)
+	}
+	return common.IsHexAddress(addr)
+}
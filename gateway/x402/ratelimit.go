@@ -0,0 +1,67 @@
+package x402
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimit is a token-bucket limit embedded in a batch JWT: RPS requests per
+// second on average, with bursts of up to Burst.
+type RateLimit struct {
+	RPS   float64 `json:"rps"`
+	Burst int     `json:"burst"`
+}
+
+// limiterIdleTTL is how long a token's limiter is kept after its last request.
+// A bucket idle this long has refilled, so dropping it loses nothing.
+const limiterIdleTTL = 10 * time.Minute
+
+// tokenLimiters holds one token bucket per batch token ID.
+type tokenLimiters struct {
+	mu        sync.Mutex
+	limiters  map[string]*tokenLimiter
+	lastSweep time.Time
+}
+
+type tokenLimiter struct {
+	lim      *rate.Limiter
+	lastSeen time.Time
+}
+
+func newTokenLimiters() *tokenLimiters {
+	return &tokenLimiters{limiters: make(map[string]*tokenLimiter)}
+}
+
+// allow takes one request from the bucket for tokenID. When the bucket is
+// empty it returns false and how long until a request would be allowed.
+func (l *tokenLimiters) allow(tokenID string, limit RateLimit) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > limiterIdleTTL {
+		for id, tl := range l.limiters {
+			if now.Sub(tl.lastSeen) > limiterIdleTTL {
+				delete(l.limiters, id)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	burst := max(limit.Burst, 1)
+	tl, ok := l.limiters[tokenID]
+	if !ok {
+		tl = &tokenLimiter{lim: rate.NewLimiter(rate.Limit(limit.RPS), burst)}
+		l.limiters[tokenID] = tl
+	}
+	tl.lastSeen = now
+
+	res := tl.lim.ReserveN(now, 1)
+	if delay := res.DelayFrom(now); delay > 0 {
+		res.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
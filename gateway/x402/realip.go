@@ -0,0 +1,106 @@
+package x402
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// RealIP wraps next so requests arriving through a trusted reverse proxy or
+// load balancer carry the client's address in RemoteAddr, rather than the
+// proxy's, for the free tier and everything else keyed by client address.
+//
+// X-Forwarded-For is read right to left, the order proxies append to it,
+// and the first address not itself a trusted proxy is the client: entries
+// left of it are whatever the client chose to send and are ignored.
+// Requests from other peers keep their address and their header is not
+// believed at all.
+func RealIP(trustedProxies []string, next http.Handler) (http.Handler, error) {
+	trusted := make([]netip.Prefix, 0, len(trustedProxies))
+	for _, s := range trustedProxies {
+		p, err := parseProxyPrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		trusted = append(trusted, p)
+	}
+	isTrusted := func(addr netip.Addr) bool {
+		for _, p := range trusted {
+			if p.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer, ok := remoteAddr(r.RemoteAddr)
+		if !ok || !isTrusted(peer) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		client := peer
+		hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, ok := forwardedAddr(hops[i])
+			if !ok {
+				// A garbled entry ends what can be believed; the last
+				// trusted hop stands in for the client.
+				break
+			}
+			client = hop
+			if !isTrusted(hop) {
+				break
+			}
+		}
+		if client != peer {
+			r = r.WithContext(r.Context())
+			r.RemoteAddr = netip.AddrPortFrom(client, 0).String()
+		}
+		next.ServeHTTP(w, r)
+	}), nil
+}
+
+// parseProxyPrefix parses a trusted proxy, a CIDR range or a single address.
+func parseProxyPrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("trusted proxy %q: %w", s, err)
+		}
+		return p.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("trusted proxy %q: %w", s, err)
+	}
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
+
+// remoteAddr parses a request's RemoteAddr, "host:port".
+func remoteAddr(s string) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(s)
+	if err != nil {
+		host = s
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// forwardedAddr parses an X-Forwarded-For entry, which some proxies write
+// with a port or, for IPv6, in brackets.
+func forwardedAddr(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
@@ -0,0 +1,238 @@
+package x402
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// sentTxRetention is how long a settlement transaction stays tracked after
+// its nonce was mined, so waitConfirmed still finds the replacement that
+// landed.
+const sentTxRetention = time.Hour
+
+// sentTx is a settlement transaction the relayer broadcast, with every
+// replacement sent for its nonce, newest last.
+type sentTx struct {
+	tx     *types.Transaction
+	hashes []common.Hash
+	sentAt time.Time
+	mined  bool
+	// charged is set once the gas of the transaction that landed is
+	// counted.
+	charged bool
+}
+
+// track records a broadcast settlement transaction, or a replacement for its
+// nonce.
+func (r *relayer) track(tx *types.Transaction, now time.Time) {
+	r.sentMu.Lock()
+	defer r.sentMu.Unlock()
+	if r.sent == nil {
+		r.sent = make(map[uint64]*sentTx)
+	}
+	s, ok := r.sent[tx.Nonce()]
+	if !ok {
+		s = &sentTx{}
+		r.sent[tx.Nonce()] = s
+	}
+	s.tx = tx
+	s.hashes = append(s.hashes, tx.Hash())
+	s.sentAt = now
+}
+
+// replacements returns hash and the hashes of every transaction sent for the
+// same nonce and account.
+func (f *LocalFacilitator) replacements(hash common.Hash) []common.Hash {
+	for _, r := range f.relayers {
+		if hashes := r.replacements(hash); hashes != nil {
+			return hashes
+		}
+	}
+	return []common.Hash{hash}
+}
+
+// replacements returns the hashes of every transaction the account sent
+// for the nonce of hash, or nil if it did not send hash.
+func (r *relayer) replacements(hash common.Hash) []common.Hash {
+	r.sentMu.Lock()
+	defer r.sentMu.Unlock()
+	for _, s := range r.sent {
+		for _, h := range s.hashes {
+			if h == hash {
+				return append([]common.Hash(nil), s.hashes...)
+			}
+		}
+	}
+	return nil
+}
+
+// charge reports whether hash is a transaction the account sent for a nonce
+// whose gas is yet to be counted, marking it counted.
+func (r *relayer) charge(hash common.Hash) bool {
+	r.sentMu.Lock()
+	defer r.sentMu.Unlock()
+	for _, s := range r.sent {
+		for _, h := range s.hashes {
+			if h == hash {
+				if s.charged {
+					return false
+				}
+				s.charged = true
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// BumpStuck rebroadcasts settlement transactions that have not been mined
+// within after of being sent, with the same nonce and call but fees raised by
+// an eighth, or to what the gas strategy sets now if that is more. A
+// transaction whose replacement would exceed the strategy's MaxFeePerGas is
+// left pending. It returns the number of transactions replaced.
+//
+// Only transactions sent by this process are tracked: after a restart,
+// earlier settlements are no longer bumped.
+func (f *LocalFacilitator) BumpStuck(ctx context.Context, now time.Time, after time.Duration) (int, error) {
+	pending := 0
+	for _, r := range f.relayers {
+		r.sentMu.Lock()
+		pending += len(r.sent)
+		r.sentMu.Unlock()
+	}
+	if pending == 0 {
+		return 0, nil
+	}
+
+	client, err := f.dial(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("rpc connect: %w", err)
+	}
+	defer client.Close()
+
+	target, err := f.currentFees(ctx, client)
+	if err != nil {
+		return 0, err
+	}
+	replaced := 0
+	var errs []error
+	for _, r := range f.relayers {
+		n, err := f.bumpStuck(ctx, client, r, now, after, target)
+		replaced += n
+		errs = append(errs, err)
+	}
+	return replaced, errors.Join(errs...)
+}
+
+// bumpStuck replaces the account's stuck settlement transactions, with fees
+// of at least target.
+func (f *LocalFacilitator) bumpStuck(ctx context.Context, client *ethclient.Client, r *relayer, now time.Time, after time.Duration, target txFees) (int, error) {
+	r.sentMu.Lock()
+	pending := len(r.sent)
+	r.sentMu.Unlock()
+	if pending == 0 {
+		return 0, nil
+	}
+
+	// Every nonce below the account's mined nonce has landed, with one of
+	// the transactions sent for it.
+	minedNonce, err := client.NonceAt(ctx, r.address, nil)
+	if err != nil {
+		return 0, fmt.Errorf("mined nonce of %s: %w", r.address.Hex(), err)
+	}
+
+	var stuck []*types.Transaction
+	r.sentMu.Lock()
+	for nonce, s := range r.sent {
+		if nonce < minedNonce {
+			if !s.mined {
+				s.mined = true
+				s.sentAt = now
+			} else if now.Sub(s.sentAt) > sentTxRetention {
+				delete(r.sent, nonce)
+			}
+			continue
+		}
+		if now.Sub(s.sentAt) >= after {
+			stuck = append(stuck, s.tx)
+		}
+	}
+	r.sentMu.Unlock()
+
+	replaced := 0
+	for _, old := range stuck {
+		fees := bumpFees(feesOf(old), target)
+		if ceiling := f.gas.MaxFeePerGas; ceiling != nil && fees.maxFee().Cmp(ceiling) > 0 {
+			slog.Warn("stuck settlement tx not replaced: fee ceiling reached",
+				"hash", old.Hash().Hex(),
+				"nonce", old.Nonce(),
+				"max_fee", fees.maxFee().String(),
+				"ceiling", ceiling.String(),
+			)
+			continue
+		}
+
+		tx := fees.newTx(f.chainID, old.Nonce(), old.Gas(), old.To(), old.Data())
+		signed, err := r.signer.SignTx(ctx, tx, f.chainID)
+		if err != nil {
+			return replaced, fmt.Errorf("signing replacement tx: %w", err)
+		}
+		if err := client.SendTransaction(ctx, signed); err != nil {
+			// Most likely the original was mined since the nonce was read;
+			// the next sweep sees it.
+			slog.Warn("replacing stuck settlement tx failed", "hash", old.Hash().Hex(), "nonce", old.Nonce(), "err", err)
+			continue
+		}
+		r.track(signed, now)
+		replaced++
+		slog.Info("stuck settlement tx replaced",
+			"hash", signed.Hash().Hex(),
+			"relayer", r.address.Hex(),
+			"replaces", old.Hash().Hex(),
+			"nonce", old.Nonce(),
+			"max_fee", fees.maxFee().String(),
+		)
+	}
+	return replaced, nil
+}
+
+// bumpFees returns the fees for a replacement of a transaction sent with old:
+// each raised by an eighth, or to target's if that is more.
+func bumpFees(old, target txFees) txFees {
+	if old.legacy {
+		price := bumpFee(old.gasPrice)
+		if target.legacy && target.gasPrice.Cmp(price) > 0 {
+			price = target.gasPrice
+		}
+		return txFees{legacy: true, gasPrice: price}
+	}
+	tip, feeCap := bumpFee(old.tip), bumpFee(old.feeCap)
+	if !target.legacy {
+		if target.tip.Cmp(tip) > 0 {
+			tip = target.tip
+		}
+		if target.feeCap.Cmp(feeCap) > 0 {
+			feeCap = target.feeCap
+		}
+	}
+	if tip.Cmp(feeCap) > 0 {
+		feeCap = tip
+	}
+	return txFees{tip: tip, feeCap: feeCap}
+}
+
+// bumpFee raises a fee by an eighth, rounded up: above the 10% nodes require
+// of a replacement transaction.
+func bumpFee(fee *big.Int) *big.Int {
+	bumped := new(big.Int).Add(fee, big.NewInt(7))
+	bumped.Div(bumped, big.NewInt(8))
+	return bumped.Add(bumped, fee)
+}
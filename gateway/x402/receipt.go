@@ -0,0 +1,117 @@
+package x402
+
+// Settlement receipts: a facilitator reports a settlement once its
+// transaction is broadcast, before anyone knows it will succeed. When the
+// facilitator can follow its transactions, the credits a payment bought are
+// handed out at once and the transaction watched in the background; if it
+// reverts, the payment was never made and the credits are taken back.
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// receiptTimeout bounds waiting for a settlement transaction to be mined.
+// A transaction still pending after it is assumed to land eventually.
+const receiptTimeout = 15 * time.Minute
+
+// receiptFacilitator returns the facilitator if the settlement transaction
+// tx it reported can be followed until mined.
+func (m *Middleware) receiptFacilitator(tx string) (ReceiptFacilitator, bool) {
+	rf, ok := m.cfg.Facilitator.(ReceiptFacilitator)
+	return rf, ok && tx != ""
+}
+
+// watchSettlement follows the settlement transaction of a payment whose
+// credits — a new token, or a top-up of claims when topUp is set — have been
+// issued. Once it is mined the settlement is reported confirmed; if it
+// reverted the credits are withdrawn and the payment's replay key released,
+// so the client can present the payment again once it is funded.
+func (m *Middleware) watchSettlement(p *collectedPayment, claims *Claims, topUp bool) {
+	rf, _ := m.receiptFacilitator(p.transaction)
+	ctx, cancel := context.WithTimeout(context.Background(), receiptTimeout)
+	defer cancel()
+
+	data := paymentEventData(&p.offer.requirements, p.result.Payer, p.offer.credits, p.replayKey)
+	data["tid"] = claims.TokenID
+	mined, err := rf.WaitMined(ctx, p.transaction)
+	switch {
+	case err == nil:
+		data["transaction"] = mined
+		m.notify(EventSettlementConfirmed, data)
+		m.watchReorg(mined, p.replayKey, data, func() bool {
+			return m.withdrawCredits(claims, p.offer.credits, topUp)
+		})
+		return
+	case !errors.Is(err, ErrSettlementReverted):
+		slog.Warn("settlement receipt not seen", "tid", claims.TokenID, "tx", p.transaction, "err", err)
+		return
+	}
+
+	revoked := m.withdrawCredits(claims, p.offer.credits, topUp)
+	slog.Error("settlement reverted, credits withdrawn",
+		"tid", claims.TokenID,
+		"payer", p.result.Payer,
+		"tx", p.transaction,
+		"credits", p.offer.credits,
+		"token_revoked", revoked,
+	)
+	if err := m.cfg.Replay.Release(p.replayKey); err != nil {
+		slog.Error("replay cache release failed", "err", err)
+	}
+	data["transaction"] = p.transaction
+	data["error"] = err.Error()
+	data["tokenRevoked"] = revoked
+	m.notify(EventSettlementReverted, data)
+}
+
+// withdrawCredits takes back credits issued for a payment that was not made,
+// reporting whether that took revoking the token. A token of its own is
+// revoked; credits added to an account or topped-up token are consumed, and
+// the token (or account) revoked only if some of them have been spent.
+func (m *Middleware) withdrawCredits(claims *Claims, credits int64, topUp bool) (revoked bool) {
+	if !topUp && claims.Account == "" {
+		if err := m.cfg.Tokens.Revoke(claims.TokenID); err != nil {
+			slog.Error("revoking unpaid token failed", "tid", claims.TokenID, "err", err)
+		}
+		return true
+	}
+	_, err := m.cfg.Tokens.UseRequest(claims, credits)
+	switch {
+	case err == nil, errors.Is(err, ErrTokenRevoked):
+		return false
+	case !errors.Is(err, ErrTokenExhausted):
+		slog.Error("withdrawing unpaid credits failed", "counter", claims.CounterID(), "err", err)
+	}
+	if err := m.cfg.Tokens.Revoke(claims.CounterID()); err != nil {
+		slog.Error("revoking unpaid token failed", "counter", claims.CounterID(), "err", err)
+	}
+	return true
+}
+
+// awaitPendingSettled follows the settlement transaction of a pending
+// payment settled in the background before reporting it settled. If it
+// reverted the payment is put back to be retried, and its token revoked if
+// that is given up on.
+func (m *Middleware) awaitPendingSettled(rf ReceiptFacilitator, p *PendingSettlement, data map[string]any, scheme, tx string) {
+	ctx, cancel := context.WithTimeout(context.Background(), receiptTimeout)
+	defer cancel()
+	mined, err := rf.WaitMined(ctx, tx)
+	switch {
+	case err == nil:
+		m.settlementConfirmed(p, data, scheme, mined)
+	case errors.Is(err, ErrSettlementReverted):
+		slog.Warn("deferred settlement reverted", "tid", p.TokenID, "tx", tx)
+		data["transaction"] = tx
+		data["error"] = err.Error()
+		data["tokenRevoked"] = false
+		data["willRetry"] = true
+		m.notify(EventSettlementReverted, data)
+		m.retrySettlement(p, err)
+	default:
+		slog.Warn("settlement receipt not seen", "tid", p.TokenID, "tx", tx, "err", err)
+		m.settlementConfirmed(p, data, scheme, tx)
+	}
+}
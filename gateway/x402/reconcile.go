@@ -0,0 +1,399 @@
+package x402
+
+// Reconciliation: once a day the USDC transfers to the gateway's pay-to
+// address on the settlement chain are compared, transaction by transaction,
+// with the settlements in the ledger. A transfer the ledger has no
+// settlement for is money received without credits issued for it; a
+// settlement with no transfer, or a different amount, is credits issued
+// without the payment behind them. Payments still neither settled nor
+// released a day on are flagged too.
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+const (
+	// reconcileDelay is how long after midnight UTC the day before is
+	// reconciled, leaving its last settlements time to be confirmed.
+	reconcileDelay = time.Hour
+	// reconcileMargin widens the blocks and the ledger entries looked at
+	// beyond the day, as a settlement is posted a little after it is mined.
+	reconcileMargin = time.Hour
+	// reconcileLogBlocks is the blocks asked for in one eth_getLogs call,
+	// within what providers allow.
+	reconcileLogBlocks = 2000
+	// reconcileTimeout bounds one reconciliation.
+	reconcileTimeout = 10 * time.Minute
+)
+
+// transferTopic is the topic of ERC-20 Transfer(address,address,uint256)
+// events.
+var transferTopic = crypto.Keccak256Hash([]byte("Transfer(address,address,uint256)"))
+
+// Reconciliation mismatch kinds.
+const (
+	// MismatchReceivedUncredited is a transfer to the pay-to address the
+	// ledger has no settlement for.
+	MismatchReceivedUncredited = "received_without_credit"
+	// MismatchCreditedUnpaid is a settlement in the ledger with no transfer
+	// on chain.
+	MismatchCreditedUnpaid = "credited_without_payment"
+	// MismatchAmount is a settlement whose amount differs from the
+	// transfers of its transaction.
+	MismatchAmount = "amount_mismatch"
+	// MismatchUnsettled is a payment credits were issued for that is still
+	// neither settled nor released.
+	MismatchUnsettled = "payment_unsettled"
+)
+
+// ReconcileConfig configures reconciliation.
+type ReconcileConfig struct {
+	// RPCURL is the settlement chain's JSON-RPC endpoint.
+	RPCURL string
+	// Network is the settlement chain, "eip155:<chain ID>".
+	Network string
+	// USDC is the token contract whose transfers are reconciled.
+	USDC common.Address
+	// PayTo is the address payments are made to.
+	PayTo common.Address
+	// Ledger is the ledger reconciled against.
+	Ledger LedgerStore
+}
+
+// ReconcileReport is the outcome of reconciling a day.
+type ReconcileReport struct {
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	FromBlock uint64    `json:"fromBlock"`
+	ToBlock   uint64    `json:"toBlock"`
+	// Transfers and Received are the transfers to the pay-to address in the
+	// day and their total, in USDC's atomic units.
+	Transfers int    `json:"transfers"`
+	Received  string `json:"received"`
+	// Settlements and Settled are the settlement transactions in the ledger
+	// in the day and their total.
+	Settlements int    `json:"settlements"`
+	Settled     string `json:"settled"`
+	// Untracked counts settlements posted without a transaction, which
+	// cannot be matched.
+	Untracked  int                 `json:"untracked"`
+	Mismatches []ReconcileMismatch `json:"mismatches"`
+	// Error is why the day could not be reconciled, if it could not.
+	Error    string    `json:"error,omitempty"`
+	Finished time.Time `json:"finished"`
+}
+
+// ReconcileMismatch is a discrepancy between the chain and the ledger.
+type ReconcileMismatch struct {
+	Kind string `json:"kind"`
+	Tx   string `json:"tx,omitempty"`
+	// Payments are the hashes of the payments the ledger settled in Tx, or
+	// of the unsettled payment.
+	Payments []string `json:"payments,omitempty"`
+	From     string   `json:"from,omitempty"`
+	OnChain  string   `json:"onChain,omitempty"`
+	Ledger   string   `json:"ledger,omitempty"`
+}
+
+// Reconciler reconciles the transfers to the pay-to address with the ledger
+// every day.
+type Reconciler struct {
+	cfg ReconcileConfig
+
+	mu   sync.Mutex
+	last *ReconcileReport
+}
+
+// NewReconciler returns a reconciler; Run starts it.
+func NewReconciler(cfg ReconcileConfig) *Reconciler {
+	return &Reconciler{cfg: cfg}
+}
+
+// Run reconciles the day before at once, then every day shortly after
+// midnight UTC, until ctx is done.
+func (r *Reconciler) Run(ctx context.Context) {
+	for {
+		now := time.Now().UTC()
+		today := now.Truncate(24 * time.Hour)
+		day := today.Add(-24 * time.Hour)
+		if now.Sub(today) < reconcileDelay {
+			day = day.Add(-24 * time.Hour)
+		}
+		r.reconcileDay(ctx, day)
+
+		next := today.Add(24*time.Hour + reconcileDelay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+	}
+}
+
+// LastReconciliation returns the report of the last day reconciled, or nil
+// before the first has finished.
+func (r *Reconciler) LastReconciliation() *ReconcileReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.last
+}
+
+// reconcileDay reconciles the day starting at day, logging and keeping the
+// report.
+func (r *Reconciler) reconcileDay(ctx context.Context, day time.Time) {
+	ctx, cancel := context.WithTimeout(ctx, reconcileTimeout)
+	defer cancel()
+	rep, err := r.Reconcile(ctx, day, day.Add(24*time.Hour))
+	if err != nil {
+		slog.Error("reconciliation failed", "day", day.Format(time.DateOnly), "err", err)
+		rep = &ReconcileReport{From: day, To: day.Add(24 * time.Hour), Error: err.Error(), Finished: time.Now().UTC()}
+	} else {
+		for _, mm := range rep.Mismatches {
+			slog.Warn("reconciliation mismatch", "kind", mm.Kind, "tx", mm.Tx, "payments", mm.Payments, "from", mm.From, "on_chain", mm.OnChain, "ledger", mm.Ledger)
+		}
+		slog.Info("reconciled",
+			"day", day.Format(time.DateOnly),
+			"transfers", rep.Transfers,
+			"received", rep.Received,
+			"settlements", rep.Settlements,
+			"settled", rep.Settled,
+			"mismatches", len(rep.Mismatches),
+		)
+	}
+	r.mu.Lock()
+	r.last = rep
+	r.mu.Unlock()
+}
+
+// txTally is what a transaction moved, on chain or in the ledger.
+type txTally struct {
+	amount   *big.Int
+	from     string
+	payments []string
+	core     bool // in the day itself rather than its margins
+}
+
+// Reconcile compares the transfers to the pay-to address mined from from
+// until before to with the ledger's settlements posted in that time, and
+// the payments posted then with what became of them.
+func (r *Reconciler) Reconcile(ctx context.Context, from, to time.Time) (*ReconcileReport, error) {
+	client, err := ethclient.DialContext(ctx, r.cfg.RPCURL)
+	if err != nil {
+		return nil, fmt.Errorf("rpc connect: %w", err)
+	}
+	defer client.Close()
+
+	head, err := client.BlockNumber(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("block number: %w", err)
+	}
+	first, err := blockAt(ctx, client, from.Add(-reconcileMargin), head)
+	if err != nil {
+		return nil, err
+	}
+	start, err := blockAt(ctx, client, from, head)
+	if err != nil {
+		return nil, err
+	}
+	end, err := blockAt(ctx, client, to, head)
+	if err != nil {
+		return nil, err
+	}
+	rep := &ReconcileReport{From: from, To: to, FromBlock: start, ToBlock: end, Mismatches: []ReconcileMismatch{}}
+
+	chain, err := r.transfers(ctx, client, first, end, start)
+	if err != nil {
+		return nil, err
+	}
+	received := new(big.Int)
+	for _, t := range chain {
+		if t.core {
+			rep.Transfers++
+			received.Add(received, t.amount)
+		}
+	}
+	rep.Received = received.String()
+
+	entries, err := r.cfg.Ledger.LedgerEntries(from, to.Add(reconcileMargin))
+	if err != nil {
+		return nil, fmt.Errorf("ledger entries: %w", err)
+	}
+	ledger, untracked := r.settlements(entries, to)
+	rep.Untracked = untracked
+	settled := new(big.Int)
+	for _, t := range ledger {
+		if t.core {
+			rep.Settlements++
+			settled.Add(settled, t.amount)
+		}
+	}
+	rep.Settled = settled.String()
+
+	for _, tx := range sortedKeys(chain) {
+		c := chain[tx]
+		l, ok := ledger[tx]
+		switch {
+		case !ok && c.core:
+			rep.Mismatches = append(rep.Mismatches, ReconcileMismatch{Kind: MismatchReceivedUncredited, Tx: tx, From: c.from, OnChain: c.amount.String()})
+		case ok && (c.core || l.core) && c.amount.Cmp(l.amount) != 0:
+			rep.Mismatches = append(rep.Mismatches, ReconcileMismatch{Kind: MismatchAmount, Tx: tx, Payments: l.payments, From: c.from, OnChain: c.amount.String(), Ledger: l.amount.String()})
+		}
+	}
+	for _, tx := range sortedKeys(ledger) {
+		if l := ledger[tx]; l.core && chain[tx] == nil {
+			rep.Mismatches = append(rep.Mismatches, ReconcileMismatch{Kind: MismatchCreditedUnpaid, Tx: tx, Payments: l.payments, Ledger: l.amount.String()})
+		}
+	}
+
+	unsettled, err := r.unsettled(entries, to)
+	if err != nil {
+		return nil, err
+	}
+	rep.Mismatches = append(rep.Mismatches, unsettled...)
+	rep.Finished = time.Now().UTC()
+	return rep, nil
+}
+
+// transfers returns the USDC transfers to the pay-to address in the blocks
+// from first until before end, by transaction. Those from start on are in
+// the day itself.
+func (r *Reconciler) transfers(ctx context.Context, client *ethclient.Client, first, end, start uint64) (map[string]*txTally, error) {
+	out := make(map[string]*txTally)
+	payTo := common.BytesToHash(r.cfg.PayTo.Bytes())
+	for lo := first; lo < end; lo += reconcileLogBlocks {
+		hi := min(lo+reconcileLogBlocks, end) - 1
+		logs, err := client.FilterLogs(ctx, ethereum.FilterQuery{
+			FromBlock: new(big.Int).SetUint64(lo),
+			ToBlock:   new(big.Int).SetUint64(hi),
+			Addresses: []common.Address{r.cfg.USDC},
+			Topics:    [][]common.Hash{{transferTopic}, nil, {payTo}},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("transfer logs of blocks %d-%d: %w", lo, hi, err)
+		}
+		for _, l := range logs {
+			addTransfer(out, l, start)
+		}
+	}
+	return out, nil
+}
+
+// addTransfer adds a Transfer log to the tally of its transaction.
+func addTransfer(out map[string]*txTally, l types.Log, start uint64) {
+	if l.Removed || len(l.Topics) != 3 || len(l.Data) != 32 {
+		return
+	}
+	tx := strings.ToLower(l.TxHash.Hex())
+	t := out[tx]
+	if t == nil {
+		t = &txTally{amount: new(big.Int), from: strings.ToLower(common.BytesToAddress(l.Topics[1].Bytes()).Hex())}
+		out[tx] = t
+	}
+	t.amount.Add(t.amount, new(big.Int).SetBytes(l.Data))
+	t.core = t.core || l.BlockNumber >= start
+}
+
+// settlements returns the USDC settled to the pay-to address, net of
+// reorgs, by transaction, from the ledger entries; those posted before to
+// are in the day itself. It also counts settlements without a transaction.
+func (r *Reconciler) settlements(entries []LedgerEntry, to time.Time) (map[string]*txTally, int) {
+	unit := r.cfg.Network + "/" + strings.ToLower(r.cfg.USDC.Hex())
+	treasury := "treasury:" + strings.ToLower(r.cfg.PayTo.Hex())
+	out := make(map[string]*txTally)
+	untracked := 0
+	for _, e := range entries {
+		if e.Kind != LedgerSettlement && e.Kind != LedgerSettlementReorged {
+			continue
+		}
+		for _, p := range e.Postings {
+			if p.Account != treasury || p.Unit != unit {
+				continue
+			}
+			if e.Tx == "" {
+				untracked++
+				continue
+			}
+			t := out[e.Tx]
+			if t == nil {
+				t = &txTally{amount: new(big.Int)}
+				out[e.Tx] = t
+			}
+			t.amount.Add(t.amount, p.Amount)
+			t.core = t.core || e.Time.Before(to)
+			if e.Kind == LedgerSettlement {
+				t.payments = append(t.payments, e.Ref)
+			}
+		}
+	}
+	for tx, t := range out {
+		if t.amount.Sign() == 0 {
+			// Reorged out and not settled again.
+			delete(out, tx)
+		}
+	}
+	return out, untracked
+}
+
+// unsettled returns the payments posted before to whose authorization is
+// still owed: neither settled nor released.
+func (r *Reconciler) unsettled(entries []LedgerEntry, to time.Time) ([]ReconcileMismatch, error) {
+	var out []ReconcileMismatch
+	for _, e := range entries {
+		if e.Kind != LedgerPayment || !e.Time.Before(to) {
+			continue
+		}
+		balances, err := r.cfg.Ledger.LedgerBalances("payment:" + e.Ref)
+		if err != nil {
+			return nil, fmt.Errorf("ledger balances: %w", err)
+		}
+		for _, b := range balances {
+			if b.Account == "payment:"+e.Ref && b.Amount.Sign() > 0 {
+				out = append(out, ReconcileMismatch{Kind: MismatchUnsettled, Payments: []string{e.Ref}, Ledger: b.Amount.String()})
+			}
+		}
+	}
+	return out, nil
+}
+
+// blockAt returns the first block mined at or after t, or head+1 if none up
+// to head was.
+func blockAt(ctx context.Context, client *ethclient.Client, t time.Time, head uint64) (uint64, error) {
+	lo, hi := uint64(0), head+1
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		h, err := client.HeaderByNumber(ctx, new(big.Int).SetUint64(mid))
+		if err != nil {
+			return 0, fmt.Errorf("header %d: %w", mid, err)
+		}
+		if int64(h.Time) < t.Unix() {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
+
+// sortedKeys returns the keys of m in order, for a report that reads the
+// same every time.
+func sortedKeys(m map[string]*txTally) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
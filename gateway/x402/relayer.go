@@ -0,0 +1,117 @@
+package x402
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// relayer is an account the local facilitator sends settlement transactions
+// from, paying their gas.
+type relayer struct {
+	signer  Signer
+	address common.Address
+
+	// sendMu serializes picking a nonce and broadcasting, so concurrent
+	// settlements from one account do not take the same nonce. Settlements
+	// from different accounts go out in parallel.
+	sendMu sync.Mutex
+
+	// sent tracks broadcast settlement transactions by nonce, for BumpStuck.
+	sentMu sync.Mutex
+	sent   map[uint64]*sentTx
+}
+
+func newRelayer(signer Signer) *relayer {
+	return &relayer{signer: signer, address: signer.Address()}
+}
+
+// WithRelayers adds relayer accounts to the one the LocalFacilitator was
+// created with. EIP-3009 settlements are spread across all of them
+// round-robin, and skip an account whose balance cannot pay for the gas.
+// Permit2 and receiveWithAuthorization settlements are always sent from the
+// first account, the one clients authorise.
+func WithRelayers(signers ...Signer) LocalFacilitatorOption {
+	return func(f *LocalFacilitator) {
+		for _, signer := range signers {
+			f.relayers = append(f.relayers, newRelayer(signer))
+		}
+	}
+}
+
+// Relayers returns the addresses of the relayer accounts, the primary one
+// first.
+func (f *LocalFacilitator) Relayers() []common.Address {
+	addrs := make([]common.Address, len(f.relayers))
+	for i, r := range f.relayers {
+		addrs[i] = r.address
+	}
+	return addrs
+}
+
+// primary returns the account that must send settlements naming the
+// relayer: Permit2 transfers, whose permit names it as spender, and
+// receiveWithAuthorization calls, which only the payee may make.
+func (f *LocalFacilitator) primary() []*relayer {
+	return f.relayers[:1]
+}
+
+// rotation returns every relayer, starting with the next one in round-robin
+// order, as the accounts to try for a settlement any of them may send.
+func (f *LocalFacilitator) rotation() []*relayer {
+	n := uint64(len(f.relayers))
+	start := (f.nextRelayer.Add(1) - 1) % n
+	rs := make([]*relayer, n)
+	for i := range rs {
+		rs[i] = f.relayers[(start+uint64(i))%n]
+	}
+	return rs
+}
+
+// send signs and broadcasts a transaction calling target with callData from
+// this account, at its next nonce, and returns it.
+func (r *relayer) send(ctx context.Context, client *ethclient.Client, chainID *big.Int, fees txFees, gas uint64, target common.Address, callData []byte) (*types.Transaction, error) {
+	r.sendMu.Lock()
+	defer r.sendMu.Unlock()
+
+	nonce, err := client.PendingNonceAt(ctx, r.address)
+	if err != nil {
+		return nil, fmt.Errorf("pending nonce: %w", err)
+	}
+	tx := fees.newTx(chainID, nonce, gas, &target, callData)
+	signed, err := r.signer.SignTx(ctx, tx, chainID)
+	if err != nil {
+		return nil, fmt.Errorf("signing settlement tx: %w", err)
+	}
+	if err := client.SendTransaction(ctx, signed); err != nil {
+		return nil, fmt.Errorf("transaction_failed: %w", err)
+	}
+	r.track(signed, time.Now())
+	return signed, nil
+}
+
+// canPay reports whether the account's balance covers cost. An account whose
+// balance cannot be read is assumed to.
+func (r *relayer) canPay(ctx context.Context, client *ethclient.Client, cost *big.Int) bool {
+	balance, err := client.BalanceAt(ctx, r.address, nil)
+	if err != nil {
+		slog.Warn("relayer balance lookup failed", "relayer", r.address.Hex(), "err", err)
+		return true
+	}
+	if balance.Cmp(cost) < 0 {
+		slog.Warn("relayer balance too low for settlement gas, skipping",
+			"relayer", r.address.Hex(),
+			"balance", balance.String(),
+			"needed", cost.String(),
+		)
+		return false
+	}
+	return true
+}
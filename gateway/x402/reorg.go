@@ -0,0 +1,131 @@
+package x402
+
+// Reorg watching: a mined settlement can still be dropped from the chain by
+// a reorganization, and a transaction that is not mined again leaves the
+// payment unmade. With ReorgBlocks set, a settlement is watched after it is
+// mined until it is final; one that stays missing for ReorgBlocks blocks has
+// its credits withdrawn and the operator alerted.
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+const (
+	// reorgPollInterval is how often a watched settlement's confirmations
+	// are checked.
+	reorgPollInterval = 12 * time.Second
+	// reorgWatchTimeout bounds watching one settlement. A settlement not
+	// final by then is left alone.
+	reorgWatchTimeout = time.Hour
+	// evmFinalityDepth is the confirmations after which the local
+	// facilitator's settlements are no longer watched: two epochs, after
+	// which Ethereum finalizes a block. L2 reorgs are shallower.
+	evmFinalityDepth = 64
+)
+
+// BlockNumber returns the number of the settlement chain's latest block.
+func (f *LocalFacilitator) BlockNumber(ctx context.Context) (uint64, error) {
+	client, err := f.dial(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("rpc connect: %w", err)
+	}
+	defer client.Close()
+	return client.BlockNumber(ctx)
+}
+
+// FinalityDepth returns evmFinalityDepth.
+func (f *LocalFacilitator) FinalityDepth() uint64 { return evmFinalityDepth }
+
+// watchReorg follows the settlement transaction tx of the payment with
+// replayKey, once it has been mined, until it has the facilitator's finality
+// depth of confirmations. If it drops out of the chain and is not included
+// again within ReorgBlocks blocks, the payment's credits are taken back
+// through withdraw, which reports whether that revoked a token, the
+// payment's replay key is released and a settlement_reorged event sent.
+func (m *Middleware) watchReorg(tx, replayKey string, data map[string]any, withdraw func() (revoked bool)) {
+	rf, ok := m.cfg.Facilitator.(ReorgFacilitator)
+	if !ok || m.cfg.ReorgBlocks == 0 || tx == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), reorgWatchTimeout)
+	defer cancel()
+
+	// seen is set once tx has been found mined; missingSince is the head
+	// when it was then found missing, zero while it is included.
+	var seen bool
+	var missingSince uint64
+	for {
+		select {
+		case <-ctx.Done():
+			if missingSince != 0 {
+				slog.Warn("settlement still missing from the chain, no longer watched", "tx", tx)
+			}
+			return
+		case <-time.After(reorgPollInterval):
+		}
+
+		n, err := rf.Confirmations(ctx, tx)
+		if err != nil {
+			slog.Warn("settlement reorg check failed", "tx", tx, "err", err)
+			continue
+		}
+		if n >= rf.FinalityDepth() {
+			return
+		}
+		if n > 0 {
+			if missingSince != 0 {
+				slog.Info("settlement included again after reorg", "tx", tx, "confirmations", n)
+			}
+			seen, missingSince = true, 0
+			continue
+		}
+		if !seen {
+			continue
+		}
+
+		head, err := rf.BlockNumber(ctx)
+		if err != nil {
+			slog.Warn("settlement reorg check failed", "tx", tx, "err", err)
+			continue
+		}
+		if missingSince == 0 {
+			missingSince = head
+			slog.Warn("settlement dropped from the chain by a reorg", "tx", tx, "head", head)
+			continue
+		}
+		if head < missingSince+m.cfg.ReorgBlocks {
+			continue
+		}
+
+		revoked := withdraw()
+		slog.Error("settlement reorged out of the chain, credits withdrawn",
+			"tx", tx,
+			"payer", data["payer"],
+			"credits", data["credits"],
+			"missing_blocks", head-missingSince,
+			"token_revoked", revoked,
+		)
+		if err := m.cfg.Replay.Release(replayKey); err != nil {
+			slog.Error("replay cache release failed", "err", err)
+		}
+		data["transaction"] = tx
+		data["error"] = fmt.Sprintf("settlement transaction missing from the chain for %d blocks", head-missingSince)
+		data["tokenRevoked"] = revoked
+		m.notify(EventSettlementReorged, data)
+		return
+	}
+}
+
+// withdrawToken takes back credits issued as the token tokenStr, whatever
+// route it was bought for, as withdrawCredits does.
+func (m *Middleware) withdrawToken(tokenStr string, credits int64) (revoked bool) {
+	claims, err := m.cfg.Tokens.parse(tokenStr)
+	if err != nil {
+		slog.Error("withdrawing credits of unpaid token failed", "err", err)
+		return false
+	}
+	return m.withdrawCredits(claims, credits, false)
+}
@@ -0,0 +1,258 @@
+package x402
+
+import (
+	"container/heap"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ErrReplayCacheFull is returned by a bounded ReplayCache that cannot accept a
+// new entry without forgetting one that is still valid. Evicting a live entry
+// would reopen the replay window, so callers should fail the payment instead.
+var ErrReplayCacheFull = errors.New("replay cache full")
+
+// DefaultReplayCacheEntries is the capacity of the in-memory replay cache
+// used when MiddlewareConfig.Replay is nil.
+const DefaultReplayCacheEntries = 100_000
+
+// defaultReplayTTL is how long a payment without an EIP-3009 validBefore is
+// remembered.
+const defaultReplayTTL = 24 * time.Hour
+
+// ReplayCache records payment authorizations that have already been redeemed,
+// so one signed payment cannot be exchanged for several batch tokens.
+// Implementations must be safe for concurrent use; persistent backends keep
+// the guarantee across restarts and, for shared databases, across replicas.
+type ReplayCache interface {
+	// Reserve atomically records key until expiresAt, with the resendDigest
+	// of the payment, empty if its client set no resend secret. It returns
+	// false if key is already present and unexpired, meaning the payment has
+	// been (or is being) redeemed.
+	Reserve(key, resendHash string, expiresAt time.Time) (bool, error)
+
+	// Release forgets key so the client may retry the same authorization.
+	// Only call this when the payment is known not to have been settled.
+	Release(key string) error
+
+	// SetToken records the batch token that the payment under key was
+	// redeemed for, so a client that lost the response can get it back.
+	SetToken(key, token string) error
+
+	// Token returns the token recorded by SetToken and the resend hash
+	// recorded by Reserve. The token is "" if key is unknown, expired, or
+	// has no token yet.
+	Token(key string) (token, resendHash string, err error)
+
+	// Prune deletes entries that expired before now and returns how many were
+	// removed. Expired entries are never treated as replays, so pruning only
+	// reclaims space.
+	Prune(now time.Time) (int, error)
+}
+
+// replayEntry derives the replay-cache key and retention deadline for a
+// payment payload made against req.
+//
+// EIP-3009 authorizations are single-use per (token contract, authorizer,
+// nonce) on-chain, so that tuple — qualified by network — identifies a payment
+// regardless of how the client re-encodes the surrounding JSON. Network and
+// asset come from the gateway's requirements, not the client's echo. Once
+// validBefore has passed the authorization can no longer be settled, so the
+// entry need not outlive it. Payloads that don't carry an EIP-3009
+// authorization fall back to a hash of the raw bytes and defaultReplayTTL.
+// Permit2 permits (permit2 and upto schemes) are keyed on (network, owner,
+// nonce), Permit2's own single-use unit, and kept until the permit's deadline.
+func replayEntry(payloadBytes []byte, req *paymentRequirementsV2) (key string, expiresAt time.Time) {
+	p, err := parseLocalPayload(payloadBytes)
+	if err == nil && usesPermit2(req.Scheme) && p.Payload.Permit2Authorization.From != "" {
+		a := &p.Payload.Permit2Authorization
+		key = strings.ToLower(strings.Join([]string{
+			"permit2",
+			req.Network,
+			common.HexToAddress(a.From).Hex(),
+			mustBI(a.Nonce).String(),
+		}, "|"))
+		deadline := mustBI(a.Deadline)
+		if deadline.Sign() > 0 && deadline.IsInt64() {
+			return key, time.Unix(deadline.Int64(), 0)
+		}
+		return key, time.Now().Add(defaultReplayTTL)
+	}
+	if err == nil && p.Payload.Authorization.From != "" && p.Payload.Authorization.Nonce != "" {
+		key = strings.ToLower(strings.Join([]string{
+			"eip3009",
+			req.Network,
+			common.HexToAddress(req.Asset).Hex(),
+			common.HexToAddress(p.Payload.Authorization.From).Hex(),
+			common.HexToHash(p.Payload.Authorization.Nonce).Hex(),
+		}, "|"))
+		validBefore := mustBI(p.Payload.Authorization.ValidBefore)
+		if validBefore.Sign() > 0 && validBefore.IsInt64() {
+			return key, time.Unix(validBefore.Int64(), 0)
+		}
+		return key, time.Now().Add(defaultReplayTTL)
+	}
+	if err == nil && IsSolanaNetwork(req.Network) && p.Payload.Transaction != "" {
+		// A Solana transaction is identified by its message, which the fee
+		// payer's signature (the transaction ID) signs. Its blockhash expires
+		// within minutes, after which it can no longer land.
+		if raw, err := base64.StdEncoding.DecodeString(p.Payload.Transaction); err == nil {
+			if tx, err := parseSolanaTx(raw); err == nil {
+				sum := sha256.Sum256(tx.message)
+				return "svm|" + req.Network + "|" + hex.EncodeToString(sum[:]), time.Now().Add(defaultReplayTTL)
+			}
+		}
+	}
+	sum := sha256.Sum256(payloadBytes)
+	return "sha256|" + hex.EncodeToString(sum[:]), time.Now().Add(defaultReplayTTL)
+}
+
+// minResendSecretLen is the shortest resend secret a client may set.
+const minResendSecretLen = 16
+
+// resendDigest is the hash a client must reproduce to get the token of a
+// payment it already made: of the payload and the secret it sent with it in
+// paymentResendSecretHeader. The payload alone will not do, as everything in
+// it is public once the authorization reaches the mempool. Empty, so that no
+// token is ever re-sent, when the secret is missing or too short.
+func resendDigest(payloadBytes []byte, secret string) string {
+	if len(secret) < minResendSecretLen {
+		return ""
+	}
+	h := sha256.New()
+	h.Write(payloadBytes)
+	h.Write([]byte{0})
+	h.Write([]byte(secret))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// InMemoryReplayCache is an in-memory ReplayCache holding at most maxEntries
+// live entries. Entries are evicted once their authorization expires.
+// NOTE: state is lost on process restart, after which a settled payment could
+// be replayed. Use a bolt or postgres backend for anything beyond a demo.
+type InMemoryReplayCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[string]*replayItem
+	byExpiry   replayHeap
+}
+
+// NewInMemoryReplayCache creates an empty in-memory replay cache. maxEntries
+// <= 0 means unbounded.
+func NewInMemoryReplayCache(maxEntries int) *InMemoryReplayCache {
+	return &InMemoryReplayCache{
+		maxEntries: maxEntries,
+		entries:    make(map[string]*replayItem),
+	}
+}
+
+// Reserve records key, with resendHash, until expiresAt, returning false if
+// it is already present. When the cache is at capacity after dropping expired
+// entries it returns ErrReplayCacheFull.
+func (c *InMemoryReplayCache) Reserve(key, resendHash string, expiresAt time.Time) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.pruneLocked(now)
+	if _, ok := c.entries[key]; ok {
+		return false, nil
+	}
+	if c.maxEntries > 0 && len(c.entries) >= c.maxEntries {
+		return false, ErrReplayCacheFull
+	}
+	it := &replayItem{key: key, expiresAt: expiresAt, resendHash: resendHash}
+	c.entries[key] = it
+	heap.Push(&c.byExpiry, it)
+	return true, nil
+}
+
+// Release forgets key.
+func (c *InMemoryReplayCache) Release(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if it, ok := c.entries[key]; ok {
+		heap.Remove(&c.byExpiry, it.index)
+		delete(c.entries, key)
+	}
+	return nil
+}
+
+// SetToken records the token issued for key. Unknown keys are ignored.
+func (c *InMemoryReplayCache) SetToken(key, token string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if it, ok := c.entries[key]; ok {
+		it.token = token
+	}
+	return nil
+}
+
+// Token returns the token and resend hash recorded for key.
+func (c *InMemoryReplayCache) Token(key string) (string, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	it, ok := c.entries[key]
+	if !ok || it.expiresAt.Before(time.Now()) {
+		return "", "", nil
+	}
+	return it.token, it.resendHash, nil
+}
+
+// Prune drops every entry that expired before now.
+func (c *InMemoryReplayCache) Prune(now time.Time) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pruneLocked(now), nil
+}
+
+func (c *InMemoryReplayCache) pruneLocked(now time.Time) int {
+	n := 0
+	for len(c.byExpiry) > 0 && c.byExpiry[0].expiresAt.Before(now) {
+		it := heap.Pop(&c.byExpiry).(*replayItem)
+		delete(c.entries, it.key)
+		n++
+	}
+	return n
+}
+
+// replayItem is one cache entry; index is its position in replayHeap.
+type replayItem struct {
+	key        string
+	expiresAt  time.Time
+	token      string
+	resendHash string
+	index      int
+}
+
+// replayHeap is a min-heap of entries ordered by expiry, so the next entry to
+// expire is always at index 0.
+type replayHeap []*replayItem
+
+func (h replayHeap) Len() int           { return len(h) }
+func (h replayHeap) Less(i, j int) bool { return h[i].expiresAt.Before(h[j].expiresAt) }
+func (h replayHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *replayHeap) Push(x any) {
+	it := x.(*replayItem)
+	it.index = len(*h)
+	*h = append(*h, it)
+}
+
+func (h *replayHeap) Pop() any {
+	old := *h
+	it := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return it
+}
@@ -0,0 +1,116 @@
+package x402
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Route puts the payment gate in front of an HTTP API other than the
+// JSON-RPC endpoint at /, such as a REST service or an inference server.
+// Requests to Prefix or a path under it are charged Credits each, whatever
+// their body, and passed to Next with Prefix cut from their path. Tokens
+// scoped to JSON-RPC methods cannot be spent on a route.
+type Route struct {
+	// Prefix is the path the route serves, such as "/v1"; it matches
+	// "/v1" and "/v1/models" but not "/v1beta".
+	Prefix string
+	// Methods, when set, are the only HTTP methods the route accepts.
+	Methods []string
+	// Credits is what one request costs.
+	Credits int64
+	// Next is the handler requests are proxied to.
+	Next http.Handler
+}
+
+// routeKey is the context key of the route a request was matched to.
+type routeKey struct{}
+
+// validateRoutes checks that routes are usable and that no two serve the
+// same prefix.
+func validateRoutes(routes []Route) error {
+	seen := make(map[string]bool, len(routes))
+	for _, rt := range routes {
+		if !strings.HasPrefix(rt.Prefix, "/") || rt.Prefix == "/" || strings.HasSuffix(rt.Prefix, "/") {
+			return fmt.Errorf("route %q: prefix must be a path other than / without a trailing slash", rt.Prefix)
+		}
+		if seen[rt.Prefix] {
+			return fmt.Errorf("route %s listed twice", rt.Prefix)
+		}
+		seen[rt.Prefix] = true
+		if rt.Credits <= 0 {
+			return fmt.Errorf("route %s: credits must be positive, got %d", rt.Prefix, rt.Credits)
+		}
+		if rt.Next == nil {
+			return fmt.Errorf("route %s: no upstream handler", rt.Prefix)
+		}
+	}
+	return nil
+}
+
+// matchRoute returns the route r's path falls under, the longest prefix
+// winning, or nil if there is none.
+func (m *Middleware) matchRoute(r *http.Request) *Route {
+	var match *Route
+	for i := range m.cfg.Routes {
+		rt := &m.cfg.Routes[i]
+		rest, ok := strings.CutPrefix(r.URL.Path, rt.Prefix)
+		if !ok || (rest != "" && rest[0] != '/') {
+			continue
+		}
+		if match == nil || len(rt.Prefix) > len(match.Prefix) {
+			match = rt
+		}
+	}
+	return match
+}
+
+// withRoute returns r bound to rt, with rt's prefix cut from its path.
+func withRoute(r *http.Request, rt *Route) *http.Request {
+	r = r.WithContext(context.WithValue(r.Context(), routeKey{}, rt))
+	u := *r.URL
+	u.Path = strings.TrimPrefix(u.Path, rt.Prefix)
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.RawPath = ""
+	r.URL = &u
+	return r
+}
+
+// routeOf returns the route r is bound to, or nil for a JSON-RPC request.
+func routeOf(r *http.Request) *Route {
+	rt, _ := r.Context().Value(routeKey{}).(*Route)
+	return rt
+}
+
+// allows reports whether the route accepts the HTTP method.
+func (rt *Route) allows(method string) bool {
+	return len(rt.Methods) == 0 || slices.Contains(rt.Methods, method)
+}
+
+// next returns the handler r is proxied to: its route's, or the JSON-RPC
+// upstream behind any response hooks.
+func (m *Middleware) next(r *http.Request) http.Handler {
+	if rt := routeOf(r); rt != nil {
+		return rt.Next
+	}
+	if ex := exchangeOf(r); ex != nil {
+		return m.withResponseHooks(ex, m.cfg.Next)
+	}
+	return m.cfg.Next
+}
+
+// cost returns the credits r costs: its route's price, the price hooks set,
+// or that of the JSON-RPC calls it makes.
+func (m *Middleware) cost(r *http.Request, calls []rpcCall) int64 {
+	if rt := routeOf(r); rt != nil {
+		return rt.Credits
+	}
+	if ex := exchangeOf(r); ex != nil {
+		return max(ex.Cost, 0)
+	}
+	return m.requestCost(calls)
+}
@@ -0,0 +1,54 @@
+package x402
+
+import (
+	"context"
+	"fmt"
+)
+
+// NetworkFacilitator verifies and settles each payment through the
+// facilitator for the network it is made on, so one gateway can offer
+// payments on several networks with different settlement backends: a remote
+// facilitator for one chain, the local facilitator for another.
+//
+// The network is read from the gateway's requirements for the offer paid,
+// so a client cannot steer its payment to another network's facilitator.
+type NetworkFacilitator struct {
+	facilitators map[string]FacilitatorClient
+}
+
+// NewNetworkFacilitator returns a FacilitatorClient routing payments on each
+// network of facilitators, keyed by CAIP-2 identifier, to its facilitator.
+func NewNetworkFacilitator(facilitators map[string]FacilitatorClient) *NetworkFacilitator {
+	return &NetworkFacilitator{facilitators: facilitators}
+}
+
+// Verify verifies the payment with the facilitator for its network.
+func (f *NetworkFacilitator) Verify(ctx context.Context, payloadBytes, requirementsBytes []byte) (*VerifyResult, error) {
+	fc, err := f.route(requirementsBytes)
+	if err != nil {
+		return nil, err
+	}
+	return fc.Verify(ctx, payloadBytes, requirementsBytes)
+}
+
+// Settle settles the payment with the facilitator for its network.
+func (f *NetworkFacilitator) Settle(ctx context.Context, payloadBytes, requirementsBytes []byte) (*SettleResult, error) {
+	fc, err := f.route(requirementsBytes)
+	if err != nil {
+		return nil, err
+	}
+	return fc.Settle(ctx, payloadBytes, requirementsBytes)
+}
+
+// route returns the facilitator for the network of the requirements.
+func (f *NetworkFacilitator) route(requirementsBytes []byte) (FacilitatorClient, error) {
+	req, err := parseRequirements(requirementsBytes)
+	if err != nil {
+		return nil, err
+	}
+	fc, ok := f.facilitators[req.Network]
+	if !ok {
+		return nil, fmt.Errorf("no facilitator for network %q", req.Network)
+	}
+	return fc, nil
+}
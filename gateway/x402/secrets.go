@@ -0,0 +1,218 @@
+package x402
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	gcpSecretsEndpoint = "https://secretmanager.googleapis.com/v1/"
+	gcpCloudScope      = "https://www.googleapis.com/auth/cloud-platform"
+)
+
+// SecretSource reads secrets kept in a secrets manager rather than in the
+// gateway's environment.
+type SecretSource interface {
+	// Secret returns the value of the secret ref names, in the manager's
+	// own reference format, with an optional "#field" suffix picking one
+	// field of a secret holding a JSON object.
+	Secret(ctx context.Context, ref string) (string, error)
+}
+
+// splitSecretRef splits a secret reference into the secret's name and the
+// field after "#", if any.
+func splitSecretRef(ref string) (name, field string) {
+	name, field, _ = strings.Cut(ref, "#")
+	return name, field
+}
+
+// secretField returns the field of a secret's JSON object value, or the
+// whole value when no field is named.
+func secretField(value, field, ref string) (string, error) {
+	if field == "" {
+		return value, nil
+	}
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(value), &fields); err != nil {
+		return "", fmt.Errorf("secret %s is not a JSON object: %w", ref, err)
+	}
+	return stringField(fields, field, ref)
+}
+
+// stringField returns the string field of a secret's fields.
+func stringField(fields map[string]any, field, ref string) (string, error) {
+	v, ok := fields[field].(string)
+	if !ok {
+		return "", fmt.Errorf("secret %s has no string field %q", ref, field)
+	}
+	return v, nil
+}
+
+// vaultSecrets reads secrets from HashiCorp Vault's KV engine.
+type vaultSecrets struct {
+	addr      string
+	token     string
+	namespace string
+	client    *http.Client
+}
+
+// NewVaultSecrets returns a SecretSource reading KV secrets, version 1 or
+// 2, from the Vault at addr with token. Its references are "path#field":
+// the path the secret is read at, such as "secret/data/gateway" for a KV
+// version 2 engine mounted at "secret", and the field to return.
+func NewVaultSecrets(addr, token, namespace string) SecretSource {
+	return &vaultSecrets{
+		addr:      strings.TrimSuffix(addr, "/"),
+		token:     token,
+		namespace: namespace,
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (v *vaultSecrets) Secret(ctx context.Context, ref string) (string, error) {
+	path, field := splitSecretRef(ref)
+	if path == "" || field == "" {
+		return "", fmt.Errorf("vault secret reference must be path#field, got %q", ref)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.addr+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+	var out struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := doJSON(v.client, req, &out); err != nil {
+		return "", fmt.Errorf("reading vault secret %s: %w", path, err)
+	}
+	// KV version 2 nests the secret's fields under data.data, next to
+	// data.metadata.
+	fields := out.Data
+	if nested, ok := fields["data"].(map[string]any); ok {
+		if _, versioned := fields["metadata"]; versioned {
+			fields = nested
+		}
+	}
+	return stringField(fields, field, ref)
+}
+
+// AWSSecretsConfig locates AWS Secrets Manager and the credentials to read
+// from it.
+type AWSSecretsConfig struct {
+	// Region is the AWS region holding the secrets, e.g. "us-east-1".
+	Region string
+	// AccessKeyID, SecretAccessKey and, for temporary credentials,
+	// SessionToken authenticate the requests. The principal needs
+	// secretsmanager:GetSecretValue on the secrets.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// awsSecrets calls the AWS Secrets Manager JSON API.
+type awsSecrets struct {
+	cfg      AWSSecretsConfig
+	endpoint string
+	client   *http.Client
+}
+
+// NewAWSSecrets returns a SecretSource reading from AWS Secrets Manager. Its
+// references are a secret's name or ARN, optionally with "#field".
+func NewAWSSecrets(cfg AWSSecretsConfig) (SecretSource, error) {
+	if cfg.Region == "" || cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		return nil, fmt.Errorf("AWS Secrets Manager needs a region and credentials")
+	}
+	return &awsSecrets{
+		cfg:      cfg,
+		endpoint: "https://secretsmanager." + cfg.Region + ".amazonaws.com/",
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (a *awsSecrets) Secret(ctx context.Context, ref string) (string, error) {
+	name, field := splitSecretRef(ref)
+	body, err := json.Marshal(map[string]string{"SecretId": name})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	if a.cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", a.cfg.SessionToken)
+	}
+	signSigV4(req, body, "secretsmanager", a.cfg.Region, a.cfg.AccessKeyID, a.cfg.SecretAccessKey, time.Now())
+
+	var out struct {
+		SecretString string `json:"SecretString"`
+	}
+	if err := doJSON(a.client, req, &out); err != nil {
+		return "", fmt.Errorf("reading AWS secret %s: %w", name, err)
+	}
+	if out.SecretString == "" {
+		return "", fmt.Errorf("AWS secret %s has no string value", name)
+	}
+	return secretField(out.SecretString, field, ref)
+}
+
+// gcpSecrets calls the GCP Secret Manager REST API.
+type gcpSecrets struct {
+	client *http.Client
+	tokens *gcpTokenSource
+}
+
+// NewGCPSecrets returns a SecretSource reading from GCP Secret Manager as
+// the service account in credentialsFile or, when it is empty, that of the
+// GCP instance the gateway runs on. Its references are
+// "projects/*/secrets/*", read at their latest version, or
+// "projects/*/secrets/*/versions/*", optionally with "#field". The account
+// needs secretmanager.versions.access on the secrets.
+func NewGCPSecrets(credentialsFile string) (SecretSource, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	tokens := &gcpTokenSource{client: client, scope: gcpCloudScope}
+	if credentialsFile != "" {
+		account, err := readServiceAccount(credentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		tokens.account = account
+	}
+	return &gcpSecrets{client: client, tokens: tokens}, nil
+}
+
+func (g *gcpSecrets) Secret(ctx context.Context, ref string) (string, error) {
+	name, field := splitSecretRef(ref)
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+	token, err := g.tokens.token(ctx)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gcpSecretsEndpoint+(&url.URL{Path: name}).EscapedPath()+":access", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	var out struct {
+		Payload struct {
+			Data []byte `json:"data"`
+		} `json:"payload"`
+	}
+	if err := doJSON(g.client, req, &out); err != nil {
+		return "", fmt.Errorf("reading GCP secret %s: %w", name, err)
+	}
+	return secretField(string(out.Payload.Data), field, ref)
+}
@@ -0,0 +1,450 @@
+package x402
+
+// Settlements made outside the HTTP request: upto payments settled for their
+// metered usage, and — in async mode — ordinary payments whose token was
+// issued as soon as they verified. Both are queued in a SettlementStore and
+// worked off by a background sweeper, with retries, so that a slow or flaky
+// RPC delays the money rather than failing the client's request. Payments
+// whose synchronous settlement failed are queued the same way, their token
+// issued once they settle. Settlements given up on are kept in a dead-letter
+// list for operators.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// settleTimeout bounds a single background settlement attempt.
+	settleTimeout = 2 * time.Minute
+	// settleRetryBase is the delay before the first retry of a failed
+	// settlement; it doubles with every further attempt up to settleRetryMax.
+	settleRetryBase = 5 * time.Second
+	settleRetryMax  = 5 * time.Minute
+	// maxSettleAttempts is how many times a settlement is tried before it is
+	// given up and its token revoked.
+	maxSettleAttempts = 8
+	// settlePendingRetryAfter is the Retry-After sent with a payment whose
+	// synchronous settlement failed and was queued for retries.
+	settlePendingRetryAfter = 30 * time.Second
+)
+
+// PendingSettlement is a verified payment awaiting settlement.
+type PendingSettlement struct {
+	// TokenID is the batch token the payment bought. For a payment whose
+	// synchronous settlement failed, which has no token yet, it is a random
+	// ID identifying the settlement.
+	TokenID string `json:"tid"`
+	// Payload is the client's decoded payment payload.
+	Payload []byte `json:"payload"`
+	// Requirements is the offer's requirements JSON. Under the upto scheme
+	// its amount is the maximum, charged in full only if every credit is used.
+	Requirements []byte `json:"requirements"`
+	// Credits is the number of credits the payment buys.
+	Credits int64 `json:"credits"`
+	// SettleAt is when the settlement falls due: at once for a deferred
+	// payment, the token's expiry for an upto one (earlier if it is used
+	// up), or the time of the next retry after a failed attempt.
+	SettleAt time.Time `json:"settleAt"`
+	// Deadline is when the authorization expires; settlement is abandoned
+	// after it.
+	Deadline time.Time `json:"deadline"`
+	// Attempts counts the failed settlement attempts so far.
+	Attempts int `json:"attempts,omitempty"`
+	// ReplayKey is the payment's replay cache key, under which a token
+	// issued once the payment settles is recorded.
+	ReplayKey string `json:"replayKey,omitempty"`
+	// Payer, Methods and Audience describe the token to issue for an
+	// unissued payment; Audience is the route it was bought for, if any.
+	Payer    string   `json:"payer,omitempty"`
+	Methods  []string `json:"methods,omitempty"`
+	Audience string   `json:"aud,omitempty"`
+	// Unissued marks a payment without a usable token: its synchronous
+	// settlement failed before one was issued, or its token was revoked when
+	// the settlement was given up on. Once it settles, a token is issued and
+	// handed to the client when it resubmits the payment.
+	Unissued bool `json:"unissued,omitempty"`
+	// LastError is the error of the latest failed attempt.
+	LastError string `json:"lastError,omitempty"`
+	// FailedAt is when the settlement was given up on.
+	FailedAt time.Time `json:"failedAt,omitzero"`
+}
+
+// SettlementStore keeps verified payments until they are settled. It is
+// implemented by the token stores so pending settlements are as durable as the
+// counters they pay for. Implementations must be safe for concurrent use.
+type SettlementStore interface {
+	// AddSettlement records p, replacing any settlement already recorded for
+	// its token.
+	AddSettlement(p PendingSettlement) error
+
+	// TakeSettlement removes and returns the settlement recorded for tokenID,
+	// or nil if there is none. Of several concurrent callers only one
+	// receives it.
+	TakeSettlement(tokenID string) (*PendingSettlement, error)
+
+	// DueSettlements returns the token IDs of settlements whose SettleAt is
+	// not after now.
+	DueSettlements(now time.Time) ([]string, error)
+
+	// AddDeadSettlement records a settlement that was given up on, replacing
+	// any recorded under the same token ID, until an operator retries or
+	// discards it.
+	AddDeadSettlement(p PendingSettlement) error
+
+	// DeadSettlements returns the settlements given up on, oldest first.
+	DeadSettlements() ([]PendingSettlement, error)
+
+	// TakeDeadSettlement removes and returns the dead settlement recorded
+	// under tokenID, or nil if there is none.
+	TakeDeadSettlement(tokenID string) (*PendingSettlement, error)
+}
+
+// sortDeadSettlements orders dead settlements oldest first.
+func sortDeadSettlements(ps []PendingSettlement) {
+	sort.Slice(ps, func(i, j int) bool { return ps[i].FailedAt.Before(ps[j].FailedAt) })
+}
+
+// enqueueSettlement records the payment a new token was issued against, to be
+// settled at settleAt.
+func (m *Middleware) enqueueSettlement(p *collectedPayment, claims *Claims, settleAt time.Time) error {
+	return m.cfg.Settlements.AddSettlement(PendingSettlement{
+		TokenID:      claims.TokenID,
+		Payload:      p.payload,
+		Requirements: p.offer.requirementsJSON,
+		Credits:      p.offer.credits,
+		SettleAt:     settleAt,
+		Deadline:     p.validUntil,
+		ReplayKey:    p.replayKey,
+		Payer:        p.result.Payer,
+		Methods:      p.offer.methods,
+		Audience:     m.cfg.Tokens.Audience(),
+	})
+}
+
+// queueFailedSettlement puts a payment whose synchronous settlement failed in
+// the settlement queue, to be retried in the background. No token has been
+// issued for it; one is once it settles (a fresh one, for a top-up), and
+// handed out when the client resubmits the payment.
+func (m *Middleware) queueFailedSettlement(p *collectedPayment, cause error) {
+	m.retrySettlement(&PendingSettlement{
+		TokenID:      uuid.New().String(),
+		Payload:      p.payload,
+		Requirements: p.offer.requirementsJSON,
+		Credits:      p.offer.credits,
+		Deadline:     p.validUntil,
+		ReplayKey:    p.replayKey,
+		Payer:        p.result.Payer,
+		Methods:      p.offer.methods,
+		Audience:     m.cfg.Tokens.Audience(),
+		Unissued:     true,
+	}, cause)
+}
+
+// settlePending settles the payment pending for tokenID, if there is one. A
+// failed settlement is put back to be retried by SettleDue.
+func (m *Middleware) settlePending(ctx context.Context, tokenID string) error {
+	p, err := m.cfg.Settlements.TakeSettlement(tokenID)
+	if err != nil || p == nil {
+		return err
+	}
+	return m.settleTaken(ctx, p)
+}
+
+// settleTaken settles a payment taken from the store, putting it back to be
+// retried if that fails.
+func (m *Middleware) settleTaken(ctx context.Context, p *PendingSettlement) error {
+	tokenID := p.TokenID
+	var req paymentRequirementsV2
+	if err := json.Unmarshal(p.Requirements, &req); err != nil {
+		err = fmt.Errorf("parsing requirements: %w", err)
+		m.retrySettlement(p, err)
+		return err
+	}
+	reqJSON := p.Requirements
+	if req.Scheme == SchemeUpto {
+		var (
+			done bool
+			err  error
+		)
+		reqJSON, done, err = m.meteredRequirements(p, req)
+		if err != nil {
+			m.retrySettlement(p, err)
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+
+	var settledReq paymentRequirementsV2
+	_ = json.Unmarshal(reqJSON, &settledReq)
+	data := paymentEventData(&settledReq, payloadPayer(p.Payload), p.Credits, p.ReplayKey)
+	data["tid"] = tokenID
+	m.notify(EventSettlementSubmitted, data)
+	settled, err := m.cfg.Facilitator.Settle(ctx, p.Payload, reqJSON)
+	if err != nil {
+		err = fmt.Errorf("settling: %w", err)
+		m.retrySettlement(p, err)
+		return err
+	}
+	m.trackTransaction(p.ReplayKey, settled.Transaction)
+	if rf, ok := m.receiptFacilitator(settled.Transaction); ok {
+		go m.awaitPendingSettled(rf, p, data, req.Scheme, settled.Transaction)
+		return nil
+	}
+	m.settlementConfirmed(p, data, req.Scheme, settled.Transaction)
+	return nil
+}
+
+// settlementConfirmed reports a pending payment settled by tx, and issues
+// its token if it has none yet.
+func (m *Middleware) settlementConfirmed(p *PendingSettlement, data map[string]any, scheme, tx string) {
+	data["transaction"] = tx
+	m.notify(EventSettlementConfirmed, data)
+	slog.Info("settled deferred payment", "tid", p.TokenID, "scheme", scheme, "tx", tx, "attempts", p.Attempts+1)
+	if p.Unissued {
+		m.issueSettledToken(p, tx)
+	}
+	go m.watchReorg(tx, p.ReplayKey, data, func() bool {
+		tokenStr, _, err := m.cfg.Replay.Token(p.ReplayKey)
+		if err != nil || tokenStr == "" {
+			slog.Error("withdrawing credits of reorged settlement failed", "tid", p.TokenID, "err", err)
+			return false
+		}
+		return m.withdrawToken(tokenStr, p.Credits)
+	})
+}
+
+// issueSettledToken issues the token an unissued payment bought, for the
+// route it was bought for, now that it has settled, and records it so the
+// client gets it by resubmitting the payment.
+func (m *Middleware) issueSettledToken(p *PendingSettlement, tx string) {
+	tokenStr, err := m.cfg.Tokens.Scoped(p.Audience).IssueToken(p.Payer, p.Credits, p.Methods)
+	if err != nil {
+		// The payment is settled: an operator has to make this good.
+		slog.Error("issuing token for settled payment failed", "id", p.TokenID, "payer", p.Payer, "tx", tx, "err", err)
+		return
+	}
+	if err := m.cfg.Replay.SetToken(p.ReplayKey, tokenStr); err != nil {
+		slog.Error("replay cache token record failed", "id", p.TokenID, "err", err)
+		return
+	}
+	slog.Info("issued batch token for settled payment", "id", p.TokenID, "payer", p.Payer, "credits", p.Credits)
+}
+
+// retrySettlement puts a payment whose settlement failed back in the store,
+// to be retried after an exponential backoff. Once its authorization has
+// expired or it has failed maxSettleAttempts times it is given up: the token
+// it bought is revoked and the settlement moved to the dead-letter list.
+func (m *Middleware) retrySettlement(p *PendingSettlement, cause error) {
+	p.Attempts++
+	p.LastError = cause.Error()
+	next := time.Now().Add(min(settleRetryBase<<(p.Attempts-1), settleRetryMax))
+	if p.Attempts < maxSettleAttempts && next.Before(p.Deadline) {
+		p.SettleAt = next
+		if err := m.cfg.Settlements.AddSettlement(*p); err != nil {
+			slog.Error("re-queueing settlement failed", "tid", p.TokenID, "err", err)
+		}
+		m.trackRetry(p.ReplayKey, p.Attempts, cause)
+		return
+	}
+
+	var req paymentRequirementsV2
+	_ = json.Unmarshal(p.Requirements, &req)
+	revoked := !p.Unissued
+	slog.Error("settlement abandoned",
+		"tid", p.TokenID,
+		"attempts", p.Attempts,
+		"token_revoked", revoked,
+		"err", cause,
+	)
+	if revoked {
+		if err := m.cfg.Tokens.Revoke(p.TokenID); err != nil {
+			slog.Error("revoking unpaid token failed", "tid", p.TokenID, "err", err)
+		}
+		// A metered token's credits were spent before it fell due; any
+		// other payment gets a new token should an operator's retry succeed.
+		p.Unissued = req.Scheme != SchemeUpto
+	}
+	p.FailedAt = time.Now()
+	if err := m.cfg.Settlements.AddDeadSettlement(*p); err != nil {
+		slog.Error("dead-lettering settlement failed", "tid", p.TokenID, "err", err)
+	}
+
+	data := paymentEventData(&req, payloadPayer(p.Payload), p.Credits, p.ReplayKey)
+	data["tid"] = p.TokenID
+	data["attempts"] = p.Attempts
+	data["error"] = cause.Error()
+	data["tokenRevoked"] = revoked
+	m.notify(EventSettlementFailed, data)
+}
+
+// DeadSettlements returns the settlements given up on after their retries
+// ran out, oldest first.
+func (m *Middleware) DeadSettlements() ([]PendingSettlement, error) {
+	if m.cfg.Settlements == nil {
+		return nil, nil
+	}
+	return m.cfg.Settlements.DeadSettlements()
+}
+
+// RetryDeadSettlement moves the dead settlement recorded under id back into
+// the queue with a fresh set of attempts, due at once. It reports false if
+// there is no such settlement.
+func (m *Middleware) RetryDeadSettlement(id string) (bool, error) {
+	if m.cfg.Settlements == nil {
+		return false, nil
+	}
+	p, err := m.cfg.Settlements.TakeDeadSettlement(id)
+	if err != nil || p == nil {
+		return false, err
+	}
+	queued := *p
+	queued.Attempts = 0
+	queued.SettleAt = time.Now()
+	queued.FailedAt = time.Time{}
+	if err := m.cfg.Settlements.AddSettlement(queued); err != nil {
+		if rerr := m.cfg.Settlements.AddDeadSettlement(*p); rerr != nil {
+			slog.Error("restoring dead settlement failed", "tid", id, "err", rerr)
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// DiscardDeadSettlement deletes the dead settlement recorded under id,
+// reporting false if there is none.
+func (m *Middleware) DiscardDeadSettlement(id string) (bool, error) {
+	if m.cfg.Settlements == nil {
+		return false, nil
+	}
+	p, err := m.cfg.Settlements.TakeDeadSettlement(id)
+	return p != nil, err
+}
+
+// settleAsync settles the payment pending for tokenID in the background,
+// after the response that prompted it has been sent.
+func (m *Middleware) settleAsync(tokenID string) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), settleTimeout)
+		defer cancel()
+		if err := m.settlePending(ctx, tokenID); err != nil {
+			slog.Warn("deferred settlement failed", "tid", tokenID, "err", err)
+		}
+	}()
+}
+
+// SettleDue settles every pending payment that has fallen due by now —
+// deferred payments, metered tokens that expired with credits left, and
+// earlier failed attempts — and returns how many were processed. Call it
+// periodically when upto assets are offered or settlement is asynchronous.
+// With SettlementBatchSize set, the payments that can be are settled in
+// batches.
+func (m *Middleware) SettleDue(ctx context.Context, now time.Time) (int, error) {
+	if m.cfg.Settlements == nil {
+		return 0, nil
+	}
+	ids, err := m.cfg.Settlements.DueSettlements(now)
+	if err != nil {
+		return 0, err
+	}
+	if m.cfg.SettlementBatchSize > 1 {
+		return len(ids), m.settleDueBatched(ctx, ids)
+	}
+	for _, id := range ids {
+		sctx, cancel := context.WithTimeout(ctx, settleTimeout)
+		if err := m.settlePending(sctx, id); err != nil {
+			slog.Warn("deferred settlement failed", "tid", id, "err", err)
+		}
+		cancel()
+	}
+	return len(ids), nil
+}
+
+// settleDueBatched settles the due payments the facilitator can batch in
+// batches of up to SettlementBatchSize, and the others one at a time.
+func (m *Middleware) settleDueBatched(ctx context.Context, ids []string) error {
+	bf := m.cfg.Facilitator.(BatchingFacilitator)
+	var batch []*PendingSettlement
+	for _, id := range ids {
+		p, err := m.cfg.Settlements.TakeSettlement(id)
+		if err != nil {
+			m.settleBatch(ctx, bf, batch)
+			return err
+		}
+		if p == nil {
+			continue
+		}
+		if !bf.Batchable(p.Requirements) {
+			sctx, cancel := context.WithTimeout(ctx, settleTimeout)
+			if err := m.settleTaken(sctx, p); err != nil {
+				slog.Warn("deferred settlement failed", "tid", id, "err", err)
+			}
+			cancel()
+			continue
+		}
+		batch = append(batch, p)
+		if len(batch) == m.cfg.SettlementBatchSize {
+			m.settleBatch(ctx, bf, batch)
+			batch = nil
+		}
+	}
+	m.settleBatch(ctx, bf, batch)
+	return nil
+}
+
+// settleBatch settles payments taken from the store in one batch, putting
+// those that fail back to be retried. A lone payment is settled on its own.
+func (m *Middleware) settleBatch(ctx context.Context, bf BatchingFacilitator, batch []*PendingSettlement) {
+	if len(batch) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, settleTimeout)
+	defer cancel()
+	if len(batch) == 1 {
+		if err := m.settleTaken(ctx, batch[0]); err != nil {
+			slog.Warn("deferred settlement failed", "tid", batch[0].TokenID, "err", err)
+		}
+		return
+	}
+
+	payments := make([]BatchPayment, len(batch))
+	events := make([]map[string]any, len(batch))
+	for i, p := range batch {
+		payments[i] = BatchPayment{Payload: p.Payload, Requirements: p.Requirements}
+		var req paymentRequirementsV2
+		_ = json.Unmarshal(p.Requirements, &req)
+		events[i] = paymentEventData(&req, payloadPayer(p.Payload), p.Credits, p.ReplayKey)
+		events[i]["tid"] = p.TokenID
+		m.notify(EventSettlementSubmitted, events[i])
+	}
+	results, err := bf.SettleBatch(ctx, payments)
+	if err != nil {
+		slog.Warn("batch settlement failed", "payments", len(batch), "err", err)
+		for _, p := range batch {
+			m.retrySettlement(p, fmt.Errorf("settling batch: %w", err))
+		}
+		return
+	}
+	for i, p := range batch {
+		err := results[i].Err
+		if err == nil && results[i].Transaction == "" {
+			err = errors.New("settled without a transaction")
+		}
+		if err != nil {
+			slog.Warn("deferred settlement failed", "tid", p.TokenID, "err", err)
+			m.retrySettlement(p, fmt.Errorf("settling: %w", err))
+			continue
+		}
+		scheme, _ := events[i]["scheme"].(string)
+		m.settlementConfirmed(p, events[i], scheme, results[i].Transaction)
+	}
+}
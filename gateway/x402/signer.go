@@ -0,0 +1,142 @@
+package x402
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Signer signs settlement transactions for one relayer account. Besides a
+// raw private key (NewKeySigner) or an encrypted keystore file
+// (NewKeystoreSigner), the key can be held by a remote signer or cloud KMS
+// that signs on the gateway's behalf without ever releasing it
+// (NewExternalSigner, NewAWSKMSSigner, NewGCPKMSSigner).
+type Signer interface {
+	// Address is the account the signer signs for.
+	Address() common.Address
+	// SignTx returns tx signed for chainID.
+	SignTx(ctx context.Context, tx *types.Transaction, chainID *big.Int) (*types.Transaction, error)
+}
+
+// keySigner signs with a private key held in memory.
+type keySigner struct {
+	key     *ecdsa.PrivateKey
+	address common.Address
+}
+
+// NewKeySigner returns a Signer for the hex-encoded private key.
+func NewKeySigner(privateKeyHex string) (Signer, error) {
+	key, err := crypto.HexToECDSA(strings.TrimPrefix(privateKeyHex, "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	return &keySigner{key: key, address: crypto.PubkeyToAddress(key.PublicKey)}, nil
+}
+
+// NewKeystoreSigner returns a Signer for the key in an encrypted keystore
+// file, as written by geth account new or clef newaccount.
+func NewKeystoreSigner(path, passphrase string) (Signer, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading keystore: %w", err)
+	}
+	key, err := keystore.DecryptKey(raw, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting keystore %s: %w", path, err)
+	}
+	return &keySigner{key: key.PrivateKey, address: key.Address}, nil
+}
+
+func (s *keySigner) Address() common.Address { return s.address }
+
+func (s *keySigner) SignTx(_ context.Context, tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	return types.SignTx(tx, types.LatestSignerForChainID(chainID), s.key)
+}
+
+// remoteSigner signs with a key held elsewhere: sign returns the DER-encoded
+// ECDSA signature of a 32-byte digest.
+type remoteSigner struct {
+	address common.Address
+	sign    func(ctx context.Context, digest []byte) ([]byte, error)
+}
+
+func (s *remoteSigner) Address() common.Address { return s.address }
+
+func (s *remoteSigner) SignTx(ctx context.Context, tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	signer := types.LatestSignerForChainID(chainID)
+	hash := signer.Hash(tx)
+	der, err := s.sign(ctx, hash[:])
+	if err != nil {
+		return nil, err
+	}
+	sig, err := recoverableSignature(der, hash[:], s.address)
+	if err != nil {
+		return nil, err
+	}
+	return tx.WithSignature(signer, sig)
+}
+
+// recoverableSignature converts a DER-encoded ECDSA signature over digest by
+// address's key into Ethereum's 65-byte [R || S || V] form: S in the lower
+// half of the curve order, V the recovery ID that yields address.
+func recoverableSignature(der, digest []byte, address common.Address) ([]byte, error) {
+	var parsed struct{ R, S *big.Int }
+	if rest, err := asn1.Unmarshal(der, &parsed); err != nil || len(rest) > 0 {
+		return nil, errors.New("malformed DER signature")
+	}
+	n := crypto.S256().Params().N
+	if parsed.R.Sign() <= 0 || parsed.R.Cmp(n) >= 0 || parsed.S.Sign() <= 0 || parsed.S.Cmp(n) >= 0 {
+		return nil, errors.New("signature out of range")
+	}
+	if parsed.S.Cmp(new(big.Int).Rsh(n, 1)) > 0 {
+		parsed.S = new(big.Int).Sub(n, parsed.S)
+	}
+
+	sig := make([]byte, crypto.SignatureLength)
+	parsed.R.FillBytes(sig[:32])
+	parsed.S.FillBytes(sig[32:64])
+	for v := byte(0); v < 2; v++ {
+		sig[64] = v
+		pub, err := crypto.SigToPub(digest, sig)
+		if err == nil && crypto.PubkeyToAddress(*pub) == address {
+			return sig, nil
+		}
+	}
+	return nil, fmt.Errorf("signature does not recover to %s", address.Hex())
+}
+
+// secp256k1OID identifies the secp256k1 curve in a SubjectPublicKeyInfo.
+var secp256k1OID = asn1.ObjectIdentifier{1, 3, 132, 0, 10}
+
+// secp256k1Address returns the Ethereum address of the secp256k1 public key
+// in a DER-encoded SubjectPublicKeyInfo, which crypto/x509 cannot parse.
+func secp256k1Address(der []byte) (common.Address, error) {
+	var spki struct {
+		Algorithm struct {
+			Algorithm asn1.ObjectIdentifier
+			Curve     asn1.ObjectIdentifier
+		}
+		PublicKey asn1.BitString
+	}
+	if rest, err := asn1.Unmarshal(der, &spki); err != nil || len(rest) > 0 {
+		return common.Address{}, errors.New("malformed public key")
+	}
+	if !spki.Algorithm.Curve.Equal(secp256k1OID) {
+		return common.Address{}, fmt.Errorf("key is on curve %s, not secp256k1", spki.Algorithm.Curve)
+	}
+	pub, err := crypto.UnmarshalPubkey(spki.PublicKey.Bytes)
+	if err != nil {
+		return common.Address{}, fmt.Errorf("invalid public key: %w", err)
+	}
+	return crypto.PubkeyToAddress(*pub), nil
+}
@@ -0,0 +1,70 @@
+package x402
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// ErrSettlementWouldRevert is returned by the local facilitator when a
+// settlement, simulated with eth_call before any gas is paid, reverts: the
+// authorization was already used, the payer's balance is short, the token is
+// paused, and so on. The error carries the contract's revert reason.
+var ErrSettlementWouldRevert = errors.New("settlement would revert")
+
+// simulationTimeout bounds the settlement simulation during Verify.
+const simulationTimeout = 5 * time.Second
+
+// simulate runs callData against target with eth_call, sent from from,
+// returning an error wrapping ErrSettlementWouldRevert if it reverts. A
+// failure to run the call at all is returned as is.
+func simulate(ctx context.Context, client *ethclient.Client, from, target common.Address, callData []byte) error {
+	_, err := client.CallContract(ctx, ethereum.CallMsg{From: from, To: &target, Data: callData}, nil)
+	if err == nil {
+		return nil
+	}
+	var dataErr rpc.DataError
+	if errors.As(err, &dataErr) {
+		if s, ok := dataErr.ErrorData().(string); ok {
+			if data, decodeErr := hexutil.Decode(s); decodeErr == nil {
+				return fmt.Errorf("%w: %s", ErrSettlementWouldRevert, revertReason(data))
+			}
+		}
+	}
+	// Some nodes report a revert without its data.
+	if strings.Contains(err.Error(), "execution reverted") {
+		return fmt.Errorf("%w: %v", ErrSettlementWouldRevert, err)
+	}
+	return err
+}
+
+// simulateSettlement checks during Verify that the settlement call would
+// succeed if sent now by the primary relayer. Like checkFunds it lets the
+// payment through when the chain cannot be read.
+func (f *LocalFacilitator) simulateSettlement(ctx context.Context, target common.Address, callData []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, simulationTimeout)
+	defer cancel()
+
+	client, err := f.dial(ctx)
+	if err != nil {
+		slog.Warn("settlement simulation skipped", "err", fmt.Errorf("rpc connect: %w", err))
+		return nil
+	}
+	defer client.Close()
+
+	err = simulate(ctx, client, f.address, target, callData)
+	if err != nil && !errors.Is(err, ErrSettlementWouldRevert) {
+		slog.Warn("settlement simulation skipped", "err", err)
+		return nil
+	}
+	return err
+}
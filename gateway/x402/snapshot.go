@@ -0,0 +1,249 @@
+package x402
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshotVersion is bumped whenever the snapshot file format changes.
+const snapshotVersion = 1
+
+// memorySnapshot is the on-disk form of the in-memory token store and replay
+// cache. It lets a small deployment survive a restart without a database.
+type memorySnapshot struct {
+	Version int                      `json:"version"`
+	SavedAt time.Time                `json:"savedAt"`
+	Tokens  map[string]snapshotToken `json:"tokens"`
+	Revoked []string                 `json:"revoked,omitempty"`
+	Replay  map[string]time.Time     `json:"replay"`
+	// ReplayTokens maps replay keys to the token the payment was redeemed for.
+	ReplayTokens map[string]string `json:"replayTokens,omitempty"`
+	// ReplayResend maps replay keys to their resend hash, if any.
+	ReplayResend map[string]string `json:"replayResend,omitempty"`
+	// Settlements holds payments not yet settled, keyed by token ID. The key
+	// predates deferred settlement, when only upto payments were pending.
+	Settlements map[string]PendingSettlement `json:"upto,omitempty"`
+	// DeadSettlements holds the settlements given up on, keyed by token ID.
+	DeadSettlements map[string]PendingSettlement `json:"deadSettlements,omitempty"`
+	// FreeRequests holds the free tier counts by client and day.
+	FreeRequests map[string]snapshotFreeCount `json:"freeRequests,omitempty"`
+	// LedgerBalances holds the ledger's balances; its entries are not kept.
+	LedgerBalances []LedgerBalance `json:"ledgerBalances,omitempty"`
+	// IssuedTokens holds the token index.
+	IssuedTokens []IssuedToken `json:"issuedTokens,omitempty"`
+}
+
+type snapshotToken struct {
+	Total int64 `json:"total"`
+	Used  int64 `json:"used"`
+}
+
+type snapshotFreeCount struct {
+	Used      int64     `json:"used"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// SaveSnapshot writes the state of store and replay to path. The file is
+// written to a temporary sibling and renamed into place, so a crash mid-write
+// never leaves a truncated snapshot behind.
+func SaveSnapshot(path string, store *InMemoryTokenStore, replay *InMemoryReplayCache) error {
+	tokens, revoked, settlements, dead, free := store.snapshot()
+	replayEntries, replayTokens, replayResend := replay.snapshot()
+	snap := memorySnapshot{
+		Version:      snapshotVersion,
+		SavedAt:      time.Now().UTC(),
+		Tokens:       tokens,
+		Revoked:      revoked,
+		Replay:       replayEntries,
+		ReplayTokens: replayTokens,
+		ReplayResend: replayResend,
+		Settlements:  settlements,
+		FreeRequests: free,
+
+		DeadSettlements: dead,
+		LedgerBalances:  store.ledgerSnapshot(),
+		IssuedTokens:    store.indexSnapshot(),
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("encoding snapshot: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("creating snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // no-op after a successful rename
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing snapshot: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("syncing snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("closing snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("installing snapshot: %w", err)
+	}
+	return nil
+}
+
+// LoadSnapshot restores store and replay from a snapshot written by
+// SaveSnapshot. A missing file is not an error — it is the normal first boot.
+func LoadSnapshot(path string, store *InMemoryTokenStore, replay *InMemoryReplayCache) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading snapshot: %w", err)
+	}
+
+	var snap memorySnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("decoding snapshot: %w", err)
+	}
+	if snap.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", snap.Version)
+	}
+
+	store.restore(snap.Tokens, snap.Revoked, snap.Settlements, snap.DeadSettlements, snap.FreeRequests)
+	store.restoreLedger(snap.LedgerBalances)
+	store.restoreIndex(snap.IssuedTokens)
+	replay.restore(snap.Replay, snap.ReplayTokens, snap.ReplayResend)
+	return nil
+}
+
+// snapshot returns a copy of every token counter, the revoked token IDs, the
+// pending and dead settlements and the free tier counts.
+func (s *InMemoryTokenStore) snapshot() (map[string]snapshotToken, []string, map[string]PendingSettlement, map[string]PendingSettlement, map[string]snapshotFreeCount) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tokens := make(map[string]snapshotToken, len(s.entries))
+	for id, e := range s.entries {
+		tokens[id] = snapshotToken{Total: e.total, Used: e.used}
+	}
+	revoked := make([]string, 0, len(s.revoked))
+	for id := range s.revoked {
+		revoked = append(revoked, id)
+	}
+	settlements := make(map[string]PendingSettlement, len(s.settlements))
+	for id, p := range s.settlements {
+		settlements[id] = p
+	}
+	dead := make(map[string]PendingSettlement, len(s.dead))
+	for id, p := range s.dead {
+		dead[id] = p
+	}
+	free := make(map[string]snapshotFreeCount, len(s.free))
+	for key, c := range s.free {
+		free[key] = snapshotFreeCount{Used: c.used, ExpiresAt: c.expiresAt}
+	}
+	return tokens, revoked, settlements, dead, free
+}
+
+// restore adds the given counters, pending and dead settlements and free tier
+// counts, overwriting any with the same key, and marks the given IDs revoked.
+func (s *InMemoryTokenStore) restore(tokens map[string]snapshotToken, revoked []string, settlements, dead map[string]PendingSettlement, free map[string]snapshotFreeCount) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, t := range tokens {
+		s.entries[id] = &entry{total: t.Total, used: t.Used}
+	}
+	for _, id := range revoked {
+		s.revoked[id] = struct{}{}
+	}
+	for id, p := range settlements {
+		s.settlements[id] = p
+	}
+	for id, p := range dead {
+		s.dead[id] = p
+	}
+	for key, c := range free {
+		s.free[key] = &freeCount{used: c.Used, expiresAt: c.ExpiresAt}
+	}
+}
+
+// ledgerSnapshot returns a copy of the ledger balances.
+func (s *InMemoryTokenStore) ledgerSnapshot() []LedgerBalance {
+	balances, _ := s.LedgerBalances("")
+	return balances
+}
+
+// restoreLedger sets the given ledger balances.
+func (s *InMemoryTokenStore) restoreLedger(balances []LedgerBalance) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range balances {
+		if b.Amount != nil {
+			s.balances[[2]string{b.Account, b.Unit}] = b.Amount
+		}
+	}
+}
+
+// indexSnapshot returns a copy of the token index.
+func (s *InMemoryTokenStore) indexSnapshot() []IssuedToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]IssuedToken, 0, len(s.issued))
+	for _, t := range s.issued {
+		out = append(out, t)
+	}
+	return out
+}
+
+// restoreIndex adds the given tokens to the token index.
+func (s *InMemoryTokenStore) restoreIndex(tokens []IssuedToken) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range tokens {
+		s.issued[t.ID] = t
+	}
+}
+
+// snapshot returns the unexpired entries with their expiries, and the tokens
+// and resend hashes recorded for them.
+func (c *InMemoryReplayCache) snapshot() (map[string]time.Time, map[string]string, map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pruneLocked(time.Now())
+	out := make(map[string]time.Time, len(c.entries))
+	tokens := make(map[string]string)
+	resend := make(map[string]string)
+	for key, it := range c.entries {
+		out[key] = it.expiresAt
+		if it.token != "" {
+			tokens[key] = it.token
+		}
+		if it.resendHash != "" {
+			resend[key] = it.resendHash
+		}
+	}
+	return out, tokens, resend
+}
+
+// restore adds the given entries, skipping any that have since expired or are
+// already present. The capacity check is bypassed: dropping a live entry on
+// restore would reopen the replay window the snapshot exists to close.
+func (c *InMemoryReplayCache) restore(entries map[string]time.Time, tokens, resend map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for key, expiresAt := range entries {
+		if _, ok := c.entries[key]; ok || expiresAt.Before(now) {
+			continue
+		}
+		it := &replayItem{key: key, expiresAt: expiresAt, token: tokens[key], resendHash: resend[key]}
+		c.entries[key] = it
+		heap.Push(&c.byExpiry, it)
+	}
+}
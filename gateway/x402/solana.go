@@ -0,0 +1,405 @@
+package x402
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+const (
+	// solanaMaxComputeUnitPrice caps the priority fee a payment transaction
+	// may set, in micro-lamports per compute unit: the fee payer pays it.
+	solanaMaxComputeUnitPrice = 5_000_000
+	// solanaPollInterval is how often a settlement's status is polled.
+	solanaPollInterval = 2 * time.Second
+	// solanaFinalizedConfirmations is reported for a finalized settlement,
+	// whose confirmations the RPC no longer counts.
+	solanaFinalizedConfirmations = 32
+)
+
+// SolanaFacilitator verifies and settles x402 "exact" payments of SPL tokens,
+// such as USDC, on Solana. The client signs a transaction moving the tokens
+// with TransferChecked into the payee's associated token account and naming
+// the facilitator's fee payer as fee payer; the facilitator checks it, adds
+// the fee payer's signature and submits it through a Solana RPC node.
+//
+// The transaction may only hold compute budget and memo instructions besides
+// the transfer, and the fee payer may appear in none of them, so signing it
+// can cost the fee payer nothing but the fee. A durable nonce transaction,
+// signed ahead of time, may also start by advancing its nonce account.
+type SolanaFacilitator struct {
+	rpcURL   string
+	network  string
+	key      ed25519.PrivateKey
+	feePayer solanaAddress
+}
+
+// NewSolanaFacilitator creates a SolanaFacilitator settling on network (a
+// "solana:" CAIP-2 identifier) through rpcURL. feePayerKey is the fee
+// payer's keypair, base58-encoded or as the JSON byte array solana-keygen
+// writes; the account needs SOL for fees.
+func NewSolanaFacilitator(rpcURL, network, feePayerKey string) (*SolanaFacilitator, error) {
+	if !IsSolanaNetwork(network) {
+		return nil, fmt.Errorf("%s is not a Solana network", network)
+	}
+	key, err := parseSolanaKey(feePayerKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Solana fee payer key: %w", err)
+	}
+	f := &SolanaFacilitator{rpcURL: rpcURL, network: network, key: key}
+	copy(f.feePayer[:], key.Public().(ed25519.PublicKey))
+	return f, nil
+}
+
+// parseSolanaKey decodes a 64-byte Solana keypair (seed then public key).
+func parseSolanaKey(s string) (ed25519.PrivateKey, error) {
+	s = strings.TrimSpace(s)
+	var raw []byte
+	if strings.HasPrefix(s, "[") {
+		if err := json.Unmarshal([]byte(s), &raw); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if raw, err = base58Decode(s); err != nil {
+			return nil, err
+		}
+	}
+	if len(raw) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("keypair is %d bytes, not %d", len(raw), ed25519.PrivateKeySize)
+	}
+	key := ed25519.NewKeyFromSeed(raw[:ed25519.SeedSize])
+	if !key.Public().(ed25519.PublicKey).Equal(ed25519.PublicKey(raw[ed25519.SeedSize:])) {
+		return nil, errors.New("keypair's public key does not match its secret key")
+	}
+	return key, nil
+}
+
+// FeePayer returns the fee payer's address, which payment transactions must
+// name as their fee payer.
+func (f *SolanaFacilitator) FeePayer() string { return f.feePayer.String() }
+
+// Verify checks the payment transaction against the requirements, then
+// simulates it. Like the EVM facilitator it lets the payment through when
+// the simulation cannot be run.
+func (f *SolanaFacilitator) Verify(ctx context.Context, payloadBytes, requirementsBytes []byte) (*VerifyResult, error) {
+	start := time.Now()
+	result, err := f.verify(ctx, payloadBytes, requirementsBytes)
+	observeCall("solana", "verify", requirementsBytes, start, err)
+	return result, err
+}
+
+func (f *SolanaFacilitator) verify(ctx context.Context, payloadBytes, requirementsBytes []byte) (*VerifyResult, error) {
+	tx, payer, err := f.check(payloadBytes, requirementsBytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.simulate(ctx, tx); err != nil {
+		if errors.Is(err, ErrSettlementWouldRevert) {
+			return nil, err
+		}
+		slog.Warn("solana settlement simulation skipped", "err", err)
+	}
+	slog.Info("solana verify OK", "payer", payer.String())
+	return &VerifyResult{Payer: payer.String()}, nil
+}
+
+// Settle signs the payment transaction as fee payer and submits it,
+// returning its signature as the transaction ID.
+func (f *SolanaFacilitator) Settle(ctx context.Context, payloadBytes, requirementsBytes []byte) (*SettleResult, error) {
+	start := time.Now()
+	result, err := f.settle(ctx, payloadBytes, requirementsBytes)
+	observeCall("solana", "settle", requirementsBytes, start, err)
+	return result, err
+}
+
+func (f *SolanaFacilitator) settle(ctx context.Context, payloadBytes, requirementsBytes []byte) (*SettleResult, error) {
+	tx, payer, err := f.check(payloadBytes, requirementsBytes)
+	if err != nil {
+		return nil, err
+	}
+	f.sign(tx)
+	var sig string
+	err = f.call(ctx, &sig, "sendTransaction", base64.StdEncoding.EncodeToString(tx.serialize()), map[string]any{
+		"encoding":            "base64",
+		"preflightCommitment": "confirmed",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("transaction_failed: %w", err)
+	}
+	slog.Info("solana settlement tx submitted", "signature", sig, "from", payer.String())
+	return &SettleResult{Transaction: sig}, nil
+}
+
+// check decodes the payment transaction and checks it pays exactly what the
+// requirements ask, returning it and the paying account.
+func (f *SolanaFacilitator) check(payloadBytes, requirementsBytes []byte) (*solanaTx, solanaAddress, error) {
+	var payer solanaAddress
+	p, err := parseLocalPayload(payloadBytes)
+	if err != nil {
+		return nil, payer, err
+	}
+	req, err := parseRequirements(requirementsBytes)
+	if err != nil {
+		return nil, payer, err
+	}
+	if req.Network != f.network || req.Scheme != "exact" {
+		return nil, payer, fmt.Errorf("unsupported scheme %q on network %q", req.Scheme, req.Network)
+	}
+	mint, err := parseSolanaAddress(req.Asset)
+	if err != nil {
+		return nil, payer, fmt.Errorf("asset: %w", err)
+	}
+	payTo, err := parseSolanaAddress(req.PayTo)
+	if err != nil {
+		return nil, payer, fmt.Errorf("payTo: %w", err)
+	}
+	amount, err := strconv.ParseUint(req.Amount, 10, 64)
+	if err != nil {
+		return nil, payer, fmt.Errorf("amount: %w", err)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(p.Payload.Transaction)
+	if err != nil {
+		return nil, payer, fmt.Errorf("payment transaction is not base64: %w", err)
+	}
+	tx, err := parseSolanaTx(raw)
+	if err != nil {
+		return nil, payer, err
+	}
+	if tx.feePayer() != f.feePayer {
+		return nil, payer, fmt.Errorf("transaction fee payer is %s, not %s", tx.feePayer(), f.feePayer)
+	}
+
+	var transfers int
+	for i, ix := range tx.instructions {
+		for _, a := range ix.accounts {
+			if a == f.feePayer {
+				return nil, payer, errors.New("fee payer used by an instruction")
+			}
+		}
+		if i == 0 && ix.advancesNonce() {
+			continue
+		}
+		if ix.program == solanaComputeBudgetProgram {
+			if err := checkComputeBudget(ix.data); err != nil {
+				return nil, payer, err
+			}
+			continue
+		}
+		if ix.program == solanaMemoProgram {
+			continue
+		}
+		_, gotMint, destination, authority, paid, ok := ix.transferChecked()
+		if !ok {
+			return nil, payer, fmt.Errorf("unexpected instruction to program %s", ix.program)
+		}
+		if gotMint != mint {
+			return nil, payer, fmt.Errorf("transfer of mint %s, not %s", gotMint, mint)
+		}
+		if destination != associatedTokenAddress(payTo, mint, ix.program) {
+			return nil, payer, fmt.Errorf("transfer to %s, not the token account of %s", destination, payTo)
+		}
+		if paid != amount {
+			return nil, payer, fmt.Errorf("amount mismatch: transfer of %d, required %d", paid, amount)
+		}
+		payer = authority
+		transfers++
+	}
+	if transfers != 1 {
+		return nil, payer, fmt.Errorf("transaction has %d token transfers, want 1", transfers)
+	}
+
+	// Every signer but the fee payer must already have signed.
+	for i := 1; i < tx.numSigners; i++ {
+		if !ed25519.Verify(tx.accounts[i][:], tx.message, tx.signatures[i][:]) {
+			return nil, payer, fmt.Errorf("invalid signature for %s", tx.accounts[i])
+		}
+	}
+	return tx, payer, nil
+}
+
+// checkComputeBudget allows setting the compute unit limit and a bounded
+// compute unit price, and nothing else.
+func checkComputeBudget(data []byte) error {
+	switch {
+	case len(data) == 5 && data[0] == 2: // SetComputeUnitLimit
+		return nil
+	case len(data) == 9 && data[0] == 3: // SetComputeUnitPrice
+		if price := binary.LittleEndian.Uint64(data[1:]); price > solanaMaxComputeUnitPrice {
+			return fmt.Errorf("compute unit price %d exceeds %d micro-lamports", price, solanaMaxComputeUnitPrice)
+		}
+		return nil
+	}
+	return errors.New("unsupported compute budget instruction")
+}
+
+// sign adds the fee payer's signature to tx.
+func (f *SolanaFacilitator) sign(tx *solanaTx) {
+	copy(tx.signatures[0][:], ed25519.Sign(f.key, tx.message))
+}
+
+// simulate runs the fee-payer-signed transaction with simulateTransaction,
+// returning an error wrapping ErrSettlementWouldRevert if it fails.
+func (f *SolanaFacilitator) simulate(ctx context.Context, tx *solanaTx) error {
+	ctx, cancel := context.WithTimeout(ctx, simulationTimeout)
+	defer cancel()
+	f.sign(tx)
+	var out struct {
+		Value struct {
+			Err  json.RawMessage `json:"err"`
+			Logs []string        `json:"logs"`
+		} `json:"value"`
+	}
+	err := f.call(ctx, &out, "simulateTransaction", base64.StdEncoding.EncodeToString(tx.serialize()), map[string]any{
+		"encoding":   "base64",
+		"sigVerify":  true,
+		"commitment": "confirmed",
+	})
+	if err != nil {
+		return err
+	}
+	if len(out.Value.Err) == 0 || string(out.Value.Err) == "null" {
+		return nil
+	}
+	reason := string(out.Value.Err)
+	if n := len(out.Value.Logs); n > 0 {
+		reason += ": " + out.Value.Logs[n-1]
+	}
+	return fmt.Errorf("%w: %s", ErrSettlementWouldRevert, reason)
+}
+
+// signatureStatus is a transaction's entry in getSignatureStatuses.
+type signatureStatus struct {
+	Confirmations      *uint64         `json:"confirmations"`
+	Err                json.RawMessage `json:"err"`
+	ConfirmationStatus string          `json:"confirmationStatus"`
+}
+
+// status returns the status of the transaction with signature tx, or nil if
+// the cluster has not seen it.
+func (f *SolanaFacilitator) status(ctx context.Context, tx string) (*signatureStatus, error) {
+	var out struct {
+		Value []*signatureStatus `json:"value"`
+	}
+	err := f.call(ctx, &out, "getSignatureStatuses", []string{tx}, map[string]any{"searchTransactionHistory": true})
+	if err != nil {
+		return nil, fmt.Errorf("signature status: %w", err)
+	}
+	if len(out.Value) == 0 {
+		return nil, nil
+	}
+	return out.Value[0], nil
+}
+
+// SettleConfirmed settles like Settle and returns once the settlement
+// transaction has the given number of confirmations, or is finalized.
+func (f *SolanaFacilitator) SettleConfirmed(ctx context.Context, payloadBytes, requirementsBytes []byte, confirmations uint64) (*SettleResult, error) {
+	result, err := f.Settle(ctx, payloadBytes, requirementsBytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.waitConfirmed(ctx, result.Transaction, confirmations); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// WaitMined blocks until the settlement transaction tx has been confirmed
+// by the cluster. It returns an error wrapping ErrSettlementReverted if the
+// transaction failed.
+func (f *SolanaFacilitator) WaitMined(ctx context.Context, tx string) (string, error) {
+	if err := f.waitConfirmed(ctx, tx, 1); err != nil {
+		return "", err
+	}
+	return tx, nil
+}
+
+// waitConfirmed polls the status of tx until it is confirmed with at least
+// confirmations confirmations, or finalized.
+func (f *SolanaFacilitator) waitConfirmed(ctx context.Context, tx string, confirmations uint64) error {
+	for {
+		s, err := f.status(ctx, tx)
+		if err != nil {
+			slog.Warn("solana settlement status lookup failed", "signature", tx, "err", err)
+		}
+		if s != nil && (s.ConfirmationStatus == "confirmed" || s.ConfirmationStatus == "finalized") {
+			if len(s.Err) > 0 && string(s.Err) != "null" {
+				return fmt.Errorf("%w: %s", ErrSettlementReverted, s.Err)
+			}
+			if s.Confirmations == nil || *s.Confirmations >= confirmations {
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(solanaPollInterval):
+		}
+	}
+}
+
+// Confirmations returns how many confirmations the settlement transaction tx
+// has: zero while the cluster has not seen it.
+func (f *SolanaFacilitator) Confirmations(ctx context.Context, tx string) (uint64, error) {
+	s, err := f.status(ctx, tx)
+	if err != nil || s == nil {
+		return 0, err
+	}
+	if s.Confirmations == nil {
+		return solanaFinalizedConfirmations, nil
+	}
+	return *s.Confirmations, nil
+}
+
+// BlockNumber returns the cluster's latest confirmed slot.
+func (f *SolanaFacilitator) BlockNumber(ctx context.Context) (uint64, error) {
+	var slot uint64
+	if err := f.call(ctx, &slot, "getSlot", map[string]any{"commitment": "confirmed"}); err != nil {
+		return 0, fmt.Errorf("slot: %w", err)
+	}
+	return slot, nil
+}
+
+// FinalityDepth returns the confirmations reported for a finalized
+// settlement.
+func (f *SolanaFacilitator) FinalityDepth() uint64 { return solanaFinalizedConfirmations }
+
+// call makes a JSON-RPC call to the Solana node.
+func (f *SolanaFacilitator) call(ctx context.Context, result any, method string, args ...any) error {
+	client, err := rpc.DialContext(ctx, f.rpcURL)
+	if err != nil {
+		return fmt.Errorf("rpc connect: %w", err)
+	}
+	defer client.Close()
+	return client.CallContext(ctx, result, method, args...)
+}
+
+// solanaPayer returns the account paying in a Solana payment payload's
+// transaction, or "" if it has none.
+func solanaPayer(transaction string) string {
+	raw, err := base64.StdEncoding.DecodeString(transaction)
+	if err != nil {
+		return ""
+	}
+	tx, err := parseSolanaTx(raw)
+	if err != nil {
+		return ""
+	}
+	for _, ix := range tx.instructions {
+		if _, _, _, authority, _, ok := ix.transferChecked(); ok {
+			return authority.String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,332 @@
+package x402
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Solana programs a payment transaction may call.
+var (
+	solanaSystemProgram          = solanaAddress{}
+	solanaTokenProgram           = mustSolanaAddress("TokenkegQfeZyiNwAJbNbGKPFXCWuBvf9Ss623VQ5DA")
+	solanaToken2022Program       = mustSolanaAddress("TokenzQdBNbLqP5VEhdkAS6EPFLC1PHnBqCXEpPxuEb")
+	solanaAssociatedTokenProgram = mustSolanaAddress("ATokenGPvbdGVxr1b2hvZbsiqW5xWH25efTNsLJA8knL")
+	solanaComputeBudgetProgram   = mustSolanaAddress("ComputeBudget111111111111111111111111111111")
+	solanaMemoProgram            = mustSolanaAddress("MemoSq4gqABAXKb96qnH8TysNcWxMyWCqXgDLGmfcHr")
+)
+
+// solanaAddress is a Solana public key or program address.
+type solanaAddress [32]byte
+
+func (a solanaAddress) String() string { return base58Encode(a[:]) }
+
+// parseSolanaAddress decodes a base58 Solana address.
+func parseSolanaAddress(s string) (solanaAddress, error) {
+	var a solanaAddress
+	b, err := base58Decode(s)
+	if err != nil {
+		return a, err
+	}
+	if len(b) != len(a) {
+		return a, fmt.Errorf("solana address %q is %d bytes, not 32", s, len(b))
+	}
+	copy(a[:], b)
+	return a, nil
+}
+
+func mustSolanaAddress(s string) solanaAddress {
+	a, err := parseSolanaAddress(s)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+// IsSolanaNetwork reports whether network is a Solana CAIP-2 identifier,
+// "solana:<genesis hash prefix>".
+func IsSolanaNetwork(network string) bool {
+	return strings.HasPrefix(network, "solana:")
+}
+
+// IsSolanaAddress reports whether s is a base58 Solana address.
+func IsSolanaAddress(s string) bool {
+	_, err := parseSolanaAddress(s)
+	return err == nil
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+func base58Encode(b []byte) string {
+	n := new(big.Int).SetBytes(b)
+	radix, mod := big.NewInt(58), new(big.Int)
+	var out []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+	for _, c := range b {
+		if c != 0 {
+			break
+		}
+		out = append(out, base58Alphabet[0])
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
+
+func base58Decode(s string) ([]byte, error) {
+	if s == "" {
+		return nil, errors.New("empty base58 string")
+	}
+	n, radix := new(big.Int), big.NewInt(58)
+	for _, c := range s {
+		i := strings.IndexRune(base58Alphabet, c)
+		if i < 0 {
+			return nil, fmt.Errorf("invalid base58 character %q", c)
+		}
+		n.Mul(n, radix).Add(n, big.NewInt(int64(i)))
+	}
+	zeros := len(s) - len(strings.TrimLeft(s, base58Alphabet[:1]))
+	return append(make([]byte, zeros), n.Bytes()...), nil
+}
+
+// solanaTx is a decoded Solana transaction. Only legacy and version 0
+// messages without address lookup tables are accepted: every account the
+// transaction touches must be listed in it, for the facilitator to check.
+type solanaTx struct {
+	signatures [][64]byte
+	// message is the serialized message, which each signature signs.
+	message []byte
+
+	numSigners   int
+	accounts     []solanaAddress
+	instructions []solanaInstruction
+}
+
+type solanaInstruction struct {
+	program  solanaAddress
+	accounts []solanaAddress
+	data     []byte
+}
+
+// parseSolanaTx decodes a wire-format transaction.
+func parseSolanaTx(raw []byte) (*solanaTx, error) {
+	r := &solanaReader{b: raw}
+	tx := &solanaTx{}
+	for n := r.compactU16(); n > 0 && r.err == nil; n-- {
+		var sig [64]byte
+		copy(sig[:], r.bytes(64))
+		tx.signatures = append(tx.signatures, sig)
+	}
+	start := r.off
+
+	versioned := r.peek()&0x80 != 0
+	if versioned {
+		if version := r.byte() & 0x7f; version != 0 {
+			return nil, fmt.Errorf("unsupported transaction version %d", version)
+		}
+	}
+	tx.numSigners = int(r.byte())
+	r.bytes(2) // read-only signed and unsigned account counts
+	for n := r.compactU16(); n > 0 && r.err == nil; n-- {
+		var a solanaAddress
+		copy(a[:], r.bytes(32))
+		tx.accounts = append(tx.accounts, a)
+	}
+	r.bytes(32) // recent blockhash
+	for n := r.compactU16(); n > 0 && r.err == nil; n-- {
+		programIndex := int(r.byte())
+		accountIndexes := r.bytes(r.compactU16())
+		data := r.bytes(r.compactU16())
+		if r.err != nil {
+			break
+		}
+		if programIndex >= len(tx.accounts) {
+			return nil, errors.New("instruction program index out of range")
+		}
+		ix := solanaInstruction{program: tx.accounts[programIndex], data: data}
+		for _, i := range accountIndexes {
+			if int(i) >= len(tx.accounts) {
+				return nil, errors.New("instruction account index out of range")
+			}
+			ix.accounts = append(ix.accounts, tx.accounts[i])
+		}
+		tx.instructions = append(tx.instructions, ix)
+	}
+	if versioned && r.compactU16() != 0 {
+		return nil, errors.New("address lookup tables are not supported")
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("malformed transaction: %w", r.err)
+	}
+	if r.off != len(raw) {
+		return nil, errors.New("malformed transaction: trailing bytes")
+	}
+	if tx.numSigners != len(tx.signatures) || tx.numSigners == 0 || tx.numSigners > len(tx.accounts) {
+		return nil, errors.New("malformed transaction: signature count does not match its signers")
+	}
+	tx.message = raw[start:]
+	return tx, nil
+}
+
+// serialize encodes the transaction with its current signatures.
+func (tx *solanaTx) serialize() []byte {
+	out := appendCompactU16(nil, len(tx.signatures))
+	for _, sig := range tx.signatures {
+		out = append(out, sig[:]...)
+	}
+	return append(out, tx.message...)
+}
+
+// feePayer returns the account paying the transaction's fees: its first
+// signer.
+func (tx *solanaTx) feePayer() solanaAddress { return tx.accounts[0] }
+
+// solanaReader reads a transaction, recording the first overrun.
+type solanaReader struct {
+	b   []byte
+	off int
+	err error
+}
+
+func (r *solanaReader) bytes(n int) []byte {
+	if r.err != nil || n > len(r.b)-r.off {
+		r.err = errors.New("unexpected end of data")
+		return nil
+	}
+	out := r.b[r.off : r.off+n]
+	r.off += n
+	return out
+}
+
+func (r *solanaReader) byte() byte {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *solanaReader) peek() byte {
+	if r.off >= len(r.b) {
+		return 0
+	}
+	return r.b[r.off]
+}
+
+// compactU16 reads Solana's variable-length "shortvec" length prefix.
+func (r *solanaReader) compactU16() int {
+	var n int
+	for shift := 0; shift < 21; shift += 7 {
+		b := r.byte()
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return n
+		}
+	}
+	r.err = errors.New("invalid compact length")
+	return 0
+}
+
+func appendCompactU16(b []byte, n int) []byte {
+	for n >= 0x80 {
+		b = append(b, byte(n)|0x80)
+		n >>= 7
+	}
+	return append(b, byte(n))
+}
+
+// transferChecked decodes an SPL Token (or Token-2022) TransferChecked
+// instruction: source, mint, destination and authority accounts, and the
+// amount in base units.
+func (ix *solanaInstruction) transferChecked() (source, mint, destination, authority solanaAddress, amount uint64, ok bool) {
+	if ix.program != solanaTokenProgram && ix.program != solanaToken2022Program {
+		return
+	}
+	// Discriminator 12, u64 amount, u8 decimals; then any multisig signers.
+	if len(ix.data) != 10 || ix.data[0] != 12 || len(ix.accounts) < 4 {
+		return
+	}
+	amount = binary.LittleEndian.Uint64(ix.data[1:9])
+	return ix.accounts[0], ix.accounts[1], ix.accounts[2], ix.accounts[3], amount, true
+}
+
+// hasMemo reports whether tx holds an SPL Memo instruction whose text is
+// memo.
+func (tx *solanaTx) hasMemo(memo string) bool {
+	for _, ix := range tx.instructions {
+		if ix.program == solanaMemoProgram && string(ix.data) == memo {
+			return true
+		}
+	}
+	return false
+}
+
+// advancesNonce reports whether ix is a System program AdvanceNonceAccount
+// instruction, which a durable nonce transaction starts with in place of a
+// recent blockhash.
+func (ix *solanaInstruction) advancesNonce() bool {
+	return ix.program == solanaSystemProgram && len(ix.data) == 4 &&
+		binary.LittleEndian.Uint32(ix.data) == 4 && len(ix.accounts) == 3
+}
+
+// associatedTokenAddress derives the associated token account holding mint
+// for owner under tokenProgram.
+func associatedTokenAddress(owner, mint, tokenProgram solanaAddress) solanaAddress {
+	addr, _ := findProgramAddress([][]byte{owner[:], tokenProgram[:], mint[:]}, solanaAssociatedTokenProgram)
+	return addr
+}
+
+// findProgramAddress returns the program derived address of seeds under
+// program: the first hash, trying bump seeds from 255 down, that is not an
+// ed25519 public key.
+func findProgramAddress(seeds [][]byte, program solanaAddress) (solanaAddress, bool) {
+	for bump := 255; bump >= 0; bump-- {
+		h := sha256.New()
+		for _, s := range seeds {
+			h.Write(s)
+		}
+		h.Write([]byte{byte(bump)})
+		h.Write(program[:])
+		h.Write([]byte("ProgramDerivedAddress"))
+		var addr solanaAddress
+		copy(addr[:], h.Sum(nil))
+		if !onEd25519Curve(addr) {
+			return addr, true
+		}
+	}
+	return solanaAddress{}, false
+}
+
+var (
+	ed25519P = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+	// ed25519D is -121665/121666 mod p.
+	ed25519D = new(big.Int).Mod(
+		new(big.Int).Mul(big.NewInt(-121665), new(big.Int).ModInverse(big.NewInt(121666), ed25519P)),
+		ed25519P,
+	)
+)
+
+// onEd25519Curve reports whether a decompresses to a point on the ed25519
+// curve, as Solana checks it: x² = (y²-1)/(dy²+1) must have a root.
+func onEd25519Curve(a solanaAddress) bool {
+	le := a
+	le[31] &= 0x7f
+	for i, j := 0, len(le)-1; i < j; i, j = i+1, j-1 {
+		le[i], le[j] = le[j], le[i]
+	}
+	p := ed25519P
+	y := new(big.Int).Mod(new(big.Int).SetBytes(le[:]), p)
+	y2 := new(big.Int).Mul(y, y)
+	u := new(big.Int).Sub(y2, big.NewInt(1))
+	v := new(big.Int).Add(new(big.Int).Mul(ed25519D, y2), big.NewInt(1))
+	x2 := new(big.Int).Mul(u, new(big.Int).ModInverse(v.Mod(v, p), p))
+	x2.Mod(x2, p)
+	return x2.Sign() == 0 || big.Jacobi(x2, p) == 1
+}
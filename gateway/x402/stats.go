@@ -0,0 +1,368 @@
+package x402
+
+// Revenue accounting: every payment verified and every settlement outcome
+// the middleware reports is tallied, with what the relayers spent on gas to
+// land them, so operators can see what the gateway earned and what is still
+// owed to it without reading the chain. The tallies cover this process since
+// it started. RevenueStats snapshots them for the admin API;
+// WriteRevenueMetrics renders them in the Prometheus text format.
+
+import (
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// revenue holds the revenue tallies of every middleware in the process.
+var revenue = newRevenueStats()
+
+// assetKey identifies an asset on a network, whose amounts add up.
+type assetKey struct {
+	network string
+	asset   string
+}
+
+// payerTally is what is tallied about one payer.
+type payerTally struct {
+	payments uint64
+	settled  uint64
+	received map[assetKey]*big.Int
+}
+
+// gasKey identifies the gas spend of one relayer account on a network.
+type gasKey struct {
+	network string
+	relayer string
+}
+
+type revenueStats struct {
+	mu       sync.Mutex
+	since    time.Time
+	payments uint64
+	// settlements counts final settlement outcomes by event type.
+	settlements map[string]uint64
+	// pending is the payment hashes verified, or being settled or retried,
+	// whose settlement has no outcome yet.
+	pending  map[string]bool
+	received map[assetKey]*big.Int
+	reorged  map[assetKey]*big.Int
+	payers   map[string]*payerTally
+	gas      map[gasKey]*big.Int
+}
+
+func newRevenueStats() *revenueStats {
+	return &revenueStats{
+		since:       time.Now(),
+		settlements: make(map[string]uint64),
+		pending:     make(map[string]bool),
+		received:    make(map[assetKey]*big.Int),
+		reorged:     make(map[assetKey]*big.Int),
+		payers:      make(map[string]*payerTally),
+		gas:         make(map[gasKey]*big.Int),
+	}
+}
+
+// record tallies a payment event, as notify reports it.
+func (s *revenueStats) record(eventType string, data map[string]any) {
+	hash, _ := data["paymentHash"].(string)
+	payer, _ := data["payer"].(string)
+	network, _ := data["network"].(string)
+	asset, _ := data["asset"].(string)
+	amountStr, _ := data["amount"].(string)
+	amount, _ := new(big.Int).SetString(amountStr, 10)
+	key := assetKey{network: network, asset: foldAddress(asset)}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch eventType {
+	case EventPaymentVerified:
+		s.payments++
+		if payer != "" {
+			s.payer(payer).payments++
+		}
+		s.setPending(hash, true)
+	case EventSettlementSubmitted:
+		s.setPending(hash, true)
+	case EventSettlementConfirmed:
+		s.settlements[eventType]++
+		s.setPending(hash, false)
+		if amount == nil {
+			return
+		}
+		addAmount(s.received, key, amount)
+		if payer != "" {
+			p := s.payer(payer)
+			p.settled++
+			addAmount(p.received, key, amount)
+		}
+	case EventSettlementFailed:
+		if retry, _ := data["willRetry"].(bool); retry {
+			return
+		}
+		s.settlements[eventType]++
+		s.setPending(hash, false)
+	case EventSettlementReverted:
+		// A deferred settlement that reverted is retried, and shows up
+		// pending again once it is resubmitted.
+		s.settlements[eventType]++
+		s.setPending(hash, false)
+	case EventSettlementReorged:
+		s.settlements[eventType]++
+		if amount == nil {
+			return
+		}
+		addAmount(s.reorged, key, amount)
+		if p := s.payers[foldAddress(payer)]; p != nil {
+			addAmount(p.received, key, new(big.Int).Neg(amount))
+		}
+	}
+}
+
+func (s *revenueStats) setPending(hash string, pending bool) {
+	switch {
+	case hash == "":
+	case pending:
+		s.pending[hash] = true
+	default:
+		delete(s.pending, hash)
+	}
+}
+
+func (s *revenueStats) payer(payer string) *payerTally {
+	payer = foldAddress(payer)
+	p := s.payers[payer]
+	if p == nil {
+		p = &payerTally{received: make(map[assetKey]*big.Int)}
+		s.payers[payer] = p
+	}
+	return p
+}
+
+// spendGas tallies the fee, in the chain's native units, a relayer paid for
+// a settlement transaction.
+func (s *revenueStats) spendGas(network, relayer string, fee *big.Int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := gasKey{network: network, relayer: relayer}
+	if s.gas[k] == nil {
+		s.gas[k] = new(big.Int)
+	}
+	s.gas[k].Add(s.gas[k], fee)
+}
+
+func addAmount(m map[assetKey]*big.Int, k assetKey, amount *big.Int) {
+	if m[k] == nil {
+		m[k] = new(big.Int)
+	}
+	m[k].Add(m[k], amount)
+}
+
+// foldAddress lowercases an EVM address, so its checksummed and lowercase
+// spellings tally together. Solana addresses are case-sensitive.
+func foldAddress(addr string) string {
+	if strings.HasPrefix(addr, "0x") {
+		return strings.ToLower(addr)
+	}
+	return addr
+}
+
+// Revenue is a snapshot of the revenue tallies. Amounts are decimal strings
+// in the asset's atomic units (or wei, for gas).
+type Revenue struct {
+	// Since is when the tallies started: when the process did.
+	Since time.Time `json:"since"`
+	// Payments counts the payments verified.
+	Payments uint64 `json:"payments"`
+	// Settlements counts the settlements confirmed, still pending, and
+	// given up on as failed, reverted or reorged out of the chain.
+	Settlements SettlementCounts `json:"settlements"`
+	// Received is what confirmed settlements paid, less what reorgs took
+	// back, per network and asset.
+	Received []AssetAmount `json:"received"`
+	// Reorged is what reorgs took back, already taken out of Received.
+	Reorged []AssetAmount `json:"reorged"`
+	// Payers is the tally of each payer, most payments first.
+	Payers []PayerRevenue `json:"payers"`
+	// RelayerGas is what the local facilitator's relayer accounts paid for
+	// the settlement transactions they sent, per network and account.
+	RelayerGas []RelayerGas `json:"relayerGas"`
+}
+
+// SettlementCounts counts settlements by outcome.
+type SettlementCounts struct {
+	Confirmed uint64 `json:"confirmed"`
+	Pending   uint64 `json:"pending"`
+	Failed    uint64 `json:"failed"`
+	Reverted  uint64 `json:"reverted"`
+	Reorged   uint64 `json:"reorged"`
+}
+
+// AssetAmount is an amount of an asset on a network.
+type AssetAmount struct {
+	Network string `json:"network"`
+	Asset   string `json:"asset"`
+	Amount  string `json:"amount"`
+}
+
+// PayerRevenue is what one payer paid.
+type PayerRevenue struct {
+	Payer    string        `json:"payer"`
+	Payments uint64        `json:"payments"`
+	Settled  uint64        `json:"settled"`
+	Received []AssetAmount `json:"received"`
+}
+
+// RelayerGas is what a relayer account spent on gas on a network, in wei.
+type RelayerGas struct {
+	Network string `json:"network"`
+	Relayer string `json:"relayer"`
+	Wei     string `json:"wei"`
+}
+
+// RevenueStats returns a snapshot of the revenue tallies.
+func RevenueStats() Revenue {
+	s := revenue
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := Revenue{
+		Since:    s.since,
+		Payments: s.payments,
+		Settlements: SettlementCounts{
+			Confirmed: s.settlements[EventSettlementConfirmed],
+			Pending:   uint64(len(s.pending)),
+			Failed:    s.settlements[EventSettlementFailed],
+			Reverted:  s.settlements[EventSettlementReverted],
+			Reorged:   s.settlements[EventSettlementReorged],
+		},
+		Received:   netAmounts(s.received, s.reorged),
+		Reorged:    netAmounts(s.reorged, nil),
+		Payers:     make([]PayerRevenue, 0, len(s.payers)),
+		RelayerGas: make([]RelayerGas, 0, len(s.gas)),
+	}
+	for payer, p := range s.payers {
+		r.Payers = append(r.Payers, PayerRevenue{
+			Payer:    payer,
+			Payments: p.payments,
+			Settled:  p.settled,
+			Received: netAmounts(p.received, nil),
+		})
+	}
+	sort.Slice(r.Payers, func(i, j int) bool {
+		a, b := r.Payers[i], r.Payers[j]
+		if a.Payments != b.Payments {
+			return a.Payments > b.Payments
+		}
+		return a.Payer < b.Payer
+	})
+	for _, k := range sortedGasKeys(s.gas) {
+		r.RelayerGas = append(r.RelayerGas, RelayerGas{Network: k.network, Relayer: k.relayer, Wei: s.gas[k].String()})
+	}
+	return r
+}
+
+// netAmounts lists the amounts of m less those of minus, by network and
+// asset.
+func netAmounts(m, minus map[assetKey]*big.Int) []AssetAmount {
+	amounts := make([]AssetAmount, 0, len(m))
+	for _, k := range sortedAssetKeys(m) {
+		amount := new(big.Int).Set(m[k])
+		if sub := minus[k]; sub != nil {
+			amount.Sub(amount, sub)
+		}
+		amounts = append(amounts, AssetAmount{Network: k.network, Asset: k.asset, Amount: amount.String()})
+	}
+	return amounts
+}
+
+func sortedAssetKeys(m map[assetKey]*big.Int) []assetKey {
+	keys := make([]assetKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].network != keys[j].network {
+			return keys[i].network < keys[j].network
+		}
+		return keys[i].asset < keys[j].asset
+	})
+	return keys
+}
+
+func sortedGasKeys(m map[gasKey]*big.Int) []gasKey {
+	keys := make([]gasKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].network != keys[j].network {
+			return keys[i].network < keys[j].network
+		}
+		return keys[i].relayer < keys[j].relayer
+	})
+	return keys
+}
+
+// WriteRevenueMetrics writes the revenue tallies in the Prometheus text
+// exposition format:
+//
+//   - x402_payments_total, payments verified
+//   - x402_settlements_total, settlements by outcome ("confirmed", "failed",
+//     "reverted" or "reorged")
+//   - x402_settlements_pending, settlements without an outcome yet
+//   - x402_revenue_received_total, what confirmed settlements paid, in the
+//     asset's atomic units, by network and asset
+//   - x402_revenue_reorged_total, what reorgs took back of it
+//   - x402_relayer_gas_spent_wei_total, relayer gas fees by network and
+//     relayer account
+//
+// Payers are left to the admin stats endpoint: a label per payer would grow
+// the series without bound.
+func WriteRevenueMetrics(w io.Writer) error {
+	s := revenue
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var b strings.Builder
+	b.WriteString("# HELP x402_payments_total Payments verified.\n")
+	b.WriteString("# TYPE x402_payments_total counter\n")
+	fmt.Fprintf(&b, "x402_payments_total %d\n", s.payments)
+	b.WriteString("# HELP x402_settlements_total Settlements by outcome.\n")
+	b.WriteString("# TYPE x402_settlements_total counter\n")
+	for _, outcome := range []struct{ label, event string }{
+		{"confirmed", EventSettlementConfirmed},
+		{"failed", EventSettlementFailed},
+		{"reverted", EventSettlementReverted},
+		{"reorged", EventSettlementReorged},
+	} {
+		fmt.Fprintf(&b, "x402_settlements_total{outcome=%q} %d\n", outcome.label, s.settlements[outcome.event])
+	}
+	b.WriteString("# HELP x402_settlements_pending Settlements without an outcome yet.\n")
+	b.WriteString("# TYPE x402_settlements_pending gauge\n")
+	fmt.Fprintf(&b, "x402_settlements_pending %d\n", len(s.pending))
+	b.WriteString("# HELP x402_revenue_received_total Amount paid by confirmed settlements, in the asset's atomic units.\n")
+	b.WriteString("# TYPE x402_revenue_received_total counter\n")
+	for _, k := range sortedAssetKeys(s.received) {
+		fmt.Fprintf(&b, "x402_revenue_received_total{%s} %s\n", k.labels(), s.received[k])
+	}
+	b.WriteString("# HELP x402_revenue_reorged_total Amount of confirmed settlements reorged out of the chain, in the asset's atomic units.\n")
+	b.WriteString("# TYPE x402_revenue_reorged_total counter\n")
+	for _, k := range sortedAssetKeys(s.reorged) {
+		fmt.Fprintf(&b, "x402_revenue_reorged_total{%s} %s\n", k.labels(), s.reorged[k])
+	}
+	b.WriteString("# HELP x402_relayer_gas_spent_wei_total Gas fees relayer accounts paid for settlement transactions, in wei.\n")
+	b.WriteString("# TYPE x402_relayer_gas_spent_wei_total counter\n")
+	for _, k := range sortedGasKeys(s.gas) {
+		fmt.Fprintf(&b, "x402_relayer_gas_spent_wei_total{network=\"%s\",relayer=\"%s\"} %s\n", escapeLabel(k.network), escapeLabel(k.relayer), s.gas[k])
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// labels renders the key as Prometheus labels, without braces.
+func (k assetKey) labels() string {
+	return fmt.Sprintf(`network="%s",asset="%s"`, escapeLabel(k.network), escapeLabel(k.asset))
+}
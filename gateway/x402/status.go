@@ -0,0 +1,229 @@
+package x402
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// settlementsPath is where a payment's settlement status is served, followed
+// by its payment hash.
+const settlementsPath = "/settlements/"
+
+// paymentHashHeader carries the payment hash of a payment the gateway has
+// verified, under which its settlement status is served.
+const paymentHashHeader = "X-Payment-Hash"
+
+const (
+	// statusRetention is how long a payment's settlement status is kept
+	// after its last change.
+	statusRetention = 24 * time.Hour
+	// maxStatuses bounds the payments tracked; the oldest are dropped first.
+	maxStatuses = 100_000
+	// statusConfirmationsTimeout bounds looking up a settlement's
+	// confirmations while answering a status request.
+	statusConfirmationsTimeout = 5 * time.Second
+)
+
+// Settlement states reported by the status API, in the order a payment
+// normally goes through them. A failed or reverted settlement may be retried,
+// moving the payment back to retrying and then submitted. A confirmed
+// settlement that a reorg drops from the chain for good becomes reorged.
+const (
+	SettlementVerified  = "verified"
+	SettlementSubmitted = "submitted"
+	SettlementRetrying  = "retrying"
+	SettlementConfirmed = "confirmed"
+	SettlementFailed    = "failed"
+	SettlementReverted  = "reverted"
+	SettlementReorged   = "reorged"
+)
+
+// paymentHash identifies a payment to clients, webhook receivers and the
+// status API without revealing its authorization: the hash of its replay
+// cache key, which is unique per payment.
+func paymentHash(replayKey string) string {
+	return crypto.Keccak256Hash([]byte(replayKey)).Hex()
+}
+
+// settlementStatus is where a payment's settlement stands.
+type settlementStatus struct {
+	PaymentHash string `json:"paymentHash"`
+	State       string `json:"state"`
+	Network     string `json:"network"`
+	Scheme      string `json:"scheme"`
+	Asset       string `json:"asset"`
+	Amount      string `json:"amount"`
+	Payer       string `json:"payer,omitempty"`
+	Credits     int64  `json:"credits"`
+	Transaction string `json:"transaction,omitempty"`
+	// Confirmations is looked up when the status is served.
+	Confirmations *uint64   `json:"confirmations,omitempty"`
+	Attempts      int       `json:"attempts,omitempty"`
+	Error         string    `json:"error,omitempty"`
+	VerifiedAt    time.Time `json:"verifiedAt,omitzero"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+// statusTracker follows payments through settlement, fed by the payment
+// events the middleware emits. Like the confirmation tracker it lives in
+// memory only, so after a restart payments settled before it are unknown.
+type statusTracker struct {
+	mu     sync.Mutex
+	byHash map[string]*settlementStatus
+}
+
+func newStatusTracker() *statusTracker {
+	return &statusTracker{byHash: make(map[string]*settlementStatus)}
+}
+
+// eventStates maps payment events to the settlement state they enter.
+var eventStates = map[string]string{
+	EventPaymentVerified:     SettlementVerified,
+	EventSettlementSubmitted: SettlementSubmitted,
+	EventSettlementConfirmed: SettlementConfirmed,
+	EventSettlementFailed:    SettlementFailed,
+	EventSettlementReverted:  SettlementReverted,
+	EventSettlementReorged:   SettlementReorged,
+}
+
+// record moves the payment an event describes (by its "paymentHash") to the
+// event's state.
+func (t *statusTracker) record(eventType string, data map[string]any) {
+	state, ok := eventStates[eventType]
+	hash, _ := data["paymentHash"].(string)
+	if !ok || hash == "" {
+		return
+	}
+	t.update(hash, func(s *settlementStatus) {
+		s.State = state
+		if retry, _ := data["willRetry"].(bool); retry {
+			s.State = SettlementRetrying
+		}
+		for field, dst := range map[string]*string{
+			"network": &s.Network,
+			"scheme":  &s.Scheme,
+			"asset":   &s.Asset,
+			"amount":  &s.Amount,
+			"payer":   &s.Payer,
+		} {
+			if v, ok := data[field].(string); ok && v != "" {
+				*dst = v
+			}
+		}
+		if credits, ok := data["credits"].(int64); ok {
+			s.Credits = credits
+		}
+		if tx, ok := data["transaction"].(string); ok && tx != "" {
+			s.Transaction = tx
+		}
+		if attempts, ok := data["attempts"].(int); ok {
+			s.Attempts = attempts
+		}
+		s.Error, _ = data["error"].(string)
+		if state == SettlementVerified {
+			s.VerifiedAt = time.Now()
+		}
+	})
+}
+
+// update applies set to the status of the payment hash, creating it if it is
+// new, and drops statuses past retention (or the oldest, when full).
+func (t *statusTracker) update(hash string, set func(*settlementStatus)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.byHash[hash]
+	if !ok {
+		t.prune()
+		s = &settlementStatus{PaymentHash: hash}
+		t.byHash[hash] = s
+	}
+	set(s)
+	s.UpdatedAt = time.Now()
+}
+
+// prune drops statuses unchanged for statusRetention, then the least
+// recently updated if the tracker is still full. t.mu must be held.
+func (t *statusTracker) prune() {
+	if len(t.byHash) < maxStatuses {
+		return
+	}
+	cutoff := time.Now().Add(-statusRetention)
+	var oldest string
+	for hash, s := range t.byHash {
+		if s.UpdatedAt.Before(cutoff) {
+			delete(t.byHash, hash)
+			continue
+		}
+		if oldest == "" || s.UpdatedAt.Before(t.byHash[oldest].UpdatedAt) {
+			oldest = hash
+		}
+	}
+	if len(t.byHash) >= maxStatuses {
+		delete(t.byHash, oldest)
+	}
+}
+
+// get returns a copy of the status of the payment hash, or nil.
+func (t *statusTracker) get(hash string) *settlementStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.byHash[strings.ToLower(hash)]
+	if !ok {
+		return nil
+	}
+	cp := *s
+	return &cp
+}
+
+// trackTransaction records the settlement transaction of the payment with
+// replayKey as soon as it is broadcast, before any event reports it.
+func (m *Middleware) trackTransaction(replayKey, tx string) {
+	if replayKey == "" || tx == "" {
+		return
+	}
+	m.statuses.update(paymentHash(replayKey), func(s *settlementStatus) { s.Transaction = tx })
+}
+
+// trackRetry records that the settlement of the payment with replayKey
+// failed and will be retried.
+func (m *Middleware) trackRetry(replayKey string, attempts int, cause error) {
+	if replayKey == "" {
+		return
+	}
+	m.statuses.update(paymentHash(replayKey), func(s *settlementStatus) {
+		s.State = SettlementRetrying
+		s.Attempts = attempts
+		s.Error = cause.Error()
+	})
+}
+
+// serveSettlementStatus answers GET <settlementsPath><paymentHash> with the
+// payment's settlement state and, once its transaction is known and the
+// facilitator can follow it, the transaction's confirmations.
+func (m *Middleware) serveSettlementStatus(w http.ResponseWriter, r *http.Request) {
+	s := m.statuses.get(strings.TrimPrefix(r.URL.Path, settlementsPath))
+	if s == nil {
+		writeError(w, http.StatusNotFound, CodeUnknownPayment, "")
+		return
+	}
+	if rf, ok := m.receiptFacilitator(s.Transaction); ok {
+		ctx, cancel := context.WithTimeout(r.Context(), statusConfirmationsTimeout)
+		n, err := rf.Confirmations(ctx, s.Transaction)
+		cancel()
+		if err != nil {
+			slog.Warn("settlement confirmations lookup failed", "tx", s.Transaction, "err", err)
+		} else {
+			s.Confirmations = &n
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(s)
+}
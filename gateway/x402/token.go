@@ -3,10 +3,14 @@ package x402
 import (
 	"errors"
 	"fmt"
+	"log/slog"
+	"math/big"
+	"slices"
+	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 )
@@ -17,15 +21,67 @@ var ErrTokenExhausted = errors.New("token credits exhausted")
 // ErrTokenNotFound is returned when the token ID is not registered in the store.
 var ErrTokenNotFound = errors.New("token not found in store")
 
+// ErrTokenRevoked is returned when an operator has revoked the token.
+var ErrTokenRevoked = errors.New("token revoked")
+
+// ErrTokenAudience is returned for a token bought for another route.
+var ErrTokenAudience = errors.New("token issued for another route")
+
 // Claims is the JWT payload for a batch RPC token.
 type Claims struct {
 	jwt.RegisteredClaims
 	// TokenID is a server-generated UUID used as the key in the counter store.
 	TokenID string `json:"tid"`
-	// RequestsTotal is the total number of RPC calls this token authorises.
-	// The server-side counter is authoritative; this field is informational and
-	// protected by HMAC-SHA256 signature — clients cannot increase it.
+	// RequestsTotal is the number of RPC calls this token authorised when it
+	// was issued. The server-side counter is authoritative (top-ups raise it
+	// without re-issuing the JWT); this field is informational and protected by
+	// HMAC-SHA256 signature — clients cannot increase it.
 	RequestsTotal int64 `json:"requests_total"`
+	// Account, when set, is the payer account whose shared balance this token
+	// draws from instead of a per-token counter (see WithAccounts).
+	Account string `json:"acct,omitempty"`
+	// Methods, when set, restricts the token to these JSON-RPC methods.
+	// Empty means every method is allowed.
+	Methods []string `json:"methods,omitempty"`
+	// RateLimit, when set, caps how fast the token may be spent, so a single
+	// customer cannot saturate the upstream however many credits it holds.
+	RateLimit *RateLimit `json:"rl,omitempty"`
+	// Metered marks a token bought under the upto scheme: its credits are
+	// paid for after use, so it draws from its own counter and cannot be
+	// topped up.
+	Metered bool `json:"metered,omitempty"`
+}
+
+// AllowsMethod reports whether the token may call the JSON-RPC method.
+func (c *Claims) AllowsMethod(method string) bool {
+	if len(c.Methods) == 0 {
+		return true
+	}
+	for _, m := range c.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// CounterID returns the key of the store counter this token spends from: the
+// payer account in account mode, otherwise the token's own ID.
+func (c *Claims) CounterID() string {
+	if c.Account != "" {
+		return c.Account
+	}
+	return c.TokenID
+}
+
+// AccountID returns the counter key for payer's shared credit balance.
+// Hex addresses are normalised so differently-cased forms share one account;
+// Solana's base58 addresses are case-sensitive and kept as they are.
+func AccountID(payer string) string {
+	if !common.IsHexAddress(payer) {
+		return "acct:" + payer
+	}
+	return "acct:" + strings.ToLower(common.HexToAddress(payer).Hex())
 }
 
 // TokenCounterStore manages server-side authoritative request counters.
@@ -36,29 +92,82 @@ type TokenCounterStore interface {
 	// is a no-op — issuance happens exactly once.
 	RegisterToken(tokenID string, total int64) error
 
-	// UseRequest atomically increments the used counter and returns the number
-	// of remaining credits. Returns ErrTokenExhausted when the allowance is
-	// reached and ErrTokenNotFound if the token was never registered.
-	UseRequest(tokenID string, total int64) (remaining int64, err error)
+	// UseRequest atomically consumes n credits and returns the number
+	// remaining. Returns ErrTokenExhausted, consuming nothing, when fewer than
+	// n credits are left, and ErrTokenNotFound if the token was never
+	// registered.
+	UseRequest(tokenID string, n int64) (remaining int64, err error)
+
+	// AddCredits atomically raises the token's total allowance by n and returns
+	// the new number of remaining credits. Returns ErrTokenNotFound if the
+	// token was never registered.
+	AddCredits(tokenID string, n int64) (remaining int64, err error)
+
+	// RefundRequest atomically returns n credits consumed by UseRequest (at
+	// most as many as have been used) and returns the new number of remaining
+	// credits. Returns ErrTokenNotFound if the token was never registered.
+	RefundRequest(tokenID string, n int64) (remaining int64, err error)
+
+	// Remaining returns the number of unused credits without consuming any.
+	// Returns ErrTokenNotFound if the token was never registered.
+	Remaining(tokenID string) (int64, error)
+
+	// RevokeToken permanently marks a registered token as revoked. Returns
+	// ErrTokenNotFound if the token was never registered. Revoking an already
+	// revoked token is a no-op.
+	RevokeToken(tokenID string) error
+
+	// IsRevoked reports whether RevokeToken has been called for tokenID.
+	IsRevoked(tokenID string) (bool, error)
 }
 
-// entry holds the atomic counter and the total allowance for a single token.
+// entry holds the used counter and the total allowance for a single token.
 type entry struct {
-	counter *atomic.Int64
-	total   int64
+	used  int64
+	total int64
 }
 
 // InMemoryTokenStore is an in-memory TokenCounterStore.
 // NOTE: state is lost on process restart — acceptable for a hackathon demo.
 // Replace with a Redis-backed implementation for production.
 type InMemoryTokenStore struct {
-	mu      sync.Mutex
-	entries map[string]*entry
+	mu          sync.Mutex
+	entries     map[string]*entry
+	revoked     map[string]struct{}
+	settlements map[string]PendingSettlement
+	dead        map[string]PendingSettlement
+	free        map[string]*freeCount
+	usage       map[usageKey][2]int64 // calls, credits
+	revenue     map[revenueKey]*revenueTotal
+	ledger      []LedgerEntry // the last memoryLedgerEntries posted
+	ledgerSeq   uint64
+	balances    map[[2]string]*big.Int // by account and unit
+	issued      map[string]IssuedToken
+}
+
+// memoryLedgerEntries is how many ledger entries the in-memory store keeps;
+// the balances are kept whole.
+const memoryLedgerEntries = 100000
+
+// freeCount is the free requests used under a free tier key.
+type freeCount struct {
+	used      int64
+	expiresAt time.Time
 }
 
 // NewInMemoryTokenStore creates an empty in-memory token counter store.
 func NewInMemoryTokenStore() *InMemoryTokenStore {
-	return &InMemoryTokenStore{entries: make(map[string]*entry)}
+	return &InMemoryTokenStore{
+		entries:     make(map[string]*entry),
+		revoked:     make(map[string]struct{}),
+		settlements: make(map[string]PendingSettlement),
+		dead:        make(map[string]PendingSettlement),
+		free:        make(map[string]*freeCount),
+		usage:       make(map[usageKey][2]int64),
+		revenue:     make(map[revenueKey]*revenueTotal),
+		balances:    make(map[[2]string]*big.Int),
+		issued:      make(map[string]IssuedToken),
+	}
 }
 
 // RegisterToken stores the total allowance for a newly issued token.
@@ -67,57 +176,456 @@ func (s *InMemoryTokenStore) RegisterToken(tokenID string, total int64) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if _, exists := s.entries[tokenID]; !exists {
-		s.entries[tokenID] = &entry{counter: &atomic.Int64{}, total: total}
+		s.entries[tokenID] = &entry{total: total}
 	}
 	return nil
 }
 
-// UseRequest atomically consumes one credit and returns the number remaining.
-// The total parameter comes from the signed JWT claims — it cannot be forged.
-func (s *InMemoryTokenStore) UseRequest(tokenID string, total int64) (int64, error) {
+// UseRequest atomically consumes n credits and returns the number remaining.
+func (s *InMemoryTokenStore) UseRequest(tokenID string, n int64) (int64, error) {
 	s.mu.Lock()
+	defer s.mu.Unlock()
 	e, ok := s.entries[tokenID]
-	s.mu.Unlock()
+	if !ok {
+		return 0, ErrTokenNotFound
+	}
+	if e.used+n > e.total {
+		return 0, ErrTokenExhausted
+	}
+	e.used += n
+	return e.total - e.used, nil
+}
 
+// AddCredits raises the token's allowance by n.
+func (s *InMemoryTokenStore) AddCredits(tokenID string, n int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[tokenID]
 	if !ok {
 		return 0, ErrTokenNotFound
 	}
+	e.total += n
+	return e.total - e.used, nil
+}
 
-	// Increment first. If we go over, decrement and report exhausted.
-	// The rollback is safe: only one goroutine can push `used` past `total`
-	// per increment, and we always roll it back, so the counter never
-	// permanently exceeds `total`.
-	used := e.counter.Add(1)
-	if used > total {
-		e.counter.Add(-1)
-		return 0, ErrTokenExhausted
+// RefundRequest gives back n consumed credits.
+func (s *InMemoryTokenStore) RefundRequest(tokenID string, n int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[tokenID]
+	if !ok {
+		return 0, ErrTokenNotFound
+	}
+	e.used -= min(n, e.used)
+	return e.total - e.used, nil
+}
+
+// Remaining returns the token's unused credits.
+func (s *InMemoryTokenStore) Remaining(tokenID string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[tokenID]
+	if !ok {
+		return 0, ErrTokenNotFound
+	}
+	return e.total - e.used, nil
+}
+
+// RevokeToken marks tokenID as revoked.
+func (s *InMemoryTokenStore) RevokeToken(tokenID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[tokenID]; !ok {
+		return ErrTokenNotFound
+	}
+	s.revoked[tokenID] = struct{}{}
+	return nil
+}
+
+// IsRevoked reports whether tokenID has been revoked.
+func (s *InMemoryTokenStore) IsRevoked(tokenID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.revoked[tokenID]
+	return ok, nil
+}
+
+// AddSettlement records a payment to be settled for its token.
+func (s *InMemoryTokenStore) AddSettlement(p PendingSettlement) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.settlements[p.TokenID] = p
+	return nil
+}
+
+// TakeSettlement removes and returns the settlement recorded for tokenID.
+func (s *InMemoryTokenStore) TakeSettlement(tokenID string) (*PendingSettlement, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.settlements[tokenID]
+	if !ok {
+		return nil, nil
+	}
+	delete(s.settlements, tokenID)
+	return &p, nil
+}
+
+// DueSettlements returns the tokens whose settlements are due by now.
+func (s *InMemoryTokenStore) DueSettlements(now time.Time) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for id, p := range s.settlements {
+		if !p.SettleAt.After(now) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// AddDeadSettlement records a settlement that was given up on.
+func (s *InMemoryTokenStore) AddDeadSettlement(p PendingSettlement) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dead[p.TokenID] = p
+	return nil
+}
+
+// DeadSettlements returns the settlements given up on, oldest first.
+func (s *InMemoryTokenStore) DeadSettlements() ([]PendingSettlement, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]PendingSettlement, 0, len(s.dead))
+	for _, p := range s.dead {
+		out = append(out, p)
+	}
+	sortDeadSettlements(out)
+	return out, nil
+}
+
+// TakeDeadSettlement removes and returns the dead settlement recorded under
+// tokenID.
+func (s *InMemoryTokenStore) TakeDeadSettlement(tokenID string) (*PendingSettlement, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.dead[tokenID]
+	if !ok {
+		return nil, nil
+	}
+	delete(s.dead, tokenID)
+	return &p, nil
+}
+
+// UseFreeRequests counts n more free requests under key.
+func (s *InMemoryTokenStore) UseFreeRequests(key string, n, limit int64, expiresAt time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.free[key]
+	if !ok {
+		c = &freeCount{expiresAt: expiresAt}
+		s.free[key] = c
+	}
+	if c.used+n > limit {
+		return 0, ErrFreeTierExhausted
+	}
+	c.used += n
+	return limit - c.used, nil
+}
+
+// PruneFreeRequests deletes the counts that expired before now.
+func (s *InMemoryTokenStore) PruneFreeRequests(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for key, c := range s.free {
+		if c.expiresAt.Before(now) {
+			delete(s.free, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// AddUsage adds calls and credits to payer's use of method in an hour.
+func (s *InMemoryTokenStore) AddUsage(hour time.Time, payer, method string, calls, credits int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := usageKey{hour: hour.Unix(), payer: payer, method: method}
+	u := s.usage[k]
+	s.usage[k] = [2]int64{u[0] + calls, u[1] + credits}
+	return nil
+}
+
+// AddRevenue adds to what payer paid in asset on network in an hour.
+func (s *InMemoryTokenStore) AddRevenue(hour time.Time, payer, network, asset string, payments int64, amount *big.Int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := revenueKey{hour: hour.Unix(), payer: payer, network: network, asset: asset}
+	r := s.revenue[k]
+	if r == nil {
+		r = &revenueTotal{amount: new(big.Int)}
+		s.revenue[k] = r
+	}
+	r.payments += payments
+	r.amount.Add(r.amount, amount)
+	return nil
+}
+
+// UsageReport totals the hours from from until before to.
+func (s *InMemoryTokenStore) UsageReport(from, to time.Time) (*UsageReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := newUsageTotals()
+	for k, u := range s.usage {
+		if k.hour >= from.Unix() && k.hour < to.Unix() {
+			t.addUsage(k.payer, k.method, u[0], u[1])
+		}
+	}
+	for k, r := range s.revenue {
+		if k.hour >= from.Unix() && k.hour < to.Unix() {
+			t.addRevenue(k.payer, k.network, k.asset, r.payments, r.amount)
+		}
+	}
+	return t.report(from, to), nil
+}
+
+// PostLedgerEntry appends e and applies its postings, unless one would take
+// a balance to the wrong side of zero.
+func (s *InMemoryTokenStore) PostLedgerEntry(e LedgerEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sums := make(map[[2]string]*big.Int, len(e.Postings))
+	for _, p := range e.Postings {
+		k := [2]string{p.Account, p.Unit}
+		if sums[k] == nil {
+			sums[k] = new(big.Int)
+			if b := s.balances[k]; b != nil {
+				sums[k].Set(b)
+			}
+		}
+		sums[k].Add(sums[k], p.Amount)
+		if !ledgerBalanceOK(p.Account, sums[k]) {
+			return fmt.Errorf("%w: %s would hold %s %s", ErrLedgerInvariant, p.Account, sums[k], p.Unit)
+		}
+	}
+	for k, b := range sums {
+		s.balances[k] = b
+	}
+	s.ledgerSeq++
+	e.Seq = s.ledgerSeq
+	if len(s.ledger) >= memoryLedgerEntries {
+		s.ledger = slices.Delete(s.ledger, 0, len(s.ledger)-memoryLedgerEntries+1)
+	}
+	s.ledger = append(s.ledger, e)
+	return nil
+}
+
+// LedgerBalances returns the balances of the accounts starting with prefix.
+func (s *InMemoryTokenStore) LedgerBalances(prefix string) ([]LedgerBalance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []LedgerBalance
+	for k, b := range s.balances {
+		if strings.HasPrefix(k[0], prefix) {
+			out = append(out, LedgerBalance{Account: k[0], Unit: k[1], Amount: new(big.Int).Set(b)})
+		}
+	}
+	sortBalances(out)
+	return out, nil
+}
+
+// LedgerEntries returns the entries posted from from until before to.
+func (s *InMemoryTokenStore) LedgerEntries(from, to time.Time) ([]LedgerEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []LedgerEntry
+	for _, e := range s.ledger {
+		if !e.Time.Before(from) && e.Time.Before(to) {
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+// IndexToken records t.
+func (s *InMemoryTokenStore) IndexToken(t IssuedToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.issued[t.ID] = t
+	return nil
+}
+
+// IssuedToken returns the record of the token with the given ID.
+func (s *InMemoryTokenStore) IssuedToken(id string) (*IssuedToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.issued[id]
+	if !ok {
+		return nil, ErrTokenNotFound
 	}
-	return total - used, nil
+	return &t, nil
+}
+
+// IssuedTokens returns the tokens q selects, newest first.
+func (s *InMemoryTokenStore) IssuedTokens(q TokenQuery) ([]IssuedToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []IssuedToken
+	for _, t := range s.issued {
+		if q.matches(t) {
+			out = append(out, t)
+		}
+	}
+	return sortIssuedTokens(out, q.limit()), nil
 }
 
 // TokenManager issues and validates batch JWT tokens.
 type TokenManager struct {
-	secret []byte
-	expiry time.Duration
-	store  TokenCounterStore
+	keys      *tokenKeys
+	expiry    time.Duration
+	store     TokenCounterStore
+	accounts  bool
+	rateLimit *RateLimit
+	audience  string
+	audit     *AuditLog
+	ledger    LedgerStore
+	tokens    TokenIndex
+}
+
+// tokenKeys are the HMAC secrets of a TokenManager and the managers scoped
+// from it: tokens are signed with the current one and accepted under it or
+// the one before, so rotating the secret does not void tokens in use.
+type tokenKeys struct {
+	mu       sync.RWMutex
+	current  []byte
+	previous []byte
+}
+
+// TokenManagerOption configures optional TokenManager behaviour.
+type TokenManagerOption func(*TokenManager)
+
+// WithAccounts switches the manager to account mode: purchased credits are
+// added to a balance keyed by the payer address, and every JWT issued to that
+// payer spends from the shared balance. This saves clients from juggling
+// several partially-used tokens. Revoking an account ID (see AccountID)
+// disables all of the payer's tokens at once.
+func WithAccounts() TokenManagerOption {
+	return func(m *TokenManager) { m.accounts = true }
+}
+
+// WithAuditLog records every token issued, credit spent, refunded or added
+// and token revoked in the audit log a.
+func WithAuditLog(a *AuditLog) TokenManagerOption {
+	return func(m *TokenManager) { m.audit = a }
+}
+
+// WithLedger posts every credit issued, added, spent, refunded or forfeited
+// to the ledger kept by l.
+func WithLedger(l LedgerStore) TokenManagerOption {
+	return func(m *TokenManager) { m.ledger = l }
+}
+
+// WithTokenIndex records every token issued from now on in ix, for operators
+// to search (see FindTokens).
+func WithTokenIndex(ix TokenIndex) TokenManagerOption {
+	return func(m *TokenManager) { m.tokens = ix }
+}
+
+// WithRateLimit embeds a token-bucket limit of rps requests per second, with
+// bursts of up to burst, in every token issued from now on.
+func WithRateLimit(rps float64, burst int) TokenManagerOption {
+	return func(m *TokenManager) { m.rateLimit = &RateLimit{RPS: rps, Burst: burst} }
 }
 
 // NewTokenManager creates a TokenManager with the given HMAC secret, token
 // lifetime, and counter store.
-func NewTokenManager(secret []byte, expiry time.Duration, store TokenCounterStore) *TokenManager {
-	return &TokenManager{
-		secret: secret,
+func NewTokenManager(secret []byte, expiry time.Duration, store TokenCounterStore, opts ...TokenManagerOption) *TokenManager {
+	m := &TokenManager{
+		keys:   &tokenKeys{current: secret},
 		expiry: expiry,
 		store:  store,
 	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Scoped returns a manager sharing m's secrets and store whose tokens are
+// only good for audience, such as the path of one chain's RPC route: it
+// issues them with audience as their "aud" claim and refuses any other
+// token. In account mode each payer has a separate balance per audience. An
+// empty audience is m's own scope, where tokens carry no audience.
+func (m *TokenManager) Scoped(audience string) *TokenManager {
+	scoped := *m
+	scoped.audience = audience
+	return &scoped
+}
+
+// RotateSecret makes secret the one new tokens are signed with, for m and
+// every manager scoped from it. Tokens signed with the secret it replaces
+// stay valid until the next rotation; earlier ones are refused.
+func (m *TokenManager) RotateSecret(secret []byte) {
+	m.keys.mu.Lock()
+	defer m.keys.mu.Unlock()
+	if string(secret) == string(m.keys.current) {
+		return
+	}
+	m.keys.previous, m.keys.current = m.keys.current, secret
+}
+
+// Audience returns the audience the manager's tokens are scoped to, if any.
+func (m *TokenManager) Audience() string {
+	return m.audience
+}
+
+// accountID returns the counter key of payer's balance in the manager's
+// audience.
+func (m *TokenManager) accountID(payer string) string {
+	if m.audience == "" {
+		return AccountID(payer)
+	}
+	return AccountID(payer) + "@" + m.audience
 }
 
 // IssueToken signs a new batch JWT for payer with requestsTotal credits and
-// registers it in the counter store. Returns the signed token string.
-func (m *TokenManager) IssueToken(payer string, requestsTotal int64) (string, error) {
+// registers it in the counter store. In account mode the credits are added to
+// the payer's balance instead. A non-empty methods list scopes the token to
+// those JSON-RPC methods. Returns the signed token string.
+func (m *TokenManager) IssueToken(payer string, requestsTotal int64, methods []string) (string, error) {
+	signed, _, err := m.issue(payer, requestsTotal, methods, false, false)
+	return signed, err
+}
+
+// IssueUnsettledToken is IssueToken for a payment that is verified but not
+// yet settled. The token always gets its own counter, even in account mode, so
+// it can be revoked on its own if settlement fails. Returns the signed token
+// and its claims.
+func (m *TokenManager) IssueUnsettledToken(payer string, requestsTotal int64, methods []string) (string, *Claims, error) {
+	return m.issue(payer, requestsTotal, methods, false, true)
+}
+
+// IssueMeteredToken signs a new batch JWT for payer with up to requestsTotal
+// credits, to be paid for by usage under the upto scheme. It always gets its
+// own counter, even in account mode. Returns the signed token and its claims.
+func (m *TokenManager) IssueMeteredToken(payer string, requestsTotal int64, methods []string) (string, *Claims, error) {
+	return m.issue(payer, requestsTotal, methods, true, true)
+}
+
+// issue signs and registers a token. ownCounter keeps it out of the payer's
+// account in account mode.
+func (m *TokenManager) issue(payer string, requestsTotal int64, methods []string, metered, ownCounter bool) (string, *Claims, error) {
 	tokenID := uuid.New().String()
 	now := time.Now()
 
+	// Payments without a known payer can't be pooled; give them their own
+	// counter. Metered usage must be attributable to its one payment, and an
+	// unsettled payment's credits revocable without touching the account.
+	account := ""
+	if m.accounts && payer != "" && !ownCounter {
+		account = m.accountID(payer)
+	}
+
 	claims := &Claims{
 		RegisteredClaims: jwt.RegisteredClaims{
 			Subject:   payer,
@@ -126,29 +634,155 @@ func (m *TokenManager) IssueToken(payer string, requestsTotal int64) (string, er
 		},
 		TokenID:       tokenID,
 		RequestsTotal: requestsTotal,
+		Account:       account,
+		Methods:       methods,
+		RateLimit:     m.rateLimit,
+		Metered:       metered,
 	}
 
+	if m.audience != "" {
+		claims.Audience = jwt.ClaimStrings{m.audience}
+	}
+
+	m.keys.mu.RLock()
+	secret := m.keys.current
+	m.keys.mu.RUnlock()
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	signed, err := token.SignedString(m.secret)
+	signed, err := token.SignedString(secret)
+	if err != nil {
+		return "", nil, fmt.Errorf("signing token: %w", err)
+	}
+
+	if account != "" {
+		if err := m.creditAccount(account, requestsTotal); err != nil {
+			return "", nil, err
+		}
+	} else if err := m.store.RegisterToken(tokenID, requestsTotal); err != nil {
+		return "", nil, fmt.Errorf("registering token: %w", err)
+	}
+
+	m.record(AuditTokenIssued, payerActor(payer), claims, map[string]any{
+		"credits": requestsTotal,
+		"methods": methods,
+		"metered": metered,
+	})
+	m.post(LedgerCreditsIssued, claims, creditTransfer("held:"+claims.CounterID(), "issued:"+ledgerPayer(payer), requestsTotal))
+	m.index(claims)
+	return signed, claims, nil
+}
+
+// record writes an audit record of event on the token of claims, if the
+// manager keeps an audit log.
+func (m *TokenManager) record(event, actor string, claims *Claims, data map[string]any) {
+	if m.audit == nil {
+		return
+	}
+	data["tid"] = claims.TokenID
+	data["counter"] = claims.CounterID()
+	if m.audience != "" {
+		data["audience"] = m.audience
+	}
+	m.audit.Record(event, actor, data)
+}
+
+// post posts a ledger entry of kind on the token of claims, if the manager
+// keeps a ledger.
+func (m *TokenManager) post(kind string, claims *Claims, postings []LedgerPosting) {
+	if m.ledger == nil {
+		return
+	}
+	postLedger(m.ledger, LedgerEntry{Kind: kind, Ref: claims.TokenID, Postings: postings})
+}
+
+// CheckPayer returns ErrTokenRevoked if the manager is in account mode and
+// payer's account has been revoked, so a payment can be refused before it is
+// settled rather than after.
+func (m *TokenManager) CheckPayer(payer string) error {
+	if !m.accounts || payer == "" {
+		return nil
+	}
+	revoked, err := m.accountRevoked(m.accountID(payer))
 	if err != nil {
-		return "", fmt.Errorf("signing token: %w", err)
+		return fmt.Errorf("checking revocation: %w", err)
+	}
+	if revoked {
+		return ErrTokenRevoked
+	}
+	return nil
+}
+
+// accountRevoked reports whether the account has been revoked, or, for an
+// account of a scoped manager, the payer's whole account: revoking a payer
+// disables its balances in every audience.
+func (m *TokenManager) accountRevoked(account string) (bool, error) {
+	revoked, err := m.store.IsRevoked(account)
+	if err != nil || revoked {
+		return revoked, err
+	}
+	if base, scoped := strings.CutSuffix(account, "@"+m.audience); scoped && m.audience != "" {
+		return m.store.IsRevoked(base)
 	}
+	return false, nil
+}
 
-	if err := m.store.RegisterToken(tokenID, requestsTotal); err != nil {
-		return "", fmt.Errorf("registering token: %w", err)
+// tokenRevoked reports whether the token of claims has been revoked, by its
+// own ID or, in account mode, with its account.
+func (m *TokenManager) tokenRevoked(claims *Claims) (bool, error) {
+	if claims.Account != "" {
+		if revoked, err := m.store.IsRevoked(claims.TokenID); err != nil || revoked {
+			return revoked, err
+		}
 	}
+	return m.accountRevoked(claims.CounterID())
+}
 
-	return signed, nil
+// creditAccount adds n credits to account, opening it on first purchase.
+func (m *TokenManager) creditAccount(account string, n int64) error {
+	if err := m.store.RegisterToken(account, 0); err != nil {
+		return fmt.Errorf("opening account: %w", err)
+	}
+	if revoked, err := m.accountRevoked(account); err != nil {
+		return fmt.Errorf("checking revocation: %w", err)
+	} else if revoked {
+		return ErrTokenRevoked
+	}
+	if _, err := m.store.AddCredits(account, n); err != nil {
+		return fmt.Errorf("crediting account: %w", err)
+	}
+	return nil
 }
 
 // ValidateToken parses and verifies the JWT signature and expiry, returning
-// the embedded claims.
+// the embedded claims. Returns ErrTokenAudience for a token of another
+// audience (see Scoped).
 func (m *TokenManager) ValidateToken(tokenString string) (*Claims, error) {
+	claims, err := m.parse(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	want := jwt.ClaimStrings(nil)
+	if m.audience != "" {
+		want = jwt.ClaimStrings{m.audience}
+	}
+	if !slices.Equal(claims.Audience, want) {
+		return nil, ErrTokenAudience
+	}
+	return claims, nil
+}
+
+// parse verifies the JWT signature and expiry of a token of any audience,
+// returning the embedded claims.
+func (m *TokenManager) parse(tokenString string) (*Claims, error) {
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(t *jwt.Token) (interface{}, error) {
 		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
 		}
-		return m.secret, nil
+		m.keys.mu.RLock()
+		defer m.keys.mu.RUnlock()
+		if m.keys.previous == nil {
+			return m.keys.current, nil
+		}
+		return jwt.VerificationKeySet{Keys: []jwt.VerificationKey{m.keys.current, m.keys.previous}}, nil
 	})
 	if err != nil {
 		return nil, err
@@ -160,8 +794,117 @@ func (m *TokenManager) ValidateToken(tokenString string) (*Claims, error) {
 	return claims, nil
 }
 
-// UseRequest atomically consumes one credit from the token and returns the
-// remaining count.
-func (m *TokenManager) UseRequest(claims *Claims) (int64, error) {
-	return m.store.UseRequest(claims.TokenID, claims.RequestsTotal)
+// UseRequest atomically consumes cost credits from the token (or its account)
+// and returns the remaining count. Returns ErrTokenRevoked, without consuming
+// anything, if an operator has revoked the token or account.
+func (m *TokenManager) UseRequest(claims *Claims, cost int64) (int64, error) {
+	revoked, err := m.tokenRevoked(claims)
+	if err != nil {
+		return 0, fmt.Errorf("checking revocation: %w", err)
+	}
+	if revoked {
+		return 0, ErrTokenRevoked
+	}
+	remaining, err := m.store.UseRequest(claims.CounterID(), cost)
+	if err == nil {
+		m.record(AuditCreditsUsed, payerActor(claims.Subject), claims, map[string]any{"credits": cost, "remaining": remaining})
+		m.post(LedgerCreditsUsed, claims, creditTransfer("consumed:"+claims.CounterID(), "held:"+claims.CounterID(), cost))
+	}
+	return remaining, err
+}
+
+// RefundRequest returns cost credits consumed by UseRequest, for calls the
+// gateway failed to serve, and returns the new remaining count.
+func (m *TokenManager) RefundRequest(claims *Claims, cost int64) (int64, error) {
+	remaining, err := m.store.RefundRequest(claims.CounterID(), cost)
+	if err == nil {
+		m.record(AuditCreditsRefunded, ActorGateway, claims, map[string]any{"credits": cost, "remaining": remaining})
+		m.post(LedgerCreditsRefunded, claims, creditTransfer("held:"+claims.CounterID(), "consumed:"+claims.CounterID(), cost))
+	}
+	return remaining, err
+}
+
+// Remaining returns the unused credits of the counter with the given ID — a
+// token ID or an account ID — without consuming any.
+func (m *TokenManager) Remaining(id string) (int64, error) {
+	return m.store.Remaining(id)
+}
+
+// Expiry returns the lifetime of newly issued tokens.
+func (m *TokenManager) Expiry() time.Duration {
+	return m.expiry
+}
+
+// CheckUsable returns nil if the token (or its account) is registered and not
+// revoked, i.e. it can still receive credits. Returns ErrTokenNotFound or
+// ErrTokenRevoked.
+func (m *TokenManager) CheckUsable(claims *Claims) error {
+	revoked, err := m.tokenRevoked(claims)
+	if err != nil {
+		return fmt.Errorf("checking revocation: %w", err)
+	}
+	if revoked {
+		return ErrTokenRevoked
+	}
+	_, err = m.store.Remaining(claims.CounterID())
+	return err
+}
+
+// AddCredits tops up an existing token (or its account) with n more credits
+// and returns the new remaining count. The JWT itself is unchanged.
+func (m *TokenManager) AddCredits(claims *Claims, n int64) (int64, error) {
+	remaining, err := m.store.AddCredits(claims.CounterID(), n)
+	if err == nil {
+		m.record(AuditCreditsAdded, payerActor(claims.Subject), claims, map[string]any{"credits": n, "remaining": remaining})
+		m.post(LedgerCreditsAdded, claims, creditTransfer("held:"+claims.CounterID(), "issued:"+ledgerPayer(claims.Subject), n))
+	}
+	return remaining, err
+}
+
+// Revoke permanently disables the token or account with the given ID. An
+// account ID disables every token of that payer, and any credits it still
+// holds can no longer be spent; so do those of a token with a counter of its
+// own. A token spending from its payer's account is disabled alone, leaving
+// the account's credits to the payer's other tokens. Returns
+// ErrTokenNotFound for unknown IDs.
+func (m *TokenManager) Revoke(id string) error {
+	return m.RevokeAs(id, ActorGateway)
+}
+
+// RevokeAs is Revoke on behalf of actor, who the audit log records as
+// revoking the counter.
+func (m *TokenManager) RevokeAs(id, actor string) error {
+	t, err := m.lookup(id)
+	if err != nil {
+		return err
+	}
+	// A token of an account has no counter of its own: it is given an empty
+	// one to record the revocation on.
+	accountToken := t.Counter != id
+	if accountToken {
+		if err := m.store.RegisterToken(id, 0); err != nil {
+			return err
+		}
+	}
+	// Credits are forfeited once, by the first revocation.
+	revoked, err := m.store.IsRevoked(id)
+	if err != nil {
+		return err
+	}
+	if err := m.store.RevokeToken(id); err != nil {
+		return err
+	}
+	if m.audit != nil {
+		m.audit.Record(AuditTokenRevoked, actor, map[string]any{"counter": id})
+	}
+	if m.ledger != nil && !revoked && !accountToken {
+		// The credits left can no longer be spent.
+		remaining, err := m.store.Remaining(id)
+		if err != nil {
+			slog.Error("reading forfeited credits failed", "counter", id, "err", err)
+			return nil
+		}
+		postLedger(m.ledger, LedgerEntry{Kind: LedgerCreditsForfeited, Ref: id, Postings: creditTransfer("forfeited:"+id, "held:"+id, remaining)})
+	}
+	return nil
 }
@@ -0,0 +1,278 @@
+package x402
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrTokenMetered is returned for credits granted to a metered token: its
+// payer would be charged for them when it settles.
+var ErrTokenMetered = errors.New("metered tokens cannot be granted credits")
+
+// maxTokenQuery caps the tokens a search returns.
+const maxTokenQuery = 1000
+
+// IssuedToken is what a token was issued with, as the counter store does
+// not keep it: who paid for it, the counter it spends from and when it
+// expires.
+type IssuedToken struct {
+	ID    string `json:"id"`
+	Payer string `json:"payer,omitempty"`
+	// Counter is the token's own ID, or the payer's account in account mode.
+	Counter  string    `json:"counter"`
+	Audience string    `json:"audience,omitempty"`
+	Credits  int64     `json:"credits"`
+	Methods  []string  `json:"methods,omitempty"`
+	Metered  bool      `json:"metered,omitempty"`
+	IssuedAt time.Time `json:"issuedAt"`
+	Expires  time.Time `json:"expires"`
+}
+
+// TokenQuery selects issued tokens. Zero fields select everything.
+type TokenQuery struct {
+	// Payer is the address the tokens were issued to, in any case.
+	Payer string
+	// ExpiresAfter and ExpiresBefore bound the tokens' expiry.
+	ExpiresAfter  time.Time
+	ExpiresBefore time.Time
+	// MinRemaining and MaxRemaining, when set, bound the credits left on
+	// the tokens' counters. The token index ignores them; FindTokens reads
+	// the counters.
+	MinRemaining *int64
+	MaxRemaining *int64
+	// Limit caps the tokens returned, newest first; at most maxTokenQuery.
+	Limit int
+}
+
+// matches reports whether t is selected by q, but for the limit.
+func (q TokenQuery) matches(t IssuedToken) bool {
+	if q.Payer != "" && foldAddress(t.Payer) != foldAddress(q.Payer) {
+		return false
+	}
+	if !q.ExpiresAfter.IsZero() && !t.Expires.After(q.ExpiresAfter) {
+		return false
+	}
+	return q.ExpiresBefore.IsZero() || t.Expires.Before(q.ExpiresBefore)
+}
+
+// limit returns the number of tokens q asks for.
+func (q TokenQuery) limit() int {
+	if q.Limit <= 0 || q.Limit > maxTokenQuery {
+		return maxTokenQuery
+	}
+	return q.Limit
+}
+
+// TokenIndex keeps a record of every token issued, for operators to find a
+// payer's tokens when handling a support ticket. Implementations must be
+// safe for concurrent use; the bolt and postgres token stores keep it across
+// restarts.
+type TokenIndex interface {
+	// IndexToken records t, replacing any record of the same ID.
+	IndexToken(t IssuedToken) error
+
+	// IssuedToken returns the record of the token with the given ID, or
+	// ErrTokenNotFound.
+	IssuedToken(id string) (*IssuedToken, error)
+
+	// IssuedTokens returns the tokens q selects, newest first.
+	IssuedTokens(q TokenQuery) ([]IssuedToken, error)
+}
+
+// sortIssuedTokens orders tokens newest first, and caps them at limit.
+func sortIssuedTokens(tokens []IssuedToken, limit int) []IssuedToken {
+	sort.Slice(tokens, func(i, j int) bool {
+		if !tokens[i].IssuedAt.Equal(tokens[j].IssuedAt) {
+			return tokens[i].IssuedAt.After(tokens[j].IssuedAt)
+		}
+		return tokens[i].ID < tokens[j].ID
+	})
+	if len(tokens) > limit {
+		tokens = tokens[:limit]
+	}
+	return tokens
+}
+
+// TokenStatus is an issued token with the state of its counter.
+type TokenStatus struct {
+	IssuedToken
+	Remaining int64 `json:"remaining"`
+	Revoked   bool  `json:"revoked"`
+	Expired   bool  `json:"expired"`
+}
+
+// index records the token of claims in the manager's token index, if it
+// keeps one. A token that fails to be indexed still works: the failure is
+// only logged.
+func (m *TokenManager) index(claims *Claims) {
+	if m.tokens == nil {
+		return
+	}
+	t := IssuedToken{
+		ID:       claims.TokenID,
+		Payer:    claims.Subject,
+		Counter:  claims.CounterID(),
+		Audience: m.audience,
+		Credits:  claims.RequestsTotal,
+		Methods:  claims.Methods,
+		Metered:  claims.Metered,
+		IssuedAt: claims.IssuedAt.Time.UTC(),
+		Expires:  claims.ExpiresAt.Time.UTC(),
+	}
+	if err := m.tokens.IndexToken(t); err != nil {
+		slog.Error("indexing token failed", "tid", t.ID, "err", err)
+	}
+}
+
+// Indexed reports whether the manager keeps a token index to search.
+func (m *TokenManager) Indexed() bool {
+	return m.tokens != nil
+}
+
+// FindTokens returns the status of the tokens q selects, newest first.
+// Unless all is set only active tokens are returned: unexpired, and neither
+// they nor their account revoked. Of the tokens the index selects, at most
+// maxTokenQuery are looked at.
+func (m *TokenManager) FindTokens(q TokenQuery, all bool) ([]TokenStatus, error) {
+	if m.tokens == nil {
+		return nil, errors.New("no token index")
+	}
+	if now := time.Now(); !all && q.ExpiresAfter.Before(now) {
+		q.ExpiresAfter = now
+	}
+	limit := q.limit()
+	q.Limit = maxTokenQuery
+	tokens, err := m.tokens.IssuedTokens(q)
+	if err != nil {
+		return nil, err
+	}
+	out := []TokenStatus{}
+	for _, t := range tokens {
+		s, err := m.status(t)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case s.Revoked && !all:
+		case q.MinRemaining != nil && s.Remaining < *q.MinRemaining:
+		case q.MaxRemaining != nil && s.Remaining > *q.MaxRemaining:
+		default:
+			out = append(out, *s)
+		}
+		if len(out) == limit {
+			break
+		}
+	}
+	return out, nil
+}
+
+// Inspect returns the status of the token with the given ID. A token issued
+// before the manager kept an index, or an account ID, is reported by its
+// counter alone. Returns ErrTokenNotFound for unknown IDs.
+func (m *TokenManager) Inspect(id string) (*TokenStatus, error) {
+	t, err := m.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+	return m.status(*t)
+}
+
+// lookup returns the index record of the token with the given ID, or a bare
+// one naming id as its counter when the index has none.
+func (m *TokenManager) lookup(id string) (*IssuedToken, error) {
+	if m.tokens != nil {
+		t, err := m.tokens.IssuedToken(id)
+		if err == nil {
+			return t, nil
+		}
+		if !errors.Is(err, ErrTokenNotFound) {
+			return nil, err
+		}
+	}
+	if _, err := m.store.Remaining(id); err != nil {
+		return nil, err
+	}
+	return &IssuedToken{ID: id, Counter: id}, nil
+}
+
+// status reads the counter of t.
+func (m *TokenManager) status(t IssuedToken) (*TokenStatus, error) {
+	s := &TokenStatus{IssuedToken: t, Expired: !t.Expires.IsZero() && !t.Expires.After(time.Now())}
+	remaining, err := m.store.Remaining(t.Counter)
+	if err != nil && !errors.Is(err, ErrTokenNotFound) {
+		return nil, err
+	}
+	s.Remaining = remaining
+	if s.Revoked, err = m.revoked(t); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// revoked reports whether t has been revoked: its counter, or, for a token
+// spending from its payer's account, the token itself.
+func (m *TokenManager) revoked(t IssuedToken) (bool, error) {
+	if t.ID != t.Counter {
+		if revoked, err := m.store.IsRevoked(t.ID); err != nil || revoked {
+			return revoked, err
+		}
+	}
+	return m.counterRevoked(t.Counter)
+}
+
+// counterRevoked reports whether the counter has been revoked, or, for an
+// account in an audience, the payer's whole account, whatever the
+// manager's own audience.
+func (m *TokenManager) counterRevoked(counter string) (bool, error) {
+	revoked, err := m.store.IsRevoked(counter)
+	if err != nil || revoked {
+		return revoked, err
+	}
+	if base, _, scoped := strings.Cut(counter, "@"); scoped && strings.HasPrefix(counter, "acct:") {
+		return m.store.IsRevoked(base)
+	}
+	return false, nil
+}
+
+// GrantCredits adds n free credits to the token with the given ID, or to the
+// account with the given account ID, on behalf of actor, and returns the new
+// remaining count. Returns ErrTokenNotFound for unknown IDs, ErrTokenRevoked
+// for a revoked counter and ErrTokenMetered for a metered token.
+func (m *TokenManager) GrantCredits(id string, n int64, actor, reason string) (int64, error) {
+	if n <= 0 {
+		return 0, fmt.Errorf("credits must be positive, got %d", n)
+	}
+	t, err := m.lookup(id)
+	if err != nil {
+		return 0, err
+	}
+	if t.Metered {
+		return 0, ErrTokenMetered
+	}
+	if revoked, err := m.revoked(*t); err != nil {
+		return 0, fmt.Errorf("checking revocation: %w", err)
+	} else if revoked {
+		return 0, ErrTokenRevoked
+	}
+	remaining, err := m.store.AddCredits(t.Counter, n)
+	if err != nil {
+		return 0, err
+	}
+	if m.audit != nil {
+		m.audit.Record(AuditCreditsGranted, actor, map[string]any{
+			"tid":       t.ID,
+			"counter":   t.Counter,
+			"credits":   n,
+			"remaining": remaining,
+			"reason":    reason,
+		})
+	}
+	if m.ledger != nil {
+		postLedger(m.ledger, LedgerEntry{Kind: LedgerCreditsGranted, Ref: t.ID, Postings: creditTransfer("held:"+t.Counter, "granted:"+t.Counter, n)})
+	}
+	return remaining, nil
+}
@@ -0,0 +1,69 @@
+package x402
+
+// The "upto" scheme: instead of prepaying a fixed credit pack, the client
+// signs a Permit2 permit for a maximum amount. Nothing is transferred at
+// purchase; the gateway meters the token's usage and, once the token is
+// exhausted or has expired, pulls only the share of the maximum that was
+// consumed. Permit2 fits because permitTransferFrom may request less than the
+// permitted amount, which EIP-3009 authorizations cannot.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"time"
+)
+
+// SchemeUpto is the Accepts scheme for metered payments: a Permit2 permit for
+// up to the advertised amount, settled for actual usage.
+const SchemeUpto = "upto"
+
+// uptoSettleMargin is how long after a token expires its permit must stay
+// valid, so the sweeper has time to settle (and retry) the metered amount.
+const uptoSettleMargin = 15 * time.Minute
+
+// usesPermit2 reports whether payments under scheme carry a Permit2 permit.
+func usesPermit2(scheme string) bool {
+	return scheme == SchemePermit2 || scheme == SchemeUpto
+}
+
+// meteredAmount returns the share of maxAmount owed for used of credits,
+// rounded up so the gateway is never paid less than the advertised price.
+func meteredAmount(maxAmount *big.Int, used, credits int64) *big.Int {
+	used = min(max(used, 0), credits)
+	n := new(big.Int).Mul(maxAmount, big.NewInt(used))
+	n.Add(n, big.NewInt(credits-1))
+	return n.Div(n, big.NewInt(credits))
+}
+
+// meteredRequirements returns the requirements JSON to settle a metered
+// payment with: the maximum amount replaced by the share its token used. done
+// is true when nothing was used and the permit may simply lapse.
+func (m *Middleware) meteredRequirements(p *PendingSettlement, req paymentRequirementsV2) (reqJSON []byte, done bool, err error) {
+	remaining, err := m.cfg.Tokens.Remaining(p.TokenID)
+	if err != nil {
+		return nil, false, fmt.Errorf("reading usage: %w", err)
+	}
+	used := p.Credits - remaining
+
+	amount := meteredAmount(mustBI(req.Amount), used, p.Credits)
+	if amount.Sign() == 0 {
+		slog.Info("upto token unused, nothing to settle", "tid", p.TokenID)
+		return nil, true, nil
+	}
+	maxAmount := req.Amount
+	req.Amount = amount.String()
+	reqJSON, err = json.Marshal(req)
+	if err != nil {
+		return nil, false, fmt.Errorf("marshalling requirements: %w", err)
+	}
+	slog.Info("settling metered payment",
+		"tid", p.TokenID,
+		"used", used,
+		"credits", p.Credits,
+		"amount", req.Amount,
+		"max", maxAmount,
+	)
+	return reqJSON, false, nil
+}
@@ -0,0 +1,231 @@
+package x402
+
+import (
+	"log/slog"
+	"math/big"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// UsageStore keeps, by hour, the calls and credits each payer spent on each
+// JSON-RPC method and what each payer paid, for the usage reports operators
+// invoice customers from. Implementations must be safe for concurrent use;
+// the bolt and postgres token stores keep them across restarts.
+type UsageStore interface {
+	// AddUsage adds calls and credits to payer's use of method in the hour
+	// starting at hour.
+	AddUsage(hour time.Time, payer, method string, calls, credits int64) error
+
+	// AddRevenue adds payments and amount, in the asset's atomic units, to
+	// what payer paid in asset on network in the hour starting at hour.
+	// Both are negative for a settlement taken back by a reorg.
+	AddRevenue(hour time.Time, payer, network, asset string, payments int64, amount *big.Int) error
+
+	// UsageReport totals the hours starting from from until before to, per
+	// payer and method, and per payer, network and asset.
+	UsageReport(from, to time.Time) (*UsageReport, error)
+}
+
+// UsageReport is what payers used and paid over a window of hours.
+type UsageReport struct {
+	From    time.Time     `json:"from"`
+	To      time.Time     `json:"to"`
+	Usage   []MethodUsage `json:"usage"`
+	Revenue []PaidRevenue `json:"revenue"`
+}
+
+// MethodUsage is what a payer spent on a JSON-RPC method. Requests to HTTP
+// routes are reported under the route's prefix.
+type MethodUsage struct {
+	Payer   string `json:"payer"`
+	Method  string `json:"method"`
+	Calls   int64  `json:"calls"`
+	Credits int64  `json:"credits"`
+}
+
+// PaidRevenue is what a payer paid in an asset, in its atomic units.
+type PaidRevenue struct {
+	Payer    string `json:"payer"`
+	Network  string `json:"network"`
+	Asset    string `json:"asset"`
+	Payments int64  `json:"payments"`
+	Amount   string `json:"amount"`
+}
+
+// usageKey identifies a payer's use of a method in an hour.
+type usageKey struct {
+	hour          int64 // unix seconds
+	payer, method string
+}
+
+// revenueKey identifies a payer's payments in an asset in an hour.
+type revenueKey struct {
+	hour                  int64 // unix seconds
+	payer, network, asset string
+}
+
+// unknownMethod is the method usage is reported under for a request whose
+// body is not JSON-RPC.
+const unknownMethod = "(unknown)"
+
+// recordUsage adds what a request that spent credits, net of refunds, cost
+// payer to the usage store: the credits of a batch are shared among its
+// calls by their list price.
+func (m *Middleware) recordUsage(r *http.Request, payer string, calls []rpcCall, credits int64) {
+	if m.cfg.Usage == nil {
+		return
+	}
+	hour := time.Now().UTC().Truncate(time.Hour)
+	payer = foldAddress(payer)
+	if rt := routeOf(r); rt != nil {
+		m.addUsage(hour, payer, rt.Prefix, 1, credits)
+		return
+	}
+	if len(calls) == 0 {
+		m.addUsage(hour, payer, unknownMethod, 1, credits)
+		return
+	}
+
+	prices := make([]int64, len(calls))
+	var total int64
+	for i := range calls {
+		prices[i] = m.requestCost(calls[i : i+1])
+		total += prices[i]
+	}
+	type tally struct{ calls, credits int64 }
+	byMethod := make(map[string]*tally)
+	var order []string
+	left := credits
+	for i, c := range calls {
+		share := left
+		if i < len(calls)-1 && total > 0 {
+			share = credits * prices[i] / total
+		}
+		left -= share
+		method := c.Method
+		if method == "" {
+			method = unknownMethod
+		}
+		t := byMethod[method]
+		if t == nil {
+			t = &tally{}
+			byMethod[method] = t
+			order = append(order, method)
+		}
+		t.calls++
+		t.credits += share
+	}
+	for _, method := range order {
+		t := byMethod[method]
+		m.addUsage(hour, payer, method, t.calls, t.credits)
+	}
+}
+
+func (m *Middleware) addUsage(hour time.Time, payer, method string, calls, credits int64) {
+	if err := m.cfg.Usage.AddUsage(hour, payer, method, calls, credits); err != nil {
+		slog.Error("usage record failed", "payer", payer, "method", method, "err", err)
+	}
+}
+
+// recordRevenue adds a confirmed settlement, or takes back one reorged out
+// of the chain, in the usage store.
+func (m *Middleware) recordRevenue(eventType string, data map[string]any) {
+	var sign int64
+	switch eventType {
+	case EventSettlementConfirmed:
+		sign = 1
+	case EventSettlementReorged:
+		sign = -1
+	default:
+		return
+	}
+	amountStr, _ := data["amount"].(string)
+	amount, ok := new(big.Int).SetString(amountStr, 10)
+	if !ok {
+		return
+	}
+	payer, _ := data["payer"].(string)
+	network, _ := data["network"].(string)
+	asset, _ := data["asset"].(string)
+	hour := time.Now().UTC().Truncate(time.Hour)
+	if err := m.cfg.Usage.AddRevenue(hour, foldAddress(payer), network, foldAddress(asset), sign, amount.Mul(amount, big.NewInt(sign))); err != nil {
+		slog.Error("revenue record failed", "payer", payer, "err", err)
+	}
+}
+
+// usageTotals adds up hourly usage and revenue records into a UsageReport,
+// for the stores that keep them hour by hour.
+type usageTotals struct {
+	usage   map[[2]string]*MethodUsage
+	revenue map[[3]string]*revenueTotal
+}
+
+type revenueTotal struct {
+	payments int64
+	amount   *big.Int
+}
+
+func newUsageTotals() *usageTotals {
+	return &usageTotals{
+		usage:   make(map[[2]string]*MethodUsage),
+		revenue: make(map[[3]string]*revenueTotal),
+	}
+}
+
+func (t *usageTotals) addUsage(payer, method string, calls, credits int64) {
+	k := [2]string{payer, method}
+	u := t.usage[k]
+	if u == nil {
+		u = &MethodUsage{Payer: payer, Method: method}
+		t.usage[k] = u
+	}
+	u.Calls += calls
+	u.Credits += credits
+}
+
+func (t *usageTotals) addRevenue(payer, network, asset string, payments int64, amount *big.Int) {
+	k := [3]string{payer, network, asset}
+	r := t.revenue[k]
+	if r == nil {
+		r = &revenueTotal{amount: new(big.Int)}
+		t.revenue[k] = r
+	}
+	r.payments += payments
+	r.amount.Add(r.amount, amount)
+}
+
+// report returns the totals, ordered by payer, then method or network and
+// asset.
+func (t *usageTotals) report(from, to time.Time) *UsageReport {
+	rep := &UsageReport{
+		From:    from,
+		To:      to,
+		Usage:   make([]MethodUsage, 0, len(t.usage)),
+		Revenue: make([]PaidRevenue, 0, len(t.revenue)),
+	}
+	for _, u := range t.usage {
+		rep.Usage = append(rep.Usage, *u)
+	}
+	sort.Slice(rep.Usage, func(i, j int) bool {
+		a, b := rep.Usage[i], rep.Usage[j]
+		if a.Payer != b.Payer {
+			return a.Payer < b.Payer
+		}
+		return a.Method < b.Method
+	})
+	for k, r := range t.revenue {
+		rep.Revenue = append(rep.Revenue, PaidRevenue{Payer: k[0], Network: k[1], Asset: k[2], Payments: r.payments, Amount: r.amount.String()})
+	}
+	sort.Slice(rep.Revenue, func(i, j int) bool {
+		a, b := rep.Revenue[i], rep.Revenue[j]
+		if a.Payer != b.Payer {
+			return a.Payer < b.Payer
+		}
+		if a.Network != b.Network {
+			return a.Network < b.Network
+		}
+		return a.Asset < b.Asset
+	})
+	return rep
+}
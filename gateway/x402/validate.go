@@ -0,0 +1,88 @@
+package x402
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+)
+
+// rpcParseError is the JSON-RPC error code for a body that is not JSON.
+const rpcParseError = -32700
+
+// enforceValid answers the request with JSON-RPC errors, and returns false,
+// if body is not a well-formed JSON-RPC 2.0 request or batch.
+func enforceValid(w http.ResponseWriter, body []byte) bool {
+	return writeRPCReply(w, validationReply(body))
+}
+
+// validationReply returns the JSON-RPC errors answering body if it is not a
+// well-formed JSON-RPC 2.0 request or batch, and nil otherwise. Like a blocked
+// method, one malformed call rejects its whole batch: it would be charged
+// for and forwarded only to be turned away by the upstream.
+func validationReply(body []byte) []byte {
+	body = bytes.TrimSpace(body)
+	if !json.Valid(body) {
+		return rpcErrorReply(nil, false, rpcParseError, "parse error")
+	}
+	if body[0] != '[' {
+		id, problem := checkRequest(body)
+		if problem == "" {
+			return nil
+		}
+		return rpcErrorReply([]rpcCall{{ID: id}}, false, rpcInvalidRequest, "invalid request: "+problem)
+	}
+
+	var elems []json.RawMessage
+	_ = json.Unmarshal(body, &elems)
+	if len(elems) == 0 {
+		return rpcErrorReply(nil, false, rpcInvalidRequest, "invalid request: empty batch")
+	}
+	resps := make([]rpcError, len(elems))
+	invalid := false
+	for i, e := range elems {
+		id, problem := checkRequest(e)
+		if id == nil {
+			id = json.RawMessage("null")
+		}
+		resps[i] = rpcError{JSONRPC: "2.0", ID: id}
+		if problem != "" {
+			invalid = true
+			resps[i].Error = rpcErrorBody{Code: rpcInvalidRequest, Message: "invalid request: " + problem}
+		} else {
+			resps[i].Error = rpcErrorBody{Code: rpcInvalidRequest, Message: "batch contains an invalid request"}
+		}
+	}
+	if !invalid {
+		return nil
+	}
+	reply, _ := json.Marshal(resps)
+	return reply
+}
+
+// checkRequest returns what makes req, one JSON value, not a JSON-RPC 2.0
+// request, or "" if nothing does, along with its ID if that is valid.
+func checkRequest(req json.RawMessage) (id json.RawMessage, problem string) {
+	var fields map[string]json.RawMessage
+	if req[0] != '{' || json.Unmarshal(req, &fields) != nil {
+		return nil, "not a JSON object"
+	}
+	if raw, ok := fields["id"]; ok {
+		switch raw[0] {
+		case '"', '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', 'n':
+			id = raw
+		default:
+			return nil, "id must be a string, number or null"
+		}
+	}
+	var version, method string
+	if json.Unmarshal(fields["jsonrpc"], &version) != nil || version != "2.0" {
+		return id, `jsonrpc must be "2.0"`
+	}
+	if json.Unmarshal(fields["method"], &method) != nil || method == "" {
+		return id, "method must be a non-empty string"
+	}
+	if raw, ok := fields["params"]; ok && raw[0] != '[' && raw[0] != '{' {
+		return id, "params must be an array or object"
+	}
+	return id, ""
+}
@@ -0,0 +1,278 @@
+package x402
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Webhook event types.
+const (
+	EventPaymentVerified     = "payment_verified"
+	EventSettlementSubmitted = "settlement_submitted"
+	EventSettlementConfirmed = "settlement_confirmed"
+	EventSettlementFailed    = "settlement_failed"
+	EventSettlementReverted  = "settlement_reverted"
+	EventSettlementReorged   = "settlement_reorged"
+	EventTokenExhausted      = "token_exhausted"
+)
+
+var webhookEventTypes = map[string]bool{
+	EventPaymentVerified:     true,
+	EventSettlementSubmitted: true,
+	EventSettlementConfirmed: true,
+	EventSettlementFailed:    true,
+	EventSettlementReverted:  true,
+	EventSettlementReorged:   true,
+	EventTokenExhausted:      true,
+}
+
+const (
+	// webhookQueueSize bounds the events waiting for delivery; further events
+	// are dropped while the queue is full.
+	webhookQueueSize = 1000
+	// webhookRetryBase is the delay before the first retry, doubled for each
+	// further one.
+	webhookRetryBase = 2 * time.Second
+	// defaultWebhookAttempts is how often an event is tried before it is
+	// dropped, when WebhookConfig.MaxAttempts is not set.
+	defaultWebhookAttempts = 6
+)
+
+// Webhook delivery headers. The signature is "t=<unix time>,v1=<hex HMAC>"
+// where the HMAC-SHA256, keyed with the webhook secret, covers "<t>.<body>".
+// Receivers should check it, reject stale timestamps, and de-duplicate
+// retried deliveries by event ID.
+const (
+	webhookSignatureHeader = "X-Webhook-Signature"
+	webhookEventHeader     = "X-Webhook-Event"
+	webhookIDHeader        = "X-Webhook-Id"
+)
+
+// WebhookEvent is the body of a webhook delivery.
+type WebhookEvent struct {
+	ID   string         `json:"id"`
+	Type string         `json:"type"`
+	Time time.Time      `json:"time"`
+	Data map[string]any `json:"data"`
+}
+
+// WebhookConfig configures webhook delivery.
+type WebhookConfig struct {
+	// URL receives every event as a signed JSON POST.
+	URL string
+	// Secret keys the deliveries' HMAC signatures. Must be non-empty.
+	Secret []byte
+	// Events, when non-empty, are the only event types delivered.
+	Events []string
+	// MaxAttempts is how often a delivery is tried before the event is
+	// dropped. Network errors, 429 and 5xx answers are retried.
+	MaxAttempts int
+}
+
+// Webhooks delivers gateway events to an operator's endpoint in the
+// background. Delivery is best-effort: events still queued or awaiting a
+// retry are lost on shutdown.
+type Webhooks struct {
+	cfg    WebhookConfig
+	events map[string]bool
+	client *http.Client
+	queue  chan webhookDelivery
+}
+
+// webhookDelivery is a queued event and how often it has been tried.
+type webhookDelivery struct {
+	event    WebhookEvent
+	body     []byte
+	attempts int
+}
+
+// NewWebhooks validates cfg and starts delivering the events sent to the
+// returned Webhooks.
+func NewWebhooks(cfg WebhookConfig) (*Webhooks, error) {
+	if cfg.URL == "" || len(cfg.Secret) == 0 {
+		return nil, fmt.Errorf("webhooks need a URL and a signing secret")
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = defaultWebhookAttempts
+	}
+	events := make(map[string]bool, len(cfg.Events))
+	for _, e := range cfg.Events {
+		if !webhookEventTypes[e] {
+			return nil, fmt.Errorf("unknown webhook event %q", e)
+		}
+		events[e] = true
+	}
+
+	h := &Webhooks{
+		cfg:    cfg,
+		events: events,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		queue: make(chan webhookDelivery, webhookQueueSize),
+	}
+	go h.run()
+	return h, nil
+}
+
+// Send queues an event of the given type for delivery. It never blocks.
+func (h *Webhooks) Send(eventType string, data map[string]any) {
+	if len(h.events) > 0 && !h.events[eventType] {
+		return
+	}
+	ev := WebhookEvent{
+		ID:   uuid.New().String(),
+		Type: eventType,
+		Time: time.Now().UTC(),
+		Data: data,
+	}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		slog.Error("encoding webhook event failed", "event", eventType, "err", err)
+		return
+	}
+	h.enqueue(webhookDelivery{event: ev, body: body})
+}
+
+func (h *Webhooks) enqueue(d webhookDelivery) {
+	select {
+	case h.queue <- d:
+	default:
+		slog.Warn("webhook queue full, event dropped", "event", d.event.Type, "id", d.event.ID)
+	}
+}
+
+// run delivers queued events one at a time. A failed delivery is re-queued
+// after its backoff rather than retried in place, so one slow event does not
+// hold up the others.
+func (h *Webhooks) run() {
+	for d := range h.queue {
+		retry, err := h.deliver(d)
+		if err == nil {
+			continue
+		}
+		d.attempts++
+		if !retry || d.attempts >= h.cfg.MaxAttempts {
+			slog.Error("webhook delivery abandoned", "event", d.event.Type, "id", d.event.ID, "attempts", d.attempts, "err", err)
+			continue
+		}
+		slog.Warn("webhook delivery failed, will retry", "event", d.event.Type, "id", d.event.ID, "attempts", d.attempts, "err", err)
+		time.AfterFunc(webhookRetryBase<<(d.attempts-1), func() { h.enqueue(d) })
+	}
+}
+
+// deliver POSTs one event, reporting whether a failure is worth retrying.
+func (h *Webhooks) deliver(d webhookDelivery) (retry bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.client.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.cfg.URL, bytes.NewReader(d.body))
+	if err != nil {
+		return false, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, d.event.Type)
+	req.Header.Set(webhookIDHeader, d.event.ID)
+	req.Header.Set(webhookSignatureHeader, "t="+ts+",v1="+h.sign(ts, d.body))
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode >= 300 {
+		retry = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return retry, fmt.Errorf("webhook endpoint returned %d", resp.StatusCode)
+	}
+	return false, nil
+}
+
+// sign returns the hex HMAC-SHA256 of "<ts>.<body>".
+func (h *Webhooks) sign(ts string, body []byte) string {
+	mac := hmac.New(sha256.New, h.cfg.Secret)
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// notify reports an event to the settlement statuses and revenue tallies,
+// and to the usage store, ledger, audit log, event stream and webhooks if
+// they are configured.
+func (m *Middleware) notify(eventType string, data map[string]any) {
+	m.statuses.record(eventType, data)
+	revenue.record(eventType, data)
+	if m.cfg.Usage != nil {
+		m.recordRevenue(eventType, data)
+	}
+	if m.cfg.Ledger != nil {
+		m.recordLedger(eventType, data)
+	}
+	if m.cfg.Audit != nil {
+		actor := ActorGateway
+		if eventType == EventPaymentVerified {
+			payer, _ := data["payer"].(string)
+			actor = payerActor(payer)
+		}
+		m.cfg.Audit.Record(eventType, actor, data)
+	}
+	if m.cfg.Events != nil {
+		m.cfg.Events.Publish(eventType, data)
+	}
+	if m.cfg.Webhooks != nil {
+		m.cfg.Webhooks.Send(eventType, data)
+	}
+}
+
+// paymentEventData describes a payment made against req for a webhook event.
+// Its "paymentHash", derived from the payment's replay key, ties together the
+// events of one payment and names its settlement status.
+func paymentEventData(req *paymentRequirementsV2, payer string, credits int64, replayKey string) map[string]any {
+	data := map[string]any{
+		"network": req.Network,
+		"scheme":  req.Scheme,
+		"asset":   req.Asset,
+		"amount":  req.Amount,
+		"payTo":   req.PayTo,
+		"credits": credits,
+	}
+	if payer != "" {
+		data["payer"] = payer
+	}
+	if replayKey != "" {
+		data["paymentHash"] = paymentHash(replayKey)
+	}
+	if req.Extra.Coupon != "" {
+		data["coupon"] = req.Extra.Coupon
+	}
+	return data
+}
+
+// payloadPayer returns the address that signed a payment payload, if it can
+// be told.
+func payloadPayer(payloadBytes []byte) string {
+	p, err := parseLocalPayload(payloadBytes)
+	if err != nil {
+		return ""
+	}
+	if from := p.Payload.Authorization.From; from != "" {
+		return from
+	}
+	if p.Payload.Transaction != "" {
+		return solanaPayer(p.Payload.Transaction)
+	}
+	return p.Payload.Permit2Authorization.From
+}
@@ -0,0 +1,383 @@
+package x402
+
+// WebSocket metering: a client holding a token can open a WebSocket on / and
+// make its JSON-RPC calls over it. Each call is checked and charged like an
+// HTTP request, except that eth_subscribe costs SubscriptionCost to set up,
+// refunded if the node refuses it, and eth_unsubscribe is free; subscription
+// notifications then cost a credit per NotificationsPerCredit delivered. The
+// connection is closed, with the error code as reason, once the token cannot
+// pay.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// rpcLimitExceeded is the JSON-RPC error code for calls refused by the
+// token's rate limit.
+const rpcLimitExceeded = -32005
+
+// WebSocketProxy proxies a client's WebSocket connection to the upstream
+// node, passing every message to filter before forwarding it. fromClient
+// tells the message's direction; a non-nil reply to a client message is sent
+// back to the client instead of forwarding the message, and an error closes
+// the connection with the error as reason. filter may be called
+// concurrently for the two directions.
+type WebSocketProxy interface {
+	ServeWebSocket(w http.ResponseWriter, r *http.Request, filter func(msg []byte, fromClient bool) (reply []byte, err error))
+}
+
+// isWebSocketUpgrade reports whether r asks to open a WebSocket.
+func isWebSocketUpgrade(r *http.Request) bool {
+	if r.Method != http.MethodGet || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, v := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveWebSocket opens a metered WebSocket for a client presenting a token,
+// in the Authorization header or, for browsers, which cannot set it, the
+// token query parameter. A client without a usable token is answered with a
+// 402 before the upgrade. Without a facilitator only the method policy and
+// batch size limit apply.
+func (m *Middleware) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	if m.cfg.Facilitator == nil {
+		m.cfg.WebSocket.ServeWebSocket(w, r, func(msg []byte, fromClient bool) ([]byte, error) {
+			if !fromClient {
+				return nil, nil
+			}
+			return m.limitReply(msg), nil
+		})
+		return
+	}
+
+	tokenStr, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		tokenStr = r.URL.Query().Get("token")
+	}
+	if tokenStr == "" {
+		m.send402(w, r)
+		return
+	}
+	claims, err := m.cfg.Tokens.ValidateToken(tokenStr)
+	if err != nil {
+		code := CodeTokenInvalid
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			code = CodeTokenExpired
+		}
+		m.send402WithCode(w, r, code, "")
+		return
+	}
+	if code := m.unusableCode(claims); code != "" {
+		m.send402WithCode(w, r, code, "")
+		return
+	}
+
+	slog.Info("WebSocket opened", "tid", claims.TokenID)
+	s := &wsSession{m: m, claims: claims, subscribes: make(map[string]int64)}
+	m.cfg.WebSocket.ServeWebSocket(w, r, func(msg []byte, fromClient bool) ([]byte, error) {
+		if fromClient {
+			return s.clientMessage(msg)
+		}
+		return nil, s.upstreamMessage(msg)
+	})
+	slog.Info("WebSocket closed", "tid", claims.TokenID)
+}
+
+// unusableCode returns the error code refusing a WebSocket to the holder of
+// claims, or "" if the token has credits left.
+func (m *Middleware) unusableCode(claims *Claims) ErrorCode {
+	err := m.cfg.Tokens.CheckUsable(claims)
+	var remaining int64
+	if err == nil {
+		remaining, err = m.cfg.Tokens.Remaining(claims.CounterID())
+	}
+	switch {
+	case errors.Is(err, ErrTokenRevoked):
+		return CodeTokenRevoked
+	case errors.Is(err, ErrTokenNotFound):
+		return CodeTokenNotFound
+	case err != nil:
+		slog.Error("token accounting failed", "tid", claims.TokenID, "err", err)
+		return CodeInternal
+	case remaining <= 0:
+		return CodeTokenExhausted
+	}
+	return ""
+}
+
+// limitReply returns the JSON-RPC error answering msg if it is malformed or
+// refused by the batch size limit or the method policy, and nil otherwise.
+func (m *Middleware) limitReply(msg []byte) []byte {
+	if reply := validationReply(msg); reply != nil {
+		return reply
+	}
+	if reply := m.batchSizeReply(msg); reply != nil {
+		return reply
+	}
+	return m.policyReply(msg)
+}
+
+// wsSession meters the messages of one client's WebSocket.
+type wsSession struct {
+	m             *Middleware
+	claims        *Claims
+	notifications atomic.Int64 // subscription notifications delivered
+
+	mu         sync.Mutex
+	subscribes map[string]int64 // setup cost of eth_subscribe calls awaiting their response, by request ID
+}
+
+// clientMessage checks and charges a JSON-RPC call, or batch, the client
+// sent, as serveClaims does an HTTP request. Calls refused by the policy,
+// the token's scope or its rate limit are answered with JSON-RPC errors;
+// running out of credits closes the connection.
+func (s *wsSession) clientMessage(msg []byte) ([]byte, error) {
+	m, claims := s.m, s.claims
+	if claims.ExpiresAt != nil && time.Now().After(claims.ExpiresAt.Time) {
+		return nil, wsError(CodeTokenExpired)
+	}
+	if reply := m.limitReply(msg); reply != nil {
+		return reply, nil
+	}
+	calls, batch := rpcCalls(msg)
+
+	if len(claims.Methods) > 0 {
+		for _, c := range calls {
+			if !claims.AllowsMethod(c.Method) {
+				slog.Info("method outside token scope", "tid", claims.TokenID, "method", c.Method)
+				return rpcErrorReply(calls, batch, rpcMethodNotFound, fmt.Sprintf("method %q not allowed for this token", c.Method)), nil
+			}
+		}
+		if len(calls) == 0 {
+			return rpcErrorReply(nil, false, rpcInvalidRequest, "invalid JSON-RPC request"), nil
+		}
+	}
+
+	if rl := claims.RateLimit; rl != nil && rl.RPS > 0 {
+		if ok, _ := m.limiters.allow(claims.TokenID, *rl); !ok {
+			return rpcErrorReply(calls, batch, rpcLimitExceeded, "rate limited"), nil
+		}
+	}
+
+	if m.allFree(calls) {
+		return nil, nil
+	}
+	cost := int64(1) // like an unparseable HTTP request
+	if len(calls) > 0 {
+		cost = 0
+		for _, c := range calls {
+			cost += m.wsCallCost(c.Method)
+		}
+	}
+	if cost == 0 {
+		return nil, nil
+	}
+	remaining, err := s.spend(cost)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	for _, c := range calls {
+		if c.Method == "eth_subscribe" && len(c.ID) > 0 {
+			s.subscribes[string(c.ID)] = m.wsCallCost(c.Method)
+		}
+	}
+	s.mu.Unlock()
+	method := ""
+	if len(calls) > 0 {
+		method = calls[0].Method
+	}
+	slog.Info("proxying WebSocket RPC message", "method", method, "tid", claims.TokenID, "cost", cost, "remaining", remaining)
+	return nil, nil
+}
+
+// upstreamMessage charges a credit for the first of every
+// NotificationsPerCredit subscription notifications delivered, so a client
+// pays for a batch of notifications before receiving it, and refunds the
+// setup cost of subscriptions the node refused.
+func (s *wsSession) upstreamMessage(msg []byte) error {
+	if !isNotification(msg) {
+		s.refundRefused(msg)
+		return nil
+	}
+	per := s.m.cfg.NotificationsPerCredit
+	if per <= 0 {
+		return nil
+	}
+	if (s.notifications.Add(1)-1)%per != 0 {
+		return nil
+	}
+	_, err := s.spend(1)
+	return err
+}
+
+// refundRefused refunds the setup cost of the eth_subscribe calls that msg,
+// a response or batch of responses, answers with an error.
+func (s *wsSession) refundRefused(msg []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.subscribes) == 0 {
+		return
+	}
+	type response struct {
+		ID    json.RawMessage `json:"id"`
+		Error json.RawMessage `json:"error"`
+	}
+	var resps []response
+	msg = bytes.TrimSpace(msg)
+	if len(msg) > 0 && msg[0] == '[' {
+		if json.Unmarshal(msg, &resps) != nil {
+			return
+		}
+	} else {
+		var r response
+		if json.Unmarshal(msg, &r) != nil {
+			return
+		}
+		resps = []response{r}
+	}
+	for _, r := range resps {
+		cost, ok := s.subscribes[string(r.ID)]
+		if !ok {
+			continue
+		}
+		delete(s.subscribes, string(r.ID))
+		if len(r.Error) == 0 || string(r.Error) == "null" || cost == 0 {
+			continue
+		}
+		remaining, err := s.m.cfg.Tokens.RefundRequest(s.claims, cost)
+		if err != nil {
+			slog.Error("credit refund failed", "tid", s.claims.TokenID, "err", err)
+			continue
+		}
+		slog.Info("refunded credits for refused subscription", "tid", s.claims.TokenID, "cost", cost, "remaining", remaining)
+	}
+}
+
+// spend consumes cost credits of the session's token. The error returned
+// when it cannot closes the connection.
+func (s *wsSession) spend(cost int64) (int64, error) {
+	m, claims := s.m, s.claims
+	remaining, err := m.cfg.Tokens.UseRequest(claims, cost)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrTokenExhausted):
+			slog.Info("token exhausted", "tid", claims.TokenID, "cost", cost)
+			if claims.Metered {
+				// Normally settled on the last credit; this catches a failed attempt.
+				m.settleAsync(claims.TokenID)
+			}
+			if cost > 1 {
+				return 0, wsError(CodeInsufficientCredits)
+			}
+			return 0, wsError(CodeTokenExhausted)
+		case errors.Is(err, ErrTokenRevoked):
+			slog.Warn("revoked token presented", "tid", claims.TokenID)
+			return 0, wsError(CodeTokenRevoked)
+		case errors.Is(err, ErrTokenNotFound):
+			slog.Warn("token not in store (server restarted?)", "tid", claims.TokenID)
+			return 0, wsError(CodeTokenNotFound)
+		default:
+			slog.Error("token accounting failed", "tid", claims.TokenID, "err", err)
+			return 0, wsError(CodeInternal)
+		}
+	}
+	if m.cfg.Events != nil {
+		m.cfg.Events.Publish(EventCreditsUsed, map[string]any{
+			"tid":       claims.TokenID,
+			"payer":     claims.Subject,
+			"credits":   cost,
+			"remaining": remaining,
+			"websocket": true,
+		})
+	}
+	if remaining == 0 {
+		slog.Info("token used up", "tid", claims.TokenID)
+		m.notify(EventTokenExhausted, map[string]any{"tid": claims.TokenID, "counter": claims.CounterID(), "payer": claims.Subject})
+		// A metered token is paid for once its last credit is spent.
+		if claims.Metered {
+			m.settleAsync(claims.TokenID)
+		}
+	}
+	return remaining, nil
+}
+
+// wsCallCost prices a call made over a WebSocket: eth_subscribe costs
+// SubscriptionCost when it is set, eth_unsubscribe nothing, and every other
+// method what it costs over HTTP.
+func (m *Middleware) wsCallCost(method string) int64 {
+	switch {
+	case method == "eth_unsubscribe":
+		return 0
+	case method == "eth_subscribe" && m.cfg.SubscriptionCost > 0:
+		return m.cfg.SubscriptionCost
+	}
+	return m.requestCost([]rpcCall{{Method: method}})
+}
+
+// allFree reports whether calls is non-empty and calls free methods only.
+func (m *Middleware) allFree(calls []rpcCall) bool {
+	for _, c := range calls {
+		if !m.freeMethods[c.Method] {
+			return false
+		}
+	}
+	return len(calls) > 0
+}
+
+// wsError is the error closing a WebSocket for code, which the client
+// receives as the close reason.
+func wsError(code ErrorCode) error {
+	return errors.New(string(code))
+}
+
+// isNotification reports whether msg is a subscription notification.
+func isNotification(msg []byte) bool {
+	if !bytes.Contains(msg, []byte(`"eth_subscription"`)) {
+		return false
+	}
+	var n struct {
+		Method string `json:"method"`
+	}
+	return json.Unmarshal(msg, &n) == nil && n.Method == "eth_subscription"
+}
+
+// rpcErrorReply returns a JSON-RPC error with code and message answering
+// each of calls, as a batch if batch is set, or a single one if there are no
+// calls to answer.
+func rpcErrorReply(calls []rpcCall, batch bool, code int, message string) []byte {
+	if len(calls) == 0 {
+		calls, batch = []rpcCall{{}}, false
+	}
+	resps := make([]rpcError, len(calls))
+	for i, c := range calls {
+		resps[i] = rpcError{JSONRPC: "2.0", ID: c.ID, Error: rpcErrorBody{Code: code, Message: message}}
+		if resps[i].ID == nil {
+			resps[i].ID = json.RawMessage("null")
+		}
+	}
+	if batch {
+		reply, _ := json.Marshal(resps)
+		return reply
+	}
+	reply, _ := json.Marshal(resps[0])
+	return reply
+}